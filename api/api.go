@@ -0,0 +1,404 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/manager"
+	"github.com/contribsys/faktory/server"
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/util"
+)
+
+/*
+ * The API subsystem serves a small JSON API over HTTP for producers
+ * which can't easily hold a Faktory connection, e.g. serverless
+ * functions.  It is disabled unless the config gives it a binding:
+ *
+ *	[api]
+ *	binding = "localhost:7421"
+ *	password = "s3cret"
+ *
+ * The password defaults to the server's and is sent as a bearer
+ * token or the basic auth password.  The API won't start without
+ * one unless the config sets insecure = true, e.g. behind a proxy
+ * which authenticates requests itself.
+ *
+ *	POST   /api/push                  push the job in the body
+ *	GET    /api/info                  the same data as INFO
+ *	GET    /api/<set>?offset=0&count=25  page through retries or dead
+ *	DELETE /api/<set>/<key>           delete the job at key
+ *	POST   /api/<set>/<key>/retry     enqueue the job at key now
+ *	GET    /api/results/<jid>         the result the job stored on ACK
+ */
+type Lifecycle struct {
+	API    *API
+	closer func()
+}
+
+func Subsystem() *Lifecycle {
+	return &Lifecycle{}
+}
+
+type API struct {
+	Options Options
+	Server  *server.Server
+	Mux     *http.ServeMux
+}
+
+type Options struct {
+	Binding  string
+	Password string
+	// Serve the API without a password.
+	Insecure bool
+}
+
+// The most jobs one GET of a set returns.
+const maxPageSize = 1000
+
+func (l *Lifecycle) opts(s *server.Server) Options {
+	pwd := s.CurrentOptions().String("api", "password", "")
+	if pwd == "" {
+		pwd = s.CurrentOptions().Password
+	}
+	insecure, _ := s.CurrentOptions().Config("api", "insecure", false).(bool)
+	return Options{
+		Binding:  s.CurrentOptions().String("api", "binding", ""),
+		Password: pwd,
+		Insecure: insecure,
+	}
+}
+
+func (l *Lifecycle) Name() string {
+	return "api"
+}
+
+func (l *Lifecycle) Start(s *server.Server) error {
+	l.API = newAPI(s, l.opts(s))
+	return l.run()
+}
+
+func (l *Lifecycle) Reload(s *server.Server) error {
+	opts := l.opts(s)
+	if opts == l.API.Options {
+		return nil
+	}
+	util.Infof("Reloading HTTP API")
+	l.stop()
+	l.API.Options = opts
+	return l.run()
+}
+
+func (l *Lifecycle) Stop(s *server.Server) error {
+	l.stop()
+	l.API = nil
+	return nil
+}
+
+func (l *Lifecycle) run() error {
+	if l.API.Options.Binding == "" {
+		return nil
+	}
+	if l.API.Options.Password == "" && !l.API.Options.Insecure {
+		return fmt.Errorf("The HTTP API needs a password, set one or insecure = true in [api]")
+	}
+	closer, err := l.API.Run()
+	if err != nil {
+		return err
+	}
+	l.closer = closer
+	return nil
+}
+
+func (l *Lifecycle) stop() {
+	if l.closer != nil {
+		util.Debug("Stopping HTTP API")
+		l.closer()
+		l.closer = nil
+	}
+}
+
+func newAPI(s *server.Server, opts Options) *API {
+	api := &API{
+		Options: opts,
+		Server:  s,
+		Mux:     http.NewServeMux(),
+	}
+	api.Mux.HandleFunc("/api/push", api.auth(api.push))
+	api.Mux.HandleFunc("/api/info", api.auth(api.info))
+	api.Mux.HandleFunc("/api/retries", api.auth(api.sortedSet("retries")))
+	api.Mux.HandleFunc("/api/retries/", api.auth(api.sortedSet("retries")))
+	api.Mux.HandleFunc("/api/dead", api.auth(api.sortedSet("dead")))
+	api.Mux.HandleFunc("/api/dead/", api.auth(api.sortedSet("dead")))
+	api.Mux.HandleFunc("/api/results/", api.auth(api.result))
+	return api
+}
+
+func (api *API) Run() (func(), error) {
+	s := &http.Server{
+		Addr:           api.Options.Binding,
+		ReadTimeout:    5 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 16,
+		Handler:        api.Mux,
+	}
+
+	listener, err := net.Listen("tcp", api.Options.Binding)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		err := s.Serve(listener)
+		if err != http.ErrServerClosed {
+			util.Error(fmt.Sprintf("%s server crashed", api.Options.Binding), err)
+		}
+	}()
+	util.Infof("HTTP API now listening at %s", api.Options.Binding)
+	return func() { s.Shutdown(context.Background()) }, nil
+}
+
+func (api *API) auth(pass http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if api.Options.Password != "" {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if _, password, ok := r.BasicAuth(); ok {
+				given = password
+			}
+			if subtle.ConstantTimeCompare([]byte(given), []byte(api.Options.Password)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="Faktory"`)
+				writeError(w, http.StatusUnauthorized, fmt.Errorf("Authorization required"))
+				return
+			}
+		}
+		pass(w, r)
+	}
+}
+
+// Record a change made through the API in the audit log.
+func (api *API) audit(r *http.Request, action string, fields map[string]interface{}) {
+	fields["addr"] = r.RemoteAddr
+	fields["via"] = "api"
+	api.Server.Audit(action, fields)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	data, _ := json.Marshal(map[string]string{"error": err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func (api *API) push(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("POST a job to push it"))
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 16*1024*1024))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid job: %v", err))
+		return
+	}
+	var job client.Job
+	err = json.Unmarshal(data, &job)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid job: %v", err))
+		return
+	}
+	if job.Jid == "" {
+		job.Jid = util.RandomJid()
+	}
+
+	err = api.Server.Push(&job, len(data))
+	switch err.(type) {
+	case *manager.QueueFullError:
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	case *manager.NotUniqueError:
+		if !api.Server.CurrentOptions().DropDuplicates {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		err = nil
+	}
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"jid": job.Jid})
+}
+
+func (api *API) info(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("GET only"))
+		return
+	}
+	data, err := api.Server.CurrentState()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// GET /api/results/<jid>
+func (api *API) result(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("GET only"))
+		return
+	}
+	jid, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/api/results/"))
+	if err != nil || jid == "" || strings.Contains(jid, "/") {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Unknown path %s", r.URL.Path))
+		return
+	}
+	res, err := api.Server.Manager().GetResult(jid)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if res == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("No result for %s", jid))
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+type setEntry struct {
+	Key string      `json:"key"`
+	Job *client.Job `json:"job"`
+}
+
+// GET /api/<set>, DELETE /api/<set>/<key> or POST /api/<set>/<key>/retry
+func (api *API) sortedSet(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		set := api.Server.Store().Retries()
+		if name == "dead" {
+			set = api.Server.Store().Dead()
+		}
+
+		rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.EscapedPath(), "/api/"+name), "/")
+		if rest == "" {
+			if r.Method != "GET" {
+				writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("GET only"))
+				return
+			}
+			api.page(w, r, set)
+			return
+		}
+
+		action := ""
+		if strings.HasSuffix(rest, "/retry") {
+			action = "retry"
+			rest = strings.TrimSuffix(rest, "/retry")
+		}
+		key, err := url.PathUnescape(rest)
+		if err != nil || strings.Contains(rest, "/") {
+			writeError(w, http.StatusNotFound, fmt.Errorf("Unknown path %s", r.URL.Path))
+			return
+		}
+
+		switch {
+		case action == "" && r.Method == "DELETE":
+			ok, err := set.Remove([]byte(key))
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if !ok {
+				writeError(w, http.StatusNotFound, fmt.Errorf("No job at %s", key))
+				return
+			}
+			api.audit(r, "jobs delete", map[string]interface{}{"set": set.Name(), "keys": []string{key}})
+			writeJSON(w, http.StatusOK, map[string]string{"key": key})
+		case action == "retry" && r.Method == "POST":
+			entry, err := set.Get([]byte(key))
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if entry == nil {
+				writeError(w, http.StatusNotFound, fmt.Errorf("No job at %s", key))
+				return
+			}
+			err = api.Server.Store().EnqueueFrom(set, []byte(key))
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			api.audit(r, "jobs retry", map[string]interface{}{"set": set.Name(), "keys": []string{key}})
+			writeJSON(w, http.StatusOK, map[string]string{"key": key})
+		default:
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed on %s", r.Method, r.URL.Path))
+		}
+	}
+}
+
+func (api *API) page(w http.ResponseWriter, r *http.Request, set storage.SortedSet) {
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid offset"))
+		return
+	}
+	count, err := queryInt(r, "count", 25)
+	if err != nil || count < 1 || count > maxPageSize {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid count, must be 1-%d", maxPageSize))
+		return
+	}
+
+	entries := []setEntry{}
+	_, err = set.Page(offset, count, func(_ int, entry storage.SortedEntry) error {
+		// Page is inclusive and returns one more than asked for
+		if len(entries) == count {
+			return nil
+		}
+		key, err := entry.Key()
+		if err != nil {
+			return err
+		}
+		job, err := entry.Job()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, setEntry{Key: string(key), Job: server.DecodedJob(job)})
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"size": set.Size(),
+		"jobs": entries,
+	})
+}
+
+func queryInt(r *http.Request, name string, defval int) (int, error) {
+	val := r.URL.Query().Get(name)
+	if val == "" {
+		return defval, nil
+	}
+	return strconv.Atoi(val)
+}
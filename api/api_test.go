@@ -0,0 +1,261 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/manager"
+	"github.com/contribsys/faktory/server"
+	"github.com/contribsys/faktory/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuth(t *testing.T) {
+	api := &API{Options: Options{Password: "s3cret"}}
+	handler := api.auth(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	for _, tc := range []struct {
+		header string
+		code   int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer s3cret", http.StatusNoContent},
+		{"Basic OnMzY3JldA==", http.StatusNoContent},
+	} {
+		req := httptest.NewRequest("GET", "/api/info", nil)
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		assert.Equal(t, tc.code, w.Code, tc.header)
+	}
+
+	api.Options.Password = ""
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/api/info", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestAPI(t *testing.T) {
+	dir := "/tmp/faktory-test-api"
+	defer os.RemoveAll(dir)
+	sock := fmt.Sprintf("%s/redis.sock", dir)
+	stopper, err := storage.BootRedis(dir, sock)
+	if err != nil {
+		panic(err)
+	}
+	defer stopper()
+
+	s, err := server.NewServer(&server.ServerOptions{
+		Binding:          "localhost:7442",
+		StorageDirectory: dir,
+		RedisSock:        sock,
+		MinCompressBytes: 1,
+	})
+	assert.NoError(t, err)
+	err = s.Boot()
+	assert.NoError(t, err)
+	defer s.Stop(nil)
+	s.Store().Flush()
+
+	api := newAPI(s, Options{})
+	call := func(method string, path string, body string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		api.Mux.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		var result map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &result)
+		return w.Code, result
+	}
+
+	code, result := call("POST", "/api/push", `{"jobtype":"Thing","args":[1],"queue":"api"}`)
+	assert.Equal(t, 200, code)
+	assert.NotEmpty(t, result["jid"])
+	q, err := s.Store().GetQueue("api")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, q.Size())
+	// encoded as PUSH does
+	pushed, err := q.Peek(1)
+	assert.NoError(t, err)
+	assert.Contains(t, string(pushed[0]), `"args_encoding":"gzip"`)
+
+	code, result = call("POST", "/api/push", `{"args":[1]}`)
+	assert.Equal(t, 422, code)
+	assert.Contains(t, result["error"], "jobtype")
+	code, _ = call("GET", "/api/push", "")
+	assert.Equal(t, 405, code)
+
+	code, result = call("GET", "/api/info", "")
+	assert.Equal(t, 200, code)
+	assert.NotNil(t, result["faktory"])
+
+	job := client.NewJob("Failed", 1)
+	job.Failure = &client.Failure{RetryCount: 1, FailedAt: "2018-01-01T00:00:00Z"}
+	job.At = "2030-01-01T00:00:00Z"
+	err = s.Store().Retries().Add(job)
+	assert.NoError(t, err)
+
+	code, result = call("GET", "/api/retries?count=10", "")
+	assert.Equal(t, 200, code)
+	assert.EqualValues(t, 1, result["size"])
+	jobs := result["jobs"].([]interface{})
+	assert.Len(t, jobs, 1)
+	key := jobs[0].(map[string]interface{})["key"].(string)
+
+	code, _ = call("GET", "/api/retries?count=5000", "")
+	assert.Equal(t, 400, code)
+
+	code, _ = call("POST", "/api/retries/"+url.PathEscape(key)+"/retry", "")
+	assert.Equal(t, 200, code)
+	assert.EqualValues(t, 0, s.Store().Retries().Size())
+	code, _ = call("DELETE", "/api/retries/"+url.PathEscape(key), "")
+	assert.Equal(t, 404, code)
+
+	err = s.Store().Dead().Add(job)
+	assert.NoError(t, err)
+	code, result = call("GET", "/api/dead", "")
+	assert.Equal(t, 200, code)
+	key = result["jobs"].([]interface{})[0].(map[string]interface{})["key"].(string)
+	code, _ = call("DELETE", "/api/dead/"+url.PathEscape(key), "")
+	assert.Equal(t, 200, code)
+	assert.EqualValues(t, 0, s.Store().Dead().Size())
+
+	code, _ = call("GET", "/api/results/nosuchjob", "")
+	assert.Equal(t, 404, code)
+	err = s.Manager().SetResult("finished", []byte(`{"rows":12}`))
+	assert.NoError(t, err)
+	code, result = call("GET", "/api/results/finished", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "finished", result["jid"])
+	assert.EqualValues(t, 12, result["result"].(map[string]interface{})["rows"])
+}
+
+func TestRun(t *testing.T) {
+	l := &Lifecycle{API: &API{Options: Options{Binding: "localhost:7464"}, Mux: http.NewServeMux()}}
+	err := l.run()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "needs a password")
+
+	l.API.Options.Insecure = true
+	err = l.run()
+	assert.NoError(t, err)
+	defer l.stop()
+
+	// the binding is taken
+	other := &API{Options: Options{Binding: "localhost:7464", Password: "s3cret"}, Mux: http.NewServeMux()}
+	_, err = other.Run()
+	assert.Error(t, err)
+}
+
+func TestDecodedArgs(t *testing.T) {
+	dir := "/tmp/faktory-test-api-decoded"
+	defer os.RemoveAll(dir)
+	sock := fmt.Sprintf("%s/redis.sock", dir)
+	stopper, err := storage.BootRedis(dir, sock)
+	if err != nil {
+		panic(err)
+	}
+	defer stopper()
+
+	posted := make(chan []byte, 10)
+	ws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		posted <- data
+	}))
+	defer ws.Close()
+
+	key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+	s, err := server.NewServer(&server.ServerOptions{
+		Binding:          "localhost:7466",
+		StorageDirectory: dir,
+		RedisSock:        sock,
+		GlobalConfig: map[string]interface{}{
+			"encryption": map[string]interface{}{
+				"key_id": "k1",
+				"keys":   map[string]interface{}{"k1": key},
+			},
+			"webhooks": map[string]interface{}{
+				"url":    ws.URL,
+				"events": []interface{}{"job.dead"},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	err = s.Boot()
+	assert.NoError(t, err)
+	defer s.Stop(nil)
+	s.Store().Flush()
+
+	conn, err := net.DialTimeout("tcp", "localhost:7466", time.Second)
+	assert.NoError(t, err)
+	defer conn.Close()
+	buf := bufio.NewReader(conn)
+	readLine := func() string {
+		line, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		return line
+	}
+	readLine()
+	conn.Write([]byte("HELLO {\"v\":2}\r\n"))
+	assert.Equal(t, "+OK\r\n", readLine())
+	conn.Write([]byte("SUBSCRIBE job.dead\r\n"))
+	assert.Equal(t, "+OK\r\n", readLine())
+
+	api := newAPI(s, Options{})
+	w := httptest.NewRecorder()
+	api.Mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/push", bytes.NewBufferString(`{"jobtype":"Invoice","args":["4111111111111111"],"queue":"api"}`)))
+	assert.Equal(t, 200, w.Code)
+
+	job, err := s.Manager().Fetch(context.Background(), "wid", "api")
+	assert.NoError(t, err)
+	assert.Equal(t, "aes256gcm", job.ArgsEncoding)
+	assert.NoError(t, s.Manager().Kill(&manager.FailPayload{Jid: job.Jid, ErrorType: "Oops"}))
+
+	// the event, the webhook and the API all see the original args
+	readLine()
+	var event struct {
+		Data client.Job `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(readLine()), &event))
+	assert.Equal(t, []interface{}{"4111111111111111"}, event.Data.Args)
+	assert.Equal(t, "", event.Data.ArgsEncoding)
+
+	select {
+	case data := <-posted:
+		assert.NoError(t, json.Unmarshal(data, &event))
+		assert.Equal(t, []interface{}{"4111111111111111"}, event.Data.Args)
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not sent")
+	}
+
+	w = httptest.NewRecorder()
+	api.Mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/dead", nil))
+	assert.Equal(t, 200, w.Code)
+	var page struct {
+		Jobs []struct {
+			Job client.Job `json:"job"`
+		} `json:"jobs"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Len(t, page.Jobs, 1)
+	assert.Equal(t, []interface{}{"4111111111111111"}, page.Jobs[0].Job.Args)
+	assert.NotContains(t, w.Body.String(), "aes256gcm")
+}
@@ -14,6 +14,7 @@ import (
 
 	"github.com/BurntSushi/toml"
 	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/config"
 	"github.com/contribsys/faktory/server"
 	"github.com/contribsys/faktory/storage"
 	"github.com/contribsys/faktory/util"
@@ -26,20 +27,24 @@ type CliOptions struct {
 	ConfigDirectory  string
 	LogLevel         string
 	StorageDirectory string
+	ConfigFile       string
+	LogFormat        string
 }
 
 func ParseArguments() CliOptions {
-	defaults := CliOptions{"localhost:7419", "localhost:7420", "development", "/etc/faktory", "info", "/var/lib/faktory/db"}
+	defaults := CliOptions{"localhost:7419", "localhost:7420", "development", "/etc/faktory", "info", "/var/lib/faktory/db", "", "text"}
 
 	flag.Usage = help
 	flag.StringVar(&defaults.WebBinding, "w", "localhost:7420", "WebUI binding")
 	flag.StringVar(&defaults.CmdBinding, "b", "localhost:7419", "Network binding")
 	flag.StringVar(&defaults.LogLevel, "l", "info", "Logging level (error, warn, info, debug)")
+	flag.StringVar(&defaults.LogFormat, "log-format", "text", "Logging format (text, json)")
 	flag.StringVar(&defaults.Environment, "e", "development", "Environment (development, production)")
 
 	// undocumented on purpose, we don't want people changing these if possible
 	flag.StringVar(&defaults.StorageDirectory, "d", "/var/lib/faktory/db", "Storage directory")
 	flag.StringVar(&defaults.ConfigDirectory, "c", "/etc/faktory", "Config directory")
+	flag.StringVar(&defaults.ConfigFile, "config", "", "TOML config file")
 	versionPtr := flag.Bool("v", false, "Show version")
 	flag.Parse()
 
@@ -73,7 +78,9 @@ func help() {
 	log.Println("-b [binding]\tNetwork binding (use :7419 to listen on all interfaces), default: localhost:7419")
 	log.Println("-w [binding]\tWeb UI binding (use :7420 to listen on all interfaces), default: localhost:7420")
 	log.Println("-e [env]\tSet environment (development, production), default: development")
+	log.Println("--config [file]\tRead server options from the given TOML file")
 	log.Println("-l [level]\tSet logging level (warn, info, debug, verbose), default: info")
+	log.Println("--log-format [format]\tLog as text or a JSON object per line (text, json), default: text")
 	log.Println("-v\t\tShow version and license information")
 	log.Println("-h\t\tThis help screen")
 }
@@ -106,14 +113,19 @@ func HandleSignals(s *server.Server) {
 func reload(s *server.Server) {
 	util.Debugf("%s reloading", client.Name)
 
-	globalConfig, err := readConfig(s.Options.ConfigDirectory, s.Options.Environment)
+	var sopts *server.ServerOptions
+	var err error
+	if s.Options.ConfigFile != "" {
+		sopts, err = fileOptions(bootOptions)
+	} else {
+		sopts, err = dirOptions(bootOptions)
+	}
 	if err != nil {
 		util.Warnf("Unable to reload config: %v", err)
 		return
 	}
 
-	s.Options.GlobalConfig = globalConfig
-	s.Reload()
+	s.ReloadOptions(sopts)
 }
 
 func exit(s *server.Server) {
@@ -122,50 +134,186 @@ func exit(s *server.Server) {
 	close(s.Stopper())
 }
 
+// The arguments the server was started with, so a reload
+// resolves the config the same way.
+var bootOptions CliOptions
+
 func BuildServer(opts CliOptions) (*server.Server, func(), error) {
-	globalConfig, err := readConfig(opts.ConfigDirectory, opts.Environment)
+	bootOptions = opts
+
+	var sopts *server.ServerOptions
+	var err error
+	if opts.ConfigFile != "" {
+		sopts, err = fileOptions(opts)
+	} else {
+		sopts, err = dirOptions(opts)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
 
-	pwd, err := fetchPassword(globalConfig, opts.Environment)
-	if err != nil {
-		return nil, nil, err
+	stopper := func() {}
+	if sopts.StorageDriver != "" && sopts.StorageDriver != "redis" {
+		util.Infof("Using %s storage at %s", sopts.StorageDriver, storage.RedactURL(sopts.StoragePath()))
+	} else if len(sopts.RedisCluster) > 0 {
+		util.Infof("Using Redis Cluster at %s", strings.Join(sopts.RedisCluster, ", "))
+	} else if sopts.RedisURL == "" {
+		stopper, err = storage.BootRedis(sopts.StorageDirectory, sopts.RedisSock)
+		if err != nil {
+			return nil, stopper, err
+		}
+	} else {
+		util.Infof("Using Redis at %s", storage.RedactURL(sopts.RedisURL))
 	}
 
-	sock := fmt.Sprintf("%s/redis.sock", opts.StorageDirectory)
-	stopper, err := storage.BootRedis(opts.StorageDirectory, sock)
+	// don't log config hash until the password has been scrubbed
+	util.Debug("Merged configuration")
+	util.Debugf("%v", loggableConfig(sopts.GlobalConfig))
+
+	s, err := server.NewServer(sopts)
 	if err != nil {
 		return nil, stopper, err
 	}
 
-	// allow binding config element if no CLI arg spec'd:
-	// [faktory]
-	//   binding = "0.0.0.0:7419"
-	if opts.CmdBinding == "localhost:7419" {
-		opts.CmdBinding = stringConfig(globalConfig, "faktory", "binding", "localhost:7419")
+	return s, stopper, nil
+}
+
+// The subsystems still need their secrets so they're scrubbed from
+// a copy.  Any value under a secret-named key is masked, whole tables
+// included, e.g. [encryption.keys], as are the passwords in URLs.
+func loggableConfig(cfg map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(cfg))
+	for key, val := range cfg {
+		switch {
+		case secretKey(key):
+			copied[key] = "********"
+		case strings.HasSuffix(strings.ToLower(key), "url"):
+			if str, ok := val.(string); ok {
+				copied[key] = storage.RedactURL(str)
+			} else {
+				copied[key] = val
+			}
+		default:
+			if table, ok := val.(map[string]interface{}); ok {
+				copied[key] = loggableConfig(table)
+			} else {
+				copied[key] = val
+			}
+		}
 	}
+	return copied
+}
 
-	sopts := &server.ServerOptions{
-		Binding:          opts.CmdBinding,
-		StorageDirectory: opts.StorageDirectory,
-		ConfigDirectory:  opts.ConfigDirectory,
-		Environment:      opts.Environment,
-		RedisSock:        sock,
-		GlobalConfig:     globalConfig,
-		Password:         pwd,
+// Does the config key name a secret, e.g. password, secret_key or
+// token?  key_id and the like don't.
+func secretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, word := range []string{"password", "secret", "token"} {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	for _, word := range []string{"key", "keys"} {
+		if key == word || strings.HasSuffix(key, "_"+word) {
+			return true
+		}
 	}
+	return false
+}
 
-	// don't log config hash until fetchPassword has had a chance to scrub the password value
-	util.Debug("Merged configuration")
-	util.Debugf("%v", globalConfig)
+// Build the server options from the conf.d/*.toml files within the
+// config directory.  The merged [faktory] table is read as --config's
+// is, see config.ParseOptions.
+func dirOptions(opts CliOptions) (*server.ServerOptions, error) {
+	globalConfig, err := readConfig(opts.ConfigDirectory, opts.Environment)
+	if err != nil {
+		return nil, err
+	}
 
-	s, err := server.NewServer(sopts)
+	// read before ParseOptions scrubs it, the server reads
+	// password_file and password_command itself
+	pwd := ""
+	external := stringConfig(globalConfig, "faktory", "password_file", "") != "" ||
+		stringConfig(globalConfig, "faktory", "password_command", "") != ""
+	if !external {
+		pwd, err = fetchPassword(globalConfig, opts.Environment)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sopts, err := config.ParseOptions(globalConfig, opts.ConfigDirectory+"/conf.d")
 	if err != nil {
-		return nil, stopper, err
+		return nil, err
 	}
+	if !external {
+		sopts.Password = pwd
+	}
+	return sopts, cliOptions(sopts, opts)
+}
 
-	return s, stopper, nil
+// Build the server options from the single TOML file given with
+// --config.
+func fileOptions(opts CliOptions) (*server.ServerOptions, error) {
+	sopts, err := config.LoadTOML(opts.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	sopts.ConfigFile = opts.ConfigFile
+	err = cliOptions(sopts, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// the server reads password_file and password_command itself
+	if sopts.PasswordFile == "" && sopts.PasswordCommand == "" {
+		sopts.Password, err = resolvePassword(sopts.Password, sopts.Environment)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sopts, nil
+}
+
+// Fill in the options which aren't configured from the CLI.  Values
+// in the config win over CLI defaults but not over explicit CLI
+// arguments.
+func cliOptions(sopts *server.ServerOptions, opts CliOptions) error {
+	if sopts.Binding == "" || opts.CmdBinding != "localhost:7419" {
+		sopts.Binding = opts.CmdBinding
+	}
+	if sopts.Environment == "" {
+		sopts.Environment = opts.Environment
+	}
+	if sopts.StorageDirectory == "" {
+		sopts.StorageDirectory = opts.StorageDirectory
+	}
+	if sopts.ConfigDirectory == "" {
+		sopts.ConfigDirectory = opts.ConfigDirectory
+	}
+	if sopts.RedisSock == "" {
+		sopts.RedisSock = fmt.Sprintf("%s/redis.sock", sopts.StorageDirectory)
+	}
+	sopts.RedisURL = redisURL(sopts.RedisURL)
+
+	var err error
+	for idx, password := range sopts.Passwords {
+		sopts.Passwords[idx], err = resolvePassword(password, "")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fall back to REDIS_URL, as set by hosts such as Heroku, if
+// redis_url isn't configured.
+func redisURL(configured string) string {
+	if configured != "" {
+		return configured
+	}
+	val, _ := os.LookupEnv("REDIS_URL")
+	return val
 }
 
 func stringConfig(cfg map[string]interface{}, subsys string, elm string, defval string) string {
@@ -245,6 +393,12 @@ func fetchPassword(cfg map[string]interface{}, env string) (string, error) {
 		}
 	}
 
+	return resolvePassword(password, env)
+}
+
+// Dereference a password which points to a file and
+// ensure production has a password.
+func resolvePassword(password string, env string) (string, error) {
 	if env == "production" && !skip() && password == "" {
 		ok, _ := util.FileExists("/etc/faktory/password")
 		if ok {
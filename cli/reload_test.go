@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/contribsys/faktory/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadOnHup(t *testing.T) {
+	file, err := ioutil.TempFile("", "faktory-reload")
+	assert.NoError(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	write := func(content string) {
+		err := ioutil.WriteFile(file.Name(), []byte(content), 0644)
+		assert.NoError(t, err)
+	}
+	write(`
+[faktory]
+binding = "localhost:7419"
+password = "foo"
+hard_kill_timeout = "30s"
+`)
+
+	bootOptions = CliOptions{
+		CmdBinding:       "localhost:7419",
+		Environment:      "development",
+		StorageDirectory: "/tmp/faktory-reload",
+		ConfigFile:       file.Name(),
+	}
+	sopts, err := fileOptions(bootOptions)
+	assert.NoError(t, err)
+	s, err := server.NewServer(sopts)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", s.Options.Password)
+
+	go HandleSignals(s)
+	// give HandleSignals a moment to register
+	time.Sleep(100 * time.Millisecond)
+
+	write(`
+[faktory]
+binding = "0.0.0.0:7419"
+password = "bar"
+hard_kill_timeout = "10s"
+`)
+	err = syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	assert.NoError(t, err)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.CurrentOptions().Password == "foo" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	opts := s.CurrentOptions()
+	assert.Equal(t, "bar", opts.Password)
+	assert.Equal(t, 10*time.Second, opts.HardKillTimeout)
+	// can't change the binding without a restart
+	assert.Equal(t, "localhost:7419", opts.Binding)
+}
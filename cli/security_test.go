@@ -1,9 +1,11 @@
 package cli
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -79,3 +81,70 @@ func TestPasswords(t *testing.T) {
 
 	os.Unsetenv("FAKTORY_SKIP_PASSWORD")
 }
+
+func TestLoggableConfig(t *testing.T) {
+	cfg := map[string]interface{}{
+		"faktory": map[string]interface{}{"binding": "localhost:7419", "password": "s3cret"},
+		"acl": map[string]interface{}{
+			"billing": map[string]interface{}{"password": "b1ll", "push": []interface{}{"billing_*"}},
+		},
+		"encryption": map[string]interface{}{
+			"key_id": "2026-10",
+			"keys":   map[string]interface{}{"2026-10": "a2V5"},
+		},
+		"api":         map[string]interface{}{"binding": "localhost:7421", "password": "ap1"},
+		"metrics":     map[string]interface{}{"binding": "localhost:7422", "password": "m3trics"},
+		"webhooks":    map[string]interface{}{"url": "https://alerts.example.com/faktory", "secret": "h00k"},
+		"backup":      map[string]interface{}{"url": "s3://bucket/faktory", "access_key": "AKIA", "secret_key": "sh4d0w"},
+		"dead_letter": map[string]interface{}{"queue": "archive", "url": "tcp://:r3mote@archive.example.com:7419"},
+	}
+	logged := fmt.Sprintf("%v", loggableConfig(cfg))
+	for _, secret := range []string{"s3cret", "b1ll", "a2V5", "ap1", "m3trics", "h00k", "AKIA", "sh4d0w", "r3mote"} {
+		assert.NotContains(t, logged, secret)
+	}
+	for _, kept := range []string{"localhost:7419", "billing_*", "key_id:2026-10", "https://alerts.example.com/faktory", "archive"} {
+		assert.Contains(t, logged, kept)
+	}
+	// the subsystems still see their secrets
+	assert.Equal(t, "s3cret", cfg["faktory"].(map[string]interface{})["password"])
+	assert.Equal(t, "h00k", cfg["webhooks"].(map[string]interface{})["secret"])
+}
+
+func TestDirOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "faktory-confd")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, os.Mkdir(dir+"/conf.d", 0755))
+	assert.NoError(t, ioutil.WriteFile(dir+"/conf.d/faktory.toml", []byte(`
+[faktory]
+binding = "0.0.0.0:7419"
+password = "s3cret"
+tls_cert_file = "/etc/faktory/tls.crt"
+tls_key_file = "/etc/faktory/tls.key"
+max_connections = 500
+idle_timeout = "5m"
+require_nonce = true
+redis_url = "redis://:r3dis@cache:6379"
+`), 0644))
+
+	sopts, err := dirOptions(CliOptions{
+		CmdBinding:       "localhost:7419",
+		Environment:      "development",
+		ConfigDirectory:  dir,
+		StorageDirectory: "/tmp/faktory-confd",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "0.0.0.0:7419", sopts.Binding)
+	assert.Equal(t, "s3cret", sopts.Password)
+	assert.Equal(t, "/etc/faktory/tls.crt", sopts.TLSCertFile)
+	assert.Equal(t, "/etc/faktory/tls.key", sopts.TLSKeyFile)
+	assert.Equal(t, 500, sopts.MaxConnections)
+	assert.Equal(t, 5*time.Minute, sopts.IdleTimeout)
+	assert.True(t, sopts.RequireNonce)
+	assert.Equal(t, "redis://:r3dis@cache:6379", sopts.RedisURL)
+	assert.Equal(t, "/tmp/faktory-confd/redis.sock", sopts.RedisSock)
+	// scrubbed for logging
+	section := sopts.GlobalConfig["faktory"].(map[string]interface{})
+	assert.Equal(t, "********", section["password"])
+	assert.Equal(t, "********", section["redis_url"])
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+)
+
+// Backup returns a JSON snapshot of the server's queues, scheduled,
+// retry and dead jobs and counters which Restore can load into any
+// server.
+//
+// Requires a server with the "backup" feature and, if the server has
+// an admin port, a connection to it.
+func (c *Client) Backup() ([]byte, error) {
+	var data []byte
+	err := c.retry(func() error {
+		err := writeLine(c.wtr, "BACKUP", nil)
+		if err != nil {
+			return err
+		}
+
+		data, err = readResponse(c.rdr)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if isGzipped(data) {
+		return gunzip(data)
+	}
+	return data, nil
+}
+
+// Restore adds a snapshot taken by Backup to the server.  The
+// snapshot is sent gzipped as it holds every job.  It's never resent
+// since the server may have restored it before the connection
+// dropped.
+//
+// Requires a server with the "backup" feature and, if the server has
+// an admin port, a connection to it.
+func (c *Client) Restore(snapshot []byte) error {
+	return c.RestoreFrom(bytes.NewReader(snapshot))
+}
+
+// RestoreFrom is Restore with the snapshot read from r, which may
+// already be gzipped, e.g. a file shipped to a bucket.  The snapshot
+// is compressed and encoded as it's sent rather than held in memory.
+func (c *Client) RestoreFrom(r io.Reader) error {
+	in := bufio.NewReader(r)
+	head, _ := in.Peek(3)
+
+	err := c.writeRestore(in, isGzipped(head))
+	if err != nil {
+		// don't leave the server half a command
+		c.conn.Close()
+		return err
+	}
+	return ok(c.rdr)
+}
+
+func (c *Client) writeRestore(in io.Reader, zipped bool) error {
+	_, err := c.wtr.WriteString("RESTORE gzip ")
+	if err != nil {
+		return err
+	}
+	enc := base64.NewEncoder(base64.StdEncoding, c.wtr)
+	if zipped {
+		_, err = io.Copy(enc, in)
+	} else {
+		zw := gzip.NewWriter(enc)
+		_, err = io.Copy(zw, in)
+		if err == nil {
+			err = zw.Close()
+		}
+	}
+	if err == nil {
+		err = enc.Close()
+	}
+	if err == nil {
+		_, err = c.wtr.WriteString("\r\n")
+	}
+	if err == nil {
+		err = c.wtr.Flush()
+	}
+	return err
+}
@@ -0,0 +1,52 @@
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupCommands(t *testing.T) {
+	withFakeServer(t, func(req, resp chan string, addr string) {
+		err := os.Setenv("FAKTORY_PROVIDER", "MIKE_URL")
+		assert.NoError(t, err)
+		err = os.Setenv("MIKE_URL", "tcp://:foobar@"+addr)
+		assert.NoError(t, err)
+
+		resp <- "+OK\r\n"
+		cl, err := Open()
+		assert.NoError(t, err)
+		<-req
+
+		snapshot := `{"version":1,"queues":[]}`
+		resp <- "$25\r\n" + snapshot + "\r\n"
+		data, err := cl.Backup()
+		assert.NoError(t, err)
+		assert.Equal(t, "BACKUP\r\n", <-req)
+		assert.Equal(t, snapshot, string(data))
+
+		resp <- "+OK\r\n"
+		err = cl.Restore(data)
+		assert.NoError(t, err)
+		line := <-req
+		assert.True(t, strings.HasPrefix(line, "RESTORE gzip "))
+		zipped, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(line[13:], "\r\n"))
+		assert.NoError(t, err)
+		raw, err := gunzip(zipped)
+		assert.NoError(t, err)
+		assert.Equal(t, snapshot, string(raw))
+
+		// a gzipped snapshot is sent as it is
+		resp <- "+OK\r\n"
+		err = cl.RestoreFrom(bytes.NewReader(zipped))
+		assert.NoError(t, err)
+		assert.Equal(t, "RESTORE gzip "+base64.StdEncoding.EncodeToString(zipped)+"\r\n", <-req)
+
+		cl.Close()
+		<-req
+	})
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"encoding/json"
+)
+
+// Batch groups jobs so the server can push a callback job once
+// they've all run.  Create the batch with BatchNew, push jobs with
+// their Bid set and then BatchCommit it.
+type Batch struct {
+	// Assigned by the server if blank.
+	Bid         string `json:"bid,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Pushed once every job in the batch has succeeded.
+	Success *Job `json:"success,omitempty"`
+	// Pushed once every job has run, whether or not it succeeded.
+	Complete *Job `json:"complete,omitempty"`
+}
+
+// BatchStatus is a batch's progress, see Client.BatchStatus.
+type BatchStatus struct {
+	Bid         string `json:"bid"`
+	Description string `json:"description,omitempty"`
+	CreatedAt   string `json:"created_at"`
+	Committed   bool   `json:"committed"`
+	Total       int64  `json:"total"`
+	Pending     int64  `json:"pending"`
+	Failed      int64  `json:"failed"`
+	Completed   bool   `json:"completed"`
+	Succeeded   bool   `json:"succeeded"`
+}
+
+// BatchNew creates the batch and returns its bid.
+//
+// Requires a server with the "batch" feature.
+func (c *Client) BatchNew(b *Batch) (string, error) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return "", err
+	}
+
+	var bid string
+	err = c.retryUnsent("BATCH NEW", data, func() error {
+		var err error
+		bid, err = readString(c.rdr)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	b.Bid = bid
+	return bid, nil
+}
+
+// BatchOpen reopens a committed batch so more jobs can be added,
+// e.g. by one of its own jobs.
+func (c *Client) BatchOpen(bid string) error {
+	return c.batchCommand("OPEN", bid)
+}
+
+// BatchCommit tells the server every job has been pushed, its
+// callbacks fire once they've run.
+func (c *Client) BatchCommit(bid string) error {
+	return c.batchCommand("COMMIT", bid)
+}
+
+func (c *Client) batchCommand(action string, bid string) error {
+	return c.retryUnsent("BATCH "+action, []byte(bid), func() error {
+		return ok(c.rdr)
+	})
+}
+
+// BatchStatus returns the batch's progress.
+func (c *Client) BatchStatus(bid string) (*BatchStatus, error) {
+	var data []byte
+	err := c.retry(func() error {
+		err := writeLine(c.wtr, "BATCH STATUS", []byte(bid))
+		if err != nil {
+			return err
+		}
+		data, err = readResponse(c.rdr)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var status BatchStatus
+	err = json.Unmarshal(data, &status)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
@@ -0,0 +1,52 @@
+package client
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchCommands(t *testing.T) {
+	withFakeServer(t, func(req, resp chan string, addr string) {
+		err := os.Setenv("FAKTORY_PROVIDER", "MIKE_URL")
+		assert.NoError(t, err)
+		err = os.Setenv("MIKE_URL", "tcp://:foobar@"+addr)
+		assert.NoError(t, err)
+
+		resp <- "+OK\r\n"
+		cl, err := Open()
+		assert.NoError(t, err)
+		<-req
+
+		b := &Batch{Description: "Import", Success: NewJob("ImportDone", 1)}
+		resp <- "+b-1234abcd\r\n"
+		bid, err := cl.BatchNew(b)
+		assert.NoError(t, err)
+		assert.Equal(t, "b-1234abcd", bid)
+		assert.Equal(t, bid, b.Bid)
+		line := <-req
+		assert.Contains(t, line, "BATCH NEW {")
+		assert.Contains(t, line, `"ImportDone"`)
+
+		resp <- "+OK\r\n"
+		err = cl.BatchCommit(bid)
+		assert.NoError(t, err)
+		assert.Equal(t, "BATCH COMMIT b-1234abcd\r\n", <-req)
+
+		resp <- "-ERR Batch b-1234abcd has already completed\r\n"
+		err = cl.BatchOpen(bid)
+		assert.Error(t, err)
+		assert.Equal(t, "BATCH OPEN b-1234abcd\r\n", <-req)
+
+		resp <- "$42\r\n{\"bid\":\"b-1234abcd\",\"total\":3,\"pending\":1}\r\n"
+		status, err := cl.BatchStatus(bid)
+		assert.NoError(t, err)
+		assert.Equal(t, "BATCH STATUS b-1234abcd\r\n", <-req)
+		assert.EqualValues(t, 3, status.Total)
+		assert.EqualValues(t, 1, status.Pending)
+
+		cl.Close()
+		<-req
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -18,13 +19,22 @@ import (
 const (
 	// This is the protocol version supported by this client.
 	// The server might be running an older or newer version.
-	ExpectedProtocolVersion = 2
+	ExpectedProtocolVersion = 3
 )
 
 var (
 	// Set this to a non-empty value in a consumer process
 	// e.g. see how faktory_worker_go sets this.
 	RandomProcessWid = ""
+
+	// Set this to "gzip" to allow the server to compress
+	// large FETCH responses.
+	AcceptEncoding = ""
+
+	// Set this to "strict", "round_robin" or "weighted" to choose
+	// how the server picks between the queues of each FETCH
+	// rather than using the server's fetch_order.
+	FetchOrder = ""
 )
 
 // The Client structure represents a thread-unsafe connection
@@ -39,6 +49,12 @@ type Client struct {
 	rdr      *bufio.Reader
 	wtr      *bufio.Writer
 	conn     net.Conn
+
+	server      *Server
+	password    string
+	features    map[string]bool
+	retryConfig RetryConfig
+	stats       ClientStats
 }
 
 // ClientData is serialized to JSON and sent
@@ -55,12 +71,19 @@ type ClientData struct {
 	Wid      string   `json:"wid"`
 	Pid      int      `json:"pid"`
 	Labels   []string `json:"labels"`
-	// Hash is hex(sha256(password + nonce))
+	// Hash is hex(sha256(password + salt + nonce))
 	PasswordHash string `json:"pwdhash"`
+	// Echo of the nonce sent by the server in HI, proves this
+	// HELLO was created for this connection.
+	Nonce string `json:"nonce,omitempty"`
 	// The protocol version used by this client.
 	// The server can reject this connection if the version will not work
 	// The server advertises its protocol version in the HI.
 	Version int `json:"v"`
+	// "gzip" if this client can read compressed FETCH responses.
+	Encoding string `json:"encoding,omitempty"`
+	// How the server picks between the queues of each FETCH.
+	FetchOrder string `json:"fetch_order,omitempty"`
 }
 
 type Server struct {
@@ -87,37 +110,36 @@ FOO_URL=tcp://:mypassword@faktory.example.com:7419`)
 
 		uval, ok := os.LookupEnv(val)
 		if ok {
-			uri, err := url.Parse(uval)
-			if err != nil {
-				return err
-			}
-			s.Network = uri.Scheme
-			s.Address = fmt.Sprintf("%s:%s", uri.Hostname(), uri.Port())
-			if uri.User != nil {
-				s.Password, _ = uri.User.Password()
-			}
-			return nil
+			return s.setURL(uval)
 		}
 		return fmt.Errorf("FAKTORY_PROVIDER set to invalid value: %s", val)
 	}
 
 	uval, ok := os.LookupEnv("FAKTORY_URL")
 	if ok {
-		uri, err := url.Parse(uval)
-		if err != nil {
-			return err
-		}
-		s.Network = uri.Scheme
-		s.Address = fmt.Sprintf("%s:%s", uri.Hostname(), uri.Port())
-		if uri.User != nil {
-			s.Password, _ = uri.User.Password()
-		}
-		return nil
+		return s.setURL(uval)
 	}
 
 	return nil
 }
 
+func (s *Server) setURL(uval string) error {
+	uri, err := url.Parse(uval)
+	if err != nil {
+		return err
+	}
+	s.Network = uri.Scheme
+	if uri.Scheme == "unix" {
+		s.Address = uri.Path
+	} else {
+		s.Address = fmt.Sprintf("%s:%s", uri.Hostname(), uri.Port())
+	}
+	if uri.User != nil {
+		s.Password, _ = uri.User.Password()
+	}
+	return nil
+}
+
 func DefaultServer() *Server {
 	return &Server{"tcp", "localhost:7419", "", 1 * time.Second, &tls.Config{}}
 }
@@ -144,12 +166,33 @@ func Open() (*Client, error) {
 	return srv.Open()
 }
 
+// NewClientFromURL connects to the Faktory server at the given URL,
+// e.g. "tcp://:mypassword@localhost:7419".  If the connection later
+// drops, the client reconnects according to retry before giving up
+// on a command.  Errors the server reports, such as an invalid
+// password, are never retried.
+func NewClientFromURL(uval string, retry RetryConfig) (*Client, error) {
+	srv := DefaultServer()
+	err := srv.setURL(uval)
+	if err != nil {
+		return nil, err
+	}
+
+	cl, err := Dial(srv, srv.Password)
+	if err != nil {
+		return nil, err
+	}
+	cl.retryConfig = retry
+	return cl, nil
+}
+
 // Dial connects to the remote faktory server.
 //
 //   client.Dial(client.Localhost, "topsecret")
 //
 func Dial(srv *Server, password string) (*Client, error) {
 	client := emptyClientData()
+	features := map[string]bool{}
 
 	var err error
 	var conn net.Conn
@@ -193,6 +236,17 @@ func Dial(srv *Server, password string) (*Client, error) {
 			}
 		}
 
+		nonce, _ := hi["nonce"].(string)
+		client.Nonce = nonce
+
+		if list, ok := hi["features"].([]interface{}); ok {
+			for _, name := range list {
+				if str, ok := name.(string); ok {
+					features[str] = true
+				}
+			}
+		}
+
 		salt, ok := hi["s"].(string)
 		if ok {
 			iter := 1
@@ -201,7 +255,7 @@ func Dial(srv *Server, password string) (*Client, error) {
 				iter = int(iterVal.(float64))
 			}
 
-			client.PasswordHash = hash(password, salt, iter)
+			client.PasswordHash = hash(password, salt+nonce, iter)
 		}
 	} else {
 		conn.Close()
@@ -225,7 +279,14 @@ func Dial(srv *Server, password string) (*Client, error) {
 		return nil, err
 	}
 
-	return &Client{Options: client, Location: srv.Address, conn: conn, rdr: r, wtr: w}, nil
+	return &Client{Options: client, Location: srv.Address, conn: conn, rdr: r, wtr: w, server: srv, password: password, features: features}, nil
+}
+
+// HasFeature returns true if the server advertised the named command
+// group, e.g. "scan", when this client connected.  Servers older than
+// protocol v3 advertise no features.
+func (c *Client) HasFeature(name string) bool {
+	return c.features[name]
 }
 
 func (c *Client) Close() error {
@@ -233,12 +294,9 @@ func (c *Client) Close() error {
 }
 
 func (c *Client) Ack(jid string) error {
-	err := writeLine(c.wtr, "ACK", []byte(fmt.Sprintf(`{"jid":"%s"}`, jid)))
-	if err != nil {
-		return err
-	}
-
-	return ok(c.rdr)
+	return c.retryUnsent("ACK", []byte(fmt.Sprintf(`{"jid":"%s"}`, jid)), func() error {
+		return ok(c.rdr)
+	})
 }
 
 func (c *Client) Push(job *Job) error {
@@ -246,39 +304,147 @@ func (c *Client) Push(job *Job) error {
 	if err != nil {
 		return err
 	}
-	err = writeLine(c.wtr, "PUSH", jobytes)
+	return c.retryUnsent("PUSH", jobytes, func() error {
+		return ok(c.rdr)
+	})
+}
+
+// PushBulk pushes many jobs in one round trip.  The returned slice
+// has the error for each job in order, nil for those pushed.
+//
+// Requires a server with the "pushb" feature.
+func (c *Client) PushBulk(jobs []*Job) ([]error, error) {
+	jobytes, err := json.Marshal(jobs)
 	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	err = c.retryUnsent("PUSHB", jobytes, func() error {
+		var err error
+		data, err = readResponse(c.rdr)
 		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var results []struct {
+		Error string `json:"error"`
+	}
+	err = json.Unmarshal(data, &results)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) != len(jobs) {
+		return nil, fmt.Errorf("Expected %d PUSHB results, got %d", len(jobs), len(results))
 	}
-	return ok(c.rdr)
+	errs := make([]error, len(jobs))
+	for idx, result := range results {
+		if result.Error != "" {
+			errs[idx] = errors.New(result.Error)
+		}
+	}
+	return errs, nil
 }
 
 func (c *Client) Fetch(q ...string) (*Job, error) {
 	if len(q) == 0 {
 		return nil, fmt.Errorf("Fetch must be called with one or more queue names")
 	}
+	return c.fetch(strings.Join(q, " "))
+}
 
-	err := writeLine(c.wtr, "FETCH", []byte(strings.Join(q, " ")))
-	if err != nil {
-		return nil, err
+// FetchWait is like Fetch but the server waits up to wait, at most
+// 30 seconds, for a job to be pushed before returning nil.
+//
+// Requires a server with the "fetch_wait" feature.
+func (c *Client) FetchWait(wait time.Duration, q ...string) (*Job, error) {
+	if len(q) == 0 {
+		return nil, fmt.Errorf("FetchWait must be called with one or more queue names")
 	}
+	secs := int(wait / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return c.fetch(fmt.Sprintf("WAIT %d %s", secs, strings.Join(q, " ")))
+}
 
-	data, err := readResponse(c.rdr)
+func (c *Client) fetch(args string) (*Job, error) {
+	var data []byte
+	err := c.retryUnsent("FETCH", []byte(args), func() error {
+		var err error
+		data, err = readResponse(c.rdr)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	if len(data) == 0 {
 		return nil, nil
 	}
+	if isGzipped(data) {
+		data, err = gunzip(data)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	var job Job
 	err = json.Unmarshal(data, &job)
 	if err != nil {
 		return nil, err
 	}
+	err = job.DecompressArgs()
+	if err != nil {
+		return nil, err
+	}
 	return &job, nil
 }
 
+// FetchN reserves up to count jobs from the queues at once, nil if
+// there are none.
+//
+// Requires a server with the "fetchn" feature.
+func (c *Client) FetchN(count int, q ...string) ([]*Job, error) {
+	if len(q) == 0 {
+		return nil, fmt.Errorf("FetchN must be called with one or more queue names")
+	}
+
+	var data []byte
+	args := "COUNT " + strconv.Itoa(count) + " " + strings.Join(q, " ")
+	err := c.retryUnsent("FETCH", []byte(args), func() error {
+		var err error
+		data, err = readResponse(c.rdr)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if isGzipped(data) {
+		data, err = gunzip(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var jobs []*Job
+	err = json.Unmarshal(data, &jobs)
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		err = job.DecompressArgs()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return jobs, nil
+}
+
 /*
  buff := make([]byte, 4096)
  count := runtime.Stack(buff, false)
@@ -290,11 +456,27 @@ func (c *Client) Fetch(q ...string) (*Job, error) {
 // If backtrace is non-nil, it is assumed to be the output from
 // runtime/debug.Stack().
 func (c *Client) Fail(jid string, err error, backtrace []byte) error {
+	return c.fail(jid, err, backtrace, nil)
+}
+
+// FailRetryIn fails the job like Fail but asks for it to be retried
+// after delay, e.g. once an API's rate limit resets, rather than
+// after the server's usual backoff.  It still uses up a retry.
+func (c *Client) FailRetryIn(jid string, err error, backtrace []byte, delay time.Duration) error {
+	return c.fail(jid, err, backtrace, map[string]interface{}{
+		"retry_in": int(delay / time.Second),
+	})
+}
+
+func (c *Client) fail(jid string, err error, backtrace []byte, extra map[string]interface{}) error {
 	failure := map[string]interface{}{
 		"message": err.Error(),
 		"errtype": "unknown",
 		"jid":     jid,
 	}
+	for key, value := range extra {
+		failure[key] = value
+	}
 
 	if backtrace != nil {
 		str := string(backtrace)
@@ -305,29 +487,33 @@ func (c *Client) Fail(jid string, err error, backtrace []byte) error {
 	if err != nil {
 		return err
 	}
-	err = writeLine(c.wtr, "FAIL", failbytes)
-	if err != nil {
-		return err
-	}
-	return ok(c.rdr)
+	return c.retryUnsent("FAIL", failbytes, func() error {
+		return ok(c.rdr)
+	})
 }
 
 func (c *Client) Flush() error {
-	err := writeLine(c.wtr, "FLUSH", nil)
-	if err != nil {
-		return err
-	}
+	return c.retry(func() error {
+		err := writeLine(c.wtr, "FLUSH", nil)
+		if err != nil {
+			return err
+		}
 
-	return ok(c.rdr)
+		return ok(c.rdr)
+	})
 }
 
 func (c *Client) Info() (map[string]interface{}, error) {
-	err := writeLine(c.wtr, "INFO", nil)
-	if err != nil {
-		return nil, err
-	}
+	var data []byte
+	err := c.retry(func() error {
+		err := writeLine(c.wtr, "INFO", nil)
+		if err != nil {
+			return err
+		}
 
-	data, err := readResponse(c.rdr)
+		data, err = readResponse(c.rdr)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -344,13 +530,68 @@ func (c *Client) Info() (map[string]interface{}, error) {
 	return hash, nil
 }
 
-func (c *Client) Generic(cmdline string) (string, error) {
-	err := writeLine(c.wtr, cmdline, nil)
+// ScanQueue returns up to count jobs from the queue, starting at
+// cursor, without changing the queue.  Start with a cursor of 0 and
+// pass each nextCursor back in until it is 0 again.  Use "dead" to
+// scan the dead set.
+func (c *Client) ScanQueue(queue string, cursor, count int) (int, []*Job, error) {
+	var data []byte
+	err := c.retry(func() error {
+		err := writeLine(c.wtr, "SCAN", []byte(fmt.Sprintf("%s %d %d", queue, cursor, count)))
+		if err != nil {
+			return err
+		}
+
+		data, err = readResponse(c.rdr)
+		return err
+	})
 	if err != nil {
-		return "", err
+		return 0, nil, err
+	}
+	if isGzipped(data) {
+		data, err = gunzip(data)
+		if err != nil {
+			return 0, nil, err
+		}
 	}
 
-	return readString(c.rdr)
+	var page struct {
+		Cursor int    `json:"cursor"`
+		Jobs   []*Job `json:"jobs"`
+	}
+	err = json.Unmarshal(data, &page)
+	if err != nil {
+		return 0, nil, err
+	}
+	return page.Cursor, page.Jobs, nil
+}
+
+// Cancel removes a job which hasn't been fetched yet from its
+// queue, the scheduled set or the retry set.  Returns false if
+// there's no such job waiting to run.
+//
+// Requires a server with the "cancel" feature.
+func (c *Client) Cancel(jid string) (bool, error) {
+	var val string
+	err := c.retryUnsent("CANCEL", []byte(jid), func() error {
+		var err error
+		val, err = readString(c.rdr)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return val == "1", nil
+}
+
+func (c *Client) Generic(cmdline string) (string, error) {
+	var val string
+	err := c.retryUnsent(cmdline, nil, func() error {
+		var err error
+		val, err = readString(c.rdr)
+		return err
+	})
+	return val, err
 }
 
 func (c *Client) Beat() (string, error) {
@@ -374,6 +615,8 @@ func emptyClientData() *ClientData {
 	client.Wid = RandomProcessWid
 	client.Labels = []string{"golang"}
 	client.Version = ExpectedProtocolVersion
+	client.Encoding = AcceptEncoding
+	client.FetchOrder = FetchOrder
 	return client
 }
 
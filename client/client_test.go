@@ -82,6 +82,17 @@ func TestClientOperations(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Contains(t, <-req, "FAIL")
 
+		resp <- "+OK\r\n"
+		err = cl.FailRetryIn("123456", &specialError{Msg: "Rate limited"}, nil, 15*time.Minute)
+		assert.NoError(t, err)
+		assert.Contains(t, <-req, `"retry_in":900`)
+
+		resp <- ":1\r\n"
+		cancelled, err := cl.Cancel("123456")
+		assert.NoError(t, err)
+		assert.True(t, cancelled)
+		assert.Equal(t, "CANCEL 123456\r\n", <-req)
+
 		resp <- "$2\r\n{}\r\n"
 		hash, err := cl.Info()
 		assert.NoError(t, err)
@@ -149,3 +160,18 @@ func TestPasswordHashing(t *testing.T) {
 	result := hash(pwd, salt, iterations)
 	assert.Equal(t, "6d877f8e5544b1f2598768f817413ab8a357afffa924dedae99eb91472d4ec30", result)
 }
+
+func TestServerURL(t *testing.T) {
+	srv := DefaultServer()
+	err := srv.setURL("tcp://:secret@faktory.example.com:7419")
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp", srv.Network)
+	assert.Equal(t, "faktory.example.com:7419", srv.Address)
+	assert.Equal(t, "secret", srv.Password)
+
+	srv = DefaultServer()
+	err = srv.setURL("unix:///var/run/faktory.sock")
+	assert.NoError(t, err)
+	assert.Equal(t, "unix", srv.Network)
+	assert.Equal(t, "/var/run/faktory.sock", srv.Address)
+}
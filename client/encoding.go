@@ -0,0 +1,71 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// An ArgsCodec compresses job args for CompressArgsWith, e.g. with
+// zstd, and must decompress anything it compressed.
+type ArgsCodec interface {
+	Compress(raw []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	codecMu sync.RWMutex
+	codecs  = map[string]ArgsCodec{
+		"gzip": gzipCodec{},
+	}
+)
+
+// RegisterArgsEncoding makes codec available as an args encoding
+// under the given name.  Servers and workers must register the same
+// codecs to read each other's jobs.  Registering an existing name
+// replaces it.
+func RegisterArgsEncoding(name string, codec ArgsCodec) error {
+	if name == "" {
+		return fmt.Errorf("args encoding name cannot be blank")
+	}
+	if strings.Contains(name, "+") {
+		return fmt.Errorf("args encoding %s cannot contain +, it joins encodings", name)
+	}
+	if codec == nil {
+		return fmt.Errorf("args encoding %s cannot be nil", name)
+	}
+
+	codecMu.Lock()
+	defer codecMu.Unlock()
+	codecs[name] = codec
+	return nil
+}
+
+func LookupArgsEncoding(name string) (ArgsCodec, bool) {
+	codecMu.RLock()
+	defer codecMu.RUnlock()
+	codec, ok := codecs[name]
+	return codec, ok
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Compress(raw []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(raw)
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(data []byte) ([]byte, error) {
+	return gunzip(data)
+}
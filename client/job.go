@@ -1,9 +1,16 @@
 package client
 
 import (
+	"bytes"
+	"compress/gzip"
 	cryptorand "crypto/rand"
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	mathrand "math/rand"
+	"strings"
 	"time"
 )
 
@@ -33,6 +40,51 @@ type Job struct {
 	Backtrace  int                    `json:"backtrace,omitempty"`
 	Failure    *Failure               `json:"failure,omitempty"`
 	Custom     map[string]interface{} `json:"custom,omitempty"`
+
+	// The encodings, e.g. "gzip", if Args holds a single compressed
+	// or otherwise encoded string, see CompressArgsWith and
+	// EncodeArgs.
+	ArgsEncoding string `json:"args_encoding,omitempty"`
+
+	// ACKs received more than this many seconds after the job was
+	// fetched are rejected and the job is failed instead.  This
+	// can't stop the worker, it only makes sure the job is retried.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+
+	// Reject pushes of another job with the same jobtype and args
+	// for this many seconds, or until this job succeeds or, with
+	// UniqueUntil "start", is fetched.
+	UniqueFor   int    `json:"unique_for,omitempty"`
+	UniqueUntil string `json:"unique_until,omitempty"`
+	// Set by the server for jobs pushed with PUSHIF UNIQUE_TYPE, which
+	// hold their queue's lock on their jobtype until they succeed or
+	// die.
+	UniqueType bool `json:"unique_type,omitempty"`
+
+	// How long to wait between retries, e.g. "fixed:5m" or
+	// "table:1m,10m,1h", instead of the server's exponential backoff.
+	Backoff string `json:"backoff,omitempty"`
+
+	// The job is discarded rather than fetched once this time has
+	// passed, for jobs which are worthless when late.
+	ExpiresAt string `json:"expires_at,omitempty"`
+
+	// The batch this job belongs to, see Batch.
+	Bid string `json:"bid,omitempty"`
+
+	// Jobs pushed by the server once this job is acknowledged
+	// or, for ThenOnFail, once it fails for the last time.
+	Then       []*Job `json:"then,omitempty"`
+	ThenOnFail []*Job `json:"then_on_fail,omitempty"`
+	// A single job to push once this job is acknowledged, the server
+	// moves it to the end of Then.
+	OnSuccess *Job `json:"on_success,omitempty"`
+	// Set by the server, the number of jobs before this one in its chain.
+	ChainDepth int `json:"chain_depth,omitempty"`
+
+	// The server holds the job until these jobs are acknowledged
+	// and kills it if any of them dies.
+	DependsOn []string `json:"depends_on,omitempty"`
 }
 
 func NewJob(jobtype string, args ...interface{}) *Job {
@@ -73,3 +125,140 @@ func (j *Job) SetCustom(name string, value interface{}) {
 
 	j.Custom[name] = value
 }
+
+// CompressArgs replaces the job's args with a single gzipped, base64
+// encoded string.  Args are left untouched if the compressed form
+// would not be smaller.  Faktory restores the original args before
+// handing the job to a worker.
+func (j *Job) CompressArgs() error {
+	return j.CompressArgsWith("gzip")
+}
+
+// CompressArgsWith is CompressArgs with a registered encoding, see
+// RegisterArgsEncoding.
+func (j *Job) CompressArgsWith(encoding string) error {
+	if j.ArgsEncoding != "" {
+		return nil
+	}
+	codec, ok := LookupArgsEncoding(encoding)
+	if !ok {
+		return fmt.Errorf("Unknown args encoding: %s", encoding)
+	}
+
+	raw, err := json.Marshal(j.Args)
+	if err != nil {
+		return err
+	}
+	compressed, err := codec.Compress(raw)
+	if err != nil {
+		return err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(compressed)
+	if len(encoded) >= len(raw) {
+		return nil
+	}
+
+	j.Args = []interface{}{encoded}
+	j.ArgsEncoding = encoding
+	return nil
+}
+
+// EncodeArgs applies a registered encoding to the args, e.g. to
+// encrypt them, whatever their size and even if they're already
+// encoded: ArgsEncoding lists each encoding applied, in order, joined
+// with "+" such as "gzip+aes256gcm".
+func (j *Job) EncodeArgs(encoding string) error {
+	codec, ok := LookupArgsEncoding(encoding)
+	if !ok {
+		return fmt.Errorf("Unknown args encoding: %s", encoding)
+	}
+	data, err := j.encodedArgs()
+	if err != nil {
+		return err
+	}
+	encoded, err := codec.Compress(data)
+	if err != nil {
+		return err
+	}
+
+	j.Args = []interface{}{base64.StdEncoding.EncodeToString(encoded)}
+	if j.ArgsEncoding == "" {
+		j.ArgsEncoding = encoding
+	} else {
+		j.ArgsEncoding += "+" + encoding
+	}
+	return nil
+}
+
+// DecompressArgs reverses CompressArgs and EncodeArgs.
+func (j *Job) DecompressArgs() error {
+	if j.ArgsEncoding == "" {
+		return nil
+	}
+	data, err := j.encodedArgs()
+	if err != nil {
+		return err
+	}
+	encodings := strings.Split(j.ArgsEncoding, "+")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		codec, ok := LookupArgsEncoding(encodings[i])
+		if !ok {
+			return fmt.Errorf("Unknown args encoding: %s", encodings[i])
+		}
+		data, err = codec.Decompress(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	var args []interface{}
+	err = json.Unmarshal(data, &args)
+	if err != nil {
+		return err
+	}
+	j.Args = args
+	j.ArgsEncoding = ""
+	return nil
+}
+
+// The args as JSON or, if they're encoded, the encoded bytes.
+func (j *Job) encodedArgs() ([]byte, error) {
+	if j.ArgsEncoding == "" {
+		return json.Marshal(j.Args)
+	}
+	if len(j.Args) != 1 {
+		return nil, fmt.Errorf("Compressed args must be a single string")
+	}
+	str, ok := j.Args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("Compressed args must be a single string")
+	}
+	return base64.StdEncoding.DecodeString(str)
+}
+
+// MaxGunzipSize is the most gzipped data from the server, or args
+// compressed by a producer, may inflate to, so a small payload can't
+// use up the memory of whoever unzips it.
+var MaxGunzipSize int64 = 256 * 1024 * 1024
+
+func gunzip(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(zr, MaxGunzipSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > MaxGunzipSize {
+		return nil, fmt.Errorf("gzip data inflates to more than %d bytes", MaxGunzipSize)
+	}
+	return out, nil
+}
+
+// gzip data always starts with these two bytes, JSON never does.
+func isGzipped(data []byte) bool {
+	return len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b
+}
@@ -1,7 +1,9 @@
 package client
 
 import (
+	"bytes"
 	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -14,3 +16,112 @@ func TestJobPriority(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Contains(t, string(data), "priority")
 }
+
+func TestCompressArgs(t *testing.T) {
+	big := strings.Repeat("<p>Hello World</p>", 1000)
+	job := NewJob("yo", big, 123)
+	raw, err := json.Marshal(job.Args)
+	assert.NoError(t, err)
+
+	err = job.CompressArgs()
+	assert.NoError(t, err)
+	assert.Equal(t, "gzip", job.ArgsEncoding)
+	assert.Equal(t, 1, len(job.Args))
+	assert.True(t, len(job.Args[0].(string)) < len(raw))
+
+	// idempotent
+	err = job.CompressArgs()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(job.Args))
+
+	data, err := json.Marshal(job)
+	assert.NoError(t, err)
+	var fetched Job
+	err = json.Unmarshal(data, &fetched)
+	assert.NoError(t, err)
+
+	err = fetched.DecompressArgs()
+	assert.NoError(t, err)
+	assert.Equal(t, "", fetched.ArgsEncoding)
+	assert.Equal(t, []interface{}{big, float64(123)}, fetched.Args)
+
+	// tiny args don't compress well so they are left alone
+	small := NewJob("yo", 1)
+	err = small.CompressArgs()
+	assert.NoError(t, err)
+	assert.Equal(t, "", small.ArgsEncoding)
+	assert.Equal(t, []interface{}{1}, small.Args)
+
+	// args which inflate past the cap are rejected
+	oldMax := MaxGunzipSize
+	MaxGunzipSize = int64(len(raw)) - 1
+	defer func() { MaxGunzipSize = oldMax }()
+	err = fetched.CompressArgs()
+	assert.NoError(t, err)
+	assert.Error(t, fetched.DecompressArgs())
+}
+
+// keeps only the first of each run of repeated bytes and its count
+type runLength struct{}
+
+func (runLength) Compress(raw []byte) ([]byte, error) {
+	out := []byte{}
+	for i := 0; i < len(raw); {
+		j := i
+		for j < len(raw) && raw[j] == raw[i] && j-i < 255 {
+			j++
+		}
+		out = append(out, raw[i], byte(j-i))
+		i = j
+	}
+	return out, nil
+}
+
+func (runLength) Decompress(data []byte) ([]byte, error) {
+	out := []byte{}
+	for i := 0; i+1 < len(data); i += 2 {
+		out = append(out, bytes.Repeat(data[i:i+1], int(data[i+1]))...)
+	}
+	return out, nil
+}
+
+func TestArgsEncoding(t *testing.T) {
+	assert.Error(t, RegisterArgsEncoding("", runLength{}))
+	assert.Error(t, RegisterArgsEncoding("rle", nil))
+	assert.Error(t, RegisterArgsEncoding("gzip+rle", runLength{}))
+	assert.NoError(t, RegisterArgsEncoding("rle", runLength{}))
+
+	big := strings.Repeat("x", 1000)
+	job := NewJob("yo", big)
+	assert.NoError(t, job.CompressArgsWith("rle"))
+	assert.Equal(t, "rle", job.ArgsEncoding)
+	assert.NoError(t, job.DecompressArgs())
+	assert.Equal(t, []interface{}{big}, job.Args)
+
+	assert.Error(t, job.CompressArgsWith("zstd"))
+	job.Args = []interface{}{"eA=="}
+	job.ArgsEncoding = "zstd"
+	assert.Error(t, job.DecompressArgs())
+}
+
+func TestEncodeArgs(t *testing.T) {
+	assert.NoError(t, RegisterArgsEncoding("rle", runLength{}))
+
+	big := strings.Repeat("x", 1000)
+	job := NewJob("yo", big, 3)
+	assert.NoError(t, job.CompressArgs())
+	assert.NoError(t, job.EncodeArgs("rle"))
+	assert.Equal(t, "gzip+rle", job.ArgsEncoding)
+	assert.NoError(t, job.DecompressArgs())
+	assert.Equal(t, "", job.ArgsEncoding)
+	assert.Equal(t, []interface{}{big, float64(3)}, job.Args)
+
+	// small args are encoded too
+	job = NewJob("yo", 1)
+	assert.NoError(t, job.EncodeArgs("rle"))
+	assert.Equal(t, "rle", job.ArgsEncoding)
+	assert.NoError(t, job.DecompressArgs())
+	assert.Equal(t, []interface{}{float64(1)}, job.Args)
+
+	assert.Error(t, job.EncodeArgs("zstd"))
+}
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"encoding/json"
+)
+
+// JobResult is what a worker passed to AckResult, see Client.Result.
+type JobResult struct {
+	Jid         string          `json:"jid"`
+	Result      json.RawMessage `json:"result"`
+	CompletedAt string          `json:"completed_at"`
+}
+
+// AckResult acknowledges the job like Ack and stores result, which
+// must marshal to at most 64KB of JSON, for producers to read back
+// with Result.
+//
+// Requires a server with the "results" feature.
+func (c *Client) AckResult(jid string, result interface{}) error {
+	data, err := json.Marshal(map[string]interface{}{"jid": jid, "result": result})
+	if err != nil {
+		return err
+	}
+	return c.retryUnsent("ACK", data, func() error {
+		return ok(c.rdr)
+	})
+}
+
+// Result returns the result the job stored when it was acknowledged,
+// nil if it hasn't finished, didn't store one or it has expired.
+func (c *Client) Result(jid string) (*JobResult, error) {
+	var data []byte
+	err := c.retry(func() error {
+		err := writeLine(c.wtr, "RESULT", []byte(jid))
+		if err != nil {
+			return err
+		}
+		data, err = readResponse(c.rdr)
+		return err
+	})
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var res JobResult
+	err = json.Unmarshal(data, &res)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
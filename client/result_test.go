@@ -0,0 +1,42 @@
+package client
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResultCommands(t *testing.T) {
+	withFakeServer(t, func(req, resp chan string, addr string) {
+		err := os.Setenv("FAKTORY_PROVIDER", "MIKE_URL")
+		assert.NoError(t, err)
+		err = os.Setenv("MIKE_URL", "tcp://:foobar@"+addr)
+		assert.NoError(t, err)
+
+		resp <- "+OK\r\n"
+		cl, err := Open()
+		assert.NoError(t, err)
+		<-req
+
+		resp <- "+OK\r\n"
+		err = cl.AckResult("abc123", map[string]int{"rows": 12})
+		assert.NoError(t, err)
+		assert.Equal(t, "ACK {\"jid\":\"abc123\",\"result\":{\"rows\":12}}\r\n", <-req)
+
+		resp <- "$75\r\n{\"jid\":\"abc123\",\"result\":{\"rows\":12},\"completed_at\":\"2026-10-14T09:30:00Z\"}\r\n"
+		res, err := cl.Result("abc123")
+		assert.NoError(t, err)
+		assert.Equal(t, "RESULT abc123\r\n", <-req)
+		assert.Equal(t, `{"rows":12}`, string(res.Result))
+
+		resp <- "$-1\r\n"
+		res, err = cl.Result("nosuchjob")
+		assert.NoError(t, err)
+		assert.Nil(t, res)
+		<-req
+
+		cl.Close()
+		<-req
+	})
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// RetryConfig controls how a Client reconnects when its connection
+// to the server drops.  The zero value disables reconnection.
+type RetryConfig struct {
+	// The number of reconnect attempts before giving up and
+	// returning the error to the caller.
+	MaxAttempts int
+	// The delay before the first attempt, doubling with each attempt
+	// up to MaxDelay.  Each delay is jittered by up to half.
+	// Default to 100ms and 5s respectively.
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+func (rc RetryConfig) delay(attempt int) time.Duration {
+	initial := rc.InitialDelay
+	if initial <= 0 {
+		initial = 100 * time.Millisecond
+	}
+	max := rc.MaxDelay
+	if max <= 0 {
+		max = 5 * time.Second
+	}
+
+	delay := initial
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// ErrPermanent wraps errors which reconnecting won't fix, e.g. the
+// server rejected the password.  The client returns these
+// immediately rather than retrying.
+type ErrPermanent struct {
+	Err error
+}
+
+func (e *ErrPermanent) Error() string {
+	return e.Err.Error()
+}
+
+type ClientStats struct {
+	// The number of times the client has successfully
+	// reconnected after losing its connection.
+	ReconnectCount int
+}
+
+func (c *Client) Stats() ClientStats {
+	return c.stats
+}
+
+// Connection errors, not errors reported by the server, are worth
+// retrying.
+func isTransient(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// Run op, reconnecting and running it again if it fails due to a
+// dropped connection.  op may have reached the server before the
+// connection dropped so only use this for commands which are safe to
+// run twice, see retryUnsent.
+func (c *Client) retry(op func() error) error {
+	err := op()
+	for attempt := 0; err != nil && isTransient(err) && attempt < c.retryConfig.MaxAttempts; attempt++ {
+		time.Sleep(c.retryConfig.delay(attempt))
+		err = c.reconnect()
+		if err != nil {
+			continue
+		}
+		c.stats.ReconnectCount++
+		err = op()
+	}
+	return err
+}
+
+// Send the command, reconnecting and sending it again only if the
+// connection dropped before it was written, and then read its reply.
+// Once written the server may have run it so it's never resent, for
+// commands like PUSH and ACK which mustn't run twice.
+func (c *Client) retryUnsent(op string, payload []byte, read func() error) error {
+	err := c.retry(func() error {
+		return writeLine(c.wtr, op, payload)
+	})
+	if err != nil {
+		return err
+	}
+	return read()
+}
+
+func (c *Client) reconnect() error {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	fresh, err := Dial(c.server, c.password)
+	if err != nil {
+		if _, ok := err.(*ProtocolError); ok {
+			return &ErrPermanent{Err: err}
+		}
+		return err
+	}
+	// only the connection, Options are the caller's
+	c.features = fresh.features
+	c.conn = fresh.conn
+	c.rdr = fresh.rdr
+	c.wtr = fresh.wtr
+	return nil
+}
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A fake server which replies +OK to everything and
+// can be killed and restarted on the same address.
+type okServer struct {
+	addr   string
+	reject bool
+	// commands with this prefix are counted and drop the
+	// connection instead of being answered
+	drop     string
+	dropped  int
+	listener net.Listener
+	conns    []net.Conn
+	mu       sync.Mutex
+}
+
+func (s *okServer) start(t *testing.T) {
+	listener, err := net.Listen("tcp", s.addr)
+	assert.NoError(t, err)
+	s.listener = listener
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+
+			go func() {
+				conn.Write([]byte("+HI {\"v\":3,\"features\":[\"scan\"]}\r\n"))
+				buf := bufio.NewReader(conn)
+				for {
+					line, err := buf.ReadString('\n')
+					if err != nil || strings.HasPrefix(line, "END") {
+						conn.Close()
+						return
+					}
+					if s.reject && strings.HasPrefix(line, "HELLO") {
+						conn.Write([]byte("-ERR Invalid password\r\n"))
+						continue
+					}
+					if s.drop != "" && strings.HasPrefix(line, s.drop) {
+						s.mu.Lock()
+						s.dropped++
+						s.mu.Unlock()
+						conn.Close()
+						return
+					}
+					conn.Write([]byte("+OK\r\n"))
+				}
+			}()
+		}
+	}()
+}
+
+func (s *okServer) kill() {
+	s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func TestReconnect(t *testing.T) {
+	srv := &okServer{addr: "localhost:44435"}
+	srv.start(t)
+
+	cl, err := NewClientFromURL("tcp://"+srv.addr, RetryConfig{
+		MaxAttempts:  10,
+		InitialDelay: 50 * time.Millisecond,
+		MaxDelay:     200 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	assert.True(t, cl.HasFeature("scan"))
+	assert.False(t, cl.HasFeature("batch"))
+
+	err = cl.Push(NewJob("Thing", 1))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, cl.Stats().ReconnectCount)
+	options := cl.Options
+	options.Labels = []string{"golang", "reports"}
+
+	srv.kill()
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		srv.start(t)
+	}()
+
+	err = cl.Flush()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, cl.Stats().ReconnectCount)
+	assert.True(t, options == cl.Options)
+	assert.Equal(t, []string{"golang", "reports"}, cl.Options.Labels)
+
+	cl.Close()
+	srv.kill()
+}
+
+func TestNoResend(t *testing.T) {
+	srv := &okServer{addr: "localhost:44437", drop: "PUSH"}
+	srv.start(t)
+	defer srv.kill()
+
+	cl, err := NewClientFromURL("tcp://"+srv.addr, RetryConfig{
+		MaxAttempts:  3,
+		InitialDelay: time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	// the server may have pushed the job before the connection
+	// dropped so it isn't pushed again
+	err = cl.Push(NewJob("Thing", 1))
+	assert.Error(t, err)
+	srv.mu.Lock()
+	assert.Equal(t, 1, srv.dropped)
+	srv.mu.Unlock()
+	assert.Equal(t, 0, cl.Stats().ReconnectCount)
+
+	// while commands which are safe to run again reconnect
+	err = cl.Flush()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, cl.Stats().ReconnectCount)
+	cl.Close()
+}
+
+func TestReconnectLimits(t *testing.T) {
+	srv := &okServer{addr: "localhost:44436"}
+	srv.start(t)
+
+	// the zero RetryConfig never reconnects
+	cl, err := NewClientFromURL("tcp://"+srv.addr, RetryConfig{})
+	assert.NoError(t, err)
+	srv.kill()
+
+	err = cl.Flush()
+	assert.Error(t, err)
+	assert.Equal(t, 0, cl.Stats().ReconnectCount)
+
+	// nothing listening, so give up after MaxAttempts
+	cl.retryConfig = RetryConfig{MaxAttempts: 3, InitialDelay: time.Millisecond}
+	err = cl.Flush()
+	assert.Error(t, err)
+	_, ok := err.(*ErrPermanent)
+	assert.False(t, ok)
+
+	// errors from the server are never retried
+	srv.reject = true
+	srv.start(t)
+	defer srv.kill()
+	err = cl.Flush()
+	assert.Error(t, err)
+	_, ok = err.(*ErrPermanent)
+	assert.True(t, ok)
+	assert.Contains(t, err.Error(), "Invalid password")
+	assert.Equal(t, 0, cl.Stats().ReconnectCount)
+}
+
+func TestRetryDelay(t *testing.T) {
+	rc := RetryConfig{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max = max * time.Millisecond
+		delay := rc.delay(attempt)
+		assert.True(t, delay >= max/2 && delay <= max, "attempt %d: %v", attempt, delay)
+	}
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"encoding/json"
+)
+
+// Progress is how far along a running job is, see Client.TrackSet.
+type Progress struct {
+	Jid       string `json:"jid"`
+	Percent   int    `json:"percent"`
+	Desc      string `json:"desc,omitempty"`
+	UpdatedAt string `json:"updated_at,omitempty"`
+}
+
+// TrackSet reports the progress of a job this worker is running,
+// percent is 0-100 and desc is an optional status line.
+//
+// Requires a server with the "track" feature.
+func (c *Client) TrackSet(jid string, percent int, desc string) error {
+	data, err := json.Marshal(&Progress{Jid: jid, Percent: percent, Desc: desc})
+	if err != nil {
+		return err
+	}
+	return c.retry(func() error {
+		err := writeLine(c.wtr, "TRACK SET", data)
+		if err != nil {
+			return err
+		}
+		return ok(c.rdr)
+	})
+}
+
+// TrackGet returns the job's last reported progress, nil if it
+// hasn't reported any recently.
+func (c *Client) TrackGet(jid string) (*Progress, error) {
+	var data []byte
+	err := c.retry(func() error {
+		err := writeLine(c.wtr, "TRACK GET", []byte(jid))
+		if err != nil {
+			return err
+		}
+		data, err = readResponse(c.rdr)
+		return err
+	})
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var progress Progress
+	err = json.Unmarshal(data, &progress)
+	if err != nil {
+		return nil, err
+	}
+	return &progress, nil
+}
@@ -0,0 +1,43 @@
+package client
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackCommands(t *testing.T) {
+	withFakeServer(t, func(req, resp chan string, addr string) {
+		err := os.Setenv("FAKTORY_PROVIDER", "MIKE_URL")
+		assert.NoError(t, err)
+		err = os.Setenv("MIKE_URL", "tcp://:foobar@"+addr)
+		assert.NoError(t, err)
+
+		resp <- "+OK\r\n"
+		cl, err := Open()
+		assert.NoError(t, err)
+		<-req
+
+		resp <- "+OK\r\n"
+		err = cl.TrackSet("abc123", 40, "Resizing")
+		assert.NoError(t, err)
+		assert.Equal(t, "TRACK SET {\"jid\":\"abc123\",\"percent\":40,\"desc\":\"Resizing\"}\r\n", <-req)
+
+		resp <- "$47\r\n{\"jid\":\"abc123\",\"percent\":40,\"desc\":\"Resizing\"}\r\n"
+		progress, err := cl.TrackGet("abc123")
+		assert.NoError(t, err)
+		assert.Equal(t, "TRACK GET abc123\r\n", <-req)
+		assert.Equal(t, 40, progress.Percent)
+		assert.Equal(t, "Resizing", progress.Desc)
+
+		resp <- "$-1\r\n"
+		progress, err = cl.TrackGet("nosuchjob")
+		assert.NoError(t, err)
+		assert.Nil(t, progress)
+		<-req
+
+		cl.Close()
+		<-req
+	})
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+)
+
+var benchOps = []string{"push", "fetch", "ack"}
+
+// The latencies and errors of one operation, for one connection or,
+// merged, the whole run.
+type benchResult struct {
+	latencies []time.Duration
+	errors    int
+	empty     int
+}
+
+func (br *benchResult) merge(other *benchResult) {
+	br.latencies = append(br.latencies, other.latencies...)
+	br.errors += other.errors
+	br.empty += other.empty
+}
+
+func bench(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	duration := flags.Duration("duration", 10*time.Second, "How long to run")
+	connections := flags.Int("connections", 10, "How many connections to run the mix on at once")
+	mixFlag := flags.String("mix", "push=1,fetch=1,ack=1", "The relative weights of PUSH, FETCH and ACK")
+	queue := flags.String("queue", "bench", "The queue to push to and fetch from")
+	payload := flags.Int("payload", 100, "The size in bytes of each job's argument")
+	prefill := flags.Int("prefill", 1000, "How many jobs to push before the run so fetches don't find the queue empty")
+	flags.Parse(args)
+	if flags.NArg() > 0 || *connections < 1 || *duration <= 0 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+	mix, err := parseMix(*mixFlag)
+	if err != nil {
+		return err
+	}
+
+	clients := make([]*client.Client, *connections)
+	for idx := range clients {
+		cl, err := client.Open()
+		if err != nil {
+			return err
+		}
+		defer cl.Close()
+		clients[idx] = cl
+	}
+
+	arg := strings.Repeat("x", *payload)
+	for i := 0; i < *prefill; i++ {
+		job := client.NewJob("BenchJob", arg)
+		job.Queue = *queue
+		err = clients[0].Push(job)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Running %s on %d connections for %v\n", *mixFlag, *connections, *duration)
+	results := make([]map[string]*benchResult, len(clients))
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(*duration)
+	for idx, cl := range clients {
+		wg.Add(1)
+		go func(idx int, cl *client.Client) {
+			defer wg.Done()
+			results[idx] = benchConnection(cl, mix, *queue, arg, deadline, rand.New(rand.NewSource(int64(idx))))
+		}(idx, cl)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	total := map[string]*benchResult{}
+	for _, op := range benchOps {
+		total[op] = &benchResult{}
+		for _, result := range results {
+			total[op].merge(result[op])
+		}
+	}
+	printBench(total, elapsed)
+	return nil
+}
+
+// Run the mix on cl until the deadline.  An ACK acknowledges the
+// connection's oldest fetched job or, if it has none, fetches one
+// instead.  Jobs fetched but not yet acknowledged when the run ends
+// are acknowledged afterwards so they aren't left reserved.
+func benchConnection(cl *client.Client, mix map[string]int, queue string, arg string, deadline time.Time, rnd *rand.Rand) map[string]*benchResult {
+	results := map[string]*benchResult{}
+	for _, op := range benchOps {
+		results[op] = &benchResult{}
+	}
+	weight := 0
+	for _, op := range benchOps {
+		weight += mix[op]
+	}
+
+	fetched := []string{}
+	for time.Now().Before(deadline) {
+		op := pickOp(mix, rnd.Intn(weight))
+		if op == "ack" && len(fetched) == 0 {
+			op = "fetch"
+		}
+
+		var err error
+		start := time.Now()
+		switch op {
+		case "push":
+			job := client.NewJob("BenchJob", arg)
+			job.Queue = queue
+			err = cl.Push(job)
+		case "fetch":
+			var job *client.Job
+			job, err = cl.Fetch(queue)
+			if err == nil && job == nil {
+				results[op].empty++
+			} else if job != nil {
+				fetched = append(fetched, job.Jid)
+			}
+		case "ack":
+			err = cl.Ack(fetched[0])
+			fetched = fetched[1:]
+		}
+		results[op].latencies = append(results[op].latencies, time.Since(start))
+		if err != nil {
+			results[op].errors++
+		}
+	}
+
+	for _, jid := range fetched {
+		cl.Ack(jid)
+	}
+	return results
+}
+
+// The operation whose share of the weights n falls in.
+func pickOp(mix map[string]int, n int) string {
+	for _, op := range benchOps {
+		if n < mix[op] {
+			return op
+		}
+		n -= mix[op]
+	}
+	return benchOps[len(benchOps)-1]
+}
+
+// Parse weights such as "push=2,fetch=1,ack=1", missing operations
+// have no weight.
+func parseMix(value string) (map[string]int, error) {
+	mix := map[string]int{}
+	total := 0
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		op := strings.ToLower(parts[0])
+		known := false
+		for _, name := range benchOps {
+			known = known || op == name
+		}
+		if !known || len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid -mix %q, expected weights such as push=2,fetch=1,ack=1", value)
+		}
+		weight, err := strconv.Atoi(parts[1])
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("Invalid -mix weight %q, must be 0 or more", item)
+		}
+		mix[op] = weight
+		total += weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("Invalid -mix %q, no operation has any weight", value)
+	}
+	return mix, nil
+}
+
+// The latency at or below which the fraction p of sorted latencies lie.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(p*float64(len(sorted))+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+func printBench(total map[string]*benchResult, elapsed time.Duration) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "op\tcount\tops/s\tp50\tp90\tp99\tmax\terrors\t")
+	count := 0
+	errors := 0
+	for _, op := range benchOps {
+		result := total[op]
+		lats := result.latencies
+		if len(lats) == 0 {
+			continue
+		}
+		sort.Slice(lats, func(i, j int) bool { return lats[i] < lats[j] })
+		count += len(lats)
+		errors += result.errors
+		fmt.Fprintf(tw, "%s\t%d\t%.0f\t%v\t%v\t%v\t%v\t%d\t\n", op, len(lats), float64(len(lats))/elapsed.Seconds(),
+			roundLatency(percentile(lats, 0.5)), roundLatency(percentile(lats, 0.9)),
+			roundLatency(percentile(lats, 0.99)), roundLatency(lats[len(lats)-1]), result.errors)
+	}
+	fmt.Fprintf(tw, "total\t%d\t%.0f\t\t\t\t\t%d\t\n", count, float64(count)/elapsed.Seconds(), errors)
+	tw.Flush()
+
+	if empty := total["fetch"].empty; empty > 0 {
+		fmt.Printf("%d fetches found the queue empty and waited, give push more weight than fetch\n", empty)
+	}
+}
+
+func roundLatency(lat time.Duration) time.Duration {
+	if lat < time.Millisecond {
+		return lat.Round(time.Microsecond)
+	}
+	return lat.Round(10 * time.Microsecond)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMix(t *testing.T) {
+	mix, err := parseMix("push=2, FETCH=1,ack=0")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"push": 2, "fetch": 1, "ack": 0}, mix)
+	assert.Equal(t, "push", pickOp(mix, 1))
+	assert.Equal(t, "fetch", pickOp(mix, 2))
+
+	for _, bad := range []string{"", "push", "beat=1", "push=-1", "push=0"} {
+		_, err := parseMix(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	lats := []time.Duration{}
+	for i := 1; i <= 100; i++ {
+		lats = append(lats, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, 50*time.Millisecond, percentile(lats, 0.5))
+	assert.Equal(t, 99*time.Millisecond, percentile(lats, 0.99))
+	assert.Equal(t, 100*time.Millisecond, percentile(lats, 1))
+	assert.Equal(t, time.Duration(0), percentile(nil, 0.5))
+}
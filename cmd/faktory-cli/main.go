@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/storage"
+	_ "github.com/contribsys/faktory/storage/postgres"
+	_ "github.com/contribsys/faktory/storage/sqlite"
+)
+
+const usage = `Usage: faktory-cli <command> [arguments]
+
+backup and restore connect to the server in FAKTORY_URL, its admin
+port if it has one.  bench connects to FAKTORY_URL.
+
+Commands:
+  backup <file>   Save a snapshot of the server's jobs and counters
+  restore <file>  Add a snapshot's jobs to the server and set its counters
+  migrate [-dry-run] -from <url> -to <url>
+                  Copy the jobs and counters from one store to another,
+                  e.g. -from redis://localhost:6379 -to postgres://db/faktory
+  bench [-duration 10s] [-connections 10] [-mix push=1,fetch=1,ack=1]
+        [-queue bench] [-payload 100] [-prefill 1000]
+                  Run a mix of PUSH, FETCH and ACK against the server and
+                  report the throughput and latency percentiles of each
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "backup":
+		err = backup(fileArgument(os.Args))
+	case "restore":
+		err = restore(fileArgument(os.Args))
+	case "migrate":
+		err = migrate(os.Args[2:])
+	case "bench":
+		err = bench(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func fileArgument(args []string) string {
+	if len(args) != 3 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+	return args[2]
+}
+
+func backup(path string) error {
+	cl, err := client.Open()
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+
+	data, err := cl.Backup()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// Snapshots shipped to a bucket are already gzipped, RestoreFrom
+// sends those as they are.
+func restore(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	cl, err := client.Open()
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+	return cl.RestoreFrom(file)
+}
+
+func migrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := flags.String("from", "", "URL of the store to copy from")
+	to := flags.String("to", "", "URL of the store to copy to")
+	dryRun := flags.Bool("dry-run", false, "Report what would be copied, only opening the store to copy to")
+	flags.Parse(args)
+	if *from == "" || *to == "" || flags.NArg() > 0 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+	if *from == *to {
+		return fmt.Errorf("-from and -to are the same store")
+	}
+
+	source, err := storage.OpenURL(*from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	dest, err := storage.OpenURL(*to)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	verb := "Copying"
+	if *dryRun {
+		verb = "Would copy"
+	}
+	fmt.Printf("%s %s to %s\n", verb, redact(*from), redact(*to))
+	return storage.Migrate(source, dest, *dryRun, func(p storage.MigrateProgress) {
+		kind := "set"
+		if p.Queue {
+			kind = "queue"
+		}
+		fmt.Printf("%s %s: %d/%d jobs\n", kind, p.Name, p.Done, p.Total)
+	})
+}
+
+// The URL without its password, if any.
+func redact(storeURL string) string {
+	u, err := url.Parse(storeURL)
+	if err != nil || u.User == nil {
+		return storeURL
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return strings.Replace(u.String(), "xxxxx", "***", 1)
+}
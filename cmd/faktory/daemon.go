@@ -5,8 +5,13 @@ import (
 	"log"
 	"time"
 
+	"github.com/contribsys/faktory/api"
 	"github.com/contribsys/faktory/cli"
 	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/metrics"
+	_ "github.com/contribsys/faktory/storage/postgres"
+	_ "github.com/contribsys/faktory/storage/sqlite"
+	"github.com/contribsys/faktory/tracing"
 	"github.com/contribsys/faktory/util"
 	"github.com/contribsys/faktory/webui"
 )
@@ -22,6 +27,10 @@ func main() {
 	logPreamble()
 
 	opts := cli.ParseArguments()
+	err := util.SetLogFormat(opts.LogFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
 	util.InitLogger(opts.LogLevel)
 	util.Debugf("Options: %v", opts)
 
@@ -42,6 +51,9 @@ func main() {
 	}
 
 	s.Register(webui.Subsystem(opts.WebBinding))
+	s.Register(api.Subsystem())
+	s.Register(metrics.Subsystem())
+	s.Register(tracing.Subsystem())
 
 	go cli.HandleSignals(s)
 	go s.Run()
@@ -0,0 +1,240 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/contribsys/faktory/server"
+)
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// LoadTOML reads the TOML file at path and maps the [faktory] table
+// onto ServerOptions:
+//
+//	[faktory]
+//	binding = "0.0.0.0:7419"
+//	storage_directory = "/var/lib/faktory/db"
+//	hard_kill_timeout = "30s"
+//
+// Each key is the toml tag of the matching ServerOptions field.
+// After parsing, every field can be overridden by an environment
+// variable named FAKTORY_ plus the upper-cased key, e.g.
+// FAKTORY_HARD_KILL_TIMEOUT=30s.  Environment variables always win.
+//
+// The entire file is also available to subsystems via GlobalConfig.
+func LoadTOML(path string) (*server.ServerOptions, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := map[string]interface{}{}
+	_, err = toml.Decode(string(data), &hash)
+	if err != nil {
+		// parse errors include "Near line N"
+		return nil, fmt.Errorf("Unable to parse %s: %v", path, err)
+	}
+	return ParseOptions(hash, path)
+}
+
+// ParseOptions maps the [faktory] table of an already decoded config,
+// e.g. the merged conf.d files, onto ServerOptions as LoadTOML does.
+// path names the config in errors.
+func ParseOptions(hash map[string]interface{}, path string) (*server.ServerOptions, error) {
+	opts := &server.ServerOptions{GlobalConfig: hash}
+	if section, ok := hash["faktory"]; ok {
+		values, ok := section.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Invalid %s: faktory must be a table", path)
+		}
+		err := eachOption(opts, func(key string, field reflect.Value) error {
+			val, ok := values[key]
+			if !ok {
+				return nil
+			}
+			err := setValue(field, val)
+			if err != nil {
+				return fmt.Errorf("Invalid %s: faktory.%s %v", path, key, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// clear passwords so we can log the config safely
+		for _, key := range []string{"password", "passwords", "password_command", "producer_password", "consumer_password", "redis_url", "redis_password", "storage_url"} {
+			if _, ok := values[key]; ok {
+				values[key] = "********"
+			}
+		}
+	}
+
+	err := eachOption(opts, func(key string, field reflect.Value) error {
+		name := "FAKTORY_" + strings.ToUpper(key)
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return nil
+		}
+		err := setString(field, val)
+		if err != nil {
+			return fmt.Errorf("Invalid %s: %v", name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return opts, nil
+}
+
+// Call fn for every ServerOptions field which has a toml key.
+func eachOption(opts *server.ServerOptions, fn func(key string, field reflect.Value) error) error {
+	rv := reflect.ValueOf(opts).Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		key := rt.Field(i).Tag.Get("toml")
+		if key == "" || key == "-" {
+			continue
+		}
+		err := fn(key, rv.Field(i))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Set field from a value decoded by the TOML parser.
+func setValue(field reflect.Value, val interface{}) error {
+	if field.Type() == durationType {
+		switch x := val.(type) {
+		case string:
+			return setString(field, x)
+		case int64:
+			// plain integers are seconds
+			field.SetInt(int64(time.Duration(x) * time.Second))
+			return nil
+		}
+		return fmt.Errorf("must be a duration like \"30s\", not %v", val)
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		if x, ok := val.(string); ok {
+			field.SetString(x)
+			return nil
+		}
+	case reflect.Bool:
+		if x, ok := val.(bool); ok {
+			field.SetBool(x)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if x, ok := val.(int64); ok {
+			field.SetInt(x)
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if x, ok := val.(int64); ok && x >= 0 {
+			field.SetUint(uint64(x))
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		switch x := val.(type) {
+		case float64:
+			field.SetFloat(x)
+			return nil
+		case int64:
+			field.SetFloat(float64(x))
+			return nil
+		}
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.String {
+			items, ok := val.([]interface{})
+			if !ok {
+				break
+			}
+			strs := make([]string, len(items))
+			for idx, item := range items {
+				str, ok := item.(string)
+				if !ok {
+					return fmt.Errorf("must be an array of strings")
+				}
+				strs[idx] = str
+			}
+			field.Set(reflect.ValueOf(strs))
+			return nil
+		}
+	}
+	return fmt.Errorf("must be a %v, not %v", field.Type(), val)
+}
+
+// Set field from the string value of an environment variable.
+func setString(field reflect.Value, val string) error {
+	if field.Type() == durationType {
+		if secs, err := strconv.ParseInt(val, 10, 64); err == nil {
+			field.SetInt(int64(time.Duration(secs) * time.Second))
+			return nil
+		}
+		dur, err := time.ParseDuration(val)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(dur))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(val)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(val, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, err := strconv.ParseUint(val, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(i)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(val, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("cannot be set from the environment")
+		}
+		strs := []string{}
+		for _, str := range strings.Split(val, ",") {
+			if str = strings.TrimSpace(str); str != "" {
+				strs = append(strs, str)
+			}
+		}
+		field.Set(reflect.ValueOf(strs))
+	default:
+		return fmt.Errorf("cannot be set from the environment")
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package manager
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+)
+
+// The backoff strategies, see ParseBackoff.
+const (
+	BackoffExponential = "exponential"
+	BackoffLinear      = "linear"
+	BackoffFixed       = "fixed"
+	BackoffTable       = "table"
+)
+
+// Backoff decides how long a failed job waits before it's retried.
+// The zero value is the usual exponential backoff.
+type Backoff struct {
+	Strategy string
+	// The wait for linear and fixed backoff.
+	Interval time.Duration
+	// The wait after each failure for table backoff, the last
+	// one is used once the table runs out.
+	Table []time.Duration
+}
+
+// ParseBackoff parses backoffs such as "exponential", "linear:30s",
+// "fixed:5m" or "table:10s,1m,10m,1h".
+func ParseBackoff(value string) (Backoff, error) {
+	parts := strings.SplitN(value, ":", 2)
+	strategy := parts[0]
+	arg := ""
+	if len(parts) == 2 {
+		arg = parts[1]
+	}
+
+	switch strategy {
+	case BackoffExponential, "":
+		if arg != "" {
+			return Backoff{}, fmt.Errorf("Invalid backoff %q, exponential takes no interval", value)
+		}
+		return Backoff{}, nil
+	case BackoffLinear, BackoffFixed:
+		interval, err := time.ParseDuration(arg)
+		if err != nil || interval <= 0 {
+			return Backoff{}, fmt.Errorf("Invalid backoff %q, expected %s:<duration> such as %s:30s", value, strategy, strategy)
+		}
+		return Backoff{Strategy: strategy, Interval: interval}, nil
+	case BackoffTable:
+		var table []time.Duration
+		for _, item := range strings.Split(arg, ",") {
+			wait, err := time.ParseDuration(strings.TrimSpace(item))
+			if err != nil || wait <= 0 {
+				return Backoff{}, fmt.Errorf("Invalid backoff %q, expected table:<duration>,... such as table:1m,10m,1h", value)
+			}
+			table = append(table, wait)
+		}
+		return Backoff{Strategy: strategy, Table: table}, nil
+	}
+	return Backoff{}, fmt.Errorf("Invalid backoff %q, must be exponential, linear, fixed or table", value)
+}
+
+// How long to wait after the job's count'th retry, counting from
+// 0 for its first failure.
+func (b Backoff) wait(count int) time.Duration {
+	switch b.Strategy {
+	case BackoffLinear:
+		return b.Interval * time.Duration(count+1)
+	case BackoffFixed:
+		return b.Interval
+	case BackoffTable:
+		if count >= len(b.Table) {
+			count = len(b.Table) - 1
+		}
+		return b.Table[count]
+	}
+	secs := (count * count * count * count) + 15 + (rand.Intn(30) * (count + 1))
+	return time.Duration(secs) * time.Second
+}
+
+// Jitter spreads out the retries of jobs which failed together,
+// e.g. during an outage, adding a random delay of up to Max or up
+// to Percent of the backoff.  The zero value adds nothing.
+type Jitter struct {
+	Max     time.Duration
+	Percent float64
+}
+
+// ParseJitter parses jitter such as "30s" or "20%".
+func ParseJitter(value string) (Jitter, error) {
+	if value == "" {
+		return Jitter{}, nil
+	}
+	if strings.HasSuffix(value, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || pct <= 0 || pct > 100 {
+			return Jitter{}, fmt.Errorf("Invalid jitter %q, percentage must be between 0 and 100", value)
+		}
+		return Jitter{Percent: pct}, nil
+	}
+	max, err := time.ParseDuration(value)
+	if err != nil || max <= 0 {
+		return Jitter{}, fmt.Errorf("Invalid jitter %q, expected a duration such as 30s or a percentage such as 20%%", value)
+	}
+	return Jitter{Max: max}, nil
+}
+
+// A random delay to add to the wait.
+func (j Jitter) extra(wait time.Duration) time.Duration {
+	max := j.Max
+	if j.Percent > 0 {
+		max = time.Duration(float64(wait) * j.Percent / 100)
+	}
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// The job's own backoff wins over its jobtype's.
+func (m *manager) backoff(job *client.Job) Backoff {
+	if job.Backoff != "" {
+		// prepare has checked it
+		b, err := ParseBackoff(job.Backoff)
+		if err == nil {
+			return b
+		}
+	}
+	if m.opts.Backoff == nil {
+		return Backoff{}
+	}
+	return m.opts.Backoff(job.Type)
+}
+
+func (m *manager) nextRetry(job *client.Job) time.Time {
+	wait := m.backoff(job).wait(job.Failure.RetryCount)
+	if m.opts.RetryJitter != nil {
+		wait += m.opts.RetryJitter().extra(wait)
+	}
+	return time.Now().Add(wait)
+}
@@ -0,0 +1,65 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBackoff(t *testing.T) {
+	b, err := ParseBackoff("exponential")
+	assert.NoError(t, err)
+	assert.Equal(t, Backoff{}, b)
+	assert.True(t, b.wait(0) >= 15*time.Second)
+	assert.True(t, b.wait(3) >= 96*time.Second)
+
+	b, err = ParseBackoff("linear:30s")
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Second, b.wait(0))
+	assert.Equal(t, 90*time.Second, b.wait(2))
+
+	b, err = ParseBackoff("fixed:5m")
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, b.wait(0))
+	assert.Equal(t, 5*time.Minute, b.wait(10))
+
+	b, err = ParseBackoff("table:10s, 1m,1h")
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Second, b.wait(0))
+	assert.Equal(t, time.Minute, b.wait(1))
+	assert.Equal(t, time.Hour, b.wait(2))
+	assert.Equal(t, time.Hour, b.wait(20))
+
+	for _, value := range []string{"exponential:2s", "linear", "fixed:-1s", "fixed:soon", "table:", "table:1m,,1h", "random"} {
+		_, err = ParseBackoff(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestParseJitter(t *testing.T) {
+	j, err := ParseJitter("")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), j.extra(time.Minute))
+
+	j, err = ParseJitter("30s")
+	assert.NoError(t, err)
+	assert.Equal(t, Jitter{Max: 30 * time.Second}, j)
+	for i := 0; i < 100; i++ {
+		extra := j.extra(time.Hour)
+		assert.True(t, extra >= 0 && extra < 30*time.Second, extra)
+	}
+
+	j, err = ParseJitter("10%")
+	assert.NoError(t, err)
+	assert.Equal(t, Jitter{Percent: 10}, j)
+	for i := 0; i < 100; i++ {
+		extra := j.extra(time.Hour)
+		assert.True(t, extra >= 0 && extra < 6*time.Minute, extra)
+	}
+
+	for _, value := range []string{"soon", "-5s", "0%", "150%", "x%"} {
+		_, err = ParseJitter(value)
+		assert.Error(t, err, value)
+	}
+}
@@ -0,0 +1,194 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/util"
+)
+
+// Batches expire this long after they're created, whether or not
+// their callbacks have fired.
+var BatchTTL = 30 * 24 * time.Hour
+
+var validBid = regexp.MustCompile(`\A[a-zA-Z0-9._-]{8,64}\z`)
+
+// BatchStatus is a batch's progress, see storage.BatchState.
+type BatchStatus struct {
+	Bid         string `json:"bid"`
+	Description string `json:"description,omitempty"`
+	CreatedAt   string `json:"created_at"`
+	Committed   bool   `json:"committed"`
+	Total       int64  `json:"total"`
+	Pending     int64  `json:"pending"`
+	Failed      int64  `json:"failed"`
+	Completed   bool   `json:"completed"`
+	Succeeded   bool   `json:"succeeded"`
+}
+
+func (m *manager) NewBatch(batch *client.Batch) error {
+	if batch.Bid == "" {
+		batch.Bid = "b-" + util.RandomJid()
+	}
+	if !validBid.MatchString(batch.Bid) {
+		return fmt.Errorf("Invalid bid %q, must be 8-64 letters, digits, '.', '_' or '-'", batch.Bid)
+	}
+	for _, callback := range []*client.Job{batch.Success, batch.Complete} {
+		if callback == nil {
+			continue
+		}
+		if callback.Jid == "" {
+			callback.Jid = util.RandomJid()
+		}
+		if callback.Bid != "" {
+			return fmt.Errorf("Batch callbacks cannot belong to a batch")
+		}
+		err := m.prepare(callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	return m.store.CreateBatch(batch.Bid, data, BatchTTL)
+}
+
+func (m *manager) OpenBatch(bid string) error {
+	return m.store.OpenBatch(bid)
+}
+
+func (m *manager) CommitBatch(bid string) error {
+	fire, err := m.store.CommitBatch(bid)
+	if err != nil {
+		return err
+	}
+	m.fireCallbacks(bid, fire)
+	return nil
+}
+
+// BatchStatus returns nil if there's no such batch.
+func (m *manager) BatchStatus(bid string) (*BatchStatus, error) {
+	state, err := m.store.GetBatch(bid)
+	if err != nil || state == nil {
+		return nil, err
+	}
+	var batch client.Batch
+	err = json.Unmarshal(state.Data, &batch)
+	if err != nil {
+		return nil, err
+	}
+	return batchStatus(state, &batch), nil
+}
+
+func batchStatus(state *storage.BatchState, batch *client.Batch) *BatchStatus {
+	return &BatchStatus{
+		Bid:         state.Bid,
+		Description: batch.Description,
+		CreatedAt:   state.CreatedAt,
+		Committed:   state.Committed,
+		Total:       state.Total,
+		Pending:     state.Pending,
+		Failed:      state.Failed,
+		Completed:   state.Completed,
+		Succeeded:   state.Succeeded,
+	}
+}
+
+// Count jobs into their batches, before they're pushed.
+func (m *manager) joinBatches(jobs []*client.Job) error {
+	added := map[string]int{}
+	for bid, count := range batchCounts(jobs) {
+		err := m.store.AddToBatch(bid, count)
+		if err != nil {
+			m.leaveBatches(added)
+			return err
+		}
+		added[bid] = count
+	}
+	return nil
+}
+
+// Take back jobs counted by joinBatches which couldn't be pushed.
+func (m *manager) leaveBatches(counts map[string]int) {
+	for bid, count := range counts {
+		err := m.store.AddToBatch(bid, -count)
+		if err != nil {
+			util.Error("Unable to remove jobs from batch "+bid, err)
+		}
+	}
+}
+
+func batchCounts(jobs []*client.Job) map[string]int {
+	counts := map[string]int{}
+	for _, job := range jobs {
+		if job.Bid != "" {
+			counts[job.Bid]++
+		}
+	}
+	return counts
+}
+
+// Record that a batch job succeeded or failed, pushing the
+// batch's callbacks if they're now due.
+func (m *manager) batchJobDone(job *client.Job, succeeded bool) {
+	if job.Bid == "" {
+		return
+	}
+	fire, err := m.store.BatchJobDone(job.Bid, job.Jid, succeeded)
+	if err != nil {
+		util.Error("Unable to update batch "+job.Bid, err)
+		return
+	}
+	m.fireCallbacks(job.Bid, fire)
+}
+
+// Callbacks get the bid in their custom data so they can look up
+// the batch.
+func (m *manager) fireCallbacks(bid string, fire []string) {
+	if len(fire) == 0 {
+		return
+	}
+	state, err := m.store.GetBatch(bid)
+	if err != nil {
+		util.Error("Unable to load batch "+bid, err)
+		return
+	}
+	if state == nil {
+		util.Warnf("Batch %s expired before its callbacks fired", bid)
+		return
+	}
+	var batch client.Batch
+	err = json.Unmarshal(state.Data, &batch)
+	if err != nil {
+		util.Error("Unable to load batch "+bid, err)
+		return
+	}
+
+	for _, name := range fire {
+		if name == storage.BatchComplete && m.opts.OnBatchComplete != nil {
+			m.opts.OnBatchComplete(batchStatus(state, &batch))
+		}
+		callback := batch.Complete
+		if name == storage.BatchSuccess {
+			callback = batch.Success
+		}
+		if callback == nil {
+			continue
+		}
+		if callback.Custom == nil {
+			callback.Custom = map[string]interface{}{}
+		}
+		callback.Custom["bid"] = bid
+		err = m.Push(callback)
+		if err != nil {
+			util.Error(fmt.Sprintf("Unable to push %s callback for batch %s", name, bid), err)
+		}
+	}
+}
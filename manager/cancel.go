@@ -0,0 +1,42 @@
+package manager
+
+import (
+	"encoding/json"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/storage"
+)
+
+func (m *manager) Cancel(jid string) (*client.Job, error) {
+	data, err := m.store.Scheduled().RemoveJid(jid)
+	if err == nil && data == nil {
+		data, err = m.store.Retries().RemoveJid(jid)
+	}
+	if err == nil && data == nil {
+		m.store.EachQueue(func(q storage.Queue) {
+			if err == nil && data == nil {
+				data, err = q.RemoveJid(jid)
+			}
+		})
+	}
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var job client.Job
+	err = json.Unmarshal(data, &job)
+	if err != nil {
+		return nil, err
+	}
+	m.abandon(&job)
+	return &job, nil
+}
+
+// Clean up after a job which will never run: release its unique
+// lock, count it as failed towards its batch and kill the jobs
+// which depend on it.
+func (m *manager) abandon(job *client.Job) {
+	m.releaseUnique(job)
+	m.batchJobDone(job, false)
+	m.dependencyDone(job, false)
+}
@@ -0,0 +1,46 @@
+package manager
+
+func (m *manager) maxConcurrency(queue string) int {
+	if m.opts.MaxConcurrency == nil {
+		return 0
+	}
+	return m.opts.MaxConcurrency(queue)
+}
+
+// Claim a slot for a job from the queue before popping it, false if
+// the queue is at its concurrency limit.  The job's reservation holds
+// the slot until it's acknowledged, failed or expires, if no job is
+// reserved the fetch must unclaim it.  Claiming first means
+// concurrent fetches can't overshoot the limit.
+func (m *manager) claim(queue string) bool {
+	limit := m.maxConcurrency(queue)
+	m.workingMutex.Lock()
+	defer m.workingMutex.Unlock()
+	if limit > 0 && m.busy[queue] >= limit {
+		return false
+	}
+	m.busy[queue]++
+	return true
+}
+
+func (m *manager) unclaim(queue string) {
+	m.workingMutex.Lock()
+	m.freeSlot(queue)
+	m.workingMutex.Unlock()
+}
+
+// The caller must hold workingMutex.
+func (m *manager) freeSlot(queue string) {
+	if m.busy[queue] <= 1 {
+		delete(m.busy, queue)
+		return
+	}
+	m.busy[queue]--
+}
+
+// The number of the queue's jobs reserved right now.
+func (m *manager) QueueBusy(queue string) int {
+	m.workingMutex.RLock()
+	defer m.workingMutex.RUnlock()
+	return m.busy[queue]
+}
@@ -0,0 +1,37 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimConcurrency(t *testing.T) {
+	m := &manager{
+		busy: map[string]int{},
+		opts: Options{
+			MaxConcurrency: func(queue string) int {
+				if queue == "imports" {
+					return 2
+				}
+				return 0
+			},
+		},
+	}
+
+	assert.True(t, m.claim("imports"))
+	assert.True(t, m.claim("imports"))
+	assert.False(t, m.claim("imports"))
+	assert.Equal(t, 2, m.QueueBusy("imports"))
+	for i := 0; i < 5; i++ {
+		assert.True(t, m.claim("default"))
+	}
+
+	m.unclaim("imports")
+	assert.True(t, m.claim("imports"))
+	m.unclaim("imports")
+	m.unclaim("imports")
+	m.unclaim("imports")
+	assert.Equal(t, 0, m.QueueBusy("imports"))
+	assert.NotContains(t, m.busy, "imports")
+}
@@ -0,0 +1,162 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/util"
+)
+
+// What happens to new dead jobs once the dead set is full, see
+// Options.DeadLimit.
+const (
+	DeadDropOldest = "drop_oldest"
+	DeadRefuse     = "refuse"
+)
+
+var (
+	// Dead jobs are pruned in batches with a pause between each
+	// so a large dead set doesn't monopolize Redis.
+	PruneBatchSize  = 1000
+	PruneBatchPause = 100 * time.Millisecond
+)
+
+// DeadRetention limits the dead jobs kept from a queue: those which
+// failed more than MaxAge ago are deleted, as are the oldest beyond
+// MaxCount.  Zero means no limit.
+type DeadRetention struct {
+	MaxAge   time.Duration
+	MaxCount int
+}
+
+func (m *manager) PruneDead(before time.Time) (int64, time.Time, error) {
+	return m.pruneDead(func(_ *client.Job, failedAt time.Time) bool {
+		return failedAt.Before(before)
+	})
+}
+
+func (m *manager) RetainDead(retention func(queue string) DeadRetention) (int64, time.Time, error) {
+	now := time.Now()
+	policies := map[string]DeadRetention{}
+	policy := func(queue string) DeadRetention {
+		p, ok := policies[queue]
+		if !ok {
+			p = retention(queue)
+			policies[queue] = p
+		}
+		return p
+	}
+
+	// count each capped queue's jobs first so we know how many of
+	// the oldest to delete
+	excess := map[string]int{}
+	for offset := 0; ; {
+		count, err := m.store.Dead().Page(offset, PruneBatchSize, func(_ int, entry storage.SortedEntry) error {
+			job, err := entry.Job()
+			if err != nil {
+				return err
+			}
+			if job.Failure != nil && job.Failure.FailedAt != "" && policy(job.Queue).MaxCount > 0 {
+				excess[job.Queue]++
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+		if count < PruneBatchSize {
+			break
+		}
+		offset += count
+	}
+	for queue, count := range excess {
+		excess[queue] = count - policy(queue).MaxCount
+	}
+
+	// the set is ordered by expiry, so oldest first
+	return m.pruneDead(func(job *client.Job, failedAt time.Time) bool {
+		if excess[job.Queue] > 0 {
+			excess[job.Queue]--
+			return true
+		}
+		p := policy(job.Queue)
+		return p.MaxAge > 0 && failedAt.Before(now.Add(-p.MaxAge))
+	})
+}
+
+func (m *manager) pruneDead(expired func(job *client.Job, failedAt time.Time) bool) (int64, time.Time, error) {
+	dead := m.store.Dead()
+
+	var oldest time.Time
+	pruned := int64(0)
+	offset := 0
+	for {
+		keys := [][]byte{}
+		count, err := dead.Page(offset, PruneBatchSize, func(_ int, entry storage.SortedEntry) error {
+			job, err := entry.Job()
+			if err != nil {
+				return err
+			}
+			// jobs without a failure are left for Purge to expire
+			if job.Failure == nil || job.Failure.FailedAt == "" {
+				return nil
+			}
+			failedAt, err := util.ParseTime(job.Failure.FailedAt)
+			if err != nil {
+				util.Warnf("Dead job %s has invalid failed_at %q", job.Jid, job.Failure.FailedAt)
+				return nil
+			}
+			if expired(job, failedAt) {
+				key, err := entry.Key()
+				if err != nil {
+					return err
+				}
+				keys = append(keys, key)
+				return nil
+			}
+			if oldest.IsZero() || failedAt.Before(oldest) {
+				oldest = failedAt
+			}
+			return nil
+		})
+		if err != nil {
+			return pruned, oldest, err
+		}
+
+		removed := 0
+		for _, key := range keys {
+			ok, err := dead.Remove(key)
+			if err != nil {
+				return pruned, oldest, err
+			}
+			if ok {
+				removed++
+			}
+		}
+		pruned += int64(removed)
+
+		if count < PruneBatchSize {
+			return pruned, oldest, nil
+		}
+		// removed entries shift the rest of the set down, even
+		// those which something else removed before we could
+		offset += count - len(keys)
+		time.Sleep(PruneBatchPause)
+	}
+}
+
+func (m *manager) deadLimit() (uint64, string) {
+	if m.opts.DeadLimit == nil {
+		return 0, DeadDropOldest
+	}
+	return m.opts.DeadLimit()
+}
+
+func (m *manager) TrimDead() (int64, error) {
+	max, overflow := m.deadLimit()
+	if max == 0 || overflow != DeadDropOldest {
+		return 0, nil
+	}
+	return m.store.Dead().Trim(max)
+}
@@ -0,0 +1,166 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPruneDead(t *testing.T) {
+	withRedis(t, "dead", func(t *testing.T, store storage.Store) {
+		store.Flush()
+		m := NewManager(store)
+
+		oldBatch := PruneBatchSize
+		oldPause := PruneBatchPause
+		PruneBatchSize = 7
+		PruneBatchPause = time.Millisecond
+		defer func() {
+			PruneBatchSize = oldBatch
+			PruneBatchPause = oldPause
+		}()
+
+		now := time.Now()
+		expected := 0
+		for i := 0; i < 100; i++ {
+			// spread the failures from 0 to 198 days ago, offset by
+			// an hour so none fall exactly on the cutoff
+			failedAt := now.Add(-time.Duration(i*2)*24*time.Hour - time.Hour)
+			if i*2 >= 90 {
+				expected++
+			}
+			job := client.NewJob("DeadJob", i)
+			job.Failure = &client.Failure{FailedAt: util.Thens(failedAt)}
+			addJob(t, store.Dead(), util.Thens(failedAt.Add(DeadTTL)), job)
+		}
+		assert.EqualValues(t, 100, store.Dead().Size())
+
+		count, oldest, err := m.PruneDead(now.Add(-90 * 24 * time.Hour))
+		assert.NoError(t, err)
+		assert.EqualValues(t, expected, count)
+		assert.EqualValues(t, 100-expected, store.Dead().Size())
+		assert.WithinDuration(t, now.Add(-88*24*time.Hour-time.Hour), oldest, time.Second)
+
+		_, err = store.Dead().Page(0, 100, func(_ int, entry storage.SortedEntry) error {
+			job, err := entry.Job()
+			assert.NoError(t, err)
+			failedAt, err := util.ParseTime(job.Failure.FailedAt)
+			assert.NoError(t, err)
+			assert.True(t, failedAt.After(now.Add(-90*24*time.Hour)))
+			return nil
+		})
+		assert.NoError(t, err)
+
+		count, _, err = m.PruneDead(now.Add(-90 * 24 * time.Hour))
+		assert.NoError(t, err)
+		assert.EqualValues(t, 0, count)
+	})
+}
+
+func TestRetainDead(t *testing.T) {
+	withRedis(t, "retain", func(t *testing.T, store storage.Store) {
+		store.Flush()
+		m := NewManager(store)
+
+		oldBatch := PruneBatchSize
+		oldPause := PruneBatchPause
+		PruneBatchSize = 7
+		PruneBatchPause = time.Millisecond
+		defer func() {
+			PruneBatchSize = oldBatch
+			PruneBatchPause = oldPause
+		}()
+
+		now := time.Now()
+		for _, queue := range []string{"default", "low", "billing"} {
+			for i := 0; i < 20; i++ {
+				// one failure every 10 days, newest first
+				failedAt := now.Add(-time.Duration(i*10)*24*time.Hour - time.Hour)
+				job := client.NewJob("DeadJob", queue, i)
+				job.Queue = queue
+				job.Failure = &client.Failure{FailedAt: util.Thens(failedAt)}
+				addJob(t, store.Dead(), util.Thens(failedAt.Add(DeadTTL)), job)
+			}
+		}
+		assert.EqualValues(t, 60, store.Dead().Size())
+
+		days := 24 * time.Hour
+		count, _, err := m.RetainDead(func(queue string) DeadRetention {
+			switch queue {
+			case "low":
+				return DeadRetention{MaxAge: 1 * days}
+			case "billing":
+				return DeadRetention{MaxAge: 180 * days, MaxCount: 5}
+			}
+			return DeadRetention{MaxAge: 90 * days}
+		})
+		assert.NoError(t, err)
+		// default keeps 0 to 80 days, low only the newest, billing
+		// the newest 5
+		assert.EqualValues(t, 11+19+15, count)
+
+		kept := map[string][]int{}
+		_, err = store.Dead().Page(0, 100, func(_ int, entry storage.SortedEntry) error {
+			job, err := entry.Job()
+			assert.NoError(t, err)
+			kept[job.Queue] = append(kept[job.Queue], int(job.Args[1].(float64)))
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Len(t, kept["default"], 9)
+		assert.Equal(t, []int{0}, kept["low"])
+		assert.ElementsMatch(t, []int{0, 1, 2, 3, 4}, kept["billing"])
+	})
+}
+
+func TestDeadLimit(t *testing.T) {
+	withRedis(t, "deadlimit", func(t *testing.T, store storage.Store) {
+		store.Flush()
+		max := uint64(5)
+		overflow := DeadDropOldest
+		died := 0
+		m := NewManagerWithOptions(store, Options{
+			DeadLimit: func() (uint64, string) { return max, overflow },
+			OnDeath:   func(*client.Job) { died++ },
+		}).(*manager)
+
+		now := time.Now()
+		for i := 0; i < 8; i++ {
+			job := client.NewJob("DeadJob", i)
+			assert.NoError(t, m.sendToMorgue(job))
+			// keep them in order
+			_, err := store.Dead().RemoveJid(job.Jid)
+			assert.NoError(t, err)
+			addJob(t, store.Dead(), util.Thens(now.Add(time.Duration(i)*time.Second)), job)
+		}
+		assert.EqualValues(t, 8, store.Dead().Size())
+		assert.Equal(t, 8, died)
+
+		count, err := m.TrimDead()
+		assert.NoError(t, err)
+		assert.EqualValues(t, 3, count)
+		assert.EqualValues(t, 5, store.Dead().Size())
+		_, err = store.Dead().Page(0, 0, func(_ int, entry storage.SortedEntry) error {
+			job, err := entry.Job()
+			assert.NoError(t, err)
+			assert.EqualValues(t, 3, job.Args[0])
+			return nil
+		})
+		assert.NoError(t, err)
+
+		overflow = DeadRefuse
+		assert.NoError(t, m.sendToMorgue(client.NewJob("DeadJob", 8)))
+		assert.EqualValues(t, 5, store.Dead().Size())
+		assert.Equal(t, 9, died)
+		max = 10
+		count, err = m.TrimDead()
+		assert.NoError(t, err)
+		assert.EqualValues(t, 0, count)
+		assert.NoError(t, m.sendToMorgue(client.NewJob("DeadJob", 8)))
+		assert.EqualValues(t, 6, store.Dead().Size())
+	})
+}
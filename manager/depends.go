@@ -0,0 +1,153 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/util"
+)
+
+// How long a finished job is remembered for the jobs which depend
+// on it and how long a job is held waiting for its dependencies.
+// A job still held after this long is killed by ReapHeldJobs.
+var DependencyTTL = 24 * time.Hour
+
+// The most jobs a single job may depend on.
+const MaxDependencies = 100
+
+func checkDependencies(job *client.Job) error {
+	if len(job.DependsOn) > MaxDependencies {
+		return fmt.Errorf("Jobs cannot depend on more than %d jobs", MaxDependencies)
+	}
+	seen := map[string]bool{}
+	for _, jid := range job.DependsOn {
+		if len(jid) < 8 {
+			return fmt.Errorf("Invalid depends_on jid %q", jid)
+		}
+		if jid == job.Jid {
+			return fmt.Errorf("Job %s cannot depend on itself", jid)
+		}
+		if seen[jid] {
+			return fmt.Errorf("Duplicate depends_on jid %s", jid)
+		}
+		seen[jid] = true
+	}
+	return nil
+}
+
+// Hold a prepared job until the jobs it depends on have succeeded.
+// Returns true if the job was held or, because one of them died,
+// killed, i.e. it mustn't be pushed now.
+func (m *manager) holdForDependencies(job *client.Job) (bool, error) {
+	if len(job.DependsOn) == 0 {
+		return false, nil
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return false, err
+	}
+	pending, err := m.store.HoldJob(job.Jid, data, job.DependsOn, DependencyTTL)
+	if err != nil {
+		return false, err
+	}
+	if pending < 0 {
+		return true, m.killDependent(job, "DependencyDied", "A job it depends on died")
+	}
+	return pending > 0, nil
+}
+
+// Hold the jobs which must wait for their dependencies and return
+// the rest to be pushed now.
+func (m *manager) holdAll(jobs []*client.Job) ([]*client.Job, error) {
+	now := make([]*client.Job, 0, len(jobs))
+	for _, job := range jobs {
+		held, err := m.holdForDependencies(job)
+		if err != nil {
+			return nil, err
+		}
+		if !held {
+			now = append(now, job)
+		}
+	}
+	return now, nil
+}
+
+// Record that a job has succeeded or failed for the last time and
+// push, or kill, the held jobs which depend on it.
+func (m *manager) dependencyDone(job *client.Job, succeeded bool) {
+	state := storage.DependencySucceeded
+	if !succeeded {
+		state = storage.DependencyDied
+	}
+	released, err := m.store.DependencyDone(job.Jid, state, DependencyTTL)
+	if err != nil {
+		util.Error("Unable to release jobs depending on "+job.Jid, err)
+		return
+	}
+
+	for _, data := range released {
+		var held client.Job
+		err := json.Unmarshal(data, &held)
+		if err == nil {
+			if succeeded {
+				err = m.pushReleased(&held)
+			} else {
+				err = m.killDependent(&held, "DependencyDied", fmt.Sprintf("Job %s, which it depends on, died", job.Jid))
+			}
+		}
+		if err != nil {
+			util.Error(fmt.Sprintf("Unable to release job %s depending on %s", held.Jid, job.Jid), err)
+		}
+	}
+}
+
+func (m *manager) pushReleased(job *client.Job) error {
+	err := m.lockUnique(job)
+	if err != nil {
+		return err
+	}
+	err = m.pushAll([]*client.Job{job})
+	if err != nil {
+		m.releaseUnique(job)
+	}
+	return err
+}
+
+// A job whose dependency died, or which waited too long for them,
+// can never run so it goes straight to the morgue, taking the jobs
+// which depend on it with it.
+func (m *manager) killDependent(job *client.Job, errorType string, reason string) error {
+	job.Failure = &client.Failure{
+		FailedAt:     util.Nows(),
+		ErrorType:    errorType,
+		ErrorMessage: reason,
+	}
+	err := m.sendToMorgue(job)
+	if err != nil {
+		return err
+	}
+	m.abandon(job)
+	return m.pushSuccessors(job.ThenOnFail)
+}
+
+func (m *manager) ReapHeldJobs() (int, error) {
+	expired, err := m.store.RemoveExpiredHolds()
+	if err != nil {
+		return 0, err
+	}
+	for _, data := range expired {
+		var held client.Job
+		err := json.Unmarshal(data, &held)
+		if err == nil {
+			util.Warnw("Job waited too long for its dependencies, sending it to the dead set", map[string]interface{}{"jid": held.Jid, "depends_on": held.DependsOn})
+			err = m.killDependent(&held, "DependencyExpired", fmt.Sprintf("Its dependencies didn't all succeed within %v", DependencyTTL))
+		}
+		if err != nil {
+			util.Error("Unable to kill expired held job "+held.Jid, err)
+		}
+	}
+	return len(expired), nil
+}
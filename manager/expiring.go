@@ -0,0 +1,33 @@
+package manager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/util"
+)
+
+// Has the job's expires_at passed?  prepare rejects invalid
+// timestamps so they're treated as never expiring.
+func expired(job *client.Job, now time.Time) bool {
+	if job.ExpiresAt == "" {
+		return false
+	}
+	t, err := util.ParseTime(job.ExpiresAt)
+	if err != nil {
+		return false
+	}
+	return !now.Before(t)
+}
+
+// Drop a job which expired while it was enqueued rather than
+// reserve it.
+func (m *manager) discardExpired(job *client.Job) bool {
+	if !expired(job, time.Now()) {
+		return false
+	}
+	util.Debugw(fmt.Sprintf("Expired at %s, discarding", job.ExpiresAt), jobFields(job))
+	m.abandon(job)
+	return true
+}
@@ -0,0 +1,24 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobExpired(t *testing.T) {
+	now := time.Now()
+	job := client.NewJob("SendCode", 1)
+	assert.False(t, expired(job, now))
+
+	job.ExpiresAt = util.Thens(now.Add(time.Minute))
+	assert.False(t, expired(job, now))
+	assert.True(t, expired(job, now.Add(time.Minute)))
+	assert.True(t, expired(job, now.Add(time.Hour)))
+
+	job.ExpiresAt = "soon"
+	assert.False(t, expired(job, now))
+}
@@ -0,0 +1,72 @@
+package manager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/util"
+)
+
+// QueueFullError is returned when a push would grow a queue past its
+// limit, see Options.QueueLimit.
+type QueueFullError struct {
+	Queue string
+	Limit uint64
+}
+
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("Queue %s is full, limit is %d", e.Queue, e.Limit)
+}
+
+// How often a push waiting for room checks the queue size.
+var queueFullPoll = 50 * time.Millisecond
+
+// Scheduled jobs don't count against a limit until they're enqueued.
+func isDue(job *client.Job) bool {
+	if job.At == "" {
+		return true
+	}
+	t, _ := util.ParseTime(job.At)
+	return !t.After(time.Now())
+}
+
+// Check the queue has room for n more jobs, waiting as long as the
+// limit allows.  Concurrent pushes may overshoot the limit slightly.
+func (m *manager) checkLimit(queue string, n uint64) error {
+	if m.opts.QueueLimit == nil {
+		return nil
+	}
+	limit, wait := m.opts.QueueLimit(queue)
+	return m.waitForRoom(queue, n, limit, wait)
+}
+
+// Like checkLimit but never waits.
+func (m *manager) checkLimitNow(queue string, n uint64) error {
+	if m.opts.QueueLimit == nil {
+		return nil
+	}
+	limit, _ := m.opts.QueueLimit(queue)
+	return m.waitForRoom(queue, n, limit, 0)
+}
+
+func (m *manager) waitForRoom(queue string, n uint64, limit uint64, wait time.Duration) error {
+	if limit == 0 {
+		return nil
+	}
+	q, err := m.store.GetQueue(queue)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		if q.Size()+n <= limit {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return &QueueFullError{Queue: queue, Limit: limit}
+		}
+		time.Sleep(queueFullPoll)
+	}
+}
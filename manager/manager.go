@@ -20,11 +20,92 @@ const (
 
 	// Save dead jobs for 180 days, after that they will be purged
 	DeadTTL = 180 * 24 * time.Hour
+
+	// The maximum number of queues a single PushTo can target.
+	MaxPushToQueues = 100
+
+	// The maximum number of jobs a single PushBulk can push.
+	MaxPushBulkJobs = 1000
+
+	// The maximum number of jobs a single FetchN can reserve.
+	MaxFetchJobs = 100
+
+	// The maximum number of successors in a job chain
+	// (see client.Job.Then) unless configured otherwise.
+	DefaultMaxChainDepth = 10
 )
 
+// Options tune a manager, see NewManagerWithOptions.
+type Options struct {
+	// Reject jobs which would start a chain of more than this
+	// many successors, DefaultMaxChainDepth if 0.
+	MaxChainDepth int
+
+	// QueueLimit returns the most jobs the queue may hold, 0 for no
+	// limit, and how long a push may wait for room.  Pushes beyond
+	// the limit fail with a QueueFullError.  Successors and retries
+	// aren't limited.
+	QueueLimit func(queue string) (uint64, time.Duration)
+
+	// Throttle returns how fast jobs may be fetched from the queue,
+	// the zero Throttle for no limit.  Throttled queues are skipped
+	// by fetches until they have a token again.
+	Throttle func(queue string) Throttle
+
+	// MaxConcurrency returns how many of the queue's jobs may be
+	// reserved at once across all workers, 0 for no limit.
+	MaxConcurrency func(queue string) int
+
+	// Backoff returns how jobs of the jobtype wait between retries,
+	// unless the job gives its own, the zero Backoff for the usual
+	// exponential backoff.
+	Backoff func(jobtype string) Backoff
+
+	// RetryJitter returns the random delay added to every retry's
+	// backoff, except for retries at a time given by FAIL.
+	RetryJitter func() Jitter
+
+	// DeadLimit returns the most jobs the dead set may hold, 0 for no
+	// limit, and what to do once it's full: DeadDropOldest leaves
+	// TrimDead to delete the oldest, DeadRefuse discards new deaths.
+	DeadLimit func() (uint64, string)
+
+	// OnDeath is called with each job added to the dead set, or
+	// discarded because it's full, see DeadRefuse.  It must not
+	// block.
+	OnDeath func(job *client.Job)
+
+	// OnBatchComplete is called once each batch's jobs have all
+	// run, whether or not they succeeded.  It must not block.
+	OnBatchComplete func(status *BatchStatus)
+
+	// Router may send each pushed job to another queue before it's
+	// checked against the queue's limit or enqueued.
+	Router Router
+}
+
 type Manager interface {
 	Push(job *client.Job) error
 
+	// PushTo pushes a copy of the job to each of the given queues.
+	// Each copy is given a new, unique JID.  Returns the JIDs in
+	// queue order.  The copies are enqueued in a single transaction
+	// but a job with a future At is scheduled one copy at a time.
+	PushTo(job *client.Job, queues ...string) ([]string, error)
+
+	// PushBulk pushes many jobs at once, those to run now in a single
+	// transaction and those with a future At one by one.  Invalid
+	// jobs are skipped, the returned slice has the error for each job
+	// in order, nil for those pushed.
+	PushBulk(jobs []*client.Job) ([]error, error)
+
+	// PushIf pushes the job only if the condition holds when
+	// the job is enqueued.  Returns false if the push was skipped.
+	// Scheduled jobs can't be pushed conditionally.  A job with
+	// UniqueType set is also skipped while another such job of its
+	// queue and jobtype is enqueued, running or retrying.
+	PushIf(job *client.Job, cond storage.PushCondition) (bool, error)
+
 	// Dispatch operations:
 	//
 	//  - Basic dequeue
@@ -50,18 +131,103 @@ type Manager interface {
 	// If all nil, the connection registers itself, blocking for a job.
 	Fetch(ctx context.Context, wid string, queues ...string) (*client.Job, error)
 
+	// FetchN reserves up to count jobs, taking from the queues in
+	// order and blocking like Fetch only when all are empty.  Each
+	// job is reserved as it's popped so once one is, it's returned:
+	// an error only ends the fetch early and is logged, it's only
+	// returned if no job was reserved.
+	FetchN(ctx context.Context, wid string, count int, queues ...string) ([]*client.Job, error)
+
+	// FetchWait is FetchN without the time limit: it keeps waiting
+	// until a job is pushed to one of the queues or ctx is done,
+	// returning nil in the latter case.
+	FetchWait(ctx context.Context, wid string, count int, queues ...string) ([]*client.Job, error)
+
+	// QueueRates returns how fast jobs are pushed to and fetched
+	// from the queue by this server.
+	QueueRates(queue string) QueueRates
+
+	// QueueBusy returns how many of the queue's jobs are reserved
+	// by workers right now.
+	QueueBusy(queue string) int
+
+	// Batches group jobs, see client.Batch.  Jobs join a batch by
+	// being pushed with its bid while it's open.
+	NewBatch(batch *client.Batch) error
+	OpenBatch(bid string) error
+	CommitBatch(bid string) error
+	BatchStatus(bid string) (*BatchStatus, error)
+
+	// Workers report the progress of the jobs they're running,
+	// producers read it back for as long as ProgressTTL.
+	SetProgress(progress *Progress) error
+	GetProgress(jids ...string) (map[string]*Progress, error)
+
+	// Results are stored, for ResultTTL, by workers when they ACK
+	// a job and read back by producers.  GetResult returns nil if
+	// the job hasn't stored one.
+	SetResult(jid string, result json.RawMessage) error
+	GetResult(jid string) (*JobResult, error)
+
+	// Acknowledge fails rather than acknowledges a job which ran
+	// longer than its timeout_seconds, returning ErrJobTimedOut
+	// along with the job.
 	Acknowledge(jid string) (*client.Job, error)
 
 	Fail(fail *FailPayload) error
 
+	// Kill fails a reserved job without retrying it, so it goes
+	// straight to the dead set, e.g. because its args can't be
+	// decoded to hand to a worker.
+	Kill(fail *FailPayload) error
+
+	// Cancel removes a job which is waiting to run, in a queue, the
+	// scheduled set or the retry set, so it never runs.  Returns nil
+	// if there's no such job, e.g. because it's been fetched.
+	Cancel(jid string) (*client.Job, error)
+
+	// JobState looks for a job in the working set, the scheduled,
+	// retry and dead sets, among the jobs held for their
+	// dependencies and finally in every queue.  A job which moves
+	// while it's being looked for may not be found.
+	JobState(jid string) (*JobState, error)
+
+	// Mutate kills, requeues or discards the jobs in the retry,
+	// scheduled or dead set which match a filter, returning how many
+	// it changed.
+	Mutate(mut *Mutation) (int, error)
+
 	WorkingCount() int
 
 	ReapExpiredJobs(timestamp string) (int, error)
 
+	// ReapHeldJobs sends the jobs which have waited longer than
+	// DependencyTTL for their dependencies to the dead set.
+	ReapHeldJobs() (int, error)
+
+	// FailWorkerJobs fails every job currently reserved by the given
+	// worker process, e.g. because it was forcibly disconnected.
+	FailWorkerJobs(wid string) (int, error)
+
 	// Purge deletes all dead jobs
 	Purge() (int64, error)
 
-	// EnqueueScheduledJobs enqueues scheduled jobs
+	// PruneDead deletes dead jobs which failed before the given time
+	// and returns how many were deleted along with the failed_at of
+	// the oldest job remaining, zero if there are none.
+	PruneDead(before time.Time) (int64, time.Time, error)
+
+	// RetainDead deletes dead jobs outside their queue's retention,
+	// returning the same as PruneDead.
+	RetainDead(retention func(queue string) DeadRetention) (int64, time.Time, error)
+
+	// TrimDead deletes the oldest dead jobs beyond the DeadLimit when
+	// it drops the oldest, returning how many were deleted.
+	TrimDead() (int64, error)
+
+	// EnqueueScheduledJobs enqueues scheduled jobs.  It, RetryJobs
+	// and Purge return ErrMoreDue if a large backlog is left for the
+	// next call, see ScheduleTimeBudget.
 	EnqueueScheduledJobs() (int64, error)
 
 	// RetryJobs enqueues failed jobs
@@ -69,17 +235,34 @@ type Manager interface {
 
 	BusyCount(wid string) int
 
+	// AddMiddleware appends fn to the chain of the given type, one of
+	// MiddlewarePush, MiddlewareSchedule, MiddlewareFetch,
+	// MiddlewareAck, MiddlewareFail or MiddlewareKill.  Add middleware
+	// before the manager is used, chains aren't safe to change while
+	// jobs are flowing.
 	AddMiddleware(fntype string, fn MiddlewareFunc)
 }
 
 func NewManager(s storage.Store) Manager {
+	return NewManagerWithOptions(s, Options{})
+}
+
+func NewManagerWithOptions(s storage.Store, opts Options) Manager {
+	if opts.MaxChainDepth == 0 {
+		opts.MaxChainDepth = DefaultMaxChainDepth
+	}
+
 	m := &manager{
-		store:      s,
-		workingMap: map[string]*Reservation{},
-		pushChain:  make(MiddlewareChain, 0),
-		failChain:  make(MiddlewareChain, 0),
-		ackChain:   make(MiddlewareChain, 0),
-		fetchChain: make(MiddlewareChain, 0),
+		store:         s,
+		opts:          opts,
+		workingMap:    map[string]*Reservation{},
+		busy:          map[string]int{},
+		pushChain:     make(MiddlewareChain, 0),
+		failChain:     make(MiddlewareChain, 0),
+		ackChain:      make(MiddlewareChain, 0),
+		fetchChain:    make(MiddlewareChain, 0),
+		killChain:     make(MiddlewareChain, 0),
+		scheduleChain: make(MiddlewareChain, 0),
 	}
 	m.loadWorkingSet()
 	return m
@@ -87,14 +270,18 @@ func NewManager(s storage.Store) Manager {
 
 func (m *manager) AddMiddleware(fntype string, fn MiddlewareFunc) {
 	switch fntype {
-	case "push":
+	case MiddlewarePush:
 		m.pushChain = append(m.pushChain, fn)
-	case "ack":
+	case MiddlewareAck:
 		m.ackChain = append(m.ackChain, fn)
-	case "fail":
+	case MiddlewareFail:
 		m.failChain = append(m.failChain, fn)
-	case "fetch":
+	case MiddlewareFetch:
 		m.fetchChain = append(m.fetchChain, fn)
+	case MiddlewareKill:
+		m.killChain = append(m.killChain, fn)
+	case MiddlewareSchedule:
+		m.scheduleChain = append(m.scheduleChain, fn)
 	default:
 		panic(fmt.Sprintf("Unknown middleware type: %s", fntype))
 	}
@@ -102,6 +289,7 @@ func (m *manager) AddMiddleware(fntype string, fn MiddlewareFunc) {
 
 type manager struct {
 	store storage.Store
+	opts  Options
 
 	// Hold the working set in memory so we don't need to burn CPU
 	// when doing 1000s of jobs/sec.
@@ -113,9 +301,94 @@ type manager struct {
 	fetchChain   MiddlewareChain
 	failChain    MiddlewareChain
 	ackChain     MiddlewareChain
+	killChain    MiddlewareChain
+	// jobs pushed with a future At, see MiddlewareSchedule
+	scheduleChain MiddlewareChain
+
+	rates     queueRates
+	throttles queueThrottles
+
+	// reservations and in-flight fetches per queue, guarded by
+	// workingMutex, see claim
+	busy map[string]int
+
+	// closed by the next push to wake up FetchWait callers
+	pushedMutex sync.Mutex
+	pushedCh    chan struct{}
 }
 
 func (m *manager) Push(job *client.Job) error {
+	err := m.prepare(job)
+	if err != nil {
+		return err
+	}
+
+	batch := []*client.Job{job}
+	err = m.joinBatches(batch)
+	if err != nil {
+		return err
+	}
+	held, err := m.holdForDependencies(job)
+	if held {
+		return err
+	}
+	if err == nil {
+		err = m.pushPrepared(job)
+	}
+	if err != nil {
+		m.leaveBatches(batchCounts(batch))
+	}
+	return err
+}
+
+// Schedule or enqueue a job which has passed prepare.
+func (m *manager) pushPrepared(job *client.Job) error {
+	if job.At != "" {
+		// already validated by prepare
+		t, _ := util.ParseTime(job.At)
+		if t.After(time.Now()) {
+			// scheduler for later
+			err := m.lockUnique(job)
+			if err != nil {
+				return err
+			}
+			err = m.scheduleLater(job)
+			if err != nil {
+				m.releaseUnique(job)
+			}
+			return err
+		}
+	}
+
+	// enqueue immediately
+	err := m.checkLimit(job.Queue, 1)
+	if err != nil {
+		return err
+	}
+	err = m.lockUnique(job)
+	if err != nil {
+		return err
+	}
+	err = m.enqueue(job)
+	if err != nil {
+		m.releaseUnique(job)
+	}
+	return err
+}
+
+// Add a job to the scheduled set to be enqueued at its At.
+func (m *manager) scheduleLater(job *client.Job) error {
+	return callMiddleware(m.scheduleChain, job, func() error {
+		data, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		return m.store.Scheduled().AddElement(job.At, job.Jid, data)
+	})
+}
+
+// validate the job and any successors and fill in missing defaults
+func (m *manager) prepare(job *client.Job) error {
 	if job.Jid == "" || len(job.Jid) < 8 {
 		return fmt.Errorf("All jobs must have a reasonable jid parameter")
 	}
@@ -133,6 +406,15 @@ func (m *manager) Push(job *client.Job) error {
 	if job.Queue == "" {
 		job.Queue = "default"
 	}
+	if m.opts.Router != nil {
+		queue, err := m.opts.Router.Route(job)
+		if err != nil {
+			return err
+		}
+		if queue != "" {
+			job.Queue = queue
+		}
+	}
 
 	// Priority can never be negative because of signedness
 	if job.Priority > 9 || job.Priority == 0 {
@@ -140,69 +422,484 @@ func (m *manager) Push(job *client.Job) error {
 	}
 
 	if job.At != "" {
-		t, err := util.ParseTime(job.At)
+		_, err := util.ParseTime(job.At)
 		if err != nil {
 			return fmt.Errorf("Invalid timestamp for 'at': '%s'", job.At)
 		}
+	}
 
-		if t.After(time.Now()) {
-			data, err := json.Marshal(job)
+	if job.Backoff != "" {
+		_, err := ParseBackoff(job.Backoff)
+		if err != nil {
+			return err
+		}
+	}
+
+	if job.ExpiresAt != "" {
+		_, err := util.ParseTime(job.ExpiresAt)
+		if err != nil {
+			return fmt.Errorf("Invalid timestamp for 'expires_at': '%s'", job.ExpiresAt)
+		}
+	}
+
+	err := checkUnique(job)
+	if err != nil {
+		return err
+	}
+	err = checkDependencies(job)
+	if err != nil {
+		return err
+	}
+
+	if job.OnSuccess != nil {
+		job.Then = append(job.Then, job.OnSuccess)
+		job.OnSuccess = nil
+	}
+	if job.ChainDepth > m.opts.MaxChainDepth {
+		return fmt.Errorf("Job chains cannot be more than %d jobs deep", m.opts.MaxChainDepth)
+	}
+	for _, successors := range [][]*client.Job{job.Then, job.ThenOnFail} {
+		for _, next := range successors {
+			if next == nil {
+				return fmt.Errorf("Successor jobs cannot be null")
+			}
+			if next.Jid == "" {
+				next.Jid = util.RandomJid()
+			}
+			if next.Bid != "" {
+				return fmt.Errorf("Successor jobs cannot belong to a batch")
+			}
+			next.ChainDepth = job.ChainDepth + 1
+			err := m.prepare(next)
 			if err != nil {
 				return err
 			}
+		}
+	}
+	return nil
+}
 
-			// scheduler for later
-			return m.store.Scheduled().AddElement(job.At, job.Jid, data)
+func (m *manager) PushTo(job *client.Job, queues ...string) ([]string, error) {
+	if len(queues) == 0 {
+		return nil, fmt.Errorf("PushTo must be called with one or more queue names")
+	}
+	if len(queues) > MaxPushToQueues {
+		return nil, fmt.Errorf("PushTo accepts at most %d queues, got %d", MaxPushToQueues, len(queues))
+	}
+
+	// every copy gets a fresh JID so the template doesn't need one
+	job.Jid = util.RandomJid()
+	err := m.prepare(job)
+	if err != nil {
+		return nil, err
+	}
+	if job.UniqueFor != 0 {
+		return nil, fmt.Errorf("PushTo can't push unique jobs, every copy has the same args")
+	}
+	if job.Bid != "" {
+		return nil, fmt.Errorf("PushTo can't push batch jobs")
+	}
+	template, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+
+	copies := make([]*client.Job, len(queues))
+	jids := make([]string, len(queues))
+	seen := map[string]bool{}
+	for idx, qname := range queues {
+		if seen[qname] {
+			return nil, fmt.Errorf("Duplicate queue name %s", qname)
 		}
+		seen[qname] = true
+
+		var cp client.Job
+		err := json.Unmarshal(template, &cp)
+		if err != nil {
+			return nil, err
+		}
+		cp.Jid = util.RandomJid()
+		cp.Queue = qname
+		renewSuccessorJids(&cp)
+		copies[idx] = &cp
+		jids[idx] = cp.Jid
 	}
 
-	// enqueue immediately
-	return m.enqueue(job)
+	if isDue(job) {
+		for _, qname := range queues {
+			err = m.checkLimit(qname, 1)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	copies, err = m.holdAll(copies)
+	if err != nil {
+		return nil, err
+	}
+	err = m.pushAll(copies)
+	if err != nil {
+		return nil, err
+	}
+	return jids, nil
 }
 
-func (m *manager) enqueue(job *client.Job) error {
-	q, err := m.store.GetQueue(job.Queue)
+func (m *manager) PushBulk(jobs []*client.Job) ([]error, error) {
+	if len(jobs) > MaxPushBulkJobs {
+		return nil, fmt.Errorf("PushBulk accepts at most %d jobs, got %d", MaxPushBulkJobs, len(jobs))
+	}
+
+	results := make([]error, len(jobs))
+	valid := make([]*client.Job, 0, len(jobs))
+	seen := map[string]bool{}
+	pending := map[string]uint64{}
+	for idx, job := range jobs {
+		if job == nil {
+			results[idx] = fmt.Errorf("Jobs cannot be null")
+			continue
+		}
+		err := m.prepare(job)
+		if err != nil {
+			results[idx] = err
+			continue
+		}
+		if seen[job.Jid] {
+			results[idx] = fmt.Errorf("Duplicate jid %s", job.Jid)
+			continue
+		}
+		if isDue(job) {
+			// don't wait, but count this call's earlier jobs
+			// for the same queue
+			err = m.checkLimitNow(job.Queue, pending[job.Queue]+1)
+			if err != nil {
+				results[idx] = err
+				continue
+			}
+		}
+		err = m.lockUnique(job)
+		if err != nil {
+			results[idx] = err
+			continue
+		}
+		err = m.joinBatches([]*client.Job{job})
+		if err != nil {
+			m.releaseUnique(job)
+			results[idx] = err
+			continue
+		}
+		held, err := m.holdForDependencies(job)
+		if err != nil && !held {
+			m.releaseUnique(job)
+			m.leaveBatches(batchCounts([]*client.Job{job}))
+			results[idx] = err
+			continue
+		}
+		if held {
+			// locked again once it's released
+			m.releaseUnique(job)
+			seen[job.Jid] = true
+			results[idx] = err
+			continue
+		}
+		if isDue(job) {
+			pending[job.Queue]++
+		}
+		seen[job.Jid] = true
+		valid = append(valid, job)
+	}
+
+	err := m.pushAll(valid)
+	if err != nil {
+		for _, job := range valid {
+			m.releaseUnique(job)
+		}
+		m.leaveBatches(batchCounts(valid))
+		return nil, err
+	}
+	return results, nil
+}
+
+// Copies of a job need their own successors too.
+func renewSuccessorJids(job *client.Job) {
+	for _, successors := range [][]*client.Job{job.Then, job.ThenOnFail} {
+		for _, next := range successors {
+			next.Jid = util.RandomJid()
+			renewSuccessorJids(next)
+		}
+	}
+}
+
+// Push already prepared jobs.  Jobs to be run now are enqueued in
+// a single transaction, any with a future At are scheduled one by
+// one before it, so an error can leave some of them scheduled.
+func (m *manager) pushAll(jobs []*client.Job) error {
+	entries := make([]storage.BulkEntry, 0, len(jobs))
+	for _, job := range jobs {
+		if job.At != "" {
+			t, _ := util.ParseTime(job.At)
+			if t.After(time.Now()) {
+				err := m.scheduleLater(job)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		job.EnqueuedAt = util.Nows()
+		err := callMiddleware(m.pushChain, job, func() error {
+			data, err := json.Marshal(job)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, storage.BulkEntry{Queue: job.Queue, Priority: job.Priority, Data: data})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+	err := m.store.PushBulk(entries)
 	if err != nil {
 		return err
 	}
+	for _, entry := range entries {
+		m.rates.enqueued(entry.Queue, 1)
+	}
+	m.pushed()
+	return nil
+}
+
+// Push the successors of a finished job, see client.Job.Then.
+// Successors are subject to queue limits and unique locks like any
+// other push; a duplicate of a unique job is dropped rather than
+// failing the job which came before it.
+func (m *manager) pushSuccessors(jobs []*client.Job) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+	locked := make([]*client.Job, 0, len(jobs))
+	release := func() {
+		for _, job := range locked {
+			m.releaseUnique(job)
+		}
+	}
+	pending := map[string]uint64{}
+	for _, job := range jobs {
+		err := m.prepare(job)
+		if err != nil {
+			release()
+			return err
+		}
+		if isDue(job) {
+			err = m.checkLimit(job.Queue, pending[job.Queue]+1)
+			if err != nil {
+				release()
+				return err
+			}
+		}
+		err = m.lockUnique(job)
+		if _, ok := err.(*NotUniqueError); ok {
+			util.Warnw("Dropping duplicate successor job", map[string]interface{}{"jid": job.Jid, "jobtype": job.Type, "error": err.Error()})
+			continue
+		}
+		if err != nil {
+			release()
+			return err
+		}
+		if isDue(job) {
+			pending[job.Queue]++
+		}
+		locked = append(locked, job)
+	}
+
+	now := make([]*client.Job, 0, len(locked))
+	for _, job := range locked {
+		held, err := m.holdForDependencies(job)
+		if err != nil && !held {
+			release()
+			return err
+		}
+		if held {
+			// locked again once it's released
+			m.releaseUnique(job)
+			continue
+		}
+		now = append(now, job)
+	}
+
+	err := m.pushAll(now)
+	if err != nil {
+		for _, job := range now {
+			m.releaseUnique(job)
+		}
+	}
+	return err
+}
+
+func (m *manager) PushIf(job *client.Job, cond storage.PushCondition) (bool, error) {
+	err := m.prepare(job)
+	if err != nil {
+		return false, err
+	}
+	if job.At != "" {
+		t, _ := util.ParseTime(job.At)
+		if t.After(time.Now()) {
+			return false, fmt.Errorf("Scheduled jobs cannot be pushed conditionally")
+		}
+	}
+	if job.Bid != "" {
+		return false, fmt.Errorf("Batch jobs cannot be pushed conditionally")
+	}
+	if len(job.DependsOn) > 0 {
+		return false, fmt.Errorf("Jobs with dependencies cannot be pushed conditionally")
+	}
+
+	err = m.checkLimit(job.Queue, 1)
+	if err != nil {
+		return false, err
+	}
 
 	job.EnqueuedAt = util.Nows()
-	data, err := json.Marshal(job)
+	err = m.lockUnique(job)
 	if err != nil {
+		return false, err
+	}
+	if job.UniqueType {
+		locked, err := m.lockUniqueType(job)
+		if err != nil || !locked {
+			job.UniqueType = false
+			m.releaseUnique(job)
+			return false, err
+		}
+	}
+	pushed := false
+	err = callMiddleware(m.pushChain, job, func() error {
+		data, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		entry := storage.BulkEntry{Queue: job.Queue, Priority: job.Priority, Data: data}
+		pushed, err = m.store.PushIf(cond, entry)
 		return err
+	})
+	if !pushed {
+		m.releaseUnique(job)
+	}
+	if pushed {
+		m.rates.enqueued(job.Queue, 1)
+		m.pushed()
 	}
+	return pushed, err
+}
 
-	return callMiddleware(m.pushChain, job, func() error {
+func (m *manager) enqueue(job *client.Job) error {
+	job.EnqueuedAt = util.Nows()
+	err := callMiddleware(m.pushChain, job, func() error {
+		q, err := m.store.GetQueue(job.Queue)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
 		return q.Push(job.Priority, data)
 	})
+	if err != nil {
+		return err
+	}
+	m.rates.enqueued(job.Queue, 1)
+	m.pushed()
+	return nil
+}
+
+// A channel which is closed by the next push to any queue.
+func (m *manager) nextPush() <-chan struct{} {
+	m.pushedMutex.Lock()
+	defer m.pushedMutex.Unlock()
+	if m.pushedCh == nil {
+		m.pushedCh = make(chan struct{})
+	}
+	return m.pushedCh
+}
+
+func (m *manager) pushed() {
+	m.pushedMutex.Lock()
+	if m.pushedCh != nil {
+		close(m.pushedCh)
+		m.pushedCh = nil
+	}
+	m.pushedMutex.Unlock()
 }
 
 func (m *manager) Fetch(ctx context.Context, wid string, queues ...string) (*client.Job, error) {
+	names, err := m.expandQueues(queues)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 && len(queues) > 0 {
+		awaitQueues(ctx, queueWait)
+		return nil, nil
+	}
+	queues = names
+
 restart:
 	var first storage.Queue
+	wait := queueWait
 
-	for idx, qname := range queues {
+	for _, qname := range queues {
 		q, err := m.store.GetQueue(qname)
 		if err != nil {
 			return nil, err
 		}
+		if q.IsPaused() || !m.claim(qname) {
+			continue
+		}
+		ok, next := m.takeToken(qname)
+		if !ok {
+			m.unclaim(qname)
+			if next < wait {
+				wait = next
+			}
+			continue
+		}
 
-		data, err := q.Pop()
+		data, popped, err := m.pop(q, wid)
 		if err != nil {
+			m.unclaim(qname)
+			m.returnToken(qname)
 			return nil, err
 		}
 		if data != nil {
 			var job client.Job
 			err = json.Unmarshal(data, &job)
 			if err != nil {
+				m.unreserve(popped, job.Jid)
+				m.unclaim(qname)
 				return nil, err
 			}
+			if m.discardExpired(&job) {
+				m.unreserve(popped, job.Jid)
+				m.unclaim(qname)
+				m.returnToken(qname)
+				goto restart
+			}
 			err = callMiddleware(m.fetchChain, &job, func() error {
-				return m.reserve(wid, &job)
+				return m.reserve(wid, &job, popped)
 			})
+			if err != nil {
+				m.unreserve(popped, job.Jid)
+				m.unclaim(qname)
+			}
 			if h, ok := err.(halt); ok {
 				// middleware halted the fetch, for whatever reason
-				util.Infof("JID %s: %s", job.Jid, h.Error())
+				util.Infow(h.Error(), jobFields(&job))
 				goto restart
 			}
 			if err != nil {
@@ -210,35 +907,57 @@ restart:
 			}
 			return &job, nil
 		}
-		if idx == 0 {
+		m.unclaim(qname)
+		m.returnToken(qname)
+		if first == nil {
 			first = q
 		}
 	}
 
-	if first == nil {
+	if len(queues) == 0 {
 		return nil, fmt.Errorf("Fetch must be called with one or more queue names")
 	}
+	if first == nil || !m.claim(first.Name()) {
+		// every queue is paused, throttled or at its concurrency
+		awaitQueues(ctx, wait)
+		return nil, nil
+	}
 
 	// scanned through our queues, no jobs were available
 	// we should block for a moment, awaiting a job to be
 	// pushed.  this allows us to pick up new jobs in µs
-	// rather than seconds.
+	// rather than seconds.  Redis can't add a job it pops
+	// while blocking to the working set so it's reserved
+	// afterwards.
 	data, err := first.BPop(ctx)
+	if err != nil || data == nil {
+		m.unclaim(first.Name())
+	}
 	if err != nil {
 		return nil, err
 	}
 	if data != nil {
+		m.spendToken(first.Name())
 		var job client.Job
 		err = json.Unmarshal(data, &job)
 		if err != nil {
+			m.unclaim(first.Name())
 			return nil, err
 		}
+		if m.discardExpired(&job) {
+			m.unclaim(first.Name())
+			m.returnToken(first.Name())
+			goto restart
+		}
 		err = callMiddleware(m.fetchChain, &job, func() error {
-			return m.reserve(wid, &job)
+			return m.reserve(wid, &job, nil)
 		})
+		if err != nil {
+			m.unclaim(first.Name())
+		}
 		if h, ok := err.(halt); ok {
 			// middleware halted the fetch, for whatever reason
-			util.Debugf("JID %s: %s", job.Jid, h.Error())
+			util.Debugw(h.Error(), jobFields(&job))
 			goto restart
 		}
 		if err != nil {
@@ -249,3 +968,148 @@ restart:
 
 	return nil, nil
 }
+
+func (m *manager) FetchN(ctx context.Context, wid string, count int, queues ...string) ([]*client.Job, error) {
+	if count < 1 || count > MaxFetchJobs {
+		return nil, fmt.Errorf("FetchN count must be between 1 and %d, got %d", MaxFetchJobs, count)
+	}
+
+	job, err := m.Fetch(ctx, wid, queues...)
+	if err != nil || job == nil {
+		return nil, err
+	}
+	return m.fetchMore(wid, count, []*client.Job{job}, queues)
+}
+
+func (m *manager) FetchWait(ctx context.Context, wid string, count int, queues ...string) ([]*client.Job, error) {
+	if count < 1 || count > MaxFetchJobs {
+		return nil, fmt.Errorf("FetchWait count must be between 1 and %d, got %d", MaxFetchJobs, count)
+	}
+	if len(queues) == 0 {
+		return nil, fmt.Errorf("FetchWait must be called with one or more queue names")
+	}
+
+	for {
+		// grab the channel first so a push during the scan isn't missed
+		pushed := m.nextPush()
+		jobs, err := m.fetchMore(wid, count, nil, queues)
+		if err != nil || len(jobs) > 0 {
+			return jobs, err
+		}
+
+		select {
+		case <-pushed:
+		case <-time.After(time.Second):
+			// scheduled jobs and retries are enqueued by the store
+			// without a push, so look again now and then
+		case <-ctx.Done():
+			return nil, nil
+		}
+	}
+}
+
+// Add jobs from the queues, without blocking, until there are count.
+// The jobs are already reserved so they're returned even if fetching
+// more fails, see FetchN.
+func (m *manager) fetchMore(wid string, count int, jobs []*client.Job, queues []string) ([]*client.Job, error) {
+	queues, err := m.expandQueues(queues)
+	if err != nil {
+		return fetchedSoFar(jobs, err)
+	}
+
+	for _, qname := range queues {
+		q, err := m.store.GetQueue(qname)
+		if err != nil {
+			return fetchedSoFar(jobs, err)
+		}
+		if q.IsPaused() {
+			continue
+		}
+
+		for len(jobs) < count {
+			if !m.claim(qname) {
+				break
+			}
+			if ok, _ := m.takeToken(qname); !ok {
+				m.unclaim(qname)
+				break
+			}
+			data, popped, err := m.pop(q, wid)
+			if err != nil || data == nil {
+				m.unclaim(qname)
+				m.returnToken(qname)
+			}
+			if err != nil {
+				return fetchedSoFar(jobs, err)
+			}
+			if data == nil {
+				break
+			}
+
+			var job client.Job
+			err = json.Unmarshal(data, &job)
+			if err != nil {
+				m.unreserve(popped, job.Jid)
+				m.unclaim(qname)
+				return fetchedSoFar(jobs, err)
+			}
+			if m.discardExpired(&job) {
+				m.unreserve(popped, job.Jid)
+				m.unclaim(qname)
+				m.returnToken(qname)
+				continue
+			}
+			err = callMiddleware(m.fetchChain, &job, func() error {
+				return m.reserve(wid, &job, popped)
+			})
+			if err != nil {
+				m.unreserve(popped, job.Jid)
+				m.unclaim(qname)
+			}
+			if h, ok := err.(halt); ok {
+				util.Infow(h.Error(), jobFields(&job))
+				continue
+			}
+			if err != nil {
+				m.release(&job)
+				return fetchedSoFar(jobs, err)
+			}
+			jobs = append(jobs, &job)
+		}
+		if len(jobs) == count {
+			break
+		}
+	}
+	return jobs, nil
+}
+
+// The jobs fetched before err, which is only returned if there are
+// none since the jobs are already reserved.
+func fetchedSoFar(jobs []*client.Job, err error) ([]*client.Job, error) {
+	if len(jobs) == 0 {
+		return nil, err
+	}
+	util.Warnw("Unable to fetch more jobs", map[string]interface{}{"fetched": len(jobs), "error": err})
+	return jobs, nil
+}
+
+// Push a job whose reservation failed back onto its queue, behind
+// any jobs enqueued since it was fetched.
+func (m *manager) release(job *client.Job) {
+	res := m.clearReservation(job.Jid)
+	if res != nil {
+		m.store.Working().RemoveElement(res.Expiry, job.Jid)
+	}
+
+	q, err := m.store.GetQueue(job.Queue)
+	if err == nil {
+		var data []byte
+		data, err = json.Marshal(job)
+		if err == nil {
+			err = q.Push(job.Priority, data)
+		}
+	}
+	if err != nil {
+		util.Error("Unable to release job "+job.Jid, err)
+	}
+}
@@ -2,6 +2,7 @@ package manager
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"testing"
@@ -151,6 +152,127 @@ func TestManager(t *testing.T) {
 			assert.Empty(t, job.EnqueuedAt)
 		})
 
+		t.Run("PushTo", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store)
+
+			queues := []string{"us-east", "us-west", "eu-central"}
+			job := client.NewJob("Notify", "all regions")
+			jids, err := m.PushTo(job, queues...)
+			assert.NoError(t, err)
+			assert.Equal(t, 3, len(jids))
+
+			seen := map[string]bool{}
+			for idx, qname := range queues {
+				fetched, err := m.Fetch(context.Background(), "workerId", qname)
+				assert.NoError(t, err)
+				assert.NotNil(t, fetched)
+				assert.Equal(t, jids[idx], fetched.Jid)
+				assert.Equal(t, qname, fetched.Queue)
+				assert.Equal(t, "Notify", fetched.Type)
+				assert.Equal(t, []interface{}{"all regions"}, fetched.Args)
+				seen[fetched.Jid] = true
+			}
+			assert.Equal(t, 3, len(seen))
+
+			_, err = m.PushTo(client.NewJob("Notify", 1))
+			assert.Error(t, err)
+			_, err = m.PushTo(client.NewJob("Notify", 1), "a", "b", "a")
+			assert.Error(t, err)
+			_, err = m.PushTo(client.NewJob("Notify", 1), "a", "bad name")
+			assert.Error(t, err)
+
+			tooMany := make([]string, MaxPushToQueues+1)
+			for idx := range tooMany {
+				tooMany[idx] = fmt.Sprintf("q%d", idx)
+			}
+			_, err = m.PushTo(client.NewJob("Notify", 1), tooMany...)
+			assert.Error(t, err)
+		})
+
+		t.Run("Chaining", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store)
+
+			step1 := client.NewJob("Download", "http://example.com/report.csv")
+			step1.Retry = 0
+			step2 := client.NewJob("Import", "report.csv")
+			step2.Jid = ""
+			cleanup := client.NewJob("Cleanup", "report.csv")
+			step1.Then = []*client.Job{step2}
+			step1.ThenOnFail = []*client.Job{cleanup}
+
+			err := m.Push(step1)
+			assert.NoError(t, err)
+			assert.NotEmpty(t, step2.Jid)
+
+			fetched, err := m.Fetch(context.Background(), "workerId", "default")
+			assert.NoError(t, err)
+			assert.Equal(t, step1.Jid, fetched.Jid)
+			q, _ := store.GetQueue("default")
+			assert.EqualValues(t, 0, q.Size())
+
+			_, err = m.Acknowledge(fetched.Jid)
+			assert.NoError(t, err)
+			assert.EqualValues(t, 1, q.Size())
+			assert.Equal(t, 0, m.WorkingCount())
+
+			next, err := m.Fetch(context.Background(), "workerId", "default")
+			assert.NoError(t, err)
+			assert.Equal(t, step2.Jid, next.Jid)
+			assert.Equal(t, "Import", next.Type)
+			assert.Equal(t, 1, next.ChainDepth)
+			_, err = m.Acknowledge(next.Jid)
+			assert.NoError(t, err)
+			assert.EqualValues(t, 0, q.Size())
+
+			// failure pushes the failure branch, not the successors
+			err = m.Push(step1)
+			assert.NoError(t, err)
+			fetched, err = m.Fetch(context.Background(), "workerId", "default")
+			assert.NoError(t, err)
+			err = m.Fail(&FailPayload{Jid: fetched.Jid, ErrorType: "IOError", ErrorMessage: "timeout"})
+			assert.NoError(t, err)
+			assert.EqualValues(t, 1, q.Size())
+			next, err = m.Fetch(context.Background(), "workerId", "default")
+			assert.NoError(t, err)
+			assert.Equal(t, "Cleanup", next.Type)
+
+			// chains can only be so deep
+			shallow := NewManagerWithOptions(store, Options{MaxChainDepth: 2})
+			root := client.NewJob("Step", 0)
+			job := root
+			for i := 1; i <= 3; i++ {
+				successor := client.NewJob("Step", i)
+				job.Then = []*client.Job{successor}
+				job = successor
+			}
+			err = shallow.Push(root)
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "more than 2")
+
+			root.Then[0].Then[0].Then = nil
+			err = shallow.Push(root)
+			assert.NoError(t, err)
+
+			// on_success is a single successor
+			q.Clear()
+			first := client.NewJob("Resize", 1)
+			first.OnSuccess = client.NewJob("Upload", 1)
+			err = m.Push(first)
+			assert.NoError(t, err)
+			assert.Nil(t, first.OnSuccess)
+			assert.Len(t, first.Then, 1)
+			fetched, err = m.Fetch(context.Background(), "workerId", "default")
+			assert.NoError(t, err)
+			assert.Equal(t, first.Jid, fetched.Jid)
+			_, err = m.Acknowledge(fetched.Jid)
+			assert.NoError(t, err)
+			next, err = m.Fetch(context.Background(), "workerId", "default")
+			assert.NoError(t, err)
+			assert.Equal(t, "Upload", next.Type)
+		})
+
 		t.Run("Fetch", func(t *testing.T) {
 			store.Flush()
 			m := NewManager(store)
@@ -172,6 +294,29 @@ func TestManager(t *testing.T) {
 			assert.EqualValues(t, 0, q.Size())
 		})
 
+		t.Run("FetchPriority", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store)
+
+			low := client.NewJob("ManagerPush", 1)
+			low.Priority = 2
+			normal := client.NewJob("ManagerPush", 2)
+			high := client.NewJob("ManagerPush", 3)
+			high.Priority = 9
+			for _, job := range []*client.Job{low, normal, high} {
+				assert.NoError(t, m.Push(job))
+			}
+			q, err := store.GetQueue("default")
+			assert.NoError(t, err)
+			assert.EqualValues(t, 3, q.Size())
+
+			for _, job := range []*client.Job{high, normal, low} {
+				fetchedJob, err := m.Fetch(context.Background(), "workerId", "default")
+				assert.NoError(t, err)
+				assert.EqualValues(t, job.Jid, fetchedJob.Jid)
+			}
+		})
+
 		t.Run("EmptyFetch", func(t *testing.T) {
 			store.Flush()
 			m := NewManager(store)
@@ -235,6 +380,707 @@ func TestManager(t *testing.T) {
 			assert.EqualValues(t, 0, q2.Size())
 		})
 
+		t.Run("FetchN", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store)
+
+			for i := 0; i < 3; i++ {
+				err := m.Push(client.NewJob("ManagerPush", i))
+				assert.NoError(t, err)
+			}
+			email := client.NewJob("SendEmail", 1)
+			email.Queue = "email"
+			err := m.Push(email)
+			assert.NoError(t, err)
+
+			jobs, err := m.FetchN(context.Background(), "workerId", 10, "default", "email")
+			assert.NoError(t, err)
+			assert.Equal(t, 4, len(jobs))
+			assert.Equal(t, email.Jid, jobs[3].Jid)
+			assert.Equal(t, 4, m.WorkingCount())
+
+			err = m.Push(client.NewJob("ManagerPush", 4))
+			assert.NoError(t, err)
+			err = m.Push(client.NewJob("ManagerPush", 5))
+			assert.NoError(t, err)
+			jobs, err = m.FetchN(context.Background(), "workerId", 1, "default")
+			assert.NoError(t, err)
+			assert.Equal(t, 1, len(jobs))
+			q, _ := store.GetQueue("default")
+			assert.EqualValues(t, 1, q.Size())
+
+			_, err = m.FetchN(context.Background(), "workerId", MaxFetchJobs+1, "default")
+			assert.Error(t, err)
+		})
+
+		t.Run("FetchNError", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store)
+
+			var jids []string
+			for i := 0; i < 3; i++ {
+				job := client.NewJob("ManagerPush", i)
+				jids = append(jids, job.Jid)
+				assert.NoError(t, m.Push(job))
+			}
+			fetches := 0
+			m.AddMiddleware("fetch", func(next func() error, job *client.Job) error {
+				fetches++
+				if fetches == 2 {
+					return fmt.Errorf("boom")
+				}
+				return next()
+			})
+
+			// the first job is reserved so it's still returned
+			jobs, err := m.FetchN(context.Background(), "workerId", 10, "default")
+			assert.NoError(t, err)
+			assert.Equal(t, 1, len(jobs))
+			assert.Equal(t, jids[0], jobs[0].Jid)
+			assert.Equal(t, 1, m.WorkingCount())
+			q, _ := store.GetQueue("default")
+			assert.EqualValues(t, 2, q.Size())
+		})
+
+		t.Run("FetchPattern", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store)
+
+			for _, qname := range []string{"shard_b", "shard_a", "other"} {
+				job := client.NewJob("Tenant", qname)
+				job.Queue = qname
+				err := m.Push(job)
+				assert.NoError(t, err)
+			}
+
+			jobs, err := m.FetchN(context.Background(), "workerId", 10, "shard_*")
+			assert.NoError(t, err)
+			assert.Equal(t, 2, len(jobs))
+			assert.Equal(t, "shard_a", jobs[0].Queue)
+			assert.Equal(t, "shard_b", jobs[1].Queue)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			job, err := m.Fetch(ctx, "workerId", "tenant_*")
+			assert.NoError(t, err)
+			assert.Nil(t, job)
+
+			_, err = m.Fetch(ctx, "workerId", "shard_[")
+			assert.Error(t, err)
+		})
+
+		t.Run("FetchPaused", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store)
+
+			email := client.NewJob("SendEmail", 1)
+			email.Queue = "email"
+			err := m.Push(email)
+			assert.NoError(t, err)
+			err = m.Push(client.NewJob("ManagerPush", 1))
+			assert.NoError(t, err)
+
+			q, err := store.GetQueue("default")
+			assert.NoError(t, err)
+			err = q.Pause()
+			assert.NoError(t, err)
+			defer q.Resume()
+			assert.True(t, q.IsPaused())
+
+			jobs, err := m.FetchN(context.Background(), "workerId", 10, "default", "email")
+			assert.NoError(t, err)
+			assert.Equal(t, 1, len(jobs))
+			assert.Equal(t, email.Jid, jobs[0].Jid)
+			assert.EqualValues(t, 1, q.Size())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			job, err := m.Fetch(ctx, "workerId", "default")
+			assert.NoError(t, err)
+			assert.Nil(t, job)
+		})
+
+		t.Run("QueueLimit", func(t *testing.T) {
+			store.Flush()
+			m := NewManagerWithOptions(store, Options{
+				QueueLimit: func(queue string) (uint64, time.Duration) {
+					if queue == "default" {
+						return 2, 0
+					}
+					return 0, 0
+				},
+			})
+
+			assert.NoError(t, m.Push(client.NewJob("ManagerPush", 1)))
+			assert.NoError(t, m.Push(client.NewJob("ManagerPush", 2)))
+			err := m.Push(client.NewJob("ManagerPush", 3))
+			assert.Error(t, err)
+			full, ok := err.(*QueueFullError)
+			assert.True(t, ok)
+			assert.Equal(t, "default", full.Queue)
+			assert.EqualValues(t, 2, full.Limit)
+
+			// scheduled jobs and other queues aren't limited yet
+			later := client.NewJob("ManagerPush", 4)
+			later.At = util.Thens(time.Now().Add(time.Hour))
+			assert.NoError(t, m.Push(later))
+			other := client.NewJob("ManagerPush", 5)
+			other.Queue = "other"
+			assert.NoError(t, m.Push(other))
+
+			store.Flush()
+			results, err := m.PushBulk([]*client.Job{
+				client.NewJob("ManagerPush", 1),
+				client.NewJob("ManagerPush", 2),
+				client.NewJob("ManagerPush", 3),
+			})
+			assert.NoError(t, err)
+			assert.NoError(t, results[0])
+			assert.NoError(t, results[1])
+			assert.IsType(t, &QueueFullError{}, results[2])
+		})
+
+		t.Run("FetchThrottled", func(t *testing.T) {
+			store.Flush()
+			m := NewManagerWithOptions(store, Options{
+				Throttle: func(queue string) Throttle {
+					if queue == "default" {
+						return Throttle{Limit: 2, Period: time.Hour}
+					}
+					return Throttle{}
+				},
+			})
+
+			for i := 0; i < 4; i++ {
+				err := m.Push(client.NewJob("ManagerPush", i))
+				assert.NoError(t, err)
+			}
+			email := client.NewJob("SendEmail", 1)
+			email.Queue = "email"
+			err := m.Push(email)
+			assert.NoError(t, err)
+
+			jobs, err := m.FetchN(context.Background(), "workerId", 10, "default", "email")
+			assert.NoError(t, err)
+			assert.Equal(t, 3, len(jobs))
+			assert.Equal(t, email.Jid, jobs[2].Jid)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			job, err := m.Fetch(ctx, "workerId", "default")
+			assert.NoError(t, err)
+			assert.Nil(t, job)
+		})
+
+		t.Run("FetchConcurrency", func(t *testing.T) {
+			store.Flush()
+			m := NewManagerWithOptions(store, Options{
+				MaxConcurrency: func(queue string) int {
+					if queue == "imports" {
+						return 2
+					}
+					return 0
+				},
+			})
+
+			for i := 0; i < 4; i++ {
+				job := client.NewJob("Import", i)
+				job.Queue = "imports"
+				err := m.Push(job)
+				assert.NoError(t, err)
+			}
+
+			jobs, err := m.FetchN(context.Background(), "workerId", 10, "imports")
+			assert.NoError(t, err)
+			assert.Equal(t, 2, len(jobs))
+			assert.Equal(t, 2, m.QueueBusy("imports"))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			job, err := m.Fetch(ctx, "workerId", "imports")
+			assert.NoError(t, err)
+			assert.Nil(t, job)
+
+			// acknowledging frees the slot
+			_, err = m.Acknowledge(jobs[0].Jid)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, m.QueueBusy("imports"))
+			job, err = m.Fetch(context.Background(), "workerId", "imports")
+			assert.NoError(t, err)
+			assert.NotNil(t, job)
+			assert.Equal(t, 2, m.QueueBusy("imports"))
+		})
+
+		t.Run("UniqueJobs", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store)
+
+			job := client.NewJob("Report", "daily")
+			job.UniqueFor = 60
+			err := m.Push(job)
+			assert.NoError(t, err)
+
+			dupe := client.NewJob("Report", "daily")
+			dupe.UniqueFor = 60
+			err = m.Push(dupe)
+			assert.Error(t, err)
+			notUnique, ok := err.(*NotUniqueError)
+			assert.True(t, ok)
+			assert.Equal(t, job.Jid, notUnique.Holder)
+			results, err := m.PushBulk([]*client.Job{dupe, client.NewJob("Report", "weekly")})
+			assert.NoError(t, err)
+			assert.IsType(t, &NotUniqueError{}, results[0])
+			assert.NoError(t, results[1])
+
+			// the lock is held until the job succeeds
+			fetched, err := m.Fetch(context.Background(), "workerId", "default")
+			assert.NoError(t, err)
+			assert.Equal(t, job.Jid, fetched.Jid)
+			assert.Error(t, m.Push(dupe))
+			_, err = m.Acknowledge(job.Jid)
+			assert.NoError(t, err)
+			assert.NoError(t, m.Push(dupe))
+
+			store.Flush()
+			early := client.NewJob("Report", "hourly")
+			early.UniqueFor = 60
+			early.UniqueUntil = UniqueUntilStart
+			assert.NoError(t, m.Push(early))
+			fetched, err = m.Fetch(context.Background(), "workerId", "default")
+			assert.NoError(t, err)
+			assert.Equal(t, early.Jid, fetched.Jid)
+			again := client.NewJob("Report", "hourly")
+			again.UniqueFor = 60
+			assert.NoError(t, m.Push(again))
+		})
+
+		t.Run("UniqueSuccessors", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store)
+
+			existing := client.NewJob("Report", "daily")
+			existing.Queue = "reports"
+			existing.UniqueFor = 60
+			assert.NoError(t, m.Push(existing))
+
+			step := client.NewJob("Export", "daily")
+			dupe := client.NewJob("Report", "daily")
+			dupe.Queue = "reports"
+			dupe.UniqueFor = 60
+			fresh := client.NewJob("Report", "weekly")
+			fresh.Queue = "reports"
+			fresh.UniqueFor = 60
+			step.Then = []*client.Job{dupe, fresh}
+			assert.NoError(t, m.Push(step))
+
+			fetched, err := m.Fetch(context.Background(), "workerId", "default")
+			assert.NoError(t, err)
+			assert.Equal(t, step.Jid, fetched.Jid)
+			_, err = m.Acknowledge(fetched.Jid)
+			assert.NoError(t, err)
+			assert.Equal(t, 0, m.WorkingCount())
+
+			// the duplicate is dropped, the other successor holds its lock
+			q, _ := store.GetQueue("reports")
+			assert.EqualValues(t, 2, q.Size())
+			again := client.NewJob("Report", "weekly")
+			again.Queue = "reports"
+			again.UniqueFor = 60
+			err = m.Push(again)
+			notUnique, ok := err.(*NotUniqueError)
+			assert.True(t, ok)
+			if ok {
+				assert.Equal(t, fresh.Jid, notUnique.Holder)
+			}
+		})
+
+		t.Run("Batches", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store)
+
+			done := client.NewJob("ImportDone", 1)
+			done.Queue = "callbacks"
+			b := &client.Batch{Description: "Import", Success: done, Complete: client.NewJob("ImportRan", 1)}
+			err := m.NewBatch(b)
+			assert.NoError(t, err)
+			assert.NotEqual(t, "", b.Bid)
+			assert.Error(t, m.NewBatch(b))
+
+			for i := 0; i < 2; i++ {
+				job := client.NewJob("Import", i)
+				job.Bid = b.Bid
+				assert.NoError(t, m.Push(job))
+			}
+			status, err := m.BatchStatus(b.Bid)
+			assert.NoError(t, err)
+			assert.EqualValues(t, 2, status.Total)
+			assert.EqualValues(t, 2, status.Pending)
+			assert.False(t, status.Committed)
+			assert.Equal(t, "Import", status.Description)
+
+			err = m.CommitBatch(b.Bid)
+			assert.NoError(t, err)
+			late := client.NewJob("Import", 3)
+			late.Bid = b.Bid
+			assert.Error(t, m.Push(late))
+			stray := client.NewJob("Import", 4)
+			stray.Bid = "b-nosuchbatch"
+			assert.Error(t, m.Push(stray))
+
+			first, err := m.Fetch(context.Background(), "workerId", "default")
+			assert.NoError(t, err)
+			second, err := m.Fetch(context.Background(), "workerId", "default")
+			assert.NoError(t, err)
+			_, err = m.Acknowledge(first.Jid)
+			assert.NoError(t, err)
+			err = m.Fail(&FailPayload{Jid: second.Jid, ErrorType: "Oops", ErrorMessage: "failed"})
+			assert.NoError(t, err)
+
+			// everything ran, but not everything succeeded
+			status, err = m.BatchStatus(b.Bid)
+			assert.NoError(t, err)
+			assert.EqualValues(t, 1, status.Pending)
+			assert.EqualValues(t, 1, status.Failed)
+			assert.True(t, status.Completed)
+			assert.False(t, status.Succeeded)
+			q, err := store.GetQueue("default")
+			assert.NoError(t, err)
+			assert.EqualValues(t, 1, q.Size())
+			ran, err := m.Fetch(context.Background(), "workerId", "default")
+			assert.NoError(t, err)
+			assert.Equal(t, "ImportRan", ran.Type)
+			assert.Equal(t, b.Bid, ran.Custom["bid"])
+			_, err = m.Acknowledge(ran.Jid)
+			assert.NoError(t, err)
+
+			callbacks, err := store.GetQueue("callbacks")
+			assert.NoError(t, err)
+			assert.EqualValues(t, 0, callbacks.Size())
+
+			// the retry succeeds
+			q, err = store.GetQueue("default")
+			assert.NoError(t, err)
+			assert.EqualValues(t, 0, q.Size())
+			data, err := json.Marshal(second)
+			assert.NoError(t, err)
+			assert.NoError(t, q.Push(second.Priority, data))
+			retried, err := m.Fetch(context.Background(), "workerId", "default")
+			assert.NoError(t, err)
+			assert.Equal(t, second.Jid, retried.Jid)
+			_, err = m.Acknowledge(retried.Jid)
+			assert.NoError(t, err)
+
+			status, err = m.BatchStatus(b.Bid)
+			assert.NoError(t, err)
+			assert.EqualValues(t, 0, status.Pending)
+			assert.EqualValues(t, 0, status.Failed)
+			assert.True(t, status.Succeeded)
+			assert.EqualValues(t, 1, callbacks.Size())
+			assert.Error(t, m.OpenBatch(b.Bid))
+		})
+
+		t.Run("Progress", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store)
+
+			job := client.NewJob("Resize", 1)
+			assert.NoError(t, m.Push(job))
+			err := m.SetProgress(&Progress{Jid: job.Jid, Percent: 10})
+			assert.Error(t, err)
+
+			_, err = m.Fetch(context.Background(), "workerId", "default")
+			assert.NoError(t, err)
+			err = m.SetProgress(&Progress{Jid: job.Jid, Percent: 101})
+			assert.Error(t, err)
+			err = m.SetProgress(&Progress{Jid: job.Jid, Percent: 40, Desc: "Resizing"})
+			assert.NoError(t, err)
+
+			results, err := m.GetProgress(job.Jid, "nosuchjob")
+			assert.NoError(t, err)
+			assert.Len(t, results, 1)
+			assert.Equal(t, 40, results[job.Jid].Percent)
+			assert.Equal(t, "Resizing", results[job.Jid].Desc)
+			assert.NotEqual(t, "", results[job.Jid].UpdatedAt)
+
+			// kept after the job finishes
+			_, err = m.Acknowledge(job.Jid)
+			assert.NoError(t, err)
+			results, err = m.GetProgress(job.Jid)
+			assert.NoError(t, err)
+			assert.Len(t, results, 1)
+		})
+
+		t.Run("ExpiringJobs", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store)
+
+			job := client.NewJob("SendCode", 1)
+			job.ExpiresAt = "tomorrow"
+			assert.Error(t, m.Push(job))
+
+			stale := client.NewJob("SendCode", 1)
+			stale.ExpiresAt = util.Thens(time.Now().Add(-time.Second))
+			assert.NoError(t, m.Push(stale))
+			fresh := client.NewJob("SendCode", 2)
+			fresh.ExpiresAt = util.Thens(time.Now().Add(time.Minute))
+			assert.NoError(t, m.Push(fresh))
+
+			fetched, err := m.Fetch(context.Background(), "workerId", "default")
+			assert.NoError(t, err)
+			assert.Equal(t, fresh.Jid, fetched.Jid)
+			q, err := store.GetQueue("default")
+			assert.NoError(t, err)
+			assert.EqualValues(t, 0, q.Size())
+			assert.Equal(t, 1, m.WorkingCount())
+		})
+
+		t.Run("Results", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store)
+
+			res, err := m.GetResult("nosuchjob")
+			assert.NoError(t, err)
+			assert.Nil(t, res)
+
+			err = m.SetResult("finished", []byte(`{"rows":12}`))
+			assert.NoError(t, err)
+			res, err = m.GetResult("finished")
+			assert.NoError(t, err)
+			assert.Equal(t, "finished", res.Jid)
+			assert.Equal(t, `{"rows":12}`, string(res.Result))
+			assert.NotEqual(t, "", res.CompletedAt)
+
+			err = m.SetResult("toobig", make([]byte, MaxResultSize+1))
+			assert.Error(t, err)
+		})
+
+		t.Run("Dependencies", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store)
+			q, err := store.GetQueue("default")
+			assert.NoError(t, err)
+
+			extract := client.NewJob("Extract", "orders")
+			load := client.NewJob("Load", "customers")
+			report := client.NewJob("Report", 1)
+			report.DependsOn = []string{extract.Jid, load.Jid}
+			for _, job := range []*client.Job{extract, load, report} {
+				assert.NoError(t, m.Push(job))
+			}
+			assert.EqualValues(t, 2, q.Size())
+
+			for i := 0; i < 2; i++ {
+				fetched, err := m.Fetch(context.Background(), "workerId", "default")
+				assert.NoError(t, err)
+				assert.NotEqual(t, report.Jid, fetched.Jid)
+				_, err = m.Acknowledge(fetched.Jid)
+				assert.NoError(t, err)
+			}
+			fetched, err := m.Fetch(context.Background(), "workerId", "default")
+			assert.NoError(t, err)
+			assert.Equal(t, report.Jid, fetched.Jid)
+			assert.Equal(t, report.DependsOn, fetched.DependsOn)
+
+			// already done
+			again := client.NewJob("Report", 2)
+			again.DependsOn = []string{extract.Jid}
+			assert.NoError(t, m.Push(again))
+			assert.EqualValues(t, 1, q.Size())
+			q.Clear()
+
+			// death cascades through the jobs depending on it
+			flaky := client.NewJob("Flaky", 1)
+			flaky.Retry = 0
+			notify := client.NewJob("Notify", 1)
+			notify.DependsOn = []string{flaky.Jid}
+			archive := client.NewJob("Archive", 1)
+			archive.DependsOn = []string{notify.Jid}
+			for _, job := range []*client.Job{flaky, notify, archive} {
+				assert.NoError(t, m.Push(job))
+			}
+			fetched, err = m.Fetch(context.Background(), "workerId", "default")
+			assert.NoError(t, err)
+			assert.Equal(t, flaky.Jid, fetched.Jid)
+			assert.NoError(t, m.Fail(&FailPayload{Jid: fetched.Jid, ErrorType: "Oops", ErrorMessage: "failed"}))
+			assert.EqualValues(t, 0, q.Size())
+			assert.EqualValues(t, 2, store.Dead().Size())
+
+			late := client.NewJob("Notify", 2)
+			late.DependsOn = []string{flaky.Jid}
+			assert.NoError(t, m.Push(late))
+			assert.EqualValues(t, 0, q.Size())
+			assert.EqualValues(t, 3, store.Dead().Size())
+			_, err = store.Dead().Page(0, 10, func(_ int, entry storage.SortedEntry) error {
+				var job client.Job
+				assert.NoError(t, json.Unmarshal(entry.Value(), &job))
+				assert.Equal(t, "DependencyDied", job.Failure.ErrorType)
+				return nil
+			})
+			assert.NoError(t, err)
+
+			self := client.NewJob("Loop", 1)
+			self.DependsOn = []string{self.Jid}
+			assert.Error(t, m.Push(self))
+			short := client.NewJob("Short", 1)
+			short.DependsOn = []string{"abc"}
+			assert.Error(t, m.Push(short))
+			twice := client.NewJob("Twice", 1)
+			twice.DependsOn = []string{extract.Jid, extract.Jid}
+			assert.Error(t, m.Push(twice))
+		})
+
+		t.Run("DependencyExpiry", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store)
+			oldTTL := DependencyTTL
+			DependencyTTL = 10 * time.Millisecond
+			defer func() { DependencyTTL = oldTTL }()
+
+			extract := client.NewJob("Extract", 1)
+			report := client.NewJob("Report", 1)
+			report.DependsOn = []string{extract.Jid}
+			assert.NoError(t, m.Push(report))
+			count, err := m.ReapHeldJobs()
+			assert.NoError(t, err)
+			assert.Equal(t, 0, count)
+
+			time.Sleep(20 * time.Millisecond)
+			count, err = m.ReapHeldJobs()
+			assert.NoError(t, err)
+			assert.Equal(t, 1, count)
+			assert.EqualValues(t, 1, store.Dead().Size())
+			_, err = store.Dead().Page(0, 10, func(_ int, entry storage.SortedEntry) error {
+				var job client.Job
+				assert.NoError(t, json.Unmarshal(entry.Value(), &job))
+				assert.Equal(t, report.Jid, job.Jid)
+				assert.Equal(t, "DependencyExpired", job.Failure.ErrorType)
+				return nil
+			})
+			assert.NoError(t, err)
+		})
+
+		t.Run("Cancel", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store)
+
+			queued := client.NewJob("Report", 1)
+			queued.Queue = "reports"
+			queued.Priority = 7
+			later := client.NewJob("Report", 2)
+			later.At = util.Thens(time.Now().Add(time.Hour))
+			unique := client.NewJob("Report", 3)
+			unique.UniqueFor = 60
+			waiting := client.NewJob("Report", 4)
+			waiting.DependsOn = []string{queued.Jid}
+			for _, job := range []*client.Job{queued, later, unique, waiting} {
+				assert.NoError(t, m.Push(job))
+			}
+
+			for _, job := range []*client.Job{queued, later, unique} {
+				cancelled, err := m.Cancel(job.Jid)
+				assert.NoError(t, err)
+				if assert.NotNil(t, cancelled) {
+					assert.Equal(t, job.Jid, cancelled.Jid)
+				}
+			}
+			q, err := store.GetQueue("reports")
+			assert.NoError(t, err)
+			assert.EqualValues(t, 0, q.Size())
+			assert.EqualValues(t, 0, store.Scheduled().Size())
+
+			// it can never run, nor can the jobs depending on it
+			assert.EqualValues(t, 1, store.Dead().Size())
+			// the unique lock is released
+			assert.NoError(t, m.Push(client.NewJob("Report", 3)))
+
+			cancelled, err := m.Cancel(queued.Jid)
+			assert.NoError(t, err)
+			assert.Nil(t, cancelled)
+
+			flaky := client.NewJob("Flaky", 1)
+			assert.NoError(t, m.Push(flaky))
+			fetched, err := m.Fetch(context.Background(), "workerId", "default", "reports")
+			assert.NoError(t, err)
+			assert.NoError(t, m.Fail(&FailPayload{Jid: fetched.Jid, ErrorType: "Oops", ErrorMessage: "failed"}))
+			assert.EqualValues(t, 1, store.Retries().Size())
+			cancelled, err = m.Cancel(fetched.Jid)
+			assert.NoError(t, err)
+			assert.NotNil(t, cancelled)
+			assert.EqualValues(t, 0, store.Retries().Size())
+		})
+
+		t.Run("JobState", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store)
+
+			state := func(jid string) *JobState {
+				st, err := m.JobState(jid)
+				assert.NoError(t, err)
+				assert.Equal(t, jid, st.Jid)
+				return st
+			}
+
+			assert.Equal(t, JobUnknown, state("nosuchjob").State)
+			assert.Nil(t, state("nosuchjob").Job)
+
+			queued := client.NewJob("Report", 1)
+			queued.Queue = "reports"
+			later := client.NewJob("Report", 2)
+			later.At = util.Thens(time.Now().Add(time.Hour))
+			waiting := client.NewJob("Report", 3)
+			waiting.DependsOn = []string{later.Jid}
+			failing := client.NewJob("Report", 4)
+			for _, job := range []*client.Job{queued, later, waiting, failing} {
+				assert.NoError(t, m.Push(job))
+			}
+			st := state(queued.Jid)
+			assert.Equal(t, JobEnqueued, st.State)
+			assert.Equal(t, "reports", st.Job.Queue)
+			assert.Equal(t, JobScheduled, state(later.Jid).State)
+			assert.Equal(t, JobHeld, state(waiting.Jid).State)
+
+			fetched, err := m.Fetch(context.Background(), "workerId", "default")
+			assert.NoError(t, err)
+			st = state(fetched.Jid)
+			assert.Equal(t, JobWorking, st.State)
+			assert.Equal(t, "workerId", st.Wid)
+			assert.NotEqual(t, "", st.ReservedAt)
+			assert.NotEqual(t, "", st.ExpiresAt)
+			assert.NoError(t, m.Fail(&FailPayload{Jid: fetched.Jid, ErrorType: "Oops", ErrorMessage: "failed"}))
+			assert.Equal(t, JobRetrying, state(failing.Jid).State)
+
+			// the job depending on it dies with it
+			_, err = m.Cancel(later.Jid)
+			assert.NoError(t, err)
+			assert.Equal(t, JobDead, state(waiting.Jid).State)
+			assert.Equal(t, JobUnknown, state(later.Jid).State)
+		})
+
+		t.Run("FetchWait", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store)
+
+			email := client.NewJob("SendEmail", 1)
+			email.Queue = "email"
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				m.Push(email)
+			}()
+
+			start := time.Now()
+			jobs, err := m.FetchWait(context.Background(), "workerId", 1, "default", "email")
+			assert.NoError(t, err)
+			assert.Equal(t, 1, len(jobs))
+			assert.Equal(t, email.Jid, jobs[0].Jid)
+			assert.True(t, time.Since(start) < time.Second)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			jobs, err = m.FetchWait(ctx, "workerId", 1, "default")
+			assert.NoError(t, err)
+			assert.Nil(t, jobs)
+		})
+
 		t.Run("FetchAwaitsForNewJob", func(t *testing.T) {
 			store.Flush()
 			m := NewManager(store)
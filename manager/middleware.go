@@ -6,9 +6,36 @@ import (
 	"github.com/contribsys/faktory/client"
 )
 
+// The points in a job's life where middleware runs, see
+// Manager.AddMiddleware.
+const (
+	// Before a job is enqueued, including retries and successors
+	// as they're enqueued.  Changes to the job, e.g. its Queue or
+	// Custom, are saved.  An error fails the push.
+	MiddlewarePush = "push"
+	// Before a job pushed with a future At is added to the scheduled
+	// set.  The push middleware runs later, when it's enqueued.
+	MiddlewareSchedule = "schedule"
+	// Before a fetched job is reserved for the worker.  Halt skips
+	// the job, dropping it, and fetches the next.
+	MiddlewareFetch = "fetch"
+	// After a job is acknowledged.
+	MiddlewareAck = "ack"
+	// Before a failed job is retried or, with no retries left,
+	// killed.
+	MiddlewareFail = "fail"
+	// Before a job is added to the dead set.  Halt discards it
+	// instead.
+	MiddlewareKill = "kill"
+)
+
+// MiddlewareFunc wraps a step in a job's life: call next to carry
+// on, or return an error without calling it to stop the job there.
+// Middleware may change the job before calling next.
 type MiddlewareFunc func(next func() error, job *client.Job) error
 type MiddlewareChain []MiddlewareFunc
 
+// Halt stops a job, see the fetch and kill middleware.
 func Halt(msg string) error {
 	return halt{msg: msg}
 }
@@ -21,6 +48,15 @@ func (h halt) Error() string {
 	return fmt.Sprintf("Halt: %s", h.msg)
 }
 
+// The fields to log about a job, see util.Infow.
+func jobFields(job *client.Job) map[string]interface{} {
+	return map[string]interface{}{
+		"jid":     job.Jid,
+		"jobtype": job.Type,
+		"queue":   job.Queue,
+	}
+}
+
 // Run the given job through the given middleware chain.
 // `final` is the function called if the entire chain passes the job along.
 func callMiddleware(chain MiddlewareChain, job *client.Job, final func() error) error {
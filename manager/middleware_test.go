@@ -8,6 +8,7 @@ import (
 
 	"github.com/contribsys/faktory/client"
 	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/util"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -111,5 +112,92 @@ func TestLiveMiddleware(t *testing.T) {
 			assert.EqualValues(t, 0, q.Size())
 		})
 
+		t.Run("Enrich", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store)
+			m.AddMiddleware(MiddlewarePush, func(next func() error, job *client.Job) error {
+				job.Queue = "tenant_" + job.Custom["tenant"].(string)
+				job.Custom["routed"] = true
+				return next()
+			})
+
+			job := client.NewJob("Yep", 1)
+			job.Custom = map[string]interface{}{"tenant": "acme"}
+			assert.NoError(t, m.Push(job))
+
+			q, err := store.GetQueue("tenant_acme")
+			assert.NoError(t, err)
+			assert.EqualValues(t, 1, q.Size())
+			fetched, err := m.Fetch(context.Background(), "12345", "tenant_acme")
+			assert.NoError(t, err)
+			assert.Equal(t, true, fetched.Custom["routed"])
+		})
+
+		t.Run("Lifecycle", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store)
+			calls := []string{}
+			for _, fntype := range []string{MiddlewareAck, MiddlewareFail, MiddlewareKill} {
+				fntype := fntype
+				m.AddMiddleware(fntype, func(next func() error, job *client.Job) error {
+					calls = append(calls, fntype+" "+job.Type)
+					if fntype == MiddlewareKill && job.Type == "Noisy" {
+						return Halt("not worth keeping")
+					}
+					return next()
+				})
+			}
+
+			for _, jobtype := range []string{"Yep", "Noisy", "Important"} {
+				job := client.NewJob(jobtype, 1)
+				job.Retry = 1
+				job.Failure = &client.Failure{RetryCount: 0}
+				assert.NoError(t, m.Push(job))
+				fetched, err := m.Fetch(context.Background(), "12345", "default")
+				assert.NoError(t, err)
+				if jobtype == "Yep" {
+					_, err = m.Acknowledge(fetched.Jid)
+				} else {
+					err = m.Fail(&FailPayload{Jid: fetched.Jid, ErrorType: "Oops", ErrorMessage: "failed"})
+				}
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, []string{"ack Yep", "fail Noisy", "kill Noisy", "fail Important", "kill Important"}, calls)
+			assert.EqualValues(t, 1, store.Dead().Size())
+			_, err := store.Dead().Page(0, 0, func(_ int, entry storage.SortedEntry) error {
+				job, err := entry.Job()
+				assert.NoError(t, err)
+				assert.Equal(t, "Important", job.Type)
+				return nil
+			})
+			assert.NoError(t, err)
+		})
+
+		t.Run("Schedule", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store)
+			calls := []string{}
+			for _, fntype := range []string{MiddlewarePush, MiddlewareSchedule} {
+				fntype := fntype
+				m.AddMiddleware(fntype, func(next func() error, job *client.Job) error {
+					calls = append(calls, fntype+" "+job.Type)
+					job.SetCustom(fntype, true)
+					return next()
+				})
+			}
+
+			job := client.NewJob("Later", 1)
+			job.At = util.Thens(time.Now().Add(time.Minute))
+			assert.NoError(t, m.Push(job))
+			assert.Equal(t, []string{"schedule Later"}, calls)
+			assert.EqualValues(t, 1, store.Scheduled().Size())
+			_, err := store.Scheduled().Page(0, 0, func(_ int, entry storage.SortedEntry) error {
+				job, err := entry.Job()
+				assert.NoError(t, err)
+				assert.Equal(t, true, job.Custom["schedule"])
+				return nil
+			})
+			assert.NoError(t, err)
+		})
 	})
 }
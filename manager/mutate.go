@@ -0,0 +1,227 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/storage"
+)
+
+// The commands a Mutation may apply.
+const (
+	// Move the jobs to the dead set.
+	MutateKill = "kill"
+	// Enqueue the jobs now.
+	MutateRequeue = "requeue"
+	// Delete the jobs.
+	MutateDiscard = "discard"
+)
+
+// A Mutation applies Cmd to the jobs in the Target set, "retries",
+// "scheduled" or "dead", which match the Filter.
+type Mutation struct {
+	Cmd    string        `json:"cmd"`
+	Target string        `json:"target"`
+	Filter *MutateFilter `json:"filter"`
+}
+
+// MutateFilter picks a set's jobs, a job must match every field
+// given.  Path and Value match a single argument, or a value within
+// one, exactly: Path is the argument's index followed by any hash
+// keys or array indexes, dot separated, e.g. "0" or "1.customer.id".
+type MutateFilter struct {
+	Jobtype string   `json:"jobtype,omitempty"`
+	Jids    []string `json:"jids,omitempty"`
+	// Matched against the job's args as a JSON array.
+	Regexp string          `json:"regexp,omitempty"`
+	Path   string          `json:"path,omitempty"`
+	Value  json.RawMessage `json:"value,omitempty"`
+}
+
+type jobFilter struct {
+	jobtype string
+	jids    map[string]bool
+	regexp  *regexp.Regexp
+	path    []string
+	value   interface{}
+}
+
+func (f *MutateFilter) compile() (*jobFilter, error) {
+	if f == nil || (f.Jobtype == "" && len(f.Jids) == 0 && f.Regexp == "" && f.Path == "") {
+		return nil, fmt.Errorf("MUTATE needs a filter with a jobtype, jids, regexp or path")
+	}
+	filter := &jobFilter{jobtype: f.Jobtype}
+	if len(f.Jids) > 0 {
+		filter.jids = map[string]bool{}
+		for _, jid := range f.Jids {
+			filter.jids[jid] = true
+		}
+	}
+	if f.Regexp != "" {
+		re, err := regexp.Compile(f.Regexp)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid filter regexp: %v", err)
+		}
+		filter.regexp = re
+	}
+	if f.Path != "" {
+		filter.path = strings.Split(f.Path, ".")
+		if _, err := strconv.Atoi(filter.path[0]); err != nil {
+			return nil, fmt.Errorf("Invalid filter path %q, it must start with an argument index", f.Path)
+		}
+		if len(f.Value) == 0 {
+			return nil, fmt.Errorf("Filter path %q needs a value", f.Path)
+		}
+		err := json.Unmarshal(f.Value, &filter.value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid filter value: %v", err)
+		}
+	}
+	return filter, nil
+}
+
+func (f *jobFilter) matches(job *client.Job) bool {
+	if f.jobtype != "" && job.Type != f.jobtype {
+		return false
+	}
+	if f.jids != nil && !f.jids[job.Jid] {
+		return false
+	}
+	if f.regexp == nil && f.path == nil {
+		return true
+	}
+
+	args := job.Args
+	if job.ArgsEncoding != "" {
+		out := *job
+		if out.DecompressArgs() != nil {
+			return false
+		}
+		args = out.Args
+	}
+	if f.regexp != nil {
+		data, err := json.Marshal(args)
+		if err != nil || !f.regexp.Match(data) {
+			return false
+		}
+	}
+	if f.path != nil {
+		value, ok := lookupPath(args, f.path)
+		if !ok || !reflect.DeepEqual(value, f.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Follow the path through hashes and arrays as decoded by
+// encoding/json.
+func lookupPath(value interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		switch v := value.(type) {
+		case []interface{}:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx < 0 || idx >= len(v) {
+				return nil, false
+			}
+			value = v[idx]
+		case map[string]interface{}:
+			var ok bool
+			value, ok = v[key]
+			if !ok {
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func (m *manager) Mutate(mut *Mutation) (int, error) {
+	var set storage.SortedSet
+	switch mut.Target {
+	case "retries":
+		set = m.store.Retries()
+	case "scheduled":
+		set = m.store.Scheduled()
+	case "dead":
+		set = m.store.Dead()
+	default:
+		return 0, fmt.Errorf("Invalid MUTATE target %q, expected retries, scheduled or dead", mut.Target)
+	}
+	switch mut.Cmd {
+	case MutateKill:
+		if mut.Target == "dead" {
+			return 0, fmt.Errorf("Jobs in the dead set are already dead")
+		}
+	case MutateRequeue, MutateDiscard:
+	default:
+		return 0, fmt.Errorf("Invalid MUTATE cmd %q, expected kill, requeue or discard", mut.Cmd)
+	}
+	filter, err := mut.Filter.compile()
+	if err != nil {
+		return 0, err
+	}
+
+	// find them all first, the set shifts as we change it
+	matched := []storage.SortedEntry{}
+	for start := 0; ; start += 100 {
+		count, err := set.Page(start, 99, func(_ int, entry storage.SortedEntry) error {
+			job, err := entry.Job()
+			if err != nil {
+				return err
+			}
+			if filter.matches(job) {
+				matched = append(matched, entry)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		if count < 100 {
+			break
+		}
+	}
+
+	changed := 0
+	for _, entry := range matched {
+		key, err := entry.Key()
+		if err != nil {
+			return changed, err
+		}
+		// skip jobs which have moved since
+		ok, err := set.Remove(key)
+		if err != nil {
+			return changed, err
+		}
+		if !ok {
+			continue
+		}
+		job, _ := entry.Job()
+		switch mut.Cmd {
+		case MutateKill:
+			err = m.sendToMorgue(job)
+			if err == nil {
+				m.abandon(job)
+			}
+		case MutateRequeue:
+			err = m.enqueue(job)
+		case MutateDiscard:
+			if mut.Target != "dead" {
+				m.abandon(job)
+			}
+		}
+		if err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
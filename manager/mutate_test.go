@@ -0,0 +1,125 @@
+package manager
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMutateFilter(t *testing.T) {
+	job := client.NewJob("SyncCustomer", 1234, map[string]interface{}{"region": "eu", "tags": []interface{}{"vip"}})
+	// as if read back from Redis
+	data, err := json.Marshal(job)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, job))
+
+	matches := func(filter string) bool {
+		var f MutateFilter
+		assert.NoError(t, json.Unmarshal([]byte(filter), &f))
+		compiled, err := f.compile()
+		assert.NoError(t, err, filter)
+		return err == nil && compiled.matches(job)
+	}
+
+	assert.True(t, matches(`{"jobtype":"SyncCustomer"}`))
+	assert.False(t, matches(`{"jobtype":"Sync"}`))
+	assert.True(t, matches(`{"jids":["other","`+job.Jid+`"]}`))
+	assert.False(t, matches(`{"jobtype":"SyncCustomer","jids":["other"]}`))
+	assert.True(t, matches(`{"path":"0","value":1234}`))
+	assert.False(t, matches(`{"path":"0","value":"1234"}`))
+	assert.False(t, matches(`{"path":"0","value":12345}`))
+	assert.True(t, matches(`{"path":"1.region","value":"eu"}`))
+	assert.True(t, matches(`{"path":"1.tags.0","value":"vip"}`))
+	assert.True(t, matches(`{"path":"1.tags","value":["vip"]}`))
+	assert.False(t, matches(`{"path":"1.tags.1","value":"vip"}`))
+	assert.False(t, matches(`{"path":"2","value":null}`))
+	assert.True(t, matches(`{"regexp":"^\\[1234,"}`))
+	assert.False(t, matches(`{"regexp":"^\\[123,"}`))
+	assert.True(t, matches(`{"jobtype":"SyncCustomer","regexp":"\"us\"|\"eu\"","path":"0","value":1234}`))
+
+	assert.NoError(t, job.CompressArgs())
+	assert.True(t, matches(`{"path":"1.region","value":"eu"}`))
+
+	for _, bad := range []string{
+		`{}`,
+		`{"regexp":"("}`,
+		`{"path":"region","value":"eu"}`,
+		`{"path":"0"}`,
+	} {
+		var f MutateFilter
+		assert.NoError(t, json.Unmarshal([]byte(bad), &f))
+		_, err := f.compile()
+		assert.Error(t, err, bad)
+	}
+	_, err = (*MutateFilter)(nil).compile()
+	assert.Error(t, err)
+}
+
+func TestMutate(t *testing.T) {
+	withRedis(t, "mutate", func(t *testing.T, store storage.Store) {
+		store.Flush()
+		m := NewManager(store)
+
+		retry := func(jobtype string, customer int) *client.Job {
+			job := client.NewJob(jobtype, customer)
+			job.Failure = &client.Failure{RetryCount: 1, ErrorType: "Oops"}
+			at := util.Thens(time.Now().Add(time.Hour))
+			data, err := json.Marshal(job)
+			assert.NoError(t, err)
+			assert.NoError(t, store.Retries().AddElement(at, job.Jid, data))
+			return job
+		}
+		for i := 0; i < 120; i++ {
+			retry("Sync", i)
+		}
+		target := retry("Sync", 1234)
+		other := retry("Bill", 1234)
+		assert.EqualValues(t, 122, store.Retries().Size())
+
+		mut := &Mutation{Cmd: MutateKill, Target: "retries", Filter: &MutateFilter{Jobtype: "Sync", Path: "0", Value: json.RawMessage("1234")}}
+		count, err := m.Mutate(mut)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, count)
+		assert.EqualValues(t, 121, store.Retries().Size())
+		assert.EqualValues(t, 1, store.Dead().Size())
+		data, err := store.Dead().FindJid(target.Jid)
+		assert.NoError(t, err)
+		assert.NotNil(t, data)
+
+		count, err = m.Mutate(mut)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, count)
+
+		// back to its queue
+		count, err = m.Mutate(&Mutation{Cmd: MutateRequeue, Target: "dead", Filter: &MutateFilter{Jids: []string{target.Jid}}})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, count)
+		q, err := store.GetQueue("default")
+		assert.NoError(t, err)
+		assert.EqualValues(t, 1, q.Size())
+
+		count, err = m.Mutate(&Mutation{Cmd: MutateDiscard, Target: "retries", Filter: &MutateFilter{Jobtype: "Sync"}})
+		assert.NoError(t, err)
+		assert.Equal(t, 120, count)
+		assert.EqualValues(t, 1, store.Retries().Size())
+		data, err = store.Retries().FindJid(other.Jid)
+		assert.NoError(t, err)
+		assert.NotNil(t, data)
+
+		for _, bad := range []*Mutation{
+			{Cmd: MutateKill, Target: "dead", Filter: &MutateFilter{Jobtype: "Bill"}},
+			{Cmd: "explode", Target: "retries", Filter: &MutateFilter{Jobtype: "Bill"}},
+			{Cmd: MutateKill, Target: "working", Filter: &MutateFilter{Jobtype: "Bill"}},
+			{Cmd: MutateKill, Target: "retries"},
+		} {
+			_, err = m.Mutate(bad)
+			assert.Error(t, err)
+		}
+		assert.EqualValues(t, 1, store.Retries().Size())
+	})
+}
@@ -0,0 +1,72 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/contribsys/faktory/storage"
+)
+
+// IsQueuePattern reports whether name is a path.Match pattern such as
+// "shard_*" rather than a queue name.  Queue names can't contain the
+// pattern characters.
+func IsQueuePattern(name string) bool {
+	return strings.ContainsAny(name, `*?[\`)
+}
+
+// Order the queues for this fetch, see weightedOrder, then replace
+// each pattern with the known queues it matches, sorted by name.
+// Queues are known once a job has been pushed to or fetched from
+// them since the server started.
+func (m *manager) expandQueues(queues []string) ([]string, error) {
+	queues, err := weightedOrder(queues)
+	if err != nil {
+		return nil, err
+	}
+
+	var live []string
+	names := make([]string, 0, len(queues))
+	seen := map[string]bool{}
+	for _, name := range queues {
+		if !IsQueuePattern(name) {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+			continue
+		}
+
+		if _, err := path.Match(name, ""); err != nil {
+			return nil, fmt.Errorf("Invalid queue pattern %q", name)
+		}
+		if live == nil {
+			m.store.EachQueue(func(q storage.Queue) {
+				live = append(live, q.Name())
+			})
+			sort.Strings(live)
+		}
+		for _, qname := range live {
+			if ok, _ := path.Match(name, qname); ok && !seen[qname] {
+				seen[qname] = true
+				names = append(names, qname)
+			}
+		}
+	}
+	return names, nil
+}
+
+// How long a blocking pop waits for a job.
+const queueWait = 2 * time.Second
+
+// Patterns may match no queue yet or every queue may be paused or
+// throttled, wait before reporting no job.
+func awaitQueues(ctx context.Context, wait time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(wait):
+	}
+}
@@ -0,0 +1,64 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/contribsys/faktory/util"
+)
+
+// ProgressTTL is how long a job's progress is kept after its worker
+// last reported it, so producers can still see how it finished.
+var ProgressTTL = 30 * time.Minute
+
+// Progress is how far along a running job is, as reported by its
+// worker.
+type Progress struct {
+	Jid       string `json:"jid"`
+	Percent   int    `json:"percent"`
+	Desc      string `json:"desc,omitempty"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+func (m *manager) SetProgress(progress *Progress) error {
+	if progress.Percent < 0 || progress.Percent > 100 {
+		return fmt.Errorf("Invalid percent %d, must be 0-100", progress.Percent)
+	}
+	m.workingMutex.RLock()
+	_, ok := m.workingMap[progress.Jid]
+	m.workingMutex.RUnlock()
+	if !ok {
+		return fmt.Errorf("Job %s is not running", progress.Jid)
+	}
+
+	progress.UpdatedAt = util.Nows()
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	return m.store.SetProgress(progress.Jid, data, ProgressTTL)
+}
+
+// GetProgress returns the progress of each job which has reported
+// any, keyed by jid.
+func (m *manager) GetProgress(jids ...string) (map[string]*Progress, error) {
+	values, err := m.store.GetProgress(jids...)
+	if err != nil {
+		return nil, err
+	}
+	results := map[string]*Progress{}
+	for _, data := range values {
+		if data == nil {
+			continue
+		}
+		var progress Progress
+		err := json.Unmarshal(data, &progress)
+		if err != nil {
+			util.Warnf("Invalid progress: %s", string(data))
+			continue
+		}
+		results[progress.Jid] = &progress
+	}
+	return results, nil
+}
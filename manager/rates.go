@@ -0,0 +1,90 @@
+package manager
+
+import (
+	"sync"
+	"time"
+)
+
+// The average number of jobs per second pushed to and fetched from
+// a queue over the last minute.
+type QueueRates struct {
+	Enqueued float64 `json:"enqueued_per_sec"`
+	Dequeued float64 `json:"dequeued_per_sec"`
+}
+
+// Rates are averaged over rateBuckets complete buckets, the
+// current bucket is still filling up.
+const (
+	rateBuckets    = 6
+	rateBucketSecs = 10
+)
+
+// rateCounter counts events in 10 second buckets.
+type rateCounter struct {
+	counts [rateBuckets + 1]uint64
+	slots  [rateBuckets + 1]int64
+}
+
+func (rc *rateCounter) add(now time.Time, n uint64) {
+	slot := now.Unix() / rateBucketSecs
+	idx := slot % int64(len(rc.slots))
+	if rc.slots[idx] != slot {
+		rc.slots[idx] = slot
+		rc.counts[idx] = 0
+	}
+	rc.counts[idx] += n
+}
+
+func (rc *rateCounter) rate(now time.Time) float64 {
+	slot := now.Unix() / rateBucketSecs
+	total := uint64(0)
+	for idx, s := range rc.slots {
+		if s < slot && s >= slot-rateBuckets {
+			total += rc.counts[idx]
+		}
+	}
+	return float64(total) / (rateBuckets * rateBucketSecs)
+}
+
+type queueRates struct {
+	mu     sync.Mutex
+	queues map[string]*[2]rateCounter
+}
+
+func (qr *queueRates) counters(queue string) *[2]rateCounter {
+	if qr.queues == nil {
+		qr.queues = map[string]*[2]rateCounter{}
+	}
+	counters, ok := qr.queues[queue]
+	if !ok {
+		counters = &[2]rateCounter{}
+		qr.queues[queue] = counters
+	}
+	return counters
+}
+
+func (qr *queueRates) enqueued(queue string, n uint64) {
+	qr.mu.Lock()
+	qr.counters(queue)[0].add(time.Now(), n)
+	qr.mu.Unlock()
+}
+
+func (qr *queueRates) dequeued(queue string) {
+	qr.mu.Lock()
+	qr.counters(queue)[1].add(time.Now(), 1)
+	qr.mu.Unlock()
+}
+
+func (qr *queueRates) get(queue string, now time.Time) QueueRates {
+	qr.mu.Lock()
+	defer qr.mu.Unlock()
+	counters, ok := qr.queues[queue]
+	if !ok {
+		return QueueRates{}
+	}
+	return QueueRates{Enqueued: counters[0].rate(now), Dequeued: counters[1].rate(now)}
+}
+
+func (m *manager) QueueRates(queue string) QueueRates {
+	return m.rates.get(queue, time.Now())
+}
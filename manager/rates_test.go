@@ -0,0 +1,29 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueueRates(t *testing.T) {
+	var rc rateCounter
+	start := time.Unix(1000, 0)
+	for i := 0; i < 60; i++ {
+		rc.add(start.Add(time.Duration(i)*time.Second), 2)
+	}
+	// the bucket in progress doesn't count yet
+	assert.InDelta(t, 100.0/60, rc.rate(start.Add(50*time.Second)), 0.001)
+	assert.Equal(t, 2.0, rc.rate(start.Add(60*time.Second)))
+	assert.InDelta(t, 1.0/3, rc.rate(start.Add(110*time.Second)), 0.001)
+	assert.Equal(t, 0.0, rc.rate(start.Add(10*time.Minute)))
+
+	var qr queueRates
+	assert.Equal(t, QueueRates{}, qr.get("default", time.Now()))
+	qr.enqueued("default", 3)
+	qr.dequeued("default")
+	rates := qr.get("default", time.Now().Add(rateBucketSecs*time.Second))
+	assert.InDelta(t, 3.0/60, rates.Enqueued, 0.001)
+	assert.InDelta(t, 1.0/60, rates.Dequeued, 0.001)
+}
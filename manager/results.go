@@ -0,0 +1,59 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/contribsys/faktory/util"
+)
+
+// ResultTTL is how long a job's result is kept after it's stored.
+var ResultTTL = 24 * time.Hour
+
+// MaxResultSize is the largest result, in bytes, a job may store.
+// Results are meant for small outcomes such as an id or a status,
+// not for returning data sets.
+const MaxResultSize = 64 * 1024
+
+// JobResult is the result a worker stored when it acknowledged
+// the job.
+type JobResult struct {
+	Jid         string          `json:"jid"`
+	Result      json.RawMessage `json:"result"`
+	CompletedAt string          `json:"completed_at"`
+}
+
+// CheckResult returns an error if the result can't be stored, so
+// callers can reject it before acknowledging the job.
+func CheckResult(result json.RawMessage) error {
+	if len(result) > MaxResultSize {
+		return fmt.Errorf("Result is %d bytes, the maximum is %d", len(result), MaxResultSize)
+	}
+	return nil
+}
+
+func (m *manager) SetResult(jid string, result json.RawMessage) error {
+	err := CheckResult(result)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(&JobResult{Jid: jid, Result: result, CompletedAt: util.Nows()})
+	if err != nil {
+		return err
+	}
+	return m.store.SetResult(jid, data, ResultTTL)
+}
+
+func (m *manager) GetResult(jid string) (*JobResult, error) {
+	data, err := m.store.GetResult(jid)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var result JobResult
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
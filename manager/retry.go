@@ -3,7 +3,6 @@ package manager
 import (
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"strings"
 	"time"
 
@@ -17,6 +16,37 @@ type FailPayload struct {
 	ErrorMessage string   `json:"message"`
 	ErrorType    string   `json:"errtype"`
 	Backtrace    []string `json:"backtrace"`
+
+	// The worker may say when the job should be retried, e.g. once
+	// a rate limit resets, at a time or in so many seconds.  Both
+	// blank uses the usual backoff.
+	RetryAt string `json:"retry_at,omitempty"`
+	RetryIn int    `json:"retry_in,omitempty"`
+
+	// set by Kill, the job isn't retried
+	kill bool
+}
+
+// When the worker asked for the job to be retried, the zero time
+// if it didn't.
+func (failure *FailPayload) retryTime(now time.Time) (time.Time, error) {
+	if failure.RetryAt != "" && failure.RetryIn != 0 {
+		return time.Time{}, fmt.Errorf("FAIL may give retry_at or retry_in, not both")
+	}
+	if failure.RetryIn < 0 {
+		return time.Time{}, fmt.Errorf("Invalid retry_in %d, must be a positive number of seconds", failure.RetryIn)
+	}
+	if failure.RetryIn > 0 {
+		return now.Add(time.Duration(failure.RetryIn) * time.Second), nil
+	}
+	if failure.RetryAt != "" {
+		t, err := util.ParseTime(failure.RetryAt)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Invalid timestamp for 'retry_at': '%s'", failure.RetryAt)
+		}
+		return t, nil
+	}
+	return time.Time{}, nil
 }
 
 func (m *manager) Fail(failure *FailPayload) error {
@@ -28,12 +58,28 @@ func (m *manager) Fail(failure *FailPayload) error {
 	if jid == "" {
 		return fmt.Errorf("Missing JID")
 	}
+	_, err := failure.retryTime(time.Now())
+	if err != nil {
+		return err
+	}
 
 	cleanse(failure)
 
 	return m.processFailure(jid, failure)
 }
 
+func (m *manager) Kill(failure *FailPayload) error {
+	if failure == nil {
+		return fmt.Errorf("No failure")
+	}
+	if failure.Jid == "" {
+		return fmt.Errorf("Missing JID")
+	}
+	cleanse(failure)
+	failure.kill = true
+	return m.processFailure(failure.Jid, failure)
+}
+
 func cleanse(failure *FailPayload) {
 	failure.ErrorType = strings.TrimSpace(failure.ErrorType)
 	failure.ErrorMessage = strings.TrimSpace(failure.ErrorMessage)
@@ -71,6 +117,7 @@ func (m *manager) clearReservation(jid string) *Reservation {
 	}
 
 	delete(m.workingMap, jid)
+	m.freeSlot(res.Job.Queue)
 	m.workingMutex.Unlock()
 	return res
 }
@@ -96,9 +143,12 @@ func (m *manager) processFailure(jid string, failure *FailPayload) error {
 	m.store.Failure()
 
 	job := res.Job
-	if job.Retry == 0 {
+	if job.Retry == 0 && !failure.kill {
 		// no retry, no death, completely ephemeral, goodbye
-		return nil
+		m.unlockUnique(job, UniqueUntilSuccess)
+		m.batchJobDone(job, false)
+		m.dependencyDone(job, false)
+		return m.pushSuccessors(job.ThenOnFail)
 	}
 
 	if job.Failure != nil {
@@ -116,16 +166,29 @@ func (m *manager) processFailure(jid string, failure *FailPayload) error {
 		}
 	}
 
+	// Fail has checked the worker's retry time
+	at, _ := failure.retryTime(time.Now())
 	return callMiddleware(m.failChain, job, func() error {
-		if job.Failure.RetryCount < job.Retry {
-			return retryLater(m.store, job)
+		m.batchJobDone(job, false)
+		if job.Failure.RetryCount < job.Retry && !failure.kill {
+			if at.IsZero() {
+				at = m.nextRetry(job)
+			}
+			return retryLater(m.store, job, at)
+		}
+		err := m.sendToMorgue(job)
+		if err != nil {
+			return err
 		}
-		return sendToMorgue(m.store, job)
+		// the job will never succeed, stop blocking its duplicates
+		m.unlockUnique(job, UniqueUntilSuccess)
+		m.dependencyDone(job, false)
+		return m.pushSuccessors(job.ThenOnFail)
 	})
 }
 
-func retryLater(store storage.Store, job *client.Job) error {
-	when := util.Thens(nextRetry(job))
+func retryLater(store storage.Store, job *client.Job, at time.Time) error {
+	when := util.Thens(at)
 	job.Failure.NextAt = when
 	bytes, err := json.Marshal(job)
 	if err != nil {
@@ -135,18 +198,32 @@ func retryLater(store storage.Store, job *client.Job) error {
 	return store.Retries().AddElement(when, job.Jid, bytes)
 }
 
-func sendToMorgue(store storage.Store, job *client.Job) error {
-	bytes, err := json.Marshal(job)
-	if err != nil {
-		return err
+func (m *manager) sendToMorgue(job *client.Job) error {
+	if max, overflow := m.deadLimit(); max > 0 && overflow == DeadRefuse && m.store.Dead().Size() >= max {
+		util.Warnw(fmt.Sprintf("Dead set is full with %d jobs, discarding job", max), jobFields(job))
+		// still dead, so still forwarded and announced
+		if m.opts.OnDeath != nil {
+			m.opts.OnDeath(job)
+		}
+		return nil
 	}
 
-	expiry := util.Thens(time.Now().Add(DeadTTL))
-	return store.Dead().AddElement(expiry, job.Jid, bytes)
-}
+	err := callMiddleware(m.killChain, job, func() error {
+		bytes, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
 
-func nextRetry(job *client.Job) time.Time {
-	count := job.Failure.RetryCount
-	secs := (count * count * count * count) + 15 + (rand.Intn(30) * (count + 1))
-	return time.Now().Add(time.Duration(secs) * time.Second)
+		expiry := util.Thens(time.Now().Add(DeadTTL))
+		return m.store.Dead().AddElement(expiry, job.Jid, bytes)
+	})
+	if h, ok := err.(halt); ok {
+		// middleware discarded the job rather than keep it dead
+		util.Infow(h.Error(), jobFields(job))
+		return nil
+	}
+	if err == nil && m.opts.OnDeath != nil {
+		m.opts.OnDeath(job)
+	}
+	return err
 }
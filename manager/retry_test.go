@@ -2,9 +2,11 @@ package manager
 
 import (
 	"testing"
+	"time"
 
 	"github.com/contribsys/faktory/client"
 	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/util"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -18,7 +20,7 @@ func TestRetry(t *testing.T) {
 			job := client.NewJob("ManagerPush", 1, 2, 3)
 			job.Retry = 1
 
-			err := m.reserve("workerId", job)
+			err := m.reserve("workerId", job, nil)
 
 			assert.NoError(t, err)
 			assert.EqualValues(t, 1, store.Working().Size())
@@ -39,7 +41,7 @@ func TestRetry(t *testing.T) {
 			assert.EqualValues(t, 1, store.TotalFailures())
 
 			// retry job
-			err = m.reserve("workerId", job)
+			err = m.reserve("workerId", job, nil)
 
 			assert.NoError(t, err)
 			assert.EqualValues(t, 1, store.Working().Size())
@@ -67,7 +69,7 @@ func TestRetry(t *testing.T) {
 			job := client.NewJob("ManagerPush", 1, 2, 3)
 			job.Retry = 0
 
-			err := m.reserve("workerId", job)
+			err := m.reserve("workerId", job, nil)
 
 			assert.NoError(t, err)
 			assert.EqualValues(t, 1, store.Working().Size())
@@ -89,6 +91,60 @@ func TestRetry(t *testing.T) {
 			assert.EqualValues(t, 1, store.TotalFailures())
 		})
 
+		t.Run("FailRetryIn", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store).(*manager)
+
+			job := client.NewJob("ManagerPush", 1, 2, 3)
+			err := m.reserve("workerId", job, nil)
+			assert.NoError(t, err)
+
+			fail := failure(job.Jid, "rate limited", "RateLimited", nil)
+			fail.RetryIn = 900
+			err = m.Fail(fail)
+			assert.NoError(t, err)
+
+			var at time.Time
+			err = store.Retries().Each(func(_ int, entry storage.SortedEntry) error {
+				retried, err := entry.Job()
+				if err != nil {
+					return err
+				}
+				at, err = util.ParseTime(retried.Failure.NextAt)
+				return err
+			})
+			assert.NoError(t, err)
+			assert.WithinDuration(t, time.Now().Add(15*time.Minute), at, 5*time.Second)
+		})
+
+		t.Run("FailWithBackoff", func(t *testing.T) {
+			store.Flush()
+			m := NewManagerWithOptions(store, Options{
+				Backoff: func(jobtype string) Backoff {
+					return Backoff{Strategy: BackoffFixed, Interval: time.Hour}
+				},
+			}).(*manager)
+
+			nextAt := func(job *client.Job) time.Time {
+				err := m.reserve("workerId", job, nil)
+				assert.NoError(t, err)
+				err = m.Fail(failure(job.Jid, "uh no", "SomeError", nil))
+				assert.NoError(t, err)
+				at, err := util.ParseTime(job.Failure.NextAt)
+				assert.NoError(t, err)
+				return at
+			}
+
+			job := client.NewJob("ManagerPush", 1)
+			assert.WithinDuration(t, time.Now().Add(time.Hour), nextAt(job), 5*time.Second)
+
+			// the job's own backoff wins
+			job = client.NewJob("ManagerPush", 2)
+			job.Backoff = "linear:10m"
+			assert.WithinDuration(t, time.Now().Add(10*time.Minute), nextAt(job), 5*time.Second)
+			assert.WithinDuration(t, time.Now().Add(20*time.Minute), nextAt(job), 5*time.Second)
+		})
+
 		t.Run("FailWithInvalidFailPayload", func(t *testing.T) {
 			store.Flush()
 			m := NewManager(store)
@@ -104,6 +160,10 @@ func TestRetry(t *testing.T) {
 			err = m.Fail(&FailPayload{Jid: "1238123123"})
 			assert.Error(t, err)
 			assert.Contains(t, err.Error(), "not found")
+
+			err = m.Fail(&FailPayload{Jid: "1238123123", RetryIn: -1})
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "retry_in")
 		})
 	})
 }
@@ -116,3 +176,26 @@ func failure(jid, msg, errtype string, bt []string) *FailPayload {
 	f.Backtrace = bt
 	return &f
 }
+
+func TestFailRetryTime(t *testing.T) {
+	now := time.Now()
+
+	at, err := (&FailPayload{}).retryTime(now)
+	assert.NoError(t, err)
+	assert.True(t, at.IsZero())
+
+	at, err = (&FailPayload{RetryIn: 900}).retryTime(now)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(15*time.Minute), at)
+
+	at, err = (&FailPayload{RetryAt: "2030-01-01T00:00:00Z"}).retryTime(now)
+	assert.NoError(t, err)
+	assert.Equal(t, 2030, at.Year())
+
+	_, err = (&FailPayload{RetryAt: "later"}).retryTime(now)
+	assert.Error(t, err)
+	_, err = (&FailPayload{RetryIn: -5}).retryTime(now)
+	assert.Error(t, err)
+	_, err = (&FailPayload{RetryIn: 5, RetryAt: "2030-01-01T00:00:00Z"}).retryTime(now)
+	assert.Error(t, err)
+}
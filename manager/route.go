@@ -0,0 +1,140 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/contribsys/faktory/client"
+)
+
+// A Router picks the queue each pushed job goes to, see
+// Options.Router.
+type Router interface {
+	// Route returns the job's queue, its own Queue or "" to leave it
+	// there.  An error fails the push.  Successors are routed when
+	// they're pushed with their parent and again when they're
+	// enqueued, so routing should give the same queue each time.
+	Route(job *client.Job) (string, error)
+}
+
+// A Route sends each job which matches all of its conditions to To.
+// With ShardBy, the argument path as in MutateFilter, "{shard}" in To
+// is replaced with the FNV-1a hash of that argument's JSON modulo
+// Shards, so e.g. a customer's jobs always go to the same queue.
+type Route struct {
+	// path.Match patterns for the jobtype and the queue it was
+	// pushed to.
+	Jobtype string
+	Queue   string
+	// Match jobs whose args, as pushed, are at least this large.
+	MinBytes int
+
+	To      string
+	ShardBy string
+	Shards  int
+
+	shardPath []string
+}
+
+func (r *Route) compile() error {
+	for _, pattern := range []string{r.Jobtype, r.Queue} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%q is not a valid pattern", pattern)
+		}
+	}
+	if r.To == "" {
+		return fmt.Errorf("A route needs a queue to send jobs to")
+	}
+	if r.ShardBy == "" {
+		if r.Shards != 0 || strings.Contains(r.To, "{shard}") {
+			return fmt.Errorf("Routing to shards needs shard_by")
+		}
+		return nil
+	}
+	r.shardPath = strings.Split(r.ShardBy, ".")
+	if _, err := strconv.Atoi(r.shardPath[0]); err != nil {
+		return fmt.Errorf("Invalid shard_by %q, it must start with an argument index", r.ShardBy)
+	}
+	if r.Shards < 1 || !strings.Contains(r.To, "{shard}") {
+		return fmt.Errorf("Routing by %s needs a shard count and {shard} in its queue", r.ShardBy)
+	}
+	return nil
+}
+
+// The job's queue if it matches, "" otherwise.
+func (r *Route) route(job *client.Job) (string, error) {
+	if r.Jobtype != "" {
+		if ok, _ := path.Match(r.Jobtype, job.Type); !ok {
+			return "", nil
+		}
+	}
+	if r.Queue != "" {
+		if ok, _ := path.Match(r.Queue, job.Queue); !ok {
+			return "", nil
+		}
+	}
+	if r.MinBytes > 0 {
+		data, err := json.Marshal(job.Args)
+		if err != nil {
+			return "", err
+		}
+		if len(data) < r.MinBytes {
+			return "", nil
+		}
+	}
+	if r.shardPath == nil {
+		return r.To, nil
+	}
+
+	args := job.Args
+	if job.ArgsEncoding != "" {
+		out := *job
+		err := out.DecompressArgs()
+		if err != nil {
+			return "", err
+		}
+		args = out.Args
+	}
+	value, ok := lookupPath(args, r.shardPath)
+	if !ok {
+		return "", nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	hash := fnv.New32a()
+	hash.Write(data)
+	shard := hash.Sum32() % uint32(r.Shards)
+	return strings.Replace(r.To, "{shard}", strconv.Itoa(int(shard)), -1), nil
+}
+
+// Routes is a Router which tries each Route in order, the first
+// which matches a job wins.
+type Routes []*Route
+
+// NewRoutes checks each route, returning an error for the first
+// which is invalid.
+func NewRoutes(routes ...*Route) (Routes, error) {
+	for idx, r := range routes {
+		err := r.compile()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid route %d: %v", idx+1, err)
+		}
+	}
+	return Routes(routes), nil
+}
+
+func (routes Routes) Route(job *client.Job) (string, error) {
+	for _, r := range routes {
+		queue, err := r.route(job)
+		if err != nil || queue != "" {
+			return queue, err
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,88 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoutes(t *testing.T) {
+	routes, err := NewRoutes(
+		&Route{Jobtype: "Sync*", To: "customers_{shard}", ShardBy: "0.customer_id", Shards: 8},
+		&Route{Queue: "default", MinBytes: 100, To: "oversized"},
+	)
+	assert.NoError(t, err)
+
+	route := func(job *client.Job) string {
+		// as if read from a PUSH
+		data, err := json.Marshal(job)
+		assert.NoError(t, err)
+		assert.NoError(t, json.Unmarshal(data, job))
+		queue, err := routes.Route(job)
+		assert.NoError(t, err)
+		return queue
+	}
+
+	shards := map[string]bool{}
+	for id := 0; id < 100; id++ {
+		queue := route(client.NewJob("SyncCustomer", map[string]interface{}{"customer_id": id}))
+		assert.True(t, strings.HasPrefix(queue, "customers_"), queue)
+		shards[queue] = true
+		// always the same shard
+		assert.Equal(t, queue, route(client.NewJob("SyncOrders", map[string]interface{}{"customer_id": id})))
+	}
+	assert.Len(t, shards, 8)
+
+	big := client.NewJob("Report", strings.Repeat("x", 100))
+	assert.Equal(t, "oversized", route(big))
+	small := client.NewJob("Report", strings.Repeat("x", 10))
+	assert.Equal(t, "", route(small))
+	big.Queue = "low"
+	assert.Equal(t, "", route(big))
+	// no customer_id, so the next route
+	assert.Equal(t, "", route(client.NewJob("SyncCustomer", 1)))
+
+	compressed := client.NewJob("SyncCustomer", map[string]interface{}{"customer_id": 1234})
+	expected := route(compressed)
+	assert.NoError(t, compressed.CompressArgs())
+	assert.Equal(t, expected, route(compressed))
+
+	for _, bad := range []*Route{
+		{Jobtype: "Sync["},
+		{Jobtype: "Sync"},
+		{To: "customers_{shard}"},
+		{To: "customers", ShardBy: "0", Shards: 8},
+		{To: "customers_{shard}", ShardBy: "0"},
+		{To: "customers_{shard}", ShardBy: "customer_id", Shards: 8},
+	} {
+		_, err := NewRoutes(bad)
+		assert.Error(t, err, fmt.Sprintf("%+v", bad))
+	}
+}
+
+func TestRoutedPush(t *testing.T) {
+	withRedis(t, "route", func(t *testing.T, store storage.Store) {
+		store.Flush()
+		routes, err := NewRoutes(&Route{Jobtype: "Invoice", To: "billing"})
+		assert.NoError(t, err)
+		m := NewManagerWithOptions(store, Options{Router: routes})
+
+		job := client.NewJob("Invoice", 1)
+		job.Then = []*client.Job{client.NewJob("Invoice", 2)}
+		assert.NoError(t, m.Push(job))
+		assert.Equal(t, "billing", job.Queue)
+		assert.Equal(t, "billing", job.Then[0].Queue)
+		q, err := store.GetQueue("billing")
+		assert.NoError(t, err)
+		assert.EqualValues(t, 1, q.Size())
+
+		other := client.NewJob("Report", 1)
+		assert.NoError(t, m.Push(other))
+		assert.Equal(t, "default", other.Queue)
+	})
+}
@@ -2,22 +2,35 @@ package manager
 
 import (
 	"encoding/json"
+	"errors"
+	"time"
 
 	"github.com/contribsys/faktory/client"
 	"github.com/contribsys/faktory/storage"
 	"github.com/contribsys/faktory/util"
 )
 
+// How many due jobs are removed from a set and pushed at a time.
+var ScheduleBatchSize = 1000
+
+// How long one pass over a set may spend on batches of due jobs
+// before it stops, so a large backlog can't hold up the server's
+// other tasks.  The pass returns ErrMoreDue and the rest are left
+// for the next.
+var ScheduleTimeBudget = 250 * time.Millisecond
+
+// ErrMoreDue is returned, along with the count so far, by a pass
+// which ran out of ScheduleTimeBudget with jobs still due.
+var ErrMoreDue = errors.New("more jobs are due")
+
 func (m *manager) Purge() (int64, error) {
 	// TODO We need to purge the dead set if it collects more
 	// than N elements.  The dead set shouldn't be able to collect
 	// millions or billions of jobs.  Sidekiq uses a default max size
 	// of 10,000 jobs.
-	dead, err := m.store.Dead().RemoveBefore(util.Nows())
-	if err != nil {
-		return 0, err
-	}
-	return int64(len(dead)), nil
+	return eachBatch(m.store.Dead(), func(dead [][]byte) int64 {
+		return int64(len(dead))
+	})
 }
 
 func (m *manager) EnqueueScheduledJobs() (int64, error) {
@@ -28,13 +41,47 @@ func (m *manager) RetryJobs() (int64, error) {
 	return m.schedule(m.store.Retries())
 }
 
-func (m *manager) schedule(set storage.SortedSet) (int64, error) {
-	elms, err := set.RemoveBefore(util.Nows())
-	if err != nil {
-		return 0, err
+// The next batch of elements due by timestamp, or all of them if the
+// set can't remove a batch at a time.
+func removeBatch(set storage.SortedSet, timestamp string) ([][]byte, error) {
+	if batched, ok := set.(storage.BatchedSet); ok {
+		return batched.RemoveBatchBefore(timestamp, ScheduleBatchSize)
 	}
+	return set.RemoveBefore(timestamp)
+}
 
+// Remove the due elements a batch at a time, passing each batch to fn
+// and totalling its counts, for up to ScheduleTimeBudget.
+func eachBatch(set storage.SortedSet, fn func(elms [][]byte) int64) (int64, error) {
+	start := time.Now()
+	now := util.Thens(start)
 	count := int64(0)
+	for {
+		elms, err := removeBatch(set, now)
+		if err != nil {
+			return count, err
+		}
+		count += fn(elms)
+		if len(elms) < ScheduleBatchSize {
+			return count, nil
+		}
+		if time.Since(start) >= ScheduleTimeBudget {
+			return count, ErrMoreDue
+		}
+	}
+}
+
+// Enqueue the due jobs a batch at a time, each batch pushed in one
+// transaction rather than a round trip per job.
+func (m *manager) schedule(set storage.SortedSet) (int64, error) {
+	return eachBatch(set, m.enqueueBatch)
+}
+
+// Run each job through the push middleware and push those it lets
+// through, returning how many were pushed.  The middleware returns
+// before the batch is pushed so it can't see the push fail.
+func (m *manager) enqueueBatch(elms [][]byte) int64 {
+	entries := make([]storage.BulkEntry, 0, len(elms))
 	for _, elm := range elms {
 		var job client.Job
 		err := json.Unmarshal(elm, &job)
@@ -43,14 +90,47 @@ func (m *manager) schedule(set storage.SortedSet) (int64, error) {
 			continue
 		}
 
-		err = m.enqueue(&job)
+		job.EnqueuedAt = util.Nows()
+		err = callMiddleware(m.pushChain, &job, func() error {
+			data, err := json.Marshal(&job)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, storage.BulkEntry{Queue: job.Queue, Priority: job.Priority, Data: data})
+			return nil
+		})
 		if err != nil {
 			util.Warnf("Error pushing job to '%s': %s", job.Queue, err.Error())
-			continue
 		}
+	}
+	if len(entries) == 0 {
+		return 0
+	}
 
-		count++
+	pushed := entries
+	err := m.store.PushBulk(entries)
+	if err != nil {
+		// one bad job, e.g. an invalid queue name, fails the whole
+		// batch so push them one at a time
+		pushed = nil
+		for _, entry := range entries {
+			q, err := m.store.GetQueue(entry.Queue)
+			if err == nil {
+				err = q.Push(entry.Priority, entry.Data)
+			}
+			if err != nil {
+				util.Warnf("Error pushing job to '%s': %s", entry.Queue, err.Error())
+				continue
+			}
+			pushed = append(pushed, entry)
+		}
 	}
 
-	return count, nil
+	for _, entry := range pushed {
+		m.rates.enqueued(entry.Queue, 1)
+	}
+	if len(pushed) > 0 {
+		m.pushed()
+	}
+	return int64(len(pushed))
 }
@@ -123,6 +123,38 @@ func TestScheduler(t *testing.T) {
 			assert.EqualValues(t, 1, q.Size())
 			assert.EqualValues(t, 0, store.Retries().Size())
 		})
+
+		t.Run("EnqueueScheduledBacklog", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store)
+
+			size, budget := ScheduleBatchSize, ScheduleTimeBudget
+			defer func() { ScheduleBatchSize, ScheduleTimeBudget = size, budget }()
+			ScheduleBatchSize = 2
+			ScheduleTimeBudget = 0
+
+			for i := 0; i < 5; i++ {
+				addJob(t, store.Scheduled(), util.Thens(time.Now()), client.NewJob("ScheduledJob", i))
+			}
+			q, err := store.GetQueue("default")
+			assert.NoError(t, err)
+
+			// each pass stops after a batch, leaving the rest
+			count, err := m.EnqueueScheduledJobs()
+			assert.Equal(t, ErrMoreDue, err)
+			assert.EqualValues(t, 2, count)
+			assert.EqualValues(t, 3, store.Scheduled().Size())
+
+			count, err = m.EnqueueScheduledJobs()
+			assert.Equal(t, ErrMoreDue, err)
+			assert.EqualValues(t, 2, count)
+
+			count, err = m.EnqueueScheduledJobs()
+			assert.NoError(t, err)
+			assert.EqualValues(t, 1, count)
+			assert.EqualValues(t, 5, q.Size())
+			assert.EqualValues(t, 0, store.Scheduled().Size())
+		})
 	})
 }
 
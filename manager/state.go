@@ -0,0 +1,94 @@
+package manager
+
+import (
+	"encoding/json"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/storage"
+)
+
+// JobState is where a job is right now, see JobState.  Reserved
+// jobs also have the worker holding them and when the reservation
+// was made and runs out.
+type JobState struct {
+	Jid        string      `json:"jid"`
+	State      string      `json:"state"`
+	Job        *client.Job `json:"job,omitempty"`
+	Wid        string      `json:"wid,omitempty"`
+	ReservedAt string      `json:"reserved_at,omitempty"`
+	ExpiresAt  string      `json:"expires_at,omitempty"`
+}
+
+// The states JobState may report.
+const (
+	JobWorking   = "working"
+	JobScheduled = "scheduled"
+	JobRetrying  = "retries"
+	JobDead      = "dead"
+	JobHeld      = "held"
+	JobEnqueued  = "enqueued"
+	JobUnknown   = "unknown"
+)
+
+func (m *manager) JobState(jid string) (*JobState, error) {
+	m.workingMutex.RLock()
+	res, ok := m.workingMap[jid]
+	m.workingMutex.RUnlock()
+	if ok {
+		return &JobState{
+			Jid:        jid,
+			State:      JobWorking,
+			Job:        res.Job,
+			Wid:        res.Wid,
+			ReservedAt: res.Since,
+			ExpiresAt:  res.Expiry,
+		}, nil
+	}
+
+	for _, set := range []struct {
+		state string
+		set   storage.SortedSet
+	}{
+		{JobScheduled, m.store.Scheduled()},
+		{JobRetrying, m.store.Retries()},
+		{JobDead, m.store.Dead()},
+	} {
+		data, err := set.set.FindJid(jid)
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			return jobState(jid, set.state, data)
+		}
+	}
+
+	data, err := m.store.HeldJob(jid)
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		return jobState(jid, JobHeld, data)
+	}
+
+	m.store.EachQueue(func(q storage.Queue) {
+		if err == nil && data == nil {
+			data, err = q.FindJid(jid)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		return jobState(jid, JobEnqueued, data)
+	}
+	return &JobState{Jid: jid, State: JobUnknown}, nil
+}
+
+func jobState(jid string, state string, data []byte) (*JobState, error) {
+	var job client.Job
+	err := json.Unmarshal(data, &job)
+	if err != nil {
+		return nil, err
+	}
+	return &JobState{Jid: jid, State: state, Job: &job}, nil
+}
@@ -0,0 +1,138 @@
+package manager
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Throttle caps how many jobs may be fetched from a queue, Limit per
+// Period.  Bursts of up to Limit jobs are allowed after the queue
+// has been idle.  The zero value doesn't throttle.
+type Throttle struct {
+	Limit  int
+	Period time.Duration
+}
+
+// The throttle in ParseThrottle's format, "" for the zero Throttle.
+func (t Throttle) String() string {
+	if t.Limit < 1 || t.Period <= 0 {
+		return ""
+	}
+	period := t.Period.String()
+	switch t.Period {
+	case time.Second:
+		period = "s"
+	case time.Minute:
+		period = "m"
+	case time.Hour:
+		period = "h"
+	}
+	return fmt.Sprintf("%d/%s", t.Limit, period)
+}
+
+// ParseThrottle parses throttles such as "10/s", "100/m" or "5/30s".
+func ParseThrottle(value string) (Throttle, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return Throttle{}, fmt.Errorf("Invalid throttle %q, expected jobs/period such as 10/s", value)
+	}
+	limit, err := strconv.Atoi(parts[0])
+	if err != nil || limit < 1 {
+		return Throttle{}, fmt.Errorf("Invalid throttle %q, jobs must be a positive integer", value)
+	}
+	period := parts[1]
+	switch period {
+	case "s", "m", "h":
+		period = "1" + period
+	}
+	dur, err := time.ParseDuration(period)
+	if err != nil || dur <= 0 {
+		return Throttle{}, fmt.Errorf("Invalid throttle %q, period must be s, m, h or a duration", value)
+	}
+	return Throttle{Limit: limit, Period: dur}, nil
+}
+
+// queueThrottles holds a token bucket per throttled queue.  A
+// fetch takes a token before popping and returns it if the queue
+// was empty.
+type queueThrottles struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Refill the queue's bucket and return it, nil if t doesn't throttle.
+func (qt *queueThrottles) bucket(queue string, t Throttle, now time.Time) *tokenBucket {
+	if t.Limit < 1 || t.Period <= 0 {
+		return nil
+	}
+	if qt.buckets == nil {
+		qt.buckets = map[string]*tokenBucket{}
+	}
+	b, ok := qt.buckets[queue]
+	if !ok {
+		b = &tokenBucket{tokens: float64(t.Limit), last: now}
+		qt.buckets[queue] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * float64(t.Limit) / t.Period.Seconds()
+	if b.tokens > float64(t.Limit) {
+		b.tokens = float64(t.Limit)
+	}
+	b.last = now
+	return b
+}
+
+// Take a token, or return how long until the next one.
+func (qt *queueThrottles) take(queue string, t Throttle, now time.Time) (bool, time.Duration) {
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+	b := qt.bucket(queue, t, now)
+	if b == nil {
+		return true, 0
+	}
+	if b.tokens < 1 {
+		secs := (1 - b.tokens) * t.Period.Seconds() / float64(t.Limit)
+		return false, time.Duration(secs * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Add n to the bucket, negative to spend tokens it doesn't have.
+func (qt *queueThrottles) add(queue string, t Throttle, n float64) {
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+	b := qt.bucket(queue, t, time.Now())
+	if b != nil {
+		b.tokens += n
+	}
+}
+
+func (m *manager) throttle(queue string) Throttle {
+	if m.opts.Throttle == nil {
+		return Throttle{}
+	}
+	return m.opts.Throttle(queue)
+}
+
+// Take a token to fetch a job from the queue, see queueThrottles.
+func (m *manager) takeToken(queue string) (bool, time.Duration) {
+	return m.throttles.take(queue, m.throttle(queue), time.Now())
+}
+
+func (m *manager) returnToken(queue string) {
+	m.throttles.add(queue, m.throttle(queue), 1)
+}
+
+// A blocking pop can't take a token up front, the job it
+// returns is paid for by delaying later fetches.
+func (m *manager) spendToken(queue string) {
+	m.throttles.add(queue, m.throttle(queue), -1)
+}
@@ -0,0 +1,55 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseThrottle(t *testing.T) {
+	th, err := ParseThrottle("10/s")
+	assert.NoError(t, err)
+	assert.Equal(t, Throttle{Limit: 10, Period: time.Second}, th)
+	th, err = ParseThrottle("100/m")
+	assert.NoError(t, err)
+	assert.Equal(t, Throttle{Limit: 100, Period: time.Minute}, th)
+	th, err = ParseThrottle("5/30s")
+	assert.NoError(t, err)
+	assert.Equal(t, Throttle{Limit: 5, Period: 30 * time.Second}, th)
+	assert.Equal(t, "5/30s", th.String())
+	assert.Equal(t, "10/s", Throttle{Limit: 10, Period: time.Second}.String())
+	assert.Equal(t, "", Throttle{}.String())
+
+	for _, bad := range []string{"", "10", "0/s", "-1/s", "x/s", "10/d", "10/0s"} {
+		_, err = ParseThrottle(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestQueueThrottles(t *testing.T) {
+	var qt queueThrottles
+	th := Throttle{Limit: 2, Period: time.Second}
+	now := time.Unix(1000, 0)
+
+	ok, _ := qt.take("default", Throttle{}, now)
+	assert.True(t, ok)
+
+	ok, _ = qt.take("api", th, now)
+	assert.True(t, ok)
+	ok, _ = qt.take("api", th, now)
+	assert.True(t, ok)
+	ok, wait := qt.take("api", th, now)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	ok, _ = qt.take("api", th, now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+	// refills stop at the limit
+	ok, _ = qt.take("api", th, now.Add(time.Hour))
+	assert.True(t, ok)
+	ok, _ = qt.take("api", th, now.Add(time.Hour))
+	assert.True(t, ok)
+	ok, _ = qt.take("api", th, now.Add(time.Hour))
+	assert.False(t, ok)
+}
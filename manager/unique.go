@@ -0,0 +1,161 @@
+package manager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/util"
+)
+
+// When a unique job releases its lock, see client.Job.UniqueUntil.
+const (
+	UniqueUntilSuccess = "success"
+	UniqueUntilStart   = "start"
+)
+
+// How long a job pushed with PUSHIF UNIQUE_TYPE holds its queue's
+// lock on its jobtype if it isn't released first, e.g. because the
+// job was lost.
+var UniqueTypeTTL = 24 * time.Hour
+
+// NotUniqueError is returned when a unique job is pushed while
+// another job with the same jobtype and args holds the lock.
+type NotUniqueError struct {
+	Jid    string
+	Holder string
+}
+
+func (e *NotUniqueError) Error() string {
+	return fmt.Sprintf("Job %s is not unique, %s is already pending", e.Jid, e.Holder)
+}
+
+func checkUnique(job *client.Job) error {
+	if job.UniqueFor < 0 {
+		return fmt.Errorf("unique_for cannot be negative")
+	}
+	switch job.UniqueUntil {
+	case "", UniqueUntilSuccess, UniqueUntilStart:
+		return nil
+	}
+	return fmt.Errorf("Invalid unique_until %q, expected %s or %s", job.UniqueUntil, UniqueUntilSuccess, UniqueUntilStart)
+}
+
+// Jobs are identical if they have the same jobtype and args,
+// whatever their queue or how the args are encoded.
+func uniqueDigest(job *client.Job) (string, error) {
+	decoded := job.Args
+	if job.ArgsEncoding != "" {
+		out := *job
+		err := out.DecompressArgs()
+		if err != nil {
+			return "", err
+		}
+		decoded = out.Args
+	}
+	args, err := json.Marshal(decoded)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.New()
+	sum.Write([]byte(job.Type))
+	sum.Write([]byte{0})
+	sum.Write(args)
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// The lock a UNIQUE_TYPE job holds on its queue and jobtype.
+func uniqueTypeDigest(job *client.Job) string {
+	sum := sha256.New()
+	sum.Write([]byte(job.Queue))
+	sum.Write([]byte{0})
+	sum.Write([]byte(job.Type))
+	sum.Write([]byte{0})
+	sum.Write([]byte("unique_type"))
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// Take the lock on the job's queue and jobtype for PUSHIF
+// UNIQUE_TYPE.  Returns false if another job holds it.
+func (m *manager) lockUniqueType(job *client.Job) (bool, error) {
+	holder, err := m.store.LockUnique(uniqueTypeDigest(job), job.Jid, UniqueTypeTTL)
+	if err != nil {
+		return false, err
+	}
+	return holder == "" || holder == job.Jid, nil
+}
+
+// Take the job's unique lock, if it's unique.  Scheduled jobs hold
+// the lock for unique_for seconds past their time.
+func (m *manager) lockUnique(job *client.Job) error {
+	if job.UniqueFor == 0 {
+		return nil
+	}
+	digest, err := uniqueDigest(job)
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Duration(job.UniqueFor) * time.Second
+	if job.At != "" {
+		t, _ := util.ParseTime(job.At)
+		if wait := t.Sub(time.Now()); wait > 0 {
+			ttl += wait
+		}
+	}
+	holder, err := m.store.LockUnique(digest, job.Jid, ttl)
+	if err != nil {
+		return err
+	}
+	if holder != "" && holder != job.Jid {
+		return &NotUniqueError{Jid: job.Jid, Holder: holder}
+	}
+	return nil
+}
+
+// Release the job's unique lock if it's released at this point,
+// until is UniqueUntilStart or UniqueUntilSuccess.
+// A jobtype lock is only released once the job succeeds or dies.
+func (m *manager) unlockUnique(job *client.Job, until string) {
+	if job.UniqueType && until == UniqueUntilSuccess {
+		m.releaseUniqueType(job)
+	}
+	if job.UniqueFor == 0 {
+		return
+	}
+	if job.UniqueUntil != until && !(job.UniqueUntil == "" && until == UniqueUntilSuccess) {
+		return
+	}
+	m.releaseUniqueArgs(job)
+}
+
+// Release the job's unique locks whatever its unique_until, e.g.
+// because it couldn't be pushed after all.
+func (m *manager) releaseUnique(job *client.Job) {
+	if job.UniqueType {
+		m.releaseUniqueType(job)
+	}
+	if job.UniqueFor != 0 {
+		m.releaseUniqueArgs(job)
+	}
+}
+
+func (m *manager) releaseUniqueArgs(job *client.Job) {
+	digest, err := uniqueDigest(job)
+	if err == nil {
+		err = m.store.UnlockUnique(digest, job.Jid)
+	}
+	if err != nil {
+		util.Error("Unable to release unique lock for "+job.Jid, err)
+	}
+}
+
+func (m *manager) releaseUniqueType(job *client.Job) {
+	err := m.store.UnlockUnique(uniqueTypeDigest(job), job.Jid)
+	if err != nil {
+		util.Error("Unable to release jobtype lock for "+job.Jid, err)
+	}
+}
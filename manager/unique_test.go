@@ -0,0 +1,42 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUniqueDigest(t *testing.T) {
+	a := client.NewJob("Report", 1, "daily")
+	b := client.NewJob("Report", 1, "daily")
+	b.Queue = "critical"
+	da, err := uniqueDigest(a)
+	assert.NoError(t, err)
+	db, err := uniqueDigest(b)
+	assert.NoError(t, err)
+	assert.Equal(t, da, db)
+
+	for _, other := range []*client.Job{
+		client.NewJob("Report", 1, "weekly"),
+		client.NewJob("Invoice", 1, "daily"),
+		client.NewJob("Report1", "daily"),
+	} {
+		d, err := uniqueDigest(other)
+		assert.NoError(t, err)
+		assert.NotEqual(t, da, d)
+	}
+
+	assert.NoError(t, checkUnique(a))
+	a.UniqueUntil = UniqueUntilStart
+	assert.NoError(t, checkUnique(a))
+	a.UniqueUntil = "end"
+	assert.Error(t, checkUnique(a))
+	a.UniqueUntil = ""
+	a.UniqueFor = -1
+	assert.Error(t, checkUnique(a))
+
+	// jobtype locks are per queue
+	assert.NotEqual(t, uniqueTypeDigest(a), uniqueTypeDigest(b))
+	assert.Equal(t, uniqueTypeDigest(a), uniqueTypeDigest(client.NewJob("Report", 2)))
+}
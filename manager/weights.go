@@ -0,0 +1,69 @@
+package manager
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// The largest weight a FETCH queue may have.
+const MaxQueueWeight = 1000
+
+// SplitQueueWeight splits a FETCH queue such as "critical:5" into the
+// queue, or pattern, and its weight.  Queues without a weight have
+// weight 0.
+func SplitQueueWeight(queue string) (string, int, error) {
+	idx := strings.LastIndexByte(queue, ':')
+	if idx < 0 {
+		return queue, 0, nil
+	}
+	weight, err := strconv.Atoi(queue[idx+1:])
+	if err != nil || weight < 1 || weight > MaxQueueWeight {
+		return "", 0, fmt.Errorf("Invalid queue weight %q, must be between 1 and %d", queue, MaxQueueWeight)
+	}
+	return queue[:idx], weight, nil
+}
+
+// Order the queues for one fetch.  If any queue has a weight, each
+// place is drawn at random in proportion to the remaining weights,
+// queues without one counting as 1, so later queues aren't starved.
+// Otherwise the queues are checked strictly in the given order.
+func weightedOrder(queues []string) ([]string, error) {
+	names := make([]string, len(queues))
+	weights := make([]int, len(queues))
+	weighted := false
+	total := 0
+	for idx, queue := range queues {
+		name, weight, err := SplitQueueWeight(queue)
+		if err != nil {
+			return nil, err
+		}
+		if weight > 0 {
+			weighted = true
+		} else {
+			weight = 1
+		}
+		names[idx] = name
+		weights[idx] = weight
+		total += weight
+	}
+	if !weighted {
+		return names, nil
+	}
+
+	ordered := make([]string, 0, len(names))
+	for len(names) > 0 {
+		pick := rand.Intn(total)
+		idx := 0
+		for pick >= weights[idx] {
+			pick -= weights[idx]
+			idx++
+		}
+		ordered = append(ordered, names[idx])
+		total -= weights[idx]
+		names = append(names[:idx], names[idx+1:]...)
+		weights = append(weights[:idx], weights[idx+1:]...)
+	}
+	return ordered, nil
+}
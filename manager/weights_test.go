@@ -0,0 +1,28 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWeightedOrder(t *testing.T) {
+	queues, err := weightedOrder([]string{"critical", "default", "bulk"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"critical", "default", "bulk"}, queues)
+
+	first := map[string]int{}
+	for i := 0; i < 6000; i++ {
+		queues, err = weightedOrder([]string{"critical:5", "default"})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(queues))
+		first[queues[0]]++
+	}
+	assert.InDelta(t, 5000, first["critical"], 300)
+	assert.InDelta(t, 1000, first["default"], 300)
+
+	for _, bad := range []string{"critical:0", "critical:x", "critical:1001", "critical:"} {
+		_, err = weightedOrder([]string{bad})
+		assert.Error(t, err, bad)
+	}
+}
@@ -2,6 +2,8 @@ package manager
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/contribsys/faktory/client"
@@ -14,6 +16,16 @@ var (
 		ErrorType:    "ReservationExpired",
 		ErrorMessage: "Faktory job reservation expired",
 	}
+	JobWorkerTerminated = &FailPayload{
+		ErrorType:    "WorkerTerminated",
+		ErrorMessage: "Faktory forcibly disconnected the worker processing this job",
+	}
+	JobTimedOut = &FailPayload{
+		ErrorType:    "TimedOut",
+		ErrorMessage: "Job was acknowledged after its timeout_seconds",
+	}
+
+	ErrJobTimedOut = errors.New("job timed out")
 )
 
 type Reservation struct {
@@ -25,6 +37,23 @@ type Reservation struct {
 	texpiry time.Time
 }
 
+// Has the job been reserved for longer than its timeout_seconds?
+func (res *Reservation) timedOut(now time.Time) bool {
+	if res.Job.TimeoutSeconds <= 0 {
+		return false
+	}
+	since := res.tsince
+	if since.IsZero() {
+		// reservations loaded from Redis after a restart
+		var err error
+		since, err = util.ParseTime(res.Since)
+		if err != nil {
+			return false
+		}
+	}
+	return now.Sub(since) > time.Duration(res.Job.TimeoutSeconds)*time.Second
+}
+
 func (m *manager) WorkingCount() int {
 	m.workingMutex.RLock()
 	defer m.workingMutex.RUnlock()
@@ -64,6 +93,7 @@ func (m *manager) loadWorkingSet() error {
 			return err
 		}
 		m.workingMap[res.Job.Jid] = &res
+		m.busy[res.Job.Queue]++
 		addedCount++
 		return nil
 	})
@@ -76,8 +106,56 @@ func (m *manager) loadWorkingSet() error {
 	return err
 }
 
-func (m *manager) reserve(wid string, job *client.Job) error {
+// The start of a Reservation's JSON, the popped job follows.
+var reservationPrefix = []byte(`{"job":`)
+
+// Pop a job from q and, if the store can do it in the same step, put
+// it in the working set so a crash can't lose the job between the
+// two, see storage.ReservingQueue.  The Reservation has the default
+// timeout and no Job, reserve fills it in.  Otherwise the Reservation
+// is nil and reserve adds the job to the working set.
+func (m *manager) pop(q storage.Queue, wid string) ([]byte, *Reservation, error) {
+	rq, ok := q.(storage.ReservingQueue)
+	if !ok {
+		data, err := q.Pop()
+		return data, nil, err
+	}
+
 	now := time.Now()
+	exp := now.Add(time.Duration(DefaultTimeout) * time.Second)
+	res := &Reservation{
+		Since:   util.Thens(now),
+		Expiry:  util.Thens(exp),
+		Wid:     wid,
+		tsince:  now,
+		texpiry: exp,
+	}
+	// the rest of the fields, in the order json.Marshal writes them
+	widData, _ := json.Marshal(wid)
+	suffix := fmt.Sprintf(`,"reserved_at":%q,"expires_at":%q,"wid":%s}`, res.Since, res.Expiry, widData)
+	data, err := rq.PopTo(m.store.Working(), res.Expiry, reservationPrefix, []byte(suffix))
+	if data == nil || err != nil {
+		return nil, nil, err
+	}
+	return data, res, nil
+}
+
+// Take a job popped into the working set back out of it, the job
+// isn't being handed to the worker after all.  Once reserved the
+// reservation is left for the usual ack, fail or expiry.
+func (m *manager) unreserve(popped *Reservation, jid string) {
+	if popped == nil {
+		return
+	}
+	m.workingMutex.RLock()
+	_, reserved := m.workingMap[jid]
+	m.workingMutex.RUnlock()
+	if !reserved {
+		m.store.Working().RemoveElement(popped.Expiry, jid)
+	}
+}
+
+func reserveTimeout(job *client.Job) int {
 	timeout := job.ReserveFor
 	if timeout == 0 {
 		timeout = DefaultTimeout
@@ -92,41 +170,85 @@ func (m *manager) reserve(wid string, job *client.Job) error {
 		timeout = DefaultTimeout
 		util.Warnf("Timeout too long %d, one day maximum", timeout)
 	}
+	return timeout
+}
 
-	exp := now.Add(time.Duration(timeout) * time.Second)
-	var res = &Reservation{
-		Job:     job,
-		Since:   util.Thens(now),
-		Expiry:  util.Thens(exp),
-		Wid:     wid,
-		tsince:  now,
-		texpiry: exp,
-	}
+// Reserve the job for the worker.  popped is the Reservation pop made,
+// if any, which is kept when the job has the default timeout and no
+// fetch middleware could have changed it.  Otherwise a new one is added
+// before popped is removed, so a crash leaves the job reserved twice
+// rather than not at all.
+func (m *manager) reserve(wid string, job *client.Job, popped *Reservation) error {
+	now := time.Now()
+	timeout := reserveTimeout(job)
 
-	data, err := json.Marshal(res)
-	if err != nil {
-		return err
-	}
+	res := popped
+	if res == nil || timeout != DefaultTimeout || len(m.fetchChain) > 0 {
+		exp := now.Add(time.Duration(timeout) * time.Second)
+		res = &Reservation{
+			Job:     job,
+			Since:   util.Thens(now),
+			Expiry:  util.Thens(exp),
+			Wid:     wid,
+			tsince:  now,
+			texpiry: exp,
+		}
 
-	err = m.store.Working().AddElement(res.Expiry, job.Jid, data)
-	if err != nil {
-		return err
+		data, err := json.Marshal(res)
+		if err != nil {
+			return err
+		}
+
+		err = m.store.Working().AddElement(res.Expiry, job.Jid, data)
+		if err != nil {
+			return err
+		}
+		if popped != nil {
+			m.store.Working().RemoveElement(popped.Expiry, job.Jid)
+		}
 	}
+	res.Job = job
 
 	m.workingMutex.Lock()
 	m.workingMap[job.Jid] = res
 	m.workingMutex.Unlock()
+	m.rates.dequeued(job.Queue)
+	m.unlockUnique(job, UniqueUntilStart)
 
 	return nil
 }
 
 func (m *manager) ack(jid string) (*client.Job, error) {
+	m.workingMutex.RLock()
+	current, reserved := m.workingMap[jid]
+	m.workingMutex.RUnlock()
+	if reserved && current.timedOut(time.Now()) {
+		err := m.processFailure(jid, JobTimedOut)
+		if err != nil {
+			return nil, err
+		}
+		return current.Job, ErrJobTimedOut
+	}
+
 	res := m.clearReservation(jid)
 	if res == nil {
 		util.Infof("No such job to acknowledge %s", jid)
 		return nil, nil
 	}
 
+	err := m.pushSuccessors(res.Job.Then)
+	if err != nil {
+		// keep the reservation so the job can be acknowledged again
+		m.workingMutex.Lock()
+		m.workingMap[jid] = res
+		m.busy[res.Job.Queue]++
+		m.workingMutex.Unlock()
+		return nil, err
+	}
+	m.unlockUnique(res.Job, UniqueUntilSuccess)
+	m.batchJobDone(res.Job, true)
+	m.dependencyDone(res.Job, true)
+
 	ok, err := m.store.Working().RemoveElement(res.Expiry, jid)
 	if !ok {
 		// doesn't matter, might not have acknowledged in time
@@ -137,7 +259,7 @@ func (m *manager) ack(jid string) (*client.Job, error) {
 func (m *manager) Acknowledge(jid string) (*client.Job, error) {
 	job, err := m.ack(jid)
 	if err != nil {
-		return nil, err
+		return job, err
 	}
 
 	if job != nil {
@@ -176,3 +298,25 @@ func (m *manager) ReapExpiredJobs(timestamp string) (int, error) {
 
 	return count, nil
 }
+
+func (m *manager) FailWorkerJobs(wid string) (int, error) {
+	jids := []string{}
+	m.workingMutex.RLock()
+	for jid, res := range m.workingMap {
+		if res.Wid == wid {
+			jids = append(jids, jid)
+		}
+	}
+	m.workingMutex.RUnlock()
+
+	count := 0
+	for _, jid := range jids {
+		err := m.processFailure(jid, JobWorkerTerminated)
+		if err != nil {
+			util.Error("Unable to fail job for terminated worker", err)
+			continue
+		}
+		count++
+	}
+	return count, nil
+}
@@ -1,6 +1,8 @@
 package manager
 
 import (
+	"context"
+	"encoding/json"
 	"testing"
 	"time"
 
@@ -21,7 +23,7 @@ func TestLoadWorkingSet(t *testing.T) {
 			assert.EqualValues(t, 0, store.Working().Size())
 			assert.EqualValues(t, 0, m.WorkingCount())
 
-			err := m.reserve("workerId", job)
+			err := m.reserve("workerId", job, nil)
 
 			assert.NoError(t, err)
 			assert.EqualValues(t, 1, store.Working().Size())
@@ -41,7 +43,7 @@ func TestLoadWorkingSet(t *testing.T) {
 			assert.EqualValues(t, 0, store.Working().Size())
 			assert.EqualValues(t, 0, m.WorkingCount())
 
-			err := m.reserve("workerId", job)
+			err := m.reserve("workerId", job, nil)
 
 			assert.NoError(t, err)
 			assert.EqualValues(t, 1, store.Working().Size())
@@ -59,7 +61,7 @@ func TestLoadWorkingSet(t *testing.T) {
 				assert.EqualValues(t, 0, store.Working().Size())
 
 				// doesn't return an error but resets to default timeout
-				err := m.reserve("workerId", job)
+				err := m.reserve("workerId", job, nil)
 
 				assert.NoError(t, err)
 				assert.EqualValues(t, 1, store.Working().Size())
@@ -84,7 +86,7 @@ func TestLoadWorkingSet(t *testing.T) {
 			assert.EqualValues(t, 0, store.TotalProcessed())
 			assert.EqualValues(t, 0, store.TotalFailures())
 
-			err = m.reserve("workerId", job)
+			err = m.reserve("workerId", job, nil)
 
 			assert.NoError(t, err)
 			assert.EqualValues(t, 0, q.Size())
@@ -121,7 +123,7 @@ func TestLoadWorkingSet(t *testing.T) {
 			assert.EqualValues(t, 0, store.Working().Size())
 			assert.EqualValues(t, 0, m.WorkingCount())
 
-			err = m.reserve("workerId", job)
+			err = m.reserve("workerId", job, nil)
 
 			assert.NoError(t, err)
 			assert.EqualValues(t, 0, q.Size())
@@ -140,5 +142,95 @@ func TestLoadWorkingSet(t *testing.T) {
 			assert.Equal(t, 1, count)
 			assert.EqualValues(t, 1, store.Retries().Size())
 		})
+
+		t.Run("FailWorkerJobs", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store).(*manager)
+
+			mine := client.NewJob("WorkingJob", 1, 2, 3)
+			err := m.reserve("workerId", mine, nil)
+			assert.NoError(t, err)
+			theirs := client.NewJob("WorkingJob", 4, 5, 6)
+			err = m.reserve("otherId", theirs, nil)
+			assert.NoError(t, err)
+			assert.EqualValues(t, 2, m.WorkingCount())
+
+			count, err := m.FailWorkerJobs("workerId")
+			assert.NoError(t, err)
+			assert.Equal(t, 1, count)
+			assert.EqualValues(t, 1, m.WorkingCount())
+			assert.EqualValues(t, 1, store.Working().Size())
+			assert.EqualValues(t, 1, store.Retries().Size())
+			assert.EqualValues(t, 0, m.BusyCount("workerId"))
+			assert.EqualValues(t, 1, m.BusyCount("otherId"))
+		})
+
+		t.Run("FetchReserves", func(t *testing.T) {
+			store.Flush()
+			m := NewManager(store).(*manager)
+
+			job := client.NewJob("WorkingJob", 1, 2, 3)
+			assert.NoError(t, m.Push(job))
+			long := client.NewJob("WorkingJob", 4, 5, 6)
+			long.ReserveFor = 600
+			assert.NoError(t, m.Push(long))
+
+			fetched, err := m.Fetch(context.Background(), "workerId", "default")
+			assert.NoError(t, err)
+			assert.Equal(t, job.Jid, fetched.Jid)
+			fetched, err = m.Fetch(context.Background(), "workerId", "default")
+			assert.NoError(t, err)
+			assert.Equal(t, long.Jid, fetched.Jid)
+			assert.EqualValues(t, 2, m.WorkingCount())
+			assert.EqualValues(t, 2, store.Working().Size())
+
+			// the stored reservations are what a restart loads
+			stored := map[string]Reservation{}
+			assert.NoError(t, store.Working().Each(func(_ int, entry storage.SortedEntry) error {
+				var res Reservation
+				assert.NoError(t, json.Unmarshal(entry.Value(), &res))
+				stored[res.Job.Jid] = res
+				return nil
+			}))
+			for jid, res := range m.workingMap {
+				assert.Equal(t, "workerId", stored[jid].Wid)
+				assert.Equal(t, res.Expiry, stored[jid].Expiry)
+			}
+			expiry, err := util.ParseTime(stored[long.Jid].Expiry)
+			assert.NoError(t, err)
+			assert.WithinDuration(t, time.Now().Add(600*time.Second), expiry, 5*time.Second)
+
+			_, err = m.Acknowledge(job.Jid)
+			assert.NoError(t, err)
+			_, err = m.Acknowledge(long.Jid)
+			assert.NoError(t, err)
+			assert.EqualValues(t, 0, store.Working().Size())
+
+			// a halted fetch leaves nothing reserved
+			m.AddMiddleware("fetch", func(next func() error, job *client.Job) error {
+				return Halt("not today")
+			})
+			assert.NoError(t, m.Push(client.NewJob("WorkingJob", 7)))
+			jobs, err := m.fetchMore("workerId", 1, nil, []string{"default"})
+			assert.NoError(t, err)
+			assert.Empty(t, jobs)
+			assert.EqualValues(t, 0, m.WorkingCount())
+			assert.EqualValues(t, 0, store.Working().Size())
+		})
 	})
 }
+
+func TestReservationTimedOut(t *testing.T) {
+	now := time.Now()
+	job := client.NewJob("Slow")
+	res := &Reservation{Job: job, Since: util.Thens(now), tsince: now}
+	assert.False(t, res.timedOut(now.Add(time.Hour)))
+
+	job.TimeoutSeconds = 5
+	assert.False(t, res.timedOut(now.Add(4*time.Second)))
+	assert.True(t, res.timedOut(now.Add(6*time.Second)))
+
+	// reservations loaded after a restart only have the timestamp
+	loaded := &Reservation{Job: job, Since: util.Thens(now)}
+	assert.True(t, loaded.timedOut(now.Add(6*time.Second)))
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+/*
+ * Probes for Kubernetes and load balancers, served next to /metrics
+ * without the password so they needn't HELLO like a client does:
+ *
+ *	GET /healthz  200 while the storage answers, else 503
+ *	GET /readyz   as /healthz but 503 once the server is draining,
+ *	              i.e. Stop has been called
+ *
+ * A draining server is still alive so /healthz stays up while it
+ * finishes shutting down, rather than getting it restarted.
+ */
+type healthState struct {
+	Status   string `json:"status"`
+	Storage  string `json:"storage"`
+	Draining bool   `json:"draining"`
+}
+
+func (m *Metrics) health(ready bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "GET only", http.StatusMethodNotAllowed)
+			return
+		}
+		state := m.checkHealth()
+		code := http.StatusOK
+		if state.Storage != "ok" || (ready && state.Draining) {
+			state.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+		}
+		data, _ := json.Marshal(state)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		w.Write(data)
+	}
+}
+
+func (m *Metrics) checkHealth() healthState {
+	state := healthState{Status: "ok", Storage: "ok", Draining: m.Server.Draining()}
+	store := m.Server.Store()
+	if store == nil {
+		state.Storage = "not booted"
+		return state
+	}
+	// a read of a key which needn't exist, a round trip to the
+	// storage whichever driver it is
+	_, err := store.Raw().Get("healthz")
+	if err != nil {
+		state.Storage = err.Error()
+	}
+	return state
+}
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/contribsys/faktory/server"
+	"github.com/contribsys/faktory/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealth(t *testing.T) {
+	dir := "/tmp/faktory-test-health"
+	defer os.RemoveAll(dir)
+	sock := fmt.Sprintf("%s/redis.sock", dir)
+	stopper, err := storage.BootRedis(dir, sock)
+	if err != nil {
+		panic(err)
+	}
+	defer stopper()
+
+	s, err := server.NewServer(&server.ServerOptions{
+		Binding:          "localhost:7461",
+		StorageDirectory: dir,
+		RedisSock:        sock,
+	})
+	assert.NoError(t, err)
+	m := newMetrics(s, Options{Password: "s3cret"})
+
+	probe := func(path string) (int, healthState) {
+		w := httptest.NewRecorder()
+		m.Mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var state healthState
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &state))
+		return w.Code, state
+	}
+
+	code, state := probe("/healthz")
+	assert.Equal(t, 503, code)
+	assert.Equal(t, "not booted", state.Storage)
+
+	err = s.Boot()
+	assert.NoError(t, err)
+
+	// no password needed
+	code, state = probe("/healthz")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, healthState{Status: "ok", Storage: "ok"}, state)
+	code, _ = probe("/readyz")
+	assert.Equal(t, 200, code)
+
+	w := httptest.NewRecorder()
+	m.Mux.ServeHTTP(w, httptest.NewRequest("POST", "/readyz", nil))
+	assert.Equal(t, 405, w.Code)
+
+	s.Stop(nil)
+	code, state = probe("/readyz")
+	assert.Equal(t, 503, code)
+	assert.Equal(t, "unavailable", state.Status)
+	assert.True(t, state.Draining)
+	// the store is closed too
+	code, state = probe("/healthz")
+	assert.Equal(t, 503, code)
+	assert.NotEqual(t, "ok", state.Storage)
+}
@@ -0,0 +1,403 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/server"
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/util"
+)
+
+/*
+ * The metrics subsystem serves the server's stats at /metrics in the
+ * Prometheus text format so they can be scraped rather than pulled
+ * out of the Web UI's JSON.  It is disabled unless the config gives
+ * it a binding:
+ *
+ *	[metrics]
+ *	binding = "localhost:7422"
+ *	password = "s3cret"
+ *
+ * The password is optional and is sent as a bearer token or the basic
+ * auth password, as Prometheus's scrape config allows.
+ *
+ * The same metrics can be pushed to a statsd server, see statsd.go,
+ * for which the metric set is collected into a sink.
+ *
+ * Health probes are served alongside, see health.go.
+ */
+type Lifecycle struct {
+	Metrics *Metrics
+	closers []func()
+}
+
+func Subsystem() *Lifecycle {
+	return &Lifecycle{}
+}
+
+type Metrics struct {
+	Options Options
+	Server  *server.Server
+	Mux     *http.ServeMux
+
+	latency fetchLatency
+}
+
+type Options struct {
+	Binding  string
+	Password string
+	Statsd   StatsdOptions
+}
+
+func (l *Lifecycle) opts(s *server.Server) Options {
+	return Options{
+		Binding:  s.CurrentOptions().String("metrics", "binding", ""),
+		Password: s.CurrentOptions().String("metrics", "password", ""),
+		Statsd:   statsdOpts(s),
+	}
+}
+
+func (l *Lifecycle) Name() string {
+	return "metrics"
+}
+
+func (l *Lifecycle) Start(s *server.Server) error {
+	l.Metrics = newMetrics(s, l.opts(s))
+	// the hook can't be removed so it does nothing while the
+	// metrics are disabled
+	s.OnFetch(l.Metrics.latency.fetched)
+	return l.run()
+}
+
+func (l *Lifecycle) stop() {
+	if len(l.closers) > 0 {
+		util.Debug("Stopping metrics")
+		for _, closer := range l.closers {
+			closer()
+		}
+		l.closers = nil
+	}
+	l.Metrics.latency.enable(false)
+}
+
+func (l *Lifecycle) Reload(s *server.Server) error {
+	opts := l.opts(s)
+	if opts == l.Metrics.Options {
+		return nil
+	}
+	util.Infof("Reloading metrics")
+	l.stop()
+	l.Metrics.Options = opts
+	return l.run()
+}
+
+func (l *Lifecycle) Stop(s *server.Server) error {
+	l.stop()
+	return nil
+}
+
+func (l *Lifecycle) run() error {
+	opts := l.Metrics.Options
+	if opts.Binding != "" {
+		closer, err := l.Metrics.Run()
+		if err != nil {
+			return err
+		}
+		l.closers = append(l.closers, closer)
+	}
+	if opts.Statsd.Address != "" {
+		closer, err := l.Metrics.RunStatsd()
+		if err != nil {
+			l.stop()
+			return err
+		}
+		l.closers = append(l.closers, closer)
+	}
+	l.Metrics.latency.enable(len(l.closers) > 0)
+	return nil
+}
+
+func newMetrics(s *server.Server, opts Options) *Metrics {
+	m := &Metrics{
+		Options: opts,
+		Server:  s,
+		Mux:     http.NewServeMux(),
+	}
+	m.Mux.HandleFunc("/metrics", m.auth(m.metrics))
+	m.Mux.HandleFunc("/healthz", m.health(false))
+	m.Mux.HandleFunc("/readyz", m.health(true))
+	return m
+}
+
+func (m *Metrics) Run() (func(), error) {
+	s := &http.Server{
+		Addr:           m.Options.Binding,
+		ReadTimeout:    5 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 16,
+		Handler:        m.Mux,
+	}
+
+	listener, err := net.Listen("tcp", m.Options.Binding)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		err := s.Serve(listener)
+		if err != http.ErrServerClosed {
+			util.Error(fmt.Sprintf("%s server crashed", m.Options.Binding), err)
+		}
+	}()
+	util.Infof("Metrics now listening at %s", m.Options.Binding)
+	return func() { s.Shutdown(context.Background()) }, nil
+}
+
+func (m *Metrics) auth(pass http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if m.Options.Password != "" {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if _, password, ok := r.BasicAuth(); ok {
+				given = password
+			}
+			if subtle.ConstantTimeCompare([]byte(given), []byte(m.Options.Password)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="Faktory"`)
+				http.Error(w, "Authorization required", http.StatusUnauthorized)
+				return
+			}
+		}
+		pass(w, r)
+	}
+}
+
+// GET /metrics
+func (m *Metrics) metrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	var buf bytes.Buffer
+	err := m.collect(&promWriter{out: &buf}, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// A sink receives the metric set from collect, each family followed
+// by its samples.
+type sink interface {
+	family(name string, kind string, help string)
+	// Labels are name and value pairs.
+	sample(name string, value float64, labels ...string)
+	histogram(name string, h *histogram, labels ...string)
+}
+
+func (m *Metrics) collect(pw sink, now time.Time) error {
+	s := m.Server
+	store := s.Store()
+	mgr := s.Manager()
+
+	queues := []storage.Queue{}
+	store.EachQueue(func(q storage.Queue) {
+		queues = append(queues, q)
+	})
+	sort.Slice(queues, func(i, j int) bool { return queues[i].Name() < queues[j].Name() })
+
+	pw.family("faktory_queue_size", "gauge", "Jobs waiting in the queue.")
+	for _, q := range queues {
+		pw.sample("faktory_queue_size", float64(q.Size()), "queue", q.Name())
+	}
+	pw.family("faktory_queue_latency_seconds", "gauge", "How long the queue's oldest job has been waiting.")
+	for _, q := range queues {
+		latency, err := server.QueueLatency(q, now)
+		if err != nil {
+			return err
+		}
+		pw.sample("faktory_queue_latency_seconds", latency, "queue", q.Name())
+	}
+	pw.family("faktory_queue_enqueued_per_second", "gauge", "Jobs pushed to the queue per second over the last minute.")
+	for _, q := range queues {
+		pw.sample("faktory_queue_enqueued_per_second", mgr.QueueRates(q.Name()).Enqueued, "queue", q.Name())
+	}
+	pw.family("faktory_queue_dequeued_per_second", "gauge", "Jobs fetched from the queue per second over the last minute.")
+	for _, q := range queues {
+		pw.sample("faktory_queue_dequeued_per_second", mgr.QueueRates(q.Name()).Dequeued, "queue", q.Name())
+	}
+	pw.family("faktory_queue_busy", "gauge", "The queue's jobs which are reserved by a worker.")
+	for _, q := range queues {
+		pw.sample("faktory_queue_busy", float64(mgr.QueueBusy(q.Name())), "queue", q.Name())
+	}
+	m.latency.write(pw)
+
+	pw.family("faktory_jobs_processed_total", "counter", "Jobs acknowledged.")
+	pw.sample("faktory_jobs_processed_total", float64(store.TotalProcessed()))
+	pw.family("faktory_jobs_failed_total", "counter", "Jobs failed.")
+	pw.sample("faktory_jobs_failed_total", float64(store.TotalFailures()))
+	pw.family("faktory_working_jobs", "gauge", "Jobs reserved by a worker.")
+	pw.sample("faktory_working_jobs", float64(mgr.WorkingCount()))
+	pw.family("faktory_scheduled_jobs", "gauge", "Jobs scheduled to run later.")
+	pw.sample("faktory_scheduled_jobs", float64(store.Scheduled().Size()))
+	pw.family("faktory_retry_jobs", "gauge", "Failed jobs waiting to retry.")
+	pw.sample("faktory_retry_jobs", float64(store.Retries().Size()))
+	pw.family("faktory_dead_jobs", "gauge", "Jobs which ran out of retries.")
+	pw.sample("faktory_dead_jobs", float64(store.Dead().Size()))
+
+	stats := s.Stats
+	pw.family("faktory_connections", "gauge", "Open client connections.")
+	pw.sample("faktory_connections", float64(atomic.LoadUint64(&stats.Connections)))
+	pw.family("faktory_commands_total", "counter", "Commands processed.")
+	pw.sample("faktory_commands_total", float64(atomic.LoadUint64(&stats.Commands)))
+	pw.family("faktory_rejected_connections_total", "counter", "Connections closed for exceeding max_connections.")
+	pw.sample("faktory_rejected_connections_total", float64(atomic.LoadUint64(&stats.Rejected)))
+	pw.family("faktory_throttled_connections_total", "counter", "Connections closed for exceeding connection_rate.")
+	pw.sample("faktory_throttled_connections_total", float64(atomic.LoadUint64(&stats.Throttled)))
+
+	tasks := s.TaskStats()
+	names := make([]string, 0, len(tasks))
+	for name := range tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pw.family("faktory_task_runs_total", "counter", "Times the server task has run.")
+	for _, name := range names {
+		pw.sample("faktory_task_runs_total", float64(tasks[name].Runs), "task", name)
+	}
+	pw.family("faktory_task_seconds_total", "counter", "Time spent running the server task.")
+	for _, name := range names {
+		pw.sample("faktory_task_seconds_total", tasks[name].Walltime.Seconds(), "task", name)
+	}
+
+	pw.family("faktory_uptime_seconds", "gauge", "Time since the server started.")
+	pw.sample("faktory_uptime_seconds", now.Sub(stats.StartedAt).Seconds())
+	pw.family("faktory_info", "gauge", "The server's version.")
+	pw.sample("faktory_info", 1, "version", client.Version)
+	return nil
+}
+
+// The upper bounds, in seconds, of the fetch latency histogram's
+// buckets.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// How long fetched jobs waited in each queue, from when they were
+// enqueued until a worker fetched them.
+type fetchLatency struct {
+	enabled int32
+	mu      sync.Mutex
+	queues  map[string]*histogram
+}
+
+func (fl *fetchLatency) enable(on bool) {
+	val := int32(0)
+	if on {
+		val = 1
+	}
+	atomic.StoreInt32(&fl.enabled, val)
+}
+
+func (fl *fetchLatency) fetched(job *client.Job) {
+	if atomic.LoadInt32(&fl.enabled) == 0 {
+		return
+	}
+	enqueued, err := util.ParseTime(job.EnqueuedAt)
+	if err == nil {
+		fl.observe(job.Queue, time.Since(enqueued).Seconds())
+	}
+}
+
+func (fl *fetchLatency) observe(queue string, secs float64) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if fl.queues == nil {
+		fl.queues = map[string]*histogram{}
+	}
+	h, ok := fl.queues[queue]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		fl.queues[queue] = h
+	}
+	for idx, bound := range latencyBuckets {
+		if secs <= bound {
+			h.counts[idx]++
+		}
+	}
+	h.count++
+	h.sum += secs
+}
+
+func (fl *fetchLatency) write(pw sink) {
+	const name = "faktory_fetch_latency_seconds"
+	pw.family(name, "histogram", "How long fetched jobs waited in their queue.")
+
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	queues := make([]string, 0, len(fl.queues))
+	for queue := range fl.queues {
+		queues = append(queues, queue)
+	}
+	sort.Strings(queues)
+	for _, queue := range queues {
+		pw.histogram(name, fl.queues[queue], "queue", queue)
+	}
+}
+
+// Writes metrics in the Prometheus text exposition format.
+type promWriter struct {
+	out *bytes.Buffer
+}
+
+func (pw *promWriter) family(name string, kind string, help string) {
+	fmt.Fprintf(pw.out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Write a sample with the given label name and value pairs.
+func (pw *promWriter) sample(name string, value float64, labels ...string) {
+	pw.out.WriteString(name)
+	if len(labels) > 0 {
+		pw.out.WriteByte('{')
+		for idx := 0; idx+1 < len(labels); idx += 2 {
+			if idx > 0 {
+				pw.out.WriteByte(',')
+			}
+			fmt.Fprintf(pw.out, `%s="%s"`, labels[idx], labelEscaper.Replace(labels[idx+1]))
+		}
+		pw.out.WriteByte('}')
+	}
+	pw.out.WriteByte(' ')
+	pw.out.WriteString(formatFloat(value))
+	pw.out.WriteByte('\n')
+}
+
+func (pw *promWriter) histogram(name string, h *histogram, labels ...string) {
+	for idx, bound := range latencyBuckets {
+		pw.sample(name+"_bucket", float64(h.counts[idx]), append(labels, "le", formatFloat(bound))...)
+	}
+	pw.sample(name+"_bucket", float64(h.count), append(labels, "le", "+Inf")...)
+	pw.sample(name+"_sum", h.sum, labels...)
+	pw.sample(name+"_count", float64(h.count), labels...)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(value float64) string {
+	return fmt.Sprintf("%g", value)
+}
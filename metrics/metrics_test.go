@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/server"
+	"github.com/contribsys/faktory/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPromWriter(t *testing.T) {
+	var buf bytes.Buffer
+	pw := &promWriter{out: &buf}
+	pw.family("faktory_queue_size", "gauge", "Jobs waiting in the queue.")
+	pw.sample("faktory_queue_size", 12, "queue", `we"ird\`)
+	pw.sample("faktory_uptime_seconds", 1.5)
+
+	assert.Equal(t, `# HELP faktory_queue_size Jobs waiting in the queue.
+# TYPE faktory_queue_size gauge
+faktory_queue_size{queue="we\"ird\\"} 12
+faktory_uptime_seconds 1.5
+`, buf.String())
+}
+
+func TestFetchLatency(t *testing.T) {
+	var fl fetchLatency
+	fl.fetched(&client.Job{Queue: "default", EnqueuedAt: "2018-01-01T00:00:00Z"})
+	assert.Len(t, fl.queues, 0)
+
+	fl.enable(true)
+	fl.observe("default", 0.02)
+	fl.observe("default", 2)
+
+	var buf bytes.Buffer
+	fl.write(&promWriter{out: &buf})
+	out := buf.String()
+	assert.Contains(t, out, `faktory_fetch_latency_seconds_bucket{queue="default",le="0.01"} 0`)
+	assert.Contains(t, out, `faktory_fetch_latency_seconds_bucket{queue="default",le="0.025"} 1`)
+	assert.Contains(t, out, `faktory_fetch_latency_seconds_bucket{queue="default",le="2.5"} 2`)
+	assert.Contains(t, out, `faktory_fetch_latency_seconds_bucket{queue="default",le="+Inf"} 2`)
+	assert.Contains(t, out, `faktory_fetch_latency_seconds_sum{queue="default"} 2.02`)
+	assert.Contains(t, out, `faktory_fetch_latency_seconds_count{queue="default"} 2`)
+}
+
+func TestAuth(t *testing.T) {
+	m := &Metrics{Options: Options{Password: "s3cret"}}
+	handler := m.auth(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	for _, tc := range []struct {
+		header string
+		code   int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer s3cret", http.StatusNoContent},
+		{"Basic OnMzY3JldA==", http.StatusNoContent},
+	} {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		assert.Equal(t, tc.code, w.Code, tc.header)
+	}
+}
+
+func TestRunBindingInUse(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	m := newMetrics(nil, Options{Binding: listener.Addr().String()})
+	closer, err := m.Run()
+	assert.Error(t, err)
+	assert.Nil(t, closer)
+}
+
+func TestMetrics(t *testing.T) {
+	dir := "/tmp/faktory-test-metrics"
+	defer os.RemoveAll(dir)
+	sock := fmt.Sprintf("%s/redis.sock", dir)
+	stopper, err := storage.BootRedis(dir, sock)
+	if err != nil {
+		panic(err)
+	}
+	defer stopper()
+
+	s, err := server.NewServer(&server.ServerOptions{
+		Binding:          "localhost:7460",
+		StorageDirectory: dir,
+		RedisSock:        sock,
+	})
+	assert.NoError(t, err)
+	err = s.Boot()
+	assert.NoError(t, err)
+	defer s.Stop(nil)
+	s.Store().Flush()
+
+	q, err := s.Store().GetQueue("metrics")
+	assert.NoError(t, err)
+	err = s.Manager().Push(client.NewJob("Thing", 1))
+	assert.NoError(t, err)
+	err = q.Push(5, []byte(`{"jid":"abc","jobtype":"Thing","queue":"metrics"}`))
+	assert.NoError(t, err)
+
+	m := newMetrics(s, Options{})
+	w := httptest.NewRecorder()
+	m.Mux.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "version=0.0.4")
+	out := w.Body.String()
+	assert.Contains(t, out, "# TYPE faktory_queue_size gauge\n")
+	assert.Contains(t, out, `faktory_queue_size{queue="default"} 1`)
+	assert.Contains(t, out, `faktory_queue_size{queue="metrics"} 1`)
+	assert.Contains(t, out, "# TYPE faktory_jobs_processed_total counter\n")
+	assert.Contains(t, out, "faktory_task_runs_total{task=")
+	assert.Contains(t, out, fmt.Sprintf(`faktory_info{version="%s"} 1`, client.Version))
+
+	w = httptest.NewRecorder()
+	m.Mux.ServeHTTP(w, httptest.NewRequest("POST", "/metrics", nil))
+	assert.Equal(t, 405, w.Code)
+}
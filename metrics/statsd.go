@@ -0,0 +1,204 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/contribsys/faktory/server"
+	"github.com/contribsys/faktory/util"
+)
+
+/*
+ * For those without Prometheus, the metrics can be pushed to a statsd
+ * server or the Datadog agent every interval:
+ *
+ *	[statsd]
+ *	address = "localhost:8125"
+ *	interval = "10s"
+ *	prefix = "faktory."
+ *	tags = true
+ *
+ * Labels are sent as DogStatsD tags, e.g. "queue:default", unless tags
+ * is false, when they are appended to the name, e.g.
+ * "faktory.queue_size.default".  Counters are sent as the change since
+ * the last push.
+ */
+type StatsdOptions struct {
+	Address  string
+	Interval time.Duration
+	Prefix   string
+	Tags     bool
+}
+
+func statsdOpts(s *server.Server) StatsdOptions {
+	opts := StatsdOptions{
+		Address:  s.CurrentOptions().String("statsd", "address", ""),
+		Interval: 10 * time.Second,
+		Prefix:   s.CurrentOptions().String("statsd", "prefix", "faktory."),
+		Tags:     true,
+	}
+	if val := s.CurrentOptions().String("statsd", "interval", ""); val != "" {
+		interval, err := time.ParseDuration(val)
+		if err != nil || interval <= 0 {
+			util.Warnf("Config error: statsd/interval %q is not a positive duration", val)
+		} else {
+			opts.Interval = interval
+		}
+	}
+	if tags, ok := s.CurrentOptions().Config("statsd", "tags", true).(bool); ok {
+		opts.Tags = tags
+	} else {
+		util.Warnf("Config error: statsd/tags is not a Boolean")
+	}
+	return opts
+}
+
+// RunStatsd pushes the metrics to the statsd server every interval
+// until the returned func is called.
+func (m *Metrics) RunStatsd() (func(), error) {
+	opts := m.Options.Statsd
+	conn, err := net.Dial("udp", opts.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	sd := newStatsd(conn, opts)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			err := m.collect(sd, time.Now())
+			if err == nil {
+				err = sd.flush()
+			}
+			if err != nil {
+				util.Warnf("Unable to send metrics to %s: %v", opts.Address, err)
+			}
+		}
+	}()
+	util.Infof("Sending metrics to statsd at %s every %v", opts.Address, opts.Interval)
+	return func() {
+		close(stop)
+		<-done
+		conn.Close()
+	}, nil
+}
+
+// Keep packets within a typical MTU so they aren't fragmented.
+const maxPacket = 1432
+
+// Writes metrics in the statsd line format, batched into packets.
+type statsd struct {
+	conn net.Conn
+	opts StatsdOptions
+	buf  bytes.Buffer
+	// the family being written
+	kind string
+	// the counter totals last sent, by name and tags
+	sent map[string]float64
+	err  error
+}
+
+func newStatsd(conn net.Conn, opts StatsdOptions) *statsd {
+	return &statsd{conn: conn, opts: opts, sent: map[string]float64{}}
+}
+
+func (sd *statsd) family(name string, kind string, help string) {
+	sd.kind = kind
+}
+
+func (sd *statsd) sample(name string, value float64, labels ...string) {
+	if sd.kind == "counter" {
+		sd.counter(name, value, labels...)
+	} else {
+		sd.write(name, value, "g", labels...)
+	}
+}
+
+func (sd *statsd) histogram(name string, h *histogram, labels ...string) {
+	sd.counter(name+"_count", float64(h.count), labels...)
+	sd.counter(name+"_sum", h.sum, labels...)
+}
+
+// Send the change in a counter's total since the last push.  The
+// first push, or a total which went down because the server
+// restarted, sends the whole total.
+func (sd *statsd) counter(name string, total float64, labels ...string) {
+	key := name + "|" + strings.Join(labels, "|")
+	delta := total
+	if last, ok := sd.sent[key]; ok && total >= last {
+		delta = total - last
+	}
+	sd.sent[key] = total
+	sd.write(name, delta, "c", labels...)
+}
+
+func (sd *statsd) write(name string, value float64, kind string, labels ...string) {
+	var line strings.Builder
+	line.WriteString(sd.opts.Prefix)
+	line.WriteString(strings.TrimPrefix(name, "faktory_"))
+	if !sd.opts.Tags {
+		for idx := 1; idx < len(labels); idx += 2 {
+			line.WriteByte('.')
+			line.WriteString(nameEscaper.Replace(labels[idx]))
+		}
+	}
+	fmt.Fprintf(&line, ":%s|%s", strconv.FormatFloat(value, 'f', -1, 64), kind)
+	if sd.opts.Tags && len(labels) > 1 {
+		line.WriteString("|#")
+		for idx := 0; idx+1 < len(labels); idx += 2 {
+			if idx > 0 {
+				line.WriteByte(',')
+			}
+			line.WriteString(labels[idx])
+			line.WriteByte(':')
+			line.WriteString(tagEscaper.Replace(labels[idx+1]))
+		}
+	}
+
+	if sd.buf.Len() > 0 && sd.buf.Len()+1+line.Len() > maxPacket {
+		sd.send()
+	}
+	if sd.buf.Len() > 0 {
+		sd.buf.WriteByte('\n')
+	}
+	sd.buf.WriteString(line.String())
+}
+
+func (sd *statsd) send() {
+	_, err := sd.conn.Write(sd.buf.Bytes())
+	if err != nil && sd.err == nil {
+		sd.err = err
+	}
+	sd.buf.Reset()
+}
+
+// Send any buffered metrics and return the first error since the
+// last flush.
+func (sd *statsd) flush() error {
+	if sd.buf.Len() > 0 {
+		sd.send()
+	}
+	err := sd.err
+	sd.err = nil
+	return err
+}
+
+// The statsd line format reserves these characters, and a label value
+// in the name mustn't add a dotted component.
+var (
+	tagEscaper  = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", "\n", "_")
+	nameEscaper = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", "\n", "_", ".", "_")
+)
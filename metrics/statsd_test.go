@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsd(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer pc.Close()
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	receive := func() []string {
+		buf := make([]byte, 2*maxPacket)
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		assert.NoError(t, err)
+		return strings.Split(string(buf[:n]), "\n")
+	}
+
+	sd := newStatsd(conn, StatsdOptions{Prefix: "faktory.", Tags: true})
+	sd.family("faktory_queue_size", "gauge", "Jobs waiting in the queue.")
+	sd.sample("faktory_queue_size", 12, "queue", "default")
+	sd.family("faktory_jobs_processed_total", "counter", "Jobs acknowledged.")
+	sd.sample("faktory_jobs_processed_total", 100)
+	sd.histogram("faktory_fetch_latency_seconds", &histogram{count: 2, sum: 0.5}, "queue", "default")
+	sd.family("faktory_info", "gauge", "The server's version.")
+	sd.sample("faktory_info", 1, "version", "1.0.0")
+	assert.NoError(t, sd.flush())
+	assert.Equal(t, []string{
+		"faktory.queue_size:12|g|#queue:default",
+		"faktory.jobs_processed_total:100|c",
+		"faktory.fetch_latency_seconds_count:2|c|#queue:default",
+		"faktory.fetch_latency_seconds_sum:0.5|c|#queue:default",
+		"faktory.info:1|g|#version:1.0.0",
+	}, receive())
+
+	sd.family("faktory_jobs_processed_total", "counter", "Jobs acknowledged.")
+	sd.sample("faktory_jobs_processed_total", 130)
+	sd.sample("faktory_jobs_processed_total", 7)
+	assert.NoError(t, sd.flush())
+	assert.Equal(t, []string{
+		"faktory.jobs_processed_total:30|c",
+		"faktory.jobs_processed_total:7|c",
+	}, receive())
+
+	sd = newStatsd(conn, StatsdOptions{Prefix: "fk.", Tags: false})
+	sd.family("faktory_queue_size", "gauge", "Jobs waiting in the queue.")
+	sd.sample("faktory_queue_size", 3, "queue", "a.b")
+	assert.NoError(t, sd.flush())
+	assert.Equal(t, []string{"fk.queue_size.a_b:3|g"}, receive())
+}
+
+func TestStatsdPackets(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer pc.Close()
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	sd := newStatsd(conn, StatsdOptions{Prefix: "faktory.", Tags: true})
+	sd.family("faktory_queue_size", "gauge", "Jobs waiting in the queue.")
+	for idx := 0; idx < 200; idx++ {
+		sd.sample("faktory_queue_size", float64(idx), "queue", "default")
+	}
+	assert.NoError(t, sd.flush())
+
+	lines := 0
+	buf := make([]byte, 2*maxPacket)
+	for lines < 200 {
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.True(t, n <= maxPacket)
+		lines += len(strings.Split(string(buf[:n]), "\n"))
+	}
+	assert.Equal(t, 200, lines)
+}
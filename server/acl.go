@@ -0,0 +1,408 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/manager"
+	"github.com/contribsys/faktory/util"
+)
+
+/*
+ * The ACL subsystem scopes credentials to particular commands and
+ * queues.  Each table under [acl] in the config defines a user with
+ * its own password:
+ *
+ *	[acl.billing]
+ *	password = "s3cret"
+ *	push = ["billing_*"]
+ *
+ *	[acl.mailer]
+ *	password = "t0ken"
+ *	fetch = ["default", "mail"]
+ *
+ * push and fetch list the queues, as path.Match patterns, the user
+ * may PUSH to and FETCH from.  A user who can fetch may also ACK,
+ * FAIL and BEAT, one who can push may also BATCH as long as the
+ * batch's callbacks go to queues it may push to.  TRACK SET needs
+ * fetch, TRACK GET and RESULT push or fetch.  Every user may send
+ * INFO and END, anything else such as QUEUE or FLUSH requires
+ * admin = true.
+ *
+ * Connections using the server's own password(s) are not restricted.
+ */
+type aclSubsystem struct {
+	mu    sync.RWMutex
+	users map[string]*aclUser
+}
+
+type aclUser struct {
+	name     string
+	password string
+	push     []string
+	fetch    []string
+	admin    bool
+}
+
+func (a *aclSubsystem) Name() string {
+	return "acl"
+}
+
+func (a *aclSubsystem) Start(s *Server) error {
+	return a.Reload(s)
+}
+
+// Changes apply to existing connections too, removing a user
+// cuts off everyone connected with it.
+func (a *aclSubsystem) Reload(s *Server) error {
+	users, err := parseACL(s.CurrentOptions().GlobalConfig["acl"])
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.users = users
+	a.mu.Unlock()
+	if len(users) > 0 {
+		util.Infof("Loaded %d ACL users", len(users))
+	}
+	return nil
+}
+
+func (a *aclSubsystem) Stop(s *Server) error {
+	return nil
+}
+
+func (a *aclSubsystem) user(name string) *aclUser {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.users[name]
+}
+
+// The name and password of each user, sorted by name.
+func (a *aclSubsystem) credentials() []credential {
+	a.mu.RLock()
+	creds := make([]credential, 0, len(a.users))
+	for _, user := range a.users {
+		creds = append(creds, credential{user: user.name, password: user.password})
+	}
+	a.mu.RUnlock()
+	sort.Slice(creds, func(i, j int) bool { return creds[i].user < creds[j].user })
+	return creds
+}
+
+// A password accepted in HELLO and the ACL user it belongs to, ""
+// for the server's own passwords.
+type credential struct {
+	user     string
+	password string
+}
+
+// The built-in users for ServerOptions.ProducerPassword and
+// ConsumerPassword.  The parentheses keep them apart from users
+// in the config.
+const (
+	producerUser = "(producer)"
+	consumerUser = "(consumer)"
+)
+
+// The producer password is only good for connections without a
+// wid and the consumer password only for those with one.
+func (cred credential) accepts(client *ClientData) bool {
+	switch cred.user {
+	case producerUser:
+		return !client.IsConsumer()
+	case consumerUser:
+		return client.IsConsumer()
+	}
+	return true
+}
+
+// Producers may push to any queue, consumers may also fetch.
+func (s *Server) aclUser(name string) *aclUser {
+	switch name {
+	case producerUser:
+		if s.CurrentOptions().ProducerPassword != "" {
+			return &aclUser{name: "producer", push: []string{"*"}}
+		}
+		return nil
+	case consumerUser:
+		if s.CurrentOptions().ConsumerPassword != "" {
+			return &aclUser{name: "consumer", push: []string{"*"}, fetch: []string{"*"}}
+		}
+		return nil
+	}
+	if s.acl == nil {
+		return nil
+	}
+	return s.acl.user(name)
+}
+
+func parseACL(section interface{}) (map[string]*aclUser, error) {
+	users := map[string]*aclUser{}
+	if section == nil {
+		return users, nil
+	}
+	tables, ok := section.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid ACL: acl must be a table")
+	}
+
+	for name, table := range tables {
+		values, ok := table.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Invalid ACL: acl.%s must be a table", name)
+		}
+		user := &aclUser{name: name}
+		for key, val := range values {
+			var err error
+			switch key {
+			case "password":
+				user.password, ok = val.(string)
+				if !ok || user.password == "" {
+					err = fmt.Errorf("must be a non-empty string")
+				}
+			case "push":
+				user.push, err = patternList(val)
+			case "fetch":
+				user.fetch, err = patternList(val)
+			case "admin":
+				user.admin, ok = val.(bool)
+				if !ok {
+					err = fmt.Errorf("must be true or false")
+				}
+			default:
+				err = fmt.Errorf("is not a known ACL setting")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Invalid ACL: acl.%s.%s %v", name, key, err)
+			}
+		}
+		if user.password == "" {
+			return nil, fmt.Errorf("Invalid ACL: acl.%s needs a password", name)
+		}
+		users[name] = user
+	}
+	return users, nil
+}
+
+func patternList(val interface{}) ([]string, error) {
+	items, ok := val.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("must be an array of queue patterns")
+	}
+	patterns := make([]string, len(items))
+	for idx, item := range items {
+		pattern, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("must be an array of queue patterns")
+		}
+		// catch typos like "billing_[" before they deny everything
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("has invalid pattern %q", pattern)
+		}
+		patterns[idx] = pattern
+	}
+	return patterns, nil
+}
+
+func matchesAny(patterns []string, queue string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, queue); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// A FETCH pattern is only allowed if every queue it could match is,
+// i.e. it is one of the patterns itself or narrows a "prefix*" one.
+func coversAny(patterns []string, pattern string) bool {
+	for _, allowed := range patterns {
+		if allowed == "*" || allowed == pattern {
+			return true
+		}
+		prefix := strings.TrimSuffix(allowed, "*")
+		if prefix != allowed && !manager.IsQueuePattern(prefix) && strings.HasPrefix(pattern, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the connection's ACL user may run cmd.  Unparseable commands
+// are let through for the command itself to reject.
+func (s *Server) authorize(c *Connection, verb string, cmd string) error {
+	if c.aclUser == "" {
+		return nil
+	}
+	user := s.aclUser(c.aclUser)
+	if user == nil {
+		return newTaggedError("FORBIDDEN", fmt.Errorf("ACL user %s no longer exists", c.aclUser))
+	}
+	if user.admin {
+		return nil
+	}
+
+	var allowed []string
+	var queues []string
+	switch verb {
+	case "END", "INFO", "UNSUBSCRIBE":
+		return nil
+	case "ACK", "FAIL", "BEAT":
+		if len(user.fetch) > 0 {
+			return nil
+		}
+	case "FETCH":
+		req, err := parseFetch(cmd)
+		if err != nil {
+			return nil
+		}
+		allowed = user.fetch
+		for _, queue := range req.queues {
+			name, _, err := manager.SplitQueueWeight(queue)
+			if err != nil {
+				return nil
+			}
+			queues = append(queues, name)
+		}
+	case "TRACK":
+		// workers report progress, producers read it
+		if len(user.fetch) > 0 || len(user.push) > 0 && strings.HasPrefix(cmd, "TRACK GET ") {
+			return nil
+		}
+	case "RESULT":
+		if len(user.push) > 0 || len(user.fetch) > 0 {
+			return nil
+		}
+	case "CANCEL":
+		if len(user.push) > 0 {
+			return nil
+		}
+	case "BATCH":
+		if len(user.push) == 0 {
+			break
+		}
+		allowed, queues = user.push, batchQueues(cmd)
+		if len(queues) == 0 {
+			return nil
+		}
+	case "PUSH", "PUSHTO", "PUSHIF", "PUSHB":
+		allowed, queues = user.push, pushQueues(verb, cmd)
+		if queues == nil {
+			return nil
+		}
+	}
+
+	if allowed != nil && len(queues) > 0 {
+		for _, queue := range queues {
+			if manager.IsQueuePattern(queue) {
+				if !coversAny(allowed, queue) {
+					return newTaggedError("FORBIDDEN", fmt.Errorf("%s may not %s queue pattern %s", user.name, verb, queue))
+				}
+				continue
+			}
+			if !matchesAny(allowed, queue) {
+				return newTaggedError("FORBIDDEN", fmt.Errorf("%s may not %s queue %s", user.name, verb, queue))
+			}
+		}
+		return nil
+	}
+	return newTaggedError("FORBIDDEN", fmt.Errorf("%s may not %s", user.name, verb))
+}
+
+// The queues a BATCH NEW's callbacks will be pushed to.
+func batchQueues(cmd string) []string {
+	parts := strings.SplitN(cmd, " ", 3)
+	if len(parts) != 3 || parts[1] != "NEW" {
+		return nil
+	}
+	var batch client.Batch
+	err := json.Unmarshal([]byte(parts[2]), &batch)
+	if err != nil {
+		return nil
+	}
+	var queues []string
+	for _, callback := range []*client.Job{batch.Success, batch.Complete} {
+		if callback == nil {
+			continue
+		}
+		queue := callback.Queue
+		if queue == "" {
+			queue = "default"
+		}
+		queues = append(queues, queue)
+	}
+	return queues
+}
+
+// The queues a push command targets, nil if it can't be parsed.
+func pushQueues(verb string, cmd string) []string {
+	var data []byte
+	switch verb {
+	case "PUSHTO":
+		parts := strings.SplitN(cmd, " -- ", 2)
+		if len(parts) != 2 {
+			return nil
+		}
+		return strings.Fields(parts[0])[1:]
+	case "PUSHB":
+		if len(cmd) < 6 {
+			return nil
+		}
+		body, err := decodeBody([]byte(cmd[6:]))
+		if err != nil {
+			return nil
+		}
+		var jobs []client.Job
+		err = json.Unmarshal(body, &jobs)
+		if err != nil {
+			return nil
+		}
+		queues := make([]string, len(jobs))
+		for idx, job := range jobs {
+			queues[idx] = job.Queue
+			if job.Queue == "" {
+				queues[idx] = "default"
+			}
+		}
+		return queues
+	case "PUSHIF":
+		parts := strings.SplitN(cmd, " ", 3)
+		if len(parts) != 3 {
+			return nil
+		}
+		payload := parts[2]
+		if parts[1] == "QUEUE_EMPTY" {
+			args := strings.SplitN(payload, " ", 2)
+			if len(args) != 2 {
+				return nil
+			}
+			payload = args[1]
+		}
+		data = []byte(payload)
+	default:
+		if len(cmd) < 5 {
+			return nil
+		}
+		var err error
+		data, err = decodeBody([]byte(cmd[5:]))
+		if err != nil {
+			return nil
+		}
+	}
+
+	var job client.Job
+	err := json.Unmarshal(data, &job)
+	if err != nil {
+		return nil
+	}
+	if job.Queue == "" {
+		return []string{"default"}
+	}
+	return []string{job.Queue}
+}
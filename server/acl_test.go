@@ -0,0 +1,241 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/stretchr/testify/assert"
+)
+
+func aclConfig(t *testing.T, data string) map[string]interface{} {
+	hash := map[string]interface{}{}
+	_, err := toml.Decode(data, &hash)
+	assert.NoError(t, err)
+	return hash
+}
+
+func TestParseACL(t *testing.T) {
+	cfg := aclConfig(t, `
+[acl.billing]
+password = "s3cret"
+push = ["billing_*"]
+
+[acl.mailer]
+password = "t0ken"
+fetch = ["default", "mail"]
+
+[acl.ops]
+password = "0ps"
+admin = true
+`)
+	users, err := parseACL(cfg["acl"])
+	assert.NoError(t, err)
+	assert.Len(t, users, 3)
+	assert.Equal(t, []string{"billing_*"}, users["billing"].push)
+	assert.Nil(t, users["billing"].fetch)
+	assert.Equal(t, []string{"default", "mail"}, users["mailer"].fetch)
+	assert.True(t, users["ops"].admin)
+
+	users, err = parseACL(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, users)
+
+	for _, bad := range []string{
+		"acl = 1",
+		"[acl.x]\npush = [\"a\"]",
+		"[acl.x]\npassword = \"p\"\npush = \"a\"",
+		"[acl.x]\npassword = \"p\"\nfetch = [\"mail[\"]",
+		"[acl.x]\npassword = \"p\"\nqueues = [\"a\"]",
+	} {
+		_, err = parseACL(aclConfig(t, bad)["acl"])
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	users, err := parseACL(aclConfig(t, `
+[acl.billing]
+password = "s3cret"
+push = ["billing_*"]
+
+[acl.mailer]
+password = "t0ken"
+fetch = ["default", "mail"]
+
+[acl.ops]
+password = "0ps"
+admin = true
+`)["acl"])
+	assert.NoError(t, err)
+	s := &Server{acl: &aclSubsystem{users: users}}
+
+	check := func(user string, cmd string) bool {
+		verb := strings.Fields(cmd)[0]
+		return s.authorize(&Connection{aclUser: user}, verb, cmd) == nil
+	}
+
+	assert.True(t, check("", "FLUSH"))
+	assert.True(t, check("ops", "FLUSH"))
+	assert.True(t, check("billing", "INFO"))
+
+	assert.True(t, check("billing", `PUSH {"jid":"1","jobtype":"Bill","args":[],"queue":"billing_eu"}`))
+	assert.False(t, check("billing", `PUSH {"jid":"1","jobtype":"Bill","args":[]}`))
+	assert.True(t, check("billing", `PUSHTO billing_eu billing_us -- {"jid":"1","jobtype":"Bill","args":[]}`))
+	assert.False(t, check("billing", `PUSHTO billing_eu default -- {"jid":"1","jobtype":"Bill","args":[]}`))
+	assert.True(t, check("billing", `PUSHIF QUEUE_EMPTY default {"jid":"1","jobtype":"Bill","args":[],"queue":"billing_eu"}`))
+	assert.True(t, check("billing", `PUSHB [{"jid":"1","jobtype":"Bill","args":[],"queue":"billing_eu"}]`))
+	assert.False(t, check("billing", `PUSHB [{"jid":"1","jobtype":"Bill","args":[],"queue":"billing_eu"},{"jid":"2","jobtype":"Bill","args":[]}]`))
+	assert.True(t, check("billing", `BATCH NEW {"success":{"jid":"1","jobtype":"Billed","args":[],"queue":"billing_eu"}}`))
+	assert.False(t, check("billing", `BATCH NEW {"complete":{"jid":"1","jobtype":"Billed","args":[]}}`))
+	assert.True(t, check("billing", "BATCH COMMIT b-12345678"))
+	assert.False(t, check("mailer", "BATCH COMMIT b-12345678"))
+	assert.True(t, check("billing", "TRACK GET 123456789"))
+	assert.False(t, check("billing", `TRACK SET {"jid":"123456789","percent":10}`))
+	assert.True(t, check("mailer", `TRACK SET {"jid":"123456789","percent":10}`))
+	assert.True(t, check("billing", "RESULT 123456789"))
+	assert.True(t, check("mailer", "RESULT 123456789"))
+	assert.True(t, check("billing", "CANCEL 123456789"))
+	assert.False(t, check("mailer", "CANCEL 123456789"))
+	assert.False(t, check("billing", "FETCH billing_eu"))
+	assert.False(t, check("billing", "ACK {}"))
+	assert.False(t, check("billing", "QUEUE CONFIG billing_eu ordering lifo"))
+
+	assert.True(t, check("mailer", "FETCH mail default"))
+	assert.True(t, check("mailer", "FETCH COUNT 10 mail default"))
+	assert.True(t, check("mailer", "FETCH mail:5 default:1"))
+	assert.False(t, check("mailer", "FETCH mail:5 billing_eu:1"))
+	assert.False(t, check("mailer", "FETCH COUNT 10 billing_eu"))
+	assert.False(t, check("mailer", "FETCH mail*"))
+
+	users["mailer"].fetch = []string{"mail_*", "?"}
+	assert.True(t, check("mailer", "FETCH mail_*"))
+	assert.True(t, check("mailer", "FETCH mail_eu_*"))
+	assert.False(t, check("mailer", "FETCH *"))
+	assert.False(t, check("mailer", "FETCH mail*"))
+	assert.False(t, check("mailer", "FETCH mail billing_eu"))
+	assert.True(t, check("mailer", "ACK {}"))
+	assert.True(t, check("mailer", "BEAT {}"))
+	assert.False(t, check("mailer", `PUSH {"jid":"1","jobtype":"Mail","args":[],"queue":"mail"}`))
+
+	// removed users lose access immediately
+	assert.False(t, check("nobody", "INFO"))
+}
+
+func TestACLHello(t *testing.T) {
+	s := &Server{
+		Options: &ServerOptions{
+			Password: "main",
+			GlobalConfig: aclConfig(t, `
+[acl.mailer]
+password = "t0ken"
+fetch = ["mail"]
+`),
+		},
+		Stats:   &RuntimeStats{},
+		workers: newWorkers(),
+		acl:     &aclSubsystem{},
+	}
+	err := s.acl.Start(s)
+	assert.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go s.serve(listener, false)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	buf := bufio.NewReader(conn)
+	line, err := buf.ReadString('\n')
+	assert.NoError(t, err)
+	var hi map[string]interface{}
+	err = json.Unmarshal([]byte(line[4:]), &hi)
+	assert.NoError(t, err)
+
+	payload, err := json.Marshal(ClientData{
+		Hostname:     "localhost",
+		Wid:          "mailer-1",
+		Version:      2,
+		PasswordHash: hash("t0ken", hi["s"].(string), int(hi["i"].(float64))),
+	})
+	assert.NoError(t, err)
+	conn.Write([]byte("HELLO " + string(payload) + "\r\n"))
+	line, err = buf.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n", line)
+
+	conn.Write([]byte("FETCH default\r\n"))
+	line, err = buf.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "-FORBIDDEN mailer may not FETCH queue default\r\n", line)
+
+	conn.Write([]byte("CLIENT LIST\r\n"))
+	line, err = buf.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "-FORBIDDEN mailer may not CLIENT\r\n", line)
+}
+
+func TestProducerConsumerPasswords(t *testing.T) {
+	s := &Server{
+		Options: &ServerOptions{Password: "main", ProducerPassword: "pr0ducer", ConsumerPassword: "c0nsumer"},
+		Stats:   &RuntimeStats{},
+		workers: newWorkers(),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go s.serve(listener, false)
+
+	hello := func(password string, wid string) (net.Conn, *bufio.Reader, string) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		assert.NoError(t, err)
+		buf := bufio.NewReader(conn)
+		line, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		var hi map[string]interface{}
+		err = json.Unmarshal([]byte(line[4:]), &hi)
+		assert.NoError(t, err)
+
+		payload, err := json.Marshal(ClientData{
+			Hostname:     "localhost",
+			Wid:          wid,
+			Version:      2,
+			PasswordHash: hash(password, hi["s"].(string), int(hi["i"].(float64))),
+		})
+		assert.NoError(t, err)
+		conn.Write([]byte("HELLO " + string(payload) + "\r\n"))
+		line, err = buf.ReadString('\n')
+		assert.NoError(t, err)
+		return conn, buf, line
+	}
+	send := func(conn net.Conn, buf *bufio.Reader, cmd string) string {
+		conn.Write([]byte(cmd + "\r\n"))
+		line, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		return line
+	}
+
+	conn, buf, result := hello("pr0ducer", "")
+	defer conn.Close()
+	assert.Equal(t, "+OK\r\n", result)
+	assert.Equal(t, "-FORBIDDEN producer may not FETCH\r\n", send(conn, buf, "FETCH default"))
+	assert.Equal(t, "-FORBIDDEN producer may not ACK\r\n", send(conn, buf, `ACK {"jid":"123"}`))
+
+	conn, buf, result = hello("c0nsumer", "worker-1")
+	defer conn.Close()
+	assert.Equal(t, "+OK\r\n", result)
+	assert.Equal(t, "-FORBIDDEN consumer may not FLUSH\r\n", send(conn, buf, "FLUSH"))
+
+	// each password only works for its kind of connection
+	conn, _, result = hello("pr0ducer", "worker-2")
+	defer conn.Close()
+	assert.Equal(t, "-ERR Invalid password\r\n", result)
+	conn, _, result = hello("c0nsumer", "")
+	defer conn.Close()
+	assert.Equal(t, "-ERR Invalid password\r\n", result)
+}
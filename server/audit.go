@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/contribsys/faktory/util"
+)
+
+/*
+ * Destructive actions, e.g. MUTATE, clearing a queue, FLUSH, a config
+ * reload or deleting jobs in the Web UI, are logged along with who
+ * took them: the client's address and, if it has them, its wid, ACL
+ * user and certificate identity.  The audit subsystem also appends
+ * each one as a line of JSON to a file of its own:
+ *
+ *	[audit]
+ *	path = "/var/log/faktory/audit.log"
+ *
+ * The file is only ever appended to and is reopened on SIGHUP so it
+ * can be rotated.
+ */
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func (a *auditLog) Name() string {
+	return "audit"
+}
+
+func (a *auditLog) Start(s *Server) error {
+	return a.Reload(s)
+}
+
+func (a *auditLog) Reload(s *Server) error {
+	path := s.CurrentOptions().String("audit", "path", "")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.close()
+	a.path = path
+	if path == "" {
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to open audit log: %v", err)
+	}
+	a.file = file
+	return nil
+}
+
+func (a *auditLog) Stop(s *Server) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.close()
+	return nil
+}
+
+func (a *auditLog) close() {
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+func (a *auditLog) write(action string, fields map[string]interface{}) error {
+	entry := make(map[string]interface{}, len(fields)+2)
+	for key, val := range fields {
+		entry[key] = val
+	}
+	entry["ts"] = util.Nows()
+	entry["action"] = action
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	_, err = a.file.Write(append(line, '\n'))
+	return err
+}
+
+// Audit records a destructive action, see auditLog.  fields should
+// say what was changed and who changed it, e.g. "addr" for the
+// remote address.
+func (s *Server) Audit(action string, fields map[string]interface{}) {
+	util.Infow(action, fields)
+	if s.audit == nil {
+		return
+	}
+	err := s.audit.write(action, fields)
+	if err != nil {
+		util.Warnf("Unable to write %q to the audit log: %v", action, err)
+	}
+}
+
+// Audit an action taken by the client on c.
+func (c *Connection) audit(s *Server, action string, fields map[string]interface{}) {
+	fields["addr"] = c.client.Address
+	if c.client.Wid != "" {
+		fields["wid"] = c.client.Wid
+	}
+	if c.aclUser != "" {
+		fields["user"] = c.aclUser
+	}
+	if c.client.Identity != "" {
+		fields["identity"] = c.client.Identity
+	}
+	s.Audit(action, fields)
+}
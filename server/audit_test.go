@@ -0,0 +1,73 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "faktory-audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	audit := &auditLog{}
+	s := &Server{audit: audit, Options: &ServerOptions{GlobalConfig: aclConfig(t, `
+[audit]
+path = "`+path+`"
+`)}}
+	assert.NoError(t, audit.Start(s))
+	defer audit.Stop(s)
+
+	c := &Connection{client: &ClientData{Address: "10.0.0.5:51234", Wid: "worker1"}, aclUser: "ops"}
+	c.audit(s, "jobs kill", map[string]interface{}{"target": "dead", "jobs": 3})
+	s.Audit("config reload", map[string]interface{}{"applied": []string{"Password"}})
+
+	// rotated away, the reload opens a new file
+	assert.NoError(t, os.Rename(path, path+".1"))
+	assert.NoError(t, audit.Reload(s))
+	s.Audit("flush", map[string]interface{}{"addr": "127.0.0.1:4000"})
+
+	read := func(path string) []map[string]interface{} {
+		data, err := ioutil.ReadFile(path)
+		assert.NoError(t, err)
+		entries := []map[string]interface{}{}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var entry map[string]interface{}
+			assert.NoError(t, json.Unmarshal([]byte(line), &entry))
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	entries := read(path + ".1")
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "jobs kill", entries[0]["action"])
+	assert.Equal(t, "dead", entries[0]["target"])
+	assert.EqualValues(t, 3, entries[0]["jobs"])
+	assert.Equal(t, "10.0.0.5:51234", entries[0]["addr"])
+	assert.Equal(t, "worker1", entries[0]["wid"])
+	assert.Equal(t, "ops", entries[0]["user"])
+	assert.NotEmpty(t, entries[0]["ts"])
+	assert.Equal(t, "config reload", entries[1]["action"])
+
+	entries = read(path)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "flush", entries[0]["action"])
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// disabled
+	s.Options.GlobalConfig = nil
+	assert.NoError(t, audit.Reload(s))
+	s.Audit("flush", map[string]interface{}{})
+	assert.Len(t, read(path), 1)
+}
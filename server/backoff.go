@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/contribsys/faktory/manager"
+	"github.com/contribsys/faktory/util"
+)
+
+/*
+ * The backoff subsystem sets how long jobs of a jobtype wait between
+ * retries, for jobs which don't give their own backoff:
+ *
+ *	[backoff]
+ *	SyncInventory = "table:10s,1m,10m,1h"
+ *	ChargeCard = "fixed:5m"
+ *	SendWebhook = "linear:30s"
+ *
+ * Jobtypes which aren't listed use the usual exponential backoff,
+ * see manager.ParseBackoff for the formats.
+ */
+type backoffs struct {
+	mu       sync.RWMutex
+	jobtypes map[string]manager.Backoff
+}
+
+func (b *backoffs) Name() string {
+	return "backoff"
+}
+
+func (b *backoffs) Start(s *Server) error {
+	return b.Reload(s)
+}
+
+func (b *backoffs) Reload(s *Server) error {
+	jobtypes, err := parseBackoffs(s.CurrentOptions().GlobalConfig["backoff"])
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.jobtypes = jobtypes
+	b.mu.Unlock()
+	if len(jobtypes) > 0 {
+		util.Infof("Loaded backoff for %d jobtypes", len(jobtypes))
+	}
+	return nil
+}
+
+func (b *backoffs) Stop(s *Server) error {
+	return nil
+}
+
+func parseBackoffs(section interface{}) (map[string]manager.Backoff, error) {
+	jobtypes := map[string]manager.Backoff{}
+	if section == nil {
+		return jobtypes, nil
+	}
+	table, ok := section.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid backoff: must be a table")
+	}
+
+	for jobtype, val := range table {
+		value, ok := val.(string)
+		if !ok {
+			return nil, fmt.Errorf("Invalid backoff: %s must be a string such as \"fixed:5m\"", jobtype)
+		}
+		backoff, err := manager.ParseBackoff(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid backoff for %s: %v", jobtype, err)
+		}
+		jobtypes[jobtype] = backoff
+	}
+	return jobtypes, nil
+}
+
+// The manager's view of the backoffs, see manager.Options.Backoff.
+func (s *Server) jobBackoff(jobtype string) manager.Backoff {
+	if s.backoffs == nil {
+		return manager.Backoff{}
+	}
+	s.backoffs.mu.RLock()
+	defer s.backoffs.mu.RUnlock()
+	return s.backoffs.jobtypes[jobtype]
+}
+
+// NewServer and ReloadOptions have checked the jitter.
+func (s *Server) retryJitter() manager.Jitter {
+	jitter, _ := manager.ParseJitter(s.CurrentOptions().RetryJitter)
+	return jitter
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/contribsys/faktory/manager"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBackoffs(t *testing.T) {
+	jobtypes, err := parseBackoffs(aclConfig(t, `
+[backoff]
+SyncInventory = "table:10s,1m"
+ChargeCard = "fixed:5m"
+`)["backoff"])
+	assert.NoError(t, err)
+	s := &Server{backoffs: &backoffs{jobtypes: jobtypes}}
+	assert.Equal(t, manager.Backoff{Strategy: manager.BackoffFixed, Interval: 5 * time.Minute}, s.jobBackoff("ChargeCard"))
+	assert.Equal(t, []time.Duration{10 * time.Second, time.Minute}, s.jobBackoff("SyncInventory").Table)
+	assert.Equal(t, manager.Backoff{}, s.jobBackoff("SendEmail"))
+
+	jobtypes, err = parseBackoffs(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, jobtypes)
+
+	for _, bad := range []string{
+		"backoff = 1",
+		"[backoff]\nChargeCard = 5",
+		"[backoff]\nChargeCard = \"sometimes\"",
+	} {
+		_, err = parseBackoffs(aclConfig(t, bad)["backoff"])
+		assert.Error(t, err, bad)
+	}
+
+	assert.Equal(t, manager.Backoff{}, (&Server{}).jobBackoff("ChargeCard"))
+}
+
+func TestRetryJitter(t *testing.T) {
+	_, err := NewServer(&ServerOptions{StorageDirectory: "/tmp/jitter", RetryJitter: "lots"})
+	assert.Error(t, err)
+
+	s, err := NewServer(&ServerOptions{StorageDirectory: "/tmp/jitter", RetryJitter: "20%"})
+	assert.NoError(t, err)
+	assert.Equal(t, manager.Jitter{Percent: 20}, s.retryJitter())
+
+	// a broken jitter keeps the current one
+	s.ReloadOptions(&ServerOptions{RetryJitter: "lots"})
+	assert.Equal(t, "20%", s.CurrentOptions().RetryJitter)
+	s.ReloadOptions(&ServerOptions{RetryJitter: "30s"})
+	assert.Equal(t, manager.Jitter{Max: 30 * time.Second}, s.retryJitter())
+}
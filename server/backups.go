@@ -0,0 +1,320 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/util"
+)
+
+/*
+ * The backup subsystem periodically uploads a snapshot, as taken by
+ * BACKUP, to a bucket so a single server can be rebuilt off-box:
+ *
+ *	[backup]
+ *	url = "s3://my-bucket/faktory/"
+ *	region = "eu-west-1"
+ *	every_minutes = 360
+ *	keep = 28
+ *	retention_days = 7
+ *
+ * url is an s3:// or gs:// bucket and key prefix.  Snapshots are
+ * gzipped JSON named faktory-<UTC time>.json.gz which faktory-cli
+ * restore accepts as is.  Amazon S3 is reached at
+ * s3.<region>.amazonaws.com and Google Cloud Storage, which needs HMAC
+ * keys, at storage.googleapis.com; endpoint overrides it for other S3
+ * compatible stores.  access_key and secret_key default to
+ * AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+ *
+ * A snapshot is taken every_minutes, daily by default, starting that
+ * long after boot.  Afterwards the oldest snapshots beyond the newest
+ * keep, 7 by default, and those older than retention_days are deleted.
+ * 0 turns either limit off.
+ */
+type backupShipping struct {
+	mu      sync.Mutex
+	s       *Server
+	config  *backupConfig
+	next    time.Time
+	running bool
+	last    string
+
+	uploads  int64
+	failures int64
+}
+
+type backupConfig struct {
+	scheme    string
+	bucket    string
+	prefix    string
+	endpoint  string
+	region    string
+	accessKey string
+	secretKey string
+	every     time.Duration
+	keep      int
+	retention time.Duration
+}
+
+const backupKeyTime = "20060102T150405Z"
+
+func (b *backupShipping) Name() string {
+	return "backup"
+}
+
+func (b *backupShipping) Start(s *Server) error {
+	err := b.Reload(s)
+	if err != nil {
+		return err
+	}
+	s.AddTask(60, b)
+	return nil
+}
+
+func (b *backupShipping) Reload(s *Server) error {
+	config, err := parseBackup(s.CurrentOptions().GlobalConfig["backup"], os.Getenv)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if config != nil && (b.config == nil || b.config.every != config.every) {
+		b.next = time.Now().Add(config.every)
+	}
+	b.s = s
+	b.config = config
+	if config != nil {
+		util.Infof("Shipping a backup to %s://%s/%s every %v", config.scheme, config.bucket, config.prefix, config.every)
+	}
+	return nil
+}
+
+func (b *backupShipping) Stop(s *Server) error {
+	return nil
+}
+
+// Starts a backup in the background when one is due so a slow
+// upload doesn't hold up the other tasks.
+func (b *backupShipping) Execute() error {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.config == nil || b.running || now.Before(b.next) {
+		return nil
+	}
+	b.running = true
+	b.next = now.Add(b.config.every)
+	go func(s *Server, config *backupConfig) {
+		key, err := shipBackup(s.Store(), config, now)
+		b.mu.Lock()
+		b.running = false
+		if err == nil {
+			b.last = key
+		}
+		b.mu.Unlock()
+		if err != nil {
+			atomic.AddInt64(&b.failures, 1)
+			util.Warnf("Unable to ship backup: %v", err)
+			return
+		}
+		atomic.AddInt64(&b.uploads, 1)
+		util.Infof("Shipped backup %s", key)
+	}(b.s, b.config)
+	return nil
+}
+
+func (b *backupShipping) Stats() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return map[string]interface{}{
+		"enabled":  b.config != nil,
+		"last":     b.last,
+		"uploads":  atomic.LoadInt64(&b.uploads),
+		"failures": atomic.LoadInt64(&b.failures),
+	}
+}
+
+// Uploads a snapshot of the store and prunes the old ones, returning
+// the new snapshot's key.
+func shipBackup(store storage.Store, config *backupConfig, now time.Time) (string, error) {
+	snap, err := storage.TakeSnapshot(store)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return "", err
+	}
+	zipped, err := util.Gzip(data)
+	if err != nil {
+		return "", err
+	}
+
+	bucket := config.objectStore()
+	key := config.prefix + "faktory-" + now.UTC().Format(backupKeyTime) + ".json.gz"
+	err = bucket.Put(key, zipped, "application/gzip")
+	if err != nil {
+		return "", err
+	}
+	return key, pruneBackups(bucket, config, now)
+}
+
+// Deletes the snapshots beyond keep or retention.  Other objects
+// under the prefix are left alone.
+func pruneBackups(bucket *objectStore, config *backupConfig, now time.Time) error {
+	if config.keep == 0 && config.retention == 0 {
+		return nil
+	}
+	keys, err := bucket.List(config.prefix + "faktory-")
+	if err != nil {
+		return err
+	}
+	snapshots := []string{}
+	taken := map[string]time.Time{}
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, config.prefix+"faktory-")
+		if !strings.HasSuffix(name, ".json.gz") {
+			continue
+		}
+		tim, err := time.Parse(backupKeyTime, strings.TrimSuffix(name, ".json.gz"))
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, key)
+		taken[key] = tim
+	}
+
+	// the keys sort oldest first
+	for idx, key := range snapshots {
+		expired := config.retention > 0 && now.Sub(taken[key]) > config.retention
+		extra := config.keep > 0 && idx < len(snapshots)-config.keep
+		if !expired && !extra {
+			continue
+		}
+		err = bucket.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (config *backupConfig) objectStore() *objectStore {
+	return newObjectStore(config.endpoint, config.bucket, config.region, config.accessKey, config.secretKey)
+}
+
+// Returns nil if the section is missing, i.e. no backups are shipped.
+// getenv supplies the default keys.
+func parseBackup(section interface{}, getenv func(string) string) (*backupConfig, error) {
+	if section == nil {
+		return nil, nil
+	}
+	values, ok := section.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid backup: must be a table")
+	}
+
+	config := &backupConfig{
+		accessKey: getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: getenv("AWS_SECRET_ACCESS_KEY"),
+		every:     24 * time.Hour,
+		keep:      7,
+	}
+	endpoint := ""
+	for key, val := range values {
+		var err error
+		switch key {
+		case "url", "endpoint", "region", "access_key", "secret_key":
+			str, ok := val.(string)
+			if !ok || str == "" {
+				err = fmt.Errorf("must be a string")
+				break
+			}
+			switch key {
+			case "url":
+				err = config.parseURL(str)
+			case "endpoint":
+				u, perr := url.Parse(str)
+				if perr != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+					err = fmt.Errorf("must be an http or https URL")
+					break
+				}
+				endpoint = str
+			case "region":
+				config.region = str
+			case "access_key":
+				config.accessKey = str
+			case "secret_key":
+				config.secretKey = str
+			}
+		case "every_minutes":
+			mins, ok := val.(int64)
+			if !ok || mins < 1 {
+				err = fmt.Errorf("must be a positive integer")
+				break
+			}
+			config.every = time.Duration(mins) * time.Minute
+		case "keep":
+			keep, ok := val.(int64)
+			if !ok || keep < 0 {
+				err = fmt.Errorf("must be a positive integer or 0")
+				break
+			}
+			config.keep = int(keep)
+		case "retention_days":
+			days, ok := val.(int64)
+			if !ok || days < 0 {
+				err = fmt.Errorf("must be a positive integer or 0")
+				break
+			}
+			config.retention = time.Duration(days) * 24 * time.Hour
+		default:
+			err = fmt.Errorf("is not a known setting")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid backup: %s %v", key, err)
+		}
+	}
+
+	if config.bucket == "" {
+		return nil, fmt.Errorf("Invalid backup: needs a url such as s3://bucket/prefix")
+	}
+	if config.accessKey == "" || config.secretKey == "" {
+		return nil, fmt.Errorf("Invalid backup: needs access_key and secret_key or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if config.region == "" {
+		config.region = "us-east-1"
+		if config.scheme == "gs" {
+			config.region = "auto"
+		}
+	}
+	config.endpoint = endpoint
+	if endpoint == "" {
+		config.endpoint = "https://s3." + config.region + ".amazonaws.com"
+		if config.scheme == "gs" {
+			config.endpoint = "https://storage.googleapis.com"
+		}
+	}
+	return config, nil
+}
+
+func (config *backupConfig) parseURL(str string) error {
+	u, err := url.Parse(str)
+	if err != nil || (u.Scheme != "s3" && u.Scheme != "gs") || u.Host == "" {
+		return fmt.Errorf("must be an s3:// or gs:// URL")
+	}
+	config.scheme = u.Scheme
+	config.bucket = u.Host
+	config.prefix = strings.TrimPrefix(u.Path, "/")
+	if config.prefix != "" && !strings.HasSuffix(config.prefix, "/") {
+		config.prefix += "/"
+	}
+	return nil
+}
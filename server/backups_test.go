@@ -0,0 +1,153 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/storage/memory"
+	"github.com/contribsys/faktory/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBackup(t *testing.T) {
+	noenv := func(string) string { return "" }
+	config, err := parseBackup(aclConfig(t, `
+[backup]
+url = "s3://my-bucket/faktory"
+region = "eu-west-1"
+access_key = "key"
+secret_key = "secret"
+every_minutes = 360
+retention_days = 7
+`)["backup"], noenv)
+	assert.NoError(t, err)
+	assert.Equal(t, &backupConfig{
+		scheme:    "s3",
+		bucket:    "my-bucket",
+		prefix:    "faktory/",
+		endpoint:  "https://s3.eu-west-1.amazonaws.com",
+		region:    "eu-west-1",
+		accessKey: "key",
+		secretKey: "secret",
+		every:     6 * time.Hour,
+		keep:      7,
+		retention: 7 * 24 * time.Hour,
+	}, config)
+
+	env := map[string]string{"AWS_ACCESS_KEY_ID": "envkey", "AWS_SECRET_ACCESS_KEY": "envsecret"}
+	config, err = parseBackup(aclConfig(t, `
+[backup]
+url = "gs://my-bucket"
+keep = 0
+`)["backup"], func(name string) string { return env[name] })
+	assert.NoError(t, err)
+	assert.Equal(t, "https://storage.googleapis.com", config.endpoint)
+	assert.Equal(t, "auto", config.region)
+	assert.Equal(t, "", config.prefix)
+	assert.Equal(t, "envkey", config.accessKey)
+	assert.Equal(t, 24*time.Hour, config.every)
+	assert.Equal(t, 0, config.keep)
+
+	config, err = parseBackup(nil, noenv)
+	assert.NoError(t, err)
+	assert.Nil(t, config)
+
+	keys := "\naccess_key = \"key\"\nsecret_key = \"secret\""
+	for _, bad := range []string{
+		"backup = 1",
+		"[backup]" + keys,
+		"[backup]\nurl = \"s3://my-bucket\"",
+		"[backup]\nurl = \"https://my-bucket\"" + keys,
+		"[backup]\nurl = 1" + keys,
+		"[backup]\nurl = \"s3://my-bucket\"\nendpoint = \"minio:9000\"" + keys,
+		"[backup]\nurl = \"s3://my-bucket\"\nevery_minutes = 0" + keys,
+		"[backup]\nurl = \"s3://my-bucket\"\nkeep = -1" + keys,
+		"[backup]\nurl = \"s3://my-bucket\"\nbucket = \"other\"" + keys,
+	} {
+		_, err = parseBackup(aclConfig(t, bad)["backup"], noenv)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestShipBackup(t *testing.T) {
+	bucket := &fakeBucket{objects: map[string][]byte{
+		"faktory/faktory-20261001T000000Z.json.gz": []byte("old"),
+		"faktory/faktory-20261012T000000Z.json.gz": []byte("recent"),
+		"faktory/faktory-20261013T000000Z.json.gz": []byte("yesterday"),
+		"faktory/notes.txt":                        []byte("not a snapshot"),
+	}}
+	ws := httptest.NewServer(bucket)
+	defer ws.Close()
+
+	store := memory.Open("backups")
+	defer store.Close()
+	q, err := store.GetQueue("default")
+	assert.NoError(t, err)
+	assert.NoError(t, q.Push(5, []byte(`{"jid":"abc123","jobtype":"Thing","args":[]}`)))
+
+	config := &backupConfig{
+		bucket:    "bucket",
+		prefix:    "faktory/",
+		endpoint:  ws.URL,
+		region:    "us-east-1",
+		accessKey: "key",
+		secretKey: "secret",
+		keep:      2,
+		retention: 7 * 24 * time.Hour,
+	}
+	now := time.Date(2026, 10, 14, 9, 30, 0, 0, time.UTC)
+	key, err := shipBackup(store, config, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "faktory/faktory-20261014T093000Z.json.gz", key)
+	// the oldest is past retention, the next beyond keep
+	assert.Equal(t, []string{
+		"faktory/faktory-20261013T000000Z.json.gz",
+		"faktory/faktory-20261014T093000Z.json.gz",
+		"faktory/notes.txt",
+	}, bucket.keys())
+
+	data, err := util.Gunzip(bucket.objects[key])
+	assert.NoError(t, err)
+	var snap storage.Snapshot
+	assert.NoError(t, json.Unmarshal(data, &snap))
+	assert.Equal(t, 1, len(snap.Queues))
+	assert.Contains(t, string(snap.Queues[0].Jobs[0]), "abc123")
+}
+
+func TestBackupShippingTask(t *testing.T) {
+	bucket := &fakeBucket{objects: map[string][]byte{}}
+	ws := httptest.NewServer(bucket)
+	defer ws.Close()
+
+	store := memory.Open("backuptask")
+	defer store.Close()
+
+	s := &Server{store: store, taskRunner: newTaskRunner(), Options: &ServerOptions{GlobalConfig: map[string]interface{}{
+		"backup": map[string]interface{}{
+			"url":        "s3://bucket/",
+			"endpoint":   ws.URL,
+			"access_key": "key",
+			"secret_key": "secret",
+		},
+	}}}
+	b := &backupShipping{}
+	assert.NoError(t, b.Start(s))
+
+	// not due until a day after boot
+	assert.NoError(t, b.Execute())
+	assert.EqualValues(t, 0, b.Stats()["uploads"])
+
+	b.mu.Lock()
+	b.next = time.Now()
+	b.mu.Unlock()
+	assert.NoError(t, b.Execute())
+	for i := 0; i < 100 && b.Stats()["uploads"] == int64(0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.EqualValues(t, 1, b.Stats()["uploads"])
+	assert.Equal(t, 1, len(bucket.keys()))
+	assert.Equal(t, bucket.keys()[0], b.Stats()["last"])
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/contribsys/faktory/util"
+)
+
+// connections tracks every connection in processLines for CLIENT
+// LIST.  The zero value is ready to use.
+type connections struct {
+	mu  sync.Mutex
+	all map[*Connection]bool
+}
+
+func (cs *connections) add(c *Connection) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.all == nil {
+		cs.all = map[*Connection]bool{}
+	}
+	cs.all[c] = true
+}
+
+func (cs *connections) remove(c *Connection) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.all, c)
+}
+
+// What CLIENT LIST reports for each connection.  Only the verb of
+// the last command is kept since the rest may hold a job payload
+// or password hash.
+type ConnectionInfo struct {
+	Address       string    `json:"addr"`
+	Wid           string    `json:"wid,omitempty"`
+	Hostname      string    `json:"hostname,omitempty"`
+	Labels        []string  `json:"labels,omitempty"`
+	Admin         bool      `json:"admin"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	LastCommand   string    `json:"last_command,omitempty"`
+	LastCommandAt time.Time `json:"last_command_at,omitempty"`
+	Commands      uint64    `json:"commands"`
+}
+
+// The live connections, oldest first.
+func (cs *connections) list() []ConnectionInfo {
+	cs.mu.Lock()
+	conns := make([]*Connection, 0, len(cs.all))
+	for c := range cs.all {
+		conns = append(conns, c)
+	}
+	cs.mu.Unlock()
+
+	infos := make([]ConnectionInfo, len(conns))
+	for idx, c := range conns {
+		infos[idx] = c.info()
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+	})
+	return infos
+}
+
+// Close every connection for which match returns true, except
+// the one asking.  Returns the number of connections closed.
+func (cs *connections) kill(caller *Connection, match func(*Connection) bool) int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	count := 0
+	for c := range cs.all {
+		if c != caller && match(c) {
+			c.Close()
+			count++
+		}
+	}
+	return count
+}
+
+// KillWorker closes every connection from the worker process wid and
+// fails the jobs it holds so they are retried rather than waiting for
+// their reservations to expire.  The worker may reconnect.
+func (s *Server) KillWorker(wid string) (int, error) {
+	return s.killWorker(nil, wid)
+}
+
+func (s *Server) killWorker(caller *Connection, wid string) (int, error) {
+	count := s.conns.kill(caller, func(c *Connection) bool {
+		return c.client.Wid == wid
+	})
+	if count == 0 {
+		return 0, nil
+	}
+	failed, err := s.manager.FailWorkerJobs(wid)
+	if err != nil {
+		return count, err
+	}
+	util.Warnf("Killed %d connections from worker %s and failed its %d jobs", count, wid, failed)
+	return count, nil
+}
+
+// KillAddress closes every connection from the remote address addr.
+func (s *Server) KillAddress(addr string) int {
+	return s.killAddress(nil, addr)
+}
+
+func (s *Server) killAddress(caller *Connection, addr string) int {
+	count := s.conns.kill(caller, func(c *Connection) bool {
+		return c.client.Address == addr
+	})
+	if count > 0 {
+		util.Warnf("Killed %d connections from %s", count, addr)
+	}
+	return count
+}
+
+func (c *Connection) recordCommand(verb string) {
+	c.mu.Lock()
+	c.lastCommand = verb
+	c.lastCommandAt = time.Now()
+	c.commands++
+	c.mu.Unlock()
+}
+
+func (c *Connection) info() ConnectionInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ConnectionInfo{
+		Address:       c.client.Address,
+		Wid:           c.client.Wid,
+		Hostname:      c.client.Hostname,
+		Labels:        c.client.Labels,
+		Admin:         c.isAdmin,
+		ConnectedAt:   c.connectedAt,
+		LastCommand:   c.lastCommand,
+		LastCommandAt: c.lastCommandAt,
+		Commands:      c.commands,
+	}
+}
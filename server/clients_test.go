@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientList(t *testing.T) {
+	s := &Server{
+		Options: &ServerOptions{},
+		Stats:   &RuntimeStats{},
+		workers: newWorkers(),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go s.serve(listener, false)
+
+	hello := func(payload string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		assert.NoError(t, err)
+		buf := bufio.NewReader(conn)
+		_, err = buf.ReadString('\n')
+		assert.NoError(t, err)
+		conn.Write([]byte("HELLO " + payload + "\r\n"))
+		line, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "+OK\r\n", line)
+		return conn, buf
+	}
+
+	producer, _ := hello(`{"v":2}`)
+	defer producer.Close()
+	consumer, buf := hello(`{"v":2,"wid":"lister","hostname":"box","labels":["golang"]}`)
+	defer consumer.Close()
+
+	var infos []ConnectionInfo
+	for i := 0; i < 2; i++ {
+		consumer.Write([]byte("CLIENT LIST\r\n"))
+		_, err = buf.ReadString('\n')
+		assert.NoError(t, err)
+		line, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		err = json.Unmarshal([]byte(line), &infos)
+		assert.NoError(t, err)
+	}
+
+	assert.Len(t, infos, 2)
+	assert.Equal(t, "", infos[0].Wid)
+	assert.Equal(t, producer.LocalAddr().String(), infos[0].Address)
+	assert.EqualValues(t, 0, infos[0].Commands)
+
+	assert.Equal(t, "lister", infos[1].Wid)
+	assert.Equal(t, "box", infos[1].Hostname)
+	assert.Equal(t, []string{"golang"}, infos[1].Labels)
+	assert.Equal(t, "CLIENT", infos[1].LastCommand)
+	// the current command counts too
+	assert.EqualValues(t, 2, infos[1].Commands)
+	assert.False(t, infos[1].LastCommandAt.IsZero())
+
+	consumer.Write([]byte("CLIENT KILL\r\n"))
+	line, _ := buf.ReadString('\n')
+	assert.Contains(t, line, "Invalid CLIENT")
+
+	consumer.Write([]byte("CLIENT KILL ADDR " + producer.LocalAddr().String() + "\r\n"))
+	line, _ = buf.ReadString('\n')
+	assert.Equal(t, ":1\r\n", line)
+	_, err = bufio.NewReader(producer).ReadString('\n')
+	assert.Error(t, err)
+
+	// never the caller's own connection
+	consumer.Write([]byte("CLIENT KILL ADDR " + consumer.LocalAddr().String() + "\r\n"))
+	line, _ = buf.ReadString('\n')
+	assert.Equal(t, ":0\r\n", line)
+}
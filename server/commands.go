@@ -1,14 +1,22 @@
 package server
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/contribsys/faktory/client"
 	"github.com/contribsys/faktory/manager"
+	"github.com/contribsys/faktory/storage"
 	"github.com/contribsys/faktory/util"
 )
 
@@ -17,15 +25,161 @@ import (
 // Commands should not have business logic.
 type command func(c *Connection, s *Server, cmd string)
 
+// A rawCommand is given the parsed request instead of a copy of the
+// line, for the commands a busy server sees the most of.  It mustn't
+// keep any of the request once it returns.
+type rawCommand func(c *Connection, s *Server, req request)
+
+var rawCmdSet = map[string]rawCommand{
+	"PUSH": push,
+	"ACK":  ack,
+	"FAIL": fail,
+	"BEAT": heartbeat,
+}
+
 var cmdSet = map[string]command{
-	"END":   end,
-	"PUSH":  push,
-	"FETCH": fetch,
-	"ACK":   ack,
-	"FAIL":  fail,
-	"BEAT":  heartbeat,
-	"INFO":  info,
-	"FLUSH": flush,
+	"END":    end,
+	"PUSHTO": pushTo,
+	"PUSHIF": pushIf,
+	"PUSHB":  pushBulk,
+	"FETCH":  fetch,
+	"INFO":   info,
+	"FLUSH":  flush,
+	"QUEUE":  queue,
+	"BATCH":  batch,
+	"TRACK":  track,
+	"RESULT": result,
+	"CANCEL": cancel,
+	"JOB":    jobs,
+
+	"DEADJOBS": deadJobs,
+	"CLIENT":   clients,
+	"MUTATE":   mutate,
+	"BACKUP":   backup,
+	"RESTORE":  restore,
+
+	"FETCH_SAMPLE":   fetchSample,
+	"FETCH_SAMPLE_N": fetchSample,
+	"SCAN":           scan,
+	"SLOWLOG":        slowlog,
+
+	"SUBSCRIBE":   subscribe,
+	"UNSUBSCRIBE": unsubscribe,
+}
+
+// RegisterCommand adds a command to the protocol, e.g. to serve
+// "MYVERB ..." with fn.  Commands may be registered while the server
+// runs but can't replace the built in ones.  They're accepted on the
+// regular and admin ports and, like other commands the ACL doesn't
+// know, forbidden to ACL users who aren't admins.
+func (s *Server) RegisterCommand(verb string, fn func(c *Connection, s *Server, cmd string)) error {
+	if verb == "" || strings.ContainsAny(verb, " \r\n") || verb != strings.ToUpper(verb) {
+		return fmt.Errorf("Invalid command %q, expected an upper case verb", verb)
+	}
+	if _, ok := builtinVerbs[verb]; ok {
+		return fmt.Errorf("Command %s is built in", verb)
+	}
+
+	s.cmdMu.Lock()
+	defer s.cmdMu.Unlock()
+	if _, ok := s.commands[verb]; ok {
+		return fmt.Errorf("Command %s is already registered", verb)
+	}
+	if s.commands == nil {
+		s.commands = map[string]command{}
+	}
+	s.commands[verb] = fn
+	return nil
+}
+
+// The verb's name and either its command or, for a rawCommand, nil.
+func (s *Server) command(verb []byte) (string, command, rawCommand, bool) {
+	if name, ok := builtinVerbs[string(verb)]; ok {
+		return name, cmdSet[name], rawCmdSet[name], true
+	}
+	name := string(verb)
+	s.cmdMu.RLock()
+	defer s.cmdMu.RUnlock()
+	proc, ok := s.commands[name]
+	return name, proc, nil, ok
+}
+
+// The command groups advertised in the HI greeting's features,
+// beyond the basic commands every server supports.
+var builtinFeatures = []string{
+	"pushto",
+	"pushif",
+	"pushb",
+	"fetchn",
+	"fetch_wait",
+	"queue_patterns",
+	"queue_weights",
+	"queue_pause",
+	"queue_limits",
+	"queue_throttle",
+	"queue_concurrency",
+	"unique",
+	"batch",
+	"depends_on",
+	"track",
+	"results",
+	"cancel",
+	"job",
+	"queue",
+	"fetch_sample",
+	"scan",
+	"deadjobs",
+	"client",
+	"mutate",
+	"backup",
+	"slowlog",
+	"subscribe",
+}
+
+// When an admin port is configured, these commands are only
+// accepted by the admin port.
+var adminCommands = map[string]bool{
+	"QUEUE":    true,
+	"DEADJOBS": true,
+	"CLIENT":   true,
+	"MUTATE":   true,
+	"BACKUP":   true,
+	"RESTORE":  true,
+	"SLOWLOG":  true,
+	"CANCEL":   true,
+	"FLUSH":    true,
+}
+
+// Job processing commands which the admin port does not accept.
+var workCommands = map[string]bool{
+	"PUSH":   true,
+	"PUSHTO": true,
+	"PUSHIF": true,
+	"PUSHB":  true,
+	"FETCH":  true,
+	"ACK":    true,
+	"FAIL":   true,
+	"BEAT":   true,
+	"BATCH":  true,
+	"TRACK":  true,
+	"RESULT": true,
+}
+
+func (s *Server) checkAccess(c *Connection, verb string) error {
+	if c.isAdmin && workCommands[verb] {
+		return newTaggedError("FORBIDDEN", fmt.Errorf("%s is not available on the admin port", verb))
+	}
+	if !c.isAdmin && s.Options.AdminBinding != "" && adminCommands[verb] {
+		return newTaggedError("FORBIDDEN", fmt.Errorf("%s is only available on the admin port", verb))
+	}
+	return nil
+}
+
+// Read-only commands which aren't counted in the command throughput.
+var uncountedCommands = map[string]bool{
+	"FETCH_SAMPLE":   true,
+	"FETCH_SAMPLE_N": true,
+	"JOB":            true,
 }
 
 func flush(c *Connection, s *Server, cmd string) {
@@ -34,6 +188,7 @@ func flush(c *Connection, s *Server, cmd string) {
 	} else {
 		util.Warn("Flushing dataset")
 	}
+	c.audit(s, "flush", map[string]interface{}{})
 	err := s.store.Flush()
 	if err != nil {
 		c.Error(cmd, err)
@@ -47,129 +202,1316 @@ func end(c *Connection, s *Server, cmd string) {
 	c.Close()
 }
 
-func push(c *Connection, s *Server, cmd string) {
-	data := cmd[5:]
+func push(c *Connection, s *Server, req request) {
+	data, err := decodeBody(req.args)
+	if err != nil {
+		c.Error("PUSH", newTaggedError("MALFORMED", err))
+		return
+	}
 
 	var job client.Job
-	err := json.Unmarshal([]byte(data), &job)
+	err = json.Unmarshal(data, &job)
+	if err != nil {
+		c.Error("PUSH", newTaggedError("MALFORMED", err))
+		return
+	}
+
+	err = s.Push(&job, len(data))
+	if err != nil && !s.dropDuplicate(err) {
+		c.Error("PUSH", err)
+		return
+	}
+
+	c.Ok()
+}
+
+func checkCompressEncoding(encoding string) error {
+	if _, ok := client.LookupArgsEncoding(encoding); !ok {
+		return fmt.Errorf("Invalid compress_encoding %q, register it with client.RegisterArgsEncoding", encoding)
+	}
+	return nil
+}
+
+// Push the job as PUSH does, encoding its args first.  size is the
+// length of the job's JSON.
+func (s *Server) Push(job *client.Job, size int) error {
+	err := s.encodeArgs(job, size)
+	if err != nil {
+		return err
+	}
+	return s.manager.Push(job)
+}
+
+// Compress the args of a pushed job whose JSON was size bytes, if
+// it's at least MinCompressBytes, then encrypt them if encryption is
+// configured.
+func (s *Server) encodeArgs(job *client.Job, size int) error {
+	opts := s.CurrentOptions()
+	if opts.MinCompressBytes > 0 && size >= opts.MinCompressBytes {
+		err := job.CompressArgsWith(opts.CompressEncoding)
+		if err != nil {
+			return err
+		}
+	}
+	return encryptArgs(job)
+}
+
+// Is err a duplicate unique job which should be dropped silently?
+func (s *Server) dropDuplicate(err error) bool {
+	_, ok := err.(*manager.NotUniqueError)
+	return ok && s.CurrentOptions().DropDuplicates
+}
+
+// Producers can send a large job compressed:
+//
+//	PUSH gzip <base64 encoded, gzipped job JSON>
+//
+// An uncompressed body is returned as is, not copied.
+func decodeBody(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte("gzip ")) {
+		return data, nil
+	}
+
+	zipped := make([]byte, base64.StdEncoding.DecodedLen(len(data)-5))
+	n, err := base64.StdEncoding.Decode(zipped, data[5:])
+	if err != nil {
+		return nil, err
+	}
+	return util.Gunzip(zipped[:n])
+}
+
+// PUSHTO q1 q2 q3 -- {job}
+func pushTo(c *Connection, s *Server, cmd string) {
+	parts := strings.SplitN(cmd, " -- ", 2)
+	if len(parts) != 2 {
+		c.Error(cmd, fmt.Errorf("Invalid PUSHTO, expected PUSHTO <queue>... -- <job>"))
+		return
+	}
+	queues := strings.Fields(parts[0])[1:]
+
+	var job client.Job
+	err := json.Unmarshal([]byte(parts[1]), &job)
+	if err != nil {
+		c.Error(cmd, newTaggedError("MALFORMED", err))
+		return
+	}
+	err = s.encodeArgs(&job, len(parts[1]))
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+
+	jids, err := s.manager.PushTo(&job, queues...)
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+
+	c.Simple(fmt.Sprintf("%d %s", len(jids), strings.Join(jids, ",")))
+}
+
+// The result of each job in a PUSHB, in order.
+type bulkResult struct {
+	Jid   string `json:"jid"`
+	Error string `json:"error,omitempty"`
+}
+
+// PUSHB [{job}, {job}, ...]
+// PUSHB gzip <base64 encoded, gzipped array>
+func pushBulk(c *Connection, s *Server, cmd string) {
+	if len(cmd) < 7 {
+		c.Error(cmd, fmt.Errorf("Invalid PUSHB, expected PUSHB [<job>...]"))
+		return
+	}
+	data, err := decodeBody([]byte(cmd[6:]))
+	if err != nil {
+		c.Error(cmd, newTaggedError("MALFORMED", err))
+		return
+	}
+
+	var payloads []json.RawMessage
+	err = json.Unmarshal(data, &payloads)
 	if err != nil {
 		c.Error(cmd, newTaggedError("MALFORMED", err))
 		return
 	}
 
-	err = s.manager.Push(&job)
+	jobs := make([]*client.Job, len(payloads))
+	for idx, payload := range payloads {
+		var job client.Job
+		err = json.Unmarshal(payload, &job)
+		if err != nil {
+			c.Error(cmd, newTaggedError("MALFORMED", fmt.Errorf("job %d: %v", idx, err)))
+			return
+		}
+		err = s.encodeArgs(&job, len(payload))
+		if err != nil {
+			c.Error(cmd, err)
+			return
+		}
+		jobs[idx] = &job
+	}
+
+	errs, err := s.manager.PushBulk(jobs)
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+
+	results := make([]bulkResult, len(jobs))
+	for idx, job := range jobs {
+		results[idx].Jid = job.Jid
+		if errs[idx] != nil && !s.dropDuplicate(errs[idx]) {
+			results[idx].Error = errs[idx].Error()
+		}
+	}
+	res, err := json.Marshal(results)
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	c.Result(res)
+}
+
+// PUSHIF UNIQUE_TYPE {job}
+// PUSHIF QUEUE_EMPTY <queue> {job}
+// PUSHIF WORKER_AVAILABLE {job}
+func pushIf(c *Connection, s *Server, cmd string) {
+	parts := strings.SplitN(cmd, " ", 3)
+	if len(parts) != 3 {
+		c.Error(cmd, fmt.Errorf("Invalid PUSHIF, expected PUSHIF <predicate> <job>"))
+		return
+	}
+
+	var cond storage.PushCondition
+	predicate, data := parts[1], parts[2]
+	switch predicate {
+	case "UNIQUE_TYPE", "WORKER_AVAILABLE":
+	case "QUEUE_EMPTY":
+		args := strings.SplitN(data, " ", 2)
+		if len(args) != 2 {
+			c.Error(cmd, fmt.Errorf("Invalid PUSHIF, expected PUSHIF QUEUE_EMPTY <queue> <job>"))
+			return
+		}
+		cond.EmptyQueue, data = args[0], args[1]
+	default:
+		c.Error(cmd, fmt.Errorf("Invalid PUSHIF, unknown predicate %s", predicate))
+		return
+	}
+
+	var job client.Job
+	err := json.Unmarshal([]byte(data), &job)
+	if err != nil {
+		c.Error(cmd, newTaggedError("MALFORMED", err))
+		return
+	}
+	job.UniqueType = predicate == "UNIQUE_TYPE"
+	err = s.encodeArgs(&job, len(data))
 	if err != nil {
 		c.Error(cmd, err)
 		return
 	}
 
+	// workers live in memory rather than Redis so this
+	// can't be checked atomically with the push.
+	if predicate == "WORKER_AVAILABLE" && !s.workers.available() {
+		c.Simple("SKIPPED")
+		return
+	}
+
+	pushed, err := s.manager.PushIf(&job, cond)
+	if s.dropDuplicate(err) {
+		c.Simple("SKIPPED")
+		return
+	}
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	if !pushed {
+		c.Simple("SKIPPED")
+		return
+	}
 	c.Ok()
 }
 
 func fetch(c *Connection, s *Server, cmd string) {
 	if c.client.state != Running {
 		// quiet or terminated workers should not get new jobs
+		c.waited = true
 		time.Sleep(2 * time.Second)
 		c.Result(nil)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
-
-	qs := strings.Split(cmd, " ")[1:]
-	job, err := s.manager.Fetch(ctx, c.client.Wid, qs...)
+	req, err := parseFetch(cmd)
 	if err != nil {
 		c.Error(cmd, err)
 		return
 	}
-	if job != nil {
-		res, err := json.Marshal(job)
+	req.queues = orderQueues(c.fetchOrder(s), req.queues, c.fetches)
+	c.fetches++
+
+	if req.wait > 0 {
+		c.waited = true
+		fetchWait(c, s, cmd, req)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if req.count > 0 {
+		jobs, err := s.manager.FetchN(ctx, c.client.Wid, req.count, req.queues...)
 		if err != nil {
 			c.Error(cmd, err)
 			return
 		}
-		c.Result(res)
-	} else {
-		c.Result(nil)
+		c.waited = len(jobs) == 0
+		replyJobs(c, s, cmd, jobs)
+		return
 	}
-}
-
-func ack(c *Connection, s *Server, cmd string) {
-	data := cmd[4:]
 
-	var hash map[string]string
-	err := json.Unmarshal([]byte(data), &hash)
+	job, err := s.manager.Fetch(ctx, c.client.Wid, req.queues...)
 	if err != nil {
-		c.Error(cmd, fmt.Errorf("Invalid ACK %s", data))
+		c.Error(cmd, err)
 		return
 	}
-	jid, ok := hash["jid"]
-	if !ok {
-		c.Error(cmd, fmt.Errorf("Invalid ACK %s", data))
-		return
+	c.waited = job == nil
+	replyJob(c, s, cmd, job)
+}
+
+// FETCH WAIT parks the connection until a job is pushed, the wait
+// is over or the server shuts down.
+func fetchWait(c *Connection, s *Server, cmd string, req fetchRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), req.wait)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.Stopper():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	count := req.count
+	if count == 0 {
+		count = 1
 	}
-	_, err = s.manager.Acknowledge(jid)
+	jobs, err := s.manager.FetchWait(ctx, c.client.Wid, count, req.queues...)
 	if err != nil {
 		c.Error(cmd, err)
 		return
 	}
-
-	c.Ok()
+	if req.count > 0 {
+		replyJobs(c, s, cmd, jobs)
+	} else if len(jobs) > 0 {
+		replyJob(c, s, cmd, jobs[0])
+	} else {
+		c.Result(nil)
+	}
 }
 
-func fail(c *Connection, s *Server, cmd string) {
-	data := cmd[5:]
-
-	var failure manager.FailPayload
-	err := json.Unmarshal([]byte(data), &failure)
+// Reply to FETCH with the job, or nil if there is none.
+func replyJob(c *Connection, s *Server, cmd string, job *client.Job) {
+	if job == nil {
+		c.Result(nil)
+		return
+	}
+	res, err := jobPayload(job)
 	if err != nil {
-		c.Error(cmd, fmt.Errorf("Invalid FAIL %s", data))
+		s.killUnreadable(job, err)
+		c.Result(nil)
 		return
 	}
+	fetched(c, s, job)
 
-	err = s.manager.Fail(&failure)
+	res, err = encodeResult(c, res)
 	if err != nil {
 		c.Error(cmd, err)
 		return
 	}
-	c.Ok()
+	c.Result(res)
 }
 
-func info(c *Connection, s *Server, cmd string) {
-	data, err := s.CurrentState()
+// Reply to FETCH with a count: an array of the jobs, or nil if
+// there are none.
+func replyJobs(c *Connection, s *Server, cmd string, jobs []*client.Job) {
+	payloads := make([]json.RawMessage, 0, len(jobs))
+	for _, job := range jobs {
+		payload, err := jobPayload(job)
+		if err != nil {
+			s.killUnreadable(job, err)
+			continue
+		}
+		fetched(c, s, job)
+		payloads = append(payloads, payload)
+	}
+	if len(payloads) == 0 {
+		c.Result(nil)
+		return
+	}
+
+	res, err := json.Marshal(payloads)
 	if err != nil {
 		c.Error(cmd, err)
 		return
 	}
-	bytes, err := json.Marshal(data)
+	res, err = encodeResult(c, res)
 	if err != nil {
 		c.Error(cmd, err)
 		return
 	}
+	c.Result(res)
+}
 
-	c.Result(bytes)
+// The longest a FETCH WAIT may park its connection.
+const maxFetchWait = 30 * time.Second
+
+// FETCH [WAIT seconds] [COUNT count] queue...
+type fetchRequest struct {
+	wait   time.Duration
+	count  int
+	queues []string
 }
 
-func heartbeat(c *Connection, s *Server, cmd string) {
-	data := cmd[5:]
+func parseFetch(cmd string) (fetchRequest, error) {
+	var req fetchRequest
+	args := strings.Split(cmd, " ")[1:]
 
-	var client ClientData
-	err := json.Unmarshal([]byte(data), &client)
+	if len(args) > 0 && args[0] == "WAIT" {
+		if len(args) < 2 {
+			return req, fmt.Errorf("Invalid FETCH WAIT, expected FETCH WAIT <seconds> [COUNT <count>] <queue>...")
+		}
+		secs, err := strconv.Atoi(args[1])
+		if err != nil || secs < 1 || time.Duration(secs)*time.Second > maxFetchWait {
+			return req, fmt.Errorf("Invalid FETCH WAIT, seconds must be between 1 and %d", maxFetchWait/time.Second)
+		}
+		req.wait = time.Duration(secs) * time.Second
+		args = args[2:]
+	}
+
+	// a queue may be named like a number so the count needs COUNT
+	if len(args) > 0 && args[0] == "COUNT" {
+		if len(args) < 2 {
+			return req, fmt.Errorf("Invalid FETCH COUNT, expected FETCH COUNT <count> <queue>...")
+		}
+		count, err := strconv.Atoi(args[1])
+		if err != nil || count < 1 || count > manager.MaxFetchJobs {
+			return req, fmt.Errorf("Invalid FETCH, count must be between 1 and %d", manager.MaxFetchJobs)
+		}
+		req.count = count
+		args = args[2:]
+	}
+	req.queues = args
+	return req, nil
+}
+
+// The job JSON sent to workers, which always see the original args.
+// The job is copied so a reservation keeps the compressed form.
+func jobPayload(job *client.Job) ([]byte, error) {
+	out := *job
+	err := out.DecompressArgs()
 	if err != nil {
-		c.Error(cmd, fmt.Errorf("Invalid BEAT %s", data))
+		return nil, err
+	}
+	return json.Marshal(&out)
+}
+
+// DecodedJob returns a copy of the job with its original args for
+// sending out of the server, e.g. in events, dead letters, the API or
+// the Web UI, which mustn't see them compressed or encrypted.  A job
+// whose args can't be decoded is returned as is.
+func DecodedJob(job *client.Job) *client.Job {
+	out := *job
+	if out.DecompressArgs() != nil {
+		return job
+	}
+	return &out
+}
+
+// A fetched job whose args can't be decoded, e.g. because they were
+// encrypted with a key which has since been dropped, would only be
+// fetched again once its reservation expires so it's killed instead.
+func (s *Server) killUnreadable(job *client.Job, err error) {
+	util.Warnw("Unable to decode job args, sending job to the dead set", map[string]interface{}{"jid": job.Jid, "queue": job.Queue, "error": err})
+	err = s.manager.Kill(&manager.FailPayload{Jid: job.Jid, ErrorType: "ArgsDecodeError", ErrorMessage: err.Error()})
+	if err != nil {
+		util.Error("Unable to kill job "+job.Jid, err)
+	}
+}
+
+// Compress a response for clients which accept gzip, if it helps.
+func encodeResult(c *Connection, res []byte) ([]byte, error) {
+	if c.client.Encoding != "gzip" {
+		return res, nil
+	}
+	zipped, err := util.Gzip(res)
+	if err != nil {
+		return nil, err
+	}
+	if len(zipped) < len(res) {
+		return zipped, nil
+	}
+	return res, nil
+}
+
+// The maximum number of jobs FETCH_SAMPLE_N can return.
+const maxSampleSize = 100
+
+// FETCH_SAMPLE <queue>
+// FETCH_SAMPLE_N <queue> <count>
+//
+// Return the next jobs FETCH would return from the queue without
+// removing, reserving or counting them.
+func fetchSample(c *Connection, s *Server, cmd string) {
+	parts := strings.Fields(cmd)
+	count := 1
+	if parts[0] == "FETCH_SAMPLE_N" {
+		if len(parts) != 3 {
+			c.Error(cmd, fmt.Errorf("Invalid FETCH_SAMPLE_N, expected FETCH_SAMPLE_N <queue> <count>"))
+			return
+		}
+		n, err := strconv.Atoi(parts[2])
+		if err != nil || n < 1 || n > maxSampleSize {
+			c.Error(cmd, fmt.Errorf("Invalid FETCH_SAMPLE_N, count must be between 1 and %d", maxSampleSize))
+			return
+		}
+		count = n
+	} else if len(parts) != 2 {
+		c.Error(cmd, fmt.Errorf("Invalid FETCH_SAMPLE, expected FETCH_SAMPLE <queue>"))
 		return
 	}
 
-	worker, ok := s.workers.heartbeat(&client, false)
-	if !ok {
-		c.Error(cmd, fmt.Errorf("Unknown worker %s", client.Wid))
+	q, err := s.store.GetQueue(parts[1])
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	datas, err := q.Peek(count)
+	if err != nil {
+		c.Error(cmd, err)
 		return
 	}
 
-	if worker.state == Running {
-		c.Ok()
-	} else {
-		c.Result([]byte(fmt.Sprintf(`{"state":"%s"}`, stateString(worker.state))))
+	payloads := make([]json.RawMessage, len(datas))
+	for idx, data := range datas {
+		var job client.Job
+		err := json.Unmarshal(data, &job)
+		if err != nil {
+			c.Error(cmd, err)
+			return
+		}
+		payloads[idx], err = jobPayload(&job)
+		if err != nil {
+			c.Error(cmd, err)
+			return
+		}
+	}
+
+	var res []byte
+	if parts[0] == "FETCH_SAMPLE_N" {
+		res, err = json.Marshal(payloads)
+		if err != nil {
+			c.Error(cmd, err)
+			return
+		}
+	} else if len(payloads) > 0 {
+		res = payloads[0]
+	}
+	if res != nil {
+		res, err = encodeResult(c, res)
+		if err != nil {
+			c.Error(cmd, err)
+			return
+		}
 	}
+	c.Result(res)
+}
+
+// The maximum number of jobs SCAN can return at once.
+const maxScanCount = 1000
+
+// SCAN <queue> <cursor> <count>
+// SCAN dead <cursor> <count>
+//
+// Return the next page of jobs from a queue, newest first, or the
+// dead set, oldest first, with the cursor of the following page.
+// A cursor of 0 starts from the beginning and a returned cursor of 0
+// means there are no more pages.
+func scan(c *Connection, s *Server, cmd string) {
+	parts := strings.Fields(cmd)
+	if len(parts) != 4 {
+		c.Error(cmd, fmt.Errorf("Invalid SCAN, expected SCAN <queue> <cursor> <count>"))
+		return
+	}
+	cursor, err := strconv.Atoi(parts[2])
+	if err != nil || cursor < 0 {
+		c.Error(cmd, fmt.Errorf("Invalid SCAN cursor %s", parts[2]))
+		return
+	}
+	count, err := strconv.Atoi(parts[3])
+	if err != nil || count < 1 || count > maxScanCount {
+		c.Error(cmd, fmt.Errorf("Invalid SCAN, count must be between 1 and %d", maxScanCount))
+		return
+	}
+
+	// Page ranges are inclusive so each page includes one extra
+	// job, which tells us whether there is another page.
+	datas := [][]byte{}
+	if parts[1] == "dead" {
+		_, err = s.store.Dead().Page(cursor, count, func(_ int, entry storage.SortedEntry) error {
+			datas = append(datas, entry.Value())
+			return nil
+		})
+	} else {
+		var q storage.Queue
+		q, err = s.store.GetQueue(parts[1])
+		if err == nil {
+			err = q.Page(int64(cursor), int64(count), func(_ int, data []byte) error {
+				datas = append(datas, data)
+				return nil
+			})
+		}
+	}
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+
+	next := 0
+	if len(datas) > count {
+		datas = datas[:count]
+		next = cursor + count
+	}
+
+	payloads := make([]json.RawMessage, len(datas))
+	for idx, data := range datas {
+		var job client.Job
+		err := json.Unmarshal(data, &job)
+		if err != nil {
+			c.Error(cmd, err)
+			return
+		}
+		payloads[idx], err = jobPayload(&job)
+		if err != nil {
+			c.Error(cmd, err)
+			return
+		}
+	}
+
+	res, err := json.Marshal(map[string]interface{}{"cursor": next, "jobs": payloads})
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	res, err = encodeResult(c, res)
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	c.Result(res)
+}
+
+// OnFetch calls fn with each job a FETCH returns to a worker, e.g. to
+// measure how long jobs wait.  It's called by the worker's connection
+// so must be quick and safe to call from many at once.
+func (s *Server) OnFetch(fn func(job *client.Job)) {
+	s.hookMu.Lock()
+	defer s.hookMu.Unlock()
+	hooks, _ := s.fetchHooks.Load().([]func(*client.Job))
+	s.fetchHooks.Store(append(hooks[:len(hooks):len(hooks)], fn))
+}
+
+func fetched(c *Connection, s *Server, job *client.Job) {
+	logFetch(c, s, job)
+	hooks, _ := s.fetchHooks.Load().([]func(*client.Job))
+	for _, fn := range hooks {
+		fn(job)
+	}
+}
+
+func logFetch(c *Connection, s *Server, job *client.Job) {
+	rate := s.CurrentOptions().FetchLogSampleRate
+	if !util.LogDebug || rate <= 0 || rand.Float64() >= rate {
+		return
+	}
+
+	fields := map[string]interface{}{
+		"jid":     job.Jid,
+		"jobtype": job.Type,
+		"queue":   job.Queue,
+		"wid":     c.client.Wid,
+	}
+	if enqueued, err := util.ParseTime(job.EnqueuedAt); err == nil {
+		fields["latency_ms"] = int64(time.Since(enqueued) / time.Millisecond)
+	}
+	util.Debugw("fetched", fields)
+}
+
+func ack(c *Connection, s *Server, req request) {
+	cmd := "ACK"
+	data := req.args
+
+	var payload struct {
+		Jid    string          `json:"jid"`
+		Result json.RawMessage `json:"result"`
+	}
+	err := json.Unmarshal(data, &payload)
+	if err != nil || payload.Jid == "" {
+		c.Error(cmd, fmt.Errorf("Invalid ACK %s", data))
+		return
+	}
+	jid := payload.Jid
+	result := payload.Result
+	if string(result) == "null" {
+		result = nil
+	}
+	err = manager.CheckResult(result)
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+
+	job, err := s.manager.Acknowledge(jid)
+	if err == manager.ErrJobTimedOut {
+		s.workers.timedOut(c.client.Wid)
+		util.Warnw(fmt.Sprintf("Worker acknowledged job after its %d second timeout", job.TimeoutSeconds), map[string]interface{}{
+			"wid":     c.client.Wid,
+			"jid":     jid,
+			"jobtype": job.Type,
+			"queue":   job.Queue,
+		})
+	}
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	if job != nil && result != nil {
+		err = s.manager.SetResult(jid, result)
+		if err != nil {
+			c.Error(cmd, err)
+			return
+		}
+	}
+
+	c.Ok()
+}
+
+// RESULT <jid>
+func result(c *Connection, s *Server, cmd string) {
+	parts := strings.Fields(cmd)
+	if len(parts) != 2 {
+		c.Error(cmd, fmt.Errorf("Invalid RESULT, expected RESULT <jid>"))
+		return
+	}
+	res, err := s.manager.GetResult(parts[1])
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	if res == nil {
+		c.Result(nil)
+		return
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	c.Result(data)
+}
+
+// CANCEL <jid>
+//
+// Replies with 1 if the job was cancelled, 0 if it isn't waiting
+// to run.
+func cancel(c *Connection, s *Server, cmd string) {
+	parts := strings.Fields(cmd)
+	if len(parts) != 2 {
+		c.Error(cmd, fmt.Errorf("Invalid CANCEL, expected CANCEL <jid>"))
+		return
+	}
+	job, err := s.manager.Cancel(parts[1])
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	if job == nil {
+		c.Number(0)
+		return
+	}
+	c.audit(s, "job cancel", map[string]interface{}{"jid": job.Jid, "queue": job.Queue})
+	c.Number(1)
+}
+
+// JOB GET <jid>
+//
+// Replies with where the job is, its payload and, if it's reserved,
+// the reservation, see manager.JobState.
+func jobs(c *Connection, s *Server, cmd string) {
+	parts := strings.Fields(cmd)
+	if len(parts) != 3 || parts[1] != "GET" {
+		c.Error(cmd, fmt.Errorf("Invalid JOB, expected JOB GET <jid>"))
+		return
+	}
+	state, err := s.manager.JobState(parts[2])
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	if state.Job != nil {
+		out := *state.Job
+		err = out.DecompressArgs()
+		if err != nil {
+			c.Error(cmd, err)
+			return
+		}
+		state.Job = &out
+	}
+
+	res, err := json.Marshal(state)
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	res, err = encodeResult(c, res)
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	c.Result(res)
+}
+
+func fail(c *Connection, s *Server, req request) {
+	cmd := "FAIL"
+	data := req.args
+
+	var failure manager.FailPayload
+	err := json.Unmarshal(data, &failure)
+	if err != nil {
+		c.Error(cmd, fmt.Errorf("Invalid FAIL %s", data))
+		return
+	}
+
+	err = s.manager.Fail(&failure)
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	c.Ok()
+}
+
+func info(c *Connection, s *Server, cmd string) {
+	data, err := s.CurrentState()
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+
+	c.Result(bytes)
+}
+
+func heartbeat(c *Connection, s *Server, req request) {
+	cmd := "BEAT"
+	data := req.args
+
+	var client ClientData
+	err := json.Unmarshal(data, &client)
+	if err != nil {
+		c.Error(cmd, fmt.Errorf("Invalid BEAT %s", data))
+		return
+	}
+
+	worker, ok := s.workers.heartbeat(&client, false)
+	if !ok {
+		c.Error(cmd, fmt.Errorf("Unknown worker %s", client.Wid))
+		return
+	}
+
+	if worker.state == Running {
+		c.Ok()
+	} else {
+		if worker.state == Terminate {
+			// the hard kill timeout starts once the worker has been told
+			s.workers.terminateSent(worker)
+		}
+		c.Result([]byte(fmt.Sprintf(`{"state":"%s"}`, stateString(worker.state))))
+	}
+}
+
+// QUEUE CONFIG <queue> ordering fifo|lifo|priority
+// QUEUE CONFIG <queue> ordering custom <comparator>
+func queue(c *Connection, s *Server, cmd string) {
+	parts := strings.Fields(cmd)
+	if len(parts) >= 2 {
+		switch parts[1] {
+		case "PAUSE", "RESUME":
+			pauseQueues(c, s, cmd, parts[1], parts[2:])
+			return
+		case "CLEAR", "REMOVE":
+			clearQueues(c, s, cmd, parts[1], parts[2:])
+			return
+		case "LIST":
+			queueList(c, s, cmd)
+			return
+		}
+	}
+	if len(parts) < 5 || parts[1] != "CONFIG" || parts[3] != "ordering" {
+		c.Error(cmd, fmt.Errorf("Invalid QUEUE, expected QUEUE CONFIG <queue> ordering <ordering>"))
+		return
+	}
+	ordering := parts[4]
+	if ordering != "custom" && len(parts) != 5 {
+		c.Error(cmd, fmt.Errorf("Invalid QUEUE, expected QUEUE CONFIG <queue> ordering <ordering>"))
+		return
+	}
+	if ordering == "custom" {
+		if len(parts) != 6 {
+			c.Error(cmd, fmt.Errorf("Invalid QUEUE, expected QUEUE CONFIG <queue> ordering custom <comparator>"))
+			return
+		}
+		ordering = parts[5]
+	}
+
+	q, err := s.store.GetQueue(parts[2])
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	err = q.SetOrdering(ordering)
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	c.Ok()
+}
+
+// QUEUE PAUSE <queue>...
+// QUEUE RESUME <queue>...
+//
+// Paused queues still accept jobs but FETCH skips them.
+func pauseQueues(c *Connection, s *Server, cmd string, action string, names []string) {
+	queues, ok := commandQueues(c, s, cmd, action, names)
+	if !ok {
+		return
+	}
+	for _, q := range queues {
+		var err error
+		if action == "PAUSE" {
+			err = q.Pause()
+		} else {
+			err = q.Resume()
+		}
+		if err != nil {
+			c.Error(cmd, err)
+			return
+		}
+		c.audit(s, "queue "+strings.ToLower(action), map[string]interface{}{"queue": q.Name()})
+		if action == "PAUSE" {
+			s.publish("queue.paused", map[string]interface{}{"queue": q.Name()})
+		} else {
+			s.publish("queue.resumed", map[string]interface{}{"queue": q.Name()})
+		}
+	}
+	c.Ok()
+}
+
+// QUEUE CLEAR <queue>...
+// QUEUE REMOVE <queue>...
+//
+// Replies with the number of jobs deleted.  REMOVE also forgets
+// the queue and its settings.
+func clearQueues(c *Connection, s *Server, cmd string, action string, names []string) {
+	queues, ok := commandQueues(c, s, cmd, action, names)
+	if !ok {
+		return
+	}
+	total := uint64(0)
+	for _, q := range queues {
+		var count uint64
+		var err error
+		if action == "CLEAR" {
+			count, err = q.Clear()
+		} else {
+			count, err = s.store.RemoveQueue(q.Name())
+		}
+		if err != nil {
+			c.Error(cmd, err)
+			return
+		}
+		c.audit(s, "queue "+strings.ToLower(action), map[string]interface{}{"queue": q.Name(), "jobs": count})
+		total += count
+	}
+	c.Number(int(total))
+}
+
+// An entry in the QUEUE LIST reply.
+type queueInfo struct {
+	Name           string  `json:"name"`
+	Size           uint64  `json:"size"`
+	Latency        float64 `json:"latency"`
+	Paused         bool    `json:"paused"`
+	Ordering       string  `json:"ordering"`
+	Throttle       string  `json:"throttle,omitempty"`
+	Busy           int     `json:"busy"`
+	MaxConcurrency int     `json:"max_concurrency,omitempty"`
+	manager.QueueRates
+}
+
+// QUEUE LIST
+//
+// Replies with every known queue, sorted by name.  Latency is how
+// many seconds the oldest job has been waiting.
+func queueList(c *Connection, s *Server, cmd string) {
+	if cmd != "QUEUE LIST" {
+		c.Error(cmd, fmt.Errorf("Invalid QUEUE, expected QUEUE LIST"))
+		return
+	}
+
+	queues := []storage.Queue{}
+	s.store.EachQueue(func(q storage.Queue) {
+		queues = append(queues, q)
+	})
+	sort.Slice(queues, func(i, j int) bool { return queues[i].Name() < queues[j].Name() })
+
+	now := time.Now()
+	infos := make([]queueInfo, len(queues))
+	for idx, q := range queues {
+		latency, err := QueueLatency(q, now)
+		if err != nil {
+			c.Error(cmd, err)
+			return
+		}
+		infos[idx] = queueInfo{
+			Name:           q.Name(),
+			Size:           q.Size(),
+			Latency:        latency,
+			Paused:         q.IsPaused(),
+			Ordering:       q.Ordering(),
+			Throttle:       s.queueThrottle(q.Name()).String(),
+			Busy:           s.manager.QueueBusy(q.Name()),
+			QueueRates:     s.manager.QueueRates(q.Name()),
+			MaxConcurrency: s.queueMaxConcurrency(q.Name()),
+		}
+	}
+
+	res, err := json.Marshal(infos)
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	c.Result(res)
+}
+
+// QueueLatency is how many seconds the queue's oldest job has been
+// waiting at now, 0 if the queue is empty.
+func QueueLatency(q storage.Queue, now time.Time) (float64, error) {
+	data, err := q.Oldest()
+	if err != nil || data == nil {
+		return 0, err
+	}
+	var job struct {
+		EnqueuedAt string `json:"enqueued_at"`
+	}
+	err = json.Unmarshal(data, &job)
+	if err != nil {
+		return 0, err
+	}
+	enqueued, err := util.ParseTime(job.EnqueuedAt)
+	if err != nil {
+		return 0, nil
+	}
+	return now.Sub(enqueued).Seconds(), nil
+}
+
+// Look up every queue a QUEUE command names before changing any.
+func commandQueues(c *Connection, s *Server, cmd string, action string, names []string) ([]storage.Queue, bool) {
+	if len(names) == 0 {
+		c.Error(cmd, fmt.Errorf("Invalid QUEUE, expected QUEUE %s <queue>...", action))
+		return nil, false
+	}
+	queues := make([]storage.Queue, len(names))
+	for idx, name := range names {
+		q, err := s.store.GetQueue(name)
+		if err != nil {
+			c.Error(cmd, err)
+			return nil, false
+		}
+		queues[idx] = q
+	}
+	return queues, true
+}
+
+// DEADJOBS PRUNE BEFORE 2018-01-01T00:00:00Z
+//
+// Replies with the number of dead jobs deleted.
+func deadJobs(c *Connection, s *Server, cmd string) {
+	parts := strings.Fields(cmd)
+	if len(parts) != 4 || parts[1] != "PRUNE" || parts[2] != "BEFORE" {
+		c.Error(cmd, fmt.Errorf("Invalid DEADJOBS, expected DEADJOBS PRUNE BEFORE <timestamp>"))
+		return
+	}
+	before, err := time.Parse(time.RFC3339, parts[3])
+	if err != nil {
+		c.Error(cmd, fmt.Errorf("Invalid DEADJOBS timestamp: %v", err))
+		return
+	}
+
+	count, err := s.deadPruner.prune(before)
+	if count > 0 {
+		c.audit(s, "dead prune", map[string]interface{}{"before": parts[3], "jobs": count})
+	}
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	c.Number(int(count))
+}
+
+// MUTATE {"cmd":"kill","target":"retries","filter":{"jobtype":"Sync","path":"0","value":1234}}
+//
+// Replies with the number of jobs changed.
+func mutate(c *Connection, s *Server, cmd string) {
+	parts := strings.SplitN(cmd, " ", 2)
+	if len(parts) != 2 {
+		c.Error(cmd, fmt.Errorf("Invalid MUTATE, expected MUTATE {mutation}"))
+		return
+	}
+	var mut manager.Mutation
+	err := json.Unmarshal([]byte(parts[1]), &mut)
+	if err != nil {
+		c.Error(cmd, newTaggedError("MALFORMED", err))
+		return
+	}
+	count, err := s.manager.Mutate(&mut)
+	if count > 0 {
+		c.audit(s, "jobs "+mut.Cmd, map[string]interface{}{"target": mut.Target, "jobs": count})
+	}
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	c.Number(count)
+}
+
+// CLIENT LIST
+// CLIENT KILL WID|ADDR <value>
+func clients(c *Connection, s *Server, cmd string) {
+	parts := strings.Fields(cmd)
+	if len(parts) == 2 && parts[1] == "LIST" {
+		clientList(c, s, cmd)
+		return
+	}
+	if len(parts) == 4 && parts[1] == "KILL" {
+		switch parts[2] {
+		case "WID":
+			count, err := s.killWorker(c, parts[3])
+			if count > 0 {
+				c.audit(s, "client kill", map[string]interface{}{"target_wid": parts[3], "connections": count})
+			}
+			if err != nil {
+				c.Error(cmd, err)
+				return
+			}
+			c.Number(count)
+			return
+		case "ADDR":
+			count := s.killAddress(c, parts[3])
+			if count > 0 {
+				c.audit(s, "client kill", map[string]interface{}{"target_addr": parts[3], "connections": count})
+			}
+			c.Number(count)
+			return
+		}
+	}
+	c.Error(cmd, fmt.Errorf("Invalid CLIENT, expected CLIENT LIST or CLIENT KILL WID|ADDR <value>"))
+}
+
+func clientList(c *Connection, s *Server, cmd string) {
+	bytes, err := json.Marshal(s.conns.list())
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	c.Result(bytes)
+}
+
+// BATCH NEW {batch}
+// BATCH OPEN <bid>
+// BATCH COMMIT <bid>
+// BATCH STATUS <bid>
+func batch(c *Connection, s *Server, cmd string) {
+	parts := strings.SplitN(cmd, " ", 3)
+	if len(parts) != 3 {
+		c.Error(cmd, fmt.Errorf("Invalid BATCH, expected BATCH NEW|OPEN|COMMIT|STATUS <arg>"))
+		return
+	}
+
+	switch parts[1] {
+	case "NEW":
+		var b client.Batch
+		err := json.Unmarshal([]byte(parts[2]), &b)
+		if err != nil {
+			c.Error(cmd, newTaggedError("MALFORMED", err))
+			return
+		}
+		// the callbacks are stored with the batch until they're pushed
+		for _, callback := range []*client.Job{b.Success, b.Complete} {
+			if callback != nil && err == nil {
+				err = encryptArgs(callback)
+			}
+		}
+		if err != nil {
+			c.Error(cmd, err)
+			return
+		}
+		err = s.manager.NewBatch(&b)
+		if err != nil {
+			c.Error(cmd, err)
+			return
+		}
+		c.Simple(b.Bid)
+	case "OPEN", "COMMIT":
+		var err error
+		if parts[1] == "OPEN" {
+			err = s.manager.OpenBatch(parts[2])
+		} else {
+			err = s.manager.CommitBatch(parts[2])
+		}
+		if err != nil {
+			c.Error(cmd, err)
+			return
+		}
+		c.Ok()
+	case "STATUS":
+		status, err := s.manager.BatchStatus(parts[2])
+		if err != nil {
+			c.Error(cmd, err)
+			return
+		}
+		if status == nil {
+			c.Error(cmd, fmt.Errorf("No such batch %s", parts[2]))
+			return
+		}
+		res, err := json.Marshal(status)
+		if err != nil {
+			c.Error(cmd, err)
+			return
+		}
+		c.Result(res)
+	default:
+		c.Error(cmd, fmt.Errorf("Invalid BATCH, unknown action %s", parts[1]))
+	}
+}
+
+// TRACK SET {"jid":"123456789","percent":40,"desc":"Resizing images"}
+// TRACK GET <jid>
+func track(c *Connection, s *Server, cmd string) {
+	parts := strings.SplitN(cmd, " ", 3)
+	if len(parts) != 3 {
+		c.Error(cmd, fmt.Errorf("Invalid TRACK, expected TRACK SET|GET <arg>"))
+		return
+	}
+
+	switch parts[1] {
+	case "SET":
+		var progress manager.Progress
+		err := json.Unmarshal([]byte(parts[2]), &progress)
+		if err != nil {
+			c.Error(cmd, newTaggedError("MALFORMED", err))
+			return
+		}
+		err = s.manager.SetProgress(&progress)
+		if err != nil {
+			c.Error(cmd, err)
+			return
+		}
+		c.Ok()
+	case "GET":
+		results, err := s.manager.GetProgress(parts[2])
+		if err != nil {
+			c.Error(cmd, err)
+			return
+		}
+		progress, ok := results[parts[2]]
+		if !ok {
+			c.Result(nil)
+			return
+		}
+		res, err := json.Marshal(progress)
+		if err != nil {
+			c.Error(cmd, err)
+			return
+		}
+		c.Result(res)
+	default:
+		c.Error(cmd, fmt.Errorf("Invalid TRACK, unknown action %s", parts[1]))
+	}
+}
+
+// BACKUP
+//
+// Replies with a snapshot of the queues, the scheduled, retry and
+// dead jobs and the counters, see storage.Snapshot.
+func backup(c *Connection, s *Server, cmd string) {
+	snap, err := storage.TakeSnapshot(s.store)
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	res, err := encodeResult(c, data)
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	c.audit(s, "backup", map[string]interface{}{"queues": len(snap.Queues)})
+	c.Result(res)
+}
+
+// RESTORE {snapshot}
+// RESTORE gzip <base64 encoded, gzipped snapshot>
+//
+// Adds a snapshot taken by BACKUP to the store, which should be empty.
+// A snapshot holds every job so it's decoded as it's unzipped rather
+// than unzipped whole, and isn't held to util.MaxGunzipSize.
+func restore(c *Connection, s *Server, cmd string) {
+	if len(cmd) < 9 {
+		c.Error(cmd, fmt.Errorf("Invalid RESTORE, expected RESTORE <snapshot>"))
+		return
+	}
+	var in io.Reader = strings.NewReader(cmd[8:])
+	if strings.HasPrefix(cmd[8:], "gzip ") {
+		zr, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, strings.NewReader(cmd[13:])))
+		if err != nil {
+			c.Error(cmd, newTaggedError("MALFORMED", err))
+			return
+		}
+		defer zr.Close()
+		in = zr
+	}
+	var snap storage.Snapshot
+	err := json.NewDecoder(in).Decode(&snap)
+	if err != nil {
+		c.Error(cmd, newTaggedError("MALFORMED", err))
+		return
+	}
+
+	err = snap.Restore(s.store)
+	if err != nil {
+		c.Error(cmd, err)
+		return
+	}
+	c.audit(s, "restore", map[string]interface{}{"queues": len(snap.Queues), "created_at": snap.CreatedAt})
+	c.Ok()
 }
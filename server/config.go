@@ -1,15 +1,266 @@
 package server
 
-import "github.com/contribsys/faktory/util"
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"reflect"
+	"strings"
+	"time"
 
+	"github.com/contribsys/faktory/manager"
+	"github.com/contribsys/faktory/util"
+)
+
+// The toml tag names the key within the [faktory] table of the
+// config file, see the config package.
 type ServerOptions struct {
-	Binding          string
-	StorageDirectory string
-	RedisSock        string
-	ConfigDirectory  string
-	Environment      string
-	Password         string
-	GlobalConfig     map[string]interface{}
+	Binding          string                 `toml:"binding"`
+	Bindings         []string               `toml:"bindings"`
+	StorageDirectory string                 `toml:"storage_directory"`
+	RedisSock        string                 `toml:"redis_sock"`
+	ConfigDirectory  string                 `toml:"config_directory"`
+	ConfigFile       string                 `toml:"-"`
+	Environment      string                 `toml:"environment"`
+	Password         string                 `toml:"password"`
+	GlobalConfig     map[string]interface{} `toml:"-"`
+
+	// Open the store with this storage.Driver, registered by a package
+	// the binary imports, rather than Redis.  It's given StorageURL,
+	// e.g. "postgres://..." for the postgres driver, or else the
+	// StorageDirectory, and the Redis options don't apply.
+	StorageDriver string `toml:"storage_driver"`
+	StorageURL    string `toml:"storage_url"`
+
+	// Connect to this Redis, e.g. a managed Redis at
+	// redis://:password@host:6379/0, rather than booting one in the
+	// StorageDirectory.  See storage.OpenRedisURL.
+	RedisURL string `toml:"redis_url"`
+	// Ask these Redis Sentinels, "host:port", for the master named by
+	// RedisURL's host, e.g. redis://:password@mymaster/0, so the
+	// server follows a failover.  See storage.RedisOptions.
+	RedisSentinels []string `toml:"redis_sentinels"`
+	// Use the Redis Cluster with these nodes, "host:port", taking the
+	// password and TLS from RedisURL if it's set.
+	RedisCluster []string `toml:"redis_cluster"`
+	// Check a rediss:// RedisURL's certificate against the CAs in
+	// this PEM file rather than the system's, and present this PEM
+	// certificate and key if Redis requires client certificates.
+	RedisTLSCAFile   string `toml:"redis_tls_ca_file"`
+	RedisTLSCertFile string `toml:"redis_tls_cert_file"`
+	RedisTLSKeyFile  string `toml:"redis_tls_key_file"`
+	// Authenticate to the RedisURL or RedisCluster as this Redis 6 ACL
+	// user, or with this password, rather than with any in RedisURL.
+	// These have nothing to do with clients' Password.
+	RedisUsername string `toml:"redis_username"`
+	RedisPassword string `toml:"redis_password"`
+	// Prefix every key, e.g. "staging:", to share the RedisURL or
+	// RedisCluster's database with other Faktory instances or apps.
+	// The bundled Redis is Faktory's own and doesn't need one.
+	RedisKeyPrefix string `toml:"redis_key_prefix"`
+
+	// Passwords lists more passwords which clients may use
+	// alongside Password, so the password can be rotated one
+	// worker at a time: add the new password here, move workers
+	// over, then make it the Password.  The Web UI only accepts
+	// Password.
+	Passwords []string `toml:"passwords"`
+
+	// Read Password from this file, e.g. a mounted Kubernetes
+	// secret, or from the output of this shell command, rather
+	// than passing it where it's visible in ps.  Either is read
+	// again on every reload.
+	PasswordFile    string `toml:"password_file"`
+	PasswordCommand string `toml:"password_command"`
+
+	// Passwords which only producers, connections without a wid, or
+	// only consumers may use.  Producers can only push jobs so a
+	// leaked producer password can't be used to drain the queues.
+	// Consumers can push, fetch, ACK, FAIL and BEAT.  Neither can
+	// send admin commands.
+	ProducerPassword string `toml:"producer_password"`
+	ConsumerPassword string `toml:"consumer_password"`
+
+	// How long a worker has to disconnect after being told to
+	// terminate before the server forcibly closes its connections
+	// and fails its jobs.  Defaults to 60 seconds.
+	HardKillTimeout time.Duration `toml:"hard_kill_timeout"`
+
+	// Compress the args of any pushed job whose JSON is at least
+	// this many bytes.  0 disables compression.
+	MinCompressBytes int `toml:"min_compress_bytes"`
+	// How to compress them, "gzip" by default or an encoding added
+	// with client.RegisterArgsEncoding.
+	CompressEncoding string `toml:"compress_encoding"`
+
+	// Reject any HELLO which does not echo the nonce sent in the HI.
+	// Clients older than protocol v3 do not send a nonce so leave
+	// this off if they still need to connect.
+	RequireNonce bool `toml:"require_nonce"`
+
+	// The fraction of successful FETCHes to log at debug level
+	// with the worker and queue latency, 0.0 is off and 1.0 logs
+	// every FETCH.
+	FetchLogSampleRate float64 `toml:"fetch_log_sample_rate"`
+
+	// Reject jobs whose then/then_on_fail successors nest deeper
+	// than this.  Defaults to 10.
+	MaxChainDepth int `toml:"max_chain_depth"`
+
+	// Also listen here for admin commands such as QUEUE, which the
+	// regular Binding will then reject.  Connections to this binding
+	// don't need the password so it should only be reachable from
+	// trusted hosts, e.g. "127.0.0.1:7418".  Disabled by default.
+	AdminBinding string `toml:"admin_binding"`
+
+	// Also accept regular connections on this Unix socket so
+	// co-located workers can skip TCP.  Access can be limited with
+	// the socket's file permissions.  Binding itself may also be a
+	// socket, e.g. "unix:///var/run/faktory.sock".
+	UnixSocket string `toml:"unix_socket"`
+
+	// Expect each connection to Binding to start with a PROXY
+	// protocol v1 or v2 header, as sent by HAProxy or an AWS NLB, so
+	// the real client address is logged and shown on the Busy page.
+	// Connections without the header are closed.
+	ProxyProtocol bool `toml:"proxy_protocol"`
+
+	// Serve the Faktory protocol at Binding over TLS with this PEM
+	// certificate and key.  Both files are read again on SIGHUP so
+	// the certificate can be renewed without a restart.
+	TLSCertFile string `toml:"tls_cert_file"`
+	TLSKeyFile  string `toml:"tls_key_file"`
+
+	// Require TLS clients to present a certificate signed by one of
+	// the CAs in this PEM file.  The certificate's common name becomes
+	// the ClientData Identity, so a fleet with its own certificates
+	// can do without a shared password.
+	TLSClientCAFile string `toml:"tls_client_ca_file"`
+
+	// Close any connection to Binding, Bindings or UnixSocket beyond
+	// this many with a MAXCONN error so a runaway worker pool can't
+	// exhaust the server's file descriptors.  The AdminBinding is
+	// exempt.  0, the default, is unlimited.
+	MaxConnections int `toml:"max_connections"`
+
+	// Limit each remote IP to opening ConnectionRate connections per
+	// second after an initial burst of ConnectionBurst, default 20, so
+	// a client stuck in a reconnect loop can't tie up the server
+	// handshaking.  Extra connections receive a THROTTLED error.  The
+	// AdminBinding is exempt.  A rate of 0, the default, disables
+	// throttling.
+	ConnectionRate  float64 `toml:"connection_rate"`
+	ConnectionBurst int     `toml:"connection_burst"`
+
+	// Close producer connections which send no command for this long.
+	// Consumer connections, those with a wid, are exempt.  0, the
+	// default, never closes idle connections.
+	IdleTimeout time.Duration `toml:"idle_timeout"`
+
+	// How FETCH chooses between its queues: "strict" left to right,
+	// "round_robin" starting with the next queue on each FETCH, or
+	// "weighted" at random in proportion to weights such as
+	// "critical:5".  By default FETCH is weighted if it has weights
+	// and strict otherwise.  Workers may pick their own in HELLO.
+	FetchOrder string `toml:"fetch_order"`
+
+	// How long a push to a queue at its [queue_limits] size waits
+	// for room before failing with QUEUEFULL.  0, the default,
+	// fails immediately.
+	QueueFullWait time.Duration `toml:"queue_full_wait"`
+
+	// Reply OK to pushes of a unique job whose duplicate is still
+	// pending, dropping the job, rather than failing with NOTUNIQUE.
+	DropDuplicates bool `toml:"drop_duplicates"`
+
+	// A random delay added to each retry so jobs which failed
+	// together don't all retry at once, a duration such as "30s"
+	// or a percentage of the backoff such as "20%".
+	RetryJitter string `toml:"retry_jitter"`
+
+	// Log commands which take longer than this, e.g. "500ms", and
+	// keep the last few for SLOWLOG.  0, the default, disables it.
+	SlowCommandThreshold time.Duration `toml:"slow_command_threshold"`
+
+	// Dead jobs which failed more than this many days ago are pruned
+	// once a day.  Defaults to 90.
+	DeadJobRetentionDays int `toml:"dead_job_retention_days"`
+
+	// The most jobs the dead set may hold, 0, the default, for no
+	// limit.  Once it's full DeadOverflow decides what happens:
+	// "drop_oldest", the default, deletes the oldest dead jobs every
+	// DeadTrimInterval (default 1m) so the set may briefly grow past
+	// the limit, "refuse" discards further jobs which die, logging
+	// each one, and never deletes those already dead.
+	DeadMaxJobs      uint64        `toml:"dead_max_jobs"`
+	DeadOverflow     string        `toml:"dead_overflow"`
+	DeadTrimInterval time.Duration `toml:"dead_trim_interval"`
+
+	// How often the server's tasks run: moving due scheduled jobs and
+	// retries to their queues, default 5s, purging expired dead jobs,
+	// default 1m, reaping expired reservations and workers which
+	// stopped heartbeating, default 15s, and hard killing workers,
+	// default 5s.  Shorter intervals mean less latency for more CPU,
+	// none may be shorter than 100ms.
+	ScheduledScanInterval   time.Duration `toml:"scheduled_scan_interval"`
+	RetryScanInterval       time.Duration `toml:"retry_scan_interval"`
+	DeadScanInterval        time.Duration `toml:"dead_scan_interval"`
+	ReservationReapInterval time.Duration `toml:"reservation_reap_interval"`
+	HeartbeatReapInterval   time.Duration `toml:"heartbeat_reap_interval"`
+	HardKillInterval        time.Duration `toml:"hard_kill_interval"`
+}
+
+// Set Password from PasswordFile or PasswordCommand, if either is set.
+func (so *ServerOptions) loadPassword() error {
+	var data []byte
+	var err error
+	if so.PasswordFile != "" {
+		data, err = ioutil.ReadFile(so.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("Unable to read password_file: %v", err)
+		}
+	} else if so.PasswordCommand != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), passwordCommandTimeout)
+		defer cancel()
+		data, err = exec.CommandContext(ctx, "/bin/sh", "-c", so.PasswordCommand).Output()
+		if err != nil {
+			return fmt.Errorf("Unable to run password_command: %v", err)
+		}
+	} else {
+		return nil
+	}
+
+	password := strings.TrimSpace(string(data))
+	if password == "" {
+		return fmt.Errorf("Empty password from password_file or password_command")
+	}
+	so.Password = password
+	return nil
+}
+
+var passwordCommandTimeout = 10 * time.Second
+
+// Every password a client may authenticate with.
+func (so *ServerOptions) passwords() []string {
+	all := []string{}
+	if so.Password != "" {
+		all = append(all, so.Password)
+	}
+	for _, password := range so.Passwords {
+		if password != "" {
+			all = append(all, password)
+		}
+	}
+	return all
+}
+
+// The path or URL StorageDriver opens.
+func (so *ServerOptions) StoragePath() string {
+	if so.StorageURL != "" {
+		return so.StorageURL
+	}
+	return so.StorageDirectory
 }
 
 func (so *ServerOptions) String(subsys string, key string, defval string) string {
@@ -40,3 +291,121 @@ func (so *ServerOptions) Config(subsys string, key string, defval interface{}) i
 	}
 	return val
 }
+
+// Options which Server.ReloadOptions can change while the server is
+// running.  Any other change requires a restart.
+var reloadableOptions = map[string]bool{
+	"Password":           true,
+	"Passwords":          true,
+	"PasswordFile":       true,
+	"PasswordCommand":    true,
+	"ProducerPassword":   true,
+	"ConsumerPassword":   true,
+	"HardKillTimeout":    true,
+	"MinCompressBytes":   true,
+	"CompressEncoding":   true,
+	"RequireNonce":       true,
+	"FetchLogSampleRate": true,
+	"MaxConnections":     true,
+	"IdleTimeout":        true,
+	"ConnectionRate":     true,
+	"ConnectionBurst":    true,
+	"FetchOrder":         true,
+	"QueueFullWait":      true,
+	"DropDuplicates":     true,
+	"RetryJitter":        true,
+
+	"SlowCommandThreshold": true,
+	"DeadJobRetentionDays": true,
+	"DeadMaxJobs":          true,
+	"DeadOverflow":         true,
+}
+
+func (so *ServerOptions) setDefaults() {
+	if so.Binding == "" {
+		so.Binding = "localhost:7419"
+	}
+	if so.HardKillTimeout == 0 {
+		so.HardKillTimeout = 60 * time.Second
+	}
+	if so.MaxChainDepth == 0 {
+		so.MaxChainDepth = manager.DefaultMaxChainDepth
+	}
+	if so.CompressEncoding == "" {
+		so.CompressEncoding = "gzip"
+	}
+	if so.ConnectionBurst == 0 {
+		so.ConnectionBurst = 20
+	}
+	if so.DeadJobRetentionDays == 0 {
+		so.DeadJobRetentionDays = 90
+	}
+	if so.DeadOverflow == "" {
+		so.DeadOverflow = manager.DeadDropOldest
+	}
+	if so.DeadTrimInterval == 0 {
+		so.DeadTrimInterval = time.Minute
+	}
+	if so.ScheduledScanInterval == 0 {
+		so.ScheduledScanInterval = 5 * time.Second
+	}
+	if so.RetryScanInterval == 0 {
+		so.RetryScanInterval = 5 * time.Second
+	}
+	if so.DeadScanInterval == 0 {
+		so.DeadScanInterval = time.Minute
+	}
+	if so.ReservationReapInterval == 0 {
+		so.ReservationReapInterval = 15 * time.Second
+	}
+	if so.HeartbeatReapInterval == 0 {
+		so.HeartbeatReapInterval = 15 * time.Second
+	}
+	if so.HardKillInterval == 0 {
+		so.HardKillInterval = 5 * time.Second
+	}
+}
+
+const minTaskInterval = 100 * time.Millisecond
+
+func (so *ServerOptions) checkTaskIntervals() error {
+	intervals := []struct {
+		key   string
+		every time.Duration
+	}{
+		{"dead_trim_interval", so.DeadTrimInterval},
+		{"scheduled_scan_interval", so.ScheduledScanInterval},
+		{"retry_scan_interval", so.RetryScanInterval},
+		{"dead_scan_interval", so.DeadScanInterval},
+		{"reservation_reap_interval", so.ReservationReapInterval},
+		{"heartbeat_reap_interval", so.HeartbeatReapInterval},
+		{"hard_kill_interval", so.HardKillInterval},
+	}
+	for _, interval := range intervals {
+		if interval.every < minTaskInterval {
+			return fmt.Errorf("Invalid %s %v, must be at least %v", interval.key, interval.every, minTaskInterval)
+		}
+	}
+	return nil
+}
+
+// Diff returns the names of the options which differ between so and
+// other.  GlobalConfig and other options without a toml key are not
+// compared.
+func (so *ServerOptions) Diff(other *ServerOptions) []string {
+	a := reflect.ValueOf(so).Elem()
+	b := reflect.ValueOf(other).Elem()
+	rt := a.Type()
+
+	changed := []string{}
+	for i := 0; i < rt.NumField(); i++ {
+		key := rt.Field(i).Tag.Get("toml")
+		if key == "" || key == "-" {
+			continue
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			changed = append(changed, rt.Field(i).Name)
+		}
+	}
+	return changed
+}
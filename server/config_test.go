@@ -0,0 +1,187 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptionsDiff(t *testing.T) {
+	a := &ServerOptions{Binding: "localhost:7419", Password: "foo", HardKillTimeout: time.Minute}
+	b := *a
+	assert.Empty(t, a.Diff(&b))
+
+	b.Password = "bar"
+	b.Binding = ":7419"
+	b.ConfigFile = "/etc/faktory/faktory.toml"
+	b.GlobalConfig = map[string]interface{}{"web": nil}
+	assert.Equal(t, []string{"Binding", "Password"}, a.Diff(&b))
+}
+
+func TestReloadOptions(t *testing.T) {
+	s, err := NewServer(&ServerOptions{StorageDirectory: "/tmp/reload", Password: "foo"})
+	assert.NoError(t, err)
+	assert.Equal(t, 60*time.Second, s.Options.HardKillTimeout)
+
+	global := map[string]interface{}{"web": map[string]interface{}{"binding": ":7420"}}
+	applied := s.ReloadOptions(&ServerOptions{
+		Binding:          ":7000",
+		StorageDirectory: "/tmp/elsewhere",
+		Password:         "bar",
+		GlobalConfig:     global,
+	})
+	assert.Equal(t, []string{"Password"}, applied)
+	opts := s.CurrentOptions()
+	assert.Equal(t, "bar", opts.Password)
+	assert.Equal(t, "localhost:7419", opts.Binding)
+	assert.Equal(t, "/tmp/reload", opts.StorageDirectory)
+	// omitted options fall back to their defaults, not zero
+	assert.Equal(t, 60*time.Second, opts.HardKillTimeout)
+	assert.Equal(t, ":7420", opts.String("web", "binding", ""))
+	// the reload published a copy, the options it booted with
+	// are untouched
+	assert.Equal(t, "foo", s.Options.Password)
+	assert.Nil(t, s.Options.GlobalConfig)
+}
+
+func TestPasswordFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "faktory-password")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := dir + "/password"
+	err = ioutil.WriteFile(path, []byte("s3cret\n"), 0600)
+	assert.NoError(t, err)
+
+	s, err := NewServer(&ServerOptions{StorageDirectory: "/tmp/reload", PasswordFile: path})
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cret", s.Options.Password)
+
+	// the file is read again on reload, even if the options are the same
+	err = ioutil.WriteFile(path, []byte("r0tated"), 0600)
+	assert.NoError(t, err)
+	s.ReloadOptions(&ServerOptions{PasswordFile: path})
+	assert.Equal(t, "r0tated", s.CurrentOptions().Password)
+
+	// a broken secret keeps the current password
+	os.Remove(path)
+	s.ReloadOptions(&ServerOptions{PasswordFile: path})
+	assert.Equal(t, "r0tated", s.CurrentOptions().Password)
+
+	_, err = NewServer(&ServerOptions{StorageDirectory: "/tmp/reload", PasswordFile: path})
+	assert.Error(t, err)
+
+	s, err = NewServer(&ServerOptions{StorageDirectory: "/tmp/reload", PasswordCommand: "echo from-vault"})
+	assert.NoError(t, err)
+	assert.Equal(t, "from-vault", s.Options.Password)
+
+	_, err = NewServer(&ServerOptions{StorageDirectory: "/tmp/reload", PasswordCommand: "exit 1"})
+	assert.Error(t, err)
+	_, err = NewServer(&ServerOptions{StorageDirectory: "/tmp/reload", PasswordCommand: "true"})
+	assert.Error(t, err)
+}
+
+func TestDeadOverflow(t *testing.T) {
+	_, err := NewServer(&ServerOptions{StorageDirectory: "/tmp/dead", DeadOverflow: "block"})
+	assert.Error(t, err)
+
+	s, err := NewServer(&ServerOptions{StorageDirectory: "/tmp/dead", DeadMaxJobs: 1000})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, s.Options.DeadTrimInterval)
+	max, overflow := s.deadLimit()
+	assert.EqualValues(t, 1000, max)
+	assert.Equal(t, "drop_oldest", overflow)
+
+	applied := s.ReloadOptions(&ServerOptions{DeadMaxJobs: 50, DeadOverflow: "refuse"})
+	assert.Equal(t, []string{"DeadMaxJobs", "DeadOverflow"}, applied)
+	max, overflow = s.deadLimit()
+	assert.EqualValues(t, 50, max)
+	assert.Equal(t, "refuse", overflow)
+
+	applied = s.ReloadOptions(&ServerOptions{DeadMaxJobs: 50, DeadOverflow: "block"})
+	assert.Empty(t, applied)
+	assert.Equal(t, "refuse", s.CurrentOptions().DeadOverflow)
+}
+
+func TestCompressEncoding(t *testing.T) {
+	_, err := NewServer(&ServerOptions{StorageDirectory: "/tmp/compress", CompressEncoding: "zstd"})
+	assert.Error(t, err)
+
+	s, err := NewServer(&ServerOptions{StorageDirectory: "/tmp/compress", MinCompressBytes: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, "gzip", s.Options.CompressEncoding)
+
+	job := client.NewJob("Render", strings.Repeat("<p>Hi</p>", 10))
+	assert.NoError(t, s.encodeArgs(job, 10))
+	assert.Equal(t, "gzip", job.ArgsEncoding)
+	job = client.NewJob("Render", strings.Repeat("<p>Hi</p>", 10))
+	assert.NoError(t, s.encodeArgs(job, 9))
+	assert.Equal(t, "", job.ArgsEncoding)
+
+	s.ReloadOptions(&ServerOptions{MinCompressBytes: 10, CompressEncoding: "zstd"})
+	assert.Equal(t, "gzip", s.CurrentOptions().CompressEncoding)
+}
+
+func TestRedisSentinels(t *testing.T) {
+	_, err := NewServer(&ServerOptions{StorageDirectory: "/tmp/sentinel", RedisSentinels: []string{"sentinel1:26379"}})
+	assert.Error(t, err)
+
+	s, err := NewServer(&ServerOptions{StorageDirectory: "/tmp/sentinel", RedisURL: "redis://mymaster", RedisSentinels: []string{"localhost:1"}})
+	assert.NoError(t, err)
+	_, err = s.openStore()
+	assert.Error(t, err)
+
+	_, err = NewServer(&ServerOptions{StorageDirectory: "/tmp/sentinel", RedisURL: "redis://mymaster", RedisSentinels: []string{"localhost:1"}, RedisCluster: []string{"localhost:2"}})
+	assert.Error(t, err)
+}
+
+func TestRedisKeyPrefix(t *testing.T) {
+	_, err := NewServer(&ServerOptions{StorageDirectory: "/tmp/prefix", RedisKeyPrefix: "staging:"})
+	assert.Error(t, err)
+
+	s, err := NewServer(&ServerOptions{StorageDirectory: "/tmp/prefix", RedisURL: "redis://localhost:1", RedisKeyPrefix: "{staging}"})
+	assert.NoError(t, err)
+	_, err = s.openStore()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "key prefix")
+}
+
+func TestStorageDriver(t *testing.T) {
+	_, err := NewServer(&ServerOptions{StorageDirectory: "/tmp/driver", StorageDriver: "nosuch"})
+	assert.Error(t, err)
+
+	opened := ""
+	assert.NoError(t, storage.RegisterDriver("servertest", func(path string) (storage.Store, error) {
+		opened = path
+		return nil, fmt.Errorf("not implemented")
+	}))
+	s, err := NewServer(&ServerOptions{StorageDirectory: "/tmp/driver", StorageDriver: "servertest"})
+	assert.NoError(t, err)
+	_, err = s.openStore()
+	assert.Error(t, err)
+	assert.Equal(t, "/tmp/driver", opened)
+	s.Options.StorageURL = "servertest://db"
+	s.openStore()
+	assert.Equal(t, "servertest://db", opened)
+
+	_, err = NewServer(&ServerOptions{StorageDirectory: "/tmp/driver", StorageDriver: "servertest", RedisURL: "redis://localhost:1"})
+	assert.Error(t, err)
+}
+
+func TestTaskIntervals(t *testing.T) {
+	s, err := NewServer(&ServerOptions{StorageDirectory: "/tmp/intervals", ScheduledScanInterval: 250 * time.Millisecond})
+	assert.NoError(t, err)
+	assert.Equal(t, 250*time.Millisecond, s.Options.ScheduledScanInterval)
+	assert.Equal(t, 5*time.Second, s.Options.RetryScanInterval)
+	assert.Equal(t, time.Minute, s.Options.DeadScanInterval)
+	assert.Equal(t, 15*time.Second, s.Options.HeartbeatReapInterval)
+
+	_, err = NewServer(&ServerOptions{StorageDirectory: "/tmp/intervals", RetryScanInterval: time.Millisecond})
+	assert.EqualError(t, err, "Invalid retry_scan_interval 1ms, must be at least 100ms")
+}
@@ -2,9 +2,14 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"strconv"
+	"sync"
+	"time"
+
+	"github.com/contribsys/faktory/manager"
 )
 
 // Represents a connection to a faktory client.
@@ -17,48 +22,186 @@ type Connection struct {
 	client *ClientData
 	conn   io.WriteCloser
 	buf    *bufio.Reader
+	// replies are buffered while processLines serves the connection
+	// and flushed after each command, nil writes straight to conn
+	out *bufio.Writer
+	// holds a command too long for buf
+	line []byte
+
+	// accepted by the admin listener, see ServerOptions.AdminBinding
+	isAdmin bool
+	// the ACL user whose password the client sent, "" if unrestricted
+	aclUser string
+	// FETCHes so far, to rotate queues for FetchRoundRobin
+	fetches uint64
+	// the command being run spent its time waiting for a job to be
+	// pushed, see checkSlow
+	waited bool
+
+	// reported by CLIENT LIST
+	connectedAt   time.Time
+	mu            sync.Mutex
+	lastCommand   string
+	lastCommandAt time.Time
+	commands      uint64
+}
+
+// The read and write buffers of served connections are pooled so a
+// busy server isn't allocating and collecting a pair per connection.
+const connBufferSize = 4096
+
+// Don't hang on to the memory of an unusually long command.
+const maxKeptLine = 256 * 1024
+
+var (
+	readerPool = sync.Pool{New: func() interface{} {
+		return bufio.NewReaderSize(nil, connBufferSize)
+	}}
+	writerPool = sync.Pool{New: func() interface{} {
+		return bufio.NewWriterSize(nil, connBufferSize)
+	}}
+)
+
+func pooledReader(rdr io.Reader) *bufio.Reader {
+	buf := readerPool.Get().(*bufio.Reader)
+	buf.Reset(rdr)
+	return buf
+}
+
+func pooledWriter(wtr io.Writer) *bufio.Writer {
+	out := writerPool.Get().(*bufio.Writer)
+	out.Reset(wtr)
+	return out
+}
+
+// Return the connection's buffers to the pools once nothing more
+// will be read or written.
+func (c *Connection) release() {
+	if c.buf != nil {
+		c.buf.Reset(nil)
+		readerPool.Put(c.buf)
+		c.buf = nil
+	}
+	if c.out != nil {
+		c.out.Reset(nil)
+		writerPool.Put(c.out)
+		c.out = nil
+	}
+	c.line = nil
+}
+
+// The next command, without its line ending.  The slice is only valid
+// until the next call.
+func (c *Connection) readLine() ([]byte, error) {
+	if cap(c.line) > maxKeptLine {
+		c.line = nil
+	}
+	line, err := c.buf.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// longer than the buffer, e.g. a PUSH of a large job
+		c.line = append(c.line[:0], line...)
+		for err == bufio.ErrBufferFull {
+			line, err = c.buf.ReadSlice('\n')
+			c.line = append(c.line, line...)
+		}
+		line = c.line
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
+
+func (c *Connection) flush() error {
+	if c.out == nil || c.out.Buffered() == 0 {
+		return nil
+	}
+	return c.out.Flush()
+}
+
+func (c *Connection) writer() io.Writer {
+	if c.out != nil {
+		return c.out
+	}
+	return c.conn
+}
+
+// Write to the buffer directly when there is one, passing the data
+// through an io.Writer would make it escape to the heap.
+func (c *Connection) write(data []byte) error {
+	var err error
+	if c.out != nil {
+		_, err = c.out.Write(data)
+	} else {
+		_, err = c.conn.Write(data)
+	}
+	return err
+}
+
+func (c *Connection) writeString(str string) error {
+	var err error
+	if c.out != nil {
+		_, err = c.out.WriteString(str)
+	} else {
+		_, err = io.WriteString(c.conn, str)
+	}
+	return err
 }
 
+// Close doesn't flush, other goroutines close connections, e.g.
+// CLIENT KILL, while only processLines writes to them.
 func (c *Connection) Close() error {
 	return c.conn.Close()
 }
 
 func (c *Connection) Error(cmd string, err error) error {
+	switch err.(type) {
+	case *manager.QueueFullError:
+		err = newTaggedError("QUEUEFULL", err)
+	case *manager.NotUniqueError:
+		err = newTaggedError("NOTUNIQUE", err)
+	}
 	re, ok := err.(*taggedError)
 	if ok {
-		_, err = c.conn.Write([]byte(fmt.Sprintf("-%s\r\n", re.Error())))
+		_, err = fmt.Fprintf(c.writer(), "-%s\r\n", re.Error())
 	} else {
-		_, err = c.conn.Write([]byte(fmt.Sprintf("-ERR %s\r\n", err.Error())))
+		_, err = fmt.Fprintf(c.writer(), "-ERR %s\r\n", err.Error())
 	}
 	return err
 }
 
 func (c *Connection) Ok() error {
-	_, err := c.conn.Write([]byte("+OK\r\n"))
-	return err
+	return c.writeString("+OK\r\n")
+}
+
+// Simple writes a RESP Simple String, e.g. "+OK\r\n".
+func (c *Connection) Simple(msg string) error {
+	c.writeString("+")
+	c.writeString(msg)
+	return c.writeString("\r\n")
 }
 
 func (c *Connection) Number(val int) error {
-	_, err := c.conn.Write([]byte(":" + strconv.Itoa(val) + "\r\n"))
-	return err
+	c.writeString(":")
+	c.writeString(strconv.Itoa(val))
+	return c.writeString("\r\n")
 }
 
 func (c *Connection) Result(msg []byte) error {
 	if msg == nil {
-		_, err := c.conn.Write([]byte("$-1\r\n"))
-		return err
+		return c.writeString("$-1\r\n")
 	}
 
-	_, err := c.conn.Write([]byte("$" + strconv.Itoa(len(msg)) + "\r\n"))
+	c.writeString("$")
+	c.writeString(strconv.Itoa(len(msg)))
+	err := c.writeString("\r\n")
 	if err != nil {
 		return err
 	}
-	if msg != nil {
-		_, err = c.conn.Write(msg)
-		if err != nil {
-			return err
-		}
+	err = c.write(msg)
+	if err != nil {
+		return err
 	}
-	_, err = c.conn.Write([]byte("\r\n"))
-	return err
+	return c.writeString("\r\n")
 }
@@ -19,6 +19,9 @@ func TestConnectionBasics(t *testing.T) {
 	dc.Ok()
 	assert.Equal(t, "+OK\r\n", output(dc))
 
+	dc.Simple("2 abc,def")
+	assert.Equal(t, "+2 abc,def\r\n", output(dc))
+
 	dc.Number(123)
 	assert.Equal(t, ":123\r\n", output(dc))
 
@@ -77,3 +80,29 @@ func dummyClientData() *ClientData {
 		lastHeartbeat: time.Now(),
 	}
 }
+
+func TestConnectionBuffering(t *testing.T) {
+	dc := dummyConnection()
+	dc.out = pooledWriter(dc.conn)
+
+	// replies wait for the flush after each command
+	dc.Ok()
+	dc.Result([]byte("{}"))
+	assert.Equal(t, "", output(dc))
+	assert.NoError(t, dc.flush())
+	assert.Equal(t, "+OK\r\n$2\r\n{}\r\n", output(dc))
+
+	long := "PUSH " + strings.Repeat("x", 3*connBufferSize)
+	dc.buf = pooledReader(strings.NewReader("INFO\r\n" + long + "\r\nEND\n"))
+	for _, expected := range []string{"INFO", long, "END"} {
+		line, err := dc.readLine()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(line))
+	}
+	_, err := dc.readLine()
+	assert.Error(t, err)
+
+	dc.release()
+	assert.Nil(t, dc.buf)
+	assert.Nil(t, dc.out)
+}
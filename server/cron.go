@@ -0,0 +1,339 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/util"
+)
+
+/*
+ * The cron subsystem pushes a job on a schedule:
+ *
+ *	[[cron]]
+ *	schedule = "30 9 * * mon-fri"
+ *	  [cron.job]
+ *	  jobtype = "SendDigest"
+ *	  queue = "low"
+ *	  args = ["daily"]
+ *
+ * The job table takes the same fields as a PUSH and the job gets a new
+ * jid each time.  Schedules are checked every few seconds, in UTC.  A
+ * schedule which comes due while Faktory is down is skipped, not
+ * pushed late.
+ */
+type cronSubsystem struct {
+	mu      sync.Mutex
+	s       *Server
+	entries []*cronEntry
+	pushed  int64
+}
+
+type cronEntry struct {
+	spec     string
+	schedule *cronSchedule
+	// the job's JSON, unmarshalled afresh for each push
+	job  []byte
+	next time.Time
+}
+
+func (c *cronSubsystem) Name() string {
+	return "cron"
+}
+
+func (c *cronSubsystem) Start(s *Server) error {
+	err := c.Reload(s)
+	if err != nil {
+		return err
+	}
+	s.AddTask(5, c)
+	return nil
+}
+
+func (c *cronSubsystem) Reload(s *Server) error {
+	entries, err := parseCron(s.CurrentOptions().GlobalConfig["cron"], time.Now())
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.s = s
+	c.entries = entries
+	c.mu.Unlock()
+	if len(entries) > 0 {
+		util.Infof("Loaded %d cron jobs", len(entries))
+	}
+	return nil
+}
+
+func (c *cronSubsystem) Stop(s *Server) error {
+	return nil
+}
+
+// Push the jobs which are due.
+func (c *cronSubsystem) Execute() error {
+	now := time.Now()
+	due := [][]byte{}
+	c.mu.Lock()
+	s := c.s
+	for _, entry := range c.entries {
+		if now.Before(entry.next) {
+			continue
+		}
+		due = append(due, entry.job)
+		entry.next = entry.schedule.next(now)
+	}
+	c.mu.Unlock()
+
+	var failed error
+	for _, data := range due {
+		var job client.Job
+		err := json.Unmarshal(data, &job)
+		if err == nil {
+			job.Jid = util.RandomJid()
+			err = s.Push(&job, len(data))
+		}
+		if err != nil {
+			util.Warnf("Unable to push cron job %s: %v", job.Type, err)
+			failed = err
+			continue
+		}
+		atomic.AddInt64(&c.pushed, 1)
+	}
+	return failed
+}
+
+func (c *cronSubsystem) Stats() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]interface{}{
+		"jobs":   len(c.entries),
+		"pushed": atomic.LoadInt64(&c.pushed),
+	}
+}
+
+func parseCron(section interface{}, now time.Time) ([]*cronEntry, error) {
+	entries := []*cronEntry{}
+	if section == nil {
+		return entries, nil
+	}
+	tables, ok := section.([]map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid cron: must be an array of tables, use [[cron]]")
+	}
+
+	for idx, table := range tables {
+		spec, ok := table["schedule"].(string)
+		if !ok {
+			return nil, fmt.Errorf("Invalid cron %d: schedule must be a string such as \"*/5 * * * *\"", idx+1)
+		}
+		schedule, err := parseCronSchedule(spec)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cron %d: %v", idx+1, err)
+		}
+		values, ok := table["job"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Invalid cron %d: missing [cron.job] table", idx+1)
+		}
+		data, err := cronJob(values)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cron %d: %v", idx+1, err)
+		}
+		entries = append(entries, &cronEntry{
+			spec:     spec,
+			schedule: schedule,
+			job:      data,
+			next:     schedule.next(now),
+		})
+	}
+	return entries, nil
+}
+
+// Check the job table and return it as JSON.
+func cronJob(values map[string]interface{}) ([]byte, error) {
+	if _, ok := values["jid"]; ok {
+		return nil, fmt.Errorf("job cannot have a jid, it gets a new one each time")
+	}
+	if _, ok := values["args"]; !ok {
+		values["args"] = []interface{}{}
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	var job client.Job
+	err = json.Unmarshal(data, &job)
+	if err != nil {
+		return nil, fmt.Errorf("invalid job: %v", err)
+	}
+	if job.Type == "" {
+		return nil, fmt.Errorf("job must have a jobtype")
+	}
+	return data, nil
+}
+
+// A cronSchedule holds a bit per allowed value of each field.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// If either day field is "*" a day must match both, otherwise
+	// either, as in crontab(5).
+	anyDay bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// parseCronSchedule parses the five fields of a crontab schedule,
+// minute, hour, day of month, month and day of week, e.g.
+// "*/15 9-17 * * mon-fri", or a macro such as @daily.
+func parseCronSchedule(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 1 {
+		if expanded, ok := cronMacros[strings.ToLower(fields[0])]; ok {
+			fields = strings.Fields(expanded)
+		}
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid schedule %q, expected minute hour day month weekday", spec)
+	}
+
+	var sched cronSchedule
+	var err error
+	for idx, f := range []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&sched.minute, 0, 59},
+		{&sched.hour, 0, 23},
+		{&sched.dom, 1, 31},
+		{&sched.month, 1, 12},
+		{&sched.dow, 0, 7},
+	} {
+		*f.bits, err = parseCronField(fields[idx], f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid schedule %q, %v", spec, err)
+		}
+	}
+	// Sunday is 0 or 7
+	if sched.dow&(1<<7) != 0 {
+		sched.dow |= 1
+	}
+	sched.anyDay = strings.HasPrefix(fields[2], "*") || strings.HasPrefix(fields[4], "*")
+
+	if sched.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("Invalid schedule %q, it never runs", spec)
+	}
+	return &sched, nil
+}
+
+// A comma separated list of *, values and ranges, each with an
+// optional /step.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng := part
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rng = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+		}
+
+		var lo, hi int
+		var err error
+		switch {
+		case rng == "*":
+			lo, hi = min, max
+		case strings.Contains(rng, "-"):
+			bounds := strings.SplitN(rng, "-", 2)
+			lo, err = cronValue(bounds[0], min, max)
+			if err == nil {
+				hi, err = cronValue(bounds[1], min, max)
+			}
+			if err == nil && hi < lo {
+				err = fmt.Errorf("backwards range %q", rng)
+			}
+		default:
+			lo, err = cronValue(rng, min, max)
+			hi = lo
+			// 5/15 means 5-max/15
+			if step > 1 {
+				hi = max
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func cronValue(value string, min, max int) (int, error) {
+	v, ok := cronNames[strings.ToLower(value)]
+	if !ok {
+		var err error
+		v, err = strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("bad value %q", value)
+		}
+	}
+	if v < min || v > max {
+		return 0, fmt.Errorf("%d is out of range %d-%d", v, min, max)
+	}
+	return v, nil
+}
+
+func (sched *cronSchedule) matchesDay(t time.Time) bool {
+	dom := sched.dom&(1<<uint(t.Day())) != 0
+	dow := sched.dow&(1<<uint(t.Weekday())) != 0
+	if sched.anyDay {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// The first minute after t which matches, in UTC, or the zero
+// time if nothing matches within five years.
+func (sched *cronSchedule) next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case sched.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !sched.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case sched.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case sched.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCronSchedule(t *testing.T) {
+	at := func(value string) time.Time {
+		tm, err := time.Parse(time.RFC3339, value)
+		assert.NoError(t, err)
+		return tm
+	}
+	// a Wednesday
+	now := at("2018-01-31T10:07:30Z")
+
+	for spec, expected := range map[string]string{
+		"* * * * *":            "2018-01-31T10:08:00Z",
+		"*/5 * * * *":          "2018-01-31T10:10:00Z",
+		"5/15 * * * *":         "2018-01-31T10:20:00Z",
+		"0 9-17/4 * * *":       "2018-01-31T13:00:00Z",
+		"30 9 * * mon-fri":     "2018-02-01T09:30:00Z",
+		"0 0 * * sun":          "2018-02-04T00:00:00Z",
+		"0 0 * * 7":            "2018-02-04T00:00:00Z",
+		"0 0 29 * *":           "2018-03-29T00:00:00Z",
+		"0 0 1,15 * 1":         "2018-02-01T00:00:00Z",
+		"0 12 * feb *":         "2018-02-01T12:00:00Z",
+		"@hourly":              "2018-01-31T11:00:00Z",
+		"@daily":               "2018-02-01T00:00:00Z",
+		"@yearly":              "2019-01-01T00:00:00Z",
+		"  15  10,11  * *  * ": "2018-01-31T10:15:00Z",
+	} {
+		sched, err := parseCronSchedule(spec)
+		assert.NoError(t, err, spec)
+		if err == nil {
+			assert.Equal(t, at(expected), sched.next(now), spec)
+		}
+	}
+
+	for _, bad := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"one * * * *",
+		"@often",
+		"0 0 30 2 *",
+	} {
+		_, err := parseCronSchedule(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	now := time.Now()
+	entries, err := parseCron(aclConfig(t, `
+[[cron]]
+schedule = "*/5 * * * *"
+  [cron.job]
+  jobtype = "SendDigest"
+  queue = "low"
+  args = ["one", "two"]
+  [cron.job.custom]
+  team = "billing"
+
+[[cron]]
+schedule = "@daily"
+  [cron.job]
+  jobtype = "Cleanup"
+`)["cron"], now)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "*/5 * * * *", entries[0].spec)
+	assert.True(t, entries[0].next.After(now))
+
+	var job client.Job
+	assert.NoError(t, json.Unmarshal(entries[0].job, &job))
+	assert.Equal(t, "SendDigest", job.Type)
+	assert.Equal(t, "low", job.Queue)
+	assert.Equal(t, []interface{}{"one", "two"}, job.Args)
+	assert.Equal(t, "billing", job.Custom["team"])
+	assert.NoError(t, json.Unmarshal(entries[1].job, &job))
+	assert.Equal(t, []interface{}{}, job.Args)
+
+	entries, err = parseCron(nil, now)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	for _, bad := range []string{
+		"[cron]\nschedule = \"* * * * *\"",
+		"[[cron]]\nschedule = 5",
+		"[[cron]]\nschedule = \"whenever\"\n[cron.job]\njobtype = \"A\"",
+		"[[cron]]\nschedule = \"* * * * *\"",
+		"[[cron]]\nschedule = \"* * * * *\"\n[cron.job]\nqueue = \"low\"",
+		"[[cron]]\nschedule = \"* * * * *\"\n[cron.job]\njobtype = \"A\"\njid = \"abcdefghijkl\"",
+		"[[cron]]\nschedule = \"* * * * *\"\n[cron.job]\njobtype = \"A\"\nargs = \"none\"",
+	} {
+		_, err = parseCron(aclConfig(t, bad)["cron"], now)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestCron(t *testing.T) {
+	configure := func(opts *ServerOptions) {
+		opts.GlobalConfig = aclConfig(t, `
+[[cron]]
+schedule = "@yearly"
+  [cron.job]
+  jobtype = "Tick"
+  queue = "ticks"
+`)
+	}
+	runServerWith("localhost:7453", configure, func(s *Server) {
+		// the subsystems have started once the server accepts connections
+		conn, _ := handshake(t, "localhost:7453")
+		defer conn.Close()
+
+		var cron *cronSubsystem
+		for _, x := range s.Subsystems {
+			if c, ok := x.(*cronSubsystem); ok {
+				cron = c
+			}
+		}
+		assert.NotNil(t, cron)
+		assert.EqualValues(t, 1, cron.Stats()["jobs"])
+
+		// nothing is due until the new year
+		assert.NoError(t, cron.Execute())
+		q, err := s.Store().GetQueue("ticks")
+		assert.NoError(t, err)
+		assert.EqualValues(t, 0, q.Size())
+
+		for i := 0; i < 2; i++ {
+			cron.mu.Lock()
+			cron.entries[0].next = time.Now().Add(-time.Second)
+			cron.mu.Unlock()
+			assert.NoError(t, cron.Execute())
+		}
+		assert.EqualValues(t, 2, q.Size())
+		assert.EqualValues(t, 2, cron.Stats()["pushed"])
+		assert.True(t, cron.entries[0].next.After(time.Now()))
+
+		jids := map[string]bool{}
+		for i := 0; i < 2; i++ {
+			data, err := q.Pop()
+			assert.NoError(t, err)
+			var job client.Job
+			assert.NoError(t, json.Unmarshal(data, &job))
+			assert.Equal(t, "Tick", job.Type)
+			jids[job.Jid] = true
+		}
+		assert.Len(t, jids, 2)
+
+		// a broken config keeps the current jobs
+		s.Options.GlobalConfig = aclConfig(t, "[[cron]]\nschedule = \"never\"")
+		s.Reload()
+		assert.EqualValues(t, 1, cron.Stats()["jobs"])
+		s.Options.GlobalConfig = map[string]interface{}{}
+		s.Reload()
+		assert.EqualValues(t, 0, cron.Stats()["jobs"])
+	})
+}
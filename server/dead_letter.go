@@ -0,0 +1,300 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/util"
+)
+
+/*
+ * The dead_letter subsystem forwards each job which dies, i.e. is
+ * moved to the dead set, so it can be archived elsewhere:
+ *
+ *	[dead_letter]
+ *	webhook = "https://archive.example.com/faktory/dead"
+ *	queue = "archive"
+ *	jobtype = "ArchiveDeadJob"
+ *	url = "tcp://:password@archive.example.com:7419"
+ *
+ * webhook is sent a POST of the job's JSON, just the job so it can be
+ * archived as is, unlike the job.dead event of [webhooks] which is
+ * meant for alerts, see webhooks.go.  Both are sent by postJSON.
+ * queue is pushed a job of the given jobtype, "DeadJob" by default,
+ * whose only argument is the dead job, on this server or, given url,
+ * on another Faktory server.  Jobs are forwarded in the background in
+ * the order they died.  The POST and the push are each retried a few
+ * times when they fail and then logged, as are jobs which die faster
+ * than they can be forwarded.  Jobs of the forwarding jobtype are
+ * never forwarded themselves.
+ */
+type deadLetters struct {
+	mu     sync.Mutex
+	config *deadLetterConfig
+	jobs   chan *client.Job
+	done   chan struct{}
+
+	// held while pushing to the remote server, apart from mu so
+	// died never waits on the network
+	remoteMu sync.Mutex
+	remote   *client.Client
+}
+
+type deadLetterConfig struct {
+	webhook string
+	queue   string
+	jobtype string
+	url     string
+}
+
+var (
+	deadLetterBacklog  = 1000
+	deadLetterAttempts = 3
+	deadLetterDelay    = time.Second
+	// of each POST, here and in webhooks.go
+	postTimeout = 10 * time.Second
+)
+
+func (d *deadLetters) Name() string {
+	return "dead_letter"
+}
+
+func (d *deadLetters) Start(s *Server) error {
+	err := d.Reload(s)
+	if err != nil {
+		return err
+	}
+	jobs := make(chan *client.Job, deadLetterBacklog)
+	done := make(chan struct{})
+	d.mu.Lock()
+	d.jobs = jobs
+	d.done = done
+	d.mu.Unlock()
+	go d.run(s, jobs, done)
+	return nil
+}
+
+func (d *deadLetters) Reload(s *Server) error {
+	config, err := parseDeadLetter(s.CurrentOptions().GlobalConfig["dead_letter"])
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.config = config
+	d.mu.Unlock()
+	d.closeRemote()
+	if config != nil {
+		util.Infof("Forwarding dead jobs")
+	}
+	return nil
+}
+
+func (d *deadLetters) Stop(s *Server) error {
+	d.mu.Lock()
+	if d.done != nil {
+		close(d.done)
+		d.done = nil
+		d.jobs = nil
+	}
+	d.mu.Unlock()
+	d.closeRemote()
+	return nil
+}
+
+func (d *deadLetters) closeRemote() {
+	d.remoteMu.Lock()
+	defer d.remoteMu.Unlock()
+	if d.remote != nil {
+		d.remote.Close()
+		d.remote = nil
+	}
+}
+
+// Queue the job to be forwarded unless the backlog is full.
+func (d *deadLetters) died(job *client.Job) {
+	d.mu.Lock()
+	config := d.config
+	jobs := d.jobs
+	d.mu.Unlock()
+	if config == nil || jobs == nil || (config.queue != "" && job.Type == config.jobtype) {
+		return
+	}
+	select {
+	case jobs <- job:
+	default:
+		util.Warnw("Dead letter backlog is full, unable to forward job", map[string]interface{}{"jid": job.Jid, "queue": job.Queue})
+	}
+}
+
+// See manager.Options.OnDeath.
+func (s *Server) jobDied(job *client.Job) {
+	if s.deadLetters != nil {
+		s.deadLetters.died(job)
+	}
+	s.publish("job.dead", DecodedJob(job))
+}
+
+func (d *deadLetters) run(s *Server, jobs chan *client.Job, done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case job := <-jobs:
+			d.forward(s, job, done)
+		}
+	}
+}
+
+// Send the job to the webhook and push it to the queue, each retried
+// on its own so a failure of one doesn't repeat the other.
+func (d *deadLetters) forward(s *Server, job *client.Job, done chan struct{}) {
+	d.mu.Lock()
+	config := d.config
+	d.mu.Unlock()
+	if config == nil {
+		return
+	}
+
+	fields := map[string]interface{}{"jid": job.Jid, "queue": job.Queue}
+	data, err := json.Marshal(DecodedJob(job))
+	if err != nil {
+		fields["error"] = err
+		util.Warnw("Unable to forward dead job", fields)
+		return
+	}
+	if config.webhook != "" {
+		err = retrySend(done, deadLetterAttempts, deadLetterDelay, func() error {
+			return postJSON(config.webhook, data, nil)
+		})
+		if err != nil {
+			fields["error"] = err
+			util.Warnw("Unable to send dead job to the webhook", fields)
+		}
+	}
+	if config.queue != "" {
+		letter := client.NewJob(config.jobtype, json.RawMessage(data))
+		letter.Queue = config.queue
+		err = retrySend(done, deadLetterAttempts, deadLetterDelay, func() error {
+			return d.push(s, config, letter, len(data))
+		})
+		if err != nil {
+			fields["error"] = err
+			util.Warnw("Unable to push dead job to the dead letter queue", fields)
+		}
+	}
+}
+
+// Push the letter to this server or, given a url, another one.
+func (d *deadLetters) push(s *Server, config *deadLetterConfig, letter *client.Job, size int) error {
+	if config.url == "" {
+		return s.Push(letter, size)
+	}
+	d.remoteMu.Lock()
+	defer d.remoteMu.Unlock()
+	var err error
+	if d.remote == nil {
+		d.remote, err = client.NewClientFromURL(config.url, client.RetryConfig{})
+		if err != nil {
+			return err
+		}
+	}
+	err = d.remote.Push(letter)
+	if err != nil {
+		// reconnect next time
+		d.remote.Close()
+		d.remote = nil
+	}
+	return err
+}
+
+// Call send until it succeeds or has failed attempts times, waiting
+// a little longer after each failure.  Gives up, returning nil, if
+// done is closed first.
+func retrySend(done chan struct{}, attempts int, delay time.Duration, send func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := send()
+		if err == nil || attempt >= attempts {
+			return err
+		}
+		select {
+		case <-done:
+			return nil
+		case <-time.After(time.Duration(attempt) * delay):
+		}
+	}
+}
+
+// POST the JSON to target with the given extra headers, an error
+// unless it replies 2xx.
+func postJSON(target string, data []byte, header map[string]string) error {
+	req, err := http.NewRequest("POST", target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Faktory/"+client.Version)
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	cl := &http.Client{Timeout: postTimeout}
+	resp, err := cl.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s replied %s", target, resp.Status)
+	}
+	return nil
+}
+
+// Returns nil if the section is missing, i.e. nothing is forwarded.
+func parseDeadLetter(section interface{}) (*deadLetterConfig, error) {
+	if section == nil {
+		return nil, nil
+	}
+	values, ok := section.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid dead_letter: must be a table")
+	}
+
+	config := &deadLetterConfig{}
+	for key, val := range values {
+		str, ok := val.(string)
+		if !ok {
+			return nil, fmt.Errorf("Invalid dead_letter: %s must be a string", key)
+		}
+		switch key {
+		case "webhook":
+			u, err := url.Parse(str)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("Invalid dead_letter: webhook must be an http or https URL")
+			}
+			config.webhook = str
+		case "queue":
+			config.queue = str
+		case "jobtype":
+			config.jobtype = str
+		case "url":
+			config.url = str
+		default:
+			return nil, fmt.Errorf("Invalid dead_letter: %s is not a known setting", key)
+		}
+	}
+	if config.webhook == "" && config.queue == "" {
+		return nil, fmt.Errorf("Invalid dead_letter: needs a webhook or a queue")
+	}
+	if config.queue == "" && (config.jobtype != "" || config.url != "") {
+		return nil, fmt.Errorf("Invalid dead_letter: jobtype and url need a queue")
+	}
+	if config.jobtype == "" {
+		config.jobtype = "DeadJob"
+	}
+	return config, nil
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDeadLetter(t *testing.T) {
+	config, err := parseDeadLetter(aclConfig(t, `
+[dead_letter]
+webhook = "https://archive.example.com/dead"
+queue = "archive"
+`)["dead_letter"])
+	assert.NoError(t, err)
+	assert.Equal(t, &deadLetterConfig{webhook: "https://archive.example.com/dead", queue: "archive", jobtype: "DeadJob"}, config)
+
+	config, err = parseDeadLetter(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, config)
+
+	for _, bad := range []string{
+		"dead_letter = 1",
+		"[dead_letter]",
+		"[dead_letter]\nwebhook = 1",
+		"[dead_letter]\nwebhook = \"archive.example.com\"",
+		"[dead_letter]\nwebhook = \"ftp://archive.example.com\"",
+		"[dead_letter]\nwebhook = \"https://archive.example.com\"\njobtype = \"Archive\"",
+		"[dead_letter]\nurl = \"tcp://archive.example.com:7419\"",
+		"[dead_letter]\nqueue = \"archive\"\ntopic = \"dead\"",
+	} {
+		_, err = parseDeadLetter(aclConfig(t, bad)["dead_letter"])
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestDeadLetterWebhook(t *testing.T) {
+	oldDelay := deadLetterDelay
+	deadLetterDelay = time.Millisecond
+	defer func() { deadLetterDelay = oldDelay }()
+
+	posted := make(chan []byte, 10)
+	calls := 0
+	ws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		// the first attempt fails and is retried
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		data, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		posted <- data
+	}))
+	defer ws.Close()
+
+	s := &Server{Options: &ServerOptions{GlobalConfig: map[string]interface{}{
+		"dead_letter": map[string]interface{}{"webhook": ws.URL},
+	}}}
+	d := &deadLetters{}
+	s.deadLetters = d
+	assert.NoError(t, d.Start(s))
+	defer d.Stop(s)
+
+	job := client.NewJob("Invoice", 1234)
+	job.Failure = &client.Failure{ErrorType: "Timeout"}
+	s.jobDied(job)
+
+	select {
+	case data := <-posted:
+		var forwarded client.Job
+		assert.NoError(t, json.Unmarshal(data, &forwarded))
+		assert.Equal(t, job.Jid, forwarded.Jid)
+		assert.Equal(t, "Timeout", forwarded.Failure.ErrorType)
+	case <-time.After(5 * time.Second):
+		t.Fatal("dead job was not forwarded")
+	}
+	assert.Equal(t, 2, calls)
+}
+
+func TestDeadLetterPushFailure(t *testing.T) {
+	oldDelay := deadLetterDelay
+	deadLetterDelay = time.Millisecond
+	defer func() { deadLetterDelay = oldDelay }()
+
+	calls := 0
+	ws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer ws.Close()
+
+	// nothing listens on the url, so every push fails
+	d := &deadLetters{config: &deadLetterConfig{webhook: ws.URL, queue: "archive", jobtype: "DeadJob", url: "tcp://localhost:7467"}}
+	d.forward(&Server{}, client.NewJob("Invoice", 1234), make(chan struct{}))
+	assert.Equal(t, 1, calls)
+}
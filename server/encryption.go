@@ -0,0 +1,215 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/util"
+)
+
+/*
+ * The encryption subsystem encrypts the args of pushed jobs with
+ * AES-256-GCM so the copy in Redis doesn't hold them in the clear:
+ *
+ *	[encryption]
+ *	key_id = "2026-10"
+ *	  [encryption.keys]
+ *	  "2026-10" = "<base64 encoded 32 byte key>"
+ *	  "2026-04" = "<base64 encoded 32 byte key>"
+ *
+ * Jobs are encrypted with key_id's key and tagged with the key id, so
+ * to rotate keys add a new one, make it the key_id and keep the old
+ * one listed until the jobs encrypted with it are gone.  The server
+ * decrypts args for FETCH and the other commands which return jobs.
+ * Every job the server pushes is encrypted, including Then
+ * successors, batch callbacks, cron jobs and dead letters.  A fetched
+ * job which can't be decrypted, e.g. because its key was dropped, is
+ * sent to the dead set rather than handed to the worker.
+ */
+type encryption struct{}
+
+// The args encoding of encrypted jobs.
+const encryptedArgs = "aes256gcm"
+
+// Keys live in the codec since args encodings are registered
+// globally, see client.RegisterArgsEncoding.
+var encryptionCodec = &aesCodec{}
+
+func init() {
+	client.RegisterArgsEncoding(encryptedArgs, encryptionCodec)
+}
+
+func (e *encryption) Name() string {
+	return "encryption"
+}
+
+func (e *encryption) Start(s *Server) error {
+	return e.Reload(s)
+}
+
+func (e *encryption) Reload(s *Server) error {
+	current, keys, err := parseEncryption(s.CurrentOptions().GlobalConfig["encryption"])
+	if err != nil {
+		return err
+	}
+	encryptionCodec.setKeys(current, keys)
+	if current != "" {
+		util.Infof("Encrypting job args with key %s", current)
+	}
+	return nil
+}
+
+func (e *encryption) Stop(s *Server) error {
+	return nil
+}
+
+type aesCodec struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+func (c *aesCodec) setKeys(current string, keys map[string]cipher.AEAD) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current = current
+	c.keys = keys
+}
+
+func (c *aesCodec) enabled() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.current != ""
+}
+
+// The key id's length and the key id, then the nonce and the
+// sealed args, with the key id as additional data.
+func (c *aesCodec) Compress(raw []byte) ([]byte, error) {
+	c.mu.RLock()
+	id := c.current
+	aead := c.keys[id]
+	c.mu.RUnlock()
+	if aead == nil {
+		return nil, fmt.Errorf("No encryption key configured")
+	}
+
+	out := make([]byte, 0, 1+len(id)+aead.NonceSize()+len(raw)+aead.Overhead())
+	out = append(out, byte(len(id)))
+	out = append(out, id...)
+	nonce := make([]byte, aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, raw, []byte(id)), nil
+}
+
+func (c *aesCodec) Decompress(data []byte) ([]byte, error) {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return nil, fmt.Errorf("Encrypted args are truncated")
+	}
+	id := string(data[1 : 1+int(data[0])])
+	data = data[1+int(data[0]):]
+
+	c.mu.RLock()
+	aead := c.keys[id]
+	c.mu.RUnlock()
+	if aead == nil {
+		return nil, fmt.Errorf("Unknown encryption key %s", id)
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("Encrypted args are truncated")
+	}
+	nonce := data[:aead.NonceSize()]
+	return aead.Open(nil, nonce, data[aead.NonceSize():], []byte(id))
+}
+
+// Encrypt the args of the job and its successors, if encryption is
+// configured.
+func encryptArgs(job *client.Job) error {
+	if !encryptionCodec.enabled() {
+		return nil
+	}
+	if job.ArgsEncoding != encryptedArgs && !strings.HasSuffix(job.ArgsEncoding, "+"+encryptedArgs) {
+		err := job.EncodeArgs(encryptedArgs)
+		if err != nil {
+			return err
+		}
+	}
+	successors := append(append([]*client.Job{}, job.Then...), job.ThenOnFail...)
+	if job.OnSuccess != nil {
+		successors = append(successors, job.OnSuccess)
+	}
+	for _, next := range successors {
+		if next == nil {
+			continue
+		}
+		err := encryptArgs(next)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns "" and no keys if the section is missing, i.e. nothing is
+// encrypted.
+func parseEncryption(section interface{}) (string, map[string]cipher.AEAD, error) {
+	if section == nil {
+		return "", nil, nil
+	}
+	values, ok := section.(map[string]interface{})
+	if !ok {
+		return "", nil, fmt.Errorf("Invalid encryption: must be a table")
+	}
+
+	current, ok := values["key_id"].(string)
+	if !ok || current == "" {
+		return "", nil, fmt.Errorf("Invalid encryption: key_id must be a string")
+	}
+	table, ok := values["keys"].(map[string]interface{})
+	if !ok {
+		return "", nil, fmt.Errorf("Invalid encryption: keys must be a table of key ids and keys")
+	}
+	for key := range values {
+		if key != "key_id" && key != "keys" {
+			return "", nil, fmt.Errorf("Invalid encryption: %s is not a known setting", key)
+		}
+	}
+
+	keys := map[string]cipher.AEAD{}
+	for id, val := range table {
+		if len(id) > 255 {
+			return "", nil, fmt.Errorf("Invalid encryption: key id %s is too long", id)
+		}
+		str, ok := val.(string)
+		if !ok {
+			return "", nil, fmt.Errorf("Invalid encryption: key %s must be a base64 string", id)
+		}
+		secret, err := base64.StdEncoding.DecodeString(str)
+		if err != nil || len(secret) != 32 {
+			return "", nil, fmt.Errorf("Invalid encryption: key %s must be 32 bytes, base64 encoded", id)
+		}
+		block, err := aes.NewCipher(secret)
+		if err != nil {
+			return "", nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return "", nil, err
+		}
+		keys[id] = aead
+	}
+	if keys[current] == nil {
+		return "", nil, fmt.Errorf("Invalid encryption: key_id %s isn't one of the keys", current)
+	}
+	return current, keys, nil
+}
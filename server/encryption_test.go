@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEncryption(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+	current, keys, err := parseEncryption(aclConfig(t, `
+[encryption]
+key_id = "2026-10"
+  [encryption.keys]
+  "2026-10" = "`+key+`"
+  "2026-04" = "`+key+`"
+`)["encryption"])
+	assert.NoError(t, err)
+	assert.Equal(t, "2026-10", current)
+	assert.Equal(t, 2, len(keys))
+
+	current, keys, err = parseEncryption(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "", current)
+	assert.Nil(t, keys)
+
+	short := base64.StdEncoding.EncodeToString([]byte("short"))
+	for _, bad := range []string{
+		"encryption = 1",
+		"[encryption]\nkey_id = \"a\"",
+		"[encryption]\n[encryption.keys]\na = \"" + key + "\"",
+		"[encryption]\nkey_id = \"b\"\n[encryption.keys]\na = \"" + key + "\"",
+		"[encryption]\nkey_id = \"a\"\n[encryption.keys]\na = \"" + short + "\"",
+		"[encryption]\nkey_id = \"a\"\n[encryption.keys]\na = \"not base64\"",
+		"[encryption]\nkey_id = \"a\"\ncipher = \"des\"\n[encryption.keys]\na = \"" + key + "\"",
+	} {
+		_, _, err = parseEncryption(aclConfig(t, bad)["encryption"])
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestEncryptArgs(t *testing.T) {
+	defer encryptionCodec.setKeys("", nil)
+
+	oldKey := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("o", 32)))
+	newKey := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("n", 32)))
+	s := &Server{Options: &ServerOptions{MinCompressBytes: 100, CompressEncoding: "gzip", GlobalConfig: aclConfig(t, `
+[encryption]
+key_id = "old"
+  [encryption.keys]
+  old = "`+oldKey+`"
+`)}}
+	e := &encryption{}
+	assert.NoError(t, e.Start(s))
+
+	job := client.NewJob("Invoice", "4111111111111111")
+	job.Then = []*client.Job{client.NewJob("Receipt", "jane@example.com")}
+	assert.NoError(t, s.encodeArgs(job, 10))
+	assert.Equal(t, encryptedArgs, job.ArgsEncoding)
+	assert.NotContains(t, job.Args[0], "4111")
+	assert.Equal(t, encryptedArgs, job.Then[0].ArgsEncoding)
+
+	// already encrypted jobs aren't encrypted twice
+	sealed := job.Args[0]
+	assert.NoError(t, encryptArgs(job))
+	assert.Equal(t, sealed, job.Args[0])
+
+	big := client.NewJob("Report", strings.Repeat("x", 1000))
+	assert.NoError(t, s.encodeArgs(big, 1000))
+	assert.Equal(t, "gzip+"+encryptedArgs, big.ArgsEncoding)
+
+	// rotate, jobs encrypted with the old key can still be read
+	s.Options.GlobalConfig = aclConfig(t, `
+[encryption]
+key_id = "new"
+  [encryption.keys]
+  old = "`+oldKey+`"
+  new = "`+newKey+`"
+`)
+	assert.NoError(t, e.Reload(s))
+	fresh := client.NewJob("Invoice", "4111111111111111")
+	assert.NoError(t, s.encodeArgs(fresh, 10))
+	assert.NotEqual(t, sealed, fresh.Args[0])
+
+	for _, j := range []*client.Job{job, fresh, big} {
+		out := *j
+		assert.NoError(t, out.DecompressArgs())
+		assert.Equal(t, "", out.ArgsEncoding)
+	}
+	out := *job
+	assert.NoError(t, out.DecompressArgs())
+	assert.Equal(t, []interface{}{"4111111111111111"}, out.Args)
+
+	// once the old key is dropped its jobs can't be decrypted
+	s.Options.GlobalConfig = aclConfig(t, `
+[encryption]
+key_id = "new"
+  [encryption.keys]
+  new = "`+newKey+`"
+`)
+	assert.NoError(t, e.Reload(s))
+	out = *job
+	assert.Error(t, out.DecompressArgs())
+	out = *fresh
+	assert.NoError(t, out.DecompressArgs())
+
+	// tampered args fail to decrypt
+	data, err := base64.StdEncoding.DecodeString(fresh.Args[0].(string))
+	assert.NoError(t, err)
+	data[len(data)-1] ^= 1
+	out = *fresh
+	out.Args = []interface{}{base64.StdEncoding.EncodeToString(data)}
+	assert.Error(t, out.DecompressArgs())
+
+	// without the section nothing's encrypted
+	s.Options.GlobalConfig = map[string]interface{}{}
+	assert.NoError(t, e.Reload(s))
+	plain := client.NewJob("Invoice", 1)
+	assert.NoError(t, s.encodeArgs(plain, 10))
+	assert.Equal(t, "", plain.ArgsEncoding)
+}
+
+func TestUnreadableArgs(t *testing.T) {
+	runServerWith("localhost:7465", nil, func(s *Server) {
+		store := s.Store()
+		store.Flush()
+		q, err := store.GetQueue("default")
+		assert.NoError(t, err)
+		// encrypted with a key the server doesn't have
+		assert.NoError(t, q.Push(5, []byte(`{"jid":"sealed","jobtype":"Invoice","queue":"default","retry":25,"args":["AAAA"],"args_encoding":"`+encryptedArgs+`"}`)))
+
+		conn, buf := handshake(t, "localhost:7465")
+		defer conn.Close()
+		conn.Write([]byte("FETCH default\r\n"))
+		result, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "$-1\r\n", result)
+
+		assert.EqualValues(t, 0, q.Size())
+		assert.EqualValues(t, 0, s.Manager().WorkingCount())
+		assert.EqualValues(t, 0, store.Retries().Size())
+		assert.EqualValues(t, 1, store.Dead().Size())
+	})
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/util"
+)
+
+/*
+ * Server events are published to the connections which SUBSCRIBE to
+ * them and POSTed to the webhooks configured for them, see webhooks.go:
+ *
+ *	SUBSCRIBE <event>...  stream the events until the next command
+ *	UNSUBSCRIBE           that command, it does nothing else
+ *
+ * The events are:
+ *
+ *	job.dead          a job ran out of retries, data is the job
+ *	batch.complete    a batch's jobs have all run, data is its status
+ *	worker.quiet      a worker process was told to quiet
+ *	worker.terminate  or to terminate
+ *	worker.gone       it stopped sending BEAT without being told to
+ *	                  terminate
+ *	queue.paused      QUEUE PAUSE paused a queue
+ *	queue.resumed     QUEUE RESUME resumed it
+ *	stats             job and connection totals, every 5 seconds
+ *
+ * A subscriber which doesn't read its events quickly enough misses
+ * them rather than holding up the server.
+ */
+var subscribeEvents = []string{
+	"job.dead", "batch.complete", "worker.quiet", "worker.terminate",
+	"worker.gone", "queue.paused", "queue.resumed", "stats",
+}
+
+var (
+	subscriberBacklog = 256
+	statsInterval     = 5 * time.Second
+)
+
+type serverEvent struct {
+	Event string      `json:"event"`
+	At    string      `json:"at"`
+	Data  interface{} `json:"data"`
+}
+
+type subscriber struct {
+	events map[string]bool
+	ch     chan serverEvent
+}
+
+type eventBus struct {
+	mu   sync.RWMutex
+	subs map[*subscriber]bool
+}
+
+func (eb *eventBus) subscribe(events map[string]bool) *subscriber {
+	sub := &subscriber{events: events, ch: make(chan serverEvent, subscriberBacklog)}
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	if eb.subs == nil {
+		eb.subs = map[*subscriber]bool{}
+	}
+	eb.subs[sub] = true
+	return sub
+}
+
+func (eb *eventBus) unsubscribe(sub *subscriber) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	delete(eb.subs, sub)
+}
+
+func (eb *eventBus) publish(event serverEvent) {
+	eb.mu.RLock()
+	defer eb.mu.RUnlock()
+	for sub := range eb.subs {
+		if !sub.events[event.Event] {
+			continue
+		}
+		select {
+		case sub.ch <- event:
+		default:
+			util.Debugf("Subscriber is behind, dropped %s event", event.Event)
+		}
+	}
+}
+
+// Send the event to its subscribers and webhook.
+func (s *Server) publish(name string, data interface{}) {
+	event := serverEvent{Event: name, At: util.Nows(), Data: data}
+	s.events.publish(event)
+	if s.webhooks != nil {
+		s.webhooks.send(event)
+	}
+}
+
+// The totals sent to subscribers of stats.
+func (s *Server) statsEvent() map[string]interface{} {
+	enqueued := uint64(0)
+	s.store.EachQueue(func(q storage.Queue) {
+		enqueued += q.Size()
+	})
+	return map[string]interface{}{
+		"enqueued":    enqueued,
+		"working":     s.manager.WorkingCount(),
+		"scheduled":   s.store.Scheduled().Size(),
+		"retries":     s.store.Retries().Size(),
+		"dead":        s.store.Dead().Size(),
+		"processed":   s.store.TotalProcessed(),
+		"failures":    s.store.TotalFailures(),
+		"workers":     s.workers.Count(),
+		"connections": atomic.LoadUint64(&s.Stats.Connections),
+	}
+}
+
+// SUBSCRIBE <event>...
+//
+// Replies OK and then writes each event as a bulk string of JSON
+// until the client sends another command, which is then run as
+// usual, e.g. UNSUBSCRIBE.
+func subscribe(c *Connection, s *Server, cmd string) {
+	parts := strings.Fields(cmd)
+	if len(parts) < 2 {
+		c.Error(cmd, fmt.Errorf("Invalid SUBSCRIBE, expected SUBSCRIBE <event>..."))
+		return
+	}
+	events := map[string]bool{}
+	for _, name := range parts[1:] {
+		if !knownEvent(subscribeEvents, name) {
+			c.Error(cmd, fmt.Errorf("Unknown event %s, expected %s", name, strings.Join(subscribeEvents, ", ")))
+			return
+		}
+		events[name] = true
+	}
+
+	// the time spent streaming isn't the command being slow, nor
+	// is the connection idle
+	c.waited = true
+	if nc, ok := c.conn.(net.Conn); ok {
+		nc.SetReadDeadline(time.Time{})
+	}
+	sub := s.events.subscribe(events)
+	defer s.events.unsubscribe(sub)
+	c.Ok()
+	if c.flush() != nil {
+		return
+	}
+
+	// wait for the next command without reading it, processLines
+	// runs it once the subscription is over
+	input := make(chan struct{})
+	go func() {
+		c.buf.Peek(1)
+		close(input)
+	}()
+	defer func() {
+		// the peek must be over before processLines reads again
+		select {
+		case <-input:
+		default:
+			c.Close()
+			<-input
+		}
+	}()
+
+	var ticks <-chan time.Time
+	if events["stats"] {
+		ticker := time.NewTicker(statsInterval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	for {
+		var event serverEvent
+		select {
+		case <-input:
+			return
+		case <-s.Stopper():
+			return
+		case event = <-sub.ch:
+		case <-ticks:
+			event = serverEvent{Event: "stats", At: util.Nows(), Data: s.statsEvent()}
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			util.Warnw("Unable to encode event", map[string]interface{}{"event": event.Event, "error": err})
+			continue
+		}
+		c.Result(data)
+		if c.flush() != nil {
+			return
+		}
+	}
+}
+
+// UNSUBSCRIBE
+func unsubscribe(c *Connection, s *Server, cmd string) {
+	c.Ok()
+}
+
+func knownEvent(events []string, name string) bool {
+	for _, known := range events {
+		if name == known {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventBus(t *testing.T) {
+	var eb eventBus
+	dead := eb.subscribe(map[string]bool{"job.dead": true})
+	all := eb.subscribe(map[string]bool{"job.dead": true, "queue.paused": true})
+
+	eb.publish(serverEvent{Event: "queue.paused"})
+	eb.publish(serverEvent{Event: "job.dead"})
+	assert.Len(t, dead.ch, 1)
+	assert.Len(t, all.ch, 2)
+	assert.Equal(t, "queue.paused", (<-all.ch).Event)
+
+	// a full subscriber misses events
+	for idx := 0; idx < subscriberBacklog+5; idx++ {
+		eb.publish(serverEvent{Event: "job.dead"})
+	}
+	assert.Len(t, dead.ch, subscriberBacklog)
+
+	eb.unsubscribe(dead)
+	eb.unsubscribe(all)
+	assert.Len(t, eb.subs, 0)
+}
+
+func TestSubscribe(t *testing.T) {
+	oldInterval := statsInterval
+	statsInterval = 50 * time.Millisecond
+	defer func() { statsInterval = oldInterval }()
+
+	runServerWith("localhost:7463", nil, func(s *Server) {
+		readBulk := func(buf *bufio.Reader) serverEvent {
+			_, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			line, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			var event serverEvent
+			assert.NoError(t, json.Unmarshal([]byte(line), &event))
+			return event
+		}
+
+		conn, buf := handshake(t, "localhost:7463")
+		defer conn.Close()
+		conn.Write([]byte("SUBSCRIBE queue.paused job.done\r\n"))
+		result, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Contains(t, result, "Unknown event job.done")
+
+		conn.Write([]byte("SUBSCRIBE queue.paused stats\r\n"))
+		result, err = buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "+OK\r\n", result)
+
+		event := readBulk(buf)
+		assert.Equal(t, "stats", event.Event)
+		assert.Contains(t, event.Data, "processed")
+
+		admin, abuf := handshake(t, "localhost:7463")
+		defer admin.Close()
+		admin.Write([]byte("QUEUE PAUSE events\r\n"))
+		result, err = abuf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "+OK\r\n", result)
+
+		for event.Event == "stats" {
+			event = readBulk(buf)
+		}
+		assert.Equal(t, "queue.paused", event.Event)
+		assert.Equal(t, map[string]interface{}{"queue": "events"}, event.Data)
+		admin.Write([]byte("QUEUE RESUME events\r\n"))
+		abuf.ReadString('\n')
+
+		// the next command ends the subscription and is run as usual
+		conn.Write([]byte("UNSUBSCRIBE\r\n"))
+		for {
+			result, err = buf.ReadString('\n')
+			assert.NoError(t, err)
+			if result == "+OK\r\n" || err != nil {
+				break
+			}
+		}
+		conn.Write([]byte("INFO\r\n"))
+		result, err = buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Contains(t, result, "$")
+	})
+}
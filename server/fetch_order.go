@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/contribsys/faktory/manager"
+)
+
+// How FETCH chooses between its queues, see ServerOptions.FetchOrder.
+const (
+	// Weighted if any queue in the FETCH has a weight, else strict.
+	FetchDefault = ""
+	// Always check the queues left to right, ignoring weights.
+	FetchStrict = "strict"
+	// Start with the next queue on each FETCH over the connection.
+	FetchRoundRobin = "round_robin"
+	// Check the queues in a random order favoring heavier queues,
+	// those without a weight count as 1.
+	FetchWeighted = "weighted"
+)
+
+func checkFetchOrder(order string) error {
+	switch order {
+	case FetchDefault, FetchStrict, FetchRoundRobin, FetchWeighted:
+		return nil
+	}
+	return fmt.Errorf("Invalid fetch_order %q, expected %s, %s or %s", order, FetchStrict, FetchRoundRobin, FetchWeighted)
+}
+
+// The fetch order for this connection: the worker's own from its
+// HELLO or the server's.
+func (c *Connection) fetchOrder(s *Server) string {
+	if c.client.FetchOrder != "" {
+		return c.client.FetchOrder
+	}
+	return s.CurrentOptions().FetchOrder
+}
+
+// Rewrite the FETCH queues so the manager checks them in the given
+// order.  turn counts the connection's previous FETCHes.
+func orderQueues(order string, queues []string, turn uint64) []string {
+	if order == FetchDefault || len(queues) == 0 {
+		return queues
+	}
+
+	ordered := make([]string, len(queues))
+	for idx, queue := range queues {
+		name, weight, err := manager.SplitQueueWeight(queue)
+		switch {
+		case err != nil:
+			// leave it for the manager to reject
+			ordered[idx] = queue
+		case order == FetchWeighted && weight == 0:
+			ordered[idx] = queue + ":1"
+		case order == FetchWeighted:
+			ordered[idx] = queue
+		default:
+			ordered[idx] = name
+		}
+	}
+
+	if order == FetchRoundRobin {
+		start := int(turn % uint64(len(ordered)))
+		ordered = append(ordered[start:], ordered[:start]...)
+	}
+	return ordered
+}
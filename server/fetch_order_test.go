@@ -0,0 +1,33 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderQueues(t *testing.T) {
+	queues := []string{"critical:5", "default", "bulk"}
+
+	assert.Equal(t, queues, orderQueues(FetchDefault, queues, 0))
+	assert.Equal(t, []string{"critical", "default", "bulk"}, orderQueues(FetchStrict, queues, 7))
+	assert.Equal(t, []string{"critical:5", "default:1", "bulk:1"}, orderQueues(FetchWeighted, queues, 0))
+
+	assert.Equal(t, []string{"critical", "default", "bulk"}, orderQueues(FetchRoundRobin, queues, 0))
+	assert.Equal(t, []string{"default", "bulk", "critical"}, orderQueues(FetchRoundRobin, queues, 1))
+	assert.Equal(t, []string{"bulk", "critical", "default"}, orderQueues(FetchRoundRobin, queues, 5))
+	assert.Empty(t, orderQueues(FetchRoundRobin, []string{}, 3))
+
+	// the input is left alone
+	assert.Equal(t, []string{"critical:5", "default", "bulk"}, queues)
+
+	assert.NoError(t, checkFetchOrder(""))
+	assert.NoError(t, checkFetchOrder("round_robin"))
+	assert.Error(t, checkFetchOrder("random"))
+
+	_, err := clientDataFromHello(`{"wid":"1234","fetch_order":"random"}`)
+	assert.Error(t, err)
+	client, err := clientDataFromHello(`{"wid":"1234","fetch_order":"weighted"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, FetchWeighted, client.FetchOrder)
+}
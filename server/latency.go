@@ -0,0 +1,101 @@
+package server
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// The commands whose latency INFO reports in command_latency.  Like
+// the slow log, a FETCH which waited and found no job isn't counted.
+var timedVerbs = [...]string{"PUSH", "FETCH", "ACK", "FAIL", "BEAT"}
+
+const (
+	// The first bucket's upper bound, each further bucket's is double
+	// the one before up to about 84 seconds.  Longer commands fall in
+	// the last bucket.
+	latencyBase    = 10 * time.Microsecond
+	latencyBuckets = 24
+)
+
+// A histogram of how long a command has taken since the server
+// started.  Percentiles are the upper bound of the bucket they fall
+// in so are at most double the real value.
+type commandLatency struct {
+	totalNs uint64
+	buckets [latencyBuckets]uint64
+}
+
+type commandLatencies [len(timedVerbs)]commandLatency
+
+func (cl *commandLatencies) record(verb string, elapsed time.Duration) {
+	for idx, timed := range timedVerbs {
+		if verb == timed {
+			cl[idx].record(elapsed)
+			return
+		}
+	}
+}
+
+func (cl *commandLatency) record(elapsed time.Duration) {
+	bucket := 0
+	if elapsed > latencyBase {
+		bucket = bits.Len64(uint64((elapsed - 1) / latencyBase))
+		if bucket >= latencyBuckets {
+			bucket = latencyBuckets - 1
+		}
+	}
+	atomic.AddUint64(&cl.buckets[bucket], 1)
+	atomic.AddUint64(&cl.totalNs, uint64(elapsed))
+}
+
+// The count, mean and percentiles of each verb, in milliseconds.
+func (cl *commandLatencies) stats() map[string]interface{} {
+	stats := map[string]interface{}{}
+	for idx, verb := range timedVerbs {
+		stats[verb] = cl[idx].stats()
+	}
+	return stats
+}
+
+func (cl *commandLatency) stats() map[string]interface{} {
+	var buckets [latencyBuckets]uint64
+	count := uint64(0)
+	for idx := range buckets {
+		buckets[idx] = atomic.LoadUint64(&cl.buckets[idx])
+		count += buckets[idx]
+	}
+	mean := 0.0
+	if count > 0 {
+		mean = millis(time.Duration(atomic.LoadUint64(&cl.totalNs) / count))
+	}
+	return map[string]interface{}{
+		"count":   count,
+		"mean_ms": mean,
+		"p50_ms":  latencyPercentile(buckets, count, 0.50),
+		"p95_ms":  latencyPercentile(buckets, count, 0.95),
+		"p99_ms":  latencyPercentile(buckets, count, 0.99),
+	}
+}
+
+func latencyPercentile(buckets [latencyBuckets]uint64, count uint64, p float64) float64 {
+	if count == 0 {
+		return 0
+	}
+	rank := uint64(p*float64(count) + 0.5)
+	if rank == 0 {
+		rank = 1
+	}
+	seen := uint64(0)
+	for idx, n := range buckets {
+		seen += n
+		if seen >= rank {
+			return millis(latencyBase << uint(idx))
+		}
+	}
+	return millis(latencyBase << uint(latencyBuckets-1))
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandLatency(t *testing.T) {
+	var cl commandLatencies
+	stats := cl.stats()
+	assert.Len(t, stats, len(timedVerbs))
+	assert.Equal(t, map[string]interface{}{
+		"count": uint64(0), "mean_ms": 0.0, "p50_ms": 0.0, "p95_ms": 0.0, "p99_ms": 0.0,
+	}, stats["FETCH"])
+
+	for idx := 0; idx < 90; idx++ {
+		cl.record("PUSH", 100*time.Microsecond)
+	}
+	for idx := 0; idx < 9; idx++ {
+		cl.record("PUSH", 3*time.Millisecond)
+	}
+	cl.record("PUSH", 5*time.Minute)
+	cl.record("INFO", time.Second)
+
+	push := cl.stats()["PUSH"].(map[string]interface{})
+	assert.EqualValues(t, 100, push["count"])
+	assert.InDelta(t, 3000.36, push["mean_ms"], 0.01)
+	// 100us falls in the bucket up to 160us, 3ms in the one up to 5.12ms
+	assert.Equal(t, 0.16, push["p50_ms"])
+	assert.Equal(t, 5.12, push["p95_ms"])
+	assert.Equal(t, 5.12, push["p99_ms"])
+
+	cl.record("ACK", 5*time.Microsecond)
+	cl.record("ACK", 10*time.Microsecond)
+	ack := cl.stats()["ACK"].(map[string]interface{})
+	assert.EqualValues(t, 2, ack["count"])
+	assert.Equal(t, 0.01, ack["p99_ms"])
+	assert.NotContains(t, cl.stats(), "INFO")
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * A minimal client for buckets which speak the S3 API, signed with
+ * AWS Signature Version 4.  Google Cloud Storage accepts the same
+ * requests given HMAC keys and region "auto".  Requests use path
+ * style URLs, endpoint/bucket/key, so any S3 compatible store works.
+ */
+type objectStore struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	// for tests
+	now func() time.Time
+}
+
+var objectStoreTimeout = 5 * time.Minute
+
+func newObjectStore(endpoint, bucket, region, accessKey, secretKey string) *objectStore {
+	return &objectStore{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: objectStoreTimeout},
+		now:       time.Now,
+	}
+}
+
+func (o *objectStore) Put(key string, data []byte, contentType string) error {
+	resp, err := o.do("PUT", key, nil, data, contentType)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (o *objectStore) Delete(key string) error {
+	resp, err := o.do("DELETE", key, nil, nil, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List returns the keys starting with prefix, in order.
+func (o *objectStore) List(prefix string) ([]string, error) {
+	keys := []string{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := o.do("GET", "", query, nil, "")
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, obj.Key)
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			sort.Strings(keys)
+			return keys, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// Sends a signed request, any status other than 2xx is an error.
+func (o *objectStore) do(method, key string, query url.Values, body []byte, contentType string) (*http.Response, error) {
+	path := "/" + o.bucket
+	if key != "" {
+		path += "/" + key
+	}
+	uri := uriEncode(path, false)
+	rawQuery := canonicalQuery(query)
+	target := o.endpoint + uri
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	o.sign(req, uri, rawQuery, body)
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s replied %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func (o *objectStore) sign(req *http.Request, uri, rawQuery string, body []byte) {
+	now := o.now().UTC()
+	stamp := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payload := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	// host and every x-amz- header are signed
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method, uri, rawQuery, canonicalHeaders.String(), signedHeaders, payload,
+	}, "\n")
+	scope := day + "/" + o.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+o.secretKey), day)
+	key = hmacSHA256(key, o.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		o.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// The query sorted by name with values encoded as SigV4 expects.
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := []string{}
+	for _, name := range names {
+		for _, val := range query[name] {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(val, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// Percent-encodes everything but the unreserved characters and, in
+// paths, the slashes.
+func uriEncode(str string, encodeSlash bool) string {
+	var buf strings.Builder
+	for _, b := range []byte(str) {
+		switch {
+		case b >= 'A' && b <= 'Z', b >= 'a' && b <= 'z', b >= '0' && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			buf.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			buf.WriteByte(b)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,35 @@
+package server
+
+import "bytes"
+
+// A request is a command line split into its verb and arguments, the
+// rest of the line after the first space.  Both are slices of the line
+// rather than copies so, like the line from Connection.readLine, they
+// are only valid until the next command is read.
+type request struct {
+	line []byte
+	verb []byte
+	args []byte
+}
+
+func parseRequest(line []byte) request {
+	req := request{line: line, verb: line}
+	if idx := bytes.IndexByte(line, ' '); idx >= 0 {
+		req.verb = line[:idx]
+		req.args = line[idx+1:]
+	}
+	return req
+}
+
+// The built in verbs, so the name of a parsed verb can be looked up
+// without copying it.
+var builtinVerbs = map[string]string{}
+
+func init() {
+	for verb := range cmdSet {
+		builtinVerbs[verb] = verb
+	}
+	for verb := range rawCmdSet {
+		builtinVerbs[verb] = verb
+	}
+}
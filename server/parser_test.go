@@ -0,0 +1,93 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRequest(t *testing.T) {
+	req := parseRequest([]byte(`PUSH {"jid":"abc"}`))
+	assert.Equal(t, "PUSH", string(req.verb))
+	assert.Equal(t, `{"jid":"abc"}`, string(req.args))
+
+	req = parseRequest([]byte("END"))
+	assert.Equal(t, "END", string(req.verb))
+	assert.Empty(t, req.args)
+
+	req = parseRequest([]byte("FETCH default critical"))
+	assert.Equal(t, "FETCH", string(req.verb))
+	assert.Equal(t, "default critical", string(req.args))
+
+	s := &Server{}
+	for _, verb := range []string{"ACK", "FETCH", "NOPE"} {
+		name, proc, raw, ok := s.command([]byte(verb))
+		assert.Equal(t, verb, name)
+		assert.Equal(t, verb != "NOPE", ok)
+		assert.Equal(t, verb == "ACK", raw != nil)
+		assert.Equal(t, verb == "FETCH", proc != nil)
+	}
+}
+
+const benchAck = `ACK {"jid":"2c7d0a7e1b3f4a5c9d8e","result":{"rows":123,"status":"done"}}`
+
+// An endless stream of the same command.
+type repeatReader struct {
+	line []byte
+	pos  int
+}
+
+func (rr *repeatReader) Read(buf []byte) (int, error) {
+	count := 0
+	for count < len(buf) {
+		n := copy(buf[count:], rr.line[rr.pos:])
+		count += n
+		rr.pos = (rr.pos + n) % len(rr.line)
+	}
+	return count, nil
+}
+
+func BenchmarkParseRequest(b *testing.B) {
+	line := []byte(benchAck)
+	s := &Server{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		req := parseRequest(line)
+		s.command(req.verb)
+	}
+}
+
+// The string parsing parseRequest replaced, for comparison.
+func BenchmarkParseRequestString(b *testing.B) {
+	line := []byte(benchAck + "\r\n")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		cmd := strings.TrimSuffix(string(line), "\r\n")
+		verb := cmd
+		if idx := strings.Index(cmd, " "); idx >= 0 {
+			verb = cmd[0:idx]
+		}
+		_ = cmdSet[verb]
+		_ = []byte(cmd[4:])
+	}
+}
+
+func BenchmarkReadCommands(b *testing.B) {
+	c := dummyConnection()
+	c.buf = pooledReader(&repeatReader{line: []byte(benchAck + "\r\n")})
+	c.out = pooledWriter(c.conn)
+	defer c.release()
+	s := &Server{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		line, err := c.readLine()
+		if err != nil {
+			b.Fatal(err)
+		}
+		req := parseRequest(line)
+		s.command(req.verb)
+		c.Ok()
+		c.flush()
+	}
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Load balancers which speak the PROXY protocol send a header with
+// the client's real address before any client data, see
+// https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener expects every connection to start with a PROXY v1 or
+// v2 header.  Connections without one are rejected since anyone who
+// can reach the port directly could otherwise spoof their address.
+type proxyListener struct {
+	net.Listener
+}
+
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	conn, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, rdr: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn reads the header on the first Read or RemoteAddr so a
+// slow client can't block the accept loop.  The connection's read
+// deadline applies.
+type proxyConn struct {
+	net.Conn
+	rdr *bufio.Reader
+
+	once   sync.Once
+	source net.Addr
+	err    error
+}
+
+func (pc *proxyConn) readHeader() error {
+	pc.once.Do(func() {
+		pc.source, pc.err = readProxyHeader(pc.rdr)
+		if pc.err != nil {
+			pc.err = fmt.Errorf("Invalid PROXY header from %s: %v", pc.Conn.RemoteAddr(), pc.err)
+		}
+	})
+	return pc.err
+}
+
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	err := pc.readHeader()
+	if err != nil {
+		return 0, err
+	}
+	return pc.rdr.Read(b)
+}
+
+// The client's address according to the load balancer, or the
+// load balancer's own address for health checks.
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	if pc.readHeader() == nil && pc.source != nil {
+		return pc.source
+	}
+	return pc.Conn.RemoteAddr()
+}
+
+// Returns the source address in the header, nil if the
+// header doesn't carry one, e.g. "PROXY UNKNOWN".
+func readProxyHeader(rdr *bufio.Reader) (net.Addr, error) {
+	prefix, err := rdr.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(prefix, proxyV2Signature) {
+		return readProxyV2(rdr)
+	}
+	if bytes.HasPrefix(prefix, []byte("PROXY ")) {
+		return readProxyV1(rdr)
+	}
+	return nil, fmt.Errorf("missing header")
+}
+
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 7419\r\n
+func readProxyV1(rdr *bufio.Reader) (net.Addr, error) {
+	// the longest v1 header is 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := rdr.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("v1 header too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2(rdr *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(rdr, header)
+	if err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	_, err = io.ReadFull(rdr, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// LOCAL connections come from the load balancer itself
+	if header[12]&0xF == 0 {
+		return nil, nil
+	}
+
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, fmt.Errorf("short v2 IPv4 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("short v2 IPv6 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	// other families, e.g. Unix sockets, have no useful address
+	return nil, nil
+}
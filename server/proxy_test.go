@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func proxyV2Header(cmd byte, family byte, addrs []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	buf.WriteByte(0x20 | cmd)
+	buf.WriteByte(family)
+	binary.Write(&buf, binary.BigEndian, uint16(len(addrs)))
+	buf.Write(addrs)
+	return buf.Bytes()
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	read := func(header []byte) (net.Addr, string, error) {
+		rdr := bufio.NewReader(bytes.NewReader(append(header, "HELLO {}\r\n"...)))
+		addr, err := readProxyHeader(rdr)
+		rest, _ := rdr.ReadString('\n')
+		return addr, rest, err
+	}
+
+	addr, rest, err := read([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 7419\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.7:56324", addr.String())
+	assert.Equal(t, "HELLO {}\r\n", rest)
+
+	addr, _, err = read([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 7419\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:56324", addr.String())
+
+	addr, rest, err = read([]byte("PROXY UNKNOWN\r\n"))
+	assert.NoError(t, err)
+	assert.Nil(t, addr)
+	assert.Equal(t, "HELLO {}\r\n", rest)
+
+	_, _, err = read([]byte("PROXY TCP4 nope 10.0.0.1 56324 7419\r\n"))
+	assert.Error(t, err)
+	_, _, err = read([]byte("HELLO {\"v\":2}\r\n"))
+	assert.Error(t, err)
+
+	// source, destination and ports, then a TLV the server ignores
+	ipv4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0xDC, 0x04, 0x1C, 0xFB, 0x04, 0x00, 0x01, 0x00}
+	addr, rest, err = read(proxyV2Header(1, 0x11, ipv4))
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.7:56324", addr.String())
+	assert.Equal(t, "HELLO {}\r\n", rest)
+
+	addr, rest, err = read(proxyV2Header(0, 0x00, nil))
+	assert.NoError(t, err)
+	assert.Nil(t, addr)
+	assert.Equal(t, "HELLO {}\r\n", rest)
+
+	_, _, err = read(proxyV2Header(1, 0x11, ipv4[:4]))
+	assert.Error(t, err)
+}
+
+func TestProxyListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	listener = &proxyListener{listener}
+	defer listener.Close()
+
+	s := &Server{Options: &ServerOptions{}, workers: newWorkers()}
+	accepted := make(chan *Connection, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- startConnection(conn, s, false)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 7419\r\n"))
+	buf := bufio.NewReader(conn)
+	line, err := buf.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Contains(t, line, "+HI")
+	conn.Write([]byte(`HELLO {"wid":"proxied","v":2}` + "\r\n"))
+	line, err = buf.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n", line)
+
+	c := <-accepted
+	assert.NotNil(t, c)
+	assert.Equal(t, "203.0.113.7:56324", c.client.Address)
+	assert.Equal(t, "203.0.113.7:56324", s.workers.heartbeats["proxied"].Address)
+
+	// direct connections without a header are dropped before the HI
+	direct, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	defer direct.Close()
+	direct.Write([]byte(`HELLO {"wid":"spoofed","v":2}` + "\r\n"))
+	assert.Nil(t, <-accepted)
+	_, err = bufio.NewReader(direct).ReadString('\n')
+	assert.Error(t, err)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/contribsys/faktory/manager"
+	"github.com/contribsys/faktory/util"
+)
+
+/*
+ * The queue limits subsystem caps how many jobs a queue may hold so
+ * producers shed load, rather than Redis running out of memory, when
+ * workers fall behind:
+ *
+ *	[queue_limits]
+ *	default = 100000
+ *	"bulk_*" = 5000
+ *
+ * Keys are queue names or path.Match patterns, a queue's own name
+ * wins over patterns and the longest matching pattern over shorter
+ * ones.  Pushes to a full queue wait up to ServerOptions.QueueFullWait
+ * for room and then fail with QUEUEFULL.
+ */
+type queueLimits struct {
+	mu       sync.RWMutex
+	exact    map[string]uint64
+	patterns map[string]uint64
+}
+
+func (ql *queueLimits) Name() string {
+	return "queue_limits"
+}
+
+func (ql *queueLimits) Start(s *Server) error {
+	return ql.Reload(s)
+}
+
+func (ql *queueLimits) Reload(s *Server) error {
+	exact, patterns, err := parseQueueLimits(s.CurrentOptions().GlobalConfig["queue_limits"])
+	if err != nil {
+		return err
+	}
+	ql.mu.Lock()
+	ql.exact = exact
+	ql.patterns = patterns
+	ql.mu.Unlock()
+	if len(exact)+len(patterns) > 0 {
+		util.Infof("Loaded %d queue limits", len(exact)+len(patterns))
+	}
+	return nil
+}
+
+func (ql *queueLimits) Stop(s *Server) error {
+	return nil
+}
+
+// The limit for the queue, 0 if it has none.
+func (ql *queueLimits) limit(queue string) uint64 {
+	ql.mu.RLock()
+	defer ql.mu.RUnlock()
+	if max, ok := ql.exact[queue]; ok {
+		return max
+	}
+	best := ""
+	limit := uint64(0)
+	for pattern, max := range ql.patterns {
+		if ok, _ := path.Match(pattern, queue); ok && len(pattern) > len(best) {
+			best = pattern
+			limit = max
+		}
+	}
+	return limit
+}
+
+func parseQueueLimits(section interface{}) (map[string]uint64, map[string]uint64, error) {
+	return parseQueueSizes("queue_limits", section)
+}
+
+// A table of queue names or patterns to a positive size, as in
+// queue_limits.
+func parseQueueSizes(setting string, section interface{}) (map[string]uint64, map[string]uint64, error) {
+	exact := map[string]uint64{}
+	patterns := map[string]uint64{}
+	if section == nil {
+		return exact, patterns, nil
+	}
+	table, ok := section.(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("Invalid %s: must be a table", setting)
+	}
+
+	for name, val := range table {
+		max, ok := val.(int64)
+		if !ok || max < 1 {
+			return nil, nil, fmt.Errorf("Invalid %s: %s must be a positive integer", setting, name)
+		}
+		if _, err := path.Match(name, ""); err != nil {
+			return nil, nil, fmt.Errorf("Invalid %s: %s is not a valid pattern", setting, name)
+		}
+		if manager.IsQueuePattern(name) {
+			patterns[name] = uint64(max)
+		} else {
+			exact[name] = uint64(max)
+		}
+	}
+	return exact, patterns, nil
+}
+
+// The manager's view of the limits, see manager.Options.QueueLimit.
+func (s *Server) queueLimit(queue string) (uint64, time.Duration) {
+	if s.limits == nil {
+		return 0, 0
+	}
+	return s.limits.limit(queue), s.CurrentOptions().QueueFullWait
+}
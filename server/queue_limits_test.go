@@ -0,0 +1,43 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQueueLimits(t *testing.T) {
+	exact, patterns, err := parseQueueLimits(aclConfig(t, `
+[queue_limits]
+default = 100
+"bulk_*" = 50
+"bulk_eu_*" = 10
+`)["queue_limits"])
+	assert.NoError(t, err)
+	ql := &queueLimits{exact: exact, patterns: patterns}
+	assert.EqualValues(t, 100, ql.limit("default"))
+	assert.EqualValues(t, 50, ql.limit("bulk_us"))
+	assert.EqualValues(t, 10, ql.limit("bulk_eu_1"))
+	assert.EqualValues(t, 0, ql.limit("critical"))
+
+	exact, patterns, err = parseQueueLimits(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, exact)
+	assert.Empty(t, patterns)
+
+	for _, bad := range []string{
+		"queue_limits = 1",
+		"[queue_limits]\ndefault = 0",
+		"[queue_limits]\ndefault = \"big\"",
+		"[queue_limits]\n\"bulk_[\" = 10",
+	} {
+		_, _, err = parseQueueLimits(aclConfig(t, bad)["queue_limits"])
+		assert.Error(t, err, bad)
+	}
+
+	s := &Server{Options: &ServerOptions{QueueFullWait: time.Second}, limits: ql}
+	limit, wait := s.queueLimit("default")
+	assert.EqualValues(t, 100, limit)
+	assert.Equal(t, time.Second, wait)
+}
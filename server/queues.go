@@ -0,0 +1,203 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/contribsys/faktory/manager"
+	"github.com/contribsys/faktory/util"
+)
+
+/*
+ * The queues subsystem holds settings for particular queues, each
+ * table under [queues] names a queue or a path.Match pattern:
+ *
+ *	[queues.geocode]
+ *	throttle = "10/s"
+ *
+ *	[queues."report_*"]
+ *	throttle = "100/m"
+ *	max_concurrency = 5
+ *
+ *	[queues.billing]
+ *	dead_retention_days = 180
+ *	dead_max_jobs = 100000
+ *
+ * throttle caps how many jobs are fetched from the queue per second,
+ * minute or hour, or per a duration such as "5/30s".  max_concurrency
+ * caps how many of its jobs may be reserved at once across all
+ * workers.  dead_retention_days overrides dead_job_retention_days for
+ * the queue's dead jobs and dead_max_jobs keeps only that many of the
+ * newest.  Each queue a pattern matches is limited separately.  A
+ * queue's own table wins over patterns and the longest matching
+ * pattern over shorter ones.
+ */
+type queueSettings struct {
+	mu       sync.RWMutex
+	exact    map[string]*queueSetting
+	patterns map[string]*queueSetting
+}
+
+type queueSetting struct {
+	throttle       manager.Throttle
+	maxConcurrency int
+	deadRetention  manager.DeadRetention
+}
+
+func (qs *queueSettings) Name() string {
+	return "queues"
+}
+
+func (qs *queueSettings) Start(s *Server) error {
+	return qs.Reload(s)
+}
+
+func (qs *queueSettings) Reload(s *Server) error {
+	exact, patterns, err := parseQueueSettings(s.CurrentOptions().GlobalConfig["queues"])
+	if err != nil {
+		return err
+	}
+	qs.mu.Lock()
+	qs.exact = exact
+	qs.patterns = patterns
+	qs.mu.Unlock()
+	if len(exact)+len(patterns) > 0 {
+		util.Infof("Loaded settings for %d queues", len(exact)+len(patterns))
+	}
+	return nil
+}
+
+func (qs *queueSettings) Stop(s *Server) error {
+	return nil
+}
+
+// The settings for the queue, nil if it has none.
+func (qs *queueSettings) setting(queue string) *queueSetting {
+	qs.mu.RLock()
+	defer qs.mu.RUnlock()
+	if setting, ok := qs.exact[queue]; ok {
+		return setting
+	}
+	best := ""
+	var setting *queueSetting
+	for pattern, candidate := range qs.patterns {
+		if ok, _ := path.Match(pattern, queue); ok && len(pattern) > len(best) {
+			best = pattern
+			setting = candidate
+		}
+	}
+	return setting
+}
+
+func parseQueueSettings(section interface{}) (map[string]*queueSetting, map[string]*queueSetting, error) {
+	exact := map[string]*queueSetting{}
+	patterns := map[string]*queueSetting{}
+	if section == nil {
+		return exact, patterns, nil
+	}
+	tables, ok := section.(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("Invalid queues: queues must be a table")
+	}
+
+	for name, table := range tables {
+		values, ok := table.(map[string]interface{})
+		if !ok {
+			return nil, nil, fmt.Errorf("Invalid queues: queues.%s must be a table", name)
+		}
+		if _, err := path.Match(name, ""); err != nil {
+			return nil, nil, fmt.Errorf("Invalid queues: %s is not a valid pattern", name)
+		}
+		setting := &queueSetting{}
+		for key, val := range values {
+			var err error
+			switch key {
+			case "throttle":
+				str, ok := val.(string)
+				if !ok {
+					err = fmt.Errorf("must be a string such as \"10/s\"")
+					break
+				}
+				setting.throttle, err = manager.ParseThrottle(str)
+			case "max_concurrency":
+				max, ok := val.(int64)
+				if !ok || max < 1 {
+					err = fmt.Errorf("must be a positive integer")
+					break
+				}
+				setting.maxConcurrency = int(max)
+			case "dead_retention_days":
+				days, ok := val.(int64)
+				if !ok || days < 1 {
+					err = fmt.Errorf("must be a positive integer")
+					break
+				}
+				setting.deadRetention.MaxAge = time.Duration(days) * 24 * time.Hour
+			case "dead_max_jobs":
+				max, ok := val.(int64)
+				if !ok || max < 1 {
+					err = fmt.Errorf("must be a positive integer")
+					break
+				}
+				setting.deadRetention.MaxCount = int(max)
+			default:
+				err = fmt.Errorf("is not a known queue setting")
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("Invalid queues: queues.%s.%s %v", name, key, err)
+			}
+		}
+		if manager.IsQueuePattern(name) {
+			patterns[name] = setting
+		} else {
+			exact[name] = setting
+		}
+	}
+	return exact, patterns, nil
+}
+
+// The manager's view of the throttles, see manager.Options.Throttle.
+func (s *Server) queueThrottle(queue string) manager.Throttle {
+	if s.queues == nil {
+		return manager.Throttle{}
+	}
+	setting := s.queues.setting(queue)
+	if setting == nil {
+		return manager.Throttle{}
+	}
+	return setting.throttle
+}
+
+// See manager.Options.MaxConcurrency.
+func (s *Server) queueMaxConcurrency(queue string) int {
+	if s.queues == nil {
+		return 0
+	}
+	setting := s.queues.setting(queue)
+	if setting == nil {
+		return 0
+	}
+	return setting.maxConcurrency
+}
+
+// How long and how many of the queue's dead jobs to keep, see
+// manager.DeadRetention.
+func (s *Server) deadRetention(queue string) manager.DeadRetention {
+	retention := manager.DeadRetention{
+		MaxAge: time.Duration(s.CurrentOptions().DeadJobRetentionDays) * 24 * time.Hour,
+	}
+	if s.queues == nil {
+		return retention
+	}
+	setting := s.queues.setting(queue)
+	if setting == nil {
+		return retention
+	}
+	if setting.deadRetention.MaxAge > 0 {
+		retention.MaxAge = setting.deadRetention.MaxAge
+	}
+	retention.MaxCount = setting.deadRetention.MaxCount
+	return retention
+}
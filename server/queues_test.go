@@ -0,0 +1,57 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/contribsys/faktory/manager"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQueueSettings(t *testing.T) {
+	exact, patterns, err := parseQueueSettings(aclConfig(t, `
+[queues.geocode]
+throttle = "10/s"
+
+[queues."report_*"]
+throttle = "100/m"
+max_concurrency = 5
+
+[queues.billing]
+dead_retention_days = 180
+dead_max_jobs = 1000
+`)["queues"])
+	assert.NoError(t, err)
+	s := &Server{queues: &queueSettings{exact: exact, patterns: patterns}}
+	assert.Equal(t, manager.Throttle{Limit: 10, Period: time.Second}, s.queueThrottle("geocode"))
+	assert.Equal(t, manager.Throttle{Limit: 100, Period: time.Minute}, s.queueThrottle("report_daily"))
+	assert.Equal(t, manager.Throttle{}, s.queueThrottle("default"))
+	assert.Equal(t, 5, s.queueMaxConcurrency("report_daily"))
+	assert.Equal(t, 0, s.queueMaxConcurrency("geocode"))
+
+	s.Options = &ServerOptions{DeadJobRetentionDays: 90}
+	assert.Equal(t, manager.DeadRetention{MaxAge: 180 * 24 * time.Hour, MaxCount: 1000}, s.deadRetention("billing"))
+	assert.Equal(t, manager.DeadRetention{MaxAge: 90 * 24 * time.Hour}, s.deadRetention("geocode"))
+	assert.Equal(t, manager.DeadRetention{MaxAge: 90 * 24 * time.Hour}, s.deadRetention("default"))
+
+	exact, patterns, err = parseQueueSettings(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, exact)
+	assert.Empty(t, patterns)
+
+	for _, bad := range []string{
+		"queues = 1",
+		"[queues]\ngeocode = 1",
+		"[queues.geocode]\nthrottle = 10",
+		"[queues.geocode]\nthrottle = \"10/d\"",
+		"[queues.geocode]\nspeed = \"10/s\"",
+		"[queues.geocode]\nmax_concurrency = 0",
+		"[queues.geocode]\nmax_concurrency = \"5\"",
+		"[queues.geocode]\ndead_retention_days = 0",
+		"[queues.geocode]\ndead_max_jobs = \"100\"",
+		"[queues.\"report_[\"]\nthrottle = \"10/s\"",
+	} {
+		_, _, err = parseQueueSettings(aclConfig(t, bad)["queues"])
+		assert.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/manager"
+	"github.com/contribsys/faktory/util"
+)
+
+/*
+ * The routes subsystem rewrites the queue of pushed jobs so producers
+ * needn't each carry the same routing logic:
+ *
+ *	[[route]]
+ *	jobtype = "SyncCustomer"
+ *	to = "customers_{shard}"
+ *	shard_by = "0.customer_id"
+ *	shards = 8
+ *
+ *	[[route]]
+ *	queue = "default"
+ *	min_bytes = 65536
+ *	to = "oversized"
+ *
+ * jobtype and queue are path.Match patterns for the job's type and
+ * the queue it was pushed to, min_bytes matches jobs whose args are at
+ * least that large.  A route matches jobs which have all of its
+ * conditions and the first route to match wins.  shard_by names an
+ * argument, by index and then any keys, and "{shard}" in to becomes
+ * its hash modulo shards.  Jobs without the argument aren't matched.
+ */
+type routes struct {
+	mu     sync.RWMutex
+	routes manager.Routes
+}
+
+func (r *routes) Name() string {
+	return "routes"
+}
+
+func (r *routes) Start(s *Server) error {
+	return r.Reload(s)
+}
+
+func (r *routes) Reload(s *Server) error {
+	parsed, err := parseRoutes(s.CurrentOptions().GlobalConfig["route"])
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.routes = parsed
+	r.mu.Unlock()
+	if len(parsed) > 0 {
+		util.Infof("Loaded %d routes", len(parsed))
+	}
+	return nil
+}
+
+func (r *routes) Stop(s *Server) error {
+	return nil
+}
+
+// See manager.Options.Router.
+func (r *routes) Route(job *client.Job) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.routes.Route(job)
+}
+
+func parseRoutes(section interface{}) (manager.Routes, error) {
+	if section == nil {
+		return nil, nil
+	}
+	tables, ok := section.([]map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid route: must be an array of tables, use [[route]]")
+	}
+
+	list := make([]*manager.Route, 0, len(tables))
+	for idx, table := range tables {
+		route := &manager.Route{}
+		strs := map[string]*string{
+			"jobtype":  &route.Jobtype,
+			"queue":    &route.Queue,
+			"to":       &route.To,
+			"shard_by": &route.ShardBy,
+		}
+		ints := map[string]*int{
+			"min_bytes": &route.MinBytes,
+			"shards":    &route.Shards,
+		}
+		for key, val := range table {
+			if field, ok := strs[key]; ok {
+				str, ok := val.(string)
+				if !ok {
+					return nil, fmt.Errorf("Invalid route %d: %s must be a string", idx+1, key)
+				}
+				*field = str
+			} else if field, ok := ints[key]; ok {
+				num, ok := val.(int64)
+				if !ok || num < 1 {
+					return nil, fmt.Errorf("Invalid route %d: %s must be a positive integer", idx+1, key)
+				}
+				*field = int(num)
+			} else {
+				return nil, fmt.Errorf("Invalid route %d: %s is not a known route setting", idx+1, key)
+			}
+		}
+		list = append(list, route)
+	}
+	return manager.NewRoutes(list...)
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRoutes(t *testing.T) {
+	parsed, err := parseRoutes(aclConfig(t, `
+[[route]]
+jobtype = "SyncCustomer"
+to = "customers_{shard}"
+shard_by = "0.customer_id"
+shards = 8
+
+[[route]]
+queue = "default"
+min_bytes = 65536
+to = "oversized"
+`)["route"])
+	assert.NoError(t, err)
+	assert.Len(t, parsed, 2)
+	assert.Equal(t, 65536, parsed[1].MinBytes)
+
+	r := &routes{routes: parsed}
+	queue, err := r.Route(client.NewJob("SyncCustomer", map[string]interface{}{"customer_id": "acme"}))
+	assert.NoError(t, err)
+	assert.Contains(t, queue, "customers_")
+	queue, err = r.Route(client.NewJob("Report", 1))
+	assert.NoError(t, err)
+	assert.Equal(t, "", queue)
+
+	parsed, err = parseRoutes(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, parsed)
+
+	for _, bad := range []string{
+		"[route]\nto = \"low\"",
+		"[[route]]\nto = 1",
+		"[[route]]\nto = \"low\"\nmin_bytes = 0",
+		"[[route]]\nto = \"low\"\npriority = 5",
+		"[[route]]\njobtype = \"Report\"",
+		"[[route]]\nto = \"customers_{shard}\"\nshard_by = \"0\"",
+	} {
+		_, err = parseRoutes(aclConfig(t, bad)["route"])
+		assert.Error(t, err, bad)
+	}
+}
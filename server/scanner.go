@@ -4,6 +4,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/contribsys/faktory/manager"
 	"github.com/contribsys/faktory/storage"
 	"github.com/contribsys/faktory/util"
 )
@@ -17,6 +18,7 @@ type scanner struct {
 	jobs     int64
 	cycles   int64
 	walltime int64
+	behind   bool
 }
 
 func (s *scanner) Name() string {
@@ -27,7 +29,8 @@ func (s *scanner) Execute() error {
 	start := time.Now()
 
 	count, err := s.task()
-	if err != nil {
+	s.behind = err == manager.ErrMoreDue
+	if err != nil && !s.behind {
 		return err
 	}
 
@@ -42,6 +45,11 @@ func (s *scanner) Execute() error {
 	return nil
 }
 
+// Whether the last pass left due jobs for the next.
+func (s *scanner) Behind() bool {
+	return s.behind
+}
+
 func (s *scanner) Stats() map[string]interface{} {
 	return map[string]interface{}{
 		"enqueued":      atomic.LoadInt64(&s.jobs),
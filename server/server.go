@@ -1,14 +1,17 @@
 package server
 
 import (
-	"bufio"
 	"crypto/sha256"
 	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
 	"os"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,44 +27,156 @@ import (
 type RuntimeStats struct {
 	Connections uint64
 	Commands    uint64
+	Rejected    uint64
+	Throttled   uint64
 	StartedAt   time.Time
+
+	// connections accepted by the non-admin listeners, including
+	// those still handshaking, see ServerOptions.MaxConnections
+	open uint64
 }
 
 type Server struct {
+	// The options the server was created with, ReloadOptions leaves
+	// them as they are, see CurrentOptions.
 	Options    *ServerOptions
 	Stats      *RuntimeStats
 	Subsystems []Subsystem
 
-	listener   net.Listener
-	store      storage.Store
-	manager    manager.Manager
-	workers    *workers
-	taskRunner *taskRunner
-	mu         sync.Mutex
-	stopper    chan bool
-	closed     bool
+	started     []Subsystem
+	endpoints   []endpoint
+	throttle    ipThrottle
+	conns       connections
+	certs       *certLoader
+	store       storage.Store
+	manager     manager.Manager
+	workers     *workers
+	taskRunner  *taskRunner
+	deadPruner  *deadPruner
+	acl         *aclSubsystem
+	limits      *queueLimits
+	queues      *queueSettings
+	backoffs    *backoffs
+	deadLetters *deadLetters
+	webhooks    *webhooks
+	routes      *routes
+	audit       *auditLog
+	slowlog     slowLog
+	latencies   commandLatencies
+	events      eventBus
+	mu          sync.Mutex
+	stopper     chan bool
+	closed      bool
+
+	// whether Register starts subsystems immediately, guarded by mu
+	subsystemsRunning bool
+
+	// the *ServerOptions published by ReloadOptions, see
+	// CurrentOptions, one reload at a time
+	options  atomic.Value
+	reloadMu sync.Mutex
+
+	// see RegisterCommand
+	cmdMu    sync.RWMutex
+	commands map[string]command
+
+	// see OnFetch, the hooks are a []func(*client.Job) so FETCH
+	// needn't lock to read them
+	hookMu     sync.Mutex
+	fetchHooks atomic.Value
 }
 
 func NewServer(opts *ServerOptions) (*Server, error) {
-	if opts.Binding == "" {
-		opts.Binding = "localhost:7419"
-	}
-	if opts.StorageDirectory == "" {
+	if opts.StorageDirectory == "" && (opts.StorageDriver == "" || opts.StorageDriver == "redis") {
 		return nil, fmt.Errorf("empty storage directory")
 	}
+	opts.setDefaults()
+	err := opts.loadPassword()
+	if err != nil {
+		return nil, err
+	}
+	err = checkFetchOrder(opts.FetchOrder)
+	if err != nil {
+		return nil, err
+	}
+	_, err = manager.ParseJitter(opts.RetryJitter)
+	if err != nil {
+		return nil, err
+	}
+	err = checkDeadOverflow(opts.DeadOverflow)
+	if err != nil {
+		return nil, err
+	}
+	err = opts.checkTaskIntervals()
+	if err != nil {
+		return nil, err
+	}
+	err = checkCompressEncoding(opts.CompressEncoding)
+	if err != nil {
+		return nil, err
+	}
+	if opts.StorageDriver != "" && opts.StorageDriver != "redis" {
+		if _, ok := storage.LookupDriver(opts.StorageDriver); !ok {
+			return nil, fmt.Errorf("Unknown storage_driver %s, registered drivers are %s", opts.StorageDriver, strings.Join(storage.Drivers(), ", "))
+		}
+		if opts.RedisURL != "" || len(opts.RedisCluster) > 0 {
+			return nil, fmt.Errorf("storage_driver %s can't use redis_url or redis_cluster", opts.StorageDriver)
+		}
+	}
+	if len(opts.RedisSentinels) > 0 && opts.RedisURL == "" {
+		return nil, fmt.Errorf("redis_sentinels needs a redis_url naming the master")
+	}
+	if len(opts.RedisSentinels) > 0 && len(opts.RedisCluster) > 0 {
+		return nil, fmt.Errorf("Use either redis_sentinels or redis_cluster, not both")
+	}
+	if opts.RedisKeyPrefix != "" && opts.RedisURL == "" && len(opts.RedisCluster) == 0 {
+		return nil, fmt.Errorf("redis_key_prefix needs a redis_url or redis_cluster")
+	}
+	err = checkRedisTLS(opts)
+	if err != nil {
+		return nil, err
+	}
 
+	acl := &aclSubsystem{}
+	limits := &queueLimits{}
+	queues := &queueSettings{}
+	backoffs := &backoffs{}
+	deadLetters := &deadLetters{}
+	webhooks := &webhooks{}
+	routes := &routes{}
+	audit := &auditLog{}
 	s := &Server{
 		Options:    opts,
 		Stats:      &RuntimeStats{StartedAt: time.Now()},
-		Subsystems: []Subsystem{},
-
-		stopper: make(chan bool),
-		closed:  false,
+		Subsystems: []Subsystem{audit, acl, limits, queues, backoffs, routes, &encryption{}, &cronSubsystem{}, deadLetters, webhooks, &backupShipping{}},
+
+		acl:         acl,
+		limits:      limits,
+		queues:      queues,
+		backoffs:    backoffs,
+		deadLetters: deadLetters,
+		webhooks:    webhooks,
+		routes:      routes,
+		audit:       audit,
+		stopper:     make(chan bool),
+		closed:      false,
 	}
 
 	return s, nil
 }
 
+// CurrentOptions returns the options as of the last ReloadOptions, or
+// Options if there hasn't been one.  Reloads publish a new copy
+// rather than changing Options so anything which can change, e.g.
+// Password or GlobalConfig, must be read from here.  The returned
+// options must not be modified.
+func (s *Server) CurrentOptions() *ServerOptions {
+	if opts, ok := s.options.Load().(*ServerOptions); ok {
+		return opts
+	}
+	return s.Options
+}
+
 func (s *Server) Heartbeats() map[string]*ClientData {
 	return s.workers.heartbeats
 }
@@ -75,7 +190,11 @@ func (s *Server) Manager() manager.Manager {
 }
 
 func (s *Server) Reload() {
-	for _, x := range s.Subsystems {
+	s.mu.Lock()
+	started := s.started
+	s.mu.Unlock()
+
+	for _, x := range started {
 		err := x.Reload(s)
 		if err != nil {
 			util.Warnf("Subsystem %v returned reload error: %v", x, err)
@@ -83,17 +202,110 @@ func (s *Server) Reload() {
 	}
 }
 
+// ReloadOptions applies any changes in opts which are safe to make
+// while running, logs the changes which need a restart, re-reads the
+// TLS certificate and then reloads each subsystem.  Returns the names
+// of the applied options.
+//
+// The changes are made to a copy of the current options which then
+// replaces them, see CurrentOptions.
+func (s *Server) ReloadOptions(opts *ServerOptions) []string {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	current := s.CurrentOptions()
+
+	opts.setDefaults()
+	err := opts.loadPassword()
+	if err != nil {
+		util.Warnf("%v, keeping the current password", err)
+		opts.Password = current.Password
+	}
+	err = checkFetchOrder(opts.FetchOrder)
+	if err != nil {
+		util.Warnf("%v, keeping the current order", err)
+		opts.FetchOrder = current.FetchOrder
+	}
+	_, err = manager.ParseJitter(opts.RetryJitter)
+	if err != nil {
+		util.Warnf("%v, keeping the current jitter", err)
+		opts.RetryJitter = current.RetryJitter
+	}
+	err = checkDeadOverflow(opts.DeadOverflow)
+	if err != nil {
+		util.Warnf("%v, keeping the current overflow", err)
+		opts.DeadOverflow = current.DeadOverflow
+	}
+	err = checkCompressEncoding(opts.CompressEncoding)
+	if err != nil {
+		util.Warnf("%v, keeping the current encoding", err)
+		opts.CompressEncoding = current.CompressEncoding
+	}
+
+	applied := []string{}
+	next := *current
+	reloaded := reflect.ValueOf(&next).Elem()
+	updated := reflect.ValueOf(opts).Elem()
+	for _, name := range current.Diff(opts) {
+		if !reloadableOptions[name] {
+			util.Warnf("Ignoring change to %s, restart Faktory to apply it", name)
+			continue
+		}
+		reloaded.FieldByName(name).Set(updated.FieldByName(name))
+		applied = append(applied, name)
+		util.Infof("Reloaded %s", name)
+	}
+	next.GlobalConfig = opts.GlobalConfig
+	s.options.Store(&next)
+
+	s.reloadCertificate()
+	s.Reload()
+	s.Audit("config reload", map[string]interface{}{"applied": applied})
+	return applied
+}
+
 func (s *Server) AddTask(everySec int64, task Taskable) {
-	s.taskRunner.AddTask(everySec, task)
+	s.taskRunner.AddTask(time.Duration(everySec)*time.Second, task)
+}
+
+func (s *Server) openStore() (storage.Store, error) {
+	if s.Options.StorageDriver != "" && s.Options.StorageDriver != "redis" {
+		return storage.Open(s.Options.StorageDriver, s.Options.StoragePath())
+	}
+	if s.Options.RedisURL == "" && len(s.Options.RedisCluster) == 0 {
+		return storage.Open("redis", s.Options.RedisSock)
+	}
+
+	config, err := redisTLSConfig(s.Options)
+	if err != nil {
+		return nil, err
+	}
+	return storage.OpenRedisWith(storage.RedisOptions{
+		URL:       s.Options.RedisURL,
+		Sentinels: s.Options.RedisSentinels,
+		Cluster:   s.Options.RedisCluster,
+		TLSConfig: config,
+		Username:  s.Options.RedisUsername,
+		Password:  s.Options.RedisPassword,
+		KeyPrefix: s.Options.RedisKeyPrefix,
+	})
 }
 
 func (s *Server) Boot() error {
-	store, err := storage.Open("redis", s.Options.RedisSock)
+	store, err := s.openStore()
 	if err != nil {
 		return err
 	}
 
-	listener, err := net.Listen("tcp", s.Options.Binding)
+	var certs *certLoader
+	if s.Options.TLSCertFile != "" || s.Options.TLSKeyFile != "" || s.Options.TLSClientCAFile != "" {
+		certs, err = newCertLoader(s.Options.TLSCertFile, s.Options.TLSKeyFile, s.Options.TLSClientCAFile)
+		if err != nil {
+			store.Close()
+			return err
+		}
+	}
+
+	endpoints, err := s.listenAll(certs)
 	if err != nil {
 		store.Close()
 		return err
@@ -102,8 +314,20 @@ func (s *Server) Boot() error {
 	s.mu.Lock()
 	s.store = store
 	s.workers = newWorkers()
-	s.manager = manager.NewManager(store)
-	s.listener = listener
+	s.manager = manager.NewManagerWithOptions(store, manager.Options{
+		MaxChainDepth:   s.Options.MaxChainDepth,
+		QueueLimit:      s.queueLimit,
+		Throttle:        s.queueThrottle,
+		MaxConcurrency:  s.queueMaxConcurrency,
+		Backoff:         s.jobBackoff,
+		RetryJitter:     s.retryJitter,
+		DeadLimit:       s.deadLimit,
+		OnDeath:         s.jobDied,
+		OnBatchComplete: s.batchCompleted,
+		Router:          s.routes,
+	})
+	s.endpoints = endpoints
+	s.certs = certs
 	s.stopper = make(chan bool)
 	s.startTasks()
 	s.mu.Unlock()
@@ -116,23 +340,123 @@ func (s *Server) Run() error {
 		panic("Server hasn't been booted")
 	}
 
-	for _, x := range s.Subsystems {
-		err := x.Start(s)
+	err := s.startSubsystems()
+	if err != nil {
+		return err
+	}
+
+	// the first endpoint is Binding, served by this goroutine
+	for _, ep := range s.endpoints[1:] {
+		if ep.admin {
+			util.Infof("Admin commands available at %s", ep.binding)
+		} else {
+			util.Infof("Also listening at %s", ep.binding)
+		}
+		go s.serve(ep.listener, ep.admin)
+	}
+	if s.certs != nil {
+		util.Infof("Using TLS certificate %s", s.certs.certFile)
+	}
+	util.Infof("PID %d listening at %s, press Ctrl-C to stop", os.Getpid(), s.Options.Binding)
+	s.serve(s.endpoints[0].listener, false)
+	return nil
+}
+
+// An address the server accepts connections at.
+type endpoint struct {
+	binding  string
+	listener net.Listener
+	admin    bool
+}
+
+// Listen at Binding and any other configured addresses, Binding
+// first.  Bindings are served exactly like Binding, while the admin
+// binding and Unix socket never use TLS or the PROXY protocol.
+func (s *Server) listenAll(certs *certLoader) ([]endpoint, error) {
+	endpoints := []endpoint{}
+	add := func(binding string, admin bool, wrap bool) error {
+		listener, err := listen(binding)
 		if err != nil {
 			return err
 		}
+		if wrap && s.Options.ProxyProtocol {
+			listener = &proxyListener{listener}
+		}
+		if wrap && certs != nil {
+			listener = tls.NewListener(listener, certs.config())
+		}
+		endpoints = append(endpoints, endpoint{binding: binding, listener: listener, admin: admin})
+		return nil
 	}
 
-	util.Infof("PID %d listening at %s, press Ctrl-C to stop", os.Getpid(), s.Options.Binding)
+	err := add(s.Options.Binding, false, true)
+	for _, binding := range s.Options.Bindings {
+		if err == nil {
+			err = add(binding, false, true)
+		}
+	}
+	if err == nil && s.Options.AdminBinding != "" {
+		err = add(s.Options.AdminBinding, true, false)
+	}
+	if err == nil && s.Options.UnixSocket != "" {
+		err = add("unix://"+s.Options.UnixSocket, false, false)
+	}
+	if err != nil {
+		for _, ep := range endpoints {
+			ep.listener.Close()
+		}
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+// Listen on a TCP address or, given "unix:///path/to.sock", a Unix
+// socket.  A socket file left behind by a crashed server is replaced.
+func listen(binding string) (net.Listener, error) {
+	if !strings.HasPrefix(binding, "unix://") {
+		return net.Listen("tcp", binding)
+	}
+
+	path := strings.TrimPrefix(binding, "unix://")
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is already in use", binding)
+		}
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
 
-	// this is the runtime loop for the command server
+// this is the runtime loop for the command server
+func (s *Server) serve(listener net.Listener, admin bool) {
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
-			return nil
+			return
+		}
+		// admin connections don't count so an operator can always
+		// get in to see what's going on
+		if !admin {
+			open := atomic.AddUint64(&s.Stats.open, 1)
+			max := s.CurrentOptions().MaxConnections
+			if max > 0 && open > uint64(max) {
+				atomic.AddUint64(&s.Stats.open, ^uint64(0))
+				atomic.AddUint64(&s.Stats.Rejected, 1)
+				go func(conn net.Conn) {
+					err := newTaggedError("MAXCONN", fmt.Errorf("Too many connections, limit is %d", max))
+					rejectConnection(conn, err)
+					util.Warnf("Rejected connection from %s, already at max_connections %d", conn.RemoteAddr(), max)
+				}(conn)
+				continue
+			}
 		}
 		go func(conn net.Conn) {
-			c := startConnection(conn, s)
+			if !admin {
+				defer atomic.AddUint64(&s.Stats.open, ^uint64(0))
+			}
+			c := startConnection(conn, s, admin)
 			if c == nil {
 				return
 			}
@@ -142,16 +466,31 @@ func (s *Server) Run() error {
 	}
 }
 
+// Reply to a connection we won't serve with err and hang up.
+func rejectConnection(conn net.Conn, err *taggedError) {
+	conn.SetDeadline(time.Now().Add(1 * time.Second))
+	conn.Write([]byte("-" + err.Error() + "\r\n"))
+	conn.Close()
+}
+
 func (s *Server) Stopper() chan bool {
 	return s.stopper
 }
 
+// Draining is true once Stop has been called: the server isn't
+// accepting connections and is shutting down.
+func (s *Server) Draining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
 func (s *Server) Stop(f func()) {
 	// Don't allow new network connections
 	s.mu.Lock()
 	s.closed = true
-	if s.listener != nil {
-		s.listener.Close()
+	for _, ep := range s.endpoints {
+		ep.listener.Close()
 	}
 	s.mu.Unlock()
 
@@ -161,6 +500,7 @@ func (s *Server) Stop(f func()) {
 		f()
 	}
 
+	s.stopSubsystems()
 	s.store.Close()
 }
 
@@ -184,16 +524,98 @@ func hash(pwd, salt string, iterations int) string {
 	return fmt.Sprintf("%x", hash)
 }
 
-func startConnection(conn net.Conn, s *Server) *Connection {
+// Nonces are remembered for a short time so the same HELLO
+// can't be accepted twice.
+const nonceTTL = 60 * time.Second
+
+// The server's passwords followed by the producer and consumer
+// passwords and those of the ACL users.
+func (s *Server) credentials() []credential {
+	opts := s.CurrentOptions()
+	creds := []credential{}
+	for _, password := range opts.passwords() {
+		creds = append(creds, credential{password: password})
+	}
+	if opts.ProducerPassword != "" {
+		creds = append(creds, credential{user: producerUser, password: opts.ProducerPassword})
+	}
+	if opts.ConsumerPassword != "" {
+		creds = append(creds, credential{user: consumerUser, password: opts.ConsumerPassword})
+	}
+	if s.acl != nil {
+		creds = append(creds, s.acl.credentials()...)
+	}
+	return creds
+}
+
+func verifyNonce(s *Server, given string, expected string) error {
+	if given == "" {
+		return fmt.Errorf("Missing nonce")
+	}
+	if subtle.ConstantTimeCompare([]byte(given), []byte(expected)) != 1 {
+		return fmt.Errorf("Unexpected nonce %q", given)
+	}
+	fresh, err := s.store.Raw().SetNX("nonce:"+given, []byte("1"), nonceTTL)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return fmt.Errorf("Replayed nonce %q", given)
+	}
+	return nil
+}
+
+func startConnection(conn net.Conn, s *Server, admin bool) (cn *Connection) {
 	// handshake must complete within 1 second
 	conn.SetDeadline(time.Now().Add(1 * time.Second))
 
+	if pc, ok := conn.(*proxyConn); ok {
+		err := pc.readHeader()
+		if err != nil {
+			util.Info(err.Error())
+			conn.Close()
+			return nil
+		}
+	}
+
+	// throttle before the TLS handshake and password hashing, the
+	// expensive part of a connection
+	if !admin && !s.allowConnection(conn.RemoteAddr()) {
+		atomic.AddUint64(&s.Stats.Throttled, 1)
+		util.Debugf("Throttled connection from %s", conn.RemoteAddr())
+		rejectConnection(conn, newTaggedError("THROTTLED", fmt.Errorf("Too many connections from %s, try again later", conn.RemoteAddr())))
+		return nil
+	}
+
+	var identity string
+	if tc, ok := conn.(*tls.Conn); ok {
+		err := tc.Handshake()
+		if err != nil {
+			util.Infof("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return nil
+		}
+		identity = certIdentity(tc.ConnectionState())
+	}
+
 	// 4000 iterations is about 1ms on my 2016 MBP w/ 2.9Ghz Core i5
 	iter := rand.Intn(4096) + 4000
 
+	nonce, err := util.RandomNonce()
+	if err != nil {
+		util.Error("Unable to generate a nonce", err)
+		rejectConnection(conn, newTaggedError("ERR", fmt.Errorf("Unable to generate a nonce")))
+		return nil
+	}
+
 	var salt string
-	conn.Write([]byte(`+HI {"v":2`))
-	if s.Options.Password != "" {
+	creds := s.credentials()
+	conn.Write([]byte(`+HI {"v":3,"nonce":"`))
+	conn.Write([]byte(nonce))
+	conn.Write([]byte(`","features":`))
+	features, _ := json.Marshal(s.Features())
+	conn.Write(features)
+	if len(creds) > 0 {
 		conn.Write([]byte(`,"i":`))
 		iters := strconv.FormatInt(int64(iter), 10)
 		conn.Write([]byte(iters))
@@ -206,7 +628,13 @@ func startConnection(conn net.Conn, s *Server) *Connection {
 	}
 	conn.Write([]byte("\r\n"))
 
-	buf := bufio.NewReader(conn)
+	buf := pooledReader(conn)
+	defer func() {
+		if cn == nil {
+			buf.Reset(nil)
+			readerPool.Put(buf)
+		}
+	}()
 
 	line, err := buf.ReadString('\n')
 	if err != nil {
@@ -217,7 +645,7 @@ func startConnection(conn net.Conn, s *Server) *Connection {
 
 	valid := strings.HasPrefix(line, "HELLO {")
 	if !valid {
-		util.Infof("Invalid preamble: %s", line)
+		util.Infof("Invalid preamble from %s: %s", conn.RemoteAddr(), line)
 		util.Info("Need a valid HELLO")
 		conn.Close()
 		return nil
@@ -229,23 +657,55 @@ func startConnection(conn net.Conn, s *Server) *Connection {
 		conn.Close()
 		return nil
 	}
+	client.Identity = identity
+	client.Address = conn.RemoteAddr().String()
+
+	if client.Nonce != "" || s.CurrentOptions().RequireNonce {
+		err := verifyNonce(s, client.Nonce, nonce)
+		if err != nil {
+			util.Infof("Rejecting HELLO: %v", err)
+			conn.Write([]byte("-ERR Invalid nonce\r\n"))
+			conn.Close()
+			return nil
+		}
+	}
 
-	if s.Options.Password != "" {
+	// the admin port relies on network access control instead
+	var aclUser string
+	if len(creds) > 0 && !admin {
 		if client.Version < 2 {
 			iter = 1
 		}
 
-		if subtle.ConstantTimeCompare([]byte(client.PasswordHash), []byte(hash(s.Options.Password, salt, iter))) != 1 {
+		// v3+ clients mix the nonce into the hash so a captured
+		// HELLO is useless on any other connection.
+		pwdsalt := salt
+		if client.Nonce != "" {
+			pwdsalt = salt + client.Nonce
+		}
+
+		valid := false
+		for _, cred := range creds {
+			if subtle.ConstantTimeCompare([]byte(client.PasswordHash), []byte(hash(cred.password, pwdsalt, iter))) == 1 && !valid && cred.accepts(client) {
+				valid = true
+				aclUser = cred.user
+			}
+		}
+		if !valid {
 			conn.Write([]byte("-ERR Invalid password\r\n"))
 			conn.Close()
 			return nil
 		}
 	}
 
-	cn := &Connection{
-		client: client,
-		conn:   conn,
-		buf:    buf,
+	cn = &Connection{
+		client:  client,
+		conn:    conn,
+		buf:     buf,
+		isAdmin: admin,
+		aclUser: aclUser,
+
+		connectedAt: time.Now(),
 	}
 
 	if client.Wid == "" {
@@ -271,11 +731,24 @@ func startConnection(conn net.Conn, s *Server) *Connection {
 func (s *Server) processLines(conn *Connection) {
 	atomic.AddUint64(&s.Stats.Connections, 1)
 	defer atomic.AddUint64(&s.Stats.Connections, ^uint64(0))
+	s.conns.add(conn)
+	defer s.conns.remove(conn)
+	conn.out = pooledWriter(conn.conn)
+	defer conn.release()
 
 	for {
-		cmd, e := conn.buf.ReadString('\n')
+		// consumers are exempt, the heartbeat reaper closes their
+		// connections once they stop sending BEAT
+		if idle := s.CurrentOptions().IdleTimeout; idle > 0 && conn.client.Wid == "" {
+			if nc, ok := conn.conn.(net.Conn); ok {
+				nc.SetReadDeadline(time.Now().Add(idle))
+			}
+		}
+		line, e := conn.readLine()
 		if e != nil {
-			if e != io.EOF {
+			if ne, ok := e.(net.Error); ok && ne.Timeout() {
+				util.Debugf("Closing idle connection from %s", conn.client.Address)
+			} else if e != io.EOF {
 				util.Error("Unexpected socket error", e)
 			}
 			conn.Close()
@@ -283,28 +756,53 @@ func (s *Server) processLines(conn *Connection) {
 		}
 		if s.closed {
 			conn.Error("Closing connection", newTaggedError("SHUTDOWN", fmt.Errorf("Shutdown in progress")))
+			conn.flush()
 			conn.Close()
 			return
 		}
-		cmd = strings.TrimSuffix(cmd, "\r\n")
-		cmd = strings.TrimSuffix(cmd, "\n")
-		//util.Debug(cmd)
-
-		idx := strings.Index(cmd, " ")
-		verb := cmd
-		if idx >= 0 {
-			verb = cmd[0:idx]
+		//util.Debug(string(line))
+
+		req := parseRequest(line)
+		verb, proc, raw, ok := s.command(req.verb)
+		// only string commands, and checking an ACL user may run
+		// the command, need a copy of the line
+		var cmd string
+		if !ok || proc != nil || conn.aclUser != "" {
+			cmd = string(line)
 		}
-		proc, ok := cmdSet[verb]
 		if !ok {
 			conn.Error(cmd, fmt.Errorf("Unknown command %s", verb))
+		} else if err := s.checkAccess(conn, verb); err != nil {
+			conn.Error(cmd, err)
+		} else if err := s.authorize(conn, verb, cmd); err != nil {
+			conn.Error(cmd, err)
 		} else {
-			atomic.AddUint64(&s.Stats.Commands, 1)
-			proc(conn, s, cmd)
+			if !uncountedCommands[verb] {
+				atomic.AddUint64(&s.Stats.Commands, 1)
+			}
+			conn.recordCommand(verb)
+			conn.waited = false
+			start := time.Now()
+			if raw != nil {
+				raw(conn, s, req)
+			} else {
+				proc(conn, s, cmd)
+			}
+			elapsed := time.Since(start)
+			if !conn.waited {
+				s.latencies.record(verb, elapsed)
+			}
+			s.checkSlow(conn, verb, elapsed)
 		}
 		if verb == "END" {
 			break
 		}
+		err := conn.flush()
+		if err != nil {
+			util.Error("Unexpected socket error", err)
+			conn.Close()
+			return
+		}
 	}
 }
 
@@ -312,34 +810,74 @@ func (s *Server) uptimeInSeconds() int {
 	return int(time.Since(s.Stats.StartedAt).Seconds())
 }
 
+// The queues and jobs on each shard, so a shard filling up can be
+// spotted.
+func shardState(sharded storage.Sharded) []map[string]interface{} {
+	shards := []map[string]interface{}{}
+	for _, shard := range sharded.Shards() {
+		queued := 0
+		queues := 0
+		shard.Store.EachQueue(func(q storage.Queue) {
+			queued += int(q.Size())
+			queues++
+		})
+		shards = append(shards, map[string]interface{}{
+			"name":           shard.Name,
+			"total_enqueued": queued,
+			"total_queues":   queues,
+		})
+	}
+	return shards
+}
+
 func (s *Server) CurrentState() (map[string]interface{}, error) {
 	defalt, err := s.store.GetQueue("default")
 	if err != nil {
 		return nil, err
 	}
 
+	pruned, oldestDead := s.deadPruner.lastRun()
+
 	totalQueued := 0
 	totalQueues := 0
+	paused := []string{}
 	// queue size is cached so this should be very efficient.
 	s.store.EachQueue(func(q storage.Queue) {
 		totalQueued += int(q.Size())
 		totalQueues++
+		if q.IsPaused() {
+			paused = append(paused, q.Name())
+		}
 	})
+	sort.Strings(paused)
+
+	faktory := map[string]interface{}{
+		"default_size":    defalt.Size(),
+		"total_failures":  s.store.TotalFailures(),
+		"total_processed": s.store.TotalProcessed(),
+		"total_enqueued":  totalQueued,
+		"total_queues":    totalQueues,
+		"paused_queues":   paused,
+		"tasks":           s.taskRunner.Stats(),
+
+		"dead_jobs_pruned_last_run": pruned,
+		"dead_jobs_oldest_at":       oldestDead,
+	}
+	if sharded, ok := s.store.(storage.Sharded); ok {
+		faktory["shards"] = shardState(sharded)
+	}
 
 	return map[string]interface{}{
 		"server_utc_time": time.Now().UTC().Format("03:04:05 UTC"),
-		"faktory": map[string]interface{}{
-			"default_size":    defalt.Size(),
-			"total_failures":  s.store.TotalFailures(),
-			"total_processed": s.store.TotalProcessed(),
-			"total_enqueued":  totalQueued,
-			"total_queues":    totalQueues,
-			"tasks":           s.taskRunner.Stats()},
+		"faktory":         faktory,
 		"server": map[string]interface{}{
-			"faktory_version": client.Version,
-			"uptime":          s.uptimeInSeconds(),
-			"connections":     atomic.LoadUint64(&s.Stats.Connections),
-			"command_count":   atomic.LoadUint64(&s.Stats.Commands),
-			"used_memory_mb":  util.MemoryUsage()},
+			"faktory_version":       client.Version,
+			"uptime":                s.uptimeInSeconds(),
+			"connections":           atomic.LoadUint64(&s.Stats.Connections),
+			"command_count":         atomic.LoadUint64(&s.Stats.Commands),
+			"rejected_connections":  atomic.LoadUint64(&s.Stats.Rejected),
+			"throttled_connections": atomic.LoadUint64(&s.Stats.Throttled),
+			"command_latency":       s.latencies.stats(),
+			"used_memory_mb":        util.MemoryUsage()},
 	}, nil
 }
@@ -2,21 +2,37 @@ package server
 
 import (
 	"bufio"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	alog "github.com/apex/log"
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/manager"
 	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/storage/memory"
+	"github.com/contribsys/faktory/util"
 	"github.com/stretchr/testify/assert"
 )
 
 func runServer(binding string, runner func()) {
+	runServerWith(binding, nil, func(s *Server) { runner() })
+}
+
+// runServerWith boots a server after letting configure modify
+// its options and passes the running Server to runner.
+func runServerWith(binding string, configure func(*ServerOptions), runner func(*Server)) {
 	dir := fmt.Sprintf("/tmp/%s", strings.Replace(binding, ":", "_", 1))
 	defer os.RemoveAll(dir)
 
@@ -33,6 +49,9 @@ func runServer(binding string, runner func()) {
 		RedisSock:        sock,
 		ConfigDirectory:  os.ExpandEnv("$HOME/.faktory"),
 	}
+	if configure != nil {
+		configure(opts)
+	}
 	s, err := NewServer(opts)
 	if err != nil {
 		panic(err)
@@ -48,7 +67,8 @@ func runServer(binding string, runner func()) {
 			panic(err)
 		}
 	}()
-	runner()
+	runner(s)
+	close(s.Stopper())
 	s.Stop(nil)
 }
 
@@ -135,6 +155,1129 @@ func TestServerStart(t *testing.T) {
 
 }
 
+func TestPushTo(t *testing.T) {
+	runServer("localhost:7421", func() {
+		conn, buf := handshake(t, "localhost:7421")
+		defer conn.Close()
+
+		conn.Write([]byte("PUSHTO alpha beta gamma -- {\"jobtype\":\"Thing\",\"args\":[123]}\r\n"))
+		result, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Regexp(t, `\A\+3 \S+,\S+,\S+\r\n\z`, result)
+		jids := strings.Split(strings.TrimSpace(result[3:]), ",")
+
+		seen := map[string]bool{}
+		for idx, queue := range []string{"alpha", "beta", "gamma"} {
+			conn.Write([]byte("FETCH " + queue + "\r\n"))
+			_, err = buf.ReadString('\n')
+			assert.NoError(t, err)
+			result, err = buf.ReadString('\n')
+			assert.NoError(t, err)
+
+			var job map[string]interface{}
+			err = json.Unmarshal([]byte(result), &job)
+			assert.NoError(t, err)
+			assert.Equal(t, jids[idx], job["jid"])
+			assert.Equal(t, queue, job["queue"])
+			assert.Equal(t, "Thing", job["jobtype"])
+			assert.Equal(t, []interface{}{float64(123)}, job["args"])
+			seen[job["jid"].(string)] = true
+		}
+		assert.Equal(t, 3, len(seen))
+
+		conn.Write([]byte("PUSHTO alpha {\"jobtype\":\"Thing\",\"args\":[123]}\r\n"))
+		result, err = buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Regexp(t, `\A-ERR Invalid PUSHTO`, result)
+	})
+}
+
+// The memory driver boots a server without Redis or a storage
+// directory.
+func TestMemoryStorage(t *testing.T) {
+	s, err := NewServer(&ServerOptions{
+		Binding:         "localhost:7458",
+		StorageDriver:   "memory",
+		ConfigDirectory: os.ExpandEnv("$HOME/.faktory"),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Boot())
+	go func() {
+		err := s.Run()
+		if err != nil {
+			panic(err)
+		}
+	}()
+	defer func() {
+		close(s.Stopper())
+		s.Stop(nil)
+	}()
+
+	conn, buf := handshake(t, "localhost:7458")
+	defer conn.Close()
+	conn.Write([]byte("PUSH {\"jid\":\"memory123\",\"jobtype\":\"Thing\",\"args\":[]}\r\n"))
+	result, err := buf.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n", result)
+
+	conn.Write([]byte("FETCH default\r\n"))
+	_, err = buf.ReadString('\n')
+	assert.NoError(t, err)
+	result, err = buf.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Contains(t, result, `"jid":"memory123"`)
+	assert.EqualValues(t, 0, s.Store().Retries().Size())
+}
+
+type fakeSharded []storage.Shard
+
+func (f fakeSharded) Shards() []storage.Shard {
+	return f
+}
+
+func TestShardState(t *testing.T) {
+	a := memory.Open("shard-a")
+	b := memory.Open("shard-b")
+	q, err := b.GetQueue("busy")
+	assert.NoError(t, err)
+	assert.NoError(t, q.Push(5, []byte(`{"jid":"one"}`)))
+	assert.NoError(t, q.Push(5, []byte(`{"jid":"two"}`)))
+
+	state := shardState(fakeSharded{{Name: "a", Store: a}, {Name: "b", Store: b}})
+	assert.Equal(t, []map[string]interface{}{
+		{"name": "a", "total_enqueued": 0, "total_queues": 0},
+		{"name": "b", "total_enqueued": 2, "total_queues": 1},
+	}, state)
+}
+
+func TestBackupRestore(t *testing.T) {
+	s, err := NewServer(&ServerOptions{
+		Binding:         "localhost:7459",
+		StorageDriver:   "memory",
+		ConfigDirectory: os.ExpandEnv("$HOME/.faktory"),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Boot())
+	go func() {
+		err := s.Run()
+		if err != nil {
+			panic(err)
+		}
+	}()
+	defer func() {
+		close(s.Stopper())
+		s.Stop(nil)
+	}()
+
+	conn, buf := handshake(t, "localhost:7459")
+	defer conn.Close()
+	conn.Write([]byte("PUSH {\"jid\":\"backup123\",\"jobtype\":\"Thing\",\"args\":[]}\r\n"))
+	result, err := buf.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n", result)
+	assert.NoError(t, s.Store().Dead().AddElement(util.Nows(), "dead123", []byte(`{"jid":"dead123","jobtype":"Thing","args":[]}`)))
+
+	conn.Write([]byte("BACKUP\r\n"))
+	_, err = buf.ReadString('\n')
+	assert.NoError(t, err)
+	snapshot, err := buf.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Contains(t, snapshot, `"jid":"backup123"`)
+	assert.Contains(t, snapshot, `"jid":"dead123"`)
+
+	assert.NoError(t, s.Store().Flush())
+	conn.Write([]byte("RESTORE " + snapshot))
+	result, err = buf.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n", result)
+
+	q, err := s.Store().GetQueue("default")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, q.Size())
+	assert.EqualValues(t, 1, s.Store().Dead().Size())
+
+	conn.Write([]byte("RESTORE {\"version\":99}\r\n"))
+	result, err = buf.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Contains(t, result, "Unsupported snapshot version 99")
+}
+
+func TestPushBulk(t *testing.T) {
+	runServer("localhost:7443", func() {
+		conn, buf := handshake(t, "localhost:7443")
+		defer conn.Close()
+
+		conn.Write([]byte(`PUSHB [{"jid":"bulkjob-1","jobtype":"Thing","args":[1]},{"jid":"bulkjob-2","args":[2]},{"jid":"bulkjob-3","jobtype":"Thing","args":[3],"queue":"other"}]` + "\r\n"))
+		_, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		result, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+
+		var results []map[string]string
+		err = json.Unmarshal([]byte(result), &results)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, len(results))
+		assert.Equal(t, map[string]string{"jid": "bulkjob-1"}, results[0])
+		assert.Equal(t, "bulkjob-2", results[1]["jid"])
+		assert.Contains(t, results[1]["error"], "jobtype")
+		assert.Equal(t, map[string]string{"jid": "bulkjob-3"}, results[2])
+
+		for _, queue := range []string{"default", "other"} {
+			conn.Write([]byte("FETCH " + queue + "\r\n"))
+			_, err = buf.ReadString('\n')
+			assert.NoError(t, err)
+			result, err = buf.ReadString('\n')
+			assert.NoError(t, err)
+			assert.Contains(t, result, "bulkjob-")
+		}
+
+		conn.Write([]byte("PUSHB {\"jid\":\"bulk-4\"}\r\n"))
+		result, err = buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Regexp(t, `\A-MALFORMED`, result)
+
+		conn.Write([]byte("PUSHB\r\n"))
+		result, err = buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Contains(t, result, "Invalid PUSHB")
+	})
+}
+
+func TestFetchCount(t *testing.T) {
+	runServer("localhost:7444", func() {
+		conn, buf := handshake(t, "localhost:7444")
+		defer conn.Close()
+
+		for _, jid := range []string{"counted-1", "counted-2"} {
+			conn.Write([]byte(`PUSH {"jid":"` + jid + `","jobtype":"Thing","args":[]}` + "\r\n"))
+			result, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			assert.Equal(t, "+OK\r\n", result)
+		}
+
+		conn.Write([]byte("FETCH COUNT 5 default\r\n"))
+		_, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		result, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		var jobs []map[string]interface{}
+		err = json.Unmarshal([]byte(result), &jobs)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(jobs))
+
+		conn.Write([]byte("FETCH COUNT 101 default\r\n"))
+		result, err = buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Regexp(t, `\A-ERR Invalid FETCH`, result)
+	})
+}
+
+func TestParseFetch(t *testing.T) {
+	req, err := parseFetch("FETCH critical default")
+	assert.NoError(t, err)
+	assert.Equal(t, fetchRequest{queues: []string{"critical", "default"}}, req)
+
+	// without COUNT a number is a queue name
+	req, err = parseFetch("FETCH 5 default")
+	assert.NoError(t, err)
+	assert.Equal(t, fetchRequest{queues: []string{"5", "default"}}, req)
+
+	req, err = parseFetch("FETCH WAIT 20 COUNT 10 default")
+	assert.NoError(t, err)
+	assert.Equal(t, fetchRequest{wait: 20 * time.Second, count: 10, queues: []string{"default"}}, req)
+
+	req, err = parseFetch("FETCH WAIT 5 default")
+	assert.NoError(t, err)
+	assert.Equal(t, fetchRequest{wait: 5 * time.Second, queues: []string{"default"}}, req)
+
+	for _, bad := range []string{"FETCH COUNT 0 default", "FETCH COUNT", "FETCH COUNT ten default", "FETCH WAIT", "FETCH WAIT 0 default", "FETCH WAIT 31 default", "FETCH WAIT soon default"} {
+		_, err = parseFetch(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestHardKill(t *testing.T) {
+	configure := func(opts *ServerOptions) {
+		opts.HardKillTimeout = 1 * time.Second
+	}
+	runServerWith("localhost:7422", configure, func(s *Server) {
+		conn, buf := handshake(t, "localhost:7422")
+		defer conn.Close()
+
+		conn.Write([]byte("PUSH {\"jid\":\"12345678901234567890abcd\",\"jobtype\":\"Thing\",\"args\":[123],\"retry\":5}\r\n"))
+		result, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "+OK\r\n", result)
+
+		conn.Write([]byte("FETCH default\r\n"))
+		_, err = buf.ReadString('\n')
+		assert.NoError(t, err)
+		result, err = buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Contains(t, result, "12345678901234567890abcd")
+		assert.Equal(t, 1, s.Manager().WorkingCount())
+
+		var wid string
+		for _, worker := range s.Heartbeats() {
+			wid = worker.Wid
+			worker.Signal(Terminate)
+		}
+
+		conn.Write([]byte(fmt.Sprintf("BEAT {\"wid\":\"%s\"}\r\n", wid)))
+		_, err = buf.ReadString('\n')
+		assert.NoError(t, err)
+		result, err = buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Contains(t, result, "terminate")
+		assert.False(t, s.Heartbeats()[wid].TerminateSentAt.IsZero())
+
+		// the worker ignores terminate and keeps its connection open
+		killer := &hardKiller{w: s.workers, m: s.manager, options: s.CurrentOptions}
+		err = killer.Execute()
+		assert.NoError(t, err)
+		assert.False(t, s.Heartbeats()[wid].Terminated)
+
+		time.Sleep(1100 * time.Millisecond)
+		err = killer.Execute()
+		assert.NoError(t, err)
+		assert.True(t, s.Heartbeats()[wid].Terminated)
+
+		_, err = buf.ReadString('\n')
+		assert.Error(t, err)
+		assert.Equal(t, 0, s.Manager().WorkingCount())
+		assert.EqualValues(t, 1, s.Store().Retries().Size())
+	})
+}
+
+func TestClientKill(t *testing.T) {
+	runServerWith("localhost:7441", nil, func(s *Server) {
+		conn, buf := handshake(t, "localhost:7441")
+		defer conn.Close()
+
+		conn.Write([]byte("PUSH {\"jid\":\"12345678901234567890abcd\",\"jobtype\":\"Thing\",\"args\":[123],\"retry\":5}\r\n"))
+		result, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "+OK\r\n", result)
+
+		conn.Write([]byte("FETCH default\r\n"))
+		_, err = buf.ReadString('\n')
+		assert.NoError(t, err)
+		result, err = buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Contains(t, result, "12345678901234567890abcd")
+
+		var wid string
+		for _, worker := range s.Heartbeats() {
+			wid = worker.Wid
+		}
+
+		admin, abuf := handshake(t, "localhost:7441")
+		defer admin.Close()
+		admin.Write([]byte("CLIENT KILL WID " + wid + "\r\n"))
+		result, err = abuf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, ":1\r\n", result)
+
+		_, err = buf.ReadString('\n')
+		assert.Error(t, err)
+		assert.Equal(t, 0, s.Manager().WorkingCount())
+		assert.EqualValues(t, 1, s.Store().Retries().Size())
+
+		admin.Write([]byte("CLIENT KILL WID nobody\r\n"))
+		result, err = abuf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, ":0\r\n", result)
+	})
+}
+
+func TestCompression(t *testing.T) {
+	configure := func(opts *ServerOptions) {
+		opts.MinCompressBytes = 1024
+	}
+	runServerWith("localhost:7423", configure, func(s *Server) {
+		conn, buf := handshake(t, "localhost:7423")
+		defer conn.Close()
+
+		big := strings.Repeat("<p>Lorem ipsum dolor sit amet</p>", 1600)
+		job := fmt.Sprintf(`{"jid":"12345678901234567890abcd","jobtype":"Render","args":["%s"]}`, big)
+		assert.True(t, len(job) > 50000)
+
+		conn.Write([]byte("PUSH " + job + "\r\n"))
+		result, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "+OK\r\n", result)
+
+		q, err := s.Store().GetQueue("default")
+		assert.NoError(t, err)
+		q.Each(func(idx int, data []byte) error {
+			assert.True(t, len(data) < len(job)/10, "stored %d bytes", len(data))
+			return nil
+		})
+
+		conn.Write([]byte("FETCH default\r\n"))
+		_, err = buf.ReadString('\n')
+		assert.NoError(t, err)
+		result, err = buf.ReadString('\n')
+		assert.NoError(t, err)
+
+		var fetched map[string]interface{}
+		err = json.Unmarshal([]byte(result), &fetched)
+		assert.NoError(t, err)
+		assert.Equal(t, []interface{}{big}, fetched["args"])
+		assert.Nil(t, fetched["args_encoding"])
+
+		// producers can send the job already compressed
+		zipped, err := util.Gzip([]byte(job))
+		assert.NoError(t, err)
+		conn.Write([]byte("PUSH gzip " + base64.StdEncoding.EncodeToString(zipped) + "\r\n"))
+		result, err = buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "+OK\r\n", result)
+		assert.EqualValues(t, 1, q.Size())
+	})
+}
+
+func TestNonceReplay(t *testing.T) {
+	configure := func(opts *ServerOptions) {
+		opts.Password = "foobar"
+		opts.RequireNonce = true
+	}
+	runServerWith("localhost:7424", configure, func(s *Server) {
+		hello := func(conn net.Conn, buf *bufio.Reader, line []byte) string {
+			conn.Write([]byte("HELLO "))
+			conn.Write(line)
+			conn.Write([]byte("\r\n"))
+			result, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			return result
+		}
+		readHi := func(buf *bufio.Reader) map[string]interface{} {
+			line, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			assert.True(t, strings.HasPrefix(line, "+HI "))
+			var hi map[string]interface{}
+			err = json.Unmarshal([]byte(line[4:]), &hi)
+			assert.NoError(t, err)
+			assert.EqualValues(t, 3, hi["v"])
+			return hi
+		}
+
+		conn, err := net.DialTimeout("tcp", "localhost:7424", 1*time.Second)
+		assert.NoError(t, err)
+		defer conn.Close()
+		buf := bufio.NewReader(conn)
+		hi := readHi(buf)
+
+		nonce := hi["nonce"].(string)
+		salt := hi["s"].(string)
+		iter := int(hi["i"].(float64))
+		client := ClientData{
+			Hostname:     "localhost",
+			Pid:          os.Getpid(),
+			Version:      3,
+			Nonce:        nonce,
+			PasswordHash: hash("foobar", salt+nonce, iter),
+		}
+		captured, err := json.Marshal(client)
+		assert.NoError(t, err)
+		assert.Equal(t, "+OK\r\n", hello(conn, buf, captured))
+
+		// an attacker replays the captured HELLO on a new connection
+		replay, err := net.DialTimeout("tcp", "localhost:7424", 1*time.Second)
+		assert.NoError(t, err)
+		defer replay.Close()
+		rbuf := bufio.NewReader(replay)
+		readHi(rbuf)
+		assert.Equal(t, "-ERR Invalid nonce\r\n", hello(replay, rbuf, captured))
+
+		// old clients without a nonce are rejected too
+		legacy, err := net.DialTimeout("tcp", "localhost:7424", 1*time.Second)
+		assert.NoError(t, err)
+		defer legacy.Close()
+		lbuf := bufio.NewReader(legacy)
+		hi = readHi(lbuf)
+		client = ClientData{
+			Hostname:     "localhost",
+			Pid:          os.Getpid(),
+			Version:      2,
+			PasswordHash: hash("foobar", hi["s"].(string), int(hi["i"].(float64))),
+		}
+		old, err := json.Marshal(client)
+		assert.NoError(t, err)
+		assert.Equal(t, "-ERR Invalid nonce\r\n", hello(legacy, lbuf, old))
+
+		err = verifyNonce(s, nonce, nonce)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "Replayed")
+	})
+}
+
+func TestPasswordRotation(t *testing.T) {
+	s := &Server{
+		Options: &ServerOptions{Password: "old", Passwords: []string{"", "new"}},
+		Stats:   &RuntimeStats{},
+		workers: newWorkers(),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go s.serve(listener, false)
+
+	hello := func(password string) string {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		assert.NoError(t, err)
+		defer conn.Close()
+		buf := bufio.NewReader(conn)
+		line, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		var hi map[string]interface{}
+		err = json.Unmarshal([]byte(line[4:]), &hi)
+		assert.NoError(t, err)
+
+		client := ClientData{
+			Hostname:     "localhost",
+			Version:      2,
+			PasswordHash: hash(password, hi["s"].(string), int(hi["i"].(float64))),
+		}
+		payload, err := json.Marshal(client)
+		assert.NoError(t, err)
+		conn.Write([]byte("HELLO " + string(payload) + "\r\n"))
+		result, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		return result
+	}
+
+	assert.Equal(t, "+OK\r\n", hello("old"))
+	assert.Equal(t, "+OK\r\n", hello("new"))
+	assert.Equal(t, "-ERR Invalid password\r\n", hello("wrong"))
+	assert.Equal(t, "-ERR Invalid password\r\n", hello(""))
+}
+
+func TestQueueOrdering(t *testing.T) {
+	storage.RegisterComparator("deadline", func(a, b storage.JobEntry) int {
+		x, _ := a.Job.GetCustom("deadline")
+		y, _ := b.Job.GetCustom("deadline")
+		return int(x.(float64) - y.(float64))
+	})
+
+	runServerWith("localhost:7425", nil, func(s *Server) {
+		conn, buf := handshake(t, "localhost:7425")
+		defer conn.Close()
+
+		send := func(line string) string {
+			conn.Write([]byte(line + "\r\n"))
+			result, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			return result
+		}
+
+		for _, jid := range []string{"c", "a", "b"} {
+			deadline := map[string]int{"a": 1, "b": 2, "c": 3}[jid]
+			job := fmt.Sprintf(`{"jid":"%s","jobtype":"Thing","args":[],"custom":{"deadline":%d}}`, strings.Repeat(jid, 12), deadline)
+			assert.Equal(t, "+OK\r\n", send("PUSH "+job))
+		}
+
+		assert.Contains(t, send("QUEUE CONFIG default ordering custom nope"), "Unknown ordering")
+		assert.Contains(t, send("QUEUE CONFIG default ordering"), "Invalid QUEUE")
+		assert.Equal(t, "+OK\r\n", send("QUEUE CONFIG default ordering custom deadline"))
+
+		for _, jid := range []string{"a", "b", "c"} {
+			send("FETCH default")
+			result, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			assert.Contains(t, result, strings.Repeat(jid, 12))
+		}
+	})
+}
+
+func TestQueuePause(t *testing.T) {
+	runServerWith("localhost:7445", nil, func(s *Server) {
+		conn, buf := handshake(t, "localhost:7445")
+		defer conn.Close()
+
+		send := func(line string) string {
+			conn.Write([]byte(line + "\r\n"))
+			result, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			return result
+		}
+
+		assert.Equal(t, "+OK\r\n", send("QUEUE PAUSE default"))
+		assert.Equal(t, "+OK\r\n", send(`PUSH {"jid":"paused-1","jobtype":"Thing","args":[]}`))
+		assert.Equal(t, "$-1\r\n", send("FETCH default"))
+
+		state, err := s.CurrentState()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"default"}, state["faktory"].(map[string]interface{})["paused_queues"])
+
+		assert.Contains(t, send("QUEUE PAUSE"), "Invalid QUEUE")
+		assert.Contains(t, send("QUEUE RESUME bad*name"), "queue names must match")
+		assert.Equal(t, "+OK\r\n", send("QUEUE RESUME default"))
+		send("FETCH default")
+		result, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Contains(t, result, "paused-1")
+	})
+}
+
+func TestQueueClearRemove(t *testing.T) {
+	runServerWith("localhost:7446", nil, func(s *Server) {
+		conn, buf := handshake(t, "localhost:7446")
+		defer conn.Close()
+
+		send := func(line string) string {
+			conn.Write([]byte(line + "\r\n"))
+			result, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			return result
+		}
+
+		for _, queue := range []string{"alpha", "alpha", "beta"} {
+			assert.Equal(t, "+OK\r\n", send(`PUSH {"jid":"`+util.RandomJid()+`","jobtype":"Thing","args":[],"queue":"`+queue+`"}`))
+		}
+		assert.Equal(t, "+OK\r\n", send("QUEUE PAUSE beta"))
+
+		assert.Equal(t, ":2\r\n", send("QUEUE CLEAR alpha"))
+		assert.Equal(t, ":0\r\n", send("QUEUE CLEAR alpha"))
+		assert.Equal(t, ":1\r\n", send("QUEUE REMOVE beta"))
+		assert.Contains(t, send("QUEUE REMOVE"), "Invalid QUEUE")
+
+		q, err := s.Store().GetQueue("beta")
+		assert.NoError(t, err)
+		assert.False(t, q.IsPaused())
+		q, err = s.Store().GetQueue("alpha")
+		assert.NoError(t, err)
+		assert.EqualValues(t, 0, q.Size())
+	})
+}
+
+func TestQueueList(t *testing.T) {
+	runServerWith("localhost:7447", nil, func(s *Server) {
+		conn, buf := handshake(t, "localhost:7447")
+		defer conn.Close()
+
+		send := func(line string) string {
+			conn.Write([]byte(line + "\r\n"))
+			result, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			return result
+		}
+
+		for _, queue := range []string{"beta", "alpha", "alpha"} {
+			assert.Equal(t, "+OK\r\n", send(`PUSH {"jid":"`+util.RandomJid()+`","jobtype":"Thing","args":[],"queue":"`+queue+`"}`))
+		}
+		assert.Equal(t, "+OK\r\n", send("QUEUE PAUSE beta"))
+
+		send("QUEUE LIST")
+		result, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		var queues []map[string]interface{}
+		err = json.Unmarshal([]byte(result), &queues)
+		assert.NoError(t, err)
+
+		assert.Equal(t, 2, len(queues))
+		assert.Equal(t, "alpha", queues[0]["name"])
+		assert.EqualValues(t, 2, queues[0]["size"])
+		assert.Equal(t, false, queues[0]["paused"])
+		assert.Equal(t, "fifo", queues[0]["ordering"])
+		assert.True(t, queues[0]["latency"].(float64) >= 0)
+		assert.Contains(t, queues[0], "enqueued_per_sec")
+		assert.Contains(t, queues[0], "dequeued_per_sec")
+		assert.Equal(t, "beta", queues[1]["name"])
+		assert.Equal(t, true, queues[1]["paused"])
+
+		assert.Contains(t, send("QUEUE LIST alpha"), "Invalid QUEUE")
+	})
+}
+
+func TestQueueLimits(t *testing.T) {
+	configure := func(opts *ServerOptions) {
+		opts.GlobalConfig = map[string]interface{}{
+			"queue_limits": map[string]interface{}{"default": int64(2)},
+		}
+	}
+	runServerWith("localhost:7448", configure, func(s *Server) {
+		conn, buf := handshake(t, "localhost:7448")
+		defer conn.Close()
+
+		send := func(line string) string {
+			conn.Write([]byte(line + "\r\n"))
+			result, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			return result
+		}
+		push := func(queue string) string {
+			return send(`PUSH {"jid":"` + util.RandomJid() + `","jobtype":"Thing","args":[],"queue":"` + queue + `"}`)
+		}
+
+		assert.Equal(t, "+OK\r\n", push("default"))
+		assert.Equal(t, "+OK\r\n", push("default"))
+		assert.Equal(t, "-QUEUEFULL Queue default is full, limit is 2\r\n", push("default"))
+		assert.Equal(t, "+OK\r\n", push("other"))
+	})
+}
+
+func TestUniqueJobs(t *testing.T) {
+	runServerWith("localhost:7449", nil, func(s *Server) {
+		conn, buf := handshake(t, "localhost:7449")
+		defer conn.Close()
+
+		send := func(line string) string {
+			conn.Write([]byte(line + "\r\n"))
+			result, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			return result
+		}
+
+		assert.Equal(t, "+OK\r\n", send(`PUSH {"jid":"unique-1","jobtype":"Report","args":[1],"unique_for":60}`))
+		assert.Equal(t, "-NOTUNIQUE Job unique-2 is not unique, unique-1 is already pending\r\n", send(`PUSH {"jid":"unique-2","jobtype":"Report","args":[1],"unique_for":60}`))
+
+		s.Options.DropDuplicates = true
+		assert.Equal(t, "+OK\r\n", send(`PUSH {"jid":"unique-2","jobtype":"Report","args":[1],"unique_for":60}`))
+		q, err := s.Store().GetQueue("default")
+		assert.NoError(t, err)
+		assert.EqualValues(t, 1, q.Size())
+	})
+}
+
+func TestBatches(t *testing.T) {
+	runServerWith("localhost:7450", nil, func(s *Server) {
+		conn, buf := handshake(t, "localhost:7450")
+		defer conn.Close()
+
+		send := func(line string) string {
+			conn.Write([]byte(line + "\r\n"))
+			result, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			return result
+		}
+
+		assert.Equal(t, "+b-import1\r\n", send(`BATCH NEW {"bid":"b-import1","success":{"jid":"callback-1","jobtype":"ImportDone","args":[]}}`))
+		assert.Equal(t, "+OK\r\n", send(`PUSH {"jid":"batched-1","jobtype":"Import","args":[1],"bid":"b-import1"}`))
+		assert.Equal(t, "+OK\r\n", send(`BATCH COMMIT b-import1`))
+		assert.Contains(t, send(`PUSH {"jid":"batched-2","jobtype":"Import","args":[2],"bid":"b-import1"}`), "is committed")
+		assert.Equal(t, "-ERR No such batch b-nosuchbatch\r\n", send(`BATCH STATUS b-nosuchbatch`))
+		assert.Contains(t, send(`BATCH FROB b-import1`), "-ERR")
+
+		result := send(`BATCH STATUS b-import1`)
+		assert.True(t, strings.HasPrefix(result, "$"), result)
+		data, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		var status client.BatchStatus
+		err = json.Unmarshal([]byte(data), &status)
+		assert.NoError(t, err)
+		assert.True(t, status.Committed)
+		assert.EqualValues(t, 1, status.Pending)
+		assert.False(t, status.Succeeded)
+	})
+}
+
+func TestTrack(t *testing.T) {
+	runServerWith("localhost:7451", nil, func(s *Server) {
+		conn, buf := handshake(t, "localhost:7451")
+		defer conn.Close()
+
+		send := func(line string) string {
+			conn.Write([]byte(line + "\r\n"))
+			result, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			return result
+		}
+
+		assert.Equal(t, "+OK\r\n", send(`PUSH {"jid":"tracked-1","jobtype":"Resize","args":[1]}`))
+		assert.Equal(t, "-ERR Job tracked-1 is not running\r\n", send(`TRACK SET {"jid":"tracked-1","percent":10}`))
+		assert.True(t, strings.HasPrefix(send("FETCH default"), "$"))
+		_, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+
+		assert.Equal(t, "+OK\r\n", send(`TRACK SET {"jid":"tracked-1","percent":40,"desc":"Resizing"}`))
+		assert.Equal(t, "$-1\r\n", send("TRACK GET nosuchjob"))
+		assert.True(t, strings.HasPrefix(send("TRACK GET tracked-1"), "$"))
+		data, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		var progress client.Progress
+		err = json.Unmarshal([]byte(data), &progress)
+		assert.NoError(t, err)
+		assert.Equal(t, 40, progress.Percent)
+		assert.Equal(t, "Resizing", progress.Desc)
+	})
+}
+
+func TestResults(t *testing.T) {
+	runServerWith("localhost:7452", nil, func(s *Server) {
+		conn, buf := handshake(t, "localhost:7452")
+		defer conn.Close()
+
+		send := func(line string) string {
+			conn.Write([]byte(line + "\r\n"))
+			result, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			return result
+		}
+
+		assert.Equal(t, "+OK\r\n", send(`PUSH {"jid":"resulting-1","jobtype":"Report","args":[1]}`))
+		assert.True(t, strings.HasPrefix(send("FETCH default"), "$"))
+		_, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+
+		big := fmt.Sprintf(`{"jid":"resulting-1","result":"%s"}`, strings.Repeat("x", manager.MaxResultSize))
+		assert.Contains(t, send("ACK "+big), "-ERR Result is")
+		assert.Equal(t, "+OK\r\n", send(`ACK {"jid":"resulting-1","result":{"rows":12}}`))
+
+		assert.Equal(t, "$-1\r\n", send("RESULT nosuchjob"))
+		assert.True(t, strings.HasPrefix(send("RESULT resulting-1"), "$"))
+		data, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		var res manager.JobResult
+		err = json.Unmarshal([]byte(data), &res)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"rows":12}`, string(res.Result))
+	})
+}
+
+func TestCancel(t *testing.T) {
+	runServerWith("localhost:7454", nil, func(s *Server) {
+		conn, buf := handshake(t, "localhost:7454")
+		defer conn.Close()
+
+		send := func(line string) string {
+			conn.Write([]byte(line + "\r\n"))
+			result, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			return result
+		}
+
+		assert.Equal(t, "+OK\r\n", send(`PUSH {"jid":"cancelled-1","jobtype":"Report","args":[1]}`))
+		assert.Equal(t, "+OK\r\n", send(`PUSH {"jid":"cancelled-2","jobtype":"Report","args":[2],"at":"2030-01-01T00:00:00Z"}`))
+		assert.Equal(t, ":1\r\n", send("CANCEL cancelled-1"))
+		assert.Equal(t, ":1\r\n", send("CANCEL cancelled-2"))
+		assert.Equal(t, ":0\r\n", send("CANCEL cancelled-1"))
+		assert.Contains(t, send("CANCEL"), "-ERR Invalid CANCEL")
+
+		q, err := s.Store().GetQueue("default")
+		assert.NoError(t, err)
+		assert.EqualValues(t, 0, q.Size())
+		assert.EqualValues(t, 0, s.Store().Scheduled().Size())
+	})
+}
+
+func TestJobGet(t *testing.T) {
+	runServerWith("localhost:7455", nil, func(s *Server) {
+		conn, buf := handshake(t, "localhost:7455")
+		defer conn.Close()
+
+		send := func(line string) string {
+			conn.Write([]byte(line + "\r\n"))
+			result, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			return result
+		}
+		get := func(jid string) manager.JobState {
+			assert.True(t, strings.HasPrefix(send("JOB GET "+jid), "$"))
+			data, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			var state manager.JobState
+			assert.NoError(t, json.Unmarshal([]byte(data), &state))
+			return state
+		}
+
+		assert.Equal(t, "+OK\r\n", send(`PUSH {"jid":"lookedup-1","jobtype":"Report","args":[1]}`))
+		state := get("lookedup-1")
+		assert.Equal(t, manager.JobEnqueued, state.State)
+		assert.Equal(t, "Report", state.Job.Type)
+
+		assert.True(t, strings.HasPrefix(send("FETCH default"), "$"))
+		_, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		state = get("lookedup-1")
+		assert.Equal(t, manager.JobWorking, state.State)
+		assert.NotEqual(t, "", state.Wid)
+
+		assert.Equal(t, manager.JobUnknown, get("nosuchjob").State)
+		assert.Contains(t, send("JOB lookedup-1"), "-ERR Invalid JOB")
+	})
+}
+
+func TestMutate(t *testing.T) {
+	runServerWith("localhost:7456", nil, func(s *Server) {
+		conn, buf := handshake(t, "localhost:7456")
+		defer conn.Close()
+
+		send := func(line string) string {
+			conn.Write([]byte(line + "\r\n"))
+			result, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			return result
+		}
+
+		for i, customer := range []int{1234, 5678} {
+			job := client.NewJob("Sync", customer)
+			job.At = "2030-01-01T00:00:00Z"
+			job.Failure = &client.Failure{RetryCount: 1, ErrorType: "Oops"}
+			data, err := json.Marshal(job)
+			assert.NoError(t, err)
+			assert.NoError(t, s.Store().Retries().AddElement(job.At, fmt.Sprintf("mutated-%d", i), data))
+		}
+
+		assert.Equal(t, ":1\r\n", send(`MUTATE {"cmd":"kill","target":"retries","filter":{"path":"0","value":1234}}`))
+		assert.EqualValues(t, 1, s.Store().Retries().Size())
+		assert.EqualValues(t, 1, s.Store().Dead().Size())
+		assert.Contains(t, send(`MUTATE {"cmd":"kill","target":"retries"}`), "-ERR MUTATE needs a filter")
+		assert.Contains(t, send(`MUTATE kill`), "-MALFORMED")
+	})
+}
+
+type captureHandler struct {
+	mu      sync.Mutex
+	entries []*alog.Entry
+}
+
+func (h *captureHandler) HandleLog(e *alog.Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = append(h.entries, e)
+	return nil
+}
+
+func TestFetchLogging(t *testing.T) {
+	logger := alog.Log.(*alog.Logger)
+	handler, level, debug := logger.Handler, logger.Level, util.LogDebug
+	defer func() {
+		logger.Handler, logger.Level, util.LogDebug = handler, level, debug
+	}()
+	capture := &captureHandler{}
+	logger.Handler, logger.Level, util.LogDebug = capture, alog.DebugLevel, true
+
+	configure := func(opts *ServerOptions) {
+		opts.FetchLogSampleRate = 1.0
+	}
+	runServerWith("localhost:7426", configure, func(s *Server) {
+		conn, buf := handshake(t, "localhost:7426")
+		defer conn.Close()
+
+		jids := []string{}
+		for i := 0; i < 10; i++ {
+			jid := fmt.Sprintf("fetchlogging%012d", i)
+			jids = append(jids, jid)
+			conn.Write([]byte(fmt.Sprintf(`PUSH {"jid":"%s","jobtype":"Thing","args":[]}`, jid) + "\r\n"))
+			result, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			assert.Equal(t, "+OK\r\n", result)
+		}
+		for range jids {
+			conn.Write([]byte("FETCH default\r\n"))
+			_, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			_, err = buf.ReadString('\n')
+			assert.NoError(t, err)
+		}
+	})
+
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	logged := []string{}
+	for _, e := range capture.entries {
+		if e.Message != "fetched" {
+			continue
+		}
+		logged = append(logged, e.Fields.Get("jid").(string))
+		assert.Equal(t, "Thing", e.Fields.Get("jobtype"))
+		assert.Equal(t, "default", e.Fields.Get("queue"))
+		assert.NotEmpty(t, e.Fields.Get("wid"))
+		assert.NotNil(t, e.Fields.Get("latency_ms"))
+	}
+	assert.Len(t, logged, 10)
+	for i := 0; i < 10; i++ {
+		assert.Contains(t, logged, fmt.Sprintf("fetchlogging%012d", i))
+	}
+}
+
+func TestPushIf(t *testing.T) {
+	runServer("localhost:7427", func() {
+		conn, buf := handshake(t, "localhost:7427")
+		defer conn.Close()
+
+		send := func(line string) string {
+			conn.Write([]byte(line + "\r\n"))
+			result, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			return result
+		}
+
+		first := `{"jid":"pushifjob000000000001","jobtype":"Report","args":[]}`
+		second := `{"jid":"pushifjob000000000002","jobtype":"Report","args":[]}`
+		assert.Equal(t, "+OK\r\n", send("PUSHIF UNIQUE_TYPE "+first))
+		assert.Equal(t, "+SKIPPED\r\n", send("PUSHIF UNIQUE_TYPE "+second))
+
+		send("FETCH default")
+		result, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Contains(t, result, "pushifjob000000000001")
+		// still pending while it runs
+		assert.Equal(t, "+SKIPPED\r\n", send("PUSHIF UNIQUE_TYPE "+second))
+		assert.Equal(t, "+OK\r\n", send(`ACK {"jid":"pushifjob000000000001"}`))
+
+		assert.Equal(t, "+OK\r\n", send("PUSHIF UNIQUE_TYPE "+second))
+
+		// the default queue now has a job
+		other := `{"jid":"pushifjob000000000003","jobtype":"Other","queue":"critical","args":[]}`
+		assert.Equal(t, "+SKIPPED\r\n", send("PUSHIF QUEUE_EMPTY default "+other))
+		assert.Equal(t, "+OK\r\n", send("PUSHIF QUEUE_EMPTY low "+other))
+
+		// this connection is a worker
+		assert.Equal(t, "+OK\r\n", send(`PUSHIF WORKER_AVAILABLE {"jid":"pushifjob000000000004","jobtype":"Other","args":[]}`))
+
+		assert.Contains(t, send("PUSHIF SOMETIMES "+other), "unknown predicate")
+		assert.Contains(t, send("PUSHIF QUEUE_EMPTY "+other), "Invalid PUSHIF")
+	})
+}
+
+func TestFetchSample(t *testing.T) {
+	runServerWith("localhost:7428", nil, func(s *Server) {
+		conn, buf := handshake(t, "localhost:7428")
+		defer conn.Close()
+
+		send := func(line string) string {
+			conn.Write([]byte(line + "\r\n"))
+			result, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			return result
+		}
+		readResult := func() string {
+			result, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			return result
+		}
+
+		for i := 1; i <= 3; i++ {
+			job := fmt.Sprintf(`{"jid":"samplejob00000000000%d","jobtype":"Thing","args":[%d]}`, i, i)
+			assert.Equal(t, "+OK\r\n", send("PUSH "+job))
+		}
+		commands := atomic.LoadUint64(&s.Stats.Commands)
+
+		send("FETCH_SAMPLE_N default 2")
+		var jobs []client.Job
+		err := json.Unmarshal([]byte(readResult()), &jobs)
+		assert.NoError(t, err)
+		assert.Len(t, jobs, 2)
+		assert.Equal(t, "samplejob000000000001", jobs[0].Jid)
+		assert.Equal(t, "samplejob000000000002", jobs[1].Jid)
+
+		send("FETCH_SAMPLE default")
+		assert.Contains(t, readResult(), "samplejob000000000001")
+		assert.Equal(t, "$-1\r\n", send("FETCH_SAMPLE empty"))
+		assert.Contains(t, send("FETCH_SAMPLE_N default 0"), "Invalid FETCH_SAMPLE_N")
+
+		q, err := s.Store().GetQueue("default")
+		assert.NoError(t, err)
+		assert.EqualValues(t, 3, q.Size())
+		assert.Equal(t, 0, s.Manager().WorkingCount())
+		assert.Equal(t, commands, atomic.LoadUint64(&s.Stats.Commands))
+
+		send("FETCH default")
+		assert.Contains(t, readResult(), "samplejob000000000001")
+		assert.EqualValues(t, 2, q.Size())
+	})
+}
+
+func TestCheckAccess(t *testing.T) {
+	s := &Server{Options: &ServerOptions{}}
+	regular := &Connection{}
+	admin := &Connection{isAdmin: true}
+
+	// everything is allowed on the regular port without an admin port
+	assert.NoError(t, s.checkAccess(regular, "QUEUE"))
+	assert.NoError(t, s.checkAccess(regular, "PUSH"))
+
+	s.Options.AdminBinding = "127.0.0.1:7418"
+	assert.Error(t, s.checkAccess(regular, "QUEUE"))
+	assert.Error(t, s.checkAccess(regular, "CANCEL"))
+	assert.Error(t, s.checkAccess(regular, "FLUSH"))
+	assert.NoError(t, s.checkAccess(regular, "PUSH"))
+	assert.NoError(t, s.checkAccess(regular, "INFO"))
+
+	assert.NoError(t, s.checkAccess(admin, "QUEUE"))
+	assert.NoError(t, s.checkAccess(admin, "INFO"))
+	for _, verb := range []string{"PUSH", "FETCH", "ACK", "FAIL", "BEAT"} {
+		assert.Error(t, s.checkAccess(admin, verb), verb)
+	}
+}
+
+func TestAdminPort(t *testing.T) {
+	configure := func(opts *ServerOptions) {
+		opts.Password = "foobar"
+		opts.AdminBinding = "localhost:7430"
+	}
+	runServerWith("localhost:7429", configure, func(s *Server) {
+		// no password needed
+		admin, abuf := handshake(t, "localhost:7430")
+		defer admin.Close()
+
+		conn, err := net.DialTimeout("tcp", "localhost:7429", 1*time.Second)
+		assert.NoError(t, err)
+		defer conn.Close()
+		buf := bufio.NewReader(conn)
+		line, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		var hi map[string]interface{}
+		err = json.Unmarshal([]byte(line[4:]), &hi)
+		assert.NoError(t, err)
+		nonce := hi["nonce"].(string)
+		hello, err := json.Marshal(&ClientData{
+			Version:      3,
+			Nonce:        nonce,
+			PasswordHash: hash("foobar", hi["s"].(string)+nonce, int(hi["i"].(float64))),
+		})
+		assert.NoError(t, err)
+		conn.Write([]byte("HELLO " + string(hello) + "\r\n"))
+		result, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "+OK\r\n", result)
+
+		send := func(buf *bufio.Reader, conn net.Conn, line string) string {
+			conn.Write([]byte(line + "\r\n"))
+			result, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			return result
+		}
+
+		assert.Contains(t, send(buf, conn, "QUEUE CONFIG default ordering lifo"), "FORBIDDEN")
+		assert.Equal(t, "+OK\r\n", send(abuf, admin, "QUEUE CONFIG default ordering lifo"))
+
+		job := `{"jid":"adminjob0000000000001","jobtype":"Thing","args":[]}`
+		assert.Contains(t, send(abuf, admin, "PUSH "+job), "FORBIDDEN")
+		assert.Equal(t, "+OK\r\n", send(buf, conn, "PUSH "+job))
+	})
+}
+
+// handshake connects to the server at the given binding and completes
+// HELLO as a worker process.
+func handshake(t *testing.T, binding string) (net.Conn, *bufio.Reader) {
+	conn, err := net.DialTimeout("tcp", binding, 1*time.Second)
+	assert.NoError(t, err)
+	buf := bufio.NewReader(conn)
+
+	_, err = buf.ReadString('\n')
+	assert.NoError(t, err)
+
+	var client ClientData
+	client.Hostname = "localhost"
+	client.Pid = os.Getpid()
+	client.Wid = strconv.FormatInt(rand.Int63(), 10)
+	client.Version = 2
+
+	val, err := json.Marshal(client)
+	assert.NoError(t, err)
+
+	conn.Write([]byte("HELLO "))
+	conn.Write(val)
+	conn.Write([]byte("\r\n"))
+	result, err := buf.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n", result)
+	return conn, buf
+}
+
 func TestPasswordHashing(t *testing.T) {
 	iterations := 1545
 	pwd := "foobar"
@@ -154,3 +1297,334 @@ func BenchmarkHash(b *testing.B) {
 		hash(pwd, salt, iterations)
 	}
 }
+
+func TestDeadJobsPrune(t *testing.T) {
+	runServerWith("localhost:7431", nil, func(s *Server) {
+		conn, buf := handshake(t, "localhost:7431")
+		defer conn.Close()
+
+		send := func(line string) string {
+			conn.Write([]byte(line + "\r\n"))
+			result, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			return result
+		}
+
+		for idx, days := range []int{10, 100, 200} {
+			job := client.NewJob("Thing", idx)
+			job.Failure = &client.Failure{FailedAt: util.Thens(time.Now().Add(-time.Duration(days) * 24 * time.Hour))}
+			data, err := json.Marshal(job)
+			assert.NoError(t, err)
+			err = s.Store().Dead().AddElement(util.Thens(time.Now()), job.Jid, data)
+			assert.NoError(t, err)
+		}
+
+		assert.Contains(t, send("DEADJOBS PRUNE"), "Invalid DEADJOBS")
+		assert.Contains(t, send("DEADJOBS PRUNE BEFORE yesterday"), "Invalid DEADJOBS timestamp")
+
+		before := time.Now().Add(-90 * 24 * time.Hour).UTC().Format(time.RFC3339)
+		assert.Equal(t, ":2\r\n", send("DEADJOBS PRUNE BEFORE "+before))
+		assert.EqualValues(t, 1, s.Store().Dead().Size())
+
+		state, err := s.CurrentState()
+		assert.NoError(t, err)
+		faktory := state["faktory"].(map[string]interface{})
+		assert.EqualValues(t, 2, faktory["dead_jobs_pruned_last_run"])
+		assert.NotEmpty(t, faktory["dead_jobs_oldest_at"])
+	})
+}
+
+func TestScan(t *testing.T) {
+	runServerWith("localhost:7432", nil, func(s *Server) {
+		cl, err := client.Dial(&client.Server{Network: "tcp", Address: "localhost:7432", Timeout: time.Second}, "")
+		assert.NoError(t, err)
+		defer cl.Close()
+
+		for i := 0; i < 50; i++ {
+			err := cl.Push(client.NewJob("Thing", i))
+			assert.NoError(t, err)
+		}
+
+		seen := map[string]bool{}
+		pages := 0
+		cursor := 0
+		for {
+			next, jobs, err := cl.ScanQueue("default", cursor, 10)
+			assert.NoError(t, err)
+			assert.Len(t, jobs, 10)
+			for _, job := range jobs {
+				assert.False(t, seen[job.Jid], "duplicate %s", job.Jid)
+				seen[job.Jid] = true
+			}
+			pages++
+			if next == 0 || pages > 5 {
+				break
+			}
+			cursor = next
+		}
+		assert.Equal(t, 5, pages)
+		assert.Len(t, seen, 50)
+
+		q, err := s.Store().GetQueue("default")
+		assert.NoError(t, err)
+		assert.EqualValues(t, 50, q.Size())
+
+		job := client.NewJob("Thing", 1)
+		data, err := json.Marshal(job)
+		assert.NoError(t, err)
+		err = s.Store().Dead().AddElement(util.Nows(), job.Jid, data)
+		assert.NoError(t, err)
+		next, jobs, err := cl.ScanQueue("dead", 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, next)
+		assert.Len(t, jobs, 1)
+		assert.Equal(t, job.Jid, jobs[0].Jid)
+
+		_, _, err = cl.ScanQueue("default", 0, 0)
+		assert.Error(t, err)
+	})
+}
+
+func TestFeatureAdvertisement(t *testing.T) {
+	dir := "/tmp/localhost_7433"
+	defer os.RemoveAll(dir)
+	sock := dir + "/test.sock"
+	stopper, err := storage.BootRedis(dir, sock)
+	assert.NoError(t, err)
+	defer stopper()
+
+	s, err := NewServer(&ServerOptions{Binding: "localhost:7433", StorageDirectory: dir, RedisSock: sock})
+	assert.NoError(t, err)
+	events := []string{}
+	s.Register(&featureSubsystem{mockSubsystem{name: "test", events: &events}, "test_feature"})
+	err = s.Boot()
+	assert.NoError(t, err)
+	go s.Run()
+	defer s.Stop(nil)
+	defer close(s.Stopper())
+
+	// Run starts the subsystems before accepting connections
+	cl, err := client.Dial(&client.Server{Network: "tcp", Address: "localhost:7433", Timeout: time.Second}, "")
+	assert.NoError(t, err)
+	defer cl.Close()
+
+	assert.True(t, cl.HasFeature("test_feature"))
+	assert.True(t, cl.HasFeature("scan"))
+	assert.False(t, cl.HasFeature("missing_feature"))
+}
+
+func TestJobTimeout(t *testing.T) {
+	runServerWith("localhost:7434", nil, func(s *Server) {
+		conn, buf := handshake(t, "localhost:7434")
+		defer conn.Close()
+
+		send := func(line string) string {
+			conn.Write([]byte(line + "\r\n"))
+			result, err := buf.ReadString('\n')
+			assert.NoError(t, err)
+			return result
+		}
+
+		job := `{"jid":"timeoutjob0000001","jobtype":"Slow","args":[],"retry":5,"timeout_seconds":1}`
+		assert.Equal(t, "+OK\r\n", send("PUSH "+job))
+		send("FETCH default")
+		result, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Contains(t, result, "timeoutjob0000001")
+
+		time.Sleep(2 * time.Second)
+		assert.Equal(t, "-ERR job timed out\r\n", send(`ACK {"jid":"timeoutjob0000001"}`))
+		assert.EqualValues(t, 1, s.Store().Retries().Size())
+		assert.Equal(t, 0, s.Manager().WorkingCount())
+		assert.EqualValues(t, 1, s.Store().TotalProcessed())
+		assert.EqualValues(t, 1, s.Store().TotalFailures())
+
+		for _, worker := range s.Heartbeats() {
+			assert.EqualValues(t, 1, atomic.LoadInt64(&worker.TimedOutJobs))
+		}
+	})
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "faktory-sock")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := dir + "/faktory.sock"
+
+	listener, err := listen("unix://" + path)
+	assert.NoError(t, err)
+	_, err = listen("unix://" + path)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "already in use")
+
+	// simulate a crash which leaves the socket file behind
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+
+	listener, err = listen("unix://" + path)
+	assert.NoError(t, err)
+	listener.Close()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestListenAll(t *testing.T) {
+	s := &Server{Options: &ServerOptions{
+		Binding:      "127.0.0.1:7437",
+		Bindings:     []string{"127.0.0.1:7438"},
+		AdminBinding: "127.0.0.1:7439",
+	}}
+	endpoints, err := s.listenAll(nil)
+	assert.NoError(t, err)
+	assert.Len(t, endpoints, 3)
+	assert.Equal(t, "127.0.0.1:7437", endpoints[0].binding)
+	assert.False(t, endpoints[1].admin)
+	assert.True(t, endpoints[2].admin)
+
+	// any failure closes the listeners already opened
+	s.Options.Binding = "127.0.0.1:7440"
+	s.Options.Bindings = []string{"127.0.0.1:7437"}
+	_, err = s.listenAll(nil)
+	assert.Error(t, err)
+	for _, ep := range endpoints {
+		ep.listener.Close()
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:7440")
+	assert.NoError(t, err)
+	listener.Close()
+}
+
+func TestMaxConnections(t *testing.T) {
+	s := &Server{
+		Options: &ServerOptions{MaxConnections: 1},
+		Stats:   &RuntimeStats{},
+		workers: newWorkers(),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	admin, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer admin.Close()
+	go s.serve(listener, false)
+	go s.serve(admin, true)
+
+	greeting := func(addr net.Addr) (net.Conn, string) {
+		conn, err := net.Dial("tcp", addr.String())
+		assert.NoError(t, err)
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		assert.NoError(t, err)
+		return conn, line
+	}
+
+	first, line := greeting(listener.Addr())
+	assert.True(t, strings.HasPrefix(line, "+HI "), line)
+
+	conn, line := greeting(listener.Addr())
+	assert.Equal(t, "-MAXCONN Too many connections, limit is 1\r\n", line)
+	conn.Close()
+	assert.EqualValues(t, 1, atomic.LoadUint64(&s.Stats.Rejected))
+
+	conn, line = greeting(admin.Addr())
+	assert.True(t, strings.HasPrefix(line, "+HI "), line)
+	conn.Close()
+
+	// closing the first connection frees up its slot
+	first.Close()
+	time.Sleep(100 * time.Millisecond)
+	conn, line = greeting(listener.Addr())
+	assert.True(t, strings.HasPrefix(line, "+HI "), line)
+	conn.Close()
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := &Server{
+		Options: &ServerOptions{IdleTimeout: 200 * time.Millisecond},
+		Stats:   &RuntimeStats{},
+		workers: newWorkers(),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go s.serve(listener, false)
+
+	hello := func(payload string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		assert.NoError(t, err)
+		buf := bufio.NewReader(conn)
+		_, err = buf.ReadString('\n')
+		assert.NoError(t, err)
+		conn.Write([]byte("HELLO " + payload + "\r\n"))
+		line, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "+OK\r\n", line)
+		return conn, buf
+	}
+
+	producer, pbuf := hello(`{"v":2}`)
+	defer producer.Close()
+	consumer, cbuf := hello(`{"v":2,"wid":"idle"}`)
+	defer consumer.Close()
+
+	// each command resets the deadline
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		producer.Write([]byte("NOPE\r\n"))
+		_, err = pbuf.ReadString('\n')
+		assert.NoError(t, err)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	_, err = pbuf.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+
+	consumer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = cbuf.ReadString('\n')
+	ne, ok := err.(net.Error)
+	assert.True(t, ok && ne.Timeout(), "%v", err)
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := "/tmp/faktory-test-7436.sock"
+	runServerWith("localhost:7436", func(opts *ServerOptions) {
+		opts.UnixSocket = path
+	}, func(s *Server) {
+		cl, err := client.Dial(&client.Server{Network: "unix", Address: path, Timeout: time.Second}, "")
+		assert.NoError(t, err)
+		defer cl.Close()
+
+		err = cl.Push(client.NewJob("Local", 1))
+		assert.NoError(t, err)
+
+		// TCP still works too
+		conn, _ := handshake(t, "localhost:7436")
+		conn.Close()
+	})
+}
+
+func TestRegisterCommand(t *testing.T) {
+	runServerWith("localhost:7457", nil, func(s *Server) {
+		echo := func(c *Connection, s *Server, cmd string) {
+			c.Simple(strings.TrimPrefix(cmd, "ECHO "))
+		}
+		assert.NoError(t, s.RegisterCommand("ECHO", echo))
+		assert.Error(t, s.RegisterCommand("ECHO", echo))
+		assert.Error(t, s.RegisterCommand("PUSH", echo))
+		assert.Error(t, s.RegisterCommand("echo", echo))
+		assert.Error(t, s.RegisterCommand("", echo))
+
+		conn, buf := handshake(t, "localhost:7457")
+		defer conn.Close()
+		conn.Write([]byte("ECHO hello\r\n"))
+		result, err := buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "+hello\r\n", result)
+
+		conn.Write([]byte("NOPE\r\n"))
+		result, err = buf.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Contains(t, result, "Unknown command NOPE")
+	})
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/contribsys/faktory/util"
+)
+
+/*
+ * Commands which take longer than ServerOptions.SlowCommandThreshold
+ * are logged and kept in the slow log, the most recent slowLogSize of
+ * them, so stalls can be seen from the server's side:
+ *
+ *	SLOWLOG        the slow commands, most recent first
+ *	SLOWLOG RESET  empty the slow log
+ *
+ * A FETCH which finds no job has spent its time waiting for one to be
+ * pushed, as has FETCH WAIT, so neither is slow.
+ */
+const slowLogSize = 128
+
+type slowCommand struct {
+	At         string  `json:"at"`
+	Verb       string  `json:"verb"`
+	Wid        string  `json:"wid,omitempty"`
+	Address    string  `json:"addr"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+type slowLog struct {
+	mu sync.Mutex
+	// a ring of the last slowLogSize entries, next is the oldest
+	entries []slowCommand
+	next    int
+}
+
+func (sl *slowLog) add(entry slowCommand) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if len(sl.entries) < slowLogSize {
+		sl.entries = append(sl.entries, entry)
+		return
+	}
+	sl.entries[sl.next] = entry
+	sl.next = (sl.next + 1) % slowLogSize
+}
+
+// The entries, most recent first.
+func (sl *slowLog) list() []slowCommand {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	list := make([]slowCommand, 0, len(sl.entries))
+	for idx := len(sl.entries) - 1; idx >= 0; idx-- {
+		list = append(list, sl.entries[(sl.next+idx)%len(sl.entries)])
+	}
+	return list
+}
+
+func (sl *slowLog) reset() {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	sl.entries = nil
+	sl.next = 0
+}
+
+// Record the command c just ran if it took longer than the threshold.
+func (s *Server) checkSlow(c *Connection, verb string, elapsed time.Duration) {
+	threshold := s.CurrentOptions().SlowCommandThreshold
+	if threshold <= 0 || elapsed <= threshold || c.waited {
+		return
+	}
+	entry := slowCommand{
+		At:         util.Nows(),
+		Verb:       verb,
+		Wid:        c.client.Wid,
+		Address:    c.client.Address,
+		DurationMs: float64(elapsed) / float64(time.Millisecond),
+	}
+	s.slowlog.add(entry)
+	util.Warnw("Slow command", map[string]interface{}{
+		"verb":        entry.Verb,
+		"wid":         entry.Wid,
+		"addr":        entry.Address,
+		"duration_ms": entry.DurationMs,
+	})
+}
+
+// SLOWLOG
+// SLOWLOG RESET
+func slowlog(c *Connection, s *Server, cmd string) {
+	parts := strings.Fields(cmd)
+	switch {
+	case len(parts) == 1:
+		data, err := json.Marshal(s.slowlog.list())
+		if err != nil {
+			c.Error(cmd, err)
+			return
+		}
+		c.Result(data)
+	case len(parts) == 2 && parts[1] == "RESET":
+		s.slowlog.reset()
+		c.Ok()
+	default:
+		c.Error(cmd, fmt.Errorf("Invalid SLOWLOG, expected SLOWLOG or SLOWLOG RESET"))
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlowLog(t *testing.T) {
+	var sl slowLog
+	for idx := 0; idx < slowLogSize+5; idx++ {
+		sl.add(slowCommand{Verb: fmt.Sprintf("CMD%d", idx)})
+	}
+	list := sl.list()
+	assert.Len(t, list, slowLogSize)
+	assert.Equal(t, fmt.Sprintf("CMD%d", slowLogSize+4), list[0].Verb)
+	assert.Equal(t, "CMD5", list[slowLogSize-1].Verb)
+
+	sl.reset()
+	assert.Len(t, sl.list(), 0)
+	sl.add(slowCommand{Verb: "FETCH"})
+	assert.Equal(t, "FETCH", sl.list()[0].Verb)
+}
+
+func TestCheckSlow(t *testing.T) {
+	s := &Server{Options: &ServerOptions{}}
+	c := &Connection{client: &ClientData{Wid: "worker1", Address: "10.0.0.5:51234"}}
+
+	// disabled
+	s.checkSlow(c, "FETCH", time.Minute)
+	assert.Len(t, s.slowlog.list(), 0)
+
+	s.Options.SlowCommandThreshold = 500 * time.Millisecond
+	s.checkSlow(c, "ACK", 100*time.Millisecond)
+	c.waited = true
+	s.checkSlow(c, "FETCH", 2*time.Second)
+	assert.Len(t, s.slowlog.list(), 0)
+
+	c.waited = false
+	s.checkSlow(c, "FETCH", 2500*time.Millisecond)
+	list := s.slowlog.list()
+	assert.Len(t, list, 1)
+	assert.Equal(t, "FETCH", list[0].Verb)
+	assert.Equal(t, "worker1", list[0].Wid)
+	assert.Equal(t, "10.0.0.5:51234", list[0].Address)
+	assert.Equal(t, 2500.0, list[0].DurationMs)
+
+	data, err := json.Marshal(list)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"duration_ms":2500`)
+}
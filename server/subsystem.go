@@ -1,5 +1,13 @@
 package server
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/contribsys/faktory/util"
+)
+
 type Subsystem interface {
 	// Called when the server is configured but before it starts accepting client connections.
 	Start(*Server) error
@@ -9,12 +17,197 @@ type Subsystem interface {
 	// necessary changes.
 	Reload(*Server) error
 
-	// Shutdown is signaled by the Server.Stopper() channel.  Subsystems should
-	// select on it to be notified when the server is shutting down.
+	// Called when the Server is stopping, in the reverse order the
+	// subsystems were started.  Shutdown is also signaled by the
+	// Server.Stopper() channel.
+	Stop(*Server) error
+}
+
+// A subsystem can implement Named so other subsystems
+// can depend on it, otherwise its name is its type.
+type Named interface {
+	Name() string
 }
 
-// register a global handler to be called when the Server instance
-// has finished booting but before it starts listening.
-func (s *Server) Register(x Subsystem) {
+// A subsystem can implement Dependent to be started
+// after the named subsystems and stopped before them.
+type Dependent interface {
+	DependsOn() []string
+}
+
+// A subsystem which adds commands can implement FeatureSubsystem
+// to advertise them to clients in the HI greeting.
+type FeatureSubsystem interface {
+	Subsystem
+	FeatureName() string
+}
+
+// Register a subsystem.  Those registered before Run are started
+// once the Server has finished booting but before it starts
+// listening.  Those registered while it runs are started at once, so
+// they may only depend on subsystems which have already started.
+func (s *Server) Register(x Subsystem) error {
+	s.mu.Lock()
+	running := s.subsystemsRunning
+	started := s.started
+	if !running {
+		s.Subsystems = append(s.Subsystems, x)
+	}
+	s.mu.Unlock()
+	if !running {
+		return nil
+	}
+
+	name := subsystemName(x)
+	names := map[string]bool{}
+	for _, y := range started {
+		names[subsystemName(y)] = true
+	}
+	if names[name] {
+		return fmt.Errorf("Duplicate subsystem %s", name)
+	}
+	if d, ok := x.(Dependent); ok {
+		for _, dep := range d.DependsOn() {
+			if !names[dep] {
+				return fmt.Errorf("Subsystem %s depends on subsystem %s which hasn't started", name, dep)
+			}
+		}
+	}
+	err := x.Start(s)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
 	s.Subsystems = append(s.Subsystems, x)
+	s.started = append(s.started, x)
+	s.mu.Unlock()
+	return nil
+}
+
+// Start subsystems in dependency order.
+func (s *Server) startSubsystems() error {
+	s.mu.Lock()
+	all := s.Subsystems
+	s.subsystemsRunning = true
+	s.mu.Unlock()
+
+	subs, err := sortSubsystems(all)
+	if err != nil {
+		return err
+	}
+	for _, x := range subs {
+		err := x.Start(s)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.started = append(s.started, x)
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// Stop any started subsystems in the reverse order of Start.
+func (s *Server) stopSubsystems() {
+	s.mu.Lock()
+	started := s.started
+	s.started = nil
+	s.subsystemsRunning = false
+	s.mu.Unlock()
+
+	for i := len(started) - 1; i >= 0; i-- {
+		x := started[i]
+		err := x.Stop(s)
+		if err != nil {
+			util.Warnf("Subsystem %s returned stop error: %v", subsystemName(x), err)
+		}
+	}
+}
+
+// Features returns the sorted names of the command groups this
+// server supports, including those added by started subsystems.
+func (s *Server) Features() []string {
+	names := map[string]bool{}
+	for _, name := range builtinFeatures {
+		names[name] = true
+	}
+	s.mu.Lock()
+	for _, x := range s.started {
+		if f, ok := x.(FeatureSubsystem); ok {
+			names[f.FeatureName()] = true
+		}
+	}
+	s.mu.Unlock()
+
+	features := make([]string, 0, len(names))
+	for name := range names {
+		features = append(features, name)
+	}
+	sort.Strings(features)
+	return features
+}
+
+func subsystemName(x Subsystem) string {
+	if n, ok := x.(Named); ok {
+		return n.Name()
+	}
+	return fmt.Sprintf("%T", x)
+}
+
+// Sort the subsystems so each starts after its dependencies.
+// Subsystems without a dependency between them keep their
+// registration order.
+func sortSubsystems(subs []Subsystem) ([]Subsystem, error) {
+	byName := map[string]Subsystem{}
+	for _, x := range subs {
+		name := subsystemName(x)
+		if _, ok := byName[name]; ok {
+			return nil, fmt.Errorf("Duplicate subsystem %s", name)
+		}
+		byName[name] = x
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	sorted := make([]Subsystem, 0, len(subs))
+
+	var visit func(x Subsystem, path []string) error
+	visit = func(x Subsystem, path []string) error {
+		name := subsystemName(x)
+		path = append(path, name)
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("Circular subsystem dependency: %s", strings.Join(path, " -> "))
+		}
+
+		state[name] = visiting
+		if d, ok := x.(Dependent); ok {
+			for _, dep := range d.DependsOn() {
+				y, ok := byName[dep]
+				if !ok {
+					return fmt.Errorf("Subsystem %s depends on unknown subsystem %s", name, dep)
+				}
+				err := visit(y, path)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		state[name] = visited
+		sorted = append(sorted, x)
+		return nil
+	}
+
+	for _, x := range subs {
+		err := visit(x, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
 }
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockSubsystem struct {
+	name   string
+	deps   []string
+	events *[]string
+}
+
+func (m *mockSubsystem) Name() string        { return m.name }
+func (m *mockSubsystem) DependsOn() []string { return m.deps }
+
+func (m *mockSubsystem) Start(s *Server) error {
+	*m.events = append(*m.events, "start "+m.name)
+	return nil
+}
+
+func (m *mockSubsystem) Reload(s *Server) error {
+	*m.events = append(*m.events, "reload "+m.name)
+	return nil
+}
+
+func (m *mockSubsystem) Stop(s *Server) error {
+	*m.events = append(*m.events, "stop "+m.name)
+	return fmt.Errorf("stop errors are logged, not fatal")
+}
+
+func TestSubsystemOrdering(t *testing.T) {
+	events := []string{}
+	s := &Server{}
+	s.Register(&mockSubsystem{name: "web", deps: []string{"cache"}, events: &events})
+	s.Register(&mockSubsystem{name: "store", events: &events})
+	s.Register(&mockSubsystem{name: "cache", deps: []string{"store"}, events: &events})
+
+	err := s.startSubsystems()
+	assert.NoError(t, err)
+	s.Reload()
+	s.stopSubsystems()
+
+	assert.Equal(t, []string{
+		"start store", "start cache", "start web",
+		"reload store", "reload cache", "reload web",
+		"stop web", "stop cache", "stop store",
+	}, events)
+
+	// stopping again is a no-op
+	s.stopSubsystems()
+	assert.Len(t, events, 9)
+}
+
+func TestSubsystemDependencyErrors(t *testing.T) {
+	events := []string{}
+	a := &mockSubsystem{name: "a", deps: []string{"c"}, events: &events}
+	b := &mockSubsystem{name: "b", deps: []string{"a"}, events: &events}
+	c := &mockSubsystem{name: "c", deps: []string{"b"}, events: &events}
+
+	_, err := sortSubsystems([]Subsystem{a, b, c})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "a -> c -> b -> a")
+
+	s := &Server{}
+	s.Register(a)
+	s.Register(b)
+	s.Register(c)
+	err = s.startSubsystems()
+	assert.Error(t, err)
+	assert.Empty(t, events)
+
+	_, err = sortSubsystems([]Subsystem{&mockSubsystem{name: "a", deps: []string{"nope"}, events: &events}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown subsystem nope")
+
+	_, err = sortSubsystems([]Subsystem{b, b})
+	assert.Error(t, err)
+}
+
+type featureSubsystem struct {
+	mockSubsystem
+	feature string
+}
+
+func (f *featureSubsystem) FeatureName() string { return f.feature }
+
+func TestFeatures(t *testing.T) {
+	events := []string{}
+	s := &Server{}
+	s.Register(&featureSubsystem{mockSubsystem{name: "test", events: &events}, "test_feature"})
+	assert.NotContains(t, s.Features(), "test_feature")
+
+	err := s.startSubsystems()
+	assert.NoError(t, err)
+	features := s.Features()
+	assert.Contains(t, features, "test_feature")
+	assert.Contains(t, features, "pushif")
+	assert.True(t, sort.StringsAreSorted(features))
+}
+
+func TestRegisterWhileRunning(t *testing.T) {
+	events := []string{}
+	s := &Server{}
+	assert.NoError(t, s.Register(&mockSubsystem{name: "store", events: &events}))
+	assert.NoError(t, s.startSubsystems())
+
+	assert.NoError(t, s.Register(&mockSubsystem{name: "cache", deps: []string{"store"}, events: &events}))
+	assert.Error(t, s.Register(&mockSubsystem{name: "web", deps: []string{"search"}, events: &events}))
+	assert.Error(t, s.Register(&mockSubsystem{name: "store", events: &events}))
+	s.stopSubsystems()
+	assert.Equal(t, []string{"start store", "start cache", "stop cache", "stop store"}, events)
+
+	// stopped, so it waits for the next start
+	assert.NoError(t, s.Register(&mockSubsystem{name: "web", events: &events}))
+	assert.Len(t, events, 4)
+}
@@ -14,11 +14,18 @@ import (
  * a recurring schedule, e.g. "reap old heartbeats every 30 seconds".
  *
  * tr = newTaskRunner()
- * tr.AddTask("heartbeat reaper", reapHeartbeats, 30)
+ * tr.AddTask(30*time.Second, &beatReaper{...})
  * ts.Run(...)
+ *
+ * Each task runs once per interval, aligned to the clock so an hourly
+ * task runs on the hour.  The runner wakes every second or, if a task
+ * runs more often, at that task's interval.  A task which is behind,
+ * see backlogged, runs again each time the runner wakes until it
+ * catches up.
  */
 type taskRunner struct {
 	tasks []*task
+	tick  time.Duration
 
 	walltimeNs int64
 	cycles     int64
@@ -28,7 +35,9 @@ type taskRunner struct {
 
 type task struct {
 	runner     Taskable
-	every      int64
+	every      time.Duration
+	last       time.Time
+	behind     bool
 	runs       int64
 	walltimeNs int64
 }
@@ -39,18 +48,30 @@ type Taskable interface {
 	Stats() map[string]interface{}
 }
 
+// A task such as a scanner which stops with work left over, e.g. when
+// a huge scheduled set has a backlog of due jobs.
+type backlogged interface {
+	Behind() bool
+}
+
 func newTaskRunner() *taskRunner {
 	return &taskRunner{
 		tasks: make([]*task, 0),
+		tick:  time.Second,
 	}
 }
 
-func (ts *taskRunner) AddTask(sec int64, thing Taskable) {
+func (ts *taskRunner) AddTask(every time.Duration, thing Taskable) {
 	var tsk task
 	tsk.runner = thing
-	tsk.every = sec
+	tsk.every = every
+	// first run at the next interval, not straight away
+	tsk.last = time.Now().Truncate(every)
 	ts.mutex.Lock()
 	ts.tasks = append(ts.tasks, &tsk)
+	if every < ts.tick {
+		ts.tick = every
+	}
 	ts.mutex.Unlock()
 }
 
@@ -58,11 +79,14 @@ func (ts *taskRunner) Run(stopper chan bool) {
 	go func() {
 		// add random jitter so the runner goroutine doesn't fire at 000ms
 		time.Sleep(time.Duration(rand.Float64()) * time.Second)
-		timer := time.NewTicker(1 * time.Second)
+		ts.mutex.RLock()
+		tick := ts.tick
+		ts.mutex.RUnlock()
+		timer := time.NewTicker(tick)
 		defer timer.Stop()
 
 		for {
-			ts.cycle()
+			ts.cycle(time.Now())
 			select {
 			case <-timer.C:
 			case <-stopper:
@@ -84,16 +108,41 @@ func (ts *taskRunner) Stats() map[string]map[string]interface{} {
 	return data
 }
 
-func (ts *taskRunner) cycle() {
+// TaskStats is how many times a task has run and how long it has
+// taken altogether.
+type TaskStats struct {
+	Runs     int64
+	Walltime time.Duration
+}
+
+// Each task's TaskStats by name.
+func (s *Server) TaskStats() map[string]TaskStats {
+	ts := s.taskRunner
+	data := map[string]TaskStats{}
+
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+	for _, task := range ts.tasks {
+		data[task.runner.Name()] = TaskStats{
+			Runs:     atomic.LoadInt64(&task.runs),
+			Walltime: time.Duration(atomic.LoadInt64(&task.walltimeNs)),
+		}
+	}
+	return data
+}
+
+func (ts *taskRunner) cycle(now time.Time) {
 	count := int64(0)
 	start := time.Now()
-	sec := start.Unix()
+	// only the runner goroutine touches a task's last run
 	ts.mutex.RLock()
 	defer ts.mutex.RUnlock()
 	for _, t := range ts.tasks {
-		if sec%t.every != 0 {
+		window := now.Truncate(t.every)
+		if !window.After(t.last) && !t.behind {
 			continue
 		}
+		t.last = window
 		tstart := time.Now()
 		//util.Debugf("Running task %s", t.runner.Name())
 		err := t.runner.Execute()
@@ -101,6 +150,9 @@ func (ts *taskRunner) cycle() {
 		if err != nil {
 			util.Warnf("Error running task %s: %v", t.runner.Name(), err)
 		}
+		if b, ok := t.runner.(backlogged); ok {
+			t.behind = b.Behind()
+		}
 		atomic.AddInt64(&t.runs, 1)
 		atomic.AddInt64(&t.walltimeNs, tend.Sub(tstart).Nanoseconds())
 		count++
@@ -114,14 +166,24 @@ func (ts *taskRunner) cycle() {
 func (s *Server) startTasks() {
 	ts := newTaskRunner()
 	// scan the various sets, looking for things to do
-	ts.AddTask(5, &scanner{name: "Scheduled", set: s.store.Scheduled(), task: s.manager.EnqueueScheduledJobs})
-	ts.AddTask(5, &scanner{name: "Retries", set: s.store.Retries(), task: s.manager.RetryJobs})
-	ts.AddTask(60, &scanner{name: "Dead", set: s.store.Dead(), task: s.manager.Purge})
+	opts := s.Options
+	ts.AddTask(opts.ScheduledScanInterval, &scanner{name: "Scheduled", set: s.store.Scheduled(), task: s.manager.EnqueueScheduledJobs})
+	ts.AddTask(opts.RetryScanInterval, &scanner{name: "Retries", set: s.store.Retries(), task: s.manager.RetryJobs})
+	ts.AddTask(opts.DeadScanInterval, &scanner{name: "Dead", set: s.store.Dead(), task: s.manager.Purge})
+	// keeps the dead set within dead_max_jobs
+	ts.AddTask(opts.DeadTrimInterval, &scanner{name: "Trimmer", set: s.store.Dead(), task: s.manager.TrimDead})
 
 	// reaps job reservations which have expired
-	ts.AddTask(15, &reservationReaper{s.manager, 0})
+	ts.AddTask(opts.ReservationReapInterval, &reservationReaper{s.manager, 0})
+	// kills jobs which waited too long for their dependencies
+	ts.AddTask(time.Minute, &heldReaper{m: s.manager})
 	// reaps workers who have not heartbeated
-	ts.AddTask(15, &beatReaper{s.workers, 0})
+	ts.AddTask(opts.HeartbeatReapInterval, &beatReaper{w: s.workers, gone: s.workerGone})
+	// kills workers who ignore the terminate signal
+	ts.AddTask(opts.HardKillInterval, &hardKiller{w: s.workers, m: s.manager, options: s.CurrentOptions})
+	// deletes dead jobs past their retention period once a day
+	s.deadPruner = &deadPruner{m: s.manager, retention: s.deadRetention}
+	ts.AddTask(24*time.Hour, s.deadPruner)
 
 	ts.Run(s.Stopper())
 	s.taskRunner = ts
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type countingTask struct {
+	runs    int
+	backlog int
+}
+
+func (ct *countingTask) Name() string { return "Counting" }
+func (ct *countingTask) Execute() error {
+	ct.runs++
+	if ct.backlog > 0 {
+		ct.backlog--
+	}
+	return nil
+}
+func (ct *countingTask) Stats() map[string]interface{} { return nil }
+func (ct *countingTask) Behind() bool                  { return ct.backlog > 0 }
+
+func TestTaskRunnerIntervals(t *testing.T) {
+	ts := newTaskRunner()
+	fast := &countingTask{}
+	slow := &countingTask{}
+	ts.AddTask(30*time.Second, slow)
+	assert.Equal(t, time.Second, ts.tick)
+	ts.AddTask(250*time.Millisecond, fast)
+	assert.Equal(t, 250*time.Millisecond, ts.tick)
+
+	// nothing runs until its next interval
+	now := time.Now().Truncate(time.Minute).Add(time.Minute)
+	ts.tasks[0].last = now.Add(-30 * time.Second)
+	ts.tasks[1].last = now.Add(-250 * time.Millisecond)
+	ts.cycle(now.Add(-time.Millisecond))
+	assert.Equal(t, 0, fast.runs)
+	assert.Equal(t, 0, slow.runs)
+
+	for i := 0; i < 8; i++ {
+		ts.cycle(now.Add(time.Duration(i) * 125 * time.Millisecond))
+	}
+	assert.Equal(t, 4, fast.runs)
+	assert.Equal(t, 1, slow.runs)
+	assert.EqualValues(t, 5, ts.executions)
+
+	ts.cycle(now.Add(30 * time.Second))
+	assert.Equal(t, 5, fast.runs)
+	assert.Equal(t, 2, slow.runs)
+}
+
+func TestTaskRunnerBacklog(t *testing.T) {
+	ts := newTaskRunner()
+	ct := &countingTask{}
+	ts.AddTask(5*time.Second, ct)
+	now := time.Now().Truncate(time.Minute).Add(time.Minute)
+	ts.tasks[0].last = now.Add(-5 * time.Second)
+
+	// a task which is behind runs every tick until it catches up
+	ct.backlog = 3
+	for i := 0; i < 5; i++ {
+		ts.cycle(now.Add(time.Duration(i) * time.Second))
+	}
+	assert.Equal(t, 3, ct.runs)
+	assert.False(t, ts.tasks[0].behind)
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"fmt"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -35,10 +37,41 @@ func (r *reservationReaper) Stats() map[string]interface{} {
 }
 
 /*
- * Removes any heartbeat records over 1 minute old.
+ * Sends the jobs held longer than manager.DependencyTTL for their
+ * dependencies to the dead set.
+ */
+type heldReaper struct {
+	m     manager.Manager
+	count int64
+}
+
+func (r *heldReaper) Name() string {
+	return "Held"
+}
+
+func (r *heldReaper) Execute() error {
+	count, err := r.m.ReapHeldJobs()
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&r.count, int64(count))
+	return nil
+}
+
+func (r *heldReaper) Stats() map[string]interface{} {
+	return map[string]interface{}{
+		"reaped": atomic.LoadInt64(&r.count),
+	}
+}
+
+/*
+ * Removes any heartbeat records over 1 minute old, passing each
+ * reaped worker to gone.
  */
 type beatReaper struct {
 	w     *workers
+	gone  func(*ClientData)
 	count int64
 }
 
@@ -47,8 +80,13 @@ func (r *beatReaper) Name() string {
 }
 
 func (r *beatReaper) Execute() error {
-	count := r.w.reapHeartbeats(time.Now().Add(-1 * time.Minute))
-	atomic.AddInt64(&r.count, int64(count))
+	reaped := r.w.reapHeartbeats(time.Now().Add(-1 * time.Minute))
+	if r.gone != nil {
+		for _, worker := range reaped {
+			r.gone(worker)
+		}
+	}
+	atomic.AddInt64(&r.count, int64(len(reaped)))
 	return nil
 }
 
@@ -58,3 +96,126 @@ func (r *beatReaper) Stats() map[string]interface{} {
 		"reaped": atomic.LoadInt64(&r.count),
 	}
 }
+
+/*
+ * Forcibly disconnects workers which are still connected
+ * HardKillTimeout after being told to terminate.  Any jobs
+ * they still hold are failed so they will be retried.
+ */
+type hardKiller struct {
+	w       *workers
+	m       manager.Manager
+	options func() *ServerOptions
+	count   int64
+}
+
+func (k *hardKiller) Name() string {
+	return "Terminator"
+}
+
+func (k *hardKiller) Execute() error {
+	timeout := k.options().HardKillTimeout
+	killed := k.w.killTerminated(time.Now().Add(-timeout))
+	for _, wid := range killed {
+		count, err := k.m.FailWorkerJobs(wid)
+		if err != nil {
+			return err
+		}
+		util.Warnf("Worker %s ignored terminate for %v, closed its connections and failed %d jobs", wid, timeout, count)
+	}
+	atomic.AddInt64(&k.count, int64(len(killed)))
+	return nil
+}
+
+func (k *hardKiller) Stats() map[string]interface{} {
+	return map[string]interface{}{
+		"killed": atomic.LoadInt64(&k.count),
+	}
+}
+
+/*
+ * Deletes dead jobs which failed more than DeadJobRetentionDays ago,
+ * or outside their queue's own retention set under [queues].
+ * Pruning a large dead set takes a while so it runs in the
+ * background rather than holding up the other tasks.
+ */
+type deadPruner struct {
+	m         manager.Manager
+	retention func(queue string) manager.DeadRetention
+	running   int32
+
+	mu         sync.Mutex
+	lastPruned int64
+	oldest     time.Time
+}
+
+func (p *deadPruner) Name() string {
+	return "Pruner"
+}
+
+func (p *deadPruner) Execute() error {
+	if !atomic.CompareAndSwapInt32(&p.running, 0, 1) {
+		return nil
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&p.running, 0)
+		count, err := p.record(p.m.RetainDead(p.retention))
+		if err != nil {
+			util.Warnf("Unable to prune dead jobs: %v", err)
+			return
+		}
+		util.Infof("Pruned %d dead jobs past their retention", count)
+	}()
+	return nil
+}
+
+func (p *deadPruner) prune(before time.Time) (int64, error) {
+	return p.record(p.m.PruneDead(before))
+}
+
+func (p *deadPruner) record(count int64, oldest time.Time, err error) (int64, error) {
+	if err != nil {
+		return count, err
+	}
+
+	p.mu.Lock()
+	p.lastPruned = count
+	p.oldest = oldest
+	p.mu.Unlock()
+	return count, nil
+}
+
+// The number of jobs deleted by the last prune and the
+// failed_at of the oldest dead job remaining, blank if
+// there are none or no prune has run yet.
+func (p *deadPruner) lastRun() (int64, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.oldest.IsZero() {
+		return p.lastPruned, ""
+	}
+	return p.lastPruned, util.Thens(p.oldest)
+}
+
+func (p *deadPruner) Stats() map[string]interface{} {
+	pruned, oldest := p.lastRun()
+	return map[string]interface{}{
+		"pruned":    pruned,
+		"oldest_at": oldest,
+	}
+}
+
+func checkDeadOverflow(overflow string) error {
+	switch overflow {
+	case manager.DeadDropOldest, manager.DeadRefuse:
+		return nil
+	}
+	return fmt.Errorf("Invalid dead_overflow %q, expected %s or %s", overflow, manager.DeadDropOldest, manager.DeadRefuse)
+}
+
+// See manager.Options.DeadLimit.
+func (s *Server) deadLimit() (uint64, string) {
+	opts := s.CurrentOptions()
+	return opts.DeadMaxJobs, opts.DeadOverflow
+}
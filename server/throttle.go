@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ipThrottle limits how quickly each remote IP can open connections
+// with a token bucket per IP.  The zero value is ready to use.
+type ipThrottle struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Returns false if ip has no tokens left.  Each bucket holds up to
+// burst tokens and refills at rate tokens per second.
+func (t *ipThrottle) allow(ip string, rate float64, burst int, now time.Time) bool {
+	if burst < 1 {
+		burst = 1
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.buckets == nil {
+		t.buckets = map[string]*bucket{}
+	}
+	t.sweep(rate, burst, now)
+
+	b, ok := t.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		t.buckets[ip] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Forget buckets which have refilled completely, a new bucket would
+// be identical, so a scan from many IPs doesn't grow the map forever.
+func (t *ipThrottle) sweep(rate float64, burst int, now time.Time) {
+	if now.Sub(t.lastSweep) < time.Minute {
+		return
+	}
+	t.lastSweep = now
+	for ip, b := range t.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= float64(burst) {
+			delete(t.buckets, ip)
+		}
+	}
+}
+
+func (t *ipThrottle) size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.buckets)
+}
+
+// Connections over Unix sockets or from unknown addresses are never
+// throttled.
+func (s *Server) allowConnection(addr net.Addr) bool {
+	opts := s.CurrentOptions()
+	rate := opts.ConnectionRate
+	if rate <= 0 {
+		return true
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	return s.throttle.allow(tcp.IP.String(), rate, opts.ConnectionBurst, time.Now())
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPThrottle(t *testing.T) {
+	var th ipThrottle
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, th.allow("10.0.0.1", 2, 3, now))
+	}
+	assert.False(t, th.allow("10.0.0.1", 2, 3, now))
+	// other IPs have their own bucket
+	assert.True(t, th.allow("10.0.0.2", 2, 3, now))
+
+	// 2 per second refills one token in 500ms
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, th.allow("10.0.0.1", 2, 3, now))
+	assert.False(t, th.allow("10.0.0.1", 2, 3, now))
+	assert.Equal(t, 2, th.size())
+
+	// full buckets are forgotten
+	now = now.Add(2 * time.Minute)
+	assert.True(t, th.allow("10.0.0.3", 2, 3, now))
+	assert.Equal(t, 1, th.size())
+}
+
+func TestConnectionThrottling(t *testing.T) {
+	s := &Server{
+		Options: &ServerOptions{ConnectionRate: 0.1, ConnectionBurst: 2},
+		Stats:   &RuntimeStats{},
+		workers: newWorkers(),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go s.serve(listener, false)
+
+	greeting := func() string {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		assert.NoError(t, err)
+		defer conn.Close()
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		assert.NoError(t, err)
+		return line
+	}
+
+	assert.Contains(t, greeting(), "+HI ")
+	assert.Contains(t, greeting(), "+HI ")
+	assert.Contains(t, greeting(), "-THROTTLED Too many connections from 127.0.0.1")
+	assert.EqualValues(t, 1, atomic.LoadUint64(&s.Stats.Throttled))
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/contribsys/faktory/util"
+)
+
+// certLoader serves the certificate in certFile and keyFile to TLS
+// clients and, if caFile is set, requires clients to present a
+// certificate signed by one of the CAs in caFile.  The files are read
+// again on reload so certificates can be rotated with SIGHUP without
+// dropping connections.
+type certLoader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func newCertLoader(certFile, keyFile, caFile string) (*certLoader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS requires both tls_cert_file and tls_key_file")
+	}
+	cl := &certLoader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	err := cl.load()
+	if err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+func (cl *certLoader) load() error {
+	cert, err := tls.LoadX509KeyPair(cl.certFile, cl.keyFile)
+	if err != nil {
+		return fmt.Errorf("Unable to load TLS certificate %s: %v", cl.certFile, err)
+	}
+
+	var pool *x509.CertPool
+	if cl.caFile != "" {
+		data, err := ioutil.ReadFile(cl.caFile)
+		if err != nil {
+			return fmt.Errorf("Unable to load TLS client CA: %v", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("Unable to load TLS client CA %s: no PEM certificates", cl.caFile)
+		}
+	}
+
+	cl.mu.Lock()
+	cl.cert = &cert
+	cl.clientCAs = pool
+	cl.mu.Unlock()
+	return nil
+}
+
+func (cl *certLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return cl.cert, nil
+}
+
+func (cl *certLoader) config() *tls.Config {
+	cfg := &tls.Config{
+		GetCertificate: cl.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if cl.caFile != "" {
+		cfg.GetConfigForClient = cl.clientConfig
+	}
+	return cfg
+}
+
+// Each handshake gets the current CA pool so a reload
+// changes which client certificates are trusted.
+func (cl *certLoader) clientConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return &tls.Config{
+		GetCertificate: cl.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		ClientCAs:      cl.clientCAs,
+	}, nil
+}
+
+// The identity of a client which presented a verified certificate:
+// its common name or else its first DNS or email SAN.
+func certIdentity(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 {
+		return ""
+	}
+	cert := state.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
+
+// Re-read the TLS certificate, if any, so a rotated
+// certificate is used for new connections.
+func (s *Server) reloadCertificate() {
+	if s.certs == nil {
+		return
+	}
+	err := s.certs.load()
+	if err != nil {
+		util.Warnf("%v, still using the previous certificate", err)
+		return
+	}
+	util.Infof("Reloaded TLS certificate %s", s.certs.certFile)
+}
+
+func checkRedisTLS(opts *ServerOptions) error {
+	if opts.RedisTLSCAFile == "" && opts.RedisTLSCertFile == "" && opts.RedisTLSKeyFile == "" {
+		return nil
+	}
+	if !strings.HasPrefix(opts.RedisURL, "rediss://") {
+		return fmt.Errorf("redis_tls_ca_file, redis_tls_cert_file and redis_tls_key_file need a rediss:// redis_url")
+	}
+	if (opts.RedisTLSCertFile == "") != (opts.RedisTLSKeyFile == "") {
+		return fmt.Errorf("A Redis client certificate needs both redis_tls_cert_file and redis_tls_key_file")
+	}
+	return nil
+}
+
+// The TLS config for a rediss:// RedisURL or nil to check Redis's
+// certificate against the system's CAs.
+func redisTLSConfig(opts *ServerOptions) (*tls.Config, error) {
+	if opts.RedisTLSCAFile == "" && opts.RedisTLSCertFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+	if opts.RedisTLSCAFile != "" {
+		data, err := ioutil.ReadFile(opts.RedisTLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load Redis TLS CA: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("Unable to load Redis TLS CA %s: no PEM certificates", opts.RedisTLSCAFile)
+		}
+	}
+	if opts.RedisTLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.RedisTLSCertFile, opts.RedisTLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load Redis TLS certificate %s: %v", opts.RedisTLSCertFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+	der  []byte
+}
+
+// Create a certificate for localhost with the given common name,
+// signed by parent or self-signed if parent is nil.
+func newTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (tc *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tc.der})
+}
+
+func (tc *testCert) keyPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(tc.key)})
+}
+
+func (tc *testCert) write(t *testing.T, certFile, keyFile string) {
+	assert.NoError(t, ioutil.WriteFile(certFile, tc.certPEM(), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, tc.keyPEM(), 0600))
+}
+
+func (tc *testCert) pair(t *testing.T) tls.Certificate {
+	pair, err := tls.X509KeyPair(tc.certPEM(), tc.keyPEM())
+	assert.NoError(t, err)
+	return pair
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "faktory-tls")
+	assert.NoError(t, err)
+	return dir
+}
+
+func TestCertReload(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	certFile := dir + "/public.crt"
+	keyFile := dir + "/private.key"
+
+	_, err := newCertLoader(certFile, "", "")
+	assert.Error(t, err)
+	_, err = newCertLoader(certFile, keyFile, "")
+	assert.Error(t, err)
+
+	first := newTestCert(t, "first", nil)
+	first.write(t, certFile, keyFile)
+	certs, err := newCertLoader(certFile, keyFile, "")
+	assert.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	listener = tls.NewListener(listener, certs.config())
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("+HI {\"v\":3}\r\n"))
+			conn.Close()
+		}
+	}()
+
+	peer := func(trusted *testCert) (string, error) {
+		pool := x509.NewCertPool()
+		pool.AddCert(trusted.cert)
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "localhost"})
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+	}
+
+	cn, err := peer(first)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", cn)
+
+	// a bad file keeps the current certificate
+	err = ioutil.WriteFile(keyFile, []byte("nope"), 0600)
+	assert.NoError(t, err)
+	assert.Error(t, certs.load())
+	cn, err = peer(first)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", cn)
+
+	second := newTestCert(t, "second", nil)
+	second.write(t, certFile, keyFile)
+	assert.NoError(t, certs.load())
+	cn, err = peer(second)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", cn)
+	_, err = peer(first)
+	assert.Error(t, err)
+}
+
+func TestTLSServer(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "Test CA", nil)
+	ca.write(t, dir+"/ca.crt", dir+"/ca.key")
+	server := newTestCert(t, "localhost", ca)
+	server.write(t, dir+"/public.crt", dir+"/private.key")
+
+	runServerWith("localhost:7435", func(opts *ServerOptions) {
+		opts.TLSCertFile = dir + "/public.crt"
+		opts.TLSKeyFile = dir + "/private.key"
+	}, func(s *Server) {
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.cert)
+		srv := &client.Server{
+			Network: "tcp+tls",
+			Address: "localhost:7435",
+			Timeout: time.Second,
+			TLS:     &tls.Config{RootCAs: pool, ServerName: "localhost"},
+		}
+		cl, err := client.Dial(srv, "")
+		assert.NoError(t, err)
+		defer cl.Close()
+
+		err = cl.Push(client.NewJob("Secure", 1))
+		assert.NoError(t, err)
+
+		// plaintext clients can't complete the handshake
+		srv.Network = "tcp"
+		_, err = client.Dial(srv, "")
+		assert.Error(t, err)
+	})
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "Test CA", nil)
+	ca.write(t, dir+"/ca.crt", dir+"/ca.key")
+	newTestCert(t, "localhost", ca).write(t, dir+"/public.crt", dir+"/private.key")
+	worker := newTestCert(t, "worker-1.example.com", ca)
+	stranger := newTestCert(t, "stranger", newTestCert(t, "Other CA", nil))
+
+	certs, err := newCertLoader(dir+"/public.crt", dir+"/private.key", dir+"/ca.crt")
+	assert.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	listener = tls.NewListener(listener, certs.config())
+	defer listener.Close()
+
+	s := &Server{Options: &ServerOptions{}, workers: newWorkers()}
+	accepted := make(chan *Connection, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- startConnection(conn, s, false)
+		}
+	}()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	hello := func(cert *testCert) error {
+		cfg := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+		if cert != nil {
+			cfg.Certificates = []tls.Certificate{cert.pair(t)}
+		}
+		conn, err := tls.Dial("tcp", listener.Addr().String(), cfg)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		buf := bufio.NewReader(conn)
+		_, err = buf.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		// the identity can't be claimed in the HELLO
+		conn.Write([]byte(`HELLO {"wid":"mtls","v":2,"Identity":"admin"}`))
+		conn.Write([]byte("\r\n"))
+		_, err = buf.ReadString('\n')
+		return err
+	}
+
+	assert.Error(t, hello(nil))
+	assert.Nil(t, <-accepted)
+	assert.Error(t, hello(stranger))
+	assert.Nil(t, <-accepted)
+
+	assert.NoError(t, hello(worker))
+	c := <-accepted
+	assert.NotNil(t, c)
+	assert.Equal(t, "worker-1.example.com", c.client.Identity)
+	assert.Equal(t, "worker-1.example.com", s.workers.heartbeats["mtls"].Identity)
+}
+
+func TestRedisTLSOptions(t *testing.T) {
+	assert.NoError(t, checkRedisTLS(&ServerOptions{RedisURL: "redis://localhost"}))
+	assert.Error(t, checkRedisTLS(&ServerOptions{RedisURL: "redis://localhost", RedisTLSCAFile: "ca.crt"}))
+	assert.Error(t, checkRedisTLS(&ServerOptions{RedisURL: "rediss://localhost", RedisTLSCertFile: "redis.crt"}))
+	assert.NoError(t, checkRedisTLS(&ServerOptions{RedisURL: "rediss://localhost", RedisTLSCertFile: "redis.crt", RedisTLSKeyFile: "redis.key"}))
+
+	config, err := redisTLSConfig(&ServerOptions{RedisURL: "rediss://localhost"})
+	assert.NoError(t, err)
+	assert.Nil(t, config)
+	_, err = redisTLSConfig(&ServerOptions{RedisURL: "rediss://localhost", RedisTLSCAFile: "/no/such/ca.crt"})
+	assert.Error(t, err)
+}
+
+func TestRedisTLS(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "Test CA", nil)
+	ca.write(t, dir+"/ca.crt", dir+"/ca.key")
+	newTestCert(t, "localhost", ca).write(t, dir+"/redis.crt", dir+"/redis.key")
+	newTestCert(t, "faktory", ca).write(t, dir+"/client.crt", dir+"/client.key")
+
+	sock := dir + "/redis.sock"
+	stopper, err := storage.BootRedis(dir, sock)
+	if stopper != nil {
+		defer stopper()
+	}
+	assert.NoError(t, err)
+
+	// stand in for a managed Redis which requires TLS and client
+	// certificates
+	certs, err := newCertLoader(dir+"/redis.crt", dir+"/redis.key", dir+"/ca.crt")
+	assert.NoError(t, err)
+	listener, err := tls.Listen("tcp", "localhost:0", certs.config())
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			backend, err := net.Dial("unix", sock)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			go func() {
+				io.Copy(backend, conn)
+				backend.Close()
+			}()
+			go func() {
+				io.Copy(conn, backend)
+				conn.Close()
+			}()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	opts := &ServerOptions{
+		StorageDirectory: dir,
+		RedisURL:         "rediss://localhost:" + port,
+		RedisTLSCAFile:   dir + "/ca.crt",
+	}
+	s, err := NewServer(opts)
+	assert.NoError(t, err)
+	// without a client certificate the handshake fails
+	_, err = s.openStore()
+	assert.Error(t, err)
+
+	opts.RedisTLSCertFile = dir + "/client.crt"
+	opts.RedisTLSKeyFile = dir + "/client.key"
+	store, err := s.openStore()
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.Raw().Set("tls", []byte("yes")))
+}
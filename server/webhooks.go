@@ -0,0 +1,286 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/contribsys/faktory/manager"
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/util"
+)
+
+/*
+ * The webhooks subsystem POSTs server events to a URL so alerts, e.g.
+ * to PagerDuty or Slack through a relay, are driven by the server
+ * rather than by scripts polling INFO:
+ *
+ *	[webhooks]
+ *	url = "https://alerts.example.com/faktory"
+ *	secret = "s3cret"
+ *	events = ["job.dead", "worker.gone"]
+ *
+ *	[webhooks.queue_depth]
+ *	default = 10000
+ *	"bulk_*" = 100000
+ *
+ * The events are:
+ *
+ *	job.dead        a job ran out of retries, data is the job
+ *	batch.complete  a batch's jobs have all run, data is its status
+ *	queue.depth     a queue grew to its queue_depth size, or shrank
+ *	                back below it, checked every 10 seconds
+ *	worker.gone     a worker process stopped sending BEAT without
+ *	                having been told to terminate
+ *
+ * All of them are sent unless events lists some.  queue_depth keys
+ * are queue names or patterns as in queue_limits.  Each POST is a JSON
+ * object {"event": ..., "at": ..., "data": ...} with the event in the
+ * X-Faktory-Event header and, given a secret, X-Faktory-Signature set
+ * to "sha256=" and the hex HMAC-SHA256 of the body keyed by the secret.
+ * Events are sent in the background in the order they happened.  A
+ * POST which fails is retried a few times, backing off, and then
+ * logged, as are events which happen faster than they can be sent.
+ */
+type webhooks struct {
+	mu     sync.Mutex
+	config *webhookConfig
+	events chan serverEvent
+	done   chan struct{}
+}
+
+type webhookConfig struct {
+	url    string
+	secret string
+	events map[string]bool
+	// the queue sizes for queue.depth, nil if there are none
+	depth *queueLimits
+}
+
+var (
+	webhookEvents        = []string{"job.dead", "batch.complete", "queue.depth", "worker.gone"}
+	webhookBacklog       = 1000
+	webhookAttempts      = 5
+	webhookDelay         = time.Second
+	webhookDepthInterval = 10 * time.Second
+)
+
+func (wh *webhooks) Name() string {
+	return "webhooks"
+}
+
+func (wh *webhooks) Start(s *Server) error {
+	err := wh.Reload(s)
+	if err != nil {
+		return err
+	}
+	events := make(chan serverEvent, webhookBacklog)
+	done := make(chan struct{})
+	wh.mu.Lock()
+	wh.events = events
+	wh.done = done
+	wh.mu.Unlock()
+	go wh.run(s, events, done)
+	return nil
+}
+
+func (wh *webhooks) Reload(s *Server) error {
+	config, err := parseWebhooks(s.CurrentOptions().GlobalConfig["webhooks"])
+	if err != nil {
+		return err
+	}
+	wh.mu.Lock()
+	wh.config = config
+	wh.mu.Unlock()
+	if config != nil {
+		util.Infof("Sending webhooks for %d events", len(config.events))
+	}
+	return nil
+}
+
+func (wh *webhooks) Stop(s *Server) error {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	if wh.done != nil {
+		close(wh.done)
+		wh.done = nil
+		wh.events = nil
+	}
+	return nil
+}
+
+// Queue the event to be sent if it's enabled and the backlog isn't
+// full.
+func (wh *webhooks) send(event serverEvent) {
+	wh.mu.Lock()
+	config := wh.config
+	events := wh.events
+	wh.mu.Unlock()
+	if config == nil || events == nil || !config.events[event.Event] {
+		return
+	}
+	select {
+	case events <- event:
+	default:
+		util.Warnw("Webhook backlog is full, unable to send event", map[string]interface{}{"event": event.Event})
+	}
+}
+
+func (wh *webhooks) run(s *Server, events chan serverEvent, done chan struct{}) {
+	ticker := time.NewTicker(webhookDepthInterval)
+	defer ticker.Stop()
+	// the queues at or over their depth, only touched here
+	deep := map[string]bool{}
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			wh.checkDepths(s.Store(), deep)
+		case event := <-events:
+			wh.deliver(event, done)
+		}
+	}
+}
+
+func (wh *webhooks) deliver(event serverEvent, done chan struct{}) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		util.Warnw("Unable to encode webhook", map[string]interface{}{"event": event.Event, "error": err})
+		return
+	}
+	err = retrySend(done, webhookAttempts, webhookDelay, func() error {
+		wh.mu.Lock()
+		config := wh.config
+		wh.mu.Unlock()
+		if config == nil {
+			return nil
+		}
+		header := map[string]string{"X-Faktory-Event": event.Event}
+		if config.secret != "" {
+			header["X-Faktory-Signature"] = "sha256=" + hex.EncodeToString(hmacSHA256([]byte(config.secret), string(data)))
+		}
+		return postJSON(config.url, data, header)
+	})
+	if err != nil {
+		util.Warnw("Unable to send webhook", map[string]interface{}{"event": event.Event, "error": err})
+	}
+}
+
+// Send queue.depth for each queue which has crossed its size since
+// the last check.
+func (wh *webhooks) checkDepths(store storage.Store, deep map[string]bool) {
+	wh.mu.Lock()
+	config := wh.config
+	wh.mu.Unlock()
+	if config == nil || config.depth == nil || !config.events["queue.depth"] {
+		return
+	}
+	store.EachQueue(func(q storage.Queue) {
+		name := q.Name()
+		max := config.depth.limit(name)
+		size := q.Size()
+		over := max > 0 && size >= max
+		if over == deep[name] {
+			return
+		}
+		if over {
+			deep[name] = true
+		} else {
+			delete(deep, name)
+		}
+		// its size was removed from the config
+		if max == 0 {
+			return
+		}
+		wh.send(serverEvent{Event: "queue.depth", At: util.Nows(), Data: map[string]interface{}{
+			"queue":     name,
+			"size":      size,
+			"threshold": max,
+			"over":      over,
+		}})
+	})
+}
+
+// See manager.Options.OnBatchComplete.
+func (s *Server) batchCompleted(status *manager.BatchStatus) {
+	s.publish("batch.complete", status)
+}
+
+// Called with each worker whose heartbeat is reaped.
+func (s *Server) workerGone(worker *ClientData) {
+	if worker.state == Terminate {
+		return
+	}
+	s.publish("worker.gone", map[string]interface{}{
+		"wid":               worker.Wid,
+		"hostname":          worker.Hostname,
+		"pid":               worker.Pid,
+		"labels":            worker.Labels,
+		"started_at":        util.Thens(worker.StartedAt),
+		"last_heartbeat_at": util.Thens(worker.lastHeartbeat),
+	})
+}
+
+// Returns nil if the section is missing, i.e. nothing is sent.
+func parseWebhooks(section interface{}) (*webhookConfig, error) {
+	if section == nil {
+		return nil, nil
+	}
+	values, ok := section.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid webhooks: must be a table")
+	}
+
+	config := &webhookConfig{events: map[string]bool{}}
+	for key, val := range values {
+		switch key {
+		case "url":
+			str, _ := val.(string)
+			u, err := url.Parse(str)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("Invalid webhooks: url must be an http or https URL")
+			}
+			config.url = str
+		case "secret":
+			str, ok := val.(string)
+			if !ok {
+				return nil, fmt.Errorf("Invalid webhooks: secret must be a string")
+			}
+			config.secret = str
+		case "events":
+			items, ok := val.([]interface{})
+			if !ok || len(items) == 0 {
+				return nil, fmt.Errorf("Invalid webhooks: events must be an array of event names")
+			}
+			for _, item := range items {
+				name, _ := item.(string)
+				if !knownEvent(webhookEvents, name) {
+					return nil, fmt.Errorf("Invalid webhooks: unknown event %q, expected %s", name, strings.Join(webhookEvents, ", "))
+				}
+				config.events[name] = true
+			}
+		case "queue_depth":
+			exact, patterns, err := parseQueueSizes("webhooks.queue_depth", val)
+			if err != nil {
+				return nil, err
+			}
+			config.depth = &queueLimits{exact: exact, patterns: patterns}
+		default:
+			return nil, fmt.Errorf("Invalid webhooks: %s is not a known setting", key)
+		}
+	}
+	if config.url == "" {
+		return nil, fmt.Errorf("Invalid webhooks: needs a url")
+	}
+	if len(config.events) == 0 {
+		for _, name := range webhookEvents {
+			config.events[name] = true
+		}
+	}
+	return config, nil
+}
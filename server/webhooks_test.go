@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/manager"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseWebhooks(t *testing.T) {
+	config, err := parseWebhooks(aclConfig(t, `
+[webhooks]
+url = "https://alerts.example.com/faktory"
+secret = "s3cret"
+events = ["job.dead", "queue.depth"]
+
+[webhooks.queue_depth]
+default = 1000
+"bulk_*" = 50000
+`)["webhooks"])
+	assert.NoError(t, err)
+	assert.Equal(t, "https://alerts.example.com/faktory", config.url)
+	assert.Equal(t, "s3cret", config.secret)
+	assert.Equal(t, map[string]bool{"job.dead": true, "queue.depth": true}, config.events)
+	assert.EqualValues(t, 1000, config.depth.limit("default"))
+	assert.EqualValues(t, 50000, config.depth.limit("bulk_mail"))
+	assert.EqualValues(t, 0, config.depth.limit("critical"))
+
+	config, err = parseWebhooks(aclConfig(t, "[webhooks]\nurl = \"http://localhost:9000/hook\"")["webhooks"])
+	assert.NoError(t, err)
+	assert.Len(t, config.events, len(webhookEvents))
+	assert.Nil(t, config.depth)
+
+	config, err = parseWebhooks(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, config)
+
+	for _, bad := range []string{
+		"webhooks = 1",
+		"[webhooks]",
+		"[webhooks]\nurl = 1",
+		"[webhooks]\nurl = \"alerts.example.com\"",
+		"[webhooks]\nurl = \"https://alerts.example.com\"\nsecret = 1",
+		"[webhooks]\nurl = \"https://alerts.example.com\"\nevents = []",
+		"[webhooks]\nurl = \"https://alerts.example.com\"\nevents = [\"job.done\"]",
+		"[webhooks]\nurl = \"https://alerts.example.com\"\ntopic = \"faktory\"",
+		"[webhooks]\nurl = \"https://alerts.example.com\"\n[webhooks.queue_depth]\ndefault = 0",
+	} {
+		_, err = parseWebhooks(aclConfig(t, bad)["webhooks"])
+		assert.Error(t, err, bad)
+	}
+}
+
+type postedHook struct {
+	event     string
+	signature string
+	body      []byte
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	oldDelay := webhookDelay
+	webhookDelay = time.Millisecond
+	defer func() { webhookDelay = oldDelay }()
+
+	posted := make(chan postedHook, 10)
+	calls := 0
+	ws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		// the first attempt fails and is retried
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		data, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		posted <- postedHook{r.Header.Get("X-Faktory-Event"), r.Header.Get("X-Faktory-Signature"), data}
+	}))
+	defer ws.Close()
+
+	s := &Server{Options: &ServerOptions{GlobalConfig: map[string]interface{}{
+		"webhooks": map[string]interface{}{
+			"url":    ws.URL,
+			"secret": "s3cret",
+			"events": []interface{}{"job.dead", "batch.complete", "worker.gone"},
+		},
+	}}}
+	wh := &webhooks{}
+	s.webhooks = wh
+	assert.NoError(t, wh.Start(s))
+	defer wh.Stop(s)
+
+	receive := func() (postedHook, serverEvent) {
+		select {
+		case hook := <-posted:
+			var event serverEvent
+			assert.NoError(t, json.Unmarshal(hook.body, &event))
+			return hook, event
+		case <-time.After(5 * time.Second):
+			t.Fatal("webhook was not sent")
+		}
+		return postedHook{}, serverEvent{}
+	}
+
+	job := client.NewJob("Invoice", 1234)
+	s.jobDied(job)
+	hook, event := receive()
+	assert.Equal(t, "job.dead", hook.event)
+	assert.Equal(t, "sha256="+hex.EncodeToString(hmacSHA256([]byte("s3cret"), string(hook.body))), hook.signature)
+	assert.Equal(t, "job.dead", event.Event)
+	assert.NotEmpty(t, event.At)
+	assert.Equal(t, job.Jid, event.Data.(map[string]interface{})["jid"])
+	assert.Equal(t, 2, calls)
+
+	// told to terminate, so it's expected to go
+	s.workerGone(&ClientData{Wid: "w1", state: Terminate})
+	s.workerGone(&ClientData{Wid: "w2", Hostname: "box", Pid: 42})
+	hook, event = receive()
+	assert.Equal(t, "worker.gone", hook.event)
+	assert.Equal(t, "w2", event.Data.(map[string]interface{})["wid"])
+	assert.Equal(t, "box", event.Data.(map[string]interface{})["hostname"])
+
+	// not enabled
+	wh.send(serverEvent{Event: "queue.depth", Data: map[string]interface{}{"queue": "default"}})
+	s.batchCompleted(&manager.BatchStatus{Bid: "b-1234567890", Completed: true, Failed: 2})
+	hook, event = receive()
+	assert.Equal(t, "batch.complete", hook.event)
+	assert.Equal(t, "b-1234567890", event.Data.(map[string]interface{})["bid"])
+	assert.EqualValues(t, 2, event.Data.(map[string]interface{})["failed"])
+}
+
+func TestWebhookQueueDepth(t *testing.T) {
+	runServerWith("localhost:7462", nil, func(s *Server) {
+		store := s.Store()
+		store.Flush()
+		q, err := store.GetQueue("bulk_mail")
+		assert.NoError(t, err)
+
+		wh := &webhooks{
+			config: &webhookConfig{
+				url:    "http://localhost:9000/hook",
+				events: map[string]bool{"queue.depth": true},
+				depth:  &queueLimits{exact: map[string]uint64{}, patterns: map[string]uint64{"bulk_*": 2}},
+			},
+			events: make(chan serverEvent, 10),
+		}
+		deep := map[string]bool{}
+		depth := func() map[string]interface{} {
+			select {
+			case event := <-wh.events:
+				assert.Equal(t, "queue.depth", event.Event)
+				return event.Data.(map[string]interface{})
+			default:
+				return nil
+			}
+		}
+
+		assert.NoError(t, q.Push(5, []byte(`{"jid":"a","jobtype":"Mail","queue":"bulk_mail"}`)))
+		wh.checkDepths(store, deep)
+		assert.Nil(t, depth())
+
+		assert.NoError(t, q.Push(5, []byte(`{"jid":"b","jobtype":"Mail","queue":"bulk_mail"}`)))
+		wh.checkDepths(store, deep)
+		assert.Equal(t, map[string]interface{}{"queue": "bulk_mail", "size": uint64(2), "threshold": uint64(2), "over": true}, depth())
+		// only sent when it crosses
+		wh.checkDepths(store, deep)
+		assert.Nil(t, depth())
+
+		_, err = q.Clear()
+		assert.NoError(t, err)
+		wh.checkDepths(store, deep)
+		assert.Equal(t, false, depth()["over"])
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/contribsys/faktory/util"
@@ -55,8 +56,31 @@ type ClientData struct {
 	Labels       []string `json:"labels"`
 	PasswordHash string   `json:"pwdhash"`
 	Version      uint8    `json:"v"`
+	Encoding     string   `json:"encoding"`
+	Nonce        string   `json:"nonce"`
 	StartedAt    time.Time
 
+	// How this worker's FETCHes choose between their queues,
+	// overriding ServerOptions.FetchOrder.
+	FetchOrder string `json:"fetch_order"`
+
+	// The common name or SAN of the verified TLS client
+	// certificate, never read from the HELLO.
+	Identity string `json:"-"`
+	// The client's network address, as reported by the load
+	// balancer when using the PROXY protocol.
+	Address string `json:"-"`
+
+	// When the server told this worker to terminate and whether
+	// it was forcibly disconnected for ignoring that signal, never
+	// read from the HELLO.
+	TerminateSentAt time.Time `json:"-"`
+	Terminated      bool      `json:"-"`
+
+	// The number of jobs this worker ACKed after their
+	// timeout_seconds, updated atomically.
+	TimedOutJobs int64
+
 	// this only applies to clients that are workers and
 	// are sending BEAT
 	lastHeartbeat time.Time
@@ -89,6 +113,10 @@ func clientDataFromHello(data string) (*ClientData, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = checkFetchOrder(client.FetchOrder)
+	if err != nil {
+		return nil, err
+	}
 
 	return &client, nil
 }
@@ -119,6 +147,22 @@ func (worker *ClientData) Signal(newstate WorkerState) {
 	}
 }
 
+// SignalWorker sends "quiet" or "terminate" to the worker process as
+// Signal does, publishing worker.quiet or worker.terminate if its
+// state changes.
+func (s *Server) SignalWorker(worker *ClientData, newstate WorkerState) {
+	before := worker.state
+	worker.Signal(newstate)
+	if worker.state != before {
+		s.publish("worker."+stateString(worker.state), map[string]interface{}{
+			"wid":      worker.Wid,
+			"hostname": worker.Hostname,
+			"pid":      worker.Pid,
+			"labels":   worker.Labels,
+		})
+	}
+}
+
 func (worker *ClientData) IsConsumer() bool {
 	return worker.Wid != ""
 }
@@ -140,6 +184,18 @@ func (w *workers) Count() int {
 	return len(w.heartbeats)
 }
 
+// Is any running worker process connected?
+func (w *workers) available() bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	for _, worker := range w.heartbeats {
+		if worker.state == Running && len(worker.connections) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func (w *workers) heartbeat(client *ClientData, register bool) (*ClientData, bool) {
 	w.mu.RLock()
 	entry, ok := w.heartbeats[client.Wid]
@@ -168,8 +224,20 @@ func (w *workers) heartbeat(client *ClientData, register bool) (*ClientData, boo
 	return entry, ok
 }
 
-func (w *workers) reapHeartbeats(t time.Time) int {
+// Count a job the given worker ACKed too late.
+func (w *workers) timedOut(wid string) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if worker, ok := w.heartbeats[wid]; ok {
+		atomic.AddInt64(&worker.TimedOutJobs, 1)
+	}
+}
+
+// Remove the workers which last sent BEAT before t, closing any
+// connections they still have, and return them.
+func (w *workers) reapHeartbeats(t time.Time) []*ClientData {
 	toDelete := []string{}
+	reaped := []*ClientData{}
 
 	w.mu.RLock()
 	for k, worker := range w.heartbeats {
@@ -185,6 +253,7 @@ func (w *workers) reapHeartbeats(t time.Time) int {
 		w.mu.Lock()
 		for _, k := range toDelete {
 			cd := w.heartbeats[k]
+			reaped = append(reaped, cd)
 			for conn, _ := range cd.connections {
 				conn.Close()
 				conns += 1
@@ -199,5 +268,43 @@ func (w *workers) reapHeartbeats(t time.Time) int {
 			util.Warn("All worker processes should send a heartbeat every 15 seconds")
 		}
 	}
-	return count
+	return reaped
+}
+
+// Record when the worker was first told to terminate, under mu since
+// killTerminated reads it.
+func (w *workers) terminateSent(worker *ClientData) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if worker.TerminateSentAt.IsZero() {
+		worker.TerminateSentAt = time.Now()
+	}
+}
+
+/*
+ * Forcibly closes the connections of any worker which was sent
+ * "terminate" before t and is still connected.  Returns the WIDs
+ * of the workers which were killed.
+ */
+func (w *workers) killTerminated(t time.Time) []string {
+	killed := []string{}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for wid, worker := range w.heartbeats {
+		if worker.Terminated || worker.TerminateSentAt.IsZero() || worker.TerminateSentAt.After(t) {
+			continue
+		}
+		if len(worker.connections) == 0 {
+			continue
+		}
+
+		for conn := range worker.connections {
+			conn.Close()
+			delete(worker.connections, conn)
+		}
+		worker.Terminated = true
+		killed = append(killed, wid)
+	}
+	return killed
 }
@@ -30,6 +30,12 @@ func TestClientData(t *testing.T) {
 	assert.NotNil(t, cw)
 	assert.True(t, cw.IsConsumer())
 
+	// a client can't claim to have been signalled already
+	cw, err = clientDataFromHello(`{"wid":"78629a0f5f3f164f","TerminateSentAt":"2001-02-03T04:05:06Z","Terminated":true}`)
+	assert.NoError(t, err)
+	assert.True(t, cw.TerminateSentAt.IsZero())
+	assert.False(t, cw.Terminated)
+
 	assert.Equal(t, Running, cw.state)
 	assert.False(t, cw.IsQuiet())
 
@@ -78,14 +84,70 @@ func TestWorkers(t *testing.T) {
 	assert.True(t, entry.lastHeartbeat.After(before))
 	assert.True(t, entry.lastHeartbeat.Before(after))
 
-	count := workers.reapHeartbeats(client.lastHeartbeat)
+	reaped := workers.reapHeartbeats(client.lastHeartbeat)
 	assert.Equal(t, 1, workers.Count())
-	assert.Equal(t, 0, count)
+	assert.Len(t, reaped, 0)
 
 	client.connections[cls{}] = true
-	count = workers.reapHeartbeats(time.Now())
+	reaped = workers.reapHeartbeats(time.Now())
 	assert.Equal(t, 0, workers.Count())
-	assert.Equal(t, 1, count)
+	assert.Equal(t, []*ClientData{entry}, reaped)
+}
+
+func TestKillTerminated(t *testing.T) {
+	t.Parallel()
+
+	workers := newWorkers()
+	client := &ClientData{Wid: "78629a0f5f3f164f"}
+	entry, _ := workers.heartbeat(client, true)
+
+	closed := &closeCounter{}
+	entry.connections[closed] = true
+
+	// not told to terminate yet
+	assert.Equal(t, 0, len(workers.killTerminated(time.Now())))
+
+	entry.Signal(Terminate)
+	entry.TerminateSentAt = time.Now().Add(-10 * time.Second)
+
+	// still within the grace period
+	assert.Equal(t, 0, len(workers.killTerminated(time.Now().Add(-time.Minute))))
+	assert.Equal(t, 0, closed.count)
+
+	killed := workers.killTerminated(time.Now())
+	assert.Equal(t, []string{"78629a0f5f3f164f"}, killed)
+	assert.Equal(t, 1, closed.count)
+	assert.True(t, entry.Terminated)
+	assert.Equal(t, 0, len(entry.connections))
+
+	// only killed once
+	assert.Equal(t, 0, len(workers.killTerminated(time.Now())))
+}
+
+func TestWorkerAvailable(t *testing.T) {
+	t.Parallel()
+
+	workers := newWorkers()
+	assert.False(t, workers.available())
+
+	entry, _ := workers.heartbeat(&ClientData{Wid: "78629a0f5f3f164f"}, true)
+	// registered but no open connections
+	assert.False(t, workers.available())
+
+	entry.connections[cls{}] = true
+	assert.True(t, workers.available())
+
+	entry.Signal(Quiet)
+	assert.False(t, workers.available())
+}
+
+type closeCounter struct {
+	count int
+}
+
+func (c *closeCounter) Close() error {
+	c.count++
+	return nil
 }
 
 type cls struct{}
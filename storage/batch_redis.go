@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// BatchState is a batch's definition as given to CreateBatch and
+// how many of its jobs are still to run.
+type BatchState struct {
+	Bid       string
+	Data      []byte
+	CreatedAt string
+	Committed bool
+	// Every job pushed as part of the batch, those which haven't
+	// succeeded yet and those which have failed and not yet
+	// succeeded on a retry.
+	Total   int64
+	Pending int64
+	Failed  int64
+	// Whether the complete and success callbacks have fired.
+	Completed bool
+	Succeeded bool
+}
+
+// The callbacks BatchJobDone and CommitBatch may return.
+const (
+	BatchComplete = "complete"
+	BatchSuccess  = "success"
+)
+
+func (store *redisStore) batchKey(bid string) string {
+	return store.key("faktory:batch:" + store.slot(bid))
+}
+
+func (store *redisStore) batchFailedKey(bid string) string {
+	return store.key("faktory:batch:" + store.slot(bid) + ":failed")
+}
+
+// Prepended to the scripts which change a committed batch, returns
+// the callbacks which are now due.  Each fires only once.
+const batchDueLua = `
+local function due(key, failed)
+  local fire = {}
+  if redis.call("hget", key, "committed") ~= "1" then
+    return fire
+  end
+  local pending = tonumber(redis.call("hget", key, "pending"))
+  if pending - redis.call("scard", failed) <= 0 and redis.call("hsetnx", key, "completed", "1") == 1 then
+    table.insert(fire, "complete")
+  end
+  if pending <= 0 and redis.call("hsetnx", key, "succeeded", "1") == 1 then
+    table.insert(fire, "success")
+  end
+  return fire
+end
+`
+
+// KEYS: the batch.  ARGV: its data, creation time and TTL in
+// milliseconds.  Returns 0 if the batch already exists.
+var batchCreateScript = redis.NewScript(`
+if redis.call("exists", KEYS[1]) == 1 then
+  return 0
+end
+redis.call("hmset", KEYS[1], "data", ARGV[1], "created_at", ARGV[2], "committed", "0", "total", 0, "pending", 0)
+redis.call("pexpire", KEYS[1], ARGV[3])
+return 1
+`)
+
+// KEYS: the batch.  ARGV: the number of jobs.  Returns nil if
+// there's no such batch, 0 if it's committed.  A negative count
+// takes back jobs which couldn't be pushed and is always allowed.
+var batchAddScript = redis.NewScript(`
+if redis.call("exists", KEYS[1]) == 0 then
+  return false
+end
+local n = tonumber(ARGV[1])
+if n > 0 and redis.call("hget", KEYS[1], "committed") == "1" then
+  return 0
+end
+redis.call("hincrby", KEYS[1], "total", n)
+redis.call("hincrby", KEYS[1], "pending", n)
+return 1
+`)
+
+// KEYS: the batch and its failed set.  ARGV: the jid and "1" if it
+// succeeded, "0" if it failed.
+var batchDoneScript = redis.NewScript(batchDueLua + `
+if redis.call("exists", KEYS[1]) == 0 then
+  return {}
+end
+if ARGV[2] == "1" then
+  redis.call("srem", KEYS[2], ARGV[1])
+  redis.call("hincrby", KEYS[1], "pending", -1)
+else
+  redis.call("sadd", KEYS[2], ARGV[1])
+  local ttl = redis.call("pttl", KEYS[1])
+  if ttl > 0 then
+    redis.call("pexpire", KEYS[2], ttl)
+  end
+end
+return due(KEYS[1], KEYS[2])
+`)
+
+// KEYS: the batch and its failed set.  Returns nil if there's no
+// such batch.
+var batchCommitScript = redis.NewScript(batchDueLua + `
+if redis.call("exists", KEYS[1]) == 0 then
+  return false
+end
+redis.call("hset", KEYS[1], "committed", "1")
+return due(KEYS[1], KEYS[2])
+`)
+
+// KEYS: the batch.  Returns nil if there's no such batch, 0 if it
+// has completed.
+var batchOpenScript = redis.NewScript(`
+if redis.call("exists", KEYS[1]) == 0 then
+  return false
+end
+if redis.call("hget", KEYS[1], "completed") == "1" then
+  return 0
+end
+redis.call("hset", KEYS[1], "committed", "0")
+return 1
+`)
+
+func (store *redisStore) CreateBatch(bid string, data []byte, ttl time.Duration) error {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	created, err := batchCreateScript.Run(store.rclient, []string{store.batchKey(bid)}, data, now, int64(ttl/time.Millisecond)).Int64()
+	if err != nil {
+		return err
+	}
+	if created == 0 {
+		return fmt.Errorf("Batch %s already exists", bid)
+	}
+	return nil
+}
+
+func (store *redisStore) GetBatch(bid string) (*BatchState, error) {
+	var values *redis.StringStringMapCmd
+	var failed *redis.IntCmd
+	_, err := store.rclient.TxPipelined(func(pipe redis.Pipeliner) error {
+		values = pipe.HGetAll(store.batchKey(bid))
+		failed = pipe.SCard(store.batchFailedKey(bid))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	hash := values.Val()
+	if len(hash) == 0 {
+		return nil, nil
+	}
+
+	total, _ := strconv.ParseInt(hash["total"], 10, 64)
+	pending, _ := strconv.ParseInt(hash["pending"], 10, 64)
+	return &BatchState{
+		Bid:       bid,
+		Data:      []byte(hash["data"]),
+		CreatedAt: hash["created_at"],
+		Committed: hash["committed"] == "1",
+		Total:     total,
+		Pending:   pending,
+		Failed:    failed.Val(),
+		Completed: hash["completed"] == "1",
+		Succeeded: hash["succeeded"] == "1",
+	}, nil
+}
+
+func (store *redisStore) AddToBatch(bid string, count int) error {
+	added, err := batchAddScript.Run(store.rclient, []string{store.batchKey(bid)}, count).Int64()
+	if err == redis.Nil {
+		return fmt.Errorf("No such batch %s", bid)
+	}
+	if err != nil {
+		return err
+	}
+	if added == 0 {
+		return fmt.Errorf("Batch %s is committed, open it to add jobs", bid)
+	}
+	return nil
+}
+
+func (store *redisStore) BatchJobDone(bid string, jid string, succeeded bool) ([]string, error) {
+	flag := "0"
+	if succeeded {
+		flag = "1"
+	}
+	return callbacks(batchDoneScript.Run(store.rclient, []string{store.batchKey(bid), store.batchFailedKey(bid)}, jid, flag))
+}
+
+func (store *redisStore) CommitBatch(bid string) ([]string, error) {
+	fire, err := callbacks(batchCommitScript.Run(store.rclient, []string{store.batchKey(bid), store.batchFailedKey(bid)}))
+	if err == redis.Nil {
+		return nil, fmt.Errorf("No such batch %s", bid)
+	}
+	return fire, err
+}
+
+func (store *redisStore) OpenBatch(bid string) error {
+	opened, err := batchOpenScript.Run(store.rclient, []string{store.batchKey(bid)}).Int64()
+	if err == redis.Nil {
+		return fmt.Errorf("No such batch %s", bid)
+	}
+	if err != nil {
+		return err
+	}
+	if opened == 0 {
+		return fmt.Errorf("Batch %s has already completed", bid)
+	}
+	return nil
+}
+
+func callbacks(cmd *redis.Cmd) ([]string, error) {
+	val, err := cmd.Result()
+	if err != nil {
+		return nil, err
+	}
+	items, _ := val.([]interface{})
+	fire := make([]string, 0, len(items))
+	for _, item := range items {
+		if name, ok := item.(string); ok {
+			fire = append(fire, name)
+		}
+	}
+	return fire, nil
+}
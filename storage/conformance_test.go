@@ -0,0 +1,53 @@
+package storage_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/storage/storagetest"
+)
+
+func TestRedisConformance(t *testing.T) {
+	dir := "/tmp/faktory-test-conformance"
+	defer os.RemoveAll(dir)
+
+	sock := dir + "/redis.sock"
+	stopper, err := storage.BootRedis(dir, sock)
+	if stopper != nil {
+		defer stopper()
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	store, err := storage.Open("redis", sock)
+	if err != nil {
+		panic(err)
+	}
+	defer store.Close()
+	t.Run("Plain", func(t *testing.T) {
+		storagetest.TestStore(t, store)
+	})
+
+	prefixed, err := storage.OpenRedisWith(storage.RedisOptions{URL: "unix://" + sock, KeyPrefix: "staging:"})
+	if err != nil {
+		panic(err)
+	}
+	defer prefixed.Close()
+	t.Run("KeyPrefix", func(t *testing.T) {
+		storagetest.TestStore(t, prefixed)
+	})
+
+	sharded, err := storage.OpenRedisShards([]storage.RedisOptions{
+		{URL: "unix://" + sock, KeyPrefix: "shard0:"},
+		{URL: "unix://" + sock, KeyPrefix: "shard1:"},
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer sharded.Close()
+	t.Run("Sharded", func(t *testing.T) {
+		storagetest.TestStore(t, sharded)
+	})
+}
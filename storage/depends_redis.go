@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// How a job which others may depend on finished, see DependencyDone.
+const (
+	DependencySucceeded = "done"
+	DependencyDied      = "dead"
+)
+
+// How long an expired held job is kept for RemoveExpiredHolds.
+const HeldJobGrace = 24 * time.Hour
+
+// Every dependency's keys, and the held jobs, share a hash slot in a
+// cluster since a job may depend on any others.
+const clusterDependsPrefix = "{faktory:depends}:"
+
+func (store *redisStore) dependencyKey(jid string) string {
+	if store.cluster {
+		return store.key(clusterDependsPrefix + jid)
+	}
+	return store.key("faktory:depends:" + jid)
+}
+
+func (store *redisStore) dependentsKey(jid string) string {
+	return store.dependencyKey(jid) + ":held"
+}
+
+func (store *redisStore) heldKeyPrefix() string {
+	if store.cluster {
+		return store.key(clusterDependsPrefix + "held:")
+	}
+	return store.key("faktory:held:")
+}
+
+// A sorted set of the held jobs' jids scored by when they expire, in
+// milliseconds since the epoch.
+func (store *redisStore) heldIndexKey() string {
+	if store.cluster {
+		return store.key(clusterDependsPrefix + "held")
+	}
+	return store.key("faktory:held")
+}
+
+// KEYS: the held job, the held index, then each dependency's state
+// and dependents.  ARGV: the jid, its data, the TTL and grace in
+// milliseconds and the time now.  Returns the number of dependencies
+// still to finish, -1 if one died or -2 if the job is already held.
+var holdScript = redis.NewScript(`
+local expires = redis.call("zscore", KEYS[2], ARGV[1])
+if expires and tonumber(expires) > tonumber(ARGV[5]) then
+  return -2
+end
+for i = 3, #KEYS, 2 do
+  if redis.call("get", KEYS[i]) == "dead" then
+    return -1
+  end
+end
+local pending = 0
+for i = 3, #KEYS, 2 do
+  if not redis.call("get", KEYS[i]) then
+    redis.call("sadd", KEYS[i+1], ARGV[1])
+    redis.call("pexpire", KEYS[i+1], ARGV[3])
+    pending = pending + 1
+  end
+end
+if pending > 0 then
+  redis.call("hmset", KEYS[1], "data", ARGV[2], "pending", pending)
+  redis.call("pexpire", KEYS[1], ARGV[3] + ARGV[4])
+  redis.call("zadd", KEYS[2], ARGV[5] + ARGV[3], ARGV[1])
+end
+return pending
+`)
+
+// KEYS: the job's state and dependents and the held index.  ARGV:
+// its state, the TTL in milliseconds, the held key prefix and the
+// time now.  Returns the data of the held jobs which are now
+// released, expired ones are left for RemoveExpiredHolds.
+var dependencyDoneScript = redis.NewScript(`
+redis.call("set", KEYS[1], ARGV[1], "px", ARGV[2])
+local released = {}
+for _, jid in ipairs(redis.call("smembers", KEYS[2])) do
+  local key = ARGV[3] .. jid
+  local expires = redis.call("zscore", KEYS[3], jid)
+  local data = redis.call("hget", key, "data")
+  if data and expires and tonumber(expires) > tonumber(ARGV[4]) and
+      (ARGV[1] == "dead" or redis.call("hincrby", key, "pending", -1) <= 0) then
+    redis.call("del", key)
+    redis.call("zrem", KEYS[3], jid)
+    table.insert(released, data)
+  end
+end
+redis.call("del", KEYS[2])
+return released
+`)
+
+// KEYS: the held index.  ARGV: the time now and the held key prefix.
+// Returns the data of the expired held jobs, which are removed.
+var removeExpiredHoldsScript = redis.NewScript(`
+local expired = {}
+for _, jid in ipairs(redis.call("zrangebyscore", KEYS[1], "-inf", ARGV[1])) do
+  local key = ARGV[2] .. jid
+  local data = redis.call("hget", key, "data")
+  redis.call("del", key)
+  redis.call("zrem", KEYS[1], jid)
+  if data then
+    table.insert(expired, data)
+  end
+end
+return expired
+`)
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func (store *redisStore) HoldJob(jid string, data []byte, deps []string, ttl time.Duration) (int64, error) {
+	keys := []string{store.heldKeyPrefix() + jid, store.heldIndexKey()}
+	for _, dep := range deps {
+		keys = append(keys, store.dependencyKey(dep), store.dependentsKey(dep))
+	}
+	pending, err := holdScript.Run(store.rclient, keys, jid, data, int64(ttl/time.Millisecond), int64(HeldJobGrace/time.Millisecond), nowMillis()).Int64()
+	if err != nil {
+		return 0, err
+	}
+	if pending == -2 {
+		return 0, fmt.Errorf("Job %s is already waiting for its dependencies", jid)
+	}
+	return pending, nil
+}
+
+func (store *redisStore) DependencyDone(jid string, state string, ttl time.Duration) ([][]byte, error) {
+	keys := []string{store.dependencyKey(jid), store.dependentsKey(jid), store.heldIndexKey()}
+	values, err := dependencyDoneScript.Run(store.rclient, keys, state, int64(ttl/time.Millisecond), store.heldKeyPrefix(), nowMillis()).Result()
+	if err != nil {
+		return nil, err
+	}
+	return heldData(values)
+}
+
+func (store *redisStore) RemoveExpiredHolds() ([][]byte, error) {
+	values, err := removeExpiredHoldsScript.Run(store.rclient, []string{store.heldIndexKey()}, nowMillis(), store.heldKeyPrefix()).Result()
+	if err != nil {
+		return nil, err
+	}
+	return heldData(values)
+}
+
+// The held jobs' data returned by a script.
+func heldData(values interface{}) ([][]byte, error) {
+	list, ok := values.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Unexpected reply %v", values)
+	}
+	data := make([][]byte, 0, len(list))
+	for _, value := range list {
+		data = append(data, []byte(value.(string)))
+	}
+	return data, nil
+}
+
+func (store *redisStore) HeldJob(jid string) ([]byte, error) {
+	expires, err := store.rclient.ZScore(store.heldIndexKey(), jid).Result()
+	if err == redis.Nil || (err == nil && int64(expires) <= nowMillis()) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := store.rclient.HGet(store.heldKeyPrefix()+jid, "data").Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return data, err
+}
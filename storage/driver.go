@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Driver opens the store at path, whatever path means to it, e.g. a
+// directory or a URL.  Drivers are registered by name, see
+// RegisterDriver, and the store must meet the contract documented on
+// Store, Queue and SortedSet.  storagetest.TestStore checks a store does.
+type Driver func(path string) (Store, error)
+
+var (
+	driverMu sync.RWMutex
+	drivers  = map[string]Driver{
+		"redis":         openRedisPath,
+		"redis_sharded": openShardedURLs,
+	}
+)
+
+// RegisterDriver makes driver available to Open under the given name,
+// typically from the init func of the package which provides it.
+// Registering an existing name replaces it.
+func RegisterDriver(name string, driver Driver) error {
+	if name == "" {
+		return fmt.Errorf("driver name cannot be blank")
+	}
+	if driver == nil {
+		return fmt.Errorf("driver %s cannot be nil", name)
+	}
+
+	driverMu.Lock()
+	defer driverMu.Unlock()
+	drivers[name] = driver
+	return nil
+}
+
+func LookupDriver(name string) (Driver, bool) {
+	driverMu.RLock()
+	defer driverMu.RUnlock()
+	driver, ok := drivers[name]
+	return driver, ok
+}
+
+// The names of the registered drivers, sorted.
+func Drivers() []string {
+	driverMu.RLock()
+	defer driverMu.RUnlock()
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open the store at path with the driver registered as dbtype.  For
+// "redis" path is the socket of a Redis started with BootRedis or the
+// URL of any other Redis, see OpenRedisURL.
+func Open(dbtype string, path string) (Store, error) {
+	driver, ok := LookupDriver(dbtype)
+	if !ok {
+		return nil, fmt.Errorf("Invalid dbtype: %s, registered drivers are %s", dbtype, strings.Join(Drivers(), ", "))
+	}
+	return driver(path)
+}
+
+// The driver for each URL scheme OpenURL accepts, other schemes are
+// the driver's own name.
+var schemeDrivers = map[string]string{
+	"rediss":     "redis",
+	"postgresql": "postgres",
+}
+
+// OpenURL opens the store at a URL whose scheme names the driver, e.g.
+// redis://localhost:6379/1 or postgres://db.example.com/faktory.  The
+// Redis and Postgres drivers are given the whole URL, any other driver
+// what follows "scheme://", e.g. sqlite:///var/lib/faktory/faktory.db
+// opens the file /var/lib/faktory/faktory.db.
+func OpenURL(storeURL string) (Store, error) {
+	idx := strings.Index(storeURL, "://")
+	if idx < 1 {
+		return nil, fmt.Errorf("Invalid storage URL %s, expected <driver>://...", storeURL)
+	}
+	scheme := strings.ToLower(storeURL[:idx])
+	dbtype := scheme
+	if name, ok := schemeDrivers[scheme]; ok {
+		dbtype = name
+	}
+	if dbtype == "redis" || dbtype == "postgres" {
+		return Open(dbtype, storeURL)
+	}
+	return Open(dbtype, storeURL[idx+3:])
+}
+
+func openRedisPath(path string) (Store, error) {
+	if strings.Contains(path, "://") {
+		return OpenRedisURL(path)
+	}
+	return OpenRedis(path)
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterDriver(t *testing.T) {
+	assert.Error(t, RegisterDriver("", openRedisPath))
+	assert.Error(t, RegisterDriver("nil", nil))
+
+	_, err := Open("fake", "/tmp/fake")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "redis")
+
+	opened := ""
+	assert.NoError(t, RegisterDriver("fake", func(path string) (Store, error) {
+		opened = path
+		return nil, fmt.Errorf("not implemented")
+	}))
+	defer func() {
+		driverMu.Lock()
+		delete(drivers, "fake")
+		driverMu.Unlock()
+	}()
+	// the snapshot tests register the memory driver too
+	assert.Contains(t, Drivers(), "fake")
+	assert.Contains(t, Drivers(), "redis")
+	_, err = Open("fake", "/tmp/fake")
+	assert.Error(t, err)
+	assert.Equal(t, "/tmp/fake", opened)
+}
+
+func TestOpenURL(t *testing.T) {
+	opened := ""
+	assert.NoError(t, RegisterDriver("fakeurl", func(path string) (Store, error) {
+		opened = path
+		return nil, fmt.Errorf("not implemented")
+	}))
+	defer func() {
+		driverMu.Lock()
+		delete(drivers, "fakeurl")
+		driverMu.Unlock()
+	}()
+
+	_, err := OpenURL("fakeurl:///var/lib/faktory/faktory.db")
+	assert.Error(t, err)
+	assert.Equal(t, "/var/lib/faktory/faktory.db", opened)
+
+	_, err = OpenURL("/var/lib/faktory/faktory.db")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Invalid storage URL")
+
+	_, err = OpenURL("mongodb://localhost")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "registered drivers are")
+}
@@ -9,25 +9,43 @@ import (
 
 func (store *redisStore) Success() error {
 	daystr := time.Now().Format("2006-01-02")
-	store.rclient.Incr(fmt.Sprintf("processed:%s", daystr))
-	store.rclient.Incr("processed")
+	store.rclient.Incr(store.key(fmt.Sprintf("processed:%s", daystr)))
+	store.rclient.Incr(store.key("processed"))
 	return nil
 }
 
 func (store *redisStore) TotalProcessed() uint64 {
-	return uint64(store.rclient.IncrBy("processed", 0).Val())
+	return uint64(store.rclient.IncrBy(store.key("processed"), 0).Val())
 }
 func (store *redisStore) TotalFailures() uint64 {
-	return uint64(store.rclient.IncrBy("failures", 0).Val())
+	return uint64(store.rclient.IncrBy(store.key("failures"), 0).Val())
+}
+
+func (store *redisStore) SetTotals(processed uint64, failures uint64) error {
+	_, err := store.rclient.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(store.key("processed"), processed, 0)
+		pipe.Set(store.key("failures"), failures, 0)
+		return nil
+	})
+	return err
+}
+
+func (store *redisStore) SetHistory(day string, procCnt uint64, failCnt uint64) error {
+	_, err := store.rclient.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(store.key(fmt.Sprintf("processed:%s", day)), procCnt, 0)
+		pipe.Set(store.key(fmt.Sprintf("failures:%s", day)), failCnt, 0)
+		return nil
+	})
+	return err
 }
 
 func (store *redisStore) Failure() error {
-	store.rclient.Incr("processed")
-	store.rclient.Incr("failures")
+	store.rclient.Incr(store.key("processed"))
+	store.rclient.Incr(store.key("failures"))
 
 	daystr := time.Now().Format("2006-01-02")
-	store.rclient.Incr(fmt.Sprintf("processed:%s", daystr))
-	store.rclient.Incr(fmt.Sprintf("failures:%s", daystr))
+	store.rclient.Incr(store.key(fmt.Sprintf("processed:%s", daystr)))
+	store.rclient.Incr(store.key(fmt.Sprintf("failures:%s", daystr)))
 	return nil
 }
 
@@ -41,8 +59,8 @@ func (store *redisStore) History(days int, fn func(day string, procCnt uint64, f
 		for idx := 0; idx < days; idx++ {
 			daystr := ts.Format("2006-01-02")
 			daystrs[idx] = daystr
-			procds[idx] = pipe.IncrBy(fmt.Sprintf("processed:%s", daystr), 0)
-			fails[idx] = pipe.IncrBy(fmt.Sprintf("failures:%s", daystr), 0)
+			procds[idx] = pipe.IncrBy(store.key(fmt.Sprintf("processed:%s", daystr)), 0)
+			fails[idx] = pipe.IncrBy(store.key(fmt.Sprintf("failures:%s", daystr)), 0)
 			ts = ts.Add(-24 * time.Hour)
 		}
 		return nil
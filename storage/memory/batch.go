@@ -0,0 +1,134 @@
+package memory
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/contribsys/faktory/storage"
+)
+
+type batch struct {
+	state   storage.BatchState
+	failed  map[string]bool
+	expires time.Time
+}
+
+// The batch, nil if there's no such batch or it's expired.  The caller
+// holds the lock.
+func (s *store) batch(bid string) *batch {
+	b, ok := s.batches[bid]
+	if !ok {
+		return nil
+	}
+	if !time.Now().Before(b.expires) {
+		delete(s.batches, bid)
+		return nil
+	}
+	return b
+}
+
+// The callbacks which are now due, each fires only once.
+func (b *batch) due() []string {
+	fire := []string{}
+	if !b.state.Committed {
+		return fire
+	}
+	failed := int64(len(b.failed))
+	if b.state.Pending-failed <= 0 && !b.state.Completed {
+		b.state.Completed = true
+		fire = append(fire, storage.BatchComplete)
+	}
+	if b.state.Pending <= 0 && !b.state.Succeeded {
+		b.state.Succeeded = true
+		fire = append(fire, storage.BatchSuccess)
+	}
+	return fire
+}
+
+func (s *store) CreateBatch(bid string, data []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.batch(bid) != nil {
+		return fmt.Errorf("Batch %s already exists", bid)
+	}
+	s.batches[bid] = &batch{
+		state: storage.BatchState{
+			Bid:       bid,
+			Data:      data,
+			CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+		},
+		failed:  map[string]bool{},
+		expires: time.Now().Add(ttl),
+	}
+	return nil
+}
+
+func (s *store) GetBatch(bid string) (*storage.BatchState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.batch(bid)
+	if b == nil {
+		return nil, nil
+	}
+	state := b.state
+	state.Failed = int64(len(b.failed))
+	return &state, nil
+}
+
+// A negative count takes back jobs which couldn't be pushed and is
+// always allowed.
+func (s *store) AddToBatch(bid string, count int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.batch(bid)
+	if b == nil {
+		return fmt.Errorf("No such batch %s", bid)
+	}
+	if count > 0 && b.state.Committed {
+		return fmt.Errorf("Batch %s is committed, open it to add jobs", bid)
+	}
+	b.state.Total += int64(count)
+	b.state.Pending += int64(count)
+	return nil
+}
+
+func (s *store) BatchJobDone(bid string, jid string, succeeded bool) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.batch(bid)
+	if b == nil {
+		return []string{}, nil
+	}
+	if succeeded {
+		delete(b.failed, jid)
+		b.state.Pending--
+	} else {
+		b.failed[jid] = true
+	}
+	return b.due(), nil
+}
+
+func (s *store) CommitBatch(bid string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.batch(bid)
+	if b == nil {
+		return nil, fmt.Errorf("No such batch %s", bid)
+	}
+	b.state.Committed = true
+	return b.due(), nil
+}
+
+func (s *store) OpenBatch(bid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.batch(bid)
+	if b == nil {
+		return fmt.Errorf("No such batch %s", bid)
+	}
+	if b.state.Completed {
+		return fmt.Errorf("Batch %s has already completed", bid)
+	}
+	b.state.Committed = false
+	return nil
+}
@@ -0,0 +1,110 @@
+package memory
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/contribsys/faktory/storage"
+)
+
+type heldJob struct {
+	data    []byte
+	pending int64
+	expires time.Time
+}
+
+// The held job, nil if it isn't held or it's expired.  Expired jobs
+// are left for RemoveExpiredHolds.  The caller holds the lock.
+func (s *store) heldJob(jid string) *heldJob {
+	held, ok := s.held[jid]
+	if !ok || !time.Now().Before(held.expires) {
+		return nil
+	}
+	return held
+}
+
+func (s *store) HoldJob(jid string, data []byte, deps []string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.heldJob(jid) != nil {
+		return 0, fmt.Errorf("Job %s is already waiting for its dependencies", jid)
+	}
+
+	now := time.Now()
+	waiting := []string{}
+	for _, dep := range deps {
+		state, ok := s.dependencies[dep]
+		if !ok || state.expired(now) {
+			waiting = append(waiting, dep)
+			continue
+		}
+		if string(state.value) == storage.DependencyDied {
+			return -1, nil
+		}
+	}
+	if len(waiting) == 0 {
+		return 0, nil
+	}
+
+	expires := now.Add(ttl)
+	for _, dep := range waiting {
+		if s.dependents[dep] == nil {
+			s.dependents[dep] = map[string]time.Time{}
+		}
+		s.dependents[dep][jid] = expires
+	}
+	s.held[jid] = &heldJob{data: data, pending: int64(len(waiting)), expires: expires}
+	return int64(len(waiting)), nil
+}
+
+func (s *store) DependencyDone(jid string, state string, ttl time.Duration) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dependencies[jid] = item{[]byte(state), time.Now().Add(ttl)}
+
+	// a died dependency releases every job waiting on it, otherwise
+	// those with nothing left to wait for
+	now := time.Now()
+	released := [][]byte{}
+	for dependent, expires := range s.dependents[jid] {
+		if !now.Before(expires) {
+			continue
+		}
+		held := s.heldJob(dependent)
+		if held == nil {
+			continue
+		}
+		held.pending--
+		if held.pending > 0 && state != storage.DependencyDied {
+			continue
+		}
+		delete(s.held, dependent)
+		released = append(released, held.data)
+	}
+	delete(s.dependents, jid)
+	return released, nil
+}
+
+func (s *store) HeldJob(jid string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if held := s.heldJob(jid); held != nil {
+		return held.data, nil
+	}
+	return nil, nil
+}
+
+func (s *store) RemoveExpiredHolds() ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	expired := [][]byte{}
+	for jid, held := range s.held {
+		if now.Before(held.expires) {
+			continue
+		}
+		delete(s.held, jid)
+		expired = append(expired, held.data)
+	}
+	return expired, nil
+}
@@ -0,0 +1,457 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/util"
+)
+
+// Queues, like the rest of the store, are guarded by the store's lock.
+type queue struct {
+	name  string
+	store *store
+	done  bool
+
+	// the jobs of each priority, oldest first
+	jobs     map[uint8][]*job
+	ordering string
+	cmp      storage.Comparator
+	paused   bool
+}
+
+type job struct {
+	seq  uint64
+	jid  string
+	data []byte
+}
+
+// The fields a job's data is searched by.
+type listedJob struct {
+	Jid string `json:"jid"`
+}
+
+// As in the Redis store, priorities outside 1-9 are the default.
+func normalPriority(priority uint8) uint8 {
+	if priority < 1 || priority > 9 {
+		return 5
+	}
+	return priority
+}
+
+func (q *queue) Name() string {
+	return q.name
+}
+
+func (q *queue) Size() uint64 {
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+	return q.size()
+}
+
+func (q *queue) size() uint64 {
+	var size uint64
+	for _, jobs := range q.jobs {
+		size += uint64(len(jobs))
+	}
+	return size
+}
+
+func (q *queue) Add(job *client.Job) error {
+	job.EnqueuedAt = util.Nows()
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	return q.Push(job.Priority, data)
+}
+
+func (q *queue) Push(priority uint8, data []byte) error {
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+	q.push(priority, data)
+	q.store.notify()
+	return nil
+}
+
+// The caller holds the lock and notifies once it's done pushing.
+func (q *queue) push(priority uint8, data []byte) {
+	var listed listedJob
+	json.Unmarshal(data, &listed)
+	q.store.seq++
+	priority = normalPriority(priority)
+	q.jobs[priority] = append(q.jobs[priority], &job{
+		seq:  q.store.seq,
+		jid:  listed.Jid,
+		data: data,
+	})
+}
+
+// Wake any BPop waiting for a job.
+func (s *store) notify() {
+	close(s.pushed)
+	s.pushed = make(chan struct{})
+}
+
+func (q *queue) Ordering() string {
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+	return q.ordering
+}
+
+func (q *queue) SetOrdering(name string) error {
+	cmp, ok := storage.LookupComparator(name)
+	if !ok {
+		return fmt.Errorf("Unknown ordering: %s", name)
+	}
+
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+	q.ordering = name
+	q.cmp = cmp
+	return nil
+}
+
+// The priorities with jobs, highest first.
+func (q *queue) priorities() []uint8 {
+	priorities := make([]uint8, 0, len(q.jobs))
+	for priority, jobs := range q.jobs {
+		if len(jobs) > 0 {
+			priorities = append(priorities, priority)
+		}
+	}
+	sort.Slice(priorities, func(i, j int) bool {
+		return priorities[i] > priorities[j]
+	})
+	return priorities
+}
+
+// The jobs in the order Pop would return them.  As in the Redis
+// store, other orderings than FIFO and LIFO only consider the
+// ComparatorWindow oldest jobs of each priority.
+func (q *queue) ordered() []*job {
+	list := []*job{}
+	for _, priority := range q.priorities() {
+		jobs := q.jobs[priority]
+		switch q.ordering {
+		case storage.FIFO:
+			list = append(list, jobs...)
+		case storage.LIFO:
+			for idx := len(jobs) - 1; idx >= 0; idx-- {
+				list = append(list, jobs[idx])
+			}
+		default:
+			list = append(list, q.candidates(jobs)...)
+		}
+	}
+	return list
+}
+
+func (q *queue) candidates(jobs []*job) []*job {
+	if len(jobs) > storage.ComparatorWindow {
+		jobs = jobs[:storage.ComparatorWindow]
+	}
+	entries := make([]storage.JobEntry, len(jobs))
+	for idx, j := range jobs {
+		var parsed client.Job
+		err := json.Unmarshal(j.data, &parsed)
+		if err != nil {
+			util.Warnf("Unable to parse job in queue %s: %v", q.name, err)
+		}
+		entries[idx] = storage.JobEntry{Index: idx, Data: j.data, Job: &parsed}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return q.cmp(entries[i], entries[j]) < 0
+	})
+	list := make([]*job, len(entries))
+	for idx, entry := range entries {
+		list[idx] = jobs[entry.Index]
+	}
+	return list
+}
+
+// Take the job out of the queue, the caller holds the lock.
+func (q *queue) remove(target *job) {
+	for priority, jobs := range q.jobs {
+		for idx, j := range jobs {
+			if j == target {
+				q.jobs[priority] = append(jobs[:idx:idx], jobs[idx+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// non-blocking, returns immediately if there's nothing enqueued
+func (q *queue) Pop() ([]byte, error) {
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+	return q.pop(), nil
+}
+
+func (q *queue) pop() []byte {
+	if q.done {
+		return nil
+	}
+	list := q.ordered()
+	if len(list) == 0 {
+		return nil
+	}
+	q.remove(list[0])
+	return list[0].data
+}
+
+// Within a store the pop and add are atomic, to another store's set
+// the job is popped from here and then added there.
+func (q *queue) PopTo(sset storage.SortedSet, timestamp string, prefix []byte, suffix []byte) ([]byte, error) {
+	value, err := parseScore(timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	q.store.mu.Lock()
+	data := q.pop()
+	if data == nil {
+		q.store.mu.Unlock()
+		return nil, nil
+	}
+	var listed listedJob
+	json.Unmarshal(data, &listed)
+	payload := make([]byte, 0, len(prefix)+len(data)+len(suffix))
+	payload = append(append(append(payload, prefix...), data...), suffix...)
+
+	other, ok := sset.(*sorted)
+	if ok && other.store == q.store {
+		other.add(value, listed.Jid, payload)
+		q.store.mu.Unlock()
+		return data, nil
+	}
+	q.store.mu.Unlock()
+	return data, sset.AddElement(timestamp, listed.Jid, payload)
+}
+
+// Waits as long as the Redis store's blocking pop for a job to be
+// pushed.
+func (q *queue) BPop(ctx context.Context) ([]byte, error) {
+	timeout := time.After(2 * time.Second)
+	for {
+		q.store.mu.Lock()
+		data := q.pop()
+		pushed := q.store.pushed
+		q.store.mu.Unlock()
+		if data != nil {
+			return data, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-timeout:
+			return nil, nil
+		case <-pushed:
+		}
+	}
+}
+
+func (q *queue) Peek(count int) ([][]byte, error) {
+	if count < 1 {
+		return nil, nil
+	}
+
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+	results := make([][]byte, 0, count)
+	for _, j := range q.ordered() {
+		if len(results) == count {
+			break
+		}
+		results = append(results, j.data)
+	}
+	return results, nil
+}
+
+func (q *queue) Oldest() ([]byte, error) {
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+	var oldest *job
+	for _, jobs := range q.jobs {
+		if len(jobs) > 0 && (oldest == nil || jobs[0].seq < oldest.seq) {
+			oldest = jobs[0]
+		}
+	}
+	if oldest == nil {
+		return nil, nil
+	}
+	return oldest.data, nil
+}
+
+func (q *queue) Pause() error {
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+	q.paused = true
+	return nil
+}
+
+func (q *queue) Resume() error {
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+	q.paused = false
+	return nil
+}
+
+func (q *queue) IsPaused() bool {
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+	return q.paused
+}
+
+func (q *queue) Clear() (uint64, error) {
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+	size := q.size()
+	q.jobs = map[uint8][]*job{}
+	return size, nil
+}
+
+func (q *queue) Each(fn func(index int, data []byte) error) error {
+	return q.Page(0, -1, fn)
+}
+
+// Pages through the queue in the order of the Redis store's lists,
+// the lowest priority jobs first and the newest first within each,
+// so the last job is the next FIFO would fetch.  As there, start and
+// start+count are inclusive and negative values count back from the
+// end.
+func (q *queue) Page(start int64, count int64, fn func(index int, data []byte) error) error {
+	q.store.mu.Lock()
+	priorities := q.priorities()
+	all := make([][]byte, 0, q.size())
+	for idx := len(priorities) - 1; idx >= 0; idx-- {
+		jobs := q.jobs[priorities[idx]]
+		for jdx := len(jobs) - 1; jdx >= 0; jdx-- {
+			all = append(all, jobs[jdx].data)
+		}
+	}
+	q.store.mu.Unlock()
+
+	total := int64(len(all))
+	end := start + count
+	if start < 0 {
+		start += total
+	}
+	if end < 0 {
+		end += total
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= total {
+		end = total - 1
+	}
+	if end < start {
+		return nil
+	}
+
+	for idx, data := range all[start : end+1] {
+		err := fn(idx, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *queue) Delete(vals [][]byte) error {
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+	for _, val := range vals {
+		if j := q.find(func(j *job) bool { return bytes.Equal(j.data, val) }); j != nil {
+			q.remove(j)
+		}
+	}
+	return nil
+}
+
+// The oldest job matching, the caller holds the lock.
+func (q *queue) find(match func(*job) bool) *job {
+	var found *job
+	for _, jobs := range q.jobs {
+		for _, j := range jobs {
+			if match(j) && (found == nil || j.seq < found.seq) {
+				found = j
+			}
+		}
+	}
+	return found
+}
+
+func (q *queue) FindJid(jid string) ([]byte, error) {
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+	if j := q.find(func(j *job) bool { return j.jid == jid }); j != nil {
+		return j.data, nil
+	}
+	return nil, nil
+}
+
+func (q *queue) RemoveJid(jid string) ([]byte, error) {
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+	if j := q.find(func(j *job) bool { return j.jid == jid }); j != nil {
+		q.remove(j)
+		return j.data, nil
+	}
+	return nil, nil
+}
+
+func (s *store) PushBulk(entries []storage.BulkEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// ensure every queue name is valid and registered before
+	// we push anything
+	queues := make([]*queue, len(entries))
+	for idx, entry := range entries {
+		q, err := s.queue(entry.Queue)
+		if err != nil {
+			return err
+		}
+		queues[idx] = q
+	}
+
+	for idx, entry := range entries {
+		queues[idx].push(entry.Priority, entry.Data)
+	}
+	s.notify()
+	return nil
+}
+
+func (s *store) PushIf(cond storage.PushCondition, entry storage.BulkEntry) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, err := s.queue(entry.Queue)
+	if err != nil {
+		return false, err
+	}
+	if cond.EmptyQueue != "" {
+		other, err := s.queue(cond.EmptyQueue)
+		if err != nil {
+			return false, err
+		}
+		if other.size() > 0 {
+			return false, nil
+		}
+	}
+
+	q.push(entry.Priority, entry.Data)
+	s.notify()
+	return true, nil
+}
@@ -0,0 +1,304 @@
+package memory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/util"
+)
+
+// Like a Redis sorted set each payload is only in a set once, scored
+// by its timestamp in seconds.  Guarded by the store's lock.
+type sorted struct {
+	name  string
+	store *store
+
+	// kept in order of score, then when they were added
+	elements []*element
+	payloads map[string]*element
+}
+
+type element struct {
+	score float64
+	seq   uint64
+	jid   string
+	data  []byte
+}
+
+func score(tim time.Time) float64 {
+	return float64(tim.Unix()) + (float64(tim.Nanosecond()) / 1000000000)
+}
+
+func parseScore(timestamp string) (float64, error) {
+	tim, err := util.ParseTime(timestamp)
+	if err != nil {
+		return 0, err
+	}
+	return score(tim), nil
+}
+
+// key is "timestamp|jid"
+func decompose(key []byte) (float64, string, error) {
+	slice := strings.Split(string(key), "|")
+	if len(slice) != 2 {
+		return 0, "", fmt.Errorf("Invalid key, expected \"timestamp|jid\", not %s", string(key))
+	}
+	value, err := parseScore(slice[0])
+	if err != nil {
+		return 0, "", err
+	}
+	return value, slice[1], nil
+}
+
+func (ss *sorted) Name() string {
+	return ss.name
+}
+
+func (ss *sorted) Size() uint64 {
+	ss.store.mu.Lock()
+	defer ss.store.mu.Unlock()
+	return uint64(len(ss.elements))
+}
+
+func (ss *sorted) Clear() error {
+	ss.store.mu.Lock()
+	defer ss.store.mu.Unlock()
+	ss.clear()
+	return nil
+}
+
+func (ss *sorted) clear() {
+	ss.elements = nil
+	ss.payloads = map[string]*element{}
+}
+
+func (ss *sorted) Add(job *client.Job) error {
+	if job.At == "" {
+		return errors.New("Job does not have an At timestamp")
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	return ss.AddElement(job.At, job.Jid, data)
+}
+
+func (ss *sorted) AddElement(timestamp string, jid string, payload []byte) error {
+	value, err := parseScore(timestamp)
+	if err != nil {
+		return err
+	}
+	ss.store.mu.Lock()
+	defer ss.store.mu.Unlock()
+	ss.add(value, jid, payload)
+	return nil
+}
+
+// Add the payload, or rescore it if it's already in the set.  The
+// caller holds the lock.
+func (ss *sorted) add(value float64, jid string, payload []byte) {
+	if elm, ok := ss.payloads[string(payload)]; ok {
+		ss.remove(elm)
+	}
+	ss.store.seq++
+	elm := &element{score: value, seq: ss.store.seq, jid: jid, data: payload}
+	idx := sort.Search(len(ss.elements), func(i int) bool {
+		return ss.elements[i].score > value
+	})
+	ss.elements = append(ss.elements, nil)
+	copy(ss.elements[idx+1:], ss.elements[idx:])
+	ss.elements[idx] = elm
+	ss.payloads[string(payload)] = elm
+}
+
+func (ss *sorted) remove(target *element) {
+	for idx, elm := range ss.elements {
+		if elm == target {
+			ss.elements = append(ss.elements[:idx:idx], ss.elements[idx+1:]...)
+			break
+		}
+	}
+	delete(ss.payloads, string(target.data))
+}
+
+// The first element matching, the caller holds the lock.
+func (ss *sorted) find(match func(*element) bool) *element {
+	for _, elm := range ss.elements {
+		if match(elm) {
+			return elm
+		}
+	}
+	return nil
+}
+
+func (ss *sorted) Get(key []byte) (storage.SortedEntry, error) {
+	value, jid, err := decompose(key)
+	if err != nil {
+		return nil, err
+	}
+	ss.store.mu.Lock()
+	defer ss.store.mu.Unlock()
+	elm := ss.find(func(elm *element) bool { return elm.score == value && elm.jid == jid })
+	if elm == nil {
+		return nil, nil
+	}
+	return storage.NewEntry(elm.score, elm.data), nil
+}
+
+// As with ZRANGE, start and start+count are inclusive.
+func (ss *sorted) Page(start int, count int, fn func(index int, e storage.SortedEntry) error) (int, error) {
+	ss.store.mu.Lock()
+	entries := []storage.SortedEntry{}
+	for idx := start; idx >= 0 && idx <= start+count && idx < len(ss.elements); idx++ {
+		elm := ss.elements[idx]
+		entries = append(entries, storage.NewEntry(elm.score, elm.data))
+	}
+	ss.store.mu.Unlock()
+
+	for idx, entry := range entries {
+		err := fn(idx, entry)
+		if err != nil {
+			return idx, err
+		}
+	}
+	return len(entries), nil
+}
+
+func (ss *sorted) Each(fn func(idx int, e storage.SortedEntry) error) error {
+	count := 50
+	current := 0
+	for {
+		elms, err := ss.Page(current, count-1, func(idx int, e storage.SortedEntry) error {
+			return fn(current+idx, e)
+		})
+		if err != nil {
+			return err
+		}
+		if elms < count {
+			// last page, done iterating
+			return nil
+		}
+		current += count
+	}
+}
+
+func (ss *sorted) rem(value float64, jid string) bool {
+	ss.store.mu.Lock()
+	defer ss.store.mu.Unlock()
+	elm := ss.find(func(elm *element) bool { return elm.score == value && elm.jid == jid })
+	if elm == nil {
+		return false
+	}
+	ss.remove(elm)
+	return true
+}
+
+func (ss *sorted) Remove(key []byte) (bool, error) {
+	value, jid, err := decompose(key)
+	if err != nil {
+		return false, err
+	}
+	return ss.rem(value, jid), nil
+}
+
+func (ss *sorted) RemoveElement(timestamp string, jid string) (bool, error) {
+	value, err := parseScore(timestamp)
+	if err != nil {
+		return false, err
+	}
+	return ss.rem(value, jid), nil
+}
+
+func (ss *sorted) RemoveBefore(timestamp string) ([][]byte, error) {
+	value, err := parseScore(timestamp)
+	if err != nil {
+		return nil, err
+	}
+	ss.store.mu.Lock()
+	defer ss.store.mu.Unlock()
+	results := [][]byte{}
+	for len(ss.elements) > 0 && ss.elements[0].score <= value {
+		results = append(results, ss.elements[0].data)
+		ss.remove(ss.elements[0])
+	}
+	return results, nil
+}
+
+func (ss *sorted) RemoveBatchBefore(timestamp string, count int) ([][]byte, error) {
+	value, err := parseScore(timestamp)
+	if err != nil {
+		return nil, err
+	}
+	ss.store.mu.Lock()
+	defer ss.store.mu.Unlock()
+	results := [][]byte{}
+	for len(results) < count && len(ss.elements) > 0 && ss.elements[0].score <= value {
+		results = append(results, ss.elements[0].data)
+		ss.remove(ss.elements[0])
+	}
+	return results, nil
+}
+
+func (ss *sorted) Trim(max uint64) (int64, error) {
+	ss.store.mu.Lock()
+	defer ss.store.mu.Unlock()
+	var removed int64
+	for uint64(len(ss.elements)) > max {
+		ss.remove(ss.elements[0])
+		removed++
+	}
+	return removed, nil
+}
+
+func (ss *sorted) FindJid(jid string) ([]byte, error) {
+	ss.store.mu.Lock()
+	defer ss.store.mu.Unlock()
+	if elm := ss.find(func(elm *element) bool { return elm.jid == jid }); elm != nil {
+		return elm.data, nil
+	}
+	return nil, nil
+}
+
+func (ss *sorted) RemoveJid(jid string) ([]byte, error) {
+	ss.store.mu.Lock()
+	defer ss.store.mu.Unlock()
+	if elm := ss.find(func(elm *element) bool { return elm.jid == jid }); elm != nil {
+		ss.remove(elm)
+		return elm.data, nil
+	}
+	return nil, nil
+}
+
+// Within a store the move is atomic, to another store's set the entry
+// is removed from here and then added there.
+func (ss *sorted) MoveTo(sset storage.SortedSet, entry storage.SortedEntry, newtime time.Time) error {
+	job, err := entry.Job()
+	if err != nil {
+		return err
+	}
+
+	ss.store.mu.Lock()
+	elm, ok := ss.payloads[string(entry.Value())]
+	if !ok {
+		ss.store.mu.Unlock()
+		// race condition, element was removed or moved elsewhere
+		return nil
+	}
+	ss.remove(elm)
+
+	other, ok := sset.(*sorted)
+	if ok && other.store == ss.store {
+		other.add(score(newtime), job.Jid, entry.Value())
+		ss.store.mu.Unlock()
+		return nil
+	}
+	ss.store.mu.Unlock()
+	return sset.AddElement(util.Thens(newtime), job.Jid, entry.Value())
+}
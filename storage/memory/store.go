@@ -0,0 +1,440 @@
+// Package memory keeps Faktory's data in the process's memory, for
+// tests which want a real server without Redis or a storage
+// directory.  Importing it registers the "memory" storage driver, see
+// storage.RegisterDriver:
+//
+//	opts := &server.ServerOptions{StorageDriver: "memory", ...}
+//
+// Every Open is a new, empty store and its data is gone once it's
+// closed, the one part of the Store contract it doesn't meet.  A
+// single lock guards everything so each operation is atomic.
+package memory
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/util"
+)
+
+func init() {
+	storage.RegisterDriver("memory", func(path string) (storage.Store, error) {
+		return Open(path), nil
+	})
+}
+
+type store struct {
+	Name string
+
+	mu       sync.Mutex
+	queueSet map[string]*queue
+	// closed when a job is pushed, for BPop to wait on
+	pushed chan struct{}
+	// the order jobs were pushed in, across queues
+	seq uint64
+
+	sorted       map[string]*sorted
+	kv           map[string]item
+	counters     map[string]uint64
+	batches      map[string]*batch
+	dependencies map[string]item
+	held         map[string]*heldJob
+	dependents   map[string]map[string]time.Time
+}
+
+// A value which expires, or doesn't if expires is zero.
+type item struct {
+	value   []byte
+	expires time.Time
+}
+
+func (i item) expired(now time.Time) bool {
+	return !i.expires.IsZero() && !now.Before(i.expires)
+}
+
+func expiresAt(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+// Open a new store, name is only used to describe it.
+func Open(name string) storage.Store {
+	if name == "" {
+		name = "memory"
+	}
+	s := &store{
+		Name:   name,
+		pushed: make(chan struct{}),
+		sorted: map[string]*sorted{},
+	}
+	for _, name := range []string{"scheduled", "retries", "dead", "working"} {
+		s.sorted[name] = &sorted{name: name, store: s, payloads: map[string]*element{}}
+	}
+	s.reset()
+	return s
+}
+
+// Empty everything but the sorted sets, which callers may hold on to.
+func (s *store) reset() {
+	s.queueSet = map[string]*queue{}
+	s.kv = map[string]item{}
+	s.counters = map[string]uint64{}
+	s.batches = map[string]*batch{}
+	s.dependencies = map[string]item{}
+	s.held = map[string]*heldJob{}
+	s.dependents = map[string]map[string]time.Time{}
+}
+
+func (s *store) Close() error {
+	util.Debug("Stopping storage")
+	return nil
+}
+
+func (s *store) Stats() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]string{
+		"stats": fmt.Sprintf("In memory, %d queues", len(s.queueSet)),
+		"name":  s.Name,
+	}
+}
+
+func (s *store) Retries() storage.SortedSet {
+	return s.sorted["retries"]
+}
+
+func (s *store) Scheduled() storage.SortedSet {
+	return s.sorted["scheduled"]
+}
+
+func (s *store) Working() storage.SortedSet {
+	return s.sorted["working"]
+}
+
+func (s *store) Dead() storage.SortedSet {
+	return s.sorted["dead"]
+}
+
+func (s *store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, q := range s.queueSet {
+		q.done = true
+	}
+	for _, ss := range s.sorted {
+		ss.clear()
+	}
+	s.reset()
+	return nil
+}
+
+func (s *store) Raw() storage.KV {
+	return &kv{s}
+}
+
+// Raw keys are kept apart from the unique locks, progress and
+// results which share the map.
+type kv struct {
+	store *store
+}
+
+func (k *kv) Get(key string) ([]byte, error) {
+	return k.store.get("raw:" + key), nil
+}
+
+func (k *kv) Set(key string, value []byte) error {
+	if value == nil {
+		return storage.ErrNilValue
+	}
+	k.store.set("raw:"+key, value, 0)
+	return nil
+}
+
+func (k *kv) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	if value == nil {
+		return false, storage.ErrNilValue
+	}
+	k.store.mu.Lock()
+	defer k.store.mu.Unlock()
+	return k.store.setnx("raw:"+key, value, ttl), nil
+}
+
+// Set key to value unless it has an unexpired value, the caller
+// holds the lock.
+func (s *store) setnx(key string, value []byte, ttl time.Duration) bool {
+	if current, ok := s.kv[key]; ok && !current.expired(time.Now()) {
+		return false
+	}
+	s.kv[key] = item{value, expiresAt(ttl)}
+	return true
+}
+
+// The value at key, nil if it's missing or expired.
+func (s *store) get(key string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lookup(key)
+}
+
+// As get, the caller holds the lock.
+func (s *store) lookup(key string) []byte {
+	current, ok := s.kv[key]
+	if !ok {
+		return nil
+	}
+	if current.expired(time.Now()) {
+		delete(s.kv, key)
+		return nil
+	}
+	return current.value
+}
+
+// Set key to value, expiring it after ttl unless that's 0.
+func (s *store) set(key string, value []byte, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kv[key] = item{value, expiresAt(ttl)}
+}
+
+func (s *store) LockUnique(digest string, jid string, ttl time.Duration) (string, error) {
+	key := "unique:" + digest
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.setnx(key, []byte(jid), ttl) {
+		return "", nil
+	}
+	return string(s.lookup(key)), nil
+}
+
+func (s *store) UnlockUnique(digest string, jid string) error {
+	key := "unique:" + digest
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if string(s.lookup(key)) == jid {
+		delete(s.kv, key)
+	}
+	return nil
+}
+
+func (s *store) SetProgress(jid string, data []byte, ttl time.Duration) error {
+	s.set("progress:"+jid, data, ttl)
+	return nil
+}
+
+func (s *store) GetProgress(jids ...string) ([][]byte, error) {
+	if len(jids) == 0 {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := make([][]byte, len(jids))
+	for idx, jid := range jids {
+		results[idx] = s.lookup("progress:" + jid)
+	}
+	return results, nil
+}
+
+func (s *store) SetResult(jid string, data []byte, ttl time.Duration) error {
+	s.set("result:"+jid, data, ttl)
+	return nil
+}
+
+func (s *store) GetResult(jid string) ([]byte, error) {
+	return s.get("result:" + jid), nil
+}
+
+func (s *store) incr(names ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range names {
+		s.counters[name]++
+	}
+	return nil
+}
+
+func (s *store) counter(name string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counters[name]
+}
+
+func (s *store) Success() error {
+	daystr := time.Now().Format("2006-01-02")
+	return s.incr("processed:"+daystr, "processed")
+}
+
+func (s *store) Failure() error {
+	daystr := time.Now().Format("2006-01-02")
+	return s.incr("processed", "failures", "processed:"+daystr, "failures:"+daystr)
+}
+
+func (s *store) TotalProcessed() uint64 {
+	return s.counter("processed")
+}
+
+func (s *store) TotalFailures() uint64 {
+	return s.counter("failures")
+}
+
+func (s *store) SetTotals(processed uint64, failures uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters["processed"] = processed
+	s.counters["failures"] = failures
+	return nil
+}
+
+func (s *store) SetHistory(day string, procCnt uint64, failCnt uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters["processed:"+day] = procCnt
+	s.counters["failures:"+day] = failCnt
+	return nil
+}
+
+func (s *store) History(days int, fn func(day string, procCnt uint64, failCnt uint64)) error {
+	ts := time.Now()
+	for idx := 0; idx < days; idx++ {
+		daystr := ts.Format("2006-01-02")
+		fn(daystr, s.counter("processed:"+daystr), s.counter("failures:"+daystr))
+		ts = ts.Add(-24 * time.Hour)
+	}
+	return nil
+}
+
+func (s *store) GetQueue(name string) (storage.Queue, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, err := s.queue(name)
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// As GetQueue, the caller holds the lock.
+func (s *store) queue(name string) (*queue, error) {
+	if name == "" {
+		return nil, fmt.Errorf("queue name cannot be blank")
+	}
+
+	q, ok := s.queueSet[name]
+	if ok {
+		return q, nil
+	}
+
+	if !storage.ValidQueueName.MatchString(name) {
+		return nil, fmt.Errorf("queue names must match %v", storage.ValidQueueName)
+	}
+
+	q = &queue{
+		name:     name,
+		store:    s,
+		ordering: storage.FIFO,
+		jobs:     map[uint8][]*job{},
+	}
+	s.queueSet[name] = q
+	return q, nil
+}
+
+// queues are iterated in sorted, lexigraphical order
+func (s *store) EachQueue(x func(storage.Queue)) {
+	// copy the set so x can call GetQueue
+	s.mu.Lock()
+	names := make([]string, 0, len(s.queueSet))
+	for name := range s.queueSet {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	queues := make([]storage.Queue, len(names))
+	for idx, name := range names {
+		queues[idx] = s.queueSet[name]
+	}
+	s.mu.Unlock()
+
+	for _, q := range queues {
+		x(q)
+	}
+}
+
+func (s *store) RemoveQueue(name string) (uint64, error) {
+	if !storage.ValidQueueName.MatchString(name) {
+		return 0, fmt.Errorf("queue names must match %v", storage.ValidQueueName)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.queueSet[name]
+	if !ok {
+		return 0, nil
+	}
+	size := q.size()
+	q.done = true
+	delete(s.queueSet, name)
+	return size, nil
+}
+
+func (s *store) EnqueueAll(sset storage.SortedSet) error {
+	return sset.Each(func(_ int, entry storage.SortedEntry) error {
+		j, err := entry.Job()
+		if err != nil {
+			return err
+		}
+
+		k, err := entry.Key()
+		if err != nil {
+			return err
+		}
+
+		q, err := s.GetQueue(j.Queue)
+		if err != nil {
+			return err
+		}
+
+		ok, err := sset.Remove(k)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		return q.Add(j)
+	})
+}
+
+func (s *store) EnqueueFrom(sset storage.SortedSet, key []byte) error {
+	entry, err := sset.Get(key)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		// race condition, element was removed already
+		return nil
+	}
+
+	job, err := entry.Job()
+	if err != nil {
+		return err
+	}
+
+	q, err := s.GetQueue(job.Queue)
+	if err != nil {
+		return err
+	}
+
+	ok, err := sset.Remove(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+
+	return q.Add(job)
+}
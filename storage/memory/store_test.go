@@ -0,0 +1,26 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryConformance(t *testing.T) {
+	store, err := storage.Open("memory", "")
+	assert.NoError(t, err)
+	defer store.Close()
+	storagetest.TestStore(t, store)
+
+	// each open is a new store
+	q, err := store.GetQueue("default")
+	assert.NoError(t, err)
+	assert.NoError(t, q.Push(5, []byte(`{"jid":"abc","jobtype":"Invoice"}`)))
+	other := Open("other")
+	count := 0
+	other.EachQueue(func(storage.Queue) { count++ })
+	assert.Equal(t, 0, count)
+	assert.Equal(t, "other", other.Stats()["name"])
+}
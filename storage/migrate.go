@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// The number of jobs read and written at a time by Migrate.
+var MigrateBatchSize = 500
+
+// MigrateProgress is reported as Migrate copies each queue and set.
+// Done counts up to Total, the size of the queue or set when Migrate
+// got to it.
+type MigrateProgress struct {
+	// A queue's name or "scheduled", "retries" or "dead".
+	Name  string
+	Queue bool
+	Done  uint64
+	Total uint64
+}
+
+// Migrate copies every queue, the scheduled, retry and dead sets and
+// the counters from one store to another, MigrateBatchSize jobs at a
+// time, so the stores needn't fit in memory.  Queues keep their
+// ordering, paused state and the order their jobs are fetched.  As
+// with Snapshot, the working set, batches and dependencies aren't
+// copied so no server should be using from while it runs.  The jobs
+// are added to whatever is already in to.
+//
+// With dryRun nothing is written, progress reports what would be
+// copied.  progress may be nil.
+func Migrate(from Store, to Store, dryRun bool, progress func(MigrateProgress)) error {
+	if progress == nil {
+		progress = func(MigrateProgress) {}
+	}
+
+	queues := []Queue{}
+	from.EachQueue(func(q Queue) {
+		queues = append(queues, q)
+	})
+	for _, q := range queues {
+		err := migrateQueue(q, to, dryRun, progress)
+		if err != nil {
+			return fmt.Errorf("Unable to migrate queue %s: %v", q.Name(), err)
+		}
+	}
+
+	sets := [][]SortedSet{
+		{from.Scheduled(), to.Scheduled()},
+		{from.Retries(), to.Retries()},
+		{from.Dead(), to.Dead()},
+	}
+	for _, pair := range sets {
+		err := migrateSet(pair[0], pair[1], dryRun, progress)
+		if err != nil {
+			return fmt.Errorf("Unable to migrate %s: %v", pair[0].Name(), err)
+		}
+	}
+
+	if dryRun {
+		return nil
+	}
+	err := to.SetTotals(from.TotalProcessed(), from.TotalFailures())
+	if err != nil {
+		return err
+	}
+	var setErr error
+	err = from.History(SnapshotHistoryDays, func(day string, procCnt uint64, failCnt uint64) {
+		if setErr == nil && (procCnt > 0 || failCnt > 0) {
+			setErr = to.SetHistory(day, procCnt, failCnt)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return setErr
+}
+
+// Page ends with the next job to be fetched so the queue is copied
+// from the end, each page reversed.
+func migrateQueue(q Queue, to Store, dryRun bool, progress func(MigrateProgress)) error {
+	total := q.Size()
+	report := MigrateProgress{Name: q.Name(), Queue: true, Total: total}
+	progress(report)
+	if !dryRun {
+		dest, err := to.GetQueue(q.Name())
+		if err != nil {
+			return err
+		}
+		if ordering := q.Ordering(); ordering != dest.Ordering() {
+			err = dest.SetOrdering(ordering)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	batch := int64(MigrateBatchSize)
+	for end := int64(total) - 1; end >= 0; end -= batch {
+		start := end - batch + 1
+		if start < 0 {
+			start = 0
+		}
+		page := [][]byte{}
+		err := q.Page(start, end-start, func(_ int, data []byte) error {
+			page = append(page, data)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		entries := make([]BulkEntry, len(page))
+		for idx, data := range page {
+			var job struct {
+				Priority uint8 `json:"priority"`
+			}
+			err = json.Unmarshal(data, &job)
+			if err != nil {
+				return fmt.Errorf("Invalid job: %v", err)
+			}
+			entries[len(page)-1-idx] = BulkEntry{Queue: q.Name(), Priority: job.Priority, Data: data}
+		}
+		if !dryRun && len(entries) > 0 {
+			err = to.PushBulk(entries)
+			if err != nil {
+				return err
+			}
+		}
+		report.Done += uint64(len(entries))
+		progress(report)
+	}
+
+	if q.IsPaused() && !dryRun {
+		dest, err := to.GetQueue(q.Name())
+		if err != nil {
+			return err
+		}
+		return dest.Pause()
+	}
+	return nil
+}
+
+func migrateSet(from SortedSet, to SortedSet, dryRun bool, progress func(MigrateProgress)) error {
+	report := MigrateProgress{Name: from.Name(), Total: from.Size()}
+	progress(report)
+	err := from.Each(func(_ int, entry SortedEntry) error {
+		if !dryRun {
+			key, err := entry.Key()
+			if err != nil {
+				return err
+			}
+			parts := strings.SplitN(string(key), "|", 2)
+			err = to.AddElement(parts[0], parts[1], entry.Value())
+			if err != nil {
+				return err
+			}
+		}
+		report.Done++
+		if report.Done%uint64(MigrateBatchSize) == 0 {
+			progress(report)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if report.Done%uint64(MigrateBatchSize) != 0 {
+		progress(report)
+	}
+	return nil
+}
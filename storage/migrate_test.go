@@ -0,0 +1,96 @@
+package storage_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/storage/memory"
+	"github.com/contribsys/faktory/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrate(t *testing.T) {
+	oldSize := storage.MigrateBatchSize
+	storage.MigrateBatchSize = 2
+	defer func() { storage.MigrateBatchSize = oldSize }()
+
+	from := memory.Open("from")
+	defaultQ, err := from.GetQueue("default")
+	assert.NoError(t, err)
+	for idx := 1; idx <= 5; idx++ {
+		job := client.NewJob("Invoice", idx)
+		job.Jid = fmt.Sprintf("job%d", idx)
+		if idx == 4 {
+			job.Priority = 9
+		}
+		assert.NoError(t, defaultQ.Add(job))
+	}
+	lifoQ, err := from.GetQueue("lifo")
+	assert.NoError(t, err)
+	assert.NoError(t, lifoQ.SetOrdering(storage.LIFO))
+	assert.NoError(t, lifoQ.Pause())
+
+	at := util.Thens(time.Now().Add(time.Hour))
+	for idx := 0; idx < 3; idx++ {
+		job := client.NewJob("Report", idx)
+		job.At = at
+		assert.NoError(t, from.Retries().Add(job))
+	}
+	assert.NoError(t, from.Success())
+	assert.NoError(t, from.Failure())
+
+	// a dry run reports everything but writes nothing
+	dry := memory.Open("dry")
+	reports := []storage.MigrateProgress{}
+	err = storage.Migrate(from, dry, true, func(p storage.MigrateProgress) {
+		reports = append(reports, p)
+	})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, dry.Retries().Size())
+	assert.EqualValues(t, 0, dry.TotalProcessed())
+	last := map[string]storage.MigrateProgress{}
+	for _, p := range reports {
+		assert.True(t, p.Done <= p.Total)
+		last[p.Name] = p
+	}
+	assert.Equal(t, storage.MigrateProgress{Name: "default", Queue: true, Done: 5, Total: 5}, last["default"])
+	assert.Equal(t, storage.MigrateProgress{Name: "retries", Done: 3, Total: 3}, last["retries"])
+	assert.Equal(t, storage.MigrateProgress{Name: "dead"}, last["dead"])
+
+	to := memory.Open("to")
+	assert.NoError(t, storage.Migrate(from, to, false, nil))
+	q, err := to.GetQueue("default")
+	assert.NoError(t, err)
+	for _, jid := range []string{"job4", "job1", "job2", "job3", "job5"} {
+		data, err := q.Pop()
+		assert.NoError(t, err)
+		var job client.Job
+		assert.NoError(t, json.Unmarshal(data, &job))
+		assert.Equal(t, jid, job.Jid)
+	}
+	q, err = to.GetQueue("lifo")
+	assert.NoError(t, err)
+	assert.True(t, q.IsPaused())
+	assert.Equal(t, storage.LIFO, q.Ordering())
+	assert.EqualValues(t, 3, to.Retries().Size())
+	assert.EqualValues(t, 2, to.TotalProcessed())
+	assert.EqualValues(t, 1, to.TotalFailures())
+
+	// the source is left as it was
+	assert.EqualValues(t, 5, defaultQ.Size())
+
+	err = storage.Migrate(from, readOnlyHistory{memory.Open("broken")}, false, nil)
+	assert.EqualError(t, err, "read only")
+}
+
+type readOnlyHistory struct {
+	storage.Store
+}
+
+func (readOnlyHistory) SetHistory(day string, procCnt uint64, failCnt uint64) error {
+	return fmt.Errorf("read only")
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"container/heap"
+	"fmt"
+	"sync"
+
+	"github.com/contribsys/faktory/client"
+)
+
+// JobEntry is a candidate for the next Pop from a queue.
+type JobEntry struct {
+	// Position within the queue, 0 is the oldest job.
+	Index int
+	Data  []byte
+	Job   *client.Job
+}
+
+// Comparator decides the order in which jobs are fetched from a
+// queue.  It returns a negative number if a should be fetched
+// before b, a positive number if b should be fetched first and
+// 0 if either will do.
+type Comparator func(a, b JobEntry) int
+
+// ComparatorWindow is the number of jobs, oldest first, which are
+// considered by a custom Comparator on each Pop.  This bounds the
+// memory and time needed to Pop from a very large queue with the
+// tradeoff that ordering is only strict within the window.
+var ComparatorWindow = 100
+
+const (
+	FIFO     = "fifo"
+	LIFO     = "lifo"
+	Priority = "priority"
+)
+
+func FIFOComparator(a, b JobEntry) int {
+	return a.Index - b.Index
+}
+
+func LIFOComparator(a, b JobEntry) int {
+	return b.Index - a.Index
+}
+
+// PriorityComparator fetches higher priority jobs first
+// and jobs of the same priority in FIFO order.
+func PriorityComparator(a, b JobEntry) int {
+	if a.Job.Priority != b.Job.Priority {
+		return int(b.Job.Priority) - int(a.Job.Priority)
+	}
+	return FIFOComparator(a, b)
+}
+
+var (
+	comparatorMu sync.RWMutex
+	comparators  = map[string]Comparator{
+		FIFO:     FIFOComparator,
+		LIFO:     LIFOComparator,
+		Priority: PriorityComparator,
+	}
+)
+
+// RegisterComparator makes cmp available as a queue ordering
+// under the given name, see Queue.SetOrdering.  Registering an
+// existing name replaces it.
+func RegisterComparator(name string, cmp Comparator) error {
+	if name == "" {
+		return fmt.Errorf("comparator name cannot be blank")
+	}
+	if cmp == nil {
+		return fmt.Errorf("comparator %s cannot be nil", name)
+	}
+
+	comparatorMu.Lock()
+	defer comparatorMu.Unlock()
+	comparators[name] = cmp
+	return nil
+}
+
+func LookupComparator(name string) (Comparator, bool) {
+	comparatorMu.RLock()
+	defer comparatorMu.RUnlock()
+	cmp, ok := comparators[name]
+	return cmp, ok
+}
+
+type entryHeap struct {
+	entries []JobEntry
+	cmp     Comparator
+}
+
+func (h *entryHeap) Len() int           { return len(h.entries) }
+func (h *entryHeap) Less(i, j int) bool { return h.cmp(h.entries[i], h.entries[j]) < 0 }
+func (h *entryHeap) Swap(i, j int)      { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+
+func (h *entryHeap) Push(x interface{}) {
+	h.entries = append(h.entries, x.(JobEntry))
+}
+
+func (h *entryHeap) Pop() interface{} {
+	last := len(h.entries) - 1
+	entry := h.entries[last]
+	h.entries = h.entries[:last]
+	return entry
+}
+
+// Return the entry which cmp says should be fetched first.
+func firstEntry(entries []JobEntry, cmp Comparator) JobEntry {
+	h := &entryHeap{entries: entries, cmp: cmp}
+	heap.Init(h)
+	return heap.Pop(h).(JobEntry)
+}
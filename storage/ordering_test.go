@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComparators(t *testing.T) {
+	entries := func() []JobEntry {
+		return []JobEntry{
+			{Index: 2, Job: &client.Job{Jid: "c", Priority: 5}},
+			{Index: 0, Job: &client.Job{Jid: "a", Priority: 1}},
+			{Index: 3, Job: &client.Job{Jid: "d", Priority: 9}},
+			{Index: 1, Job: &client.Job{Jid: "b", Priority: 9}},
+		}
+	}
+
+	assert.Equal(t, "a", firstEntry(entries(), FIFOComparator).Job.Jid)
+	assert.Equal(t, "d", firstEntry(entries(), LIFOComparator).Job.Jid)
+	assert.Equal(t, "b", firstEntry(entries(), PriorityComparator).Job.Jid)
+
+	for _, name := range []string{FIFO, LIFO, Priority} {
+		_, ok := LookupComparator(name)
+		assert.True(t, ok, name)
+	}
+
+	_, ok := LookupComparator("jobtype")
+	assert.False(t, ok)
+	err := RegisterComparator("jobtype", func(a, b JobEntry) int {
+		if a.Job.Jid < b.Job.Jid {
+			return 1
+		}
+		return -1
+	})
+	assert.NoError(t, err)
+	cmp, ok := LookupComparator("jobtype")
+	assert.True(t, ok)
+	assert.Equal(t, "d", firstEntry(entries(), cmp).Job.Jid)
+
+	assert.Error(t, RegisterComparator("", FIFOComparator))
+	assert.Error(t, RegisterComparator("nil", nil))
+}
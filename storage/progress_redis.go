@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const progressKeyPrefix = "faktory:progress:"
+
+func (store *redisStore) SetProgress(jid string, data []byte, ttl time.Duration) error {
+	return store.rclient.Set(store.key(progressKeyPrefix+jid), data, ttl).Err()
+}
+
+func (store *redisStore) GetProgress(jids ...string) ([][]byte, error) {
+	if len(jids) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(jids))
+	for idx, jid := range jids {
+		keys[idx] = store.key(progressKeyPrefix + jid)
+	}
+	values, err := store.mget(keys)
+	if err != nil {
+		return nil, err
+	}
+	results := make([][]byte, len(jids))
+	for idx, value := range values {
+		if data, ok := value.(string); ok {
+			results[idx] = []byte(data)
+		}
+	}
+	return results, nil
+}
+
+// MGET, which a cluster only runs on keys in the same hash slot.
+func (store *redisStore) mget(keys []string) ([]interface{}, error) {
+	if !store.cluster {
+		return store.rclient.MGet(keys...).Result()
+	}
+	cmds := make([]*redis.StringCmd, len(keys))
+	_, err := store.rclient.Pipelined(func(pipe redis.Pipeliner) error {
+		for idx, key := range keys {
+			cmds[idx] = pipe.Get(key)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(keys))
+	for idx, cmd := range cmds {
+		if val, err := cmd.Result(); err == nil {
+			values[idx] = val
+		}
+	}
+	return values, nil
+}
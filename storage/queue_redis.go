@@ -3,6 +3,11 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/contribsys/faktory/client"
@@ -14,13 +19,65 @@ type redisQueue struct {
 	name  string
 	store *redisStore
 	done  bool
+
+	mu       sync.RWMutex
+	ordering string
+	cmp      Comparator
+	paused   bool
+}
+
+// The set of paused queue names.  Queue names can't contain
+// a colon so this can't clash with a queue.
+const pausedQueuesKey = "faktory:paused"
+
+// Default priority jobs are kept in the queue's own list and every
+// other priority in a list of its own, "<queue>:p<priority>", so a
+// queue of default priority jobs looks the same as it always has.
+const defaultPriority = 5
+
+func priorityKey(queue string, priority uint8) string {
+	if priority < 1 || priority > 9 || priority == defaultPriority {
+		return queue
+	}
+	return fmt.Sprintf("%s:p%d", queue, priority)
+}
+
+// The queue's lists, highest priority first.
+func priorityKeys(queue string) []string {
+	keys := make([]string, 0, 9)
+	for priority := uint8(9); priority > 0; priority-- {
+		keys = append(keys, priorityKey(queue, priority))
+	}
+	return keys
+}
+
+// The queue's list for jobs of this priority and all of its lists,
+// in the queue's hash slot.
+func (store *redisStore) listKey(queue string, priority uint8) string {
+	return store.key(priorityKey(store.slot(queue), priority))
+}
+
+func (store *redisStore) listKeys(queue string) []string {
+	keys := priorityKeys(store.slot(queue))
+	for idx := range keys {
+		keys[idx] = store.key(keys[idx])
+	}
+	return keys
+}
+
+// The fields which say which list a job is in and how long it has
+// been there.
+type listedJob struct {
+	Priority   uint8  `json:"priority"`
+	EnqueuedAt string `json:"enqueued_at"`
 }
 
 func (store *redisStore) NewQueue(name string) *redisQueue {
 	return &redisQueue{
-		name:  name,
-		store: store,
-		done:  false,
+		name:     name,
+		store:    store,
+		done:     false,
+		ordering: FIFO,
 	}
 }
 
@@ -32,18 +89,85 @@ func (q *redisQueue) Name() string {
 	return q.name
 }
 
+func (q *redisQueue) keys() []string {
+	return q.store.listKeys(q.name)
+}
+
+// The lengths of the queue's lists, highest priority first.
+func (q *redisQueue) sizes() ([]int64, error) {
+	keys := q.keys()
+	cmds := make([]*redis.IntCmd, len(keys))
+	_, err := q.store.rclient.Pipelined(func(pipe redis.Pipeliner) error {
+		for idx, key := range keys {
+			cmds[idx] = pipe.LLen(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sizes := make([]int64, len(keys))
+	for idx, cmd := range cmds {
+		sizes[idx] = cmd.Val()
+	}
+	return sizes, nil
+}
+
+// Pages through the queue as if it were a single list, the lowest
+// priority jobs first so the tail is still the next job to fetch.
+// Like LRANGE, start and start+count are inclusive and negative
+// values count back from the end.
 func (q *redisQueue) Page(start int64, count int64, fn func(index int, data []byte) error) error {
-	index := 0
+	sizes, err := q.sizes()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
 
-	slice, err := q.store.rclient.LRange(q.name, start, start+count).Result()
-	for _, job := range slice {
-		err = fn(index, []byte(job))
+	end := start + count
+	if start < 0 {
+		start += total
+	}
+	if end < 0 {
+		end += total
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= total {
+		end = total - 1
+	}
+
+	keys := q.keys()
+	index := 0
+	var offset int64
+	for idx := len(keys) - 1; idx >= 0 && offset <= end; idx-- {
+		size := sizes[idx]
+		if size == 0 || offset+size <= start {
+			offset += size
+			continue
+		}
+		from := start - offset
+		if from < 0 {
+			from = 0
+		}
+		slice, err := q.store.rclient.LRange(keys[idx], from, end-offset).Result()
 		if err != nil {
 			return err
 		}
-		index += 1
+		for _, job := range slice {
+			err = fn(index, []byte(job))
+			if err != nil {
+				return err
+			}
+			index += 1
+		}
+		offset += size
 	}
-	return err
+	return nil
 }
 
 func (q *redisQueue) Each(fn func(index int, data []byte) error) error {
@@ -51,17 +175,83 @@ func (q *redisQueue) Each(fn func(index int, data []byte) error) error {
 }
 
 func (q *redisQueue) Clear() (uint64, error) {
-	q.store.rclient.Del(q.name)
-	return 0, nil
+	err := q.store.checkQueueKey(q.name)
+	if err != nil {
+		return 0, err
+	}
+
+	return clearKeys(q.store.rclient, q.keys(), nil)
+}
+
+// Delete the lists, and anything else fn adds to the transaction,
+// returning how many jobs they held.
+func clearKeys(rclient redis.UniversalClient, keys []string, fn func(redis.Pipeliner)) (uint64, error) {
+	sizes := make([]*redis.IntCmd, len(keys))
+	_, err := rclient.TxPipelined(func(pipe redis.Pipeliner) error {
+		for idx, key := range keys {
+			sizes[idx] = pipe.LLen(key)
+		}
+		pipe.Del(keys...)
+		if fn != nil {
+			fn(pipe)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	var total uint64
+	for _, size := range sizes {
+		total += uint64(size.Val())
+	}
+	return total, nil
 }
 
 func (q *redisQueue) init() error {
+	paused, err := q.store.rclient.SIsMember(q.store.key(pausedQueuesKey), q.name).Result()
+	if err != nil {
+		return err
+	}
+	q.paused = paused
 	util.Debugf("Queue init: %s %d elements", q.name, q.Size())
 	return nil
 }
 
+func (q *redisQueue) Pause() error {
+	err := q.store.rclient.SAdd(q.store.key(pausedQueuesKey), q.name).Err()
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	q.paused = true
+	q.mu.Unlock()
+	return nil
+}
+
+func (q *redisQueue) Resume() error {
+	err := q.store.rclient.SRem(q.store.key(pausedQueuesKey), q.name).Err()
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	q.paused = false
+	q.mu.Unlock()
+	return nil
+}
+
+func (q *redisQueue) IsPaused() bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.paused
+}
+
 func (q *redisQueue) Size() uint64 {
-	return uint64(q.store.rclient.LLen(q.name).Val())
+	sizes, _ := q.sizes()
+	var total uint64
+	for _, size := range sizes {
+		total += uint64(size)
+	}
+	return total
 }
 
 func (q *redisQueue) Add(job *client.Job) error {
@@ -75,7 +265,7 @@ func (q *redisQueue) Add(job *client.Job) error {
 }
 
 func (q *redisQueue) Push(priority uint8, payload []byte) error {
-	q.store.rclient.LPush(q.name, payload)
+	q.store.rclient.LPush(q.store.listKey(q.name, priority), payload)
 	return nil
 }
 
@@ -88,16 +278,321 @@ func (q *redisQueue) Pop() ([]byte, error) {
 	return q._pop()
 }
 
+func (q *redisQueue) Ordering() string {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.ordering
+}
+
+func (q *redisQueue) SetOrdering(name string) error {
+	cmp, ok := LookupComparator(name)
+	if !ok {
+		return fmt.Errorf("Unknown ordering: %s", name)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.ordering = name
+	q.cmp = cmp
+	return nil
+}
+
+func (q *redisQueue) comparator() (string, Comparator) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.ordering, q.cmp
+}
+
+// KEYS: the queue's lists, highest priority first, then the set to
+// add the job to, if any.  ARGV: "rpop" or "lpop" and, with a set, the
+// job's score, prefix and suffix.  Pops from the first list which
+// isn't empty.
+var popScript = redis.NewScript(`
+local lists = #KEYS
+if ARGV[2] then
+  lists = lists - 1
+end
+for idx = 1, lists do
+  local val = redis.call(ARGV[1], KEYS[idx])
+  if val then
+    if ARGV[2] then
+      redis.call("zadd", KEYS[#KEYS], ARGV[2], ARGV[3] .. val .. ARGV[4])
+    end
+    return val
+  end
+end
+return false
+`)
+
+// Where PopTo adds the popped job.
+type popTarget struct {
+	key    string
+	score  string
+	prefix []byte
+	suffix []byte
+}
+
 func (q *redisQueue) _pop() ([]byte, error) {
-	val, err := q.store.rclient.RPop(q.name).Result()
-	if val == "" {
+	return q.popTo(nil)
+}
+
+// The lists and the set are updated by one script unless they might
+// be in different hash slots of a cluster or the set belongs to
+// another store, e.g. another shard, when the job is popped and then
+// added.
+func (q *redisQueue) PopTo(sset SortedSet, timestamp string, prefix []byte, suffix []byte) ([]byte, error) {
+	if q.done {
+		return nil, nil
+	}
+
+	rs, ok := sset.(*redisSorted)
+	if !ok || rs.store != q.store || q.store.cluster {
+		return popTo(q, sset, timestamp, prefix, suffix)
+	}
+	tim, err := util.ParseTime(timestamp)
+	if err != nil {
+		return nil, err
+	}
+	time_f := float64(tim.Unix()) + (float64(tim.Nanosecond()) / 1000000000)
+	return q.popTo(&popTarget{
+		key:    rs.key,
+		score:  strconv.FormatFloat(time_f, 'f', -1, 64),
+		prefix: prefix,
+		suffix: suffix,
+	})
+}
+
+// Pop a job and then add it to the set, for a queue and set which
+// can't be updated together.  A job which can't be added is pushed
+// back onto the queue.
+func popTo(q Queue, sset SortedSet, timestamp string, prefix []byte, suffix []byte) ([]byte, error) {
+	data, err := q.Pop()
+	if data == nil || err != nil {
+		return data, err
+	}
+	var job struct {
+		Jid      string `json:"jid"`
+		Priority uint8  `json:"priority"`
+	}
+	json.Unmarshal(data, &job)
+	payload := make([]byte, 0, len(prefix)+len(data)+len(suffix))
+	payload = append(append(append(payload, prefix...), data...), suffix...)
+	err = sset.AddElement(timestamp, job.Jid, payload)
+	if err != nil {
+		q.Push(job.Priority, data)
+		return nil, err
+	}
+	return data, nil
+}
+
+func (q *redisQueue) popTo(target *popTarget) ([]byte, error) {
+	// FIFO and LIFO map directly onto the lists so they
+	// don't need to load any candidates.
+	ordering, cmp := q.comparator()
+	op := "rpop"
+	switch ordering {
+	case FIFO:
+	case LIFO:
+		op = "lpop"
+	default:
+		return q.sortedPop(cmp, target)
+	}
+
+	keys := q.keys()
+	args := []interface{}{op}
+	if target != nil {
+		keys = append(keys, target.key)
+		args = append(args, target.score, target.prefix, target.suffix)
+	}
+	val, err := popScript.Run(q.store.rclient, keys, args...).String()
+	if err == redis.Nil || val == "" {
 		return nil, nil
 	}
-	return []byte(val), err
+	if err != nil {
+		return nil, err
+	}
+	return []byte(val), nil
+}
+
+// LPUSH adds to the head of each list so its tail is the oldest job,
+// whatever the ordering.
+func (q *redisQueue) Oldest() ([]byte, error) {
+	keys := q.keys()
+	cmds := make([]*redis.StringCmd, len(keys))
+	_, err := q.store.rclient.Pipelined(func(pipe redis.Pipeliner) error {
+		for idx, key := range keys {
+			cmds[idx] = pipe.LIndex(key, -1)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	var oldest []byte
+	var oldestAt time.Time
+	for _, cmd := range cmds {
+		val, err := cmd.Result()
+		if err != nil {
+			continue
+		}
+		var job listedJob
+		json.Unmarshal([]byte(val), &job)
+		at, err := util.ParseTime(job.EnqueuedAt)
+		if oldest == nil || (err == nil && (oldestAt.IsZero() || at.Before(oldestAt))) {
+			oldest = []byte(val)
+			oldestAt = at
+		}
+	}
+	return oldest, nil
+}
+
+func (q *redisQueue) Peek(count int) ([][]byte, error) {
+	if count < 1 {
+		return nil, nil
+	}
+
+	// every job in a higher priority list is fetched first
+	ordering, cmp := q.comparator()
+	results := make([][]byte, 0, count)
+	for _, key := range q.keys() {
+		need := count - len(results)
+		if need == 0 {
+			break
+		}
+
+		var vals []string
+		var err error
+		switch ordering {
+		case FIFO:
+			vals, err = q.store.rclient.LRange(key, int64(-need), -1).Result()
+			// the oldest job is at the tail
+			for i, j := 0, len(vals)-1; i < j; i, j = i+1, j-1 {
+				vals[i], vals[j] = vals[j], vals[i]
+			}
+		case LIFO:
+			vals, err = q.store.rclient.LRange(key, 0, int64(need-1)).Result()
+		default:
+			var entries []JobEntry
+			entries, err = q.candidates(key)
+			sort.SliceStable(entries, func(i, j int) bool {
+				return cmp(entries[i], entries[j]) < 0
+			})
+			if len(entries) > need {
+				entries = entries[:need]
+			}
+			for _, entry := range entries {
+				vals = append(vals, string(entry.Data))
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, val := range vals {
+			results = append(results, []byte(val))
+		}
+	}
+	return results, nil
+}
+
+// Load the ComparatorWindow oldest jobs in one of the queue's lists
+// as entries for a Comparator.
+func (q *redisQueue) candidates(key string) ([]JobEntry, error) {
+	// the oldest job is at the tail of the list
+	vals, err := q.store.rclient.LRange(key, int64(-ComparatorWindow), -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]JobEntry, len(vals))
+	for idx, val := range vals {
+		data := []byte(val)
+		var job client.Job
+		err := json.Unmarshal(data, &job)
+		if err != nil {
+			util.Warnf("Unable to parse job in queue %s: %v", q.name, err)
+		}
+		entries[idx] = JobEntry{Index: len(vals) - 1 - idx, Data: data, Job: &job}
+	}
+	return entries, nil
+}
+
+// KEYS: a list and the set to add the job to.  ARGV: the job, its
+// score, prefix and suffix.  Returns how many were removed from the
+// list, the job is only added if it was there.
+var removeToScript = redis.NewScript(`
+local count = redis.call("lrem", KEYS[1], -1, ARGV[1])
+if count > 0 then
+  redis.call("zadd", KEYS[2], ARGV[2], ARGV[3] .. ARGV[1] .. ARGV[4])
+end
+return count
+`)
+
+// Pop the first of the ComparatorWindow oldest jobs according to
+// cmp, from the highest priority list which isn't empty.
+func (q *redisQueue) sortedPop(cmp Comparator, target *popTarget) ([]byte, error) {
+	for _, key := range q.keys() {
+		for {
+			entries, err := q.candidates(key)
+			if err != nil {
+				return nil, err
+			}
+			if len(entries) == 0 {
+				break
+			}
+
+			first := firstEntry(entries, cmp)
+			var count int64
+			if target == nil {
+				count, err = q.store.rclient.LRem(key, -1, first.Data).Result()
+			} else {
+				count, err = removeToScript.Run(q.store.rclient, []string{key, target.key},
+					first.Data, target.score, target.prefix, target.suffix).Int64()
+			}
+			if err != nil {
+				return nil, err
+			}
+			if count > 0 {
+				return first.Data, nil
+			}
+			// another connection popped this job first, try again
+		}
+	}
+	return nil, nil
 }
 
 func (q *redisQueue) BPop(ctx context.Context) ([]byte, error) {
-	val, err := q.store.rclient.BRPop(2*time.Second, q.name).Result()
+	ordering, _ := q.comparator()
+	switch ordering {
+	case FIFO:
+		return q.bpop(q.store.rclient.BRPop)
+	case LIFO:
+		return q.bpop(q.store.rclient.BLPop)
+	}
+
+	// Redis can't block until a job arrives without also popping it
+	// so poll for a job with the same timeout as a blocking pop.
+	timeout := time.After(2 * time.Second)
+	for {
+		data, err := q.Pop()
+		if err != nil || data != nil {
+			return data, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-timeout:
+			return nil, nil
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// Redis checks the keys in order so the highest priority job
+// is popped first.
+func (q *redisQueue) bpop(fn func(time.Duration, ...string) *redis.StringSliceCmd) ([]byte, error) {
+	val, err := fn(2*time.Second, q.keys()...).Result()
 	if err != nil {
 		if err == redis.Nil {
 			return nil, nil
@@ -110,7 +605,9 @@ func (q *redisQueue) BPop(ctx context.Context) ([]byte, error) {
 
 func (q *redisQueue) Delete(vals [][]byte) error {
 	for _, val := range vals {
-		err := q.store.rclient.LRem(q.name, 1, val).Err()
+		var job listedJob
+		json.Unmarshal(val, &job)
+		err := q.store.rclient.LRem(q.store.listKey(q.name, job.Priority), 1, val).Err()
 		if err != nil {
 			return err
 		}
@@ -118,3 +615,102 @@ func (q *redisQueue) Delete(vals [][]byte) error {
 
 	return nil
 }
+
+// Walks each list a page at a time, so a job which moves while the
+// queue is busy may be missed.
+func (q *redisQueue) FindJid(jid string) ([]byte, error) {
+	prefix := jidPrefix(jid)
+	for _, key := range q.keys() {
+		for start := int64(0); ; start += 100 {
+			vals, err := q.store.rclient.LRange(key, start, start+99).Result()
+			if err != nil {
+				return nil, err
+			}
+			for _, val := range vals {
+				if strings.HasPrefix(val, prefix) {
+					return []byte(val), nil
+				}
+			}
+			if len(vals) < 100 {
+				break
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (q *redisQueue) RemoveJid(jid string) ([]byte, error) {
+	data, err := q.FindJid(jid)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var job listedJob
+	json.Unmarshal(data, &job)
+	cnt, err := q.store.rclient.LRem(q.store.listKey(q.name, job.Priority), 1, data).Result()
+	if err != nil {
+		return nil, err
+	}
+	if cnt == 0 {
+		// fetched since we found it
+		return nil, nil
+	}
+	return data, nil
+}
+
+func (store *redisStore) PushBulk(entries []BulkEntry) error {
+	// ensure every queue name is valid and registered before
+	// we touch Redis so a bad name can't cause a partial push.
+	for _, entry := range entries {
+		_, err := store.GetQueue(entry.Queue)
+		if err != nil {
+			return err
+		}
+	}
+
+	// a cluster client splits this into a transaction per slot,
+	// i.e. per queue, see RedisOptions.Cluster
+	_, err := store.rclient.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, entry := range entries {
+			pipe.LPush(store.listKey(entry.Queue, entry.Priority), entry.Data)
+		}
+		return nil
+	})
+	return err
+}
+
+// KEYS: the list to push to and, optionally, the lists of a queue
+// which must be empty.  ARGV: the payload.
+var pushIfScript = redis.NewScript(`
+for i = 2, #KEYS do
+  if redis.call("llen", KEYS[i]) > 0 then
+    return 0
+  end
+end
+redis.call("lpush", KEYS[1], ARGV[1])
+return 1
+`)
+
+func (store *redisStore) PushIf(cond PushCondition, entry BulkEntry) (bool, error) {
+	_, err := store.GetQueue(entry.Queue)
+	if err != nil {
+		return false, err
+	}
+
+	keys := []string{store.listKey(entry.Queue, entry.Priority)}
+	if cond.EmptyQueue != "" {
+		_, err := store.GetQueue(cond.EmptyQueue)
+		if err != nil {
+			return false, err
+		}
+		if store.cluster && cond.EmptyQueue != entry.Queue {
+			return false, fmt.Errorf("Redis Cluster can't check queue %s is empty while pushing to %s", cond.EmptyQueue, entry.Queue)
+		}
+		keys = append(keys, store.listKeys(cond.EmptyQueue)...)
+	}
+
+	pushed, err := pushIfScript.Run(store.rclient, keys, entry.Data).Int64()
+	if err != nil {
+		return false, err
+	}
+	return pushed == 1, nil
+}
@@ -1,11 +1,14 @@
 package storage
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"sync"
 	"sync/atomic"
 	"testing"
 
+	"github.com/contribsys/faktory/client"
 	"github.com/contribsys/faktory/util"
 	"github.com/stretchr/testify/assert"
 )
@@ -48,7 +51,7 @@ func TestBasicQueueOps(t *testing.T) {
 
 			cnt, err := q.Clear()
 			assert.NoError(t, err)
-			assert.EqualValues(t, 0, cnt)
+			assert.EqualValues(t, 1, cnt)
 			assert.EqualValues(t, 0, q.Size())
 
 			// valid names:
@@ -120,6 +123,144 @@ func TestBasicQueueOps(t *testing.T) {
 			assert.Nil(t, data)
 		})
 
+		t.Run("ordering", func(t *testing.T) {
+			store.Flush()
+			q, err := store.GetQueue("ordered")
+			assert.NoError(t, err)
+			assert.Equal(t, FIFO, q.Ordering())
+
+			err = RegisterComparator("deadline", func(a, b JobEntry) int {
+				x, _ := a.Job.GetCustom("deadline")
+				y, _ := b.Job.GetCustom("deadline")
+				return int(x.(float64) - y.(float64))
+			})
+			assert.NoError(t, err)
+
+			deadlines := []int{30, 10, 40, 20}
+			for _, deadline := range deadlines {
+				job := client.NewJob("Thing", deadline)
+				job.SetCustom("deadline", deadline)
+				err = q.Add(job)
+				assert.NoError(t, err)
+			}
+
+			err = q.SetOrdering("nope")
+			assert.Error(t, err)
+			err = q.SetOrdering("deadline")
+			assert.NoError(t, err)
+			assert.Equal(t, "deadline", q.Ordering())
+
+			for _, expected := range []float64{10, 20, 30, 40} {
+				data, err := q.Pop()
+				assert.NoError(t, err)
+				var job client.Job
+				err = json.Unmarshal(data, &job)
+				assert.NoError(t, err)
+				assert.Equal(t, []interface{}{expected}, job.Args)
+			}
+			data, err := q.Pop()
+			assert.NoError(t, err)
+			assert.Nil(t, data)
+
+			err = q.SetOrdering(LIFO)
+			assert.NoError(t, err)
+			q.Push(5, []byte("old"))
+			q.Push(5, []byte("new"))
+			data, err = q.Pop()
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("new"), data)
+		})
+
+		t.Run("priority", func(t *testing.T) {
+			store.Flush()
+			q, err := store.GetQueue("default")
+			assert.NoError(t, err)
+
+			jids := func(vals [][]byte) []string {
+				result := make([]string, len(vals))
+				for idx, val := range vals {
+					var job client.Job
+					assert.NoError(t, json.Unmarshal(val, &job))
+					result[idx] = job.Jid
+				}
+				return result
+			}
+			for _, job := range []struct {
+				jid      string
+				priority uint8
+			}{{"a", 5}, {"b", 9}, {"c", 1}, {"d", 9}} {
+				j := client.NewJob("Thing", 1)
+				j.Jid = job.jid
+				j.Priority = job.priority
+				assert.NoError(t, q.Add(j))
+			}
+			assert.EqualValues(t, 4, q.Size())
+
+			vals, err := q.Peek(10)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"b", "d", "a", "c"}, jids(vals))
+
+			// lowest priority first, the tail is fetched next
+			vals = nil
+			err = q.Each(func(idx int, data []byte) error {
+				vals = append(vals, data)
+				return nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"c", "a", "d", "b"}, jids(vals))
+			vals = nil
+			err = q.Page(1, 1, func(idx int, data []byte) error {
+				vals = append(vals, data)
+				return nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"a", "d"}, jids(vals))
+
+			data, err := q.Oldest()
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"a"}, jids([][]byte{data}))
+
+			assert.NoError(t, q.Delete(vals[1:]))
+			assert.EqualValues(t, 3, q.Size())
+			for _, jid := range []string{"b", "a", "c"} {
+				data, err := q.Pop()
+				assert.NoError(t, err)
+				assert.Equal(t, []string{jid}, jids([][]byte{data}))
+			}
+
+			err = q.SetOrdering(LIFO)
+			assert.NoError(t, err)
+			q.Push(5, []byte("old"))
+			q.Push(5, []byte("new"))
+			q.Push(8, []byte("urgent"))
+			for _, expected := range []string{"urgent", "new", "old"} {
+				data, err := q.BPop(context.Background())
+				assert.NoError(t, err)
+				assert.Equal(t, expected, string(data))
+			}
+			assert.NoError(t, q.SetOrdering(FIFO))
+
+			_, high := fakeJobWithPriority(9)
+			_, low := fakeJobWithPriority(2)
+			err = store.PushBulk([]BulkEntry{{Queue: "default", Priority: 2, Data: low}, {Queue: "default", Priority: 9, Data: high}})
+			assert.NoError(t, err)
+			// the empty check looks at every priority
+			pushed, err := store.PushIf(PushCondition{EmptyQueue: "default"}, BulkEntry{Queue: "default", Priority: 9, Data: []byte(`{"jobtype":"Other","priority":9}`)})
+			assert.NoError(t, err)
+			assert.False(t, pushed)
+			data, err = q.Pop()
+			assert.NoError(t, err)
+			assert.Equal(t, high, data)
+
+			cnt, err := q.Clear()
+			assert.NoError(t, err)
+			assert.EqualValues(t, 1, cnt)
+			assert.NoError(t, q.Push(7, low))
+			cnt, err = store.RemoveQueue("default")
+			assert.NoError(t, err)
+			assert.EqualValues(t, 1, cnt)
+		})
+
 		t.Run("threaded", func(t *testing.T) {
 			store.Flush()
 			q, err := store.GetQueue("default")
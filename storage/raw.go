@@ -2,6 +2,7 @@ package storage
 
 import (
 	"errors"
+	"time"
 
 	"github.com/go-redis/redis"
 )
@@ -13,6 +14,10 @@ var (
 type KV interface {
 	Get(key string) ([]byte, error)
 	Set(key string, value []byte) error
+
+	// Set the key only if it does not exist, expiring it after ttl.
+	// Returns false if the key was already set.
+	SetNX(key string, value []byte, ttl time.Duration) (bool, error)
 }
 
 // Provide a basic KV scratch pad, for misc feature usage.
@@ -26,7 +31,7 @@ func (s *redisStore) Raw() KV {
 }
 
 func (kv *redisKV) Get(key string) ([]byte, error) {
-	value, err := kv.store.rclient.Get(key).Result()
+	value, err := kv.store.rclient.Get(kv.store.key(key)).Result()
 	if err != nil {
 		if err == redis.Nil {
 			return nil, nil
@@ -40,5 +45,12 @@ func (kv *redisKV) Set(key string, value []byte) error {
 	if value == nil {
 		return ErrNilValue
 	}
-	return kv.store.rclient.Set(key, value, 0).Err()
+	return kv.store.rclient.Set(kv.store.key(key), value, 0).Err()
+}
+
+func (kv *redisKV) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	if value == nil {
+		return false, ErrNilValue
+	}
+	return kv.store.rclient.SetNX(kv.store.key(key), value, ttl).Result()
 }
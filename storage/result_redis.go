@@ -0,0 +1,21 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const resultKeyPrefix = "faktory:result:"
+
+func (store *redisStore) SetResult(jid string, data []byte, ttl time.Duration) error {
+	return store.rclient.Set(store.key(resultKeyPrefix+jid), data, ttl).Err()
+}
+
+func (store *redisStore) GetResult(jid string) ([]byte, error) {
+	data, err := store.rclient.Get(store.key(resultKeyPrefix + jid)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return data, err
+}
@@ -0,0 +1,284 @@
+package storage
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/contribsys/faktory/util"
+	"github.com/go-redis/redis"
+)
+
+// The points each shard has on the hash ring, enough to spread the
+// queues evenly.
+var shardReplicas = 160
+
+// A shardedStore spreads the queues across several Redis instances so
+// no one of them has to hold every job:
+//
+//	[faktory]
+//	storage_driver = "redis_sharded"
+//	storage_url = "redis://:password@redis-a:6379,redis://:password@redis-b:6379"
+//
+// Each queue name is consistently hashed to a shard, so adding a shard
+// only moves the queues which now hash to it, and has its jobs and
+// settings there.  Opening the store moves any queue it finds on
+// another shard to its own, with its ordering and paused state, so
+// adding a shard doesn't strand jobs and each queue is on one shard.
+// A shard dropped from the list isn't read at all so move its jobs
+// first, e.g. with faktory-cli migrate.  Everything else, the
+// scheduled, retry, dead and working sets, batches, locks and
+// counters, is kept on the first shard.  PushBulk is only atomic for
+// the entries of each shard and, like Redis Cluster, PushIf can't
+// check a queue on another shard is empty.
+type shardedStore struct {
+	// the first shard, which holds everything but the queues
+	Store
+	shards []Store
+	names  []string
+	ring   hashRing
+}
+
+func openShardedURLs(path string) (Store, error) {
+	opts := []RedisOptions{}
+	for _, part := range strings.Split(path, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			opts = append(opts, RedisOptions{URL: part})
+		}
+	}
+	return OpenRedisShards(opts)
+}
+
+// OpenRedisShards opens a store whose queues are spread across the
+// Redis instances, see shardedStore.  The instances are identified by
+// their URL, without any password, and key prefix so the order they're
+// given in doesn't matter, apart from the first.
+func OpenRedisShards(shards []RedisOptions) (Store, error) {
+	if len(shards) < 2 {
+		return nil, fmt.Errorf("A sharded store needs at least two Redis URLs, separated by commas")
+	}
+
+	ss := &shardedStore{}
+	for _, opts := range shards {
+		if len(opts.Cluster) > 0 {
+			ss.Close()
+			return nil, fmt.Errorf("A Redis Cluster can't be a shard")
+		}
+		store, err := OpenRedisWith(opts)
+		if err != nil {
+			ss.Close()
+			return nil, fmt.Errorf("Unable to open shard %s: %v", RedactURL(opts.URL), err)
+		}
+		name := RedactURL(opts.URL) + opts.KeyPrefix
+		for _, other := range ss.names {
+			if other == name {
+				store.Close()
+				ss.Close()
+				return nil, fmt.Errorf("Shard %s is listed twice", name)
+			}
+		}
+		ss.shards = append(ss.shards, store)
+		ss.names = append(ss.names, name)
+	}
+	ss.Store = ss.shards[0]
+	ss.ring = newHashRing(ss.names)
+	err := ss.rebalance()
+	if err != nil {
+		ss.Close()
+		return nil, err
+	}
+	return ss, nil
+}
+
+// Move each queue on a shard which no longer owns it, as the shards
+// changed, to its owner.
+func (ss *shardedStore) rebalance() error {
+	for idx, store := range ss.shards {
+		moving := []Queue{}
+		store.EachQueue(func(q Queue) {
+			if ss.ring.owner(q.Name()) != idx {
+				moving = append(moving, q)
+			}
+		})
+		for _, q := range moving {
+			owner := ss.ring.owner(q.Name())
+			util.Infof("Moving queue %s from shard %s to %s", q.Name(), ss.names[idx], ss.names[owner])
+			err := migrateQueue(q, ss.shards[owner], false, func(MigrateProgress) {})
+			if err == nil {
+				_, err = store.RemoveQueue(q.Name())
+			}
+			if err != nil {
+				return fmt.Errorf("Unable to move queue %s to shard %s: %v", q.Name(), ss.names[owner], err)
+			}
+		}
+	}
+	return nil
+}
+
+// The first shard also holds everything else.
+func (ss *shardedStore) Shards() []Shard {
+	shards := make([]Shard, len(ss.shards))
+	for idx, store := range ss.shards {
+		shards[idx] = Shard{Name: ss.names[idx], Store: store}
+	}
+	return shards
+}
+
+// The shard holding the queue.
+func (ss *shardedStore) shard(queue string) Store {
+	return ss.shards[ss.ring.owner(queue)]
+}
+
+func (ss *shardedStore) Close() error {
+	var err error
+	for _, store := range ss.shards {
+		if cerr := store.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (ss *shardedStore) GetQueue(name string) (Queue, error) {
+	return ss.shard(name).GetQueue(name)
+}
+
+// Only the owner's copy of a queue, GetQueue may have added an empty
+// one to another shard.
+func (ss *shardedStore) EachQueue(fn func(Queue)) {
+	for idx, store := range ss.shards {
+		store.EachQueue(func(q Queue) {
+			if ss.ring.owner(q.Name()) == idx {
+				fn(q)
+			}
+		})
+	}
+}
+
+func (ss *shardedStore) RemoveQueue(name string) (uint64, error) {
+	return ss.shard(name).RemoveQueue(name)
+}
+
+// The first shard's stats, and the others' numbered from 1.
+func (ss *shardedStore) Stats() map[string]string {
+	stats := map[string]string{}
+	for idx, store := range ss.shards {
+		for key, val := range store.Stats() {
+			if idx == 0 {
+				stats[key] = val
+			} else {
+				stats[fmt.Sprintf("%s.%d", key, idx)] = val
+			}
+		}
+	}
+	stats["name"] = strings.Join(ss.names, ",")
+	stats["shards"] = strconv.Itoa(len(ss.shards))
+	return stats
+}
+
+func (ss *shardedStore) EnqueueAll(sset SortedSet) error {
+	return enqueueAll(ss, sset)
+}
+
+func (ss *shardedStore) EnqueueFrom(sset SortedSet, key []byte) error {
+	return enqueueFrom(ss, sset, key)
+}
+
+// Pushes each shard's entries in a transaction, checking every queue
+// name first so a bad one can't cause a partial push.
+func (ss *shardedStore) PushBulk(entries []BulkEntry) error {
+	for _, entry := range entries {
+		if !ValidQueueName.MatchString(entry.Queue) {
+			return fmt.Errorf("queue names must match %v", ValidQueueName)
+		}
+	}
+
+	byShard := map[int][]BulkEntry{}
+	for _, entry := range entries {
+		idx := ss.ring.owner(entry.Queue)
+		byShard[idx] = append(byShard[idx], entry)
+	}
+	for idx, store := range ss.shards {
+		if len(byShard[idx]) == 0 {
+			continue
+		}
+		err := store.PushBulk(byShard[idx])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ss *shardedStore) PushIf(cond PushCondition, entry BulkEntry) (bool, error) {
+	store := ss.shard(entry.Queue)
+	if cond.EmptyQueue != "" && ss.shard(cond.EmptyQueue) != store {
+		return false, fmt.Errorf("A sharded store can't check queue %s is empty while pushing to %s, they're on different shards", cond.EmptyQueue, entry.Queue)
+	}
+	return store.PushIf(cond, entry)
+}
+
+func (ss *shardedStore) Flush() error {
+	for _, store := range ss.shards {
+		err := store.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The first shard's client, see Redis.
+func (ss *shardedStore) Redis() redis.UniversalClient {
+	return ss.shards[0].(Redis).Redis()
+}
+
+// A consistent hash ring: each name owns the points its replicas hash
+// to and a key belongs to the owner of the next point at or after its
+// hash.
+type hashRing struct {
+	points []uint32
+	owners []int
+}
+
+func newHashRing(names []string) hashRing {
+	type point struct {
+		hash  uint32
+		owner int
+	}
+	points := make([]point, 0, len(names)*shardReplicas)
+	for idx, name := range names {
+		for replica := 0; replica < shardReplicas; replica++ {
+			points = append(points, point{fnvHash(name + "#" + strconv.Itoa(replica)), idx})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+
+	ring := hashRing{points: make([]uint32, len(points)), owners: make([]int, len(points))}
+	for idx, p := range points {
+		ring.points[idx] = p.hash
+		ring.owners[idx] = p.owner
+	}
+	return ring
+}
+
+func (ring hashRing) owner(key string) int {
+	hash := fnvHash(key)
+	idx := sort.Search(len(ring.points), func(i int) bool {
+		return ring.points[i] >= hash
+	})
+	if idx == len(ring.points) {
+		idx = 0
+	}
+	return ring.owners[idx]
+}
+
+func fnvHash(str string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(str))
+	return hash.Sum32()
+}
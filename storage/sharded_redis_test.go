@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashRing(t *testing.T) {
+	ring := newHashRing([]string{"redis://a:6379", "redis://b:6379", "redis://c:6379"})
+	counts := map[int]int{}
+	owners := map[string]int{}
+	for idx := 0; idx < 3000; idx++ {
+		queue := fmt.Sprintf("queue-%d", idx)
+		owners[queue] = ring.owner(queue)
+		counts[owners[queue]]++
+	}
+	assert.Equal(t, 3, len(counts))
+	for _, count := range counts {
+		assert.InDelta(t, 1000, count, 250)
+	}
+	assert.Equal(t, owners["queue-1"], ring.owner("queue-1"))
+
+	// a new shard only takes queues, the others stay put
+	grown := newHashRing([]string{"redis://a:6379", "redis://b:6379", "redis://c:6379", "redis://d:6379"})
+	moved := 0
+	for queue, owner := range owners {
+		if now := grown.owner(queue); now != owner {
+			assert.Equal(t, 3, now)
+			moved++
+		}
+	}
+	assert.InDelta(t, 750, moved, 250)
+}
+
+func TestOpenRedisShards(t *testing.T) {
+	_, err := Open("redis_sharded", "redis://localhost:6379")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "at least two")
+
+	_, err = OpenRedisShards([]RedisOptions{{Cluster: []string{"localhost:7000"}}, {URL: "redis://localhost:6379"}})
+	assert.Error(t, err)
+
+	assert.Equal(t, "redis://:xxxxx@a:6379,redis://b:6379", RedactURL("redis://:secret@a:6379,redis://b:6379"))
+}
+
+func TestShardedStore(t *testing.T) {
+	dir := "/tmp/faktory-test-sharded"
+	defer os.RemoveAll(dir)
+
+	sock := dir + "/redis.sock"
+	stopper, err := BootRedis(dir, sock)
+	if stopper != nil {
+		defer stopper()
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	// two shards sharing the Redis by key prefix
+	store, err := OpenRedisShards([]RedisOptions{
+		{URL: "unix://" + sock, KeyPrefix: "shard0:"},
+		{URL: "unix://" + sock, KeyPrefix: "shard1:"},
+	})
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.Flush())
+
+	ss := store.(*shardedStore)
+	var near, far string
+	for idx := 0; near == "" || far == ""; idx++ {
+		name := fmt.Sprintf("q%d", idx)
+		if ss.ring.owner(name) == 0 {
+			near = name
+		} else {
+			far = name
+		}
+	}
+
+	assert.NoError(t, store.PushBulk([]BulkEntry{
+		{Queue: near, Priority: 5, Data: []byte(`{"jid":"near"}`)},
+		{Queue: far, Priority: 5, Data: []byte(`{"jid":"far"}`)},
+	}))
+	shards := ss.Shards()
+	q, err := shards[1].Store.GetQueue(far)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, q.Size())
+	q, err = shards[0].Store.GetQueue(far)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, q.Size())
+
+	total := uint64(0)
+	store.EachQueue(func(q Queue) {
+		total += q.Size()
+	})
+	assert.EqualValues(t, 2, total)
+
+	_, err = store.PushIf(PushCondition{EmptyQueue: near}, BulkEntry{Queue: far, Priority: 5, Data: []byte(`{"jid":"iffy"}`)})
+	assert.Error(t, err)
+
+	// the sets live on the first shard and enqueue onto any
+	assert.NoError(t, store.Retries().AddElement("2018-01-01T00:00:00Z", "retry1", []byte(`{"jid":"retry1","queue":"`+far+`"}`)))
+	assert.NoError(t, store.EnqueueAll(store.Retries()))
+	q, err = shards[1].Store.GetQueue(far)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, q.Size())
+	assert.Equal(t, "2", store.Stats()["shards"])
+
+	// jobs left on another shard, as when a shard is added, move to
+	// the queue's own shard when the store is opened
+	q, err = shards[0].Store.GetQueue(far)
+	assert.NoError(t, err)
+	assert.NoError(t, q.Push(5, []byte(`{"jid":"stranded"}`)))
+	assert.NoError(t, q.Pause())
+	reopened, err := OpenRedisShards([]RedisOptions{
+		{URL: "unix://" + sock, KeyPrefix: "shard0:"},
+		{URL: "unix://" + sock, KeyPrefix: "shard1:"},
+	})
+	assert.NoError(t, err)
+	defer reopened.Close()
+	shards = reopened.(*shardedStore).Shards()
+	q, err = shards[1].Store.GetQueue(far)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, q.Size())
+	assert.True(t, q.IsPaused())
+	shards[0].Store.EachQueue(func(q Queue) {
+		assert.NotEqual(t, far, q.Name())
+	})
+	seen := 0
+	reopened.EachQueue(func(q Queue) {
+		if q.Name() == far {
+			seen++
+		}
+	})
+	assert.Equal(t, 1, seen)
+}
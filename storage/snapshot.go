@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/contribsys/faktory/util"
+)
+
+// SnapshotVersion is the version of the Snapshot format written by
+// TakeSnapshot.  Restore rejects snapshots from a newer version.
+const SnapshotVersion = 1
+
+// The number of days of history a snapshot keeps.
+var SnapshotHistoryDays = 180
+
+// A Snapshot is a store's queues, scheduled, retry and dead jobs and
+// counters in a form which doesn't depend on the storage driver, so
+// a backup taken from one store can be restored to any other.  It's
+// saved as JSON.  The working set isn't included: reservations belong
+// to the processes which made them.
+type Snapshot struct {
+	Version   int             `json:"version"`
+	CreatedAt string          `json:"created_at"`
+	Queues    []SnapshotQueue `json:"queues"`
+	Scheduled []SnapshotEntry `json:"scheduled"`
+	Retries   []SnapshotEntry `json:"retries"`
+	Dead      []SnapshotEntry `json:"dead"`
+	Processed uint64          `json:"processed"`
+	Failures  uint64          `json:"failures"`
+	History   []SnapshotDay   `json:"history"`
+}
+
+// The jobs of a queue, in the order they'd be fetched.
+type SnapshotQueue struct {
+	Name   string            `json:"name"`
+	Paused bool              `json:"paused,omitempty"`
+	Jobs   []json.RawMessage `json:"jobs"`
+}
+
+// A job in a sorted set and its timestamp.
+type SnapshotEntry struct {
+	At  string          `json:"at"`
+	Jid string          `json:"jid"`
+	Job json.RawMessage `json:"job"`
+}
+
+type SnapshotDay struct {
+	Day       string `json:"day"`
+	Processed uint64 `json:"processed"`
+	Failures  uint64 `json:"failures"`
+}
+
+// TakeSnapshot reads everything a Snapshot holds from the store.  It
+// isn't atomic: jobs fetched or pushed while it runs may or may not
+// be included.
+func TakeSnapshot(store Store) (*Snapshot, error) {
+	snap := &Snapshot{
+		Version:   SnapshotVersion,
+		CreatedAt: util.Nows(),
+		Queues:    []SnapshotQueue{},
+		Processed: store.TotalProcessed(),
+		Failures:  store.TotalFailures(),
+		History:   []SnapshotDay{},
+	}
+
+	var err error
+	store.EachQueue(func(q Queue) {
+		if err != nil {
+			return
+		}
+		sq := SnapshotQueue{Name: q.Name(), Paused: q.IsPaused(), Jobs: []json.RawMessage{}}
+		err = q.Each(func(_ int, data []byte) error {
+			sq.Jobs = append(sq.Jobs, json.RawMessage(data))
+			return nil
+		})
+		// Each ends with the next job to be fetched, reverse it
+		for i, j := 0, len(sq.Jobs)-1; i < j; i, j = i+1, j-1 {
+			sq.Jobs[i], sq.Jobs[j] = sq.Jobs[j], sq.Jobs[i]
+		}
+		snap.Queues = append(snap.Queues, sq)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	snap.Scheduled, err = snapshotSet(store.Scheduled())
+	if err != nil {
+		return nil, err
+	}
+	snap.Retries, err = snapshotSet(store.Retries())
+	if err != nil {
+		return nil, err
+	}
+	snap.Dead, err = snapshotSet(store.Dead())
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.History(SnapshotHistoryDays, func(day string, procCnt uint64, failCnt uint64) {
+		if procCnt > 0 || failCnt > 0 {
+			snap.History = append(snap.History, SnapshotDay{Day: day, Processed: procCnt, Failures: failCnt})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+func snapshotSet(sset SortedSet) ([]SnapshotEntry, error) {
+	entries := []SnapshotEntry{}
+	err := sset.Each(func(_ int, entry SortedEntry) error {
+		key, err := entry.Key()
+		if err != nil {
+			return err
+		}
+		parts := strings.SplitN(string(key), "|", 2)
+		entries = append(entries, SnapshotEntry{At: parts[0], Jid: parts[1], Job: json.RawMessage(entry.Value())})
+		return nil
+	})
+	return entries, err
+}
+
+// Restore adds the snapshot's jobs to the store and sets its
+// counters.  Existing jobs are kept so restore to an empty store,
+// restoring twice enqueues each job twice.
+func (snap *Snapshot) Restore(store Store) error {
+	if snap.Version < 1 || snap.Version > SnapshotVersion {
+		return fmt.Errorf("Unsupported snapshot version %d, expected at most %d", snap.Version, SnapshotVersion)
+	}
+
+	for _, sq := range snap.Queues {
+		q, err := store.GetQueue(sq.Name)
+		if err != nil {
+			return err
+		}
+		entries := make([]BulkEntry, len(sq.Jobs))
+		for idx, data := range sq.Jobs {
+			var job struct {
+				Priority uint8 `json:"priority"`
+			}
+			err = json.Unmarshal(data, &job)
+			if err != nil {
+				return fmt.Errorf("Invalid job in queue %s: %v", sq.Name, err)
+			}
+			entries[idx] = BulkEntry{Queue: sq.Name, Priority: job.Priority, Data: data}
+		}
+		if len(entries) > 0 {
+			err = store.PushBulk(entries)
+			if err != nil {
+				return err
+			}
+		}
+		if sq.Paused {
+			err = q.Pause()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	sets := map[SortedSet][]SnapshotEntry{
+		store.Scheduled(): snap.Scheduled,
+		store.Retries():   snap.Retries,
+		store.Dead():      snap.Dead,
+	}
+	for sset, entries := range sets {
+		for _, entry := range entries {
+			err := sset.AddElement(entry.At, entry.Jid, entry.Job)
+			if err != nil {
+				return fmt.Errorf("Invalid %s entry %s: %v", sset.Name(), entry.Jid, err)
+			}
+		}
+	}
+
+	err := store.SetTotals(snap.Processed, snap.Failures)
+	if err != nil {
+		return err
+	}
+	for _, day := range snap.History {
+		if _, err := time.Parse("2006-01-02", day.Day); err != nil {
+			return fmt.Errorf("Invalid history day %s", day.Day)
+		}
+		err = store.SetHistory(day.Day, day.Processed, day.Failures)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
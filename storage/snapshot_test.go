@@ -0,0 +1,86 @@
+package storage_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/storage/memory"
+	"github.com/contribsys/faktory/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	store := memory.Open("source")
+	defaultQ, err := store.GetQueue("default")
+	assert.NoError(t, err)
+	for _, jid := range []string{"first", "second"} {
+		job := client.NewJob("Invoice", 1)
+		job.Jid = jid
+		assert.NoError(t, defaultQ.Add(job))
+	}
+	urgent := client.NewJob("Invoice", 2)
+	urgent.Jid = "urgent"
+	urgent.Priority = 9
+	assert.NoError(t, defaultQ.Add(urgent))
+	pausedQ, err := store.GetQueue("paused")
+	assert.NoError(t, err)
+	assert.NoError(t, pausedQ.Pause())
+
+	at := util.Thens(time.Now().Add(time.Hour))
+	scheduled := client.NewJob("Report", 3)
+	scheduled.At = at
+	assert.NoError(t, store.Scheduled().Add(scheduled))
+	dead := client.NewJob("Report", 4)
+	dead.At = at
+	assert.NoError(t, store.Dead().Add(dead))
+	assert.NoError(t, store.Success())
+	assert.NoError(t, store.Failure())
+
+	snap, err := storage.TakeSnapshot(store)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.SnapshotVersion, snap.Version)
+	assert.Equal(t, 2, len(snap.Queues))
+	assert.Equal(t, 1, len(snap.Scheduled))
+	assert.Equal(t, scheduled.Jid, snap.Scheduled[0].Jid)
+	assert.Equal(t, 0, len(snap.Retries))
+	assert.EqualValues(t, 2, snap.Processed)
+
+	// round trip through the JSON a backup file holds
+	data, err := json.Marshal(snap)
+	assert.NoError(t, err)
+	var loaded storage.Snapshot
+	assert.NoError(t, json.Unmarshal(data, &loaded))
+
+	restored := memory.Open("restored")
+	assert.NoError(t, loaded.Restore(restored))
+	q, err := restored.GetQueue("default")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, q.Size())
+	for _, jid := range []string{"urgent", "first", "second"} {
+		data, err := q.Pop()
+		assert.NoError(t, err)
+		var job client.Job
+		assert.NoError(t, json.Unmarshal(data, &job))
+		assert.Equal(t, jid, job.Jid)
+	}
+	q, err = restored.GetQueue("paused")
+	assert.NoError(t, err)
+	assert.True(t, q.IsPaused())
+
+	assert.EqualValues(t, 1, restored.Scheduled().Size())
+	assert.EqualValues(t, 1, restored.Dead().Size())
+	data, err = restored.Scheduled().FindJid(scheduled.Jid)
+	assert.NoError(t, err)
+	assert.NotNil(t, data)
+	entry, err := restored.Scheduled().Get([]byte(at + "|" + scheduled.Jid))
+	assert.NoError(t, err)
+	assert.NotNil(t, entry)
+	assert.EqualValues(t, 2, restored.TotalProcessed())
+	assert.EqualValues(t, 1, restored.TotalFailures())
+
+	loaded.Version = storage.SnapshotVersion + 1
+	assert.Error(t, loaded.Restore(memory.Open("newer")))
+}
@@ -15,14 +15,15 @@ import (
 
 type redisSorted struct {
 	name  string
+	key   string
 	store *redisStore
 }
 
 func (rs *redisStore) initSorted() {
-	rs.scheduled = &redisSorted{name: "scheduled", store: rs}
-	rs.retries = &redisSorted{name: "retries", store: rs}
-	rs.dead = &redisSorted{name: "dead", store: rs}
-	rs.working = &redisSorted{name: "working", store: rs}
+	rs.scheduled = &redisSorted{name: "scheduled", key: rs.key("scheduled"), store: rs}
+	rs.retries = &redisSorted{name: "retries", key: rs.key("retries"), store: rs}
+	rs.dead = &redisSorted{name: "dead", key: rs.key("dead"), store: rs}
+	rs.working = &redisSorted{name: "working", key: rs.key("working"), store: rs}
 }
 
 func (rs *redisSorted) Name() string {
@@ -30,11 +31,11 @@ func (rs *redisSorted) Name() string {
 }
 
 func (rs *redisSorted) Size() uint64 {
-	return uint64(rs.store.rclient.ZCard(rs.name).Val())
+	return uint64(rs.store.rclient.ZCard(rs.key).Val())
 }
 
 func (rs *redisSorted) Clear() error {
-	return rs.store.rclient.Del(rs.name).Err()
+	return rs.store.rclient.Del(rs.key).Err()
 }
 
 func (rs *redisSorted) Add(job *client.Job) error {
@@ -55,7 +56,7 @@ func (rs *redisSorted) AddElement(timestamp string, jid string, payload []byte)
 		return err
 	}
 	time_f := float64(tim.Unix()) + (float64(tim.Nanosecond()) / 1000000000)
-	_, err = rs.store.rclient.ZAdd(rs.name, redis.Z{Score: time_f, Member: payload}).Result()
+	_, err = rs.store.rclient.ZAdd(rs.key, redis.Z{Score: time_f, Member: payload}).Result()
 	return err
 }
 
@@ -75,7 +76,7 @@ func decompose(key []byte) (float64, string, error) {
 
 func (rs *redisSorted) getScore(score float64) ([]string, error) {
 	strf := strconv.FormatFloat(score, 'f', -1, 64)
-	elms, err := rs.store.rclient.ZRangeByScore(rs.name, redis.ZRangeBy{Min: strf, Max: strf}).Result()
+	elms, err := rs.store.rclient.ZRangeByScore(rs.key, redis.ZRangeBy{Min: strf, Max: strf}).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -159,7 +160,7 @@ func (e *setEntry) Job() (*client.Job, error) {
 }
 
 func (rs *redisSorted) Page(start int, count int, fn func(index int, e SortedEntry) error) (int, error) {
-	zs, err := rs.store.rclient.ZRangeWithScores(rs.name, int64(start), int64(start+count)).Result()
+	zs, err := rs.store.rclient.ZRangeWithScores(rs.key, int64(start), int64(start+count)).Result()
 	if err != nil {
 		return 0, err
 	}
@@ -201,13 +202,13 @@ func (rs *redisSorted) rem(time_f float64, jid string) (bool, error) {
 		return false, nil
 	}
 	if len(elms) == 1 {
-		count, err := rs.store.rclient.ZRem(rs.name, elms[0]).Result()
+		count, err := rs.store.rclient.ZRem(rs.key, elms[0]).Result()
 		return count == 1, err
 	}
 
 	for _, elm := range elms {
 		if strings.Index(elm, jid) > 0 {
-			count, err := rs.store.rclient.ZRem(rs.name, elm).Result()
+			count, err := rs.store.rclient.ZRem(rs.key, elm).Result()
 			return count == 1, err
 		}
 	}
@@ -243,8 +244,8 @@ func (rs *redisSorted) RemoveBefore(timestamp string) ([][]byte, error) {
 
 	var vals *redis.StringSliceCmd
 	_, err = rs.store.rclient.TxPipelined(func(pipe redis.Pipeliner) error {
-		vals = pipe.ZRangeByScore(rs.name, redis.ZRangeBy{Min: "-inf", Max: strf})
-		pipe.ZRemRangeByScore(rs.name, "-inf", strf)
+		vals = pipe.ZRangeByScore(rs.key, redis.ZRangeBy{Min: "-inf", Max: strf})
+		pipe.ZRemRangeByScore(rs.key, "-inf", strf)
 		return nil
 	})
 	if err != nil {
@@ -265,13 +266,96 @@ func (rs *redisSorted) RemoveBefore(timestamp string) ([][]byte, error) {
 	return results, nil
 }
 
+// KEYS: the set.  ARGV: the highest score to remove and the most
+// elements to remove.  ZREM is called a hundred members at a time to
+// stay well within Lua's stack.
+var removeBatchScript = redis.NewScript(`
+local vals = redis.call("zrangebyscore", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[2])
+for idx = 1, #vals, 100 do
+  redis.call("zrem", KEYS[1], unpack(vals, idx, math.min(idx + 99, #vals)))
+end
+return vals
+`)
+
+func (rs *redisSorted) RemoveBatchBefore(timestamp string, count int) ([][]byte, error) {
+	tim, err := util.ParseTime(timestamp)
+	if err != nil {
+		return nil, err
+	}
+	time_f := float64(tim.Unix()) + (float64(tim.Nanosecond()) / 1000000000)
+	strf := strconv.FormatFloat(time_f, 'f', -1, 64)
+
+	vals, err := removeBatchScript.Run(rs.store.rclient, []string{rs.key}, strf, count).Result()
+	if err != nil {
+		return nil, err
+	}
+	members, _ := vals.([]interface{})
+	results := make([][]byte, len(members))
+	for idx, member := range members {
+		str, _ := member.(string)
+		results[idx] = []byte(str)
+	}
+	return results, nil
+}
+
+func (rs *redisSorted) Trim(max uint64) (int64, error) {
+	return rs.store.rclient.ZRemRangeByRank(rs.key, 0, -int64(max)-1).Result()
+}
+
+// Job payloads are marshalled from client.Job so they all start
+// with the jid.
+func jidPrefix(jid string) string {
+	quoted, _ := json.Marshal(jid)
+	return `{"jid":` + string(quoted) + `,`
+}
+
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+func (rs *redisSorted) FindJid(jid string) ([]byte, error) {
+	prefix := jidPrefix(jid)
+	match := globEscaper.Replace(prefix) + "*"
+	var cursor uint64
+	for {
+		members, next, err := rs.store.rclient.ZScan(rs.key, cursor, match, 100).Result()
+		if err != nil {
+			return nil, err
+		}
+		// members alternate with their scores
+		for idx := 0; idx < len(members); idx += 2 {
+			if strings.HasPrefix(members[idx], prefix) {
+				return []byte(members[idx]), nil
+			}
+		}
+		if next == 0 {
+			return nil, nil
+		}
+		cursor = next
+	}
+}
+
+func (rs *redisSorted) RemoveJid(jid string) ([]byte, error) {
+	data, err := rs.FindJid(jid)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	cnt, err := rs.store.rclient.ZRem(rs.key, string(data)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if cnt == 0 {
+		// moved since we found it
+		return nil, nil
+	}
+	return data, nil
+}
+
 func (rs *redisSorted) MoveTo(sset SortedSet, entry SortedEntry, newtime time.Time) error {
 	job, err := entry.Job()
 	if err != nil {
 		return err
 	}
 
-	cnt, err := rs.store.rclient.ZRem(rs.name, string(entry.Value())).Result()
+	cnt, err := rs.store.rclient.ZRem(rs.key, string(entry.Value())).Result()
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,27 @@
+// Package sqlite stores Faktory's data in an SQLite file rather than
+// Redis, for small installs, edge devices and CI where running Redis
+// alongside Faktory is more than the load calls for.  The driver,
+// modernc.org/sqlite, is pure Go so there's nothing else to install,
+// but it needs a far newer Go than the rest of Faktory so the store
+// is only built with the sqlite build tag:
+//
+//	go build -tags sqlite ./cmd/faktory
+//
+// Importing it then registers the "sqlite" storage driver, see
+// storage.RegisterDriver:
+//
+//	[faktory]
+//	storage_driver = "sqlite"
+//	storage_url = "/var/lib/faktory/faktory.db"
+//
+// The path is the database file, or a directory to keep faktory.db
+// in if it has no extension, so without storage_url the database is
+// kept in the storage directory.  ":memory:" is a store which lasts
+// as long as the process, handy for tests.
+//
+// The store itself is sqlstore's.  SQLite allows one writer at a time
+// so it uses a single connection and every change is a transaction on
+// it.
+//
+// Without the tag the package is empty and registers nothing.
+package sqlite
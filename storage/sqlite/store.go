@@ -0,0 +1,147 @@
+// +build sqlite
+
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/storage/sqlstore"
+	_ "modernc.org/sqlite"
+)
+
+func init() {
+	storage.RegisterDriver("sqlite", func(path string) (storage.Store, error) {
+		return Open(path)
+	})
+}
+
+// Times are stored as milliseconds since the epoch.  Every change is
+// a transaction holding the database's write lock so rows needn't be
+// locked.
+var dialect = &sqlstore.Dialect{
+	Name:        "SQLite",
+	Schema:      schema,
+	Version:     `SELECT 'SQLite ' || sqlite_version()`,
+	Placeholder: "?",
+	Now:         `CAST((julianday('now') - 2440587.5) * 86400000 AS INTEGER)`,
+	After:       `({now} + %s)`,
+	NoLimit:     `-1`,
+}
+
+// The database file for path, see the package docs.
+func databaseFile(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("SQLite storage needs a path")
+	}
+	if path == ":memory:" {
+		return path, nil
+	}
+	if filepath.Ext(path) == "" {
+		err := os.MkdirAll(path, os.ModeDir|0755)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(path, "faktory.db"), nil
+	}
+	err := os.MkdirAll(filepath.Dir(path), os.ModeDir|0755)
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Open the database at path, creating it and any missing tables.
+func Open(path string) (storage.Store, error) {
+	file, err := databaseFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// WAL lets readers in other processes, e.g. a backup, work
+	// alongside the writer, and immediate transactions take the write
+	// lock up front so they can't fail part way through on a busy
+	// database.
+	dsn := "file:" + file + "?_txlock=immediate&_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)"
+	if file != ":memory:" {
+		dsn += "&_pragma=journal_mode(WAL)"
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open SQLite database %s: %v", file, err)
+	}
+	db.SetMaxOpenConns(1)
+	return sqlstore.Open(db, file, dialect)
+}
+
+var schema = `
+CREATE TABLE IF NOT EXISTS faktory_queues (
+  name TEXT PRIMARY KEY,
+  paused INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS faktory_jobs (
+  id INTEGER PRIMARY KEY,
+  queue TEXT NOT NULL,
+  priority INTEGER NOT NULL,
+  jid TEXT NOT NULL,
+  jobtype TEXT NOT NULL,
+  data BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS faktory_jobs_fetch ON faktory_jobs (queue, priority DESC, id);
+CREATE INDEX IF NOT EXISTS faktory_jobs_jid ON faktory_jobs (queue, jid);
+CREATE TABLE IF NOT EXISTS faktory_sorted (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL,
+  score REAL NOT NULL,
+  jid TEXT NOT NULL,
+  digest BLOB NOT NULL,
+  data BLOB NOT NULL,
+  UNIQUE (name, digest)
+);
+CREATE INDEX IF NOT EXISTS faktory_sorted_score ON faktory_sorted (name, score, id);
+CREATE INDEX IF NOT EXISTS faktory_sorted_jid ON faktory_sorted (name, jid);
+CREATE TABLE IF NOT EXISTS faktory_kv (
+  key TEXT PRIMARY KEY,
+  value BLOB NOT NULL,
+  expires_at INTEGER
+);
+CREATE TABLE IF NOT EXISTS faktory_counters (
+  name TEXT PRIMARY KEY,
+  value INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS faktory_batches (
+  bid TEXT PRIMARY KEY,
+  data BLOB NOT NULL,
+  created_at TEXT NOT NULL,
+  committed INTEGER NOT NULL DEFAULT 0,
+  total INTEGER NOT NULL DEFAULT 0,
+  pending INTEGER NOT NULL DEFAULT 0,
+  completed INTEGER NOT NULL DEFAULT 0,
+  succeeded INTEGER NOT NULL DEFAULT 0,
+  expires_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS faktory_batch_failures (
+  bid TEXT NOT NULL REFERENCES faktory_batches ON DELETE CASCADE,
+  jid TEXT NOT NULL,
+  PRIMARY KEY (bid, jid)
+);
+CREATE TABLE IF NOT EXISTS faktory_dependencies (
+  jid TEXT PRIMARY KEY,
+  state TEXT NOT NULL,
+  expires_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS faktory_held (
+  jid TEXT PRIMARY KEY,
+  data BLOB NOT NULL,
+  pending INTEGER NOT NULL,
+  expires_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS faktory_dependents (
+  dependency TEXT NOT NULL,
+  jid TEXT NOT NULL,
+  expires_at INTEGER NOT NULL,
+  PRIMARY KEY (dependency, jid)
+);
+`
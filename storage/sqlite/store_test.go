@@ -0,0 +1,76 @@
+// +build sqlite
+
+package sqlite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSqliteConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "faktory-sqlite")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "conformance.db")
+	store, err := storage.Open("sqlite", path)
+	assert.NoError(t, err)
+	storagetest.TestStore(t, store)
+
+	// queues persist across opens
+	q, err := store.GetQueue("persisted")
+	assert.NoError(t, err)
+	assert.NoError(t, q.Push(5, []byte(`{"jid":"abc","jobtype":"Invoice"}`)))
+	assert.NoError(t, q.Pause())
+	assert.NoError(t, store.Close())
+
+	reopened, err := Open(path)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	names := []string{}
+	reopened.EachQueue(func(q storage.Queue) {
+		names = append(names, q.Name())
+		if q.Name() == "persisted" {
+			assert.True(t, q.IsPaused())
+			assert.EqualValues(t, 1, q.Size())
+		}
+	})
+	assert.Contains(t, names, "persisted")
+}
+
+func TestMemoryConformance(t *testing.T) {
+	store, err := Open(":memory:")
+	assert.NoError(t, err)
+	defer store.Close()
+	storagetest.TestStore(t, store)
+}
+
+func TestDatabaseFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "faktory-sqlite")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file, err := databaseFile(filepath.Join(dir, "db"))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "db", "faktory.db"), file)
+	info, err := os.Stat(filepath.Join(dir, "db"))
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	file, err = databaseFile(filepath.Join(dir, "nested", "jobs.sqlite"))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "nested", "jobs.sqlite"), file)
+
+	file, err = databaseFile(":memory:")
+	assert.NoError(t, err)
+	assert.Equal(t, ":memory:", file)
+
+	_, err = databaseFile("")
+	assert.Error(t, err)
+}
@@ -0,0 +1,204 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/contribsys/faktory/storage"
+)
+
+// The batch's row, locked for the rest of the transaction, nil if
+// there's no such batch.
+type batchRow struct {
+	committed bool
+	pending   int64
+	completed bool
+	succeeded bool
+}
+
+func lockBatch(tx *txn, bid string) (*batchRow, error) {
+	var row batchRow
+	err := tx.QueryRow(`SELECT committed, pending, completed, succeeded FROM faktory_batches
+  WHERE bid = $1 AND expires_at > {now} {for update}`, bid).Scan(&row.committed, &row.pending, &row.completed, &row.succeeded)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &row, nil
+}
+
+// The callbacks which are now due, each fires only once.
+func due(tx *txn, bid string, row *batchRow) ([]string, error) {
+	fire := []string{}
+	if !row.committed {
+		return fire, nil
+	}
+	var failed int64
+	err := tx.QueryRow(`SELECT count(*) FROM faktory_batch_failures WHERE bid = $1`, bid).Scan(&failed)
+	if err != nil {
+		return nil, err
+	}
+	if row.pending-failed <= 0 && !row.completed {
+		fire = append(fire, storage.BatchComplete)
+	}
+	if row.pending <= 0 && !row.succeeded {
+		fire = append(fire, storage.BatchSuccess)
+	}
+	if len(fire) > 0 {
+		_, err = tx.Exec(`UPDATE faktory_batches SET completed = completed OR $2, succeeded = succeeded OR $3 WHERE bid = $1`,
+			bid, row.pending-failed <= 0, row.pending <= 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fire, nil
+}
+
+func (s *store) CreateBatch(bid string, data []byte, ttl time.Duration) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`DELETE FROM faktory_batches WHERE bid = $1 AND expires_at <= {now}`, bid)
+	if err != nil {
+		return err
+	}
+	created := time.Now().UTC().Format(time.RFC3339Nano)
+	result, err := tx.Exec(`INSERT INTO faktory_batches (bid, data, created_at, expires_at)
+  VALUES ($1, $2, $3, {after $4}) ON CONFLICT DO NOTHING`, bid, data, created, millis(ttl))
+	if err != nil {
+		return err
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		return fmt.Errorf("Batch %s already exists", bid)
+	}
+	return tx.Commit()
+}
+
+func (s *store) GetBatch(bid string) (*storage.BatchState, error) {
+	state := &storage.BatchState{Bid: bid}
+	err := s.db.QueryRow(`SELECT data, created_at, committed, total, pending, completed, succeeded,
+  (SELECT count(*) FROM faktory_batch_failures f WHERE f.bid = b.bid)
+  FROM faktory_batches b WHERE bid = $1 AND expires_at > {now}`, bid).Scan(
+		&state.Data, &state.CreatedAt, &state.Committed, &state.Total, &state.Pending,
+		&state.Completed, &state.Succeeded, &state.Failed)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// A negative count takes back jobs which couldn't be pushed and is
+// always allowed.
+func (s *store) AddToBatch(bid string, count int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	row, err := lockBatch(tx, bid)
+	if err != nil {
+		return err
+	}
+	if row == nil {
+		return fmt.Errorf("No such batch %s", bid)
+	}
+	if count > 0 && row.committed {
+		return fmt.Errorf("Batch %s is committed, open it to add jobs", bid)
+	}
+	_, err = tx.Exec(`UPDATE faktory_batches SET total = total + $2, pending = pending + $2 WHERE bid = $1`, bid, count)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *store) BatchJobDone(bid string, jid string, succeeded bool) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	row, err := lockBatch(tx, bid)
+	if err != nil {
+		return nil, err
+	}
+	if row == nil {
+		return []string{}, nil
+	}
+
+	if succeeded {
+		_, err = tx.Exec(`DELETE FROM faktory_batch_failures WHERE bid = $1 AND jid = $2`, bid, jid)
+		if err == nil {
+			_, err = tx.Exec(`UPDATE faktory_batches SET pending = pending - 1 WHERE bid = $1`, bid)
+			row.pending--
+		}
+	} else {
+		_, err = tx.Exec(`INSERT INTO faktory_batch_failures (bid, jid) VALUES ($1, $2) ON CONFLICT DO NOTHING`, bid, jid)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fire, err := due(tx, bid, row)
+	if err != nil {
+		return nil, err
+	}
+	return fire, tx.Commit()
+}
+
+func (s *store) CommitBatch(bid string) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	row, err := lockBatch(tx, bid)
+	if err != nil {
+		return nil, err
+	}
+	if row == nil {
+		return nil, fmt.Errorf("No such batch %s", bid)
+	}
+	_, err = tx.Exec(`UPDATE faktory_batches SET committed = true WHERE bid = $1`, bid)
+	if err != nil {
+		return nil, err
+	}
+	row.committed = true
+
+	fire, err := due(tx, bid, row)
+	if err != nil {
+		return nil, err
+	}
+	return fire, tx.Commit()
+}
+
+func (s *store) OpenBatch(bid string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	row, err := lockBatch(tx, bid)
+	if err != nil {
+		return err
+	}
+	if row == nil {
+		return fmt.Errorf("No such batch %s", bid)
+	}
+	if row.completed {
+		return fmt.Errorf("Batch %s has already completed", bid)
+	}
+	_, err = tx.Exec(`UPDATE faktory_batches SET committed = false WHERE bid = $1`, bid)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,174 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/contribsys/faktory/storage"
+)
+
+// Holding a job and finishing one of its dependencies take the
+// dialect's lock on each dependency for the transaction, in order so
+// they can't deadlock, so a job can't be held just as a dependency
+// finishes and wait forever.
+func lockDependencies(tx *txn, jids []string) error {
+	sorted := append([]string{}, jids...)
+	sort.Strings(sorted)
+	for _, jid := range sorted {
+		err := tx.lock("faktory_depends:" + jid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *store) HoldJob(jid string, data []byte, deps []string, ttl time.Duration) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	err = lockDependencies(tx, deps)
+	if err != nil {
+		return 0, err
+	}
+
+	var held bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM faktory_held WHERE jid = $1 AND expires_at > {now})`, jid).Scan(&held)
+	if err != nil {
+		return 0, err
+	}
+	if held {
+		return 0, fmt.Errorf("Job %s is already waiting for its dependencies", jid)
+	}
+
+	waiting := []string{}
+	for _, dep := range deps {
+		var state string
+		err = tx.QueryRow(`SELECT state FROM faktory_dependencies WHERE jid = $1 AND expires_at > {now}`, dep).Scan(&state)
+		if err == sql.ErrNoRows {
+			waiting = append(waiting, dep)
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if state == storage.DependencyDied {
+			return -1, nil
+		}
+	}
+	if len(waiting) == 0 {
+		return 0, nil
+	}
+
+	for _, dep := range waiting {
+		_, err = tx.Exec(`INSERT INTO faktory_dependents (dependency, jid, expires_at) VALUES ($1, $2, {after $3})
+  ON CONFLICT (dependency, jid) DO UPDATE SET expires_at = EXCLUDED.expires_at`, dep, jid, millis(ttl))
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO faktory_held (jid, data, pending, expires_at) VALUES ($1, $2, $3, {after $4})
+  ON CONFLICT (jid) DO UPDATE SET data = EXCLUDED.data, pending = EXCLUDED.pending, expires_at = EXCLUDED.expires_at`,
+		jid, data, len(waiting), millis(ttl))
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(waiting)), tx.Commit()
+}
+
+func (s *store) DependencyDone(jid string, state string, ttl time.Duration) ([][]byte, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	err = lockDependencies(tx, []string{jid})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`INSERT INTO faktory_dependencies (jid, state, expires_at) VALUES ($1, $2, {after $3})
+  ON CONFLICT (jid) DO UPDATE SET state = EXCLUDED.state, expires_at = EXCLUDED.expires_at`, jid, state, millis(ttl))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`SELECT jid FROM faktory_dependents WHERE dependency = $1 AND expires_at > {now}`, jid)
+	if err != nil {
+		return nil, err
+	}
+	dependents := []string{}
+	for rows.Next() {
+		var dependent string
+		err = rows.Scan(&dependent)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		dependents = append(dependents, dependent)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`DELETE FROM faktory_dependents WHERE dependency = $1`, jid)
+	if err != nil {
+		return nil, err
+	}
+
+	// a died dependency releases every job waiting on it, otherwise
+	// those with nothing left to wait for
+	released := [][]byte{}
+	for _, dependent := range dependents {
+		var pending int64
+		var data []byte
+		err = tx.QueryRow(`UPDATE faktory_held SET pending = pending - 1 WHERE jid = $1 AND expires_at > {now}
+  RETURNING pending, data`, dependent).Scan(&pending, &data)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if pending > 0 && state != storage.DependencyDied {
+			continue
+		}
+		_, err = tx.Exec(`DELETE FROM faktory_held WHERE jid = $1`, dependent)
+		if err != nil {
+			return nil, err
+		}
+		released = append(released, data)
+	}
+	return released, tx.Commit()
+}
+
+func (s *store) HeldJob(jid string) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow(`SELECT data FROM faktory_held WHERE jid = $1 AND expires_at > {now}`, jid).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *store) RemoveExpiredHolds() ([][]byte, error) {
+	rows, err := s.db.Query(`DELETE FROM faktory_held WHERE expires_at <= {now} RETURNING data`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	expired := [][]byte{}
+	for rows.Next() {
+		var data []byte
+		err = rows.Scan(&data)
+		if err != nil {
+			return nil, err
+		}
+		expired = append(expired, data)
+	}
+	return expired, rows.Err()
+}
@@ -0,0 +1,142 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A Dialect is what differs between the databases the store runs on.
+// Queries are written for Postgres, with numbered $1 placeholders, and
+// these tokens which the dialect fills in:
+//
+//	{now}          the database's time, comparable with expires_at
+//	{after $N}     the time $N milliseconds after {now}, NULL if $N is
+//	{for update}   locks the rows a SELECT returns
+//	{skip locked}  as {for update} but skips rows another transaction
+//	               has locked
+//	{no limit}     a LIMIT which returns every row, for an OFFSET
+type Dialect struct {
+	// For errors, e.g. "Postgres".
+	Name string
+	// Creates any missing faktory_* tables.
+	Schema string
+	// Selects the database's version for Stats.
+	Version string
+	// The prefix of numbered placeholders, e.g. "$" or "?".
+	Placeholder string
+	// SQL for {now}.
+	Now string
+	// SQL for {after $N}, with %s standing for the placeholder.
+	After string
+	// SQL for {for update} and {skip locked}, empty when every
+	// transaction holds a lock on the whole database.
+	ForUpdate  string
+	SkipLocked string
+	// SQL for {no limit}.
+	NoLimit string
+	// Lock takes a lock on key which is held until tx ends, so
+	// transactions touching the same queue or job take turns.  nil
+	// when every transaction holds a lock on the whole database.
+	Lock func(tx *sql.Tx, key string) error
+}
+
+var (
+	afterToken  = regexp.MustCompile(`\{after (\$\d+)\}`)
+	placeholder = regexp.MustCompile(`\$(\d+)`)
+)
+
+// The query with its tokens and placeholders in this dialect's SQL.
+func (d *Dialect) render(query string) string {
+	out := afterToken.ReplaceAllStringFunc(query, func(token string) string {
+		return fmt.Sprintf(d.After, afterToken.FindStringSubmatch(token)[1])
+	})
+	out = strings.NewReplacer(
+		"{now}", d.Now,
+		"{for update}", d.ForUpdate,
+		"{skip locked}", d.SkipLocked,
+		"{no limit}", d.NoLimit,
+	).Replace(out)
+	if d.Placeholder != "$" {
+		out = placeholder.ReplaceAllString(out, d.Placeholder+"$1")
+	}
+	return out
+}
+
+// "$from, $from+1, ..." for count values.
+func placeholders(from int, count int) string {
+	params := make([]string, count)
+	for idx := range params {
+		params[idx] = fmt.Sprintf("$%d", from+idx)
+	}
+	return strings.Join(params, ", ")
+}
+
+// A database which takes queries in the store's form, see Dialect.
+type conn struct {
+	db      *sql.DB
+	dialect *Dialect
+}
+
+func (c *conn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.db.Exec(c.dialect.render(query), args...)
+}
+
+func (c *conn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.db.Query(c.dialect.render(query), args...)
+}
+
+func (c *conn) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.db.QueryRow(c.dialect.render(query), args...)
+}
+
+func (c *conn) Begin() (*txn, error) {
+	t, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &txn{t, c.dialect}, nil
+}
+
+func (c *conn) Close() error {
+	return c.db.Close()
+}
+
+// A transaction on a conn.
+type txn struct {
+	tx      *sql.Tx
+	dialect *Dialect
+}
+
+func (t *txn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return t.tx.Exec(t.dialect.render(query), args...)
+}
+
+func (t *txn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return t.tx.Query(t.dialect.render(query), args...)
+}
+
+func (t *txn) QueryRow(query string, args ...interface{}) *sql.Row {
+	return t.tx.QueryRow(t.dialect.render(query), args...)
+}
+
+// Take the dialect's lock on key for the rest of the transaction.
+func (t *txn) lock(key string) error {
+	if t.dialect.Lock == nil {
+		return nil
+	}
+	return t.dialect.Lock(t.tx, key)
+}
+
+func (t *txn) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *txn) Rollback() error {
+	return t.tx.Rollback()
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
@@ -0,0 +1,500 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/util"
+)
+
+type queue struct {
+	name  string
+	store *store
+	done  bool
+
+	mu       sync.RWMutex
+	ordering string
+	cmp      storage.Comparator
+	paused   bool
+}
+
+// The columns a job's data is searched by.
+type listedJob struct {
+	Jid      string `json:"jid"`
+	Type     string `json:"jobtype"`
+	Priority uint8  `json:"priority"`
+}
+
+func parseJob(data []byte) listedJob {
+	var job listedJob
+	json.Unmarshal(data, &job)
+	return job
+}
+
+// As in the Redis store, priorities outside 1-9 are the default.
+func normalPriority(priority uint8) uint8 {
+	if priority < 1 || priority > 9 {
+		return 5
+	}
+	return priority
+}
+
+func (s *store) newQueue(name string) *queue {
+	return &queue{
+		name:     name,
+		store:    s,
+		ordering: storage.FIFO,
+	}
+}
+
+func (q *queue) init() error {
+	err := q.store.db.QueryRow(`SELECT paused FROM faktory_queues WHERE name = $1`, q.name).Scan(&q.paused)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	util.Debugf("Queue init: %s %d elements", q.name, q.Size())
+	return nil
+}
+
+func (q *queue) Close() {
+	q.done = true
+}
+
+func (q *queue) Name() string {
+	return q.name
+}
+
+func (q *queue) Size() uint64 {
+	var size uint64
+	q.store.db.QueryRow(`SELECT count(*) FROM faktory_jobs WHERE queue = $1`, q.name).Scan(&size)
+	return size
+}
+
+func (q *queue) Add(job *client.Job) error {
+	job.EnqueuedAt = util.Nows()
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	return q.Push(job.Priority, data)
+}
+
+func (q *queue) Push(priority uint8, data []byte) error {
+	return push(q.store.db, q.name, priority, data)
+}
+
+func push(db execer, queue string, priority uint8, data []byte) error {
+	job := parseJob(data)
+	_, err := db.Exec(`INSERT INTO faktory_jobs (queue, priority, jid, jobtype, data) VALUES ($1, $2, $3, $4, $5)`,
+		queue, normalPriority(priority), job.Jid, job.Type, data)
+	return err
+}
+
+func (q *queue) comparator() (string, storage.Comparator) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.ordering, q.cmp
+}
+
+func (q *queue) Ordering() string {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.ordering
+}
+
+func (q *queue) SetOrdering(name string) error {
+	cmp, ok := storage.LookupComparator(name)
+	if !ok {
+		return fmt.Errorf("Unknown ordering: %s", name)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.ordering = name
+	q.cmp = cmp
+	return nil
+}
+
+// The order FIFO and LIFO pop jobs of the same priority in, nil for
+// other orderings.
+func (q *queue) order() (string, storage.Comparator) {
+	ordering, cmp := q.comparator()
+	switch ordering {
+	case storage.FIFO:
+		return "id", nil
+	case storage.LIFO:
+		return "id DESC", nil
+	}
+	return "", cmp
+}
+
+// non-blocking, returns immediately if there's nothing enqueued
+func (q *queue) Pop() ([]byte, error) {
+	if q.done {
+		return nil, nil
+	}
+
+	order, cmp := q.order()
+	if cmp != nil {
+		return q.sortedPop(cmp)
+	}
+	// SKIP LOCKED so servers popping at once each get a different job
+	// rather than waiting on each other
+	var data []byte
+	err := q.store.db.QueryRow(`DELETE FROM faktory_jobs WHERE id = (
+  SELECT id FROM faktory_jobs WHERE queue = $1
+  ORDER BY priority DESC, `+order+` LIMIT 1 {skip locked}
+) RETURNING data`, q.name).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return data, err
+}
+
+// The database can't block until a job arrives so poll for one with
+// the same timeout as the Redis store's blocking pop.
+func (q *queue) BPop(ctx context.Context) ([]byte, error) {
+	timeout := time.After(2 * time.Second)
+	for {
+		data, err := q.Pop()
+		if err != nil || data != nil {
+			return data, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-timeout:
+			return nil, nil
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// The priorities with jobs, highest first.
+func (q *queue) priorities() ([]uint8, error) {
+	rows, err := q.store.db.Query(`SELECT DISTINCT priority FROM faktory_jobs WHERE queue = $1 ORDER BY priority DESC`, q.name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var priorities []uint8
+	for rows.Next() {
+		var priority uint8
+		err = rows.Scan(&priority)
+		if err != nil {
+			return nil, err
+		}
+		priorities = append(priorities, priority)
+	}
+	return priorities, rows.Err()
+}
+
+type candidate struct {
+	id    int64
+	entry storage.JobEntry
+}
+
+// The ComparatorWindow oldest jobs of this priority, sorted by cmp.
+func (q *queue) candidates(priority uint8, cmp storage.Comparator) ([]candidate, error) {
+	rows, err := q.store.db.Query(`SELECT id, data FROM faktory_jobs WHERE queue = $1 AND priority = $2
+  ORDER BY id LIMIT $3`, q.name, priority, storage.ComparatorWindow)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []candidate
+	for rows.Next() {
+		var id int64
+		var data []byte
+		err = rows.Scan(&id, &data)
+		if err != nil {
+			return nil, err
+		}
+		var job client.Job
+		err = json.Unmarshal(data, &job)
+		if err != nil {
+			util.Warnf("Unable to parse job in queue %s: %v", q.name, err)
+		}
+		list = append(list, candidate{id, storage.JobEntry{Index: len(list), Data: data, Job: &job}})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return cmp(list[i].entry, list[j].entry) < 0
+	})
+	return list, nil
+}
+
+// Pop the first of the ComparatorWindow oldest jobs according to
+// cmp, from the highest priority with any jobs.
+func (q *queue) sortedPop(cmp storage.Comparator) ([]byte, error) {
+	priorities, err := q.priorities()
+	if err != nil {
+		return nil, err
+	}
+	for _, priority := range priorities {
+		for {
+			list, err := q.candidates(priority, cmp)
+			if err != nil {
+				return nil, err
+			}
+			if len(list) == 0 {
+				break
+			}
+
+			var data []byte
+			err = q.store.db.QueryRow(`DELETE FROM faktory_jobs WHERE id = $1 RETURNING data`, list[0].id).Scan(&data)
+			if err == nil {
+				return data, nil
+			}
+			if err != sql.ErrNoRows {
+				return nil, err
+			}
+			// another server popped this job first, try again
+		}
+	}
+	return nil, nil
+}
+
+func (q *queue) Peek(count int) ([][]byte, error) {
+	if count < 1 {
+		return nil, nil
+	}
+
+	order, cmp := q.order()
+	if cmp == nil {
+		return q.query(`SELECT data FROM faktory_jobs WHERE queue = $1
+  ORDER BY priority DESC, `+order+` LIMIT $2`, q.name, count)
+	}
+
+	priorities, err := q.priorities()
+	if err != nil {
+		return nil, err
+	}
+	results := make([][]byte, 0, count)
+	for _, priority := range priorities {
+		list, err := q.candidates(priority, cmp)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range list {
+			if len(results) == count {
+				return results, nil
+			}
+			results = append(results, c.entry.Data)
+		}
+	}
+	return results, nil
+}
+
+// The data column of each row.
+func (q *queue) query(query string, args ...interface{}) ([][]byte, error) {
+	rows, err := q.store.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := [][]byte{}
+	for rows.Next() {
+		var data []byte
+		err = rows.Scan(&data)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, data)
+	}
+	return results, rows.Err()
+}
+
+func (q *queue) Oldest() ([]byte, error) {
+	var data []byte
+	err := q.store.db.QueryRow(`SELECT data FROM faktory_jobs WHERE queue = $1 ORDER BY id LIMIT 1`, q.name).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (q *queue) Pause() error {
+	return q.setPaused(true)
+}
+
+func (q *queue) Resume() error {
+	return q.setPaused(false)
+}
+
+func (q *queue) setPaused(paused bool) error {
+	_, err := q.store.db.Exec(`INSERT INTO faktory_queues (name, paused) VALUES ($1, $2)
+  ON CONFLICT (name) DO UPDATE SET paused = EXCLUDED.paused`, q.name, paused)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	q.paused = paused
+	q.mu.Unlock()
+	return nil
+}
+
+func (q *queue) IsPaused() bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.paused
+}
+
+func (q *queue) Clear() (uint64, error) {
+	result, err := q.store.db.Exec(`DELETE FROM faktory_jobs WHERE queue = $1`, q.name)
+	if err != nil {
+		return 0, err
+	}
+	count, _ := result.RowsAffected()
+	return uint64(count), nil
+}
+
+func (q *queue) Each(fn func(index int, data []byte) error) error {
+	return q.Page(0, -1, fn)
+}
+
+// Pages through the queue in the order of the Redis store's lists,
+// the lowest priority jobs first and the newest first within each,
+// so the last job is the next FIFO would fetch.  As there, start and
+// start+count are inclusive and negative values count back from the
+// end.
+func (q *queue) Page(start int64, count int64, fn func(index int, data []byte) error) error {
+	total := int64(q.Size())
+	end := start + count
+	if start < 0 {
+		start += total
+	}
+	if end < 0 {
+		end += total
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= total {
+		end = total - 1
+	}
+	if end < start {
+		return nil
+	}
+
+	jobs, err := q.query(`SELECT data FROM faktory_jobs WHERE queue = $1
+  ORDER BY priority, id DESC LIMIT $3 OFFSET $2`, q.name, start, end-start+1)
+	if err != nil {
+		return err
+	}
+	for idx, data := range jobs {
+		err = fn(idx, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *queue) Delete(vals [][]byte) error {
+	for _, val := range vals {
+		job := parseJob(val)
+		_, err := q.store.db.Exec(`DELETE FROM faktory_jobs WHERE id = (
+  SELECT id FROM faktory_jobs WHERE queue = $1 AND jid = $2 AND data = $3 LIMIT 1
+)`, q.name, job.Jid, val)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *queue) FindJid(jid string) ([]byte, error) {
+	var data []byte
+	err := q.store.db.QueryRow(`SELECT data FROM faktory_jobs WHERE queue = $1 AND jid = $2 ORDER BY id LIMIT 1`, q.name, jid).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (q *queue) RemoveJid(jid string) ([]byte, error) {
+	var data []byte
+	err := q.store.db.QueryRow(`DELETE FROM faktory_jobs WHERE id = (
+  SELECT id FROM faktory_jobs WHERE queue = $1 AND jid = $2 ORDER BY id LIMIT 1 {skip locked}
+) RETURNING data`, q.name, jid).Scan(&data)
+	if err == sql.ErrNoRows {
+		// fetched since we found it, or never there
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *store) PushBulk(entries []storage.BulkEntry) error {
+	// ensure every queue name is valid and registered before
+	// we insert anything
+	for _, entry := range entries {
+		_, err := s.GetQueue(entry.Queue)
+		if err != nil {
+			return err
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, entry := range entries {
+		err = push(tx, entry.Queue, entry.Priority, entry.Data)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Conditional pushes to a queue take turns, with the dialect's lock on
+// the queue for the transaction, so two can't both see the condition
+// hold.  Plain pushes don't take the lock.
+func (s *store) PushIf(cond storage.PushCondition, entry storage.BulkEntry) (bool, error) {
+	_, err := s.GetQueue(entry.Queue)
+	if err != nil {
+		return false, err
+	}
+	if cond.EmptyQueue != "" {
+		_, err := s.GetQueue(cond.EmptyQueue)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	err = tx.lock("faktory_queue:" + entry.Queue)
+	if err != nil {
+		return false, err
+	}
+
+	var skip bool
+	if cond.EmptyQueue != "" {
+		err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM faktory_jobs WHERE queue = $1)`, cond.EmptyQueue).Scan(&skip)
+		if err != nil || skip {
+			return false, err
+		}
+	}
+
+	err = push(tx, entry.Queue, entry.Priority, entry.Data)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
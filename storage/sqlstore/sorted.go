@@ -0,0 +1,302 @@
+package sqlstore
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/util"
+)
+
+// One of the named sets in faktory_sorted.  Like a Redis sorted set
+// each payload is only in a set once, by its digest, and scored by
+// its timestamp in seconds.
+type sorted struct {
+	name  string
+	store *store
+}
+
+func score(tim time.Time) float64 {
+	return float64(tim.Unix()) + (float64(tim.Nanosecond()) / 1000000000)
+}
+
+func parseScore(timestamp string) (float64, error) {
+	tim, err := util.ParseTime(timestamp)
+	if err != nil {
+		return 0, err
+	}
+	return score(tim), nil
+}
+
+// key is "timestamp|jid"
+func decompose(key []byte) (float64, string, error) {
+	slice := strings.Split(string(key), "|")
+	if len(slice) != 2 {
+		return 0, "", fmt.Errorf("Invalid key, expected \"timestamp|jid\", not %s", string(key))
+	}
+	value, err := parseScore(slice[0])
+	if err != nil {
+		return 0, "", err
+	}
+	return value, slice[1], nil
+}
+
+func digest(payload []byte) []byte {
+	sum := sha256.Sum256(payload)
+	return sum[:]
+}
+
+func (ss *sorted) Name() string {
+	return ss.name
+}
+
+func (ss *sorted) Size() uint64 {
+	var size uint64
+	ss.store.db.QueryRow(`SELECT count(*) FROM faktory_sorted WHERE name = $1`, ss.name).Scan(&size)
+	return size
+}
+
+func (ss *sorted) Clear() error {
+	_, err := ss.store.db.Exec(`DELETE FROM faktory_sorted WHERE name = $1`, ss.name)
+	return err
+}
+
+func (ss *sorted) Add(job *client.Job) error {
+	if job.At == "" {
+		return errors.New("Job does not have an At timestamp")
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	return ss.AddElement(job.At, job.Jid, data)
+}
+
+func (ss *sorted) AddElement(timestamp string, jid string, payload []byte) error {
+	value, err := parseScore(timestamp)
+	if err != nil {
+		return err
+	}
+	return ss.add(ss.store.db, value, jid, payload)
+}
+
+func (ss *sorted) add(db execer, value float64, jid string, payload []byte) error {
+	_, err := db.Exec(`INSERT INTO faktory_sorted (name, score, jid, digest, data) VALUES ($1, $2, $3, $4, $5)
+  ON CONFLICT (name, digest) DO UPDATE SET score = EXCLUDED.score`, ss.name, value, jid, digest(payload), payload)
+	return err
+}
+
+func (ss *sorted) Get(key []byte) (storage.SortedEntry, error) {
+	value, jid, err := decompose(key)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	err = ss.store.db.QueryRow(`SELECT data FROM faktory_sorted WHERE name = $1 AND score = $2 AND jid = $3 LIMIT 1`,
+		ss.name, value, jid).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewEntry(value, data), nil
+}
+
+// As with ZRANGE, start and start+count are inclusive.
+func (ss *sorted) Page(start int, count int, fn func(index int, e storage.SortedEntry) error) (int, error) {
+	rows, err := ss.store.db.Query(`SELECT score, data FROM faktory_sorted WHERE name = $1
+  ORDER BY score, id LIMIT $3 OFFSET $2`, ss.name, start, count+1)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	entries := []storage.SortedEntry{}
+	for rows.Next() {
+		var value float64
+		var data []byte
+		err = rows.Scan(&value, &data)
+		if err != nil {
+			return 0, err
+		}
+		entries = append(entries, storage.NewEntry(value, data))
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	for idx, entry := range entries {
+		err = fn(idx, entry)
+		if err != nil {
+			return idx, err
+		}
+	}
+	return len(entries), nil
+}
+
+func (ss *sorted) Each(fn func(idx int, e storage.SortedEntry) error) error {
+	count := 50
+	current := 0
+	for {
+		elms, err := ss.Page(current, count-1, func(idx int, e storage.SortedEntry) error {
+			return fn(current+idx, e)
+		})
+		if err != nil {
+			return err
+		}
+		if elms < count {
+			// last page, done iterating
+			return nil
+		}
+		current += count
+	}
+}
+
+func (ss *sorted) rem(value float64, jid string) (bool, error) {
+	result, err := ss.store.db.Exec(`DELETE FROM faktory_sorted WHERE id = (
+  SELECT id FROM faktory_sorted WHERE name = $1 AND score = $2 AND jid = $3 LIMIT 1
+)`, ss.name, value, jid)
+	if err != nil {
+		return false, err
+	}
+	count, _ := result.RowsAffected()
+	return count == 1, nil
+}
+
+func (ss *sorted) Remove(key []byte) (bool, error) {
+	value, jid, err := decompose(key)
+	if err != nil {
+		return false, err
+	}
+	return ss.rem(value, jid)
+}
+
+func (ss *sorted) RemoveElement(timestamp string, jid string) (bool, error) {
+	value, err := parseScore(timestamp)
+	if err != nil {
+		return false, err
+	}
+	return ss.rem(value, jid)
+}
+
+func (ss *sorted) RemoveBefore(timestamp string) ([][]byte, error) {
+	value, err := parseScore(timestamp)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := ss.store.db.Query(`DELETE FROM faktory_sorted WHERE name = $1 AND score <= $2
+  RETURNING id, score, data`, ss.name, value)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type removed struct {
+		id    int64
+		score float64
+		data  []byte
+	}
+	list := []removed{}
+	for rows.Next() {
+		var r removed
+		err = rows.Scan(&r.id, &r.score, &r.data)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// RETURNING has no order
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].score != list[j].score {
+			return list[i].score < list[j].score
+		}
+		return list[i].id < list[j].id
+	})
+	results := make([][]byte, len(list))
+	for idx, r := range list {
+		results[idx] = r.data
+	}
+	return results, nil
+}
+
+func (ss *sorted) Trim(max uint64) (int64, error) {
+	result, err := ss.store.db.Exec(`DELETE FROM faktory_sorted WHERE id IN (
+  SELECT id FROM faktory_sorted WHERE name = $1 ORDER BY score DESC, id DESC LIMIT {no limit} OFFSET $2
+)`, ss.name, int64(max))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (ss *sorted) FindJid(jid string) ([]byte, error) {
+	var data []byte
+	err := ss.store.db.QueryRow(`SELECT data FROM faktory_sorted WHERE name = $1 AND jid = $2 LIMIT 1`, ss.name, jid).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (ss *sorted) RemoveJid(jid string) ([]byte, error) {
+	var data []byte
+	err := ss.store.db.QueryRow(`DELETE FROM faktory_sorted WHERE id = (
+  SELECT id FROM faktory_sorted WHERE name = $1 AND jid = $2 LIMIT 1
+) RETURNING data`, ss.name, jid).Scan(&data)
+	if err == sql.ErrNoRows {
+		// moved since we found it, or never there
+		return nil, nil
+	}
+	return data, err
+}
+
+// Within a store the move is a transaction, to another store's set
+// the entry is removed from here and then added there.
+func (ss *sorted) MoveTo(sset storage.SortedSet, entry storage.SortedEntry, newtime time.Time) error {
+	job, err := entry.Job()
+	if err != nil {
+		return err
+	}
+
+	tx, err := ss.store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(`DELETE FROM faktory_sorted WHERE name = $1 AND digest = $2`, ss.name, digest(entry.Value()))
+	if err != nil {
+		return err
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		// race condition, element was removed or moved elsewhere
+		return nil
+	}
+
+	other, ok := sset.(*sorted)
+	if !ok || other.store != ss.store {
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		return sset.AddElement(util.Thens(newtime), job.Jid, entry.Value())
+	}
+	err = other.add(tx, score(newtime), job.Jid, entry.Value())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,610 @@
+// Package sqlstore is the storage.Store the SQL storage drivers share,
+// kept in a database/sql database rather than Redis.  Each driver
+// opens its database and passes it to Open with its Dialect, what
+// differs between the databases: placeholders, times, locking and the
+// column types of the schema.
+//
+// Queues are a table of jobs and sorted sets a table indexed by set
+// and timestamp.  Expiring data such as unique locks and batches is
+// filtered out when read and deleted every minute.
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/util"
+)
+
+type store struct {
+	Name     string
+	db       *conn
+	mu       sync.Mutex
+	queueSet map[string]*queue
+
+	scheduled *sorted
+	retries   *sorted
+	dead      *sorted
+	working   *sorted
+
+	stop chan struct{}
+}
+
+// How often expired rows are deleted.
+var reapInterval = time.Minute
+
+// Open creates any missing tables in db and returns the store kept
+// there, called name in its Stats and errors.  db is closed if it
+// can't be opened.
+func Open(db *sql.DB, name string, dialect *Dialect) (storage.Store, error) {
+	s := &store{
+		Name:     name,
+		db:       &conn{db, dialect},
+		queueSet: map[string]*queue{},
+		stop:     make(chan struct{}),
+	}
+	s.scheduled = &sorted{name: "scheduled", store: s}
+	s.retries = &sorted{name: "retries", store: s}
+	s.dead = &sorted{name: "dead", store: s}
+	s.working = &sorted{name: "working", store: s}
+
+	err := s.migrate()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Unable to open %s database %s: %v", dialect.Name, name, err)
+	}
+
+	// queues outlive the process, unlike the Redis store's set
+	names, err := s.queueNames()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, name := range names {
+		q := s.newQueue(name)
+		err = q.init()
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		s.queueSet[name] = q
+	}
+
+	go s.reap()
+	return s, nil
+}
+
+// The rows are read and closed before anything else uses the
+// database, which may have only one connection.
+func (s *store) queueNames() ([]string, error) {
+	rows, err := s.db.Query(`SELECT name FROM faktory_queues`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := []string{}
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// Servers opening the store at once would race to create the tables
+// so they take turns.
+func (s *store) migrate() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = tx.lock("faktory_schema")
+	if err != nil {
+		return err
+	}
+	_, err = tx.tx.Exec(s.db.dialect.Schema)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// The tables with an expires_at column.  Expired held jobs are left
+// for RemoveExpiredHolds, for storage.HeldJobGrace.
+var expiring = []string{"faktory_kv", "faktory_batches", "faktory_dependencies", "faktory_dependents"}
+
+func (s *store) reap() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		for _, table := range expiring {
+			_, err := s.db.Exec(`DELETE FROM ` + table + ` WHERE expires_at <= {now}`)
+			if err != nil {
+				util.Warnf("Unable to delete expired rows from %s: %v", table, err)
+			}
+		}
+		_, err := s.db.Exec(`DELETE FROM faktory_held WHERE expires_at <= {after $1}`, -millis(storage.HeldJobGrace))
+		if err != nil {
+			util.Warnf("Unable to delete expired rows from faktory_held: %v", err)
+		}
+	}
+}
+
+// Expiries are given to the database as a number of milliseconds from
+// its {now}, so servers needn't agree on the time.
+func millis(ttl time.Duration) int64 {
+	return int64(ttl / time.Millisecond)
+}
+
+// As millis but NULL, never expiring, if ttl is 0.
+func maybeMillis(ttl time.Duration) interface{} {
+	if ttl <= 0 {
+		return nil
+	}
+	return millis(ttl)
+}
+
+func (s *store) Close() error {
+	util.Debug("Stopping storage")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.stop)
+	return s.db.Close()
+}
+
+func (s *store) Stats() map[string]string {
+	var version string
+	err := s.db.QueryRow(s.db.dialect.Version).Scan(&version)
+	if err != nil {
+		version = err.Error()
+	}
+	return map[string]string{
+		"stats": version,
+		"name":  s.Name,
+	}
+}
+
+func (s *store) Retries() storage.SortedSet {
+	return s.retries
+}
+
+func (s *store) Scheduled() storage.SortedSet {
+	return s.scheduled
+}
+
+func (s *store) Working() storage.SortedSet {
+	return s.working
+}
+
+func (s *store) Dead() storage.SortedSet {
+	return s.dead
+}
+
+// Empties the faktory_* tables, leaving any others in the database
+// alone.
+func (s *store) Flush() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"faktory_queues", "faktory_jobs", "faktory_sorted", "faktory_kv", "faktory_counters",
+		"faktory_batch_failures", "faktory_batches", "faktory_dependencies", "faktory_held", "faktory_dependents"} {
+		_, err = tx.Exec(`DELETE FROM ` + table)
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.queueSet = map[string]*queue{}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *store) Raw() storage.KV {
+	return &kv{s}
+}
+
+// Raw keys are kept apart from the unique locks, progress and
+// results which share the table.
+type kv struct {
+	store *store
+}
+
+func (k *kv) Get(key string) ([]byte, error) {
+	return k.store.get("raw:" + key)
+}
+
+func (k *kv) Set(key string, value []byte) error {
+	if value == nil {
+		return storage.ErrNilValue
+	}
+	return k.store.set("raw:"+key, value, 0)
+}
+
+func (k *kv) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	if value == nil {
+		return false, storage.ErrNilValue
+	}
+	return k.store.setnx("raw:"+key, value, maybeMillis(ttl))
+}
+
+// Set key to value, expiring after ttl milliseconds, unless it has an
+// unexpired value.
+func (s *store) setnx(key string, value []byte, ttl interface{}) (bool, error) {
+	var taken []byte
+	err := s.db.QueryRow(`INSERT INTO faktory_kv (key, value, expires_at) VALUES ($1, $2, {after $3})
+  ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, expires_at = EXCLUDED.expires_at
+  WHERE faktory_kv.expires_at <= {now}
+  RETURNING value`, key, value, ttl).Scan(&taken)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// The value at key, nil if it's missing or expired.
+func (s *store) get(key string) ([]byte, error) {
+	var value []byte
+	err := s.db.QueryRow(`SELECT value FROM faktory_kv
+  WHERE key = $1 AND (expires_at IS NULL OR expires_at > {now})`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return value, err
+}
+
+// Set key to value, expiring it after ttl unless that's 0.
+func (s *store) set(key string, value []byte, ttl time.Duration) error {
+	_, err := s.db.Exec(`INSERT INTO faktory_kv (key, value, expires_at) VALUES ($1, $2, {after $3})
+  ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, expires_at = EXCLUDED.expires_at`, key, value, maybeMillis(ttl))
+	return err
+}
+
+func (s *store) LockUnique(digest string, jid string, ttl time.Duration) (string, error) {
+	key := "unique:" + digest
+	for {
+		ok, err := s.setnx(key, []byte(jid), millis(ttl))
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return "", nil
+		}
+		holder, err := s.get(key)
+		if err != nil {
+			return "", err
+		}
+		if holder != nil {
+			return string(holder), nil
+		}
+		// the lock expired since the insert, take it
+	}
+}
+
+func (s *store) UnlockUnique(digest string, jid string) error {
+	_, err := s.db.Exec(`DELETE FROM faktory_kv WHERE key = $1 AND value = $2`, "unique:"+digest, []byte(jid))
+	return err
+}
+
+func (s *store) SetProgress(jid string, data []byte, ttl time.Duration) error {
+	return s.set("progress:"+jid, data, ttl)
+}
+
+// The values of the unexpired keys of those given.
+func (s *store) getAll(keys []string) (map[string][]byte, error) {
+	args := make([]interface{}, len(keys))
+	for idx, key := range keys {
+		args[idx] = key
+	}
+	rows, err := s.db.Query(`SELECT key, value FROM faktory_kv
+  WHERE (expires_at IS NULL OR expires_at > {now}) AND key IN (`+placeholders(1, len(keys))+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := map[string][]byte{}
+	for rows.Next() {
+		var key string
+		var value []byte
+		err = rows.Scan(&key, &value)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, rows.Err()
+}
+
+func (s *store) GetProgress(jids ...string) ([][]byte, error) {
+	if len(jids) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(jids))
+	for idx, jid := range jids {
+		keys[idx] = "progress:" + jid
+	}
+	values, err := s.getAll(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([][]byte, len(jids))
+	for idx, key := range keys {
+		results[idx] = values[key]
+	}
+	return results, nil
+}
+
+func (s *store) SetResult(jid string, data []byte, ttl time.Duration) error {
+	return s.set("result:"+jid, data, ttl)
+}
+
+func (s *store) GetResult(jid string) ([]byte, error) {
+	return s.get("result:" + jid)
+}
+
+func (s *store) incr(names ...string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, name := range names {
+		_, err := tx.Exec(`INSERT INTO faktory_counters (name, value) VALUES ($1, 1)
+  ON CONFLICT (name) DO UPDATE SET value = faktory_counters.value + 1`, name)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Overwrite the counters, a name then its value.
+func (s *store) setCounters(pairs ...interface{}) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for idx := 0; idx < len(pairs); idx += 2 {
+		_, err = tx.Exec(`INSERT INTO faktory_counters (name, value) VALUES ($1, $2)
+  ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value`, pairs[idx], pairs[idx+1])
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *store) counter(name string) uint64 {
+	var value int64
+	s.db.QueryRow(`SELECT value FROM faktory_counters WHERE name = $1`, name).Scan(&value)
+	return uint64(value)
+}
+
+func (s *store) Success() error {
+	daystr := time.Now().Format("2006-01-02")
+	return s.incr("processed:"+daystr, "processed")
+}
+
+func (s *store) Failure() error {
+	daystr := time.Now().Format("2006-01-02")
+	return s.incr("processed", "failures", "processed:"+daystr, "failures:"+daystr)
+}
+
+func (s *store) TotalProcessed() uint64 {
+	return s.counter("processed")
+}
+
+func (s *store) TotalFailures() uint64 {
+	return s.counter("failures")
+}
+
+func (s *store) SetTotals(processed uint64, failures uint64) error {
+	return s.setCounters("processed", int64(processed), "failures", int64(failures))
+}
+
+func (s *store) SetHistory(day string, procCnt uint64, failCnt uint64) error {
+	return s.setCounters("processed:"+day, int64(procCnt), "failures:"+day, int64(failCnt))
+}
+
+func (s *store) History(days int, fn func(day string, procCnt uint64, failCnt uint64)) error {
+	if days < 1 {
+		return nil
+	}
+	ts := time.Now()
+	daystrs := make([]string, days)
+	args := make([]interface{}, 0, days*2)
+	for idx := 0; idx < days; idx++ {
+		daystrs[idx] = ts.Format("2006-01-02")
+		args = append(args, "processed:"+daystrs[idx], "failures:"+daystrs[idx])
+		ts = ts.Add(-24 * time.Hour)
+	}
+
+	rows, err := s.db.Query(`SELECT name, value FROM faktory_counters WHERE name IN (`+placeholders(1, len(args))+`)`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	counts := map[string]uint64{}
+	for rows.Next() {
+		var name string
+		var value int64
+		err = rows.Scan(&name, &value)
+		if err != nil {
+			return err
+		}
+		counts[name] = uint64(value)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, daystr := range daystrs {
+		fn(daystr, counts["processed:"+daystr], counts["failures:"+daystr])
+	}
+	return nil
+}
+
+func (s *store) GetQueue(name string) (storage.Queue, error) {
+	if name == "" {
+		return nil, fmt.Errorf("queue name cannot be blank")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, ok := s.queueSet[name]
+	if ok {
+		return q, nil
+	}
+
+	if !storage.ValidQueueName.MatchString(name) {
+		return nil, fmt.Errorf("queue names must match %v", storage.ValidQueueName)
+	}
+
+	q = s.newQueue(name)
+	_, err := s.db.Exec(`INSERT INTO faktory_queues (name) VALUES ($1) ON CONFLICT DO NOTHING`, name)
+	if err != nil {
+		return nil, err
+	}
+	err = q.init()
+	if err != nil {
+		return nil, err
+	}
+	s.queueSet[name] = q
+	return q, nil
+}
+
+// queues are iterated in sorted, lexigraphical order
+func (s *store) EachQueue(x func(storage.Queue)) {
+	// copy the set so x can call GetQueue
+	s.mu.Lock()
+	names := make([]string, 0, len(s.queueSet))
+	for name := range s.queueSet {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	queues := make([]storage.Queue, len(names))
+	for idx, name := range names {
+		queues[idx] = s.queueSet[name]
+	}
+	s.mu.Unlock()
+
+	for _, q := range queues {
+		x(q)
+	}
+}
+
+func (s *store) RemoveQueue(name string) (uint64, error) {
+	if !storage.ValidQueueName.MatchString(name) {
+		return 0, fmt.Errorf("queue names must match %v", storage.ValidQueueName)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(`DELETE FROM faktory_jobs WHERE queue = $1`, name)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`DELETE FROM faktory_queues WHERE name = $1`, name)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	if q, ok := s.queueSet[name]; ok {
+		q.Close()
+		delete(s.queueSet, name)
+	}
+	size, _ := result.RowsAffected()
+	return uint64(size), nil
+}
+
+func (s *store) EnqueueAll(sset storage.SortedSet) error {
+	return sset.Each(func(_ int, entry storage.SortedEntry) error {
+		j, err := entry.Job()
+		if err != nil {
+			return err
+		}
+
+		k, err := entry.Key()
+		if err != nil {
+			return err
+		}
+
+		q, err := s.GetQueue(j.Queue)
+		if err != nil {
+			return err
+		}
+
+		ok, err := sset.Remove(k)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		return q.Add(j)
+	})
+}
+
+func (s *store) EnqueueFrom(sset storage.SortedSet, key []byte) error {
+	entry, err := sset.Get(key)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		// race condition, element was removed already
+		return nil
+	}
+
+	job, err := entry.Job()
+	if err != nil {
+		return err
+	}
+
+	q, err := s.GetQueue(job.Queue)
+	if err != nil {
+		return err
+	}
+
+	ok, err := sset.Remove(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+
+	return q.Add(job)
+}
@@ -0,0 +1,72 @@
+package sqlstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseJob(t *testing.T) {
+	job := parseJob([]byte(`{"jid":"abc","queue":"default","jobtype":"Invoice","args":[],"priority":9}`))
+	assert.Equal(t, "abc", job.Jid)
+	assert.Equal(t, "Invoice", job.Type)
+	assert.EqualValues(t, 9, job.Priority)
+	assert.Equal(t, listedJob{}, parseJob([]byte("junk")))
+
+	assert.EqualValues(t, 5, normalPriority(0))
+	assert.EqualValues(t, 5, normalPriority(10))
+	assert.EqualValues(t, 1, normalPriority(1))
+	assert.EqualValues(t, 9, normalPriority(9))
+}
+
+func TestDecompose(t *testing.T) {
+	tim := time.Now()
+	value, jid, err := decompose([]byte(util.Thens(tim) + "|abc"))
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", jid)
+	assert.InDelta(t, score(tim), value, 0.000001)
+
+	// keys of entries round trip to the same score
+	key, err := storage.NewEntry(value, []byte(`{"jid":"abc"}`)).Key()
+	assert.NoError(t, err)
+	again, _, err := decompose(key)
+	assert.NoError(t, err)
+	assert.Equal(t, value, again)
+
+	_, _, err = decompose([]byte("abc"))
+	assert.Error(t, err)
+	_, _, err = decompose([]byte("yesterday|abc"))
+	assert.Error(t, err)
+}
+
+func TestRender(t *testing.T) {
+	pg := &Dialect{
+		Placeholder: "$",
+		Now:         `now()`,
+		After:       `now() + %s::bigint * interval '1 millisecond'`,
+		SkipLocked:  `FOR UPDATE SKIP LOCKED`,
+		NoLimit:     `ALL`,
+	}
+	lite := &Dialect{
+		Placeholder: "?",
+		Now:         `unixepoch()`,
+		After:       `({now} + %s)`,
+		NoLimit:     `-1`,
+	}
+
+	query := `INSERT INTO faktory_kv (key, value, expires_at) VALUES ($1, $2, {after $3})
+  WHERE faktory_kv.expires_at <= {now}`
+	assert.Equal(t, `INSERT INTO faktory_kv (key, value, expires_at) VALUES ($1, $2, now() + $3::bigint * interval '1 millisecond')
+  WHERE faktory_kv.expires_at <= now()`, pg.render(query))
+	assert.Equal(t, `INSERT INTO faktory_kv (key, value, expires_at) VALUES (?1, ?2, (unixepoch() + ?3))
+  WHERE faktory_kv.expires_at <= unixepoch()`, lite.render(query))
+
+	query = `SELECT id FROM faktory_sorted WHERE name = $1 LIMIT {no limit} OFFSET $12 {skip locked}`
+	assert.Equal(t, `SELECT id FROM faktory_sorted WHERE name = $1 LIMIT ALL OFFSET $12 FOR UPDATE SKIP LOCKED`, pg.render(query))
+	assert.Equal(t, `SELECT id FROM faktory_sorted WHERE name = ?1 LIMIT -1 OFFSET ?12 `, lite.render(query))
+
+	assert.Equal(t, "$3, $4, $5", placeholders(3, 3))
+}
@@ -0,0 +1,553 @@
+// Package storagetest checks a storage.Store meets the contract the
+// server relies on, so a Driver can be tested without the server:
+//
+//	func TestMyStore(t *testing.T) {
+//		store, err := storage.Open("mydriver", dir)
+//		...
+//		storagetest.TestStore(t, store)
+//	}
+package storagetest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/storage"
+	"github.com/contribsys/faktory/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestStore runs each check against the store, flushing it first, so
+// don't point it at a store holding data you want to keep.
+func TestStore(t *testing.T, store storage.Store) {
+	for _, check := range []struct {
+		name string
+		fn   func(*testing.T, storage.Store)
+	}{
+		{"Queues", testQueues},
+		{"Priorities", testPriorities},
+		{"PopTo", testPopTo},
+		{"SortedSets", testSortedSets},
+		{"RemoveBatchBefore", testRemoveBatch},
+		{"PushBulk", testPushBulk},
+		{"UniqueLocks", testUniqueLocks},
+		{"Batches", testBatches},
+		{"Dependencies", testDependencies},
+		{"ProgressAndResults", testProgressAndResults},
+		{"History", testHistory},
+		{"Raw", testRaw},
+	} {
+		t.Run(check.name, func(t *testing.T) {
+			assert.NoError(t, store.Flush())
+			check.fn(t, store)
+		})
+	}
+}
+
+// A job's data as the server stores it.
+func job(queue string, priority uint8) (*client.Job, []byte) {
+	job := client.NewJob("Check", 1)
+	job.Queue = queue
+	job.Priority = priority
+	data, err := json.Marshal(job)
+	if err != nil {
+		panic(err)
+	}
+	return job, data
+}
+
+func testQueues(t *testing.T, store storage.Store) {
+	_, err := store.GetQueue("")
+	assert.Error(t, err)
+	_, err = store.GetQueue("no spaces")
+	assert.Error(t, err)
+
+	q, err := store.GetQueue("default")
+	assert.NoError(t, err)
+	assert.Equal(t, "default", q.Name())
+	assert.EqualValues(t, 0, q.Size())
+	data, err := q.Pop()
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+	data, err = q.Oldest()
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+
+	first, firstData := job("default", 5)
+	_, secondData := job("default", 5)
+	assert.NoError(t, q.Push(5, firstData))
+	assert.NoError(t, q.Push(5, secondData))
+	assert.EqualValues(t, 2, q.Size())
+
+	data, err = q.Oldest()
+	assert.NoError(t, err)
+	assert.Equal(t, firstData, data)
+	peeked, err := q.Peek(5)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{firstData, secondData}, peeked)
+	count := 0
+	assert.NoError(t, q.Each(func(_ int, _ []byte) error {
+		count++
+		return nil
+	}))
+	assert.Equal(t, 2, count)
+
+	data, err = q.FindJid(first.Jid)
+	assert.NoError(t, err)
+	assert.Equal(t, firstData, data)
+	data, err = q.FindJid("missing")
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+
+	assert.NoError(t, q.Pause())
+	assert.True(t, q.IsPaused())
+	assert.NoError(t, q.Resume())
+	assert.False(t, q.IsPaused())
+
+	// FIFO by default
+	data, err = q.Pop()
+	assert.NoError(t, err)
+	assert.Equal(t, firstData, data)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	data, err = q.BPop(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, secondData, data)
+
+	third, thirdData := job("default", 5)
+	assert.NoError(t, q.Add(third))
+	assert.EqualValues(t, 1, q.Size())
+	data, err = q.RemoveJid(third.Jid)
+	assert.NoError(t, err)
+	assert.NotNil(t, data)
+	assert.NoError(t, q.Push(5, thirdData))
+	assert.NoError(t, q.Delete([][]byte{thirdData}))
+	assert.EqualValues(t, 0, q.Size())
+
+	assert.NoError(t, q.Push(5, thirdData))
+	cleared, err := q.Clear()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, cleared)
+
+	other, err := store.GetQueue("other")
+	assert.NoError(t, err)
+	_, data = job("other", 5)
+	assert.NoError(t, other.Push(5, data))
+	assert.NoError(t, other.Pause())
+	names := []string{}
+	store.EachQueue(func(q storage.Queue) {
+		names = append(names, q.Name())
+	})
+	assert.Contains(t, names, "default")
+	assert.Contains(t, names, "other")
+
+	removed, err := store.RemoveQueue("other")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, removed)
+	other, err = store.GetQueue("other")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, other.Size())
+	assert.False(t, other.IsPaused())
+}
+
+func testPriorities(t *testing.T, store storage.Store) {
+	q, err := store.GetQueue("prio")
+	assert.NoError(t, err)
+	_, low := job("prio", 1)
+	_, normal := job("prio", 5)
+	_, high := job("prio", 9)
+	assert.NoError(t, q.Push(1, low))
+	assert.NoError(t, q.Push(5, normal))
+	assert.NoError(t, q.Push(9, high))
+	assert.EqualValues(t, 3, q.Size())
+
+	peeked, err := q.Peek(3)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{high, normal, low}, peeked)
+	for _, expected := range [][]byte{high, normal, low} {
+		data, err := q.Pop()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, data)
+	}
+
+	assert.Error(t, q.SetOrdering("no such ordering"))
+	assert.NoError(t, q.SetOrdering(storage.LIFO))
+	assert.Equal(t, storage.LIFO, q.Ordering())
+	_, first := job("prio", 5)
+	_, second := job("prio", 5)
+	assert.NoError(t, q.Push(5, first))
+	assert.NoError(t, q.Push(5, second))
+	data, err := q.Pop()
+	assert.NoError(t, err)
+	assert.Equal(t, second, data)
+}
+
+// Only for stores whose queues are ReservingQueues.
+func testPopTo(t *testing.T, store storage.Store) {
+	q, err := store.GetQueue("reserving")
+	assert.NoError(t, err)
+	rq, ok := q.(storage.ReservingQueue)
+	if !ok {
+		t.Skip("queues can't PopTo")
+	}
+	working := store.Working()
+	at := util.Thens(time.Now().Add(time.Minute))
+	prefix, suffix := []byte(`{"job":`), []byte(`,"wid":"w1"}`)
+
+	data, err := rq.PopTo(working, at, prefix, suffix)
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+	assert.EqualValues(t, 0, working.Size())
+
+	first, firstData := job("reserving", 5)
+	second, secondData := job("reserving", 5)
+	assert.NoError(t, q.Push(5, firstData))
+	assert.NoError(t, q.Push(5, secondData))
+	data, err = rq.PopTo(working, at, prefix, suffix)
+	assert.NoError(t, err)
+	assert.Equal(t, firstData, data)
+	assert.EqualValues(t, 1, q.Size())
+	assert.EqualValues(t, 1, working.Size())
+	assert.NoError(t, working.Each(func(_ int, entry storage.SortedEntry) error {
+		assert.Equal(t, `{"job":`+string(firstData)+`,"wid":"w1"}`, string(entry.Value()))
+		return nil
+	}))
+	removed, err := working.RemoveElement(at, first.Jid)
+	assert.NoError(t, err)
+	assert.True(t, removed)
+
+	// orderings which load candidates too
+	assert.NoError(t, q.SetOrdering(storage.Priority))
+	data, err = rq.PopTo(working, at, prefix, suffix)
+	assert.NoError(t, err)
+	assert.Equal(t, secondData, data)
+	assert.EqualValues(t, 0, q.Size())
+	removed, err = working.RemoveElement(at, second.Jid)
+	assert.NoError(t, err)
+	assert.True(t, removed)
+}
+
+func testSortedSets(t *testing.T, store storage.Store) {
+	for _, sset := range []storage.SortedSet{store.Scheduled(), store.Retries(), store.Dead(), store.Working()} {
+		assert.EqualValues(t, 0, sset.Size(), sset.Name())
+	}
+	retries, dead := store.Retries(), store.Dead()
+
+	past := time.Now().Add(-time.Minute)
+	early, earlyData := job("default", 5)
+	late, lateData := job("default", 5)
+	assert.NoError(t, retries.AddElement(util.Thens(past), early.Jid, earlyData))
+	assert.NoError(t, retries.AddElement(util.Thens(time.Now().Add(time.Hour)), late.Jid, lateData))
+	late.At = util.Thens(time.Now().Add(2 * time.Hour))
+	assert.NoError(t, retries.Add(late))
+	assert.EqualValues(t, 3, retries.Size())
+
+	entries := []storage.SortedEntry{}
+	_, err := retries.Page(0, 10, func(_ int, e storage.SortedEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(entries))
+	assert.Equal(t, earlyData, entries[0].Value())
+	parsed, err := entries[0].Job()
+	assert.NoError(t, err)
+	assert.Equal(t, early.Jid, parsed.Jid)
+
+	key, err := entries[0].Key()
+	assert.NoError(t, err)
+	entry, err := retries.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, earlyData, entry.Value())
+	entry, err = retries.Get([]byte(fmt.Sprintf("%s|%s", util.Thens(past.Add(time.Second)), "missing")))
+	assert.NoError(t, err)
+	assert.Nil(t, entry)
+
+	data, err := retries.FindJid(early.Jid)
+	assert.NoError(t, err)
+	assert.Equal(t, earlyData, data)
+	data, err = retries.FindJid("missing")
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+
+	assert.NoError(t, retries.MoveTo(dead, entries[0], time.Now()))
+	assert.EqualValues(t, 2, retries.Size())
+	assert.EqualValues(t, 1, dead.Size())
+	// a second move of the same entry is a no-op
+	assert.NoError(t, retries.MoveTo(dead, entries[0], time.Now()))
+	assert.EqualValues(t, 1, dead.Size())
+
+	removed, err := dead.RemoveBefore(util.Thens(time.Now().Add(time.Second)))
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{earlyData}, removed)
+	assert.EqualValues(t, 0, dead.Size())
+
+	trimmed, err := retries.Trim(1)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, trimmed)
+	assert.EqualValues(t, 1, retries.Size())
+
+	data, err = retries.RemoveJid(late.Jid)
+	assert.NoError(t, err)
+	assert.NotNil(t, data)
+	assert.EqualValues(t, 0, retries.Size())
+
+	ok, err := retries.Remove(key)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// EnqueueAll moves every job to its queue
+	assert.NoError(t, retries.AddElement(util.Thens(past), early.Jid, earlyData))
+	assert.NoError(t, store.EnqueueAll(retries))
+	assert.EqualValues(t, 0, retries.Size())
+	q, err := store.GetQueue("default")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, q.Size())
+
+	assert.NoError(t, retries.AddElement(util.Thens(past), late.Jid, lateData))
+	assert.NoError(t, store.EnqueueFrom(retries, []byte(fmt.Sprintf("%s|%s", util.Thens(past), late.Jid))))
+	assert.EqualValues(t, 2, q.Size())
+	assert.NoError(t, retries.Clear())
+}
+
+// Only for stores whose sets are BatchedSets.
+func testRemoveBatch(t *testing.T, store storage.Store) {
+	retries := store.Retries()
+	batched, ok := retries.(storage.BatchedSet)
+	if !ok {
+		t.Skip("sets can't RemoveBatchBefore")
+	}
+
+	now := time.Now()
+	due := [][]byte{}
+	for idx := 0; idx < 5; idx++ {
+		job, data := job("default", 5)
+		assert.NoError(t, retries.AddElement(util.Thens(now.Add(time.Duration(idx-10)*time.Second)), job.Jid, data))
+		due = append(due, data)
+	}
+	later, laterData := job("default", 5)
+	assert.NoError(t, retries.AddElement(util.Thens(now.Add(time.Hour)), later.Jid, laterData))
+
+	batch, err := batched.RemoveBatchBefore(util.Thens(now), 3)
+	assert.NoError(t, err)
+	assert.Equal(t, due[:3], batch)
+	batch, err = batched.RemoveBatchBefore(util.Thens(now), 3)
+	assert.NoError(t, err)
+	assert.Equal(t, due[3:], batch)
+	batch, err = batched.RemoveBatchBefore(util.Thens(now), 3)
+	assert.NoError(t, err)
+	assert.Empty(t, batch)
+	assert.EqualValues(t, 1, retries.Size())
+}
+
+func testPushBulk(t *testing.T, store storage.Store) {
+	_, a := job("a", 5)
+	_, b := job("b", 9)
+	assert.NoError(t, store.PushBulk([]storage.BulkEntry{
+		{Queue: "a", Priority: 5, Data: a},
+		{Queue: "b", Priority: 9, Data: b},
+	}))
+	qa, err := store.GetQueue("a")
+	assert.NoError(t, err)
+	qb, err := store.GetQueue("b")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, qa.Size())
+	assert.EqualValues(t, 1, qb.Size())
+
+	// a is no longer empty
+	_, c := job("b", 5)
+	pushed, err := store.PushIf(storage.PushCondition{EmptyQueue: "a"}, storage.BulkEntry{Queue: "a", Priority: 5, Data: c})
+	assert.NoError(t, err)
+	assert.False(t, pushed)
+	pushed, err = store.PushIf(storage.PushCondition{EmptyQueue: "c"}, storage.BulkEntry{Queue: "a", Priority: 5, Data: c})
+	assert.NoError(t, err)
+	assert.True(t, pushed)
+	assert.EqualValues(t, 2, qa.Size())
+}
+
+func testUniqueLocks(t *testing.T, store storage.Store) {
+	holder, err := store.LockUnique("digest", "a", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, "", holder)
+	holder, err = store.LockUnique("digest", "b", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", holder)
+
+	// only the holder releases the lock
+	assert.NoError(t, store.UnlockUnique("digest", "b"))
+	holder, err = store.LockUnique("digest", "b", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", holder)
+	assert.NoError(t, store.UnlockUnique("digest", "a"))
+	holder, err = store.LockUnique("digest", "b", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, "", holder)
+}
+
+func testBatches(t *testing.T, store storage.Store) {
+	state, err := store.GetBatch("missing")
+	assert.NoError(t, err)
+	assert.Nil(t, state)
+	assert.Error(t, store.AddToBatch("missing", 1))
+
+	assert.NoError(t, store.CreateBatch("b1", []byte("data"), time.Minute))
+	assert.Error(t, store.CreateBatch("b1", []byte("data"), time.Minute))
+	assert.NoError(t, store.AddToBatch("b1", 2))
+	fire, err := store.CommitBatch("b1")
+	assert.NoError(t, err)
+	assert.Empty(t, fire)
+	assert.Error(t, store.AddToBatch("b1", 1))
+
+	fire, err = store.BatchJobDone("b1", "j1", false)
+	assert.NoError(t, err)
+	assert.Empty(t, fire)
+	fire, err = store.BatchJobDone("b1", "j2", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{storage.BatchComplete}, fire)
+
+	// the failed job's retry succeeds
+	fire, err = store.BatchJobDone("b1", "j1", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{storage.BatchSuccess}, fire)
+
+	state, err = store.GetBatch("b1")
+	assert.NoError(t, err)
+	assert.Equal(t, "b1", state.Bid)
+	assert.Equal(t, []byte("data"), state.Data)
+	assert.EqualValues(t, 2, state.Total)
+	assert.EqualValues(t, 0, state.Pending)
+	assert.EqualValues(t, 0, state.Failed)
+	assert.True(t, state.Committed)
+	assert.True(t, state.Completed)
+	assert.True(t, state.Succeeded)
+	assert.Error(t, store.OpenBatch("b1"))
+}
+
+func testDependencies(t *testing.T, store storage.Store) {
+	pending, err := store.HoldJob("child", []byte("child job"), []string{"p1", "p2"}, time.Minute)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, pending)
+	data, err := store.HeldJob("child")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("child job"), data)
+
+	released, err := store.DependencyDone("p1", storage.DependencySucceeded, time.Minute)
+	assert.NoError(t, err)
+	assert.Empty(t, released)
+	released, err = store.DependencyDone("p2", storage.DependencySucceeded, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("child job")}, released)
+	data, err = store.HeldJob("child")
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+
+	// the dependencies have already succeeded
+	pending, err = store.HoldJob("sibling", []byte("sibling job"), []string{"p1", "p2"}, time.Minute)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, pending)
+
+	_, err = store.DependencyDone("p3", storage.DependencyDied, time.Minute)
+	assert.NoError(t, err)
+	pending, err = store.HoldJob("orphan", []byte("orphan job"), []string{"p3"}, time.Minute)
+	assert.NoError(t, err)
+	assert.EqualValues(t, -1, pending)
+
+	pending, err = store.HoldJob("waiting", []byte("waiting job"), []string{"p4"}, time.Minute)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, pending)
+	released, err = store.DependencyDone("p4", storage.DependencyDied, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("waiting job")}, released)
+
+	// a job held past its ttl is left to be removed and killed
+	pending, err = store.HoldJob("stale", []byte("stale job"), []string{"p5"}, 10*time.Millisecond)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, pending)
+	expired, err := store.RemoveExpiredHolds()
+	assert.NoError(t, err)
+	assert.Empty(t, expired)
+	time.Sleep(20 * time.Millisecond)
+	data, err = store.HeldJob("stale")
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+	released, err = store.DependencyDone("p5", storage.DependencySucceeded, time.Minute)
+	assert.NoError(t, err)
+	assert.Empty(t, released)
+	expired, err = store.RemoveExpiredHolds()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("stale job")}, expired)
+	expired, err = store.RemoveExpiredHolds()
+	assert.NoError(t, err)
+	assert.Empty(t, expired)
+}
+
+func testProgressAndResults(t *testing.T, store storage.Store) {
+	assert.NoError(t, store.SetProgress("j1", []byte("50"), time.Minute))
+	progress, err := store.GetProgress("j1", "j2")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("50"), nil}, progress)
+	progress, err = store.GetProgress()
+	assert.NoError(t, err)
+	assert.Empty(t, progress)
+
+	assert.NoError(t, store.SetResult("j1", []byte("42"), time.Minute))
+	result, err := store.GetResult("j1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("42"), result)
+	result, err = store.GetResult("j2")
+	assert.NoError(t, err)
+	assert.Nil(t, result)
+}
+
+func testHistory(t *testing.T, store storage.Store) {
+	assert.NoError(t, store.Success())
+	assert.NoError(t, store.Failure())
+	assert.EqualValues(t, 2, store.TotalProcessed())
+	assert.EqualValues(t, 1, store.TotalFailures())
+
+	days := 0
+	var processed, failed uint64
+	assert.NoError(t, store.History(3, func(day string, procCnt uint64, failCnt uint64) {
+		days++
+		processed += procCnt
+		failed += failCnt
+	}))
+	assert.Equal(t, 3, days)
+	assert.EqualValues(t, 2, processed)
+	assert.EqualValues(t, 1, failed)
+
+	assert.NoError(t, store.SetTotals(100, 7))
+	assert.EqualValues(t, 100, store.TotalProcessed())
+	assert.EqualValues(t, 7, store.TotalFailures())
+	yesterday := time.Now().Add(-24 * time.Hour).Format("2006-01-02")
+	assert.NoError(t, store.SetHistory(yesterday, 40, 3))
+	counts := map[string][2]uint64{}
+	assert.NoError(t, store.History(2, func(day string, procCnt uint64, failCnt uint64) {
+		counts[day] = [2]uint64{procCnt, failCnt}
+	}))
+	assert.Equal(t, [2]uint64{40, 3}, counts[yesterday])
+	assert.Equal(t, [2]uint64{2, 1}, counts[time.Now().Format("2006-01-02")])
+}
+
+func testRaw(t *testing.T, store storage.Store) {
+	kv := store.Raw()
+	val, err := kv.Get("mike")
+	assert.NoError(t, err)
+	assert.Nil(t, val)
+	assert.Error(t, kv.Set("mike", nil))
+	assert.NoError(t, kv.Set("mike", []byte("bob")))
+	val, err = kv.Get("mike")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bob"), val)
+
+	ok, err := kv.SetNX("mike", []byte("alice"), time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = kv.SetNX("jane", []byte("alice"), time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
@@ -2,7 +2,6 @@ package storage
 
 import (
 	"context"
-	"fmt"
 	"time"
 
 	"github.com/contribsys/faktory/client"
@@ -16,6 +15,19 @@ type BackupInfo struct {
 	Timestamp int64
 }
 
+// Store is where the server keeps everything: queues, the sorted sets
+// of scheduled, retrying, dead and working jobs and the state of
+// features like batches and unique locks.  A Driver's store must:
+//
+//   - be safe to call from many goroutines at once
+//   - keep its data across Close and a fresh Open of the same path
+//   - report missing data as nil, and no error, where documented below
+//   - do what's documented as atomic or a single transaction
+//     atomically, since several servers may share a store
+//
+// Jobs are their JSON, as client.Job marshals, and the store may
+// decode them to find a jid or priority.  storagetest.TestStore checks
+// this contract.
 type Store interface {
 	Close() error
 	Retries() SortedSet
@@ -24,15 +36,78 @@ type Store interface {
 	Dead() SortedSet
 	GetQueue(string) (Queue, error)
 	EachQueue(func(Queue))
+
+	// Delete the queue, its jobs and settings such as pausing.
+	// Returns the number of jobs deleted.
+	RemoveQueue(string) (uint64, error)
 	Stats() map[string]string
 	EnqueueAll(SortedSet) error
 	EnqueueFrom(SortedSet, []byte) error
 
+	// Push a batch of payloads onto their queues in a single
+	// transaction: either every entry is enqueued or none are.  A
+	// Redis Cluster or a Sharded store only runs it as one
+	// transaction per hash slot or shard, see RedisOptions.Cluster.
+	PushBulk([]BulkEntry) error
+
+	// Push the entry only if the condition holds, evaluated
+	// atomically with the push.  Returns false if skipped.
+	PushIf(PushCondition, BulkEntry) (bool, error)
+
+	// Take the unique lock for a job digest on behalf of jid, for
+	// ttl, unless another job holds it.  Returns the jid holding
+	// the lock, "" if jid took it.
+	LockUnique(digest string, jid string, ttl time.Duration) (string, error)
+	// Release the lock if jid still holds it.
+	UnlockUnique(digest string, jid string) error
+
+	// Batches group jobs so callbacks can be pushed once they've
+	// run.  A batch expires ttl after it's created.  Jobs can only
+	// be added while it's open, i.e. not committed.
+	CreateBatch(bid string, data []byte, ttl time.Duration) error
+	GetBatch(bid string) (*BatchState, error)
+	AddToBatch(bid string, count int) error
+	OpenBatch(bid string) error
+	// Record a batch job's success or failure and commit a batch.
+	// Both return the callbacks which are now due, if any.
+	BatchJobDone(bid string, jid string, succeeded bool) ([]string, error)
+	CommitBatch(bid string) ([]string, error)
+
+	// Hold a job until the jobs it depends on succeed.  Returns how
+	// many are still to finish, 0 if none so it isn't held, or -1 if
+	// one of them died.  DependencyDone records how a job finished,
+	// DependencySucceeded or DependencyDied, for ttl and returns the
+	// data of the held jobs it releases: those with nothing left to
+	// wait for or, if it died, every job waiting on it.
+	HoldJob(jid string, data []byte, deps []string, ttl time.Duration) (int64, error)
+	DependencyDone(jid string, state string, ttl time.Duration) ([][]byte, error)
+	// The data of a held job, nil if it isn't held.
+	HeldJob(jid string) ([]byte, error)
+	// Remove the jobs held for longer than their ttl and return
+	// their data so they can be killed rather than lost.  Holds
+	// which are never removed are deleted HeldJobGrace after they
+	// expire.
+	RemoveExpiredHolds() ([][]byte, error)
+
+	// Progress reported by a job's worker, kept for ttl after the
+	// last update.  GetProgress returns nil for jobs without any.
+	SetProgress(jid string, data []byte, ttl time.Duration) error
+	GetProgress(jids ...string) ([][]byte, error)
+
+	// The result a job returned when it was acknowledged, kept for
+	// ttl.  GetResult returns nil if there's none.
+	SetResult(jid string, data []byte, ttl time.Duration) error
+	GetResult(jid string) ([]byte, error)
+
 	History(days int, fn func(day string, procCnt uint64, failCnt uint64)) error
 	Success() error
 	Failure() error
 	TotalProcessed() uint64
 	TotalFailures() uint64
+	// Overwrite the totals and a day's counts, as when restoring a
+	// backup, see Snapshot.
+	SetTotals(processed uint64, failures uint64) error
+	SetHistory(day string, procCnt uint64, failCnt uint64) error
 
 	// Clear the database of all job data.
 	// Equivalent to Redis's FLUSHDB
@@ -42,9 +117,41 @@ type Store interface {
 }
 
 type Redis interface {
-	Redis() *redis.Client
+	Redis() redis.UniversalClient
 }
 
+// Sharded is implemented by a store which spreads its queues across
+// several stores, such as the redis_sharded driver's.
+type Sharded interface {
+	Shards() []Shard
+}
+
+// A Shard is one of a Sharded store's stores and its name, e.g. the
+// Redis URL without its password.
+type Shard struct {
+	Name  string
+	Store Store
+}
+
+// BulkEntry is a single payload destined for the named queue,
+// see Store.PushBulk.
+type BulkEntry struct {
+	Queue    string
+	Priority uint8
+	Data     []byte
+}
+
+// PushCondition is checked by Store.PushIf, every
+// non-blank condition must hold for the push to happen.
+type PushCondition struct {
+	// Skip unless this queue is empty.
+	EmptyQueue string
+}
+
+// Queue is a named queue of jobs.  Pop returns nil, and no error,
+// from an empty queue while BPop waits a couple of seconds, or until
+// the context is done, for a job to be pushed.  Higher priority jobs
+// pop first and, within a priority, in the queue's ordering.
 type Queue interface {
 	Name() string
 	Size() uint64
@@ -54,12 +161,46 @@ type Queue interface {
 
 	Pop() ([]byte, error)
 	BPop(context.Context) ([]byte, error)
+
+	// Return up to count jobs in the order Pop would return them,
+	// without removing them.
+	Peek(count int) ([][]byte, error)
+
+	// The job which was pushed longest ago, nil if the queue
+	// is empty.
+	Oldest() ([]byte, error)
+
+	// The name of the registered Comparator which decides the
+	// order Pop returns jobs, FIFO by default.
+	Ordering() string
+	SetOrdering(name string) error
+
+	// A paused queue still accepts jobs but FETCH skips it.  The
+	// state is kept in Redis so it survives a restart.
+	Pause() error
+	Resume() error
+	IsPaused() bool
+
+	// Delete every job in the queue, returning how many.
 	Clear() (uint64, error)
 
 	Each(func(index int, data []byte) error) error
 	Page(start int64, count int64, fn func(index int, data []byte) error) error
 
 	Delete(keys [][]byte) error
+	// Find or remove the job with this jid, returning its data or
+	// nil if it isn't in the queue.
+	FindJid(jid string) ([]byte, error)
+	RemoveJid(jid string) ([]byte, error)
+}
+
+// A ReservingQueue can pop its next job and add it to a SortedSet in
+// a single step, so a crash can't lose a job between the two.  The
+// set's element is the job wrapped in prefix and suffix, the manager
+// uses it to put a fetched job straight into the working set.  PopTo
+// returns nil, and adds nothing, if the queue is empty.
+type ReservingQueue interface {
+	PopTo(sset SortedSet, timestamp string, prefix []byte, suffix []byte) ([]byte, error)
 }
 
 type SortedEntry interface {
@@ -68,6 +209,9 @@ type SortedEntry interface {
 	Job() (*client.Job, error)
 }
 
+// SortedSet holds jobs by timestamp, util.Thens format, and jid,
+// which together make an entry's key.  Page and Each go from the
+// earliest timestamp.
 type SortedSet interface {
 	Name() string
 	Size() uint64
@@ -86,6 +230,13 @@ type SortedSet interface {
 	Remove(key []byte) (bool, error)
 	RemoveElement(timestamp string, jid string) (bool, error)
 	RemoveBefore(timestamp string) ([][]byte, error)
+	// Remove the lowest scored elements so no more than max remain,
+	// returning how many were removed.
+	Trim(max uint64) (int64, error)
+	// Find or remove the job with this jid, whatever its timestamp,
+	// returning its data or nil if it isn't in the set.
+	FindJid(jid string) ([]byte, error)
+	RemoveJid(jid string) ([]byte, error)
 
 	// Move the given key from this SortedSet to the given
 	// SortedSet atomically.  The given func may mutate the payload and
@@ -93,10 +244,9 @@ type SortedSet interface {
 	MoveTo(sset SortedSet, entry SortedEntry, newtime time.Time) error
 }
 
-func Open(dbtype string, path string) (Store, error) {
-	if dbtype == "redis" {
-		return OpenRedis(path)
-	} else {
-		return nil, fmt.Errorf("Invalid dbtype: %s", dbtype)
-	}
+// A BatchedSet can remove the elements before a timestamp a batch at
+// a time, earliest first, so the scheduler needn't load a large
+// backlog of due jobs at once.  Returns no more than count elements.
+type BatchedSet interface {
+	RemoveBatchBefore(timestamp string, count int) ([][]byte, error)
 }
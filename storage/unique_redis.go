@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const uniqueKeyPrefix = "faktory:unique:"
+
+// KEYS: the lock.  ARGV: the jid taking it and its TTL in
+// milliseconds.  Returns the jid holding the lock, "" if taken.
+var lockUniqueScript = redis.NewScript(`
+if redis.call("set", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+  return ""
+end
+return redis.call("get", KEYS[1])
+`)
+
+// KEYS: the lock.  ARGV: the jid which should hold it.
+var unlockUniqueScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+  return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+func (store *redisStore) LockUnique(digest string, jid string, ttl time.Duration) (string, error) {
+	ms := int64(ttl / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	return lockUniqueScript.Run(store.rclient, []string{store.key(uniqueKeyPrefix + digest)}, jid, ms).String()
+}
+
+func (store *redisStore) UnlockUnique(digest string, jid string) error {
+	return unlockUniqueScript.Run(store.rclient, []string{store.key(uniqueKeyPrefix + digest)}, jid).Err()
+}
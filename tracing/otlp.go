@@ -0,0 +1,223 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/util"
+)
+
+const (
+	// Spans waiting to be sent.  If the collector can't keep up any
+	// more are dropped rather than hold up jobs.
+	queueSize = 4096
+	// The most spans in one request.
+	batchSize     = 512
+	flushInterval = 5 * time.Second
+	exportTimeout = 10 * time.Second
+)
+
+// Sends spans in batches to an OTLP/HTTP collector as JSON.
+type exporter struct {
+	opts   Options
+	client *http.Client
+	spans  chan *span
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func newExporter(opts Options) *exporter {
+	e := &exporter{
+		opts:   opts,
+		client: &http.Client{Timeout: exportTimeout},
+		spans:  make(chan *span, queueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *exporter) export(sp *span) {
+	select {
+	case e.spans <- sp:
+	default:
+		util.Debugf("Dropping span %s, %s can't keep up", sp.name, e.opts.Endpoint)
+	}
+}
+
+// Stop the exporter once the spans already exported are sent.
+func (e *exporter) close() {
+	close(e.stop)
+	<-e.done
+}
+
+func (e *exporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*span, 0, batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := e.send(batch)
+		if err != nil {
+			util.Warnf("Unable to send %d spans to %s: %v", len(batch), e.opts.Endpoint, err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case sp := <-e.spans:
+			batch = append(batch, sp)
+			if len(batch) == batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.stop:
+			for {
+				select {
+				case sp := <-e.spans:
+					batch = append(batch, sp)
+					if len(batch) == batchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *exporter) send(spans []*span) error {
+	data, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.opts.Endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s replied %s", e.opts.Endpoint, resp.Status)
+	}
+	return nil
+}
+
+/*
+ * The OTLP JSON encoding of an ExportTraceServiceRequest, see
+ * https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding.
+ * IDs are hex and 64-bit integers are strings.
+ */
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId"`
+	TraceState        string          `json:"traceState,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	spanKindServer  = 2
+	statusCodeError = 2
+)
+
+func (e *exporter) request(spans []*span) *otlpRequest {
+	out := make([]otlpSpan, len(spans))
+	for idx, sp := range spans {
+		out[idx] = otlpSpan{
+			TraceID:           sp.traceID,
+			SpanID:            sp.spanID,
+			ParentSpanID:      sp.parentID,
+			TraceState:        sp.traceState,
+			Name:              sp.name,
+			Kind:              spanKindServer,
+			StartTimeUnixNano: strconv.FormatInt(sp.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(sp.end.UnixNano(), 10),
+			Attributes:        attributes(sp.attributes),
+		}
+		if sp.err != nil {
+			out[idx].Status = otlpStatus{Code: statusCodeError, Message: sp.err.Error()}
+		}
+	}
+
+	return &otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: attributes(map[string]string{"service.name": e.opts.ServiceName}),
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "faktory", Version: client.Version},
+				Spans: out,
+			}},
+		}},
+	}
+}
+
+func attributes(attrs map[string]string) []otlpAttribute {
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	out := make([]otlpAttribute, len(keys))
+	for idx, key := range keys {
+		out[idx] = otlpAttribute{Key: key, Value: otlpValue{StringValue: attrs[key]}}
+	}
+	return out
+}
@@ -0,0 +1,246 @@
+package tracing
+
+import (
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	mathrand "math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/contribsys/faktory/manager"
+	"github.com/contribsys/faktory/server"
+	"github.com/contribsys/faktory/util"
+)
+
+/*
+ * The tracing subsystem continues a client's OpenTelemetry trace
+ * through the server.  A job whose custom hash holds a W3C
+ * traceparent, and optionally tracestate, gets a server span when it
+ * is enqueued, scheduled, fetched and acknowledged, each a child of
+ * the traceparent.  The custom hash is kept through retries so they
+ * stay in the same trace.  Spans are sent to an OTLP/HTTP collector,
+ * tracing is disabled unless the config gives one:
+ *
+ *	[tracing]
+ *	endpoint = "http://localhost:4318/v1/traces"
+ *	service_name = "faktory"
+ *
+ * Jobs whose traceparent isn't sampled get no spans.
+ */
+type Lifecycle struct {
+	mu       sync.RWMutex
+	opts     Options
+	exporter *exporter
+}
+
+func Subsystem() *Lifecycle {
+	return &Lifecycle{}
+}
+
+type Options struct {
+	Endpoint    string
+	ServiceName string
+}
+
+func (l *Lifecycle) options(s *server.Server) Options {
+	return Options{
+		Endpoint:    s.CurrentOptions().String("tracing", "endpoint", ""),
+		ServiceName: s.CurrentOptions().String("tracing", "service_name", "faktory"),
+	}
+}
+
+func (l *Lifecycle) Name() string {
+	return "tracing"
+}
+
+func (l *Lifecycle) Start(s *server.Server) error {
+	// the middleware can't be removed so it does nothing while
+	// tracing is disabled
+	mgr := s.Manager()
+	mgr.AddMiddleware(manager.MiddlewarePush, l.traced("enqueue"))
+	mgr.AddMiddleware(manager.MiddlewareSchedule, l.traced("schedule"))
+	mgr.AddMiddleware(manager.MiddlewareFetch, l.traced("fetch"))
+	mgr.AddMiddleware(manager.MiddlewareAck, l.traced("ack"))
+	l.configure(l.options(s))
+	return nil
+}
+
+func (l *Lifecycle) Reload(s *server.Server) error {
+	opts := l.options(s)
+	l.mu.RLock()
+	same := opts == l.opts
+	l.mu.RUnlock()
+	if same {
+		return nil
+	}
+	util.Infof("Reloading tracing")
+	l.configure(opts)
+	return nil
+}
+
+func (l *Lifecycle) Stop(s *server.Server) error {
+	l.configure(Options{})
+	return nil
+}
+
+// Replace the exporter, flushing the old one's spans.
+func (l *Lifecycle) configure(opts Options) {
+	var exp *exporter
+	if opts.Endpoint != "" {
+		exp = newExporter(opts)
+		util.Infof("Sending traces to %s", opts.Endpoint)
+	}
+
+	l.mu.Lock()
+	old := l.exporter
+	l.opts = opts
+	l.exporter = exp
+	l.mu.Unlock()
+
+	if old != nil {
+		util.Debug("Stopping tracing")
+		old.close()
+	}
+}
+
+func (l *Lifecycle) current() *exporter {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.exporter
+}
+
+// Middleware which records a span for op around the rest of the
+// chain.
+func (l *Lifecycle) traced(op string) manager.MiddlewareFunc {
+	return func(next func() error, job *client.Job) error {
+		exp := l.current()
+		if exp == nil {
+			return next()
+		}
+		parent, ok := parentOf(job)
+		if !ok || !parent.sampled {
+			return next()
+		}
+
+		start := time.Now()
+		err := next()
+		exp.export(newSpan(op, parent, job, start, time.Now(), err))
+		return err
+	}
+}
+
+// The trace context a client sent with a job.
+type traceContext struct {
+	traceID  string
+	parentID string
+	sampled  bool
+	state    string
+}
+
+func parentOf(job *client.Job) (traceContext, bool) {
+	val, ok := job.GetCustom("traceparent")
+	if !ok {
+		return traceContext{}, false
+	}
+	header, ok := val.(string)
+	if !ok {
+		return traceContext{}, false
+	}
+	tc, ok := parseTraceparent(header)
+	if !ok {
+		return tc, false
+	}
+	if state, ok := job.GetCustom("tracestate"); ok {
+		tc.state, _ = state.(string)
+	}
+	return tc, true
+}
+
+// Parse a W3C traceparent, e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+// Unknown future versions may append fields, which are ignored.
+func parseTraceparent(header string) (traceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 {
+		return traceContext{}, false
+	}
+	version, traceID, parentID, flags := parts[0], parts[1], parts[2], parts[3]
+	if !isHex(version, 2) || version == "ff" || (version == "00" && len(parts) != 4) {
+		return traceContext{}, false
+	}
+	if !isHex(traceID, 32) || traceID == strings.Repeat("0", 32) {
+		return traceContext{}, false
+	}
+	if !isHex(parentID, 16) || parentID == strings.Repeat("0", 16) {
+		return traceContext{}, false
+	}
+	if !isHex(flags, 2) {
+		return traceContext{}, false
+	}
+	bits, _ := hex.DecodeString(flags)
+	return traceContext{
+		traceID:  traceID,
+		parentID: parentID,
+		sampled:  bits[0]&1 == 1,
+	}, true
+}
+
+// Is s n lowercase hex digits?
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+type span struct {
+	name       string
+	traceID    string
+	spanID     string
+	parentID   string
+	traceState string
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	err        error
+}
+
+func newSpan(op string, parent traceContext, job *client.Job, start time.Time, end time.Time, err error) *span {
+	attrs := map[string]string{
+		"messaging.system":           "faktory",
+		"messaging.operation":        op,
+		"messaging.destination.name": job.Queue,
+		"messaging.message.id":       job.Jid,
+		"faktory.jobtype":            job.Type,
+	}
+	if job.Bid != "" {
+		attrs["faktory.bid"] = job.Bid
+	}
+	return &span{
+		name:       "faktory " + op,
+		traceID:    parent.traceID,
+		spanID:     newSpanID(),
+		parentID:   parent.parentID,
+		traceState: parent.state,
+		start:      start,
+		end:        end,
+		attributes: attrs,
+		err:        err,
+	}
+}
+
+func newSpanID() string {
+	bytes := make([]byte, 8)
+	_, err := cryptorand.Read(bytes)
+	if err != nil {
+		mathrand.Read(bytes)
+	}
+	return hex.EncodeToString(bytes)
+}
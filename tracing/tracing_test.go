@@ -0,0 +1,112 @@
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/contribsys/faktory/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tc, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", tc.traceID)
+	assert.Equal(t, "00f067aa0ba902b7", tc.parentID)
+	assert.True(t, tc.sampled)
+
+	tc, ok = parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assert.True(t, ok)
+	assert.False(t, tc.sampled)
+
+	_, ok = parseTraceparent("cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-what-the-future")
+	assert.True(t, ok)
+
+	for _, header := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+	} {
+		_, ok := parseTraceparent(header)
+		assert.False(t, ok, header)
+	}
+}
+
+func TestTraced(t *testing.T) {
+	requests := make(chan otlpRequest, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		assert.NoError(t, err)
+		requests <- req
+	}))
+	defer ts.Close()
+
+	l := Subsystem()
+	enqueue := l.traced("enqueue")
+	ack := l.traced("ack")
+
+	job := client.NewJob("Traced", 1)
+	job.SetCustom("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	job.SetCustom("tracestate", "vendor=value")
+	untraced := client.NewJob("Untraced", 1)
+	unsampled := client.NewJob("Unsampled", 1)
+	unsampled.SetCustom("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+
+	called := 0
+	next := func() error {
+		called++
+		return nil
+	}
+	// disabled
+	assert.NoError(t, enqueue(next, job))
+	assert.Equal(t, 1, called)
+
+	l.configure(Options{Endpoint: ts.URL, ServiceName: "faktory"})
+	assert.NoError(t, enqueue(next, job))
+	assert.NoError(t, enqueue(next, untraced))
+	assert.NoError(t, enqueue(next, unsampled))
+	oops := errors.New("oops")
+	err := ack(func() error { return oops }, job)
+	assert.Equal(t, oops, err)
+	assert.Equal(t, 4, called)
+	l.configure(Options{})
+
+	req := <-requests
+	assert.Len(t, requests, 0)
+	assert.Len(t, req.ResourceSpans, 1)
+	rs := req.ResourceSpans[0]
+	assert.Equal(t, "service.name", rs.Resource.Attributes[0].Key)
+	assert.Equal(t, "faktory", rs.Resource.Attributes[0].Value.StringValue)
+	spans := rs.ScopeSpans[0].Spans
+	assert.Len(t, spans, 2)
+
+	sp := spans[0]
+	assert.Equal(t, "faktory enqueue", sp.Name)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sp.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", sp.ParentSpanID)
+	assert.Len(t, sp.SpanID, 16)
+	assert.Equal(t, "vendor=value", sp.TraceState)
+	assert.Equal(t, 0, sp.Status.Code)
+	attrs := map[string]string{}
+	for _, attr := range sp.Attributes {
+		attrs[attr.Key] = attr.Value.StringValue
+	}
+	assert.Equal(t, job.Jid, attrs["messaging.message.id"])
+	assert.Equal(t, "default", attrs["messaging.destination.name"])
+	assert.Equal(t, "Traced", attrs["faktory.jobtype"])
+
+	sp = spans[1]
+	assert.Equal(t, "faktory ack", sp.Name)
+	assert.NotEqual(t, spans[0].SpanID, sp.SpanID)
+	assert.Equal(t, statusCodeError, sp.Status.Code)
+	assert.Equal(t, "oops", sp.Status.Message)
+}
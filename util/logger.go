@@ -1,6 +1,7 @@
 package util
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -36,10 +37,21 @@ var Strings = [...]string{
 	alog.FatalLevel: "F",
 }
 
+// Lowercase names for the JSON "level" field.
+var levelNames = [...]string{
+	alog.DebugLevel: "debug",
+	alog.InfoLevel:  "info",
+	alog.WarnLevel:  "warn",
+	alog.ErrorLevel: "error",
+	alog.FatalLevel: "fatal",
+}
+
 type LogHandler struct {
 	mu     sync.Mutex
 	writer io.Writer
 	tty    bool
+	// write a JSON object per line, see SetLogFormat
+	json bool
 }
 
 const (
@@ -47,10 +59,13 @@ const (
 )
 
 func (h *LogHandler) HandleLog(e *alog.Entry) error {
+	ts := time.Now().UTC().Format(TimeFormat)
+	if h.json {
+		return h.handleJSON(e, ts)
+	}
 	color := Colors[e.Level]
 	level := Strings[e.Level]
 	names := e.Fields.Names()
-	ts := time.Now().UTC().Format(TimeFormat)
 
 	h.mu.Lock()
 	defer h.mu.Unlock()
@@ -69,8 +84,83 @@ func (h *LogHandler) HandleLog(e *alog.Entry) error {
 	return nil
 }
 
+// Each line is an object with the level, ts and msg plus the entry's
+// fields, e.g. wid, jid and queue.
+func (h *LogHandler) handleJSON(e *alog.Entry, ts string) error {
+	obj := make(map[string]interface{}, len(e.Fields)+3)
+	for name, val := range e.Fields {
+		switch v := val.(type) {
+		case error:
+			obj[name] = v.Error()
+		case fmt.Stringer:
+			obj[name] = v.String()
+		default:
+			obj[name] = val
+		}
+	}
+	obj["level"] = levelNames[e.Level]
+	obj["ts"] = ts
+	obj["msg"] = e.Message
+
+	line, err := json.Marshal(obj)
+	if err != nil {
+		// a field which can't be marshalled shouldn't lose the message
+		for name, val := range e.Fields {
+			obj[name] = fmt.Sprintf("%v", val)
+		}
+		line, err = json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err = fmt.Fprintf(h.writer, "%s\n", line)
+	return err
+}
+
+// Structured debug logging, each field is output as key=value:
+//
+//	util.Debugw("fetched", map[string]interface{}{"jid": jid})
+func Debugw(msg string, fields map[string]interface{}) {
+	if LogDebug {
+		logg.WithFields(alog.Fields(fields)).Debug(msg)
+	}
+}
+
+// Structured info logging, see Debugw.
+func Infow(msg string, fields map[string]interface{}) {
+	logg.WithFields(alog.Fields(fields)).Info(msg)
+}
+
+// Structured warn logging, see Debugw.
+func Warnw(msg string, fields map[string]interface{}) {
+	logg.WithFields(alog.Fields(fields)).Warn(msg)
+}
+
+// "text" or "json", see SetLogFormat
+var logFormat = "text"
+
+// SetLogFormat chooses how log lines are written: "text" for people
+// or "json", a JSON object per line, for log pipelines.  Call it
+// before InitLogger.
+func SetLogFormat(format string) error {
+	switch format {
+	case "text", "json":
+		logFormat = format
+		return nil
+	default:
+		return fmt.Errorf("Invalid log format %q, expected text or json", format)
+	}
+}
+
 func NewLogger(level string, production bool) Logger {
-	alog.SetHandler(&LogHandler{writer: os.Stdout, tty: isTTY(int(os.Stdout.Fd()))})
+	alog.SetHandler(&LogHandler{
+		writer: os.Stdout,
+		tty:    isTTY(int(os.Stdout.Fd())),
+		json:   logFormat == "json",
+	})
 	alog.SetLevelFromString(level)
 	return alog.Log
 }
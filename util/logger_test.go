@@ -0,0 +1,43 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	alog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &alog.Logger{Handler: &LogHandler{writer: &buf}, Level: alog.DebugLevel}
+
+	logger.WithFields(alog.Fields{"jid": "abc123", "queue": "default"}).Info("fetched")
+	assert.Regexp(t, `^I \S+ jid=abc123 queue=default fetched\n$`, buf.String())
+
+	buf.Reset()
+	logger.Handler = &LogHandler{writer: &buf, json: true}
+	logger.WithFields(alog.Fields{"jid": "abc123", "wid": "worker1", "queue": "default"}).
+		WithError(errors.New("boom")).Warn("Unable to forward dead job")
+
+	var line map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "warn", line["level"])
+	assert.Equal(t, "Unable to forward dead job", line["msg"])
+	assert.Equal(t, "abc123", line["jid"])
+	assert.Equal(t, "worker1", line["wid"])
+	assert.Equal(t, "default", line["queue"])
+	assert.Equal(t, "boom", line["error"])
+	assert.NotEmpty(t, line["ts"])
+
+	buf.Reset()
+	logger.WithField("fn", func() {}).Info("unmarshallable")
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "unmarshallable", line["msg"])
+
+	assert.NoError(t, SetLogFormat("json"))
+	assert.Error(t, SetLogFormat("xml"))
+	assert.NoError(t, SetLogFormat("text"))
+}
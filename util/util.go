@@ -3,9 +3,13 @@ package util
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	cryptorand "crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
 	mathrand "math/rand"
 	"os"
 	"runtime"
@@ -108,6 +112,40 @@ func Debugf(msg string, args ...interface{}) {
 	}
 }
 
+func Gzip(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// The most Gunzip inflates data to, so a small payload can't use up
+// the memory of whoever unzips it.
+var MaxGunzipSize int64 = 256 * 1024 * 1024
+
+func Gunzip(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(zr, MaxGunzipSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > MaxGunzipSize {
+		return nil, fmt.Errorf("gzip data inflates to more than %d bytes", MaxGunzipSize)
+	}
+	return out, nil
+}
+
 func RandomJid() string {
 	bytes := make([]byte, 12)
 	_, err := cryptorand.Read(bytes)
@@ -118,6 +156,19 @@ func RandomJid() string {
 	return base64.RawURLEncoding.EncodeToString(bytes)
 }
 
+// RandomNonce returns 128 random bits, hex-encoded, for use as a
+// single-use authentication nonce.  Unlike RandomJid there's no
+// fallback when crypto/rand fails, a guessable nonce is no nonce.
+func RandomNonce() (string, error) {
+	bytes := make([]byte, 16)
+	_, err := cryptorand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(bytes), nil
+}
+
 const (
 	// This is the canonical timestamp format used by Faktory.
 	// Always UTC, lexigraphically sortable.  This is the best
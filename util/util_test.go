@@ -36,3 +36,33 @@ func TestBacktrace(t *testing.T) {
 	//fmt.Println(str)
 	//}
 }
+
+func TestRandomNonce(t *testing.T) {
+	nonce, err := RandomNonce()
+	assert.NoError(t, err)
+	assert.Len(t, nonce, 32)
+
+	other, err := RandomNonce()
+	assert.NoError(t, err)
+	assert.NotEqual(t, nonce, other)
+}
+
+func TestGzip(t *testing.T) {
+	data := []byte("hello hello hello hello hello hello")
+	zipped, err := Gzip(data)
+	assert.NoError(t, err)
+	assert.NotEqual(t, data, zipped)
+
+	unzipped, err := Gunzip(zipped)
+	assert.NoError(t, err)
+	assert.Equal(t, data, unzipped)
+
+	_, err = Gunzip(data)
+	assert.Error(t, err)
+
+	oldMax := MaxGunzipSize
+	MaxGunzipSize = int64(len(data)) - 1
+	defer func() { MaxGunzipSize = oldMax }()
+	_, err = Gunzip(zipped)
+	assert.Error(t, err)
+}
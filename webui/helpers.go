@@ -166,20 +166,33 @@ func setJobs(set storage.SortedSet, count, currentPage uint64, fn func(idx int,
 	}
 }
 
-func busyReservations(req *http.Request, fn func(worker *manager.Reservation)) {
+func busyReservations(req *http.Request, fn func(worker *manager.Reservation, progress *manager.Progress)) {
+	var reservations []*manager.Reservation
 	err := ctx(req).Store().Working().Each(func(idx int, entry storage.SortedEntry) error {
 		var res manager.Reservation
 		err := json.Unmarshal(entry.Value(), &res)
 		if err != nil {
 			util.Error("Cannot unmarshal reservation", err)
 		} else {
-			fn(&res)
+			reservations = append(reservations, &res)
 		}
 		return err
 	})
 	if err != nil {
 		util.Error("Error iterating reservations", err)
 	}
+
+	jids := make([]string, len(reservations))
+	for idx, res := range reservations {
+		jids[idx] = res.Job.Jid
+	}
+	progress, err := ctx(req).Server().Manager().GetProgress(jids...)
+	if err != nil {
+		util.Error("Error fetching job progress", err)
+	}
+	for _, res := range reservations {
+		fn(res, progress[res.Job.Jid])
+	}
 }
 
 func busyWorkers(req *http.Request, fn func(proc *server.ClientData)) {
@@ -188,7 +201,26 @@ func busyWorkers(req *http.Request, fn func(proc *server.ClientData)) {
 	}
 }
 
+// Record a change made through the Web UI in the audit log.
+func audit(req *http.Request, action string, fields map[string]interface{}) {
+	fields["addr"] = req.RemoteAddr
+	fields["via"] = "webui"
+	ctx(req).Server().Audit(action, fields)
+}
+
 func actOn(req *http.Request, set storage.SortedSet, action string, keys []string) error {
+	err := act(req, set, action, keys)
+	if err == nil {
+		fields := map[string]interface{}{"set": set.Name(), "keys": keys}
+		if len(keys) == 1 && keys[0] == "all" {
+			fields = map[string]interface{}{"set": set.Name(), "all": true}
+		}
+		audit(req, "jobs "+action, fields)
+	}
+	return err
+}
+
+func act(req *http.Request, set storage.SortedSet, action string, keys []string) error {
 	switch action {
 	case "delete":
 		if len(keys) == 1 && keys[0] == "all" {
@@ -239,12 +271,21 @@ func actOn(req *http.Request, set storage.SortedSet, action string, keys []strin
 	}
 }
 
+// The job's args as workers see them, see server.DecodedJob.
+func displayArgs(job *client.Job) []interface{} {
+	return server.DecodedJob(job).Args
+}
+
 func uptimeInDays(req *http.Request) string {
 	return fmt.Sprintf("%.0f", time.Since(ctx(req).Server().Stats.StartedAt).Seconds()/float64(86400))
 }
 
 func redis_info(req *http.Request) string {
-	client := ctx(req).Store().(storage.Redis)
+	client, ok := ctx(req).Store().(storage.Redis)
+	if !ok {
+		// another storage driver
+		return ctx(req).Store().Stats()["stats"]
+	}
 	val, err := client.Redis().Info().Result()
 	if err != nil {
 		return fmt.Sprintf("%v", err)
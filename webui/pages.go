@@ -78,13 +78,15 @@ func queueHandler(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			audit(r, "queue delete", map[string]interface{}{"queue": q.Name(), "jobs": len(bkeys)})
 		} else {
 			// clear entire queue
-			_, err := q.Clear()
+			count, err := q.Clear()
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			audit(r, "queue clear", map[string]interface{}{"queue": q.Name(), "jobs": count})
 			http.Redirect(w, r, "/queues", http.StatusFound)
 			return
 		}
@@ -302,7 +304,16 @@ func busyHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
 		wid := r.FormValue("wid")
 		action := r.FormValue("signal")
-		if wid != "" {
+		if wid != "" && wid != "all" && action == "kill" {
+			count, err := ctx(r).Server().KillWorker(wid)
+			if count > 0 {
+				audit(r, "client kill", map[string]interface{}{"target_wid": wid, "connections": count})
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else if wid != "" {
 			var signal server.WorkerState
 			if action == "quiet" {
 				signal = server.Quiet
@@ -313,9 +324,10 @@ func busyHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			for _, client := range ctx(r).Server().Heartbeats() {
+			s := ctx(r).Server()
+			for _, client := range s.Heartbeats() {
 				if wid == "all" || wid == client.Wid {
-					client.Signal(signal)
+					s.SignalWorker(client, signal)
 				}
 			}
 		}
@@ -120,13 +120,13 @@ func (l *Lifecycle) opts(s *server.Server) Options {
 	opts := defaultOptions()
 	opts.Binding = l.defaultBinding
 	if opts.Binding == "localhost:7420" {
-		opts.Binding = s.Options.String("web", "binding", "localhost:7420")
+		opts.Binding = s.CurrentOptions().String("web", "binding", "localhost:7420")
 	}
 	// Allow the Web UI to have a different password from the command port
 	// so you can rotate user-used passwords and machine-used passwords separately
-	pwd := s.Options.String("web", "password", "")
+	pwd := s.CurrentOptions().String("web", "password", "")
 	if pwd == "" {
-		pwd = s.Options.Password
+		pwd = s.CurrentOptions().Password
 	}
 	opts.Password = pwd
 	return opts
@@ -162,7 +162,11 @@ func (l *Lifecycle) Reload(s *server.Server) error {
 	return nil
 }
 
-func (l *Lifecycle) Shutdown(s *server.Server) error {
+func (l *Lifecycle) Name() string {
+	return "webui"
+}
+
+func (l *Lifecycle) Stop(s *server.Server) error {
 	if l.closer != nil {
 		util.Debug("Stopping WebUI")
 		l.closer()